@@ -0,0 +1,218 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package goauth
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// RevokeOtherSessions revokes all sessions of the user except the session
+// with keepKey (see RevokeEntriesForUser). If keepKey is "" all sessions are
+// revoked. If the SessionHandler doesn't implement SessionLister the other
+// sessions can't be found, then all sessions (including keepKey) are revoked:
+// keeping sessions of an attacker alive is worse than logging out the user.
+//
+// New in version v0.7
+func (c *SessionController) RevokeOtherSessions(user UserKeyType, keepKey string, reason RevocationReason) (int64, error) {
+	if keepKey == "" {
+		return c.RevokeEntriesForUser(user, reason)
+	}
+	sessions, err := c.ListSessions(user)
+	if err == ErrNotSupported {
+		return c.RevokeEntriesForUser(user, reason)
+	}
+	if err != nil {
+		return -1, err
+	}
+	keys := make([]string, 0, len(sessions))
+	for key := range sessions {
+		if key == keepKey {
+			continue
+		}
+		if err := c.addTombstone(key, reason); err != nil {
+			return -1, err
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	num, err := c.DeleteKeys(keys)
+	if err != nil {
+		return num, err
+	}
+	for _, key := range keys {
+		c.notifyLogout(SessionID(key), user, reason)
+	}
+	return num, nil
+}
+
+// AccountService couples changes of the credentials of a user with the
+// sessions of the user: UpdatePassword and ChangePassword revoke all other
+// sessions of the user (with ReasonPasswordChanged), so a stolen session
+// doesn't survive a password change.
+// Applications should change passwords through an AccountService instead of
+// calling UserHandler.UpdatePassword directly.
+//
+// Usage:
+//
+//	accounts := goauth.NewAccountService(users, controller)
+//	// requires the SessionMiddleware
+//	http.Handle("/password/change", middleware.RequireSession(http.HandlerFunc(accounts.ServeChangePassword)))
+//
+// New in version v0.7
+type AccountService struct {
+	Users      UserHandler
+	Controller *SessionController
+
+	// LoginService is used to check the current password in ChangePassword
+	// if it is not nil, so the attempts are rate limited.
+	LoginService *LoginService
+
+	// KeepCurrentSession keeps the session that changed the password in
+	// ServeChangePassword, defaults to true. If it is false the user has to
+	// log in again with the new password.
+	KeepCurrentSession bool
+
+	// Notifier is informed about changed passwords, may be nil.
+	Notifier SecurityNotifier
+
+	// Render and RenderError write the responses of the handlers, they
+	// default to RenderJSON and RenderJSONError.
+	Render      func(w http.ResponseWriter, r *http.Request, status int, value interface{})
+	RenderError func(w http.ResponseWriter, r *http.Request, status int, err error)
+}
+
+// NewAccountService returns a new AccountService that keeps the current
+// session and renders JSON.
+//
+// New in version v0.7
+func NewAccountService(users UserHandler, controller *SessionController) *AccountService {
+	return &AccountService{Users: users, Controller: controller,
+		KeepCurrentSession: true, Render: RenderJSON, RenderError: RenderJSONError}
+}
+
+// UpdatePassword sets the password of the user and revokes all sessions of
+// the user except the one with keepKey, see
+// SessionController.RevokeOtherSessions. It returns the number of revoked
+// sessions.
+// Returns ErrUserNotFound if the user doesn't exist.
+//
+// New in version v0.7
+func (s *AccountService) UpdatePassword(userName string, plainPW []byte, keepKey string) (int64, error) {
+	id, err := s.Users.GetUserID(userName)
+	if err != nil {
+		return -1, err
+	}
+	if err := s.Users.UpdatePassword(userName, plainPW); err != nil {
+		return -1, err
+	}
+	if s.Notifier != nil {
+		s.Notifier.Notify(NewSecurityEvent(EventPasswordChanged, id, userName))
+	}
+	return s.Controller.RevokeOtherSessions(id, keepKey, ReasonPasswordChanged)
+}
+
+// ChangePassword is like UpdatePassword but checks the current password of
+// the user first. ip is passed to LoginService, it may be "".
+// Returns ErrInvalidCredentials if the current password is wrong and a
+// *RateLimitError if LoginService denies the attempt.
+//
+// New in version v0.7
+func (s *AccountService) ChangePassword(userName string, oldPW, newPW []byte, keepKey, ip string) (int64, error) {
+	var id uint64
+	var err error
+	if s.LoginService != nil {
+		id, err = s.LoginService.Validate(userName, oldPW, ip)
+	} else {
+		id, err = s.Users.Validate(userName, oldPW)
+	}
+	if err == ErrRegistrationPending {
+		err = nil
+	}
+	if err == ErrUserNotFound || (err == nil && id == NoUserID) {
+		return -1, ErrInvalidCredentials
+	}
+	if err != nil {
+		return -1, err
+	}
+	return s.UpdatePassword(userName, newPW, keepKey)
+}
+
+// ServeChangePassword changes the password of the user of the session (see
+// SessionMiddleware). The current password is the field "password", the new
+// one the field "new_password" of the request (see AuthRequest).
+// The response contains the number of revoked sessions.
+//
+// New in version v0.7
+func (s *AccountService) ServeChangePassword(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r, s.RenderError) {
+		return
+	}
+	id, ok := UserIDFromContext(r.Context())
+	if !ok {
+		s.RenderError(w, r, http.StatusUnauthorized, ErrInvalidCredentials)
+		return
+	}
+	req, err := ParseAuthRequest(r)
+	if err != nil {
+		s.RenderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if req.Password == "" || req.NewPassword == "" {
+		s.RenderError(w, r, http.StatusBadRequest, errors.New("Password and new password are required."))
+		return
+	}
+	userName, err := s.Users.GetUserName(id)
+	if err != nil {
+		s.RenderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	keepKey := ""
+	if s.KeepCurrentSession {
+		keepKey = SessionKeyFromContext(r.Context())
+	}
+	num, err := s.ChangePassword(userName, []byte(req.Password), []byte(req.NewPassword), keepKey, ClientIP(r))
+	if rateErr, ok := err.(*RateLimitError); ok {
+		SetRetryAfter(w, rateErr.RetryAfter)
+		s.RenderError(w, r, http.StatusTooManyRequests, rateErr)
+		return
+	}
+	switch err {
+	case nil:
+		s.Render(w, r, http.StatusOK, &AuthResponse{Status: "ok", UserID: id,
+			UserName: userName, Deleted: num})
+	case ErrInvalidCredentials:
+		s.RenderError(w, r, http.StatusUnauthorized, err)
+	case ErrIPBanned:
+		s.RenderError(w, r, http.StatusForbidden, err)
+	case ErrVerificationBusy:
+		SetRetryAfter(w, time.Second)
+		s.RenderError(w, r, http.StatusServiceUnavailable, err)
+	case ErrNotSupported:
+		s.RenderError(w, r, http.StatusNotImplemented, err)
+	default:
+		s.RenderError(w, r, http.StatusInternalServerError, err)
+	}
+}
@@ -0,0 +1,68 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+// Package awskmsauth implements goauth.KMSDecrypter with AWS KMS, so the
+// secrets of goauth can be stored encrypted in the config and are decrypted
+// on startup, see goauth.KMSSecretProvider.
+//
+// Usage:
+//
+//	cfg, err := config.LoadDefaultConfig(ctx)
+//	provider := goauth.NewKMSSecretProvider(awskmsauth.New(kms.NewFromConfig(cfg), keyID))
+//	provider.Add("cookie_hash", ciphertext)
+//	rotator := goauth.NewSecretRotator(provider, time.Hour)
+//
+// New in version v0.7
+package awskmsauth
+
+import (
+	"context"
+
+	"github.com/FabianWe/goauth"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+)
+
+// KMS implements goauth.KMSDecrypter.
+type KMS struct {
+	Client *kms.Client
+
+	// KeyID is the id or ARN of the KMS key, it's optional for symmetric
+	// keys (the key is part of the ciphertext) but recommended.
+	KeyID string
+}
+
+// New returns a new KMS.
+func New(client *kms.Client, keyID string) *KMS {
+	return &KMS{Client: client, KeyID: keyID}
+}
+
+func (k *KMS) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	input := &kms.DecryptInput{CiphertextBlob: ciphertext}
+	if k.KeyID != "" {
+		input.KeyId = aws.String(k.KeyID)
+	}
+	out, err := k.Client.Decrypt(ctx, input)
+	if err != nil {
+		return nil, &goauth.BackendError{Backend: "awskms", Op: "Decrypt", Err: err}
+	}
+	return out.Plaintext, nil
+}
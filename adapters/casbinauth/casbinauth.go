@@ -0,0 +1,229 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package casbinauth exposes the users, roles and organization memberships
+// managed by goauth to the casbin policy engine and provides a net/http
+// middleware that calls Enforce.
+//
+// goauth users are represented by the subject "user:<id>", roles of a
+// goauth.RoleHandler by "role:<name>" and organizations by the domain
+// "org:<id>". The Sync functions write the goauth data as grouping policies,
+// so a model like this can be used:
+//
+//	[request_definition]
+//	r = sub, dom, obj, act
+//
+//	[policy_definition]
+//	p = sub, dom, obj, act
+//
+//	[role_definition]
+//	g = _, _, _
+//
+//	[policy_effect]
+//	e = some(where (p.eft == allow))
+//
+//	[matchers]
+//	m = g(r.sub, p.sub, r.dom) && r.dom == p.dom && keyMatch(r.obj, p.obj) && r.act == p.act
+//
+// New in version v0.7
+package casbinauth
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/FabianWe/goauth"
+	"github.com/casbin/casbin/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+// Enforcer is the part of casbin.IEnforcer used by the middleware.
+type Enforcer interface {
+	Enforce(rvals ...interface{}) (bool, error)
+}
+
+// PolicyManager is the part of casbin.IEnforcer used by the Sync functions.
+type PolicyManager interface {
+	AddNamedGroupingPolicy(ptype string, params ...interface{}) (bool, error)
+	RemoveFilteredNamedGroupingPolicy(ptype string, fieldIndex int, fieldValues ...string) (bool, error)
+}
+
+var (
+	_ Enforcer      = (*casbin.Enforcer)(nil)
+	_ PolicyManager = (*casbin.Enforcer)(nil)
+)
+
+// Subject returns the casbin subject of a goauth user.
+func Subject(user uint64) string {
+	return "user:" + strconv.FormatUint(user, 10)
+}
+
+// RoleSubject returns the casbin subject of a goauth role.
+func RoleSubject(role string) string {
+	return "role:" + role
+}
+
+// Domain returns the casbin domain of an organization.
+func Domain(org uint64) string {
+	return "org:" + strconv.FormatUint(org, 10)
+}
+
+// SyncUserRoles replaces the grouping policies (of type ptype, for example
+// "g") of all users with the roles stored in roles:
+// (Subject(user), RoleSubject(role)) for each role of the user.
+// ptype must be a role definition with two arguments.
+func SyncUserRoles(pm PolicyManager, ptype string, users goauth.UserHandler, roles goauth.RoleHandler) error {
+	ids, err := users.ListUsers()
+	if err != nil {
+		return err
+	}
+	for id := range ids {
+		sub := Subject(id)
+		if _, err := pm.RemoveFilteredNamedGroupingPolicy(ptype, 0, sub); err != nil {
+			return err
+		}
+		userRoles, err := roles.UserRoles(id)
+		if err != nil {
+			return err
+		}
+		for _, role := range userRoles {
+			if _, err := pm.AddNamedGroupingPolicy(ptype, sub, RoleSubject(role)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SyncOrgMembership replaces the grouping policies (of type ptype) of all
+// users with their organization memberships:
+// (Subject(user), role, Domain(org)) where role is "member", "admin" or
+// "owner" (see goauth.OrgRole). Roles imply the lower roles, so an owner
+// also gets the admin and member roles in the domain.
+// ptype must be a role definition with three arguments (with domains).
+func SyncOrgMembership(pm PolicyManager, ptype string, users goauth.UserHandler, orgs goauth.OrgHandler) error {
+	ids, err := users.ListUsers()
+	if err != nil {
+		return err
+	}
+	for id := range ids {
+		sub := Subject(id)
+		if _, err := pm.RemoveFilteredNamedGroupingPolicy(ptype, 0, sub); err != nil {
+			return err
+		}
+		memberships, err := orgs.ListOrgsForUser(id)
+		if err != nil {
+			return err
+		}
+		for org, role := range memberships {
+			for r := goauth.OrgMember; r <= role; r++ {
+				if _, err := pm.AddNamedGroupingPolicy(ptype, sub, r.String(), Domain(org)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Middleware calls Enforce for each request with the subject of the user
+// stored in the request context (so it must be used after a goauth session
+// or bearer middleware), the domain (if Domain is set), the object and the
+// action.
+type Middleware struct {
+	Enforcer Enforcer
+
+	// Domain returns the domain of the request. If it is nil Enforce is
+	// called without a domain (sub, obj, act).
+	Domain func(r *http.Request) (string, error)
+
+	// Object returns the object of the request, defaults to the URL path.
+	Object func(r *http.Request) string
+
+	// Action returns the action of the request, defaults to the method.
+	Action func(r *http.Request) string
+
+	// Forbidden is called if Enforce denies the request, defaults to a 403
+	// response.
+	Forbidden http.HandlerFunc
+}
+
+// NewMiddleware returns a new Middleware without domains.
+func NewMiddleware(e Enforcer) *Middleware {
+	return &Middleware{Enforcer: e,
+		Object: func(r *http.Request) string { return r.URL.Path },
+		Action: func(r *http.Request) string { return r.Method }}
+}
+
+// NewOrgMiddleware returns a new Middleware that uses Domain(org) as domain,
+// orgFromRequest returns the organization of the request.
+func NewOrgMiddleware(e Enforcer, orgFromRequest func(r *http.Request) (uint64, error)) *Middleware {
+	m := NewMiddleware(e)
+	m.Domain = func(r *http.Request) (string, error) {
+		org, err := orgFromRequest(r)
+		if err != nil {
+			return "", err
+		}
+		return Domain(org), nil
+	}
+	return m
+}
+
+// Enforce checks the request.
+func (m *Middleware) Enforce(r *http.Request) (bool, error) {
+	user, ok := goauth.UserIDFromContext(r.Context())
+	if !ok {
+		return false, nil
+	}
+	obj, act := m.Object(r), m.Action(r)
+	if m.Domain == nil {
+		return m.Enforcer.Enforce(Subject(user), obj, act)
+	}
+	dom, err := m.Domain(r)
+	if err != nil {
+		return false, fmt.Errorf("casbinauth: can't get domain: %w", err)
+	}
+	return m.Enforcer.Enforce(Subject(user), dom, obj, act)
+}
+
+// Handler returns a handler that calls next only if Enforce allows the
+// request.
+func (m *Middleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allowed, err := m.Enforce(r)
+		if err != nil {
+			log.WithError(err).Error("goauth: casbin enforce failed")
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if !allowed {
+			if m.Forbidden != nil {
+				m.Forbidden(w, r)
+			} else {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			}
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,68 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package chiauth provides the goauth middleware for the chi router.
+//
+// chi uses the net/http middleware signature, so the methods of the goauth
+// middleware types can be used directly with r.Use. This package only exists
+// for consistency with the other adapters and for discoverability:
+//
+//	r := chi.NewRouter()
+//	r.Use(chiauth.RequireSession(sessionMiddleware))
+//	r.Use(chiauth.CSRF(csrf))
+//
+// New in version v0.7
+package chiauth
+
+import (
+	"net/http"
+
+	"github.com/FabianWe/goauth"
+)
+
+// Middleware is the type of chi middleware.
+type Middleware func(http.Handler) http.Handler
+
+// RequireSession returns m.RequireSession.
+func RequireSession(m *goauth.SessionMiddleware) Middleware {
+	return m.RequireSession
+}
+
+// OptionalSession returns m.OptionalSession.
+func OptionalSession(m *goauth.SessionMiddleware) Middleware {
+	return m.OptionalSession
+}
+
+// RequireBearer returns m.RequireBearer.
+func RequireBearer(m *goauth.BearerMiddleware) Middleware {
+	return m.RequireBearer
+}
+
+// CSRF returns c.Middleware.
+func CSRF(c *goauth.CSRFProtection) Middleware {
+	return c.Middleware
+}
+
+// BasicAuth returns m.Middleware.
+func BasicAuth(m *goauth.BasicAuthMiddleware) Middleware {
+	return m.Middleware
+}
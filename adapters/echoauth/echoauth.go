@@ -0,0 +1,75 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package echoauth provides the goauth middleware for the Echo framework.
+//
+//	e := echo.New()
+//	e.Use(echoauth.RequireSession(sessionMiddleware))
+//	e.GET("/me", func(c echo.Context) error {
+//		id, _ := echoauth.UserID(c)
+//		...
+//	})
+//
+// New in version v0.7
+package echoauth
+
+import (
+	"github.com/FabianWe/goauth"
+	"github.com/labstack/echo/v4"
+)
+
+// RequireSession adapts m.RequireSession.
+func RequireSession(m *goauth.SessionMiddleware) echo.MiddlewareFunc {
+	return echo.WrapMiddleware(m.RequireSession)
+}
+
+// OptionalSession adapts m.OptionalSession.
+func OptionalSession(m *goauth.SessionMiddleware) echo.MiddlewareFunc {
+	return echo.WrapMiddleware(m.OptionalSession)
+}
+
+// RequireBearer adapts m.RequireBearer.
+func RequireBearer(m *goauth.BearerMiddleware) echo.MiddlewareFunc {
+	return echo.WrapMiddleware(m.RequireBearer)
+}
+
+// CSRF adapts c.Middleware.
+func CSRF(c *goauth.CSRFProtection) echo.MiddlewareFunc {
+	return echo.WrapMiddleware(c.Middleware)
+}
+
+// BasicAuth adapts m.Middleware.
+func BasicAuth(m *goauth.BasicAuthMiddleware) echo.MiddlewareFunc {
+	return echo.WrapMiddleware(m.Middleware)
+}
+
+// SessionData returns the session data stored by the goauth middleware, nil
+// if there is no session.
+func SessionData(c echo.Context) *goauth.SessionKeyData {
+	return goauth.SessionDataFromContext(c.Request().Context())
+}
+
+// UserID returns the id of the user stored by the goauth middleware, see
+// goauth.UserIDFromContext.
+func UserID(c echo.Context) (uint64, bool) {
+	return goauth.UserIDFromContext(c.Request().Context())
+}
@@ -0,0 +1,166 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package fiberauth provides the goauth middleware for the Fiber framework.
+//
+// Fiber is not based on net/http, so the request is converted for the goauth
+// middleware and the session data is stored in the locals of the fiber
+// context afterwards:
+//
+//	app := fiber.New()
+//	app.Use(fiberauth.RequireSession(sessionMiddleware))
+//	app.Get("/me", func(c *fiber.Ctx) error {
+//		id, _ := fiberauth.UserID(c)
+//		...
+//	})
+//
+// New in version v0.7
+package fiberauth
+
+import (
+	"bytes"
+	"net/http"
+
+	"github.com/FabianWe/goauth"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+)
+
+type localsKey int
+
+const (
+	sessionDataKey localsKey = iota
+	sessionKeyKey
+)
+
+// responseWriter buffers the response written by a net/http middleware.
+type responseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *responseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(b)
+}
+
+// Wrap converts a net/http middleware to a fiber.Handler. Headers set by the
+// middleware (for example cookies) are copied to the fiber response. If the
+// middleware doesn't call the next handler its response is sent, otherwise
+// the session stored in the request context is copied to the locals and the
+// next fiber handler is called.
+// The session already stored in the locals is passed to the middleware in
+// the request context.
+func Wrap(middleware func(http.Handler) http.Handler) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		r, err := adaptor.ConvertRequest(c, true)
+		if err != nil {
+			return err
+		}
+		// a session stored by a previous goauth handler must be visible to
+		// this middleware (for example for CSRF)
+		if data := SessionData(c); data != nil {
+			key, _ := c.Locals(sessionKeyKey).(string)
+			r = r.WithContext(goauth.NewSessionContext(r.Context(), key, data))
+		}
+		var nextRequest *http.Request
+		w := &responseWriter{header: make(http.Header)}
+		next := http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+			nextRequest = r
+		})
+		middleware(next).ServeHTTP(w, r)
+		for name, values := range w.header {
+			for _, value := range values {
+				c.Response().Header.Add(name, value)
+			}
+		}
+		if nextRequest == nil {
+			if w.status == 0 {
+				w.status = http.StatusOK
+			}
+			return c.Status(w.status).Send(w.body.Bytes())
+		}
+		if data := goauth.SessionDataFromContext(nextRequest.Context()); data != nil {
+			c.Locals(sessionDataKey, data)
+			c.Locals(sessionKeyKey, goauth.SessionKeyFromContext(nextRequest.Context()))
+		}
+		return c.Next()
+	}
+}
+
+// RequireSession adapts m.RequireSession.
+func RequireSession(m *goauth.SessionMiddleware) fiber.Handler {
+	return Wrap(m.RequireSession)
+}
+
+// OptionalSession adapts m.OptionalSession.
+func OptionalSession(m *goauth.SessionMiddleware) fiber.Handler {
+	return Wrap(m.OptionalSession)
+}
+
+// RequireBearer adapts m.RequireBearer.
+func RequireBearer(m *goauth.BearerMiddleware) fiber.Handler {
+	return Wrap(m.RequireBearer)
+}
+
+// BasicAuth adapts m.Middleware.
+func BasicAuth(m *goauth.BasicAuthMiddleware) fiber.Handler {
+	return Wrap(m.Middleware)
+}
+
+// CSRF adapts c.Middleware. In CSRFSynchronizerToken mode the session is
+// taken from the locals, so use it after RequireSession or OptionalSession.
+func CSRF(c *goauth.CSRFProtection) fiber.Handler {
+	return Wrap(c.Middleware)
+}
+
+// SessionData returns the session data stored by the goauth middleware, nil
+// if there is no session.
+func SessionData(c *fiber.Ctx) *goauth.SessionKeyData {
+	data, _ := c.Locals(sessionDataKey).(*goauth.SessionKeyData)
+	return data
+}
+
+// UserID returns the id of the user stored by the goauth middleware, see
+// goauth.UserIDFromContext.
+func UserID(c *fiber.Ctx) (uint64, bool) {
+	data := SessionData(c)
+	if data == nil {
+		return goauth.NoUserID, false
+	}
+	id, err := goauth.UserKeyToID(data.User)
+	if err != nil {
+		return goauth.NoUserID, false
+	}
+	return id, true
+}
@@ -0,0 +1,531 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+// Package firestoreauth implements goauth.SessionHandler and
+// goauth.UserHandler with Google Cloud Firestore, for applications on GCP
+// serverless platforms that don't want to run SQL or redis only for the
+// authentication.
+//
+// Each session is a document in the collection "goauth_sessions", the
+// document ID is the base64 encoded session key. Enable a TTL policy on the
+// field valid_until so that Firestore removes expired sessions:
+//
+//	gcloud firestore fields ttls update valid_until \
+//		--collection-group=goauth_sessions --enable-ttl
+//
+// Each user is a document in the collection "goauth_users", the document
+// ID is the base64 encoded username, so usernames are unique. Numeric user
+// ids are assigned from a counter document (by default
+// "goauth_meta/user_ids") in the same transaction.
+// DeleteEntriesForUser and ListSessionsForUser query the field user and
+// GetUserName the field id, both are covered by the automatic single field
+// indexes.
+//
+// Usage:
+//
+//	client, err := firestore.NewClient(ctx, projectID)
+//	controller := goauth.NewSessionController(firestoreauth.NewSessionHandler(client))
+//	users := firestoreauth.NewUserHandler(client, nil)
+//
+// New in version v0.7
+package firestoreauth
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/FabianWe/goauth"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// encode encodes a key or username s.t. it's a valid document ID.
+func encode(s string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+// SessionHandler implements goauth.SessionHandler, goauth.SessionLister and
+// goauth.HealthChecker with a Firestore collection.
+type SessionHandler struct {
+	Client *firestore.Client
+
+	// Collection is the collection of the sessions, defaults to
+	// "goauth_sessions".
+	Collection string
+
+	// ConvertUser is the function used to transform the string representation
+	// of the user identification back to its original type.
+	// The default assumes uint64.
+	ConvertUser func(val string) (interface{}, error)
+
+	// Timeout is the timeout for each operation, 0 means no timeout.
+	// See goauth.OperationTimeoutHandler.
+	Timeout time.Duration
+}
+
+var (
+	_ goauth.SessionHandler = (*SessionHandler)(nil)
+	_ goauth.SessionLister  = (*SessionHandler)(nil)
+	_ goauth.HealthChecker  = (*SessionHandler)(nil)
+)
+
+// NewSessionHandler returns a new SessionHandler.
+func NewSessionHandler(client *firestore.Client) *SessionHandler {
+	convert := func(val string) (interface{}, error) {
+		res, err := strconv.ParseUint(val, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		return res, nil
+	}
+	return &SessionHandler{Client: client, Collection: "goauth_sessions", ConvertUser: convert}
+}
+
+// sessionDoc is the document stored for each session.
+type sessionDoc struct {
+	User       string    `firestore:"user"`
+	Created    time.Time `firestore:"created"`
+	ValidUntil time.Time `firestore:"valid_until"`
+}
+
+func (h *SessionHandler) doc(key string) *firestore.DocumentRef {
+	return h.Client.Collection(h.Collection).Doc(encode(key))
+}
+
+// OperationTimeout returns Timeout, see goauth.OperationTimeoutHandler.
+func (h *SessionHandler) OperationTimeout() time.Duration {
+	return h.Timeout
+}
+
+// SetOperationTimeout sets Timeout, see goauth.OperationTimeoutHandler.
+func (h *SessionHandler) SetOperationTimeout(timeout time.Duration) {
+	h.Timeout = timeout
+}
+
+// Init is a NOOP, collections are created implicitly. The TTL policy must be
+// configured separately, see the package documentation.
+func (h *SessionHandler) Init() error {
+	return nil
+}
+
+func (h *SessionHandler) GetData(key string) (*goauth.SessionKeyData, error) {
+	ctx, cancel := operationContext(context.Background(), h.Timeout)
+	defer cancel()
+	snap, err := h.doc(key).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, goauth.ErrKeyNotFound
+	}
+	if err != nil {
+		return nil, wrapError("GetData", err)
+	}
+	entry := &sessionDoc{}
+	if err := snap.DataTo(entry); err != nil {
+		return nil, wrapError("GetData", err)
+	}
+	user, err := h.ConvertUser(entry.User)
+	if err != nil {
+		return nil, err
+	}
+	return &goauth.SessionKeyData{User: user, CreationTime: entry.Created,
+		ValidUntil: entry.ValidUntil}, nil
+}
+
+func (h *SessionHandler) CreateEntry(user goauth.UserKeyType, key string, validDuration time.Duration) (*goauth.SessionKeyData, error) {
+	ctx, cancel := operationContext(context.Background(), h.Timeout)
+	defer cancel()
+	data := goauth.CurrentTimeKeyData(user, validDuration)
+	entry := &sessionDoc{User: fmt.Sprintf("%v", user), Created: data.CreationTime,
+		ValidUntil: data.ValidUntil}
+	if _, err := h.doc(key).Create(ctx, entry); err != nil {
+		return nil, wrapError("CreateEntry", err)
+	}
+	return data, nil
+}
+
+// deleteAll deletes all documents returned by the query.
+func (h *SessionHandler) deleteAll(ctx context.Context, op string, query firestore.Query) (int64, error) {
+	iter := query.Documents(ctx)
+	defer iter.Stop()
+	var removed int64
+	for {
+		snap, err := iter.Next()
+		if err == iterator.Done {
+			return removed, nil
+		}
+		if err != nil {
+			return removed, wrapError(op, err)
+		}
+		if _, err := snap.Ref.Delete(ctx); err != nil {
+			return removed, wrapError(op, err)
+		}
+		removed++
+	}
+}
+
+func (h *SessionHandler) DeleteEntriesForUser(user goauth.UserKeyType) (int64, error) {
+	ctx, cancel := operationContext(context.Background(), h.Timeout)
+	defer cancel()
+	query := h.Client.Collection(h.Collection).Where("user", "==", fmt.Sprintf("%v", user))
+	return h.deleteAll(ctx, "DeleteEntriesForUser", query)
+}
+
+// DeleteInvalidKeys deletes all expired sessions. The TTL policy removes them
+// as well but it can take up to a day until a document is removed.
+func (h *SessionHandler) DeleteInvalidKeys() (int64, error) {
+	ctx, cancel := operationContext(context.Background(), h.Timeout)
+	defer cancel()
+	query := h.Client.Collection(h.Collection).Where("valid_until", "<", goauth.CurrentTime())
+	return h.deleteAll(ctx, "DeleteInvalidKeys", query)
+}
+
+func (h *SessionHandler) DeleteKey(key string) error {
+	ctx, cancel := operationContext(context.Background(), h.Timeout)
+	defer cancel()
+	_, err := h.doc(key).Delete(ctx)
+	return wrapError("DeleteKey", err)
+}
+
+// ListSessionsForUser returns all valid sessions of the user, see
+// goauth.SessionLister.
+func (h *SessionHandler) ListSessionsForUser(user goauth.UserKeyType) (map[string]*goauth.SessionKeyData, error) {
+	ctx, cancel := operationContext(context.Background(), h.Timeout)
+	defer cancel()
+	iter := h.Client.Collection(h.Collection).Where("user", "==", fmt.Sprintf("%v", user)).Documents(ctx)
+	defer iter.Stop()
+	now := goauth.CurrentTime()
+	res := make(map[string]*goauth.SessionKeyData)
+	for {
+		snap, err := iter.Next()
+		if err == iterator.Done {
+			return res, nil
+		}
+		if err != nil {
+			return nil, wrapError("ListSessionsForUser", err)
+		}
+		key, err := base64.RawURLEncoding.DecodeString(snap.Ref.ID)
+		if err != nil {
+			continue
+		}
+		entry := &sessionDoc{}
+		if err := snap.DataTo(entry); err != nil {
+			return nil, wrapError("ListSessionsForUser", err)
+		}
+		// filtered here, a range filter on valid_until requires a composite
+		// index
+		if goauth.KeyValid(now, entry.ValidUntil) {
+			res[string(key)] = &goauth.SessionKeyData{User: user, CreationTime: entry.Created,
+				ValidUntil: entry.ValidUntil}
+		}
+	}
+}
+
+// Healthy reads a document from the collection, see goauth.HealthChecker.
+func (h *SessionHandler) Healthy(ctx context.Context) error {
+	ctx, cancel := operationContext(ctx, h.Timeout)
+	defer cancel()
+	_, err := h.Client.Collection(h.Collection).Doc("health").Get(ctx)
+	if err != nil && status.Code(err) != codes.NotFound {
+		return wrapError("Healthy", err)
+	}
+	return nil
+}
+
+// UserHandler implements goauth.UserHandler, goauth.AdminFlagHandler and
+// goauth.ActiveFlagHandler with a Firestore collection.
+type UserHandler struct {
+	Client *firestore.Client
+
+	// PwHandler is used to hash and check passwords.
+	PwHandler goauth.PasswordHandler
+
+	// Collection is the collection of the users, defaults to "goauth_users".
+	Collection string
+
+	// CounterDoc is the path of the document that stores the last assigned
+	// user id, defaults to "goauth_meta/user_ids".
+	CounterDoc string
+
+	// Names restricts the usernames of new users, see goauth.UsernamePolicy.
+	// nil means no restrictions.
+	Names *goauth.UsernamePolicy
+
+	// Timeout is the timeout for each operation, 0 means no timeout.
+	// See goauth.OperationTimeoutHandler.
+	Timeout time.Duration
+}
+
+var _ goauth.UserHandler = (*UserHandler)(nil)
+
+// NewUserHandler returns a new UserHandler, if pwHandler is nil
+// goauth.DefaultPWHandler is used.
+func NewUserHandler(client *firestore.Client, pwHandler goauth.PasswordHandler) *UserHandler {
+	if pwHandler == nil {
+		pwHandler = goauth.DefaultPWHandler
+	}
+	return &UserHandler{Client: client, PwHandler: pwHandler, Collection: "goauth_users",
+		CounterDoc: "goauth_meta/user_ids"}
+}
+
+// userDoc is the document stored for each user.
+type userDoc struct {
+	ID        int64     `firestore:"id"`
+	UserName  string    `firestore:"username"`
+	FirstName string    `firestore:"first_name"`
+	LastName  string    `firestore:"last_name"`
+	Email     string    `firestore:"email"`
+	Password  []byte    `firestore:"password"`
+	LastLogin time.Time `firestore:"last_login"`
+	IsActive  bool      `firestore:"is_active"`
+	IsAdmin   bool      `firestore:"is_admin"`
+	IsPending bool      `firestore:"is_pending"`
+}
+
+func (h *UserHandler) doc(userName string) *firestore.DocumentRef {
+	return h.Client.Collection(h.Collection).Doc(encode(userName))
+}
+
+// OperationTimeout returns Timeout, see goauth.OperationTimeoutHandler.
+func (h *UserHandler) OperationTimeout() time.Duration {
+	return h.Timeout
+}
+
+// SetOperationTimeout sets Timeout, see goauth.OperationTimeoutHandler.
+func (h *UserHandler) SetOperationTimeout(timeout time.Duration) {
+	h.Timeout = timeout
+}
+
+// Init is a NOOP, collections are created implicitly.
+func (h *UserHandler) Init() error {
+	return nil
+}
+
+func (h *UserHandler) get(ctx context.Context, op, userName string) (*userDoc, error) {
+	snap, err := h.doc(userName).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, goauth.ErrUserNotFound
+	}
+	if err != nil {
+		return nil, wrapError(op, err)
+	}
+	res := &userDoc{}
+	if err := snap.DataTo(res); err != nil {
+		return nil, wrapError(op, err)
+	}
+	return res, nil
+}
+
+// update sets the given field of the user.
+func (h *UserHandler) update(op, userName, field string, value interface{}) error {
+	ctx, cancel := operationContext(context.Background(), h.Timeout)
+	defer cancel()
+	_, err := h.doc(userName).Update(ctx, []firestore.Update{{Path: field, Value: value}})
+	if status.Code(err) == codes.NotFound {
+		return goauth.ErrUserNotFound
+	}
+	return wrapError(op, err)
+}
+
+func (h *UserHandler) Insert(userName, firstName, lastName, email string, plainPW []byte) (uint64, error) {
+	if err := h.Names.Check(userName); err != nil {
+		return goauth.NoUserID, err
+	}
+	encrypted, err := h.PwHandler.GenerateHash(plainPW)
+	if err != nil {
+		return goauth.NoUserID, err
+	}
+	ctx, cancel := operationContext(context.Background(), h.Timeout)
+	defer cancel()
+	ref, counterRef := h.doc(userName), h.Client.Doc(h.CounterDoc)
+	var id int64
+	err = h.Client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		if _, err := tx.Get(ref); err == nil {
+			return goauth.ErrDuplicateUsername
+		} else if status.Code(err) != codes.NotFound {
+			return err
+		}
+		var counter struct {
+			Last int64 `firestore:"last"`
+		}
+		snap, err := tx.Get(counterRef)
+		if err == nil {
+			if err := snap.DataTo(&counter); err != nil {
+				return err
+			}
+		} else if status.Code(err) != codes.NotFound {
+			return err
+		}
+		id = counter.Last + 1
+		if err := tx.Set(counterRef, map[string]interface{}{"last": id}); err != nil {
+			return err
+		}
+		return tx.Create(ref, &userDoc{ID: id, UserName: userName, FirstName: firstName,
+			LastName: lastName, Email: email, Password: encrypted,
+			LastLogin: goauth.CurrentTime(), IsActive: true})
+	})
+	if err == goauth.ErrDuplicateUsername {
+		return goauth.NoUserID, err
+	}
+	if err != nil {
+		return goauth.NoUserID, wrapError("Insert", err)
+	}
+	return uint64(id), nil
+}
+
+func (h *UserHandler) Validate(userName string, cleartextPwCheck []byte) (uint64, error) {
+	ctx, cancel := operationContext(context.Background(), h.Timeout)
+	defer cancel()
+	user, err := h.get(ctx, "Validate", userName)
+	if err != nil {
+		return goauth.NoUserID, err
+	}
+	// the password might have been cleared, the user can't log in then
+	if len(user.Password) == 0 {
+		return goauth.NoUserID, nil
+	}
+	ok, err := h.PwHandler.CheckPassword(user.Password, cleartextPwCheck)
+	if err != nil || !ok {
+		return goauth.NoUserID, err
+	}
+	if user.IsPending {
+		return uint64(user.ID), goauth.ErrRegistrationPending
+	}
+	return uint64(user.ID), nil
+}
+
+func (h *UserHandler) UpdatePassword(userName string, plainPW []byte) error {
+	encrypted, err := h.PwHandler.GenerateHash(plainPW)
+	if err != nil {
+		return err
+	}
+	return h.update("UpdatePassword", userName, "password", encrypted)
+}
+
+func (h *UserHandler) ListUsers() (map[uint64]string, error) {
+	ctx, cancel := operationContext(context.Background(), h.Timeout)
+	defer cancel()
+	iter := h.Client.Collection(h.Collection).Select("id", "username").Documents(ctx)
+	defer iter.Stop()
+	res := make(map[uint64]string)
+	for {
+		snap, err := iter.Next()
+		if err == iterator.Done {
+			return res, nil
+		}
+		if err != nil {
+			return nil, wrapError("ListUsers", err)
+		}
+		user := &userDoc{}
+		if err := snap.DataTo(user); err != nil {
+			return nil, wrapError("ListUsers", err)
+		}
+		res[uint64(user.ID)] = user.UserName
+	}
+}
+
+func (h *UserHandler) GetUserName(id uint64) (string, error) {
+	ctx, cancel := operationContext(context.Background(), h.Timeout)
+	defer cancel()
+	iter := h.Client.Collection(h.Collection).Where("id", "==", int64(id)).Limit(1).Documents(ctx)
+	defer iter.Stop()
+	snap, err := iter.Next()
+	if err == iterator.Done {
+		return "", goauth.ErrUserNotFound
+	}
+	if err != nil {
+		return "", wrapError("GetUserName", err)
+	}
+	user := &userDoc{}
+	if err := snap.DataTo(user); err != nil {
+		return "", wrapError("GetUserName", err)
+	}
+	return user.UserName, nil
+}
+
+func (h *UserHandler) GetUserID(userName string) (uint64, error) {
+	info, err := h.GetUserBaseInfo(userName)
+	if err != nil {
+		return goauth.NoUserID, err
+	}
+	return info.ID, nil
+}
+
+func (h *UserHandler) DeleteUser(userName string) error {
+	ctx, cancel := operationContext(context.Background(), h.Timeout)
+	defer cancel()
+	_, err := h.doc(userName).Delete(ctx)
+	return wrapError("DeleteUser", err)
+}
+
+func (h *UserHandler) GetUserBaseInfo(userName string) (*goauth.BaseUserInformation, error) {
+	ctx, cancel := operationContext(context.Background(), h.Timeout)
+	defer cancel()
+	user, err := h.get(ctx, "GetUserBaseInfo", userName)
+	if err != nil {
+		return nil, err
+	}
+	return &goauth.BaseUserInformation{ID: uint64(user.ID), UserName: user.UserName,
+		FirstName: user.FirstName, LastName: user.LastName, Email: user.Email,
+		LastLogin: user.LastLogin, IsActive: user.IsActive, IsAdmin: user.IsAdmin,
+		IsPending: user.IsPending}, nil
+}
+
+func (h *UserHandler) SetAdmin(userName string, admin bool) error {
+	return h.update("SetAdmin", userName, "is_admin", admin)
+}
+
+func (h *UserHandler) SetActive(userName string, active bool) error {
+	return h.update("SetActive", userName, "is_active", active)
+}
+
+// operationContext returns a context with the timeout, if timeout <= 0 the
+// parent is returned.
+func operationContext(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return parent, func() {}
+	}
+	return context.WithTimeout(parent, timeout)
+}
+
+// wrapError wraps err in a *goauth.BackendError, it returns nil if err is
+// nil.
+func wrapError(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	res := &goauth.BackendError{Backend: "firestore", Op: op, Err: err}
+	switch status.Code(err) {
+	case codes.AlreadyExists:
+		res.Kind = goauth.ErrDuplicateEntry
+	case codes.Unavailable, codes.DeadlineExceeded:
+		res.Kind = goauth.ErrBackendUnavailable
+	default:
+		if errors.Is(err, context.DeadlineExceeded) {
+			res.Kind = goauth.ErrBackendUnavailable
+		}
+	}
+	return res
+}
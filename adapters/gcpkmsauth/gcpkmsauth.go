@@ -0,0 +1,64 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+// Package gcpkmsauth implements goauth.KMSDecrypter with Google Cloud KMS, so
+// the secrets of goauth can be stored encrypted in the config and are
+// decrypted on startup, see goauth.KMSSecretProvider.
+//
+// Usage:
+//
+//	client, err := kms.NewKeyManagementClient(ctx)
+//	provider := goauth.NewKMSSecretProvider(gcpkmsauth.New(client,
+//		"projects/p/locations/global/keyRings/r/cryptoKeys/goauth"))
+//	provider.Add("cookie_hash", ciphertext)
+//	rotator := goauth.NewSecretRotator(provider, time.Hour)
+//
+// New in version v0.7
+package gcpkmsauth
+
+import (
+	"context"
+
+	kms "cloud.google.com/go/kms/apiv1"
+	"cloud.google.com/go/kms/apiv1/kmspb"
+	"github.com/FabianWe/goauth"
+)
+
+// KMS implements goauth.KMSDecrypter.
+type KMS struct {
+	Client *kms.KeyManagementClient
+
+	// KeyName is the resource name of the crypto key.
+	KeyName string
+}
+
+// New returns a new KMS.
+func New(client *kms.KeyManagementClient, keyName string) *KMS {
+	return &KMS{Client: client, KeyName: keyName}
+}
+
+func (k *KMS) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	resp, err := k.Client.Decrypt(ctx, &kmspb.DecryptRequest{Name: k.KeyName, Ciphertext: ciphertext})
+	if err != nil {
+		return nil, &goauth.BackendError{Backend: "gcpkms", Op: "Decrypt", Err: err}
+	}
+	return resp.GetPlaintext(), nil
+}
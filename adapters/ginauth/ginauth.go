@@ -0,0 +1,95 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package ginauth provides the goauth middleware for the Gin framework.
+//
+//	r := gin.Default()
+//	r.Use(ginauth.RequireSession(sessionMiddleware))
+//	r.GET("/me", func(c *gin.Context) {
+//		id, _ := ginauth.UserID(c)
+//		...
+//	})
+//
+// New in version v0.7
+package ginauth
+
+import (
+	"net/http"
+
+	"github.com/FabianWe/goauth"
+	"github.com/gin-gonic/gin"
+)
+
+// Wrap converts a net/http middleware to a gin.HandlerFunc. If the
+// middleware doesn't call the next handler (because it wrote a response
+// itself) the gin chain is aborted.
+func Wrap(middleware func(http.Handler) http.Handler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		called := false
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+			c.Request = r
+			c.Next()
+		})
+		middleware(next).ServeHTTP(c.Writer, c.Request)
+		if !called {
+			c.Abort()
+		}
+	}
+}
+
+// RequireSession adapts m.RequireSession.
+func RequireSession(m *goauth.SessionMiddleware) gin.HandlerFunc {
+	return Wrap(m.RequireSession)
+}
+
+// OptionalSession adapts m.OptionalSession.
+func OptionalSession(m *goauth.SessionMiddleware) gin.HandlerFunc {
+	return Wrap(m.OptionalSession)
+}
+
+// RequireBearer adapts m.RequireBearer.
+func RequireBearer(m *goauth.BearerMiddleware) gin.HandlerFunc {
+	return Wrap(m.RequireBearer)
+}
+
+// CSRF adapts c.Middleware.
+func CSRF(c *goauth.CSRFProtection) gin.HandlerFunc {
+	return Wrap(c.Middleware)
+}
+
+// BasicAuth adapts m.Middleware.
+func BasicAuth(m *goauth.BasicAuthMiddleware) gin.HandlerFunc {
+	return Wrap(m.Middleware)
+}
+
+// SessionData returns the session data stored by the goauth middleware, nil
+// if there is no session.
+func SessionData(c *gin.Context) *goauth.SessionKeyData {
+	return goauth.SessionDataFromContext(c.Request.Context())
+}
+
+// UserID returns the id of the user stored by the goauth middleware, see
+// goauth.UserIDFromContext.
+func UserID(c *gin.Context) (uint64, bool) {
+	return goauth.UserIDFromContext(c.Request.Context())
+}
@@ -0,0 +1,111 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package gormauth creates the SQL handlers of goauth for an existing
+// *gorm.DB, so goauth shares the connection pool of the application. The
+// dialect is chosen by the name of the gorm dialector.
+//
+// Usage:
+//
+//	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+//	sessions, err := gormauth.NewSessionHandler(db, "", "")
+//	users, err := gormauth.NewUserHandler(db, nil)
+//
+// New in version v0.7
+package gormauth
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/FabianWe/goauth"
+	"gorm.io/gorm"
+)
+
+// Dialects of goauth.
+const (
+	MySQL    = "mysql"
+	Postgres = "postgres"
+	SQLite3  = "sqlite3"
+)
+
+// Dialect returns the goauth dialect for the dialector of the database.
+func Dialect(db *gorm.DB) (string, error) {
+	switch name := db.Dialector.Name(); name {
+	case "mysql":
+		return MySQL, nil
+	case "postgres":
+		return Postgres, nil
+	case "sqlite", "sqlite3":
+		return SQLite3, nil
+	default:
+		return "", fmt.Errorf("Unsupported gorm dialect for goauth: %s", name)
+	}
+}
+
+// sqlDB returns the dialect and the *sql.DB of the database.
+func sqlDB(db *gorm.DB) (string, *sql.DB, error) {
+	dialect, err := Dialect(db)
+	if err != nil {
+		return "", nil, err
+	}
+	res, err := db.DB()
+	if err != nil {
+		return "", nil, err
+	}
+	return dialect, res, nil
+}
+
+// NewSessionHandler returns a new goauth.SQLSessionHandler for the database,
+// tableName and userIDType have the same meaning as in
+// goauth.NewMySQLSessionHandler.
+func NewSessionHandler(db *gorm.DB, tableName, userIDType string) (*goauth.SQLSessionHandler, error) {
+	dialect, conn, err := sqlDB(db)
+	if err != nil {
+		return nil, err
+	}
+	switch dialect {
+	case MySQL:
+		return goauth.NewMySQLSessionHandler(conn, tableName, userIDType), nil
+	case Postgres:
+		return goauth.NewPostgresSessionHandler(conn, tableName, userIDType), nil
+	default:
+		return goauth.NewSQLite3SessionHandler(conn, tableName, userIDType), nil
+	}
+}
+
+// NewUserHandler returns a new goauth.SQLUserHandler for the database, if
+// pwHandler is nil goauth.DefaultPWHandler is used.
+func NewUserHandler(db *gorm.DB, pwHandler goauth.PasswordHandler) (*goauth.SQLUserHandler, error) {
+	dialect, conn, err := sqlDB(db)
+	if err != nil {
+		return nil, err
+	}
+	switch dialect {
+	case MySQL:
+		return goauth.NewMySQLUserHandler(conn, pwHandler), nil
+	case Postgres:
+		return goauth.NewPostgresUserHandler(conn, pwHandler), nil
+	default:
+		return goauth.NewSQLite3UserHandler(conn, pwHandler), nil
+	}
+}
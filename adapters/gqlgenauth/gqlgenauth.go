@@ -0,0 +1,163 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+// Package gqlgenauth provides the directives @auth, @hasRole and
+// @hasPermission for GraphQL servers generated by gqlgen
+// (github.com/99designs/gqlgen), backed by the sessions and the roles of
+// goauth.
+//
+// The session is read from the request context, so wrap the GraphQL handler
+// with goauth.SessionMiddleware.OptionalSession. Subscriptions over
+// websockets authenticate with the connection init payload, see
+// WebsocketInit.
+//
+// Usage, in the schema:
+//
+//	directive @auth on FIELD_DEFINITION
+//	directive @hasRole(role: String!) on FIELD_DEFINITION
+//	directive @hasPermission(permission: String!) on FIELD_DEFINITION
+//
+// and in the server:
+//
+//	directives := gqlgenauth.New(goauth.NewPermissionChecker(roles))
+//	cfg := generated.Config{Resolvers: resolver}
+//	cfg.Directives.Auth = directives.Auth
+//	cfg.Directives.HasRole = directives.HasRole
+//	cfg.Directives.HasPermission = directives.HasPermission
+//	srv := handler.NewDefaultServer(generated.NewExecutableSchema(cfg))
+//	http.Handle("/query", middleware.OptionalSession(srv))
+//
+// New in version v0.7
+package gqlgenauth
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/99designs/gqlgen/graphql/handler/transport"
+	"github.com/FabianWe/goauth"
+	log "github.com/sirupsen/logrus"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+// Error codes in the extensions of the GraphQL errors.
+const (
+	CodeUnauthenticated = "UNAUTHENTICATED"
+	CodeForbidden       = "FORBIDDEN"
+)
+
+// ErrUnauthenticated is returned by the directives if there is no valid
+// session, ErrForbidden if the user lacks the role or permission.
+var (
+	ErrUnauthenticated = &gqlerror.Error{Message: "Authentication required.",
+		Extensions: map[string]interface{}{"code": CodeUnauthenticated}}
+	ErrForbidden = &gqlerror.Error{Message: "Permission denied.",
+		Extensions: map[string]interface{}{"code": CodeForbidden}}
+)
+
+// Directives implements the directives, Checker is only required for
+// HasRole and HasPermission.
+type Directives struct {
+	Checker *goauth.PermissionChecker
+}
+
+// New returns new Directives.
+func New(checker *goauth.PermissionChecker) *Directives {
+	return &Directives{Checker: checker}
+}
+
+// CurrentUser returns the id of the authenticated user, see
+// goauth.UserIDFromContext.
+func CurrentUser(ctx context.Context) (uint64, bool) {
+	return goauth.UserIDFromContext(ctx)
+}
+
+// Auth implements @auth: the field is resolved only if the request has a
+// valid session.
+func (d *Directives) Auth(ctx context.Context, obj interface{}, next graphql.Resolver) (interface{}, error) {
+	if _, ok := CurrentUser(ctx); !ok {
+		return nil, ErrUnauthenticated
+	}
+	return next(ctx)
+}
+
+// HasRole implements @hasRole(role: String!).
+func (d *Directives) HasRole(ctx context.Context, obj interface{}, next graphql.Resolver, role string) (interface{}, error) {
+	return d.require(ctx, next, func(user uint64) (bool, error) {
+		return d.Checker.HasRole(user, role)
+	})
+}
+
+// HasPermission implements @hasPermission(permission: String!).
+func (d *Directives) HasPermission(ctx context.Context, obj interface{}, next graphql.Resolver, permission string) (interface{}, error) {
+	return d.require(ctx, next, func(user uint64) (bool, error) {
+		return d.Checker.HasPermission(user, permission)
+	})
+}
+
+func (d *Directives) require(ctx context.Context, next graphql.Resolver, check func(user uint64) (bool, error)) (interface{}, error) {
+	user, ok := CurrentUser(ctx)
+	if !ok {
+		return nil, ErrUnauthenticated
+	}
+	allowed, err := check(user)
+	if err != nil {
+		// don't leak backend errors to the client
+		log.WithError(err).Error("goauth: Can't check permissions")
+		return nil, errors.New("Internal server error.")
+	}
+	if !allowed {
+		return nil, ErrForbidden
+	}
+	return next(ctx)
+}
+
+// WebsocketInit returns a transport.WebsocketInitFunc that authenticates a
+// websocket connection with the session key in the "Authorization" entry
+// of the init payload (optionally prefixed with "Bearer "). If verifier is
+// nil the key is looked up with controller. Connections without a key are
+// accepted without a session, @auth rejects them then; connections with an
+// invalid key are closed.
+func WebsocketInit(controller *goauth.SessionController, verifier goauth.TokenVerifier) transport.WebsocketInitFunc {
+	if verifier == nil {
+		verifier = goauth.SessionTokenVerifier{Controller: controller}
+	}
+	return func(ctx context.Context, payload transport.InitPayload) (context.Context, *transport.InitPayload, error) {
+		key := payload.Authorization()
+		if len(key) > 7 && strings.EqualFold(key[:7], "Bearer ") {
+			key = strings.TrimSpace(key[7:])
+		}
+		if key == "" {
+			return ctx, &payload, nil
+		}
+		data, err := verifier.VerifyToken(key)
+		if err != nil {
+			return ctx, nil, ErrUnauthenticated
+		}
+		if v, ok := verifier.(goauth.SessionTokenVerifier); ok {
+			// signed keys, see goauth.SessionController.Signer
+			key, _ = v.Controller.ParseClientKey(key)
+		}
+		return goauth.NewSessionContext(ctx, key, data), &payload, nil
+	}
+}
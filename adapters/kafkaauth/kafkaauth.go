@@ -0,0 +1,66 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+// Package kafkaauth implements goauth.MessageProducer with
+// github.com/segmentio/kafka-go, so the security events of goauth can be
+// published to Kafka with a goauth.EventPublisher.
+//
+// The topic is set per message, so the Topic of the kafka.Writer must be
+// empty. The key of each message is the user id, the message id is sent in
+// the header "goauth-id".
+//
+// Usage:
+//
+//	writer := &kafka.Writer{Addr: kafka.TCP("localhost:9092"), Balancer: &kafka.Hash{}}
+//	publisher := goauth.NewEventPublisher(kafkaauth.NewProducer(writer))
+//	publisher.Start(ctx, 1000)
+//	bus.SubscribeNotifier(publisher)
+//
+// New in version v0.7
+package kafkaauth
+
+import (
+	"context"
+
+	"github.com/FabianWe/goauth"
+	"github.com/segmentio/kafka-go"
+)
+
+// Producer implements goauth.MessageProducer.
+type Producer struct {
+	Writer *kafka.Writer
+}
+
+var _ goauth.MessageProducer = (*Producer)(nil)
+
+// NewProducer returns a new Producer.
+func NewProducer(writer *kafka.Writer) *Producer {
+	return &Producer{Writer: writer}
+}
+
+func (p *Producer) Publish(ctx context.Context, msg *goauth.EventMessage) error {
+	err := p.Writer.WriteMessages(ctx, kafka.Message{Topic: msg.Topic, Key: msg.Key,
+		Value: msg.Value, Headers: []kafka.Header{{Key: "goauth-id", Value: []byte(msg.ID)}}})
+	if err != nil {
+		return &goauth.BackendError{Backend: "kafka", Op: "Publish", Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,440 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package ldapauth implements goauth.UserHandler with an LDAP directory or
+// Active Directory on top of github.com/go-ldap/ldap. Users are authenticated
+// by a bind with their DN, the directory itself is only read.
+//
+// Usage:
+//
+//	users := ldapauth.NewUserHandler("ldaps://ldap.example.com",
+//		"ou=people,dc=example,dc=com", bindDN, bindPassword)
+//	users.Shadow = sqlUsers
+//
+// New in version v0.7
+package ldapauth
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/FabianWe/goauth"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// Attributes defines the directory attributes that are used to fill
+// BaseUserInformation.
+//
+// New in version v0.7
+type Attributes struct {
+	// UserName is the attribute containing the username, for example "uid"
+	// or "sAMAccountName" for Active Directory.
+	UserName string
+
+	// FirstName, LastName and Email are the attributes for the user
+	// information, for example "givenName", "sn" and "mail".
+	FirstName, LastName, Email string
+
+	// ID is the attribute containing a numeric id of the user, for example
+	// "uidNumber". It is only used if there is no shadow handler.
+	ID string
+}
+
+// DefaultAttributes are the attributes of the inetOrgPerson and
+// posixAccount object classes.
+//
+// New in version v0.7
+var DefaultAttributes = Attributes{UserName: "uid", FirstName: "givenName",
+	LastName: "sn", Email: "mail", ID: "uidNumber"}
+
+// ActiveDirectoryAttributes are the attributes to use with Active Directory.
+// Active Directory has no numeric user id, so you need a shadow handler.
+//
+// New in version v0.7
+var ActiveDirectoryAttributes = Attributes{UserName: "sAMAccountName",
+	FirstName: "givenName", LastName: "sn", Email: "mail"}
+
+// UserHandler is a goauth.UserHandler that authenticates users against an
+// LDAP directory or Active Directory. Validate searches the user (with the
+// service account BindDN) and then binds with the DN of the user and the
+// password.
+//
+// The directory is only read, so Insert and UpdatePassword return
+// ErrNotSupported.
+//
+// Users in a directory usually don't have a stable numeric id that can be
+// used for sessions. Therefore you can set Shadow to another UserHandler
+// (usually a SQLUserHandler): Each user that logs in successfully is then
+// created in the shadow handler (without a password) and the id of the shadow
+// user is used. ListUsers, GetUserName, GetUserID and DeleteUser then work on
+// the shadow handler. If Shadow is nil the ID attribute is used instead.
+//
+// New in version v0.7
+type UserHandler struct {
+	// URL is the URL of the directory, for example
+	// "ldaps://ldap.example.com".
+	URL string
+
+	// TLSConfig is used for ldaps connections and StartTLS.
+	TLSConfig *tls.Config
+
+	// StartTLS upgrades ldap:// connections with StartTLS.
+	StartTLS bool
+
+	// BindDN and BindPassword are the credentials of the service account
+	// used to search users. Leave them empty if anonymous searches are
+	// allowed.
+	BindDN, BindPassword string
+
+	// BaseDN is the DN users are searched in, for example
+	// "ou=people,dc=example,dc=com".
+	BaseDN string
+
+	// UserFilter is the filter to find a user, %s is replaced by the
+	// (escaped) username. Defaults to "(&(objectClass=person)(<UserName>=%s))".
+	UserFilter string
+
+	// Attributes are the attributes for the user information.
+	Attributes Attributes
+
+	// Shadow is the handler users are shadowed into, can be nil.
+	Shadow goauth.UserHandler
+}
+
+// NewUserHandler returns a new UserHandler with DefaultAttributes
+// and no shadow handler.
+//
+// New in version v0.7
+func NewUserHandler(url, baseDN, bindDN, bindPassword string) *UserHandler {
+	return &UserHandler{URL: url, BaseDN: baseDN, BindDN: bindDN,
+		BindPassword: bindPassword, Attributes: DefaultAttributes}
+}
+
+// NewActiveDirectoryUserHandler returns a new UserHandler using
+// ActiveDirectoryAttributes that shadows the users into shadow.
+//
+// New in version v0.7
+func NewActiveDirectoryUserHandler(url, baseDN, bindDN, bindPassword string, shadow goauth.UserHandler) *UserHandler {
+	return &UserHandler{URL: url, BaseDN: baseDN, BindDN: bindDN,
+		BindPassword: bindPassword, Attributes: ActiveDirectoryAttributes,
+		Shadow: shadow}
+}
+
+// connect opens a new connection and binds with the service account.
+func (handler *UserHandler) connect() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(handler.URL, ldap.DialWithTLSConfig(handler.TLSConfig))
+	if err != nil {
+		return nil, err
+	}
+	if handler.StartTLS {
+		if err := conn.StartTLS(handler.TLSConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if handler.BindDN != "" {
+		if err := conn.Bind(handler.BindDN, handler.BindPassword); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// filter returns the search filter with %s replaced by value, value is not
+// escaped!
+func (handler *UserHandler) filter(value string) string {
+	userFilter := handler.UserFilter
+	if userFilter == "" {
+		userFilter = fmt.Sprintf("(&(objectClass=person)(%s=%%s))", handler.Attributes.UserName)
+	}
+	return strings.Replace(userFilter, "%s", value, -1)
+}
+
+// search returns the entries matching filter.
+func (handler *UserHandler) search(conn *ldap.Conn, filter string) ([]*ldap.Entry, error) {
+	attrs := []string{handler.Attributes.UserName, handler.Attributes.FirstName,
+		handler.Attributes.LastName, handler.Attributes.Email, "userAccountControl"}
+	if handler.Attributes.ID != "" {
+		attrs = append(attrs, handler.Attributes.ID)
+	}
+	req := ldap.NewSearchRequest(handler.BaseDN, ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases, 0, 0, false, filter, attrs, nil)
+	res, err := conn.Search(req)
+	if err != nil {
+		return nil, err
+	}
+	return res.Entries, nil
+}
+
+// findUser returns the entry of the user or ErrUserNotFound.
+func (handler *UserHandler) findUser(conn *ldap.Conn, userName string) (*ldap.Entry, error) {
+	entries, err := handler.search(conn, handler.filter(ldap.EscapeFilter(userName)))
+	if err != nil {
+		return nil, err
+	}
+	switch len(entries) {
+	case 0:
+		return nil, goauth.ErrUserNotFound
+	case 1:
+		return entries[0], nil
+	default:
+		return nil, fmt.Errorf("Username %s is not unique in the directory", userName)
+	}
+}
+
+// entryInfo maps the attributes of the entry to BaseUserInformation, the ID
+// is parsed from the ID attribute (if set).
+func (handler *UserHandler) entryInfo(entry *ldap.Entry) (*goauth.BaseUserInformation, error) {
+	res := &goauth.BaseUserInformation{ID: goauth.NoUserID,
+		UserName:  entry.GetAttributeValue(handler.Attributes.UserName),
+		FirstName: entry.GetAttributeValue(handler.Attributes.FirstName),
+		LastName:  entry.GetAttributeValue(handler.Attributes.LastName),
+		Email:     entry.GetAttributeValue(handler.Attributes.Email),
+		IsActive:  true}
+	// Active Directory: bit 2 of userAccountControl is set for disabled
+	// accounts
+	if uac := entry.GetAttributeValue("userAccountControl"); uac != "" {
+		if flags, err := strconv.ParseUint(uac, 10, 32); err == nil && flags&2 != 0 {
+			res.IsActive = false
+		}
+	}
+	if handler.Attributes.ID != "" {
+		if idStr := entry.GetAttributeValue(handler.Attributes.ID); idStr != "" {
+			id, err := strconv.ParseUint(idStr, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			res.ID = id
+		}
+	}
+	return res, nil
+}
+
+// shadowUser returns the id of the user in the shadow handler, creating the
+// user if it doesn't exist yet.
+func (handler *UserHandler) shadowUser(info *goauth.BaseUserInformation) (uint64, error) {
+	id, err := handler.Shadow.GetUserID(info.UserName)
+	if err != goauth.ErrUserNotFound {
+		return id, err
+	}
+	password, err := goauth.GenRandomBase64(-1)
+	if err != nil {
+		return goauth.NoUserID, err
+	}
+	id, err = handler.Shadow.Insert(info.UserName, info.FirstName, info.LastName, info.Email, []byte(password))
+	if err != nil {
+		return goauth.NoUserID, err
+	}
+	if id == goauth.NoUserID {
+		if id, err = handler.Shadow.GetUserID(info.UserName); err != nil {
+			return goauth.NoUserID, err
+		}
+	}
+	// the password is checked by the directory, not by the shadow handler
+	if statusHandler, ok := handler.Shadow.(goauth.PasswordStatusHandler); ok {
+		if err := statusHandler.ClearPassword(info.UserName); err != nil {
+			return goauth.NoUserID, err
+		}
+	}
+	return id, nil
+}
+
+// Init initializes the shadow handler (if set).
+func (handler *UserHandler) Init() error {
+	if handler.Shadow != nil {
+		return handler.Shadow.Init()
+	}
+	return nil
+}
+
+// Insert returns ErrNotSupported, users must be created in the directory.
+func (handler *UserHandler) Insert(userName, firstName, lastName, email string, plainPW []byte) (uint64, error) {
+	return goauth.NoUserID, goauth.ErrNotSupported
+}
+
+// Validate searches the user and binds with the DN of the user and the
+// password.
+// If a shadow handler is used the user is shadowed on success.
+// It returns ErrUserInactive if the account is disabled in Active Directory
+// or the shadow user is not active (see ActiveFlagHandler).
+func (handler *UserHandler) Validate(userName string, cleartextPwCheck []byte) (uint64, error) {
+	// an empty password results in an unauthenticated bind which succeeds
+	// on many servers!
+	if len(cleartextPwCheck) == 0 {
+		return goauth.NoUserID, nil
+	}
+	conn, err := handler.connect()
+	if err != nil {
+		return goauth.NoUserID, err
+	}
+	defer conn.Close()
+	entry, err := handler.findUser(conn, userName)
+	if err != nil {
+		return goauth.NoUserID, err
+	}
+	if err := conn.Bind(entry.DN, string(cleartextPwCheck)); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return goauth.NoUserID, nil
+		}
+		return goauth.NoUserID, err
+	}
+	info, err := handler.entryInfo(entry)
+	if err != nil {
+		return goauth.NoUserID, err
+	}
+	if !info.IsActive {
+		return goauth.NoUserID, goauth.ErrUserInactive
+	}
+	if handler.Shadow != nil {
+		id, err := handler.shadowUser(info)
+		if err != nil {
+			return goauth.NoUserID, err
+		}
+		// the shadow user may be deactivated, for example by an
+		// AccountDeletionManager
+		if err := goauth.CheckActive(handler.Shadow, info.UserName); err != nil {
+			return goauth.NoUserID, err
+		}
+		return id, nil
+	}
+	if info.ID == goauth.NoUserID {
+		return goauth.NoUserID, fmt.Errorf("No %s attribute for user %s", handler.Attributes.ID, userName)
+	}
+	return info.ID, nil
+}
+
+// UpdatePassword returns ErrNotSupported, passwords must be changed in the
+// directory.
+func (handler *UserHandler) UpdatePassword(username string, plainPW []byte) error {
+	return goauth.ErrNotSupported
+}
+
+// ListUsers returns the shadowed users if a shadow handler is used and all
+// users in the directory otherwise.
+func (handler *UserHandler) ListUsers() (map[uint64]string, error) {
+	if handler.Shadow != nil {
+		return handler.Shadow.ListUsers()
+	}
+	conn, err := handler.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	entries, err := handler.search(conn, handler.filter("*"))
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[uint64]string, len(entries))
+	for _, entry := range entries {
+		info, err := handler.entryInfo(entry)
+		if err != nil {
+			return nil, err
+		}
+		if info.ID != goauth.NoUserID {
+			res[info.ID] = info.UserName
+		}
+	}
+	return res, nil
+}
+
+// GetUserName returns the username for the id.
+func (handler *UserHandler) GetUserName(id uint64) (string, error) {
+	if handler.Shadow != nil {
+		return handler.Shadow.GetUserName(id)
+	}
+	if handler.Attributes.ID == "" {
+		return "", goauth.ErrNotSupported
+	}
+	conn, err := handler.connect()
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	filter := fmt.Sprintf("(&(objectClass=person)(%s=%d))", handler.Attributes.ID, id)
+	entries, err := handler.search(conn, filter)
+	if err != nil {
+		return "", err
+	}
+	if len(entries) != 1 {
+		return "", goauth.ErrUserNotFound
+	}
+	return entries[0].GetAttributeValue(handler.Attributes.UserName), nil
+}
+
+// GetUserID returns the id for the username.
+func (handler *UserHandler) GetUserID(userName string) (uint64, error) {
+	if handler.Shadow != nil {
+		return handler.Shadow.GetUserID(userName)
+	}
+	info, err := handler.GetUserBaseInfo(userName)
+	if err != nil {
+		return goauth.NoUserID, err
+	}
+	if info.ID == goauth.NoUserID {
+		return goauth.NoUserID, fmt.Errorf("No %s attribute for user %s", handler.Attributes.ID, userName)
+	}
+	return info.ID, nil
+}
+
+// DeleteUser deletes the shadowed user. Without a shadow handler it returns
+// ErrNotSupported.
+func (handler *UserHandler) DeleteUser(username string) error {
+	if handler.Shadow != nil {
+		return handler.Shadow.DeleteUser(username)
+	}
+	return goauth.ErrNotSupported
+}
+
+// GetUserBaseInfo returns the information from the directory. If a shadow
+// handler is used the id and last login time are taken from the shadowed
+// user (if it exists).
+func (handler *UserHandler) GetUserBaseInfo(userName string) (*goauth.BaseUserInformation, error) {
+	conn, err := handler.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	entry, err := handler.findUser(conn, userName)
+	if err != nil {
+		return nil, err
+	}
+	info, err := handler.entryInfo(entry)
+	if err != nil {
+		return nil, err
+	}
+	if handler.Shadow != nil {
+		shadowInfo, err := handler.Shadow.GetUserBaseInfo(info.UserName)
+		switch err {
+		case nil:
+			info.ID = shadowInfo.ID
+			info.LastLogin = shadowInfo.LastLogin
+		case goauth.ErrUserNotFound:
+			info.ID = goauth.NoUserID
+		default:
+			return nil, err
+		}
+	}
+	return info, nil
+}
@@ -0,0 +1,337 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+// Package natsauth implements a goauth.SessionHandler over a NATS JetStream
+// key-value bucket, for systems that already run NATS and don't want to
+// operate redis only for the sessions.
+//
+// Each session is stored under "skey.<key>" and expires with the session
+// (per-key TTL, requires nats-server 2.11 and a bucket with LimitMarkerTTL
+// set, see CreateBucket). The keys of a user are indexed under
+// "usessions.<user>.<key>" with the same TTL. Keys and users are base64
+// encoded, so all session keys can be stored.
+//
+// Usage:
+//
+//	js, err := jetstream.New(nc)
+//	kv, err := natsauth.CreateBucket(ctx, js, "sessions")
+//	controller := goauth.NewSessionController(natsauth.NewSessionHandler(kv))
+//
+// Producer publishes the security events of a goauth.EventPublisher to a
+// JetStream stream, the topic is the subject:
+//
+//	publisher := goauth.NewEventPublisher(natsauth.NewProducer(js))
+package natsauth
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/FabianWe/goauth"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// CreateBucket creates (or updates) the bucket with per-key TTLs enabled.
+func CreateBucket(ctx context.Context, js jetstream.JetStream, bucket string) (jetstream.KeyValue, error) {
+	return js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{Bucket: bucket,
+		Description: "goauth sessions", LimitMarkerTTL: time.Second})
+}
+
+// SessionHandler implements goauth.SessionHandler, goauth.SessionLister and
+// goauth.HealthChecker with a JetStream key-value bucket.
+type SessionHandler struct {
+	KV jetstream.KeyValue
+
+	// SessionPrefix and UserPrefix are the prefixes of the session entries
+	// and the user index, they default to "skey." and "usessions.".
+	SessionPrefix, UserPrefix string
+
+	// ConvertUser is the function used to transform the string representation
+	// of the user identification back to its original type.
+	// The default assumes uint64.
+	ConvertUser func(val string) (interface{}, error)
+
+	// Timeout is the timeout for each operation, 0 means no timeout.
+	// See goauth.OperationTimeoutHandler.
+	Timeout time.Duration
+}
+
+var (
+	_ goauth.SessionHandler = (*SessionHandler)(nil)
+	_ goauth.SessionLister  = (*SessionHandler)(nil)
+	_ goauth.HealthChecker  = (*SessionHandler)(nil)
+)
+
+// NewSessionHandler returns a new SessionHandler for the bucket, see
+// CreateBucket.
+func NewSessionHandler(kv jetstream.KeyValue) *SessionHandler {
+	convert := func(val string) (interface{}, error) {
+		res, err := strconv.ParseUint(val, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		return res, nil
+	}
+	return &SessionHandler{KV: kv, SessionPrefix: "skey.", UserPrefix: "usessions.",
+		ConvertUser: convert}
+}
+
+// sessionEntry is the JSON value stored for each session.
+type sessionEntry struct {
+	User       string    `json:"user"`
+	Created    time.Time `json:"created"`
+	ValidUntil time.Time `json:"valid_until"`
+}
+
+// encode encodes a key or user s.t. it only contains characters allowed in
+// NATS keys.
+func encode(s string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+func (h *SessionHandler) sessionKey(key string) string {
+	return h.SessionPrefix + encode(key)
+}
+
+func (h *SessionHandler) userPrefix(user string) string {
+	return h.UserPrefix + encode(user) + "."
+}
+
+// OperationTimeout returns Timeout, see goauth.OperationTimeoutHandler.
+func (h *SessionHandler) OperationTimeout() time.Duration {
+	return h.Timeout
+}
+
+// SetOperationTimeout sets Timeout, see goauth.OperationTimeoutHandler.
+func (h *SessionHandler) SetOperationTimeout(timeout time.Duration) {
+	h.Timeout = timeout
+}
+
+// Init is a NOOP, the bucket must exist already (see CreateBucket).
+func (h *SessionHandler) Init() error {
+	return nil
+}
+
+func (h *SessionHandler) get(ctx context.Context, key string) (*sessionEntry, error) {
+	entry, err := h.KV.Get(ctx, h.sessionKey(key))
+	if err != nil {
+		if errors.Is(err, jetstream.ErrKeyNotFound) {
+			return nil, goauth.ErrKeyNotFound
+		}
+		return nil, wrapError("GetData", err)
+	}
+	res := &sessionEntry{}
+	if err := json.Unmarshal(entry.Value(), res); err != nil {
+		return nil, wrapError("GetData", err)
+	}
+	return res, nil
+}
+
+func (h *SessionHandler) GetData(key string) (*goauth.SessionKeyData, error) {
+	ctx, cancel := operationContext(context.Background(), h.Timeout)
+	defer cancel()
+	entry, err := h.get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	user, err := h.ConvertUser(entry.User)
+	if err != nil {
+		return nil, err
+	}
+	return &goauth.SessionKeyData{User: user, CreationTime: entry.Created,
+		ValidUntil: entry.ValidUntil}, nil
+}
+
+func (h *SessionHandler) CreateEntry(user goauth.UserKeyType, key string, validDuration time.Duration) (*goauth.SessionKeyData, error) {
+	ctx, cancel := operationContext(context.Background(), h.Timeout)
+	defer cancel()
+	data := goauth.CurrentTimeKeyData(user, validDuration)
+	userString := fmt.Sprintf("%v", user)
+	value, err := json.Marshal(&sessionEntry{User: userString, Created: data.CreationTime,
+		ValidUntil: data.ValidUntil})
+	if err != nil {
+		return nil, err
+	}
+	ttl := jetstream.KeyTTL(validDuration)
+	if _, err := h.KV.Create(ctx, h.sessionKey(key), value, ttl); err != nil {
+		return nil, wrapError("CreateEntry", err)
+	}
+	if _, err := h.KV.Create(ctx, h.userPrefix(userString)+encode(key), nil, ttl); err != nil {
+		// without the index entry DeleteEntriesForUser would miss the session
+		h.KV.Purge(ctx, h.sessionKey(key))
+		return nil, wrapError("CreateEntry", err)
+	}
+	return data, nil
+}
+
+// userKeys returns the session keys in the index of the user.
+func (h *SessionHandler) userKeys(ctx context.Context, op, user string) ([]string, error) {
+	prefix := h.userPrefix(user)
+	lister, err := h.KV.ListKeysFiltered(ctx, prefix+">")
+	if err != nil {
+		if errors.Is(err, jetstream.ErrNoKeysFound) {
+			return nil, nil
+		}
+		return nil, wrapError(op, err)
+	}
+	defer lister.Stop()
+	var res []string
+	for indexKey := range lister.Keys() {
+		key, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(indexKey, prefix))
+		if err != nil {
+			continue
+		}
+		res = append(res, string(key))
+	}
+	return res, nil
+}
+
+func (h *SessionHandler) DeleteEntriesForUser(user goauth.UserKeyType) (int64, error) {
+	ctx, cancel := operationContext(context.Background(), h.Timeout)
+	defer cancel()
+	userString := fmt.Sprintf("%v", user)
+	keys, err := h.userKeys(ctx, "DeleteEntriesForUser", userString)
+	if err != nil {
+		return -1, err
+	}
+	var removed int64
+	for _, key := range keys {
+		if err := h.KV.Purge(ctx, h.sessionKey(key)); err != nil {
+			return removed, wrapError("DeleteEntriesForUser", err)
+		}
+		if err := h.KV.Purge(ctx, h.userPrefix(userString)+encode(key)); err != nil {
+			return removed, wrapError("DeleteEntriesForUser", err)
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// DeleteInvalidKeys does nothing, the entries expire automatically.
+func (h *SessionHandler) DeleteInvalidKeys() (int64, error) {
+	return 0, nil
+}
+
+func (h *SessionHandler) DeleteKey(key string) error {
+	ctx, cancel := operationContext(context.Background(), h.Timeout)
+	defer cancel()
+	entry, err := h.get(ctx, key)
+	if err == goauth.ErrKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := h.KV.Purge(ctx, h.sessionKey(key)); err != nil {
+		return wrapError("DeleteKey", err)
+	}
+	return wrapError("DeleteKey", h.KV.Purge(ctx, h.userPrefix(entry.User)+encode(key)))
+}
+
+// ListSessionsForUser returns all valid sessions of the user, see
+// goauth.SessionLister.
+func (h *SessionHandler) ListSessionsForUser(user goauth.UserKeyType) (map[string]*goauth.SessionKeyData, error) {
+	ctx, cancel := operationContext(context.Background(), h.Timeout)
+	defer cancel()
+	keys, err := h.userKeys(ctx, "ListSessionsForUser", fmt.Sprintf("%v", user))
+	if err != nil {
+		return nil, err
+	}
+	now := goauth.CurrentTime()
+	res := make(map[string]*goauth.SessionKeyData, len(keys))
+	for _, key := range keys {
+		entry, err := h.get(ctx, key)
+		if err == goauth.ErrKeyNotFound {
+			// the session expired before its index entry
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if goauth.KeyValid(now, entry.ValidUntil) {
+			res[key] = &goauth.SessionKeyData{User: user, CreationTime: entry.Created,
+				ValidUntil: entry.ValidUntil}
+		}
+	}
+	return res, nil
+}
+
+// Healthy reads a key from the bucket, see goauth.HealthChecker.
+func (h *SessionHandler) Healthy(ctx context.Context) error {
+	ctx, cancel := operationContext(ctx, h.Timeout)
+	defer cancel()
+	_, err := h.KV.Get(ctx, h.SessionPrefix+"health")
+	if err != nil && !errors.Is(err, jetstream.ErrKeyNotFound) {
+		return wrapError("Healthy", err)
+	}
+	return nil
+}
+
+// Producer implements goauth.MessageProducer with JetStream, the stream for
+// the subjects must exist. The message id is used as Nats-Msg-Id, so the
+// stream drops duplicates. The key is ignored, messages of a subject are
+// always ordered.
+type Producer struct {
+	JS jetstream.JetStream
+}
+
+var _ goauth.MessageProducer = (*Producer)(nil)
+
+// NewProducer returns a new Producer.
+func NewProducer(js jetstream.JetStream) *Producer {
+	return &Producer{JS: js}
+}
+
+func (p *Producer) Publish(ctx context.Context, msg *goauth.EventMessage) error {
+	_, err := p.JS.Publish(ctx, msg.Topic, msg.Value, jetstream.WithMsgID(msg.ID))
+	return wrapError("Publish", err)
+}
+
+// operationContext returns a context with the timeout, if timeout <= 0 the
+// parent is returned.
+func operationContext(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return parent, func() {}
+	}
+	return context.WithTimeout(parent, timeout)
+}
+
+// wrapError wraps err in a *goauth.BackendError, it returns nil if err is
+// nil.
+func wrapError(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	res := &goauth.BackendError{Backend: "nats", Op: op, Err: err}
+	switch {
+	case errors.Is(err, jetstream.ErrKeyExists):
+		res.Kind = goauth.ErrDuplicateEntry
+	case errors.Is(err, context.DeadlineExceeded):
+		res.Kind = goauth.ErrBackendUnavailable
+	}
+	return res
+}
@@ -0,0 +1,423 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package oauth2auth implements logins via external OAuth2 and OpenID Connect
+// identity providers ("Login with Google") on top of golang.org/x/oauth2 and
+// github.com/coreos/go-oidc. External identities are linked with users in a
+// goauth.IdentityHandler and unknown identities can be provisioned with a
+// goauth.UserProvisioner.
+//
+// Usage:
+//
+//	google, err := oauth2auth.NewGoogleProvider(ctx, clientID, secret, redirectURL)
+//	manager := oauth2auth.NewLoginManager(controller, identities)
+//	manager.AddProvider(google)
+//
+// New in version v0.7
+package oauth2auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/FabianWe/goauth"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gorilla/sessions"
+	"golang.org/x/oauth2"
+)
+
+// ErrUnknownProvider is returned by the LoginManager if no provider
+// with the given name was registered.
+//
+// New in version v0.7
+var ErrUnknownProvider = errors.New("Unknown OAuth provider.")
+
+// ErrInvalidState is returned on a callback if the state parameter is
+// missing or doesn't match the state stored when the login was started.
+//
+// New in version v0.7
+var ErrInvalidState = errors.New("Invalid or missing OAuth state.")
+
+// Provider describes an OAuth2 or OpenID Connect provider.
+//
+// For OpenID Connect providers Verifier must be set, the user is identified
+// by the verified ID token returned with the access token.
+// For plain OAuth2 providers (GitHub for example) Verifier is nil and the
+// user is identified by requesting UserInfoURL with the access token, the
+// response is then parsed by ParseUserInfo.
+//
+// New in version v0.7
+type Provider struct {
+	// Name is the name of the provider, for example "google".
+	Name string
+
+	// Config is the OAuth2 config (client id, secret, endpoints, scopes and
+	// the redirect URL).
+	Config *oauth2.Config
+
+	// Verifier verifies ID tokens, nil for plain OAuth2 providers.
+	Verifier *oidc.IDTokenVerifier
+
+	// UserInfoURL is the URL to get the user information from, only used if
+	// Verifier is nil.
+	UserInfoURL string
+
+	// ParseUserInfo parses the response from UserInfoURL, only used if
+	// Verifier is nil.
+	ParseUserInfo func(body []byte) (*goauth.ExternalUserInfo, error)
+}
+
+// NewOIDCProvider returns a provider for a generic OpenID Connect identity
+// provider. The provider configuration is retrieved via OpenID Connect
+// discovery from issuer + "/.well-known/openid-configuration", so this
+// function performs an http request.
+// If scopes is empty "openid", "profile" and "email" are requested.
+//
+// New in version v0.7
+func NewOIDCProvider(ctx context.Context, name, issuer, clientID, clientSecret, redirectURL string, scopes ...string) (*Provider, error) {
+	provider, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		return nil, err
+	}
+	if len(scopes) == 0 {
+		scopes = []string{oidc.ScopeOpenID, "profile", "email"}
+	}
+	config := &oauth2.Config{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Endpoint:     provider.Endpoint(),
+		RedirectURL:  redirectURL,
+		Scopes:       scopes,
+	}
+	verifier := provider.Verifier(&oidc.Config{ClientID: clientID})
+	return &Provider{Name: name, Config: config, Verifier: verifier}, nil
+}
+
+// NewGoogleProvider returns a provider called "google" for Google accounts.
+//
+// New in version v0.7
+func NewGoogleProvider(ctx context.Context, clientID, clientSecret, redirectURL string) (*Provider, error) {
+	return NewOIDCProvider(ctx, "google", "https://accounts.google.com", clientID, clientSecret, redirectURL)
+}
+
+// NewGitLabProvider returns a provider called "gitlab". baseURL is the URL
+// of your GitLab instance, set it to "" to use https://gitlab.com.
+//
+// New in version v0.7
+func NewGitLabProvider(ctx context.Context, baseURL, clientID, clientSecret, redirectURL string) (*Provider, error) {
+	if baseURL == "" {
+		baseURL = "https://gitlab.com"
+	}
+	return NewOIDCProvider(ctx, "gitlab", baseURL, clientID, clientSecret, redirectURL)
+}
+
+// NewMicrosoftProvider returns a provider called "microsoft" for the
+// Microsoft identity platform.
+// tenant must be the id (or a verified domain) of your Azure AD tenant, the
+// multi-tenant endpoints such as "common" don't return a fixed issuer and
+// can't be verified.
+//
+// New in version v0.7
+func NewMicrosoftProvider(ctx context.Context, tenant, clientID, clientSecret, redirectURL string) (*Provider, error) {
+	issuer := fmt.Sprintf("https://login.microsoftonline.com/%s/v2.0", tenant)
+	return NewOIDCProvider(ctx, "microsoft", issuer, clientID, clientSecret, redirectURL)
+}
+
+// NewGitHubProvider returns a provider called "github". GitHub doesn't
+// support OpenID Connect for user logins, so the user is identified via
+// the https://api.github.com/user endpoint. The subject is the numeric
+// GitHub user id (which doesn't change when a user is renamed).
+// Note that the email is only available if the user made it public.
+//
+// New in version v0.7
+func NewGitHubProvider(clientID, clientSecret, redirectURL string) *Provider {
+	config := &oauth2.Config{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  "https://github.com/login/oauth/authorize",
+			TokenURL: "https://github.com/login/oauth/access_token",
+		},
+		RedirectURL: redirectURL,
+		Scopes:      []string{"read:user", "user:email"},
+	}
+	return &Provider{Name: "github", Config: config,
+		UserInfoURL: "https://api.github.com/user", ParseUserInfo: parseGitHubUser}
+}
+
+// parseGitHubUser parses the response of the GitHub user API.
+func parseGitHubUser(body []byte) (*goauth.ExternalUserInfo, error) {
+	var user struct {
+		ID    json.Number `json:"id"`
+		Login string      `json:"login"`
+		Name  string      `json:"name"`
+		Email string      `json:"email"`
+	}
+	if err := json.Unmarshal(body, &user); err != nil {
+		return nil, err
+	}
+	if user.ID == "" {
+		return nil, errors.New("No user id in GitHub response")
+	}
+	claims := make(map[string]interface{})
+	if err := json.Unmarshal(body, &claims); err != nil {
+		return nil, err
+	}
+	return &goauth.ExternalUserInfo{Subject: user.ID.String(), UserName: user.Login,
+		Name: user.Name, Email: user.Email, Claims: claims}, nil
+}
+
+// identify returns the information about the user that logged in at the
+// provider and obtained token.
+// nonce is the nonce that must be contained in the ID token, it's ignored
+// for plain OAuth2 providers.
+func (p *Provider) identify(ctx context.Context, token *oauth2.Token, nonce string) (*goauth.ExternalUserInfo, error) {
+	var info *goauth.ExternalUserInfo
+	if p.Verifier != nil {
+		rawIDToken, ok := token.Extra("id_token").(string)
+		if !ok {
+			return nil, errors.New("No id_token in token response")
+		}
+		idToken, err := p.Verifier.Verify(ctx, rawIDToken)
+		if err != nil {
+			return nil, err
+		}
+		if subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(nonce)) != 1 {
+			return nil, errors.New("Invalid nonce in id_token")
+		}
+		var claims struct {
+			Email             string `json:"email"`
+			EmailVerified     bool   `json:"email_verified"`
+			Name              string `json:"name"`
+			GivenName         string `json:"given_name"`
+			FamilyName        string `json:"family_name"`
+			PreferredUsername string `json:"preferred_username"`
+		}
+		if err := idToken.Claims(&claims); err != nil {
+			return nil, err
+		}
+		allClaims := make(map[string]interface{})
+		if err := idToken.Claims(&allClaims); err != nil {
+			return nil, err
+		}
+		info = &goauth.ExternalUserInfo{Subject: idToken.Subject,
+			UserName: claims.PreferredUsername, Name: claims.Name,
+			FirstName: claims.GivenName, LastName: claims.FamilyName,
+			Email: claims.Email, EmailVerified: claims.EmailVerified,
+			Claims: allClaims}
+	} else {
+		if p.UserInfoURL == "" || p.ParseUserInfo == nil {
+			return nil, fmt.Errorf("Provider %s has no way to identify users", p.Name)
+		}
+		resp, err := p.Config.Client(ctx, token).Get(p.UserInfoURL)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("User info request failed with status %d", resp.StatusCode)
+		}
+		info, err = p.ParseUserInfo(body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	info.Provider = p.Name
+	return info, nil
+}
+
+// LoginManager handles logins via external OAuth2 / OpenID Connect
+// providers ("Login with Google").
+//
+// A login works as follows: AuthCodeURL creates a random state (and nonce)
+// and stores it in a gorilla session called StateSessionName, you redirect
+// the user to the returned URL. After the login at the provider the user
+// is redirected to the RedirectURL of the provider config, there you call
+// Callback. Callback validates the state, exchanges the code for a token,
+// identifies the user at the provider, looks up the goauth user linked with
+// the identity in Identities and creates a new auth session with Controller.
+//
+// New in version v0.7
+type LoginManager struct {
+	// Providers maps the provider names to the providers.
+	Providers map[string]*Provider
+
+	// Identities stores the links between external identities and users.
+	Identities goauth.IdentityHandler
+
+	// Controller is used to create new sessions.
+	Controller *goauth.SessionController
+
+	// StateSessionName is the name of the gorilla session state and nonce
+	// are stored in, defaults to "oauth-state".
+	StateSessionName string
+
+	// SessionDuration is the duration created auth sessions are valid,
+	// defaults to 24 hours.
+	SessionDuration time.Duration
+
+	// Provisioner is used to create users for external identities that are
+	// not linked with a user yet. If it is nil (the default) such logins
+	// fail with ErrIdentityNotLinked.
+	Provisioner *goauth.UserProvisioner
+}
+
+// NewLoginManager returns a new LoginManager without any providers,
+// add them with AddProvider.
+//
+// New in version v0.7
+func NewLoginManager(controller *goauth.SessionController, identities goauth.IdentityHandler) *LoginManager {
+	return &LoginManager{Providers: make(map[string]*Provider),
+		Identities: identities, Controller: controller,
+		StateSessionName: "oauth-state", SessionDuration: 24 * time.Hour}
+}
+
+// AddProvider adds the provider (identified by its name).
+func (m *LoginManager) AddProvider(provider *Provider) {
+	m.Providers[provider.Name] = provider
+}
+
+// GetProvider returns the provider with the given name or nil and
+// ErrUnknownProvider.
+func (m *LoginManager) GetProvider(name string) (*Provider, error) {
+	provider, has := m.Providers[name]
+	if !has {
+		return nil, ErrUnknownProvider
+	}
+	return provider, nil
+}
+
+const (
+	// oauthStateKey is the key the state is stored in the state session.
+	oauthStateKey = "state"
+
+	// oauthNonceKey is the key the nonce is stored in the state session.
+	oauthNonceKey = "nonce"
+
+	// oauthProviderKey is the key the name of the provider is stored in the
+	// state session.
+	oauthProviderKey = "provider"
+)
+
+// AuthCodeURL starts a new login at the provider: It creates a new state and
+// nonce, stores them in the state session and returns the URL to redirect
+// the user to.
+// Since the user is redirected right after this call it will save the state
+// session.
+func (m *LoginManager) AuthCodeURL(w http.ResponseWriter, r *http.Request, store sessions.Store, providerName string) (string, error) {
+	provider, err := m.GetProvider(providerName)
+	if err != nil {
+		return "", err
+	}
+	state, err := goauth.GenRandomBase64(24)
+	if err != nil {
+		return "", err
+	}
+	nonce, err := goauth.GenRandomBase64(24)
+	if err != nil {
+		return "", err
+	}
+	session, err := store.Get(r, m.StateSessionName)
+	if err != nil {
+		return "", err
+	}
+	session.Values[oauthStateKey] = state
+	session.Values[oauthNonceKey] = nonce
+	session.Values[oauthProviderKey] = provider.Name
+	// the login at the provider should not take forever
+	session.Options.MaxAge = 600
+	if err := session.Save(r, w); err != nil {
+		return "", err
+	}
+	var opts []oauth2.AuthCodeOption
+	if provider.Verifier != nil {
+		opts = append(opts, oidc.Nonce(nonce))
+	}
+	return provider.Config.AuthCodeURL(state, opts...), nil
+}
+
+// Callback handles the redirect from the provider.
+// It returns the data of the new auth session, the information about the
+// user at the provider, the auth session and an error.
+//
+// If the external identity is not linked with a user and Provisioner is set
+// a new user is created. Otherwise it returns nil, the user info, nil and
+// ErrIdentityNotLinked. So you can for example ask the user to log in and
+// then link the identity.
+//
+// The state session is invalidated (MaxAge = -1) and as with
+// SessionController.CreateAuthSession the sessions are not saved, so call
+// sessions.Save(r, w) to save both of them.
+func (m *LoginManager) Callback(r *http.Request, store sessions.Store) (*goauth.SessionKeyData, *goauth.ExternalUserInfo, *sessions.Session, error) {
+	stateSession, err := store.Get(r, m.StateSessionName)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	state, _ := stateSession.Values[oauthStateKey].(string)
+	nonce, _ := stateSession.Values[oauthNonceKey].(string)
+	providerName, _ := stateSession.Values[oauthProviderKey].(string)
+	// a state can only be used once
+	delete(stateSession.Values, oauthStateKey)
+	delete(stateSession.Values, oauthNonceKey)
+	delete(stateSession.Values, oauthProviderKey)
+	stateSession.Options.MaxAge = -1
+
+	queryState := r.FormValue("state")
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(queryState)) != 1 {
+		return nil, nil, nil, ErrInvalidState
+	}
+	provider, err := m.GetProvider(providerName)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if providerErr := r.FormValue("error"); providerErr != "" {
+		return nil, nil, nil, fmt.Errorf("Provider %s returned an error: %s", provider.Name, providerErr)
+	}
+	ctx := r.Context()
+	token, err := provider.Config.Exchange(ctx, r.FormValue("code"))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	info, err := provider.identify(ctx, token, nonce)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	userID, err := goauth.ResolveExternalUser(m.Identities, m.Provisioner, info)
+	if err != nil {
+		return nil, info, nil, err
+	}
+	data, _, session, err := m.Controller.CreateAuthSession(r, store, userID, m.SessionDuration)
+	if err != nil {
+		return nil, info, session, err
+	}
+	return data, info, session, nil
+}
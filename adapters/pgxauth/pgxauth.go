@@ -0,0 +1,287 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+// Package pgxauth implements the session and user handlers of goauth
+// directly with github.com/jackc/pgx (pgxpool) for postgres, without the
+// database/sql abstraction. The handlers use the same tables and queries as
+// the postgres handlers of goauth, so you can switch between them.
+//
+// Usage:
+//
+//	pool, err := pgxpool.New(ctx, "postgres://...")
+//	sessions := pgxauth.NewSessionHandler(pool, "", "")
+//	controller := goauth.NewSessionController(sessions)
+//	users := pgxauth.NewUserHandler(pool, nil)
+//
+// In addition to goauth.SessionHandler the session handler supports batches:
+// GetDataMulti and DeleteKeys send all queries in one round trip.
+package pgxauth
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/FabianWe/goauth"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// SessionHandler implements goauth.SessionHandler, goauth.SessionLister and
+// goauth.HealthChecker with a pgxpool.Pool.
+type SessionHandler struct {
+	Pool *pgxpool.Pool
+
+	// Queries contains the postgres queries, only the query strings are
+	// used.
+	Queries *goauth.SQLSessionHandler
+
+	// Timeout is the timeout for each operation, 0 means no timeout.
+	// See goauth.OperationTimeoutHandler.
+	Timeout time.Duration
+}
+
+var (
+	_ goauth.SessionHandler     = (*SessionHandler)(nil)
+	_ goauth.SessionLister      = (*SessionHandler)(nil)
+	_ goauth.BulkSessionDeleter = (*SessionHandler)(nil)
+	_ goauth.MultiSessionGetter = (*SessionHandler)(nil)
+	_ goauth.HealthChecker      = (*SessionHandler)(nil)
+)
+
+// NewSessionHandler returns a new SessionHandler, tableName and userIDType
+// have the same meaning as in goauth.NewPostgresSessionHandler.
+func NewSessionHandler(pool *pgxpool.Pool, tableName, userIDType string) *SessionHandler {
+	if userIDType == "" {
+		userIDType = "BIGINT NOT NULL"
+	}
+	queries := goauth.NewSQLSessionHandler(nil, goauth.NewPostgresSessionTemplate(),
+		tableName, userIDType, false)
+	return &SessionHandler{Pool: pool, Queries: queries}
+}
+
+// OperationTimeout returns Timeout, see goauth.OperationTimeoutHandler.
+func (h *SessionHandler) OperationTimeout() time.Duration {
+	return h.Timeout
+}
+
+// SetOperationTimeout sets Timeout, see goauth.OperationTimeoutHandler.
+func (h *SessionHandler) SetOperationTimeout(timeout time.Duration) {
+	h.Timeout = timeout
+}
+
+func (h *SessionHandler) Init() error {
+	ctx, cancel := operationContext(context.Background(), h.Timeout)
+	defer cancel()
+	_, err := h.Pool.Exec(ctx, h.Queries.InitQ)
+	return wrapError("Init", err)
+}
+
+func (h *SessionHandler) GetData(key string) (*goauth.SessionKeyData, error) {
+	ctx, cancel := operationContext(context.Background(), h.Timeout)
+	defer cancel()
+	return scanSession(h.Pool.QueryRow(ctx, h.Queries.GetQ, key))
+}
+
+// scanSession scans the user id, creation time and valid until of a session.
+func scanSession(row pgx.Row) (*goauth.SessionKeyData, error) {
+	var uid uint64
+	var created, validUntil time.Time
+	if err := row.Scan(&uid, &created, &validUntil); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, goauth.ErrKeyNotFound
+		}
+		return nil, wrapError("GetData", err)
+	}
+	return &goauth.SessionKeyData{User: uid, CreationTime: created, ValidUntil: validUntil}, nil
+}
+
+// GetDataMulti returns the data for all keys in one batch, keys that don't
+// exist are not contained in the result.
+func (h *SessionHandler) GetDataMulti(keys []string) (map[string]*goauth.SessionKeyData, error) {
+	res := make(map[string]*goauth.SessionKeyData, len(keys))
+	if len(keys) == 0 {
+		return res, nil
+	}
+	ctx, cancel := operationContext(context.Background(), h.Timeout)
+	defer cancel()
+	batch := &pgx.Batch{}
+	for _, key := range keys {
+		batch.Queue(h.Queries.GetQ, key)
+	}
+	results := h.Pool.SendBatch(ctx, batch)
+	defer results.Close()
+	for _, key := range keys {
+		data, err := scanSession(results.QueryRow())
+		switch {
+		case err == nil:
+			res[key] = data
+		case errors.Is(err, goauth.ErrKeyNotFound):
+		default:
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+func (h *SessionHandler) CreateEntry(user goauth.UserKeyType, key string, validDuration time.Duration) (*goauth.SessionKeyData, error) {
+	ctx, cancel := operationContext(context.Background(), h.Timeout)
+	defer cancel()
+	data := goauth.CurrentTimeKeyData(user, validDuration)
+	_, err := h.Pool.Exec(ctx, h.Queries.CreateQ, user, key, data.CreationTime, data.ValidUntil)
+	if err != nil {
+		return nil, wrapError("CreateEntry", err)
+	}
+	return data, nil
+}
+
+func (h *SessionHandler) DeleteEntriesForUser(user goauth.UserKeyType) (int64, error) {
+	ctx, cancel := operationContext(context.Background(), h.Timeout)
+	defer cancel()
+	tag, err := h.Pool.Exec(ctx, h.Queries.DeleteForUserQ, user)
+	if err != nil {
+		return -1, wrapError("DeleteEntriesForUser", err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+func (h *SessionHandler) DeleteInvalidKeys() (int64, error) {
+	ctx, cancel := operationContext(context.Background(), h.Timeout)
+	defer cancel()
+	tag, err := h.Pool.Exec(ctx, h.Queries.DeleteInvalidQ, goauth.CurrentTime())
+	if err != nil {
+		return -1, wrapError("DeleteInvalidKeys", err)
+	}
+	return tag.RowsAffected(), nil
+}
+
+func (h *SessionHandler) DeleteKey(key string) error {
+	ctx, cancel := operationContext(context.Background(), h.Timeout)
+	defer cancel()
+	_, err := h.Pool.Exec(ctx, h.Queries.DeleteKeyQ, key)
+	return wrapError("DeleteKey", err)
+}
+
+// DeleteKeys removes all keys in one batch and returns the number of removed
+// keys, see goauth.BulkSessionDeleter.
+func (h *SessionHandler) DeleteKeys(keys []string) (int64, error) {
+	args := make([]interface{}, len(keys))
+	for i, key := range keys {
+		args[i] = key
+	}
+	return h.deleteBatch("DeleteKeys", h.Queries.DeleteKeyQ, args)
+}
+
+// DeleteEntriesForUsers removes all keys of the users in one batch, see
+// goauth.BulkSessionDeleter.
+func (h *SessionHandler) DeleteEntriesForUsers(users []goauth.UserKeyType) (int64, error) {
+	args := make([]interface{}, len(users))
+	for i, user := range users {
+		args[i] = user
+	}
+	return h.deleteBatch("DeleteEntriesForUsers", h.Queries.DeleteForUserQ, args)
+}
+
+// deleteBatch executes query for each argument in one batch and returns the
+// number of affected rows.
+func (h *SessionHandler) deleteBatch(op, query string, args []interface{}) (int64, error) {
+	if len(args) == 0 {
+		return 0, nil
+	}
+	ctx, cancel := operationContext(context.Background(), h.Timeout)
+	defer cancel()
+	batch := &pgx.Batch{}
+	for _, arg := range args {
+		batch.Queue(query, arg)
+	}
+	results := h.Pool.SendBatch(ctx, batch)
+	defer results.Close()
+	var num int64
+	for range args {
+		tag, err := results.Exec()
+		if err != nil {
+			return num, wrapError(op, err)
+		}
+		num += tag.RowsAffected()
+	}
+	return num, nil
+}
+
+// ListSessionsForUser returns all valid sessions of the user, see
+// goauth.SessionLister.
+func (h *SessionHandler) ListSessionsForUser(user goauth.UserKeyType) (map[string]*goauth.SessionKeyData, error) {
+	ctx, cancel := operationContext(context.Background(), h.Timeout)
+	defer cancel()
+	rows, err := h.Pool.Query(ctx, h.Queries.ListForUserQ, user, goauth.CurrentTime())
+	if err != nil {
+		return nil, wrapError("ListSessionsForUser", err)
+	}
+	defer rows.Close()
+	res := make(map[string]*goauth.SessionKeyData)
+	for rows.Next() {
+		var key string
+		var created, validUntil time.Time
+		if err := rows.Scan(&key, &created, &validUntil); err != nil {
+			return nil, wrapError("ListSessionsForUser", err)
+		}
+		res[key] = &goauth.SessionKeyData{User: user, CreationTime: created, ValidUntil: validUntil}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapError("ListSessionsForUser", err)
+	}
+	return res, nil
+}
+
+// Healthy pings the database, see goauth.HealthChecker.
+func (h *SessionHandler) Healthy(ctx context.Context) error {
+	return ping(ctx, h.Pool, h.Timeout)
+}
+
+func ping(ctx context.Context, pool *pgxpool.Pool, timeout time.Duration) error {
+	ctx, cancel := operationContext(ctx, timeout)
+	defer cancel()
+	return wrapError("Ping", pool.Ping(ctx))
+}
+
+// operationContext returns a context with the timeout, if timeout <= 0 the
+// parent is returned.
+func operationContext(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return parent, func() {}
+	}
+	return context.WithTimeout(parent, timeout)
+}
+
+// wrapError wraps err in a *goauth.BackendError, it returns nil if err is
+// nil.
+func wrapError(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	res := &goauth.BackendError{Backend: "pgx", Op: op, Err: err}
+	switch {
+	case goauth.IsDuplicateKeyError(err):
+		res.Kind = goauth.ErrDuplicateEntry
+	case errors.Is(err, context.DeadlineExceeded):
+		res.Kind = goauth.ErrBackendUnavailable
+	}
+	return res
+}
@@ -0,0 +1,255 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package pgxauth
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/FabianWe/goauth"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// UserHandler implements goauth.UserHandler and goauth.HealthChecker with a
+// pgxpool.Pool. Unlike goauth.SQLUserHandler it returns the id of inserted
+// users (with "RETURNING id").
+// PII encryption (goauth.FieldEncryptor) is not supported.
+type UserHandler struct {
+	Pool *pgxpool.Pool
+
+	// Queries contains the postgres queries.
+	Queries *goauth.SQLUserQueries
+
+	// PwHandler is used to encrypt / validate passwords.
+	PwHandler goauth.PasswordHandler
+
+	// Names is enforced in Insert, the names of deleted users are held.
+	// See goauth.UsernamePolicy.
+	Names *goauth.UsernamePolicy
+
+	// Timeout is the timeout for each operation, 0 means no timeout.
+	Timeout time.Duration
+
+	insertQuery string
+}
+
+var (
+	_ goauth.UserHandler   = (*UserHandler)(nil)
+	_ goauth.HealthChecker = (*UserHandler)(nil)
+)
+
+// NewUserHandler returns a new UserHandler, if pwHandler is nil
+// goauth.DefaultPWHandler is used.
+func NewUserHandler(pool *pgxpool.Pool, pwHandler goauth.PasswordHandler) *UserHandler {
+	if pwHandler == nil {
+		pwHandler = goauth.DefaultPWHandler
+	}
+	queries := goauth.PostgresUserQueries(pwHandler.PasswordHashLength())
+	insertQuery := strings.TrimSuffix(strings.TrimSpace(queries.InsertQuery), ";") + " RETURNING id;"
+	return &UserHandler{Pool: pool, Queries: queries, PwHandler: pwHandler,
+		insertQuery: insertQuery}
+}
+
+// OperationTimeout returns Timeout, see goauth.OperationTimeoutHandler.
+func (h *UserHandler) OperationTimeout() time.Duration {
+	return h.Timeout
+}
+
+// SetOperationTimeout sets Timeout, see goauth.OperationTimeoutHandler.
+func (h *UserHandler) SetOperationTimeout(timeout time.Duration) {
+	h.Timeout = timeout
+}
+
+func (h *UserHandler) Init() error {
+	ctx, cancel := operationContext(context.Background(), h.Timeout)
+	defer cancel()
+	_, err := h.Pool.Exec(ctx, h.Queries.InitQuery)
+	return wrapError("Init", err)
+}
+
+func (h *UserHandler) Insert(userName, firstName, lastName, email string, plainPW []byte) (uint64, error) {
+	if err := h.Names.Check(userName); err != nil {
+		return goauth.NoUserID, err
+	}
+	encrypted, err := h.PwHandler.GenerateHash(plainPW)
+	if err != nil {
+		return goauth.NoUserID, err
+	}
+	ctx, cancel := operationContext(context.Background(), h.Timeout)
+	defer cancel()
+	var id uint64
+	err = h.Pool.QueryRow(ctx, h.insertQuery, userName, firstName, lastName, email,
+		encrypted, true, goauth.CurrentTime()).Scan(&id)
+	if err != nil {
+		res := &goauth.BackendError{Backend: "pgx", Op: "Insert", Err: err}
+		if goauth.IsDuplicateKeyError(err) {
+			res.Kind = goauth.ErrDuplicateUsername
+			if strings.Contains(strings.ToLower(err.Error()), "email") {
+				res.Kind = goauth.ErrDuplicateEmail
+			}
+		}
+		return goauth.NoUserID, res
+	}
+	return id, nil
+}
+
+func (h *UserHandler) Validate(userName string, cleartextPwCheck []byte) (uint64, error) {
+	ctx, cancel := operationContext(context.Background(), h.Timeout)
+	defer cancel()
+	var id uint64
+	var hashPw []byte
+	if err := h.Pool.QueryRow(ctx, h.Queries.ValidateQuery, userName).Scan(&id, &hashPw); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return goauth.NoUserID, goauth.ErrUserNotFound
+		}
+		return goauth.NoUserID, wrapError("Validate", err)
+	}
+	if len(hashPw) == 0 {
+		return goauth.NoUserID, nil
+	}
+	ok, err := h.PwHandler.CheckPassword(hashPw, cleartextPwCheck)
+	if err != nil || !ok {
+		return goauth.NoUserID, err
+	}
+	var pending bool
+	if err := h.Pool.QueryRow(ctx, h.Queries.PendingQuery, userName).Scan(&pending); err != nil {
+		return goauth.NoUserID, wrapError("Validate", err)
+	}
+	if pending {
+		return id, goauth.ErrRegistrationPending
+	}
+	return id, nil
+}
+
+func (h *UserHandler) UpdatePassword(userName string, plainPW []byte) error {
+	encrypted, err := h.PwHandler.GenerateHash(plainPW)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := operationContext(context.Background(), h.Timeout)
+	defer cancel()
+	_, err = h.Pool.Exec(ctx, h.Queries.UpdatePasswordQuery, encrypted, userName)
+	return wrapError("UpdatePassword", err)
+}
+
+func (h *UserHandler) ListUsers() (map[uint64]string, error) {
+	ctx, cancel := operationContext(context.Background(), h.Timeout)
+	defer cancel()
+	rows, err := h.Pool.Query(ctx, h.Queries.ListUsersQuery)
+	if err != nil {
+		return nil, wrapError("ListUsers", err)
+	}
+	defer rows.Close()
+	res := make(map[uint64]string)
+	for rows.Next() {
+		var id uint64
+		var userName string
+		if err := rows.Scan(&id, &userName); err != nil {
+			return nil, wrapError("ListUsers", err)
+		}
+		res[id] = userName
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapError("ListUsers", err)
+	}
+	return res, nil
+}
+
+func (h *UserHandler) GetUserName(id uint64) (string, error) {
+	ctx, cancel := operationContext(context.Background(), h.Timeout)
+	defer cancel()
+	var userName string
+	if err := h.Pool.QueryRow(ctx, h.Queries.GetUsernameQ, id).Scan(&userName); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", goauth.ErrUserNotFound
+		}
+		return "", wrapError("GetUserName", err)
+	}
+	return userName, nil
+}
+
+func (h *UserHandler) GetUserID(userName string) (uint64, error) {
+	ctx, cancel := operationContext(context.Background(), h.Timeout)
+	defer cancel()
+	var id uint64
+	if err := h.Pool.QueryRow(ctx, h.Queries.GetIDQuery, userName).Scan(&id); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return goauth.NoUserID, goauth.ErrUserNotFound
+		}
+		return goauth.NoUserID, wrapError("GetUserID", err)
+	}
+	return id, nil
+}
+
+func (h *UserHandler) DeleteUser(userName string) error {
+	ctx, cancel := operationContext(context.Background(), h.Timeout)
+	defer cancel()
+	tag, err := h.Pool.Exec(ctx, h.Queries.DeleteUserQ, userName)
+	if err != nil {
+		return wrapError("DeleteUser", err)
+	}
+	if h.Names == nil || tag.RowsAffected() == 0 {
+		return nil
+	}
+	return h.Names.Hold(userName)
+}
+
+func (h *UserHandler) GetUserBaseInfo(userName string) (*goauth.BaseUserInformation, error) {
+	ctx, cancel := operationContext(context.Background(), h.Timeout)
+	defer cancel()
+	res := &goauth.BaseUserInformation{UserName: userName}
+	var email, displayName, avatarURL, locale, timezone *string
+	err := h.Pool.QueryRow(ctx, h.Queries.GetUserInfoQuery, userName).Scan(&res.ID,
+		&res.FirstName, &res.LastName, &email, &res.IsActive, &res.LastLogin,
+		&res.IsAdmin, &res.EmailVerified, &res.IsPending, &displayName, &avatarURL,
+		&locale, &timezone)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, goauth.ErrUserNotFound
+		}
+		return nil, wrapError("GetUserBaseInfo", err)
+	}
+	if email != nil {
+		res.Email = *email
+	}
+	if displayName != nil {
+		res.DisplayName = *displayName
+	}
+	if avatarURL != nil {
+		res.AvatarURL = *avatarURL
+	}
+	if locale != nil {
+		res.Locale = *locale
+	}
+	if timezone != nil {
+		res.Timezone = *timezone
+	}
+	return res, nil
+}
+
+// Healthy pings the database, see goauth.HealthChecker.
+func (h *UserHandler) Healthy(ctx context.Context) error {
+	return ping(ctx, h.Pool, h.Timeout)
+}
@@ -0,0 +1,202 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package promauth implements goauth.Metrics with Prometheus collectors.
+//
+// Usage:
+//
+//	metrics := promauth.NewMetrics("myapp")
+//	prometheus.MustRegister(metrics)
+//
+//	handler := goauth.NewInstrumentedSessionHandler(sessions, "redis", metrics)
+//	controller := goauth.NewSessionController(handler)
+//	controller.Metrics = metrics
+//	authHandlers.Metrics = metrics
+//	janitor.Metrics = metrics
+//	http.Handle("/metrics", promhttp.Handler())
+//
+// The following metrics are exported (with the namespace as prefix):
+//
+//	goauth_logins_total{result}
+//	goauth_session_validation_failures_total{reason}
+//	goauth_backend_operation_duration_seconds{backend, op}
+//	goauth_backend_errors_total{backend, op}
+//	goauth_janitor_removed_total{task}
+//	goauth_janitor_errors_total{task}
+//
+// NewVerificationBudgetCollector exports the saturation of a
+// goauth.VerificationBudget:
+//
+//	goauth_password_verifications_in_flight
+//	goauth_password_verifications_capacity
+//	goauth_password_verifications_waiting
+//	goauth_password_verifications_rejected_total
+//
+// New in version v0.7
+package promauth
+
+import (
+	"time"
+
+	"github.com/FabianWe/goauth"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics implements goauth.Metrics and prometheus.Collector.
+type Metrics struct {
+	Logins             *prometheus.CounterVec
+	ValidationFailures *prometheus.CounterVec
+	BackendDuration    *prometheus.HistogramVec
+	BackendErrors      *prometheus.CounterVec
+	JanitorRemoved     *prometheus.CounterVec
+	JanitorErrors      *prometheus.CounterVec
+}
+
+var _ goauth.Metrics = (*Metrics)(nil)
+
+// NewMetrics returns new Metrics, namespace is the Prometheus namespace of
+// all metrics (may be empty).
+func NewMetrics(namespace string) *Metrics {
+	return &Metrics{
+		Logins: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "goauth", Name: "logins_total",
+			Help: "Number of login attempts by result.",
+		}, []string{"result"}),
+		ValidationFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "goauth", Name: "session_validation_failures_total",
+			Help: "Number of failed session validations by reason.",
+		}, []string{"reason"}),
+		BackendDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace, Subsystem: "goauth", Name: "backend_operation_duration_seconds",
+			Help:    "Latency of backend operations.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"backend", "op"}),
+		BackendErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "goauth", Name: "backend_errors_total",
+			Help: "Number of failed backend operations.",
+		}, []string{"backend", "op"}),
+		JanitorRemoved: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "goauth", Name: "janitor_removed_total",
+			Help: "Number of entries removed by janitor tasks.",
+		}, []string{"task"}),
+		JanitorErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "goauth", Name: "janitor_errors_total",
+			Help: "Number of failed janitor task runs.",
+		}, []string{"task"}),
+	}
+}
+
+func (m *Metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{m.Logins, m.ValidationFailures, m.BackendDuration,
+		m.BackendErrors, m.JanitorRemoved, m.JanitorErrors}
+}
+
+// Describe implements prometheus.Collector.
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range m.collectors() {
+		c.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range m.collectors() {
+		c.Collect(ch)
+	}
+}
+
+// LoginAttempt implements goauth.Metrics.
+func (m *Metrics) LoginAttempt(result string) {
+	m.Logins.WithLabelValues(result).Inc()
+}
+
+// ValidationFailed implements goauth.Metrics.
+func (m *Metrics) ValidationFailed(reason string) {
+	m.ValidationFailures.WithLabelValues(reason).Inc()
+}
+
+// ObserveBackend implements goauth.Metrics.
+func (m *Metrics) ObserveBackend(backend, op string, duration time.Duration, err error) {
+	m.BackendDuration.WithLabelValues(backend, op).Observe(duration.Seconds())
+	if err != nil {
+		m.BackendErrors.WithLabelValues(backend, op).Inc()
+	}
+}
+
+// JanitorRun implements goauth.Metrics.
+func (m *Metrics) JanitorRun(task string, removed int64, err error) {
+	if err != nil {
+		m.JanitorErrors.WithLabelValues(task).Inc()
+		return
+	}
+	m.JanitorRemoved.WithLabelValues(task).Add(float64(removed))
+}
+
+// VerificationBudgetCollector exports the saturation of a
+// goauth.VerificationBudget, it implements prometheus.Collector.
+type VerificationBudgetCollector struct {
+	InFlight prometheus.GaugeFunc
+	Capacity prometheus.GaugeFunc
+	Waiting  prometheus.GaugeFunc
+	Rejected prometheus.CounterFunc
+}
+
+// NewVerificationBudgetCollector returns a new collector for the budget,
+// namespace is the Prometheus namespace of all metrics (may be empty).
+func NewVerificationBudgetCollector(namespace string, budget *goauth.VerificationBudget) *VerificationBudgetCollector {
+	return &VerificationBudgetCollector{
+		InFlight: prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace, Subsystem: "goauth", Name: "password_verifications_in_flight",
+			Help: "Number of password hash computations in progress.",
+		}, func() float64 { return float64(budget.Stats().InFlight) }),
+		Capacity: prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace, Subsystem: "goauth", Name: "password_verifications_capacity",
+			Help: "Maximum number of concurrent password hash computations.",
+		}, func() float64 { return float64(budget.Stats().Capacity) }),
+		Waiting: prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace, Subsystem: "goauth", Name: "password_verifications_waiting",
+			Help: "Number of password hash computations waiting for a slot.",
+		}, func() float64 { return float64(budget.Stats().Waiting) }),
+		Rejected: prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "goauth", Name: "password_verifications_rejected_total",
+			Help: "Number of password hash computations rejected because the budget was exhausted.",
+		}, func() float64 { return float64(budget.Stats().Rejected) }),
+	}
+}
+
+func (c *VerificationBudgetCollector) collectors() []prometheus.Collector {
+	return []prometheus.Collector{c.InFlight, c.Capacity, c.Waiting, c.Rejected}
+}
+
+// Describe implements prometheus.Collector.
+func (c *VerificationBudgetCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, collector := range c.collectors() {
+		collector.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (c *VerificationBudgetCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, collector := range c.collectors() {
+		collector.Collect(ch)
+	}
+}
@@ -0,0 +1,271 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package samlauth makes an application a SAML 2.0 service provider on top of
+// github.com/crewjam/saml, the subjects of the assertions are linked with
+// users in a goauth.IdentityHandler in the same way as the logins of the
+// oauth2auth adapter.
+//
+// New in version v0.7
+package samlauth
+
+import (
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/FabianWe/goauth"
+	"github.com/crewjam/saml"
+	"github.com/gorilla/sessions"
+)
+
+// ErrNoRequest is returned by the ServiceProvider if an assertion
+// is received but no authentication request was started before (and
+// IdP-initiated logins are not allowed).
+//
+// New in version v0.7
+var ErrNoRequest = errors.New("No pending SAML authentication request.")
+
+// Attribute names that are used to fill the ExternalUserInfo from a SAML
+// assertion. Identity providers use different names, the first one found is
+// used.
+var (
+	samlEmailAttributes = []string{"email", "mail", "emailAddress",
+		"urn:oid:0.9.2342.19200300.100.1.3",
+		"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress"}
+	samlUserNameAttributes = []string{"uid", "username", "sAMAccountName",
+		"urn:oid:0.9.2342.19200300.100.1.1",
+		"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/name"}
+	samlFirstNameAttributes = []string{"givenName", "firstName",
+		"urn:oid:2.5.4.42",
+		"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/givenname"}
+	samlLastNameAttributes = []string{"sn", "surname", "lastName",
+		"urn:oid:2.5.4.4",
+		"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/surname"}
+	samlNameAttributes = []string{"displayName", "cn", "urn:oid:2.16.840.1.113730.3.1.241"}
+)
+
+// ServiceProvider makes your application a SAML 2.0 service provider,
+// users then log in at the identity provider of their organization and the
+// identity provider sends a signed assertion back that results in a goauth
+// session.
+//
+// The SAML details (metadata, signing and validation of signatures, audience
+// and conditions) are handled by SP, a github.com/crewjam/saml
+// ServiceProvider. You have to configure it with your key and certificate,
+// the URLs of your metadata and assertion consumer service (ACS) endpoint
+// and the metadata of the identity provider.
+//
+// A login works similar to the LoginManager of the oauth2auth adapter:
+// AuthnRequestURL creates an authentication request, stores its id in a
+// gorilla session called RequestSessionName and returns the URL to redirect
+// the user to. The identity provider then posts the response to the ACS URL,
+// there you call ACS.
+// The NameID of the assertion is used as the subject of the external
+// identity, so make sure your identity provider uses a persistent NameID
+// format.
+//
+// New in version v0.7
+type ServiceProvider struct {
+	// SP is the underlying service provider.
+	SP *saml.ServiceProvider
+
+	// ProviderName is the name used in the IdentityHandler for identities
+	// from this identity provider, defaults to "saml".
+	ProviderName string
+
+	// Identities stores the links between SAML subjects and users.
+	Identities goauth.IdentityHandler
+
+	// Provisioner is used to create users for unknown subjects, if nil
+	// unknown subjects result in ErrIdentityNotLinked.
+	Provisioner *goauth.UserProvisioner
+
+	// Controller is used to create new sessions.
+	Controller *goauth.SessionController
+
+	// RequestSessionName is the name of the gorilla session the id of the
+	// request is stored in, defaults to "saml-request".
+	RequestSessionName string
+
+	// SessionDuration is the duration created auth sessions are valid,
+	// defaults to 24 hours.
+	SessionDuration time.Duration
+}
+
+// NewServiceProvider returns a new ServiceProvider.
+//
+// New in version v0.7
+func NewServiceProvider(sp *saml.ServiceProvider, controller *goauth.SessionController, identities goauth.IdentityHandler) *ServiceProvider {
+	return &ServiceProvider{SP: sp, ProviderName: "saml",
+		Identities: identities, Controller: controller,
+		RequestSessionName: "saml-request", SessionDuration: 24 * time.Hour}
+}
+
+// Metadata returns the XML metadata of the service provider, give this to
+// the administrator of the identity provider.
+func (p *ServiceProvider) Metadata() ([]byte, error) {
+	return xml.MarshalIndent(p.SP.Metadata(), "", "  ")
+}
+
+// ServeMetadata is a http.HandlerFunc that serves the metadata, mount it at
+// the metadata URL of the service provider.
+func (p *ServiceProvider) ServeMetadata(w http.ResponseWriter, r *http.Request) {
+	metadata, err := p.Metadata()
+	if err != nil {
+		http.Error(w, "Can't create metadata", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	w.Write(metadata)
+}
+
+const (
+	// samlRequestIDKey is the key the request id is stored in the request
+	// session.
+	samlRequestIDKey = "id"
+)
+
+// AuthnRequestURL creates a new authentication request and returns the URL
+// (HTTP-Redirect binding) to redirect the user to.
+// The id of the request is stored in the request session which is saved.
+// relayState is returned unchanged by the identity provider, you can use it
+// to remember where the user should be redirected after the login.
+func (p *ServiceProvider) AuthnRequestURL(w http.ResponseWriter, r *http.Request, store sessions.Store, relayState string) (string, error) {
+	idpURL := p.SP.GetSSOBindingLocation(saml.HTTPRedirectBinding)
+	if idpURL == "" {
+		return "", errors.New("Identity provider doesn't support the HTTP-Redirect binding")
+	}
+	req, err := p.SP.MakeAuthenticationRequest(idpURL, saml.HTTPRedirectBinding, saml.HTTPPostBinding)
+	if err != nil {
+		return "", err
+	}
+	redirectURL, err := req.Redirect(relayState, p.SP)
+	if err != nil {
+		return "", err
+	}
+	session, err := store.Get(r, p.RequestSessionName)
+	if err != nil {
+		return "", err
+	}
+	session.Values[samlRequestIDKey] = req.ID
+	session.Options.MaxAge = 600
+	if err := session.Save(r, w); err != nil {
+		return "", err
+	}
+	return redirectURL.String(), nil
+}
+
+// ACS handles a response posted by the identity provider to the assertion
+// consumer service URL.
+// The response is validated (signature, audience, conditions, the id of the
+// request it responds to) and the subject is mapped to a user in the same
+// way as in oauth2auth.LoginManager.Callback, see there for the returned
+// values.
+// The relay state is available as r.FormValue("RelayState").
+//
+// As with oauth2auth.LoginManager.Callback the sessions are not saved, call
+// sessions.Save(r, w).
+func (p *ServiceProvider) ACS(r *http.Request, store sessions.Store) (*goauth.SessionKeyData, *goauth.ExternalUserInfo, *sessions.Session, error) {
+	requestSession, err := store.Get(r, p.RequestSessionName)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	requestID, _ := requestSession.Values[samlRequestIDKey].(string)
+	delete(requestSession.Values, samlRequestIDKey)
+	requestSession.Options.MaxAge = -1
+	var possibleIDs []string
+	if requestID != "" {
+		possibleIDs = append(possibleIDs, requestID)
+	} else if !p.SP.AllowIDPInitiated {
+		return nil, nil, nil, ErrNoRequest
+	}
+	assertion, err := p.SP.ParseResponse(r, possibleIDs)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	info, err := p.userInfo(assertion)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	userID, err := goauth.ResolveExternalUser(p.Identities, p.Provisioner, info)
+	if err != nil {
+		return nil, info, nil, err
+	}
+	data, _, session, err := p.Controller.CreateAuthSession(r, store, userID, p.SessionDuration)
+	if err != nil {
+		return nil, info, session, err
+	}
+	return data, info, session, nil
+}
+
+// userInfo creates the ExternalUserInfo from a (validated) assertion.
+// All attributes are stored in the claims, for attributes with multiple
+// values a []string is stored.
+func (p *ServiceProvider) userInfo(assertion *saml.Assertion) (*goauth.ExternalUserInfo, error) {
+	if assertion.Subject == nil || assertion.Subject.NameID == nil || assertion.Subject.NameID.Value == "" {
+		return nil, errors.New("SAML assertion has no subject")
+	}
+	claims := make(map[string]interface{})
+	for _, statement := range assertion.AttributeStatements {
+		for _, attr := range statement.Attributes {
+			values := make([]string, len(attr.Values))
+			for i, value := range attr.Values {
+				values[i] = value.Value
+			}
+			var claim interface{} = values
+			if len(values) == 1 {
+				claim = values[0]
+			}
+			claims[attr.Name] = claim
+			if attr.FriendlyName != "" {
+				claims[attr.FriendlyName] = claim
+			}
+		}
+	}
+	info := &goauth.ExternalUserInfo{Provider: p.ProviderName,
+		Subject:   assertion.Subject.NameID.Value,
+		UserName:  samlClaim(claims, samlUserNameAttributes),
+		Name:      samlClaim(claims, samlNameAttributes),
+		FirstName: samlClaim(claims, samlFirstNameAttributes),
+		LastName:  samlClaim(claims, samlLastNameAttributes),
+		Email:     samlClaim(claims, samlEmailAttributes),
+		Claims:    claims}
+	return info, nil
+}
+
+// samlClaim returns the first value for the first name in names that is
+// contained in claims.
+func samlClaim(claims map[string]interface{}, names []string) string {
+	for _, name := range names {
+		switch value := claims[name].(type) {
+		case string:
+			return value
+		case []string:
+			if len(value) > 0 {
+				return value[0]
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,97 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package sqlxauth creates the SQL handlers of goauth for an existing
+// *sqlx.DB, so goauth shares the connection pool of the application. The
+// dialect is chosen by the driver name of the database.
+//
+// Usage:
+//
+//	db := sqlx.MustConnect("postgres", dsn)
+//	sessions, err := sqlxauth.NewSessionHandler(db, "", "")
+//	users, err := sqlxauth.NewUserHandler(db, nil)
+//
+// New in version v0.7
+package sqlxauth
+
+import (
+	"fmt"
+
+	"github.com/FabianWe/goauth"
+	"github.com/jmoiron/sqlx"
+)
+
+// Dialects of goauth.
+const (
+	MySQL    = "mysql"
+	Postgres = "postgres"
+	SQLite3  = "sqlite3"
+)
+
+// Dialect returns the goauth dialect for the driver of the database.
+func Dialect(db *sqlx.DB) (string, error) {
+	switch name := db.DriverName(); name {
+	case "mysql":
+		return MySQL, nil
+	case "postgres", "pgx", "pgx/v5":
+		return Postgres, nil
+	case "sqlite3", "sqlite":
+		return SQLite3, nil
+	default:
+		return "", fmt.Errorf("Unsupported driver for goauth: %s", name)
+	}
+}
+
+// NewSessionHandler returns a new goauth.SQLSessionHandler for the database,
+// tableName and userIDType have the same meaning as in
+// goauth.NewMySQLSessionHandler.
+func NewSessionHandler(db *sqlx.DB, tableName, userIDType string) (*goauth.SQLSessionHandler, error) {
+	dialect, err := Dialect(db)
+	if err != nil {
+		return nil, err
+	}
+	switch dialect {
+	case MySQL:
+		return goauth.NewMySQLSessionHandler(db.DB, tableName, userIDType), nil
+	case Postgres:
+		return goauth.NewPostgresSessionHandler(db.DB, tableName, userIDType), nil
+	default:
+		return goauth.NewSQLite3SessionHandler(db.DB, tableName, userIDType), nil
+	}
+}
+
+// NewUserHandler returns a new goauth.SQLUserHandler for the database, if
+// pwHandler is nil goauth.DefaultPWHandler is used.
+func NewUserHandler(db *sqlx.DB, pwHandler goauth.PasswordHandler) (*goauth.SQLUserHandler, error) {
+	dialect, err := Dialect(db)
+	if err != nil {
+		return nil, err
+	}
+	switch dialect {
+	case MySQL:
+		return goauth.NewMySQLUserHandler(db.DB, pwHandler), nil
+	case Postgres:
+		return goauth.NewPostgresUserHandler(db.DB, pwHandler), nil
+	default:
+		return goauth.NewSQLite3UserHandler(db.DB, pwHandler), nil
+	}
+}
@@ -0,0 +1,168 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+// Package tikvauth implements goauth.OrderedKV with the transactional API
+// of TiKV, so goauth.KVSessionHandler and goauth.KVUserHandler store the
+// sessions and users in TiKV. This is meant for very large deployments that
+// need horizontally scalable and strongly consistent session storage.
+//
+// Usage:
+//
+//	client, err := txnkv.NewClient([]string{"127.0.0.1:2379"})
+//	kv := tikvauth.NewKV(client)
+//	controller := goauth.NewSessionController(goauth.NewKVSessionHandler(kv))
+//	users := goauth.NewKVUserHandler(kv, nil)
+package tikvauth
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/FabianWe/goauth"
+	tikverr "github.com/tikv/client-go/v2/error"
+	"github.com/tikv/client-go/v2/txnkv"
+	"github.com/tikv/client-go/v2/txnkv/transaction"
+)
+
+// KV implements goauth.OrderedKV with a TiKV transaction client.
+type KV struct {
+	Client *txnkv.Client
+
+	// Retries is the number of times Update is retried after a write
+	// conflict, defaults to 3.
+	Retries int
+
+	// Timeout is the timeout for each transaction, 0 means no timeout.
+	Timeout time.Duration
+}
+
+var _ goauth.OrderedKV = (*KV)(nil)
+
+// NewKV returns a new KV.
+func NewKV(client *txnkv.Client) *KV {
+	return &KV{Client: client, Retries: 3}
+}
+
+// run runs fn in a new transaction and commits it if commit is true. It
+// returns the error of fn and the error of the transaction separately.
+func (kv *KV) run(fn func(txn goauth.KVTxn) error, commit bool) (error, error) {
+	ctx, cancel := operationContext(context.Background(), kv.Timeout)
+	defer cancel()
+	tikvTxn, err := kv.Client.Begin()
+	if err != nil {
+		return nil, err
+	}
+	if err := fn(&txn{ctx: ctx, txn: tikvTxn}); err != nil {
+		tikvTxn.Rollback()
+		return err, nil
+	}
+	if !commit {
+		return nil, tikvTxn.Rollback()
+	}
+	return nil, tikvTxn.Commit(ctx)
+}
+
+func (kv *KV) Update(fn func(txn goauth.KVTxn) error) error {
+	var fnErr, err error
+	for attempt := 0; attempt <= kv.Retries; attempt++ {
+		fnErr, err = kv.run(fn, true)
+		if !tikverr.IsErrWriteConflict(err) {
+			break
+		}
+	}
+	if fnErr != nil {
+		return fnErr
+	}
+	return wrapError("Update", err)
+}
+
+func (kv *KV) View(fn func(txn goauth.KVTxn) error) error {
+	fnErr, err := kv.run(fn, false)
+	if fnErr != nil {
+		return fnErr
+	}
+	return wrapError("View", err)
+}
+
+// txn implements goauth.KVTxn.
+type txn struct {
+	ctx context.Context
+	txn *transaction.KVTxn
+}
+
+func (t *txn) Get(key []byte) ([]byte, error) {
+	value, err := t.txn.Get(t.ctx, key)
+	if tikverr.IsErrNotFound(err) {
+		return nil, goauth.ErrKVNotFound
+	}
+	if err != nil {
+		return nil, wrapError("Get", err)
+	}
+	return value, nil
+}
+
+func (t *txn) Set(key, value []byte) error {
+	return wrapError("Set", t.txn.Set(key, value))
+}
+
+func (t *txn) Delete(key []byte) error {
+	return wrapError("Delete", t.txn.Delete(key))
+}
+
+func (t *txn) Scan(start, end []byte, limit int) ([]goauth.KVPair, error) {
+	it, err := t.txn.Iter(start, end)
+	if err != nil {
+		return nil, wrapError("Scan", err)
+	}
+	defer it.Close()
+	var res []goauth.KVPair
+	for it.Valid() && (limit <= 0 || len(res) < limit) {
+		res = append(res, goauth.KVPair{Key: append([]byte(nil), it.Key()...),
+			Value: append([]byte(nil), it.Value()...)})
+		if err := it.Next(); err != nil {
+			return nil, wrapError("Scan", err)
+		}
+	}
+	return res, nil
+}
+
+// operationContext returns a context with the timeout, if timeout <= 0 the
+// parent is returned.
+func operationContext(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return parent, func() {}
+	}
+	return context.WithTimeout(parent, timeout)
+}
+
+// wrapError wraps err in a *goauth.BackendError, it returns nil if err is
+// nil.
+func wrapError(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	res := &goauth.BackendError{Backend: "tikv", Op: op, Err: err}
+	if errors.Is(err, context.DeadlineExceeded) {
+		res.Kind = goauth.ErrBackendUnavailable
+	}
+	return res
+}
@@ -0,0 +1,470 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// AdminUser is the representation of a user in the AdminAPI.
+type AdminUser struct {
+	ID            uint64    `json:"id"`
+	UserName      string    `json:"username"`
+	FirstName     string    `json:"first_name"`
+	LastName      string    `json:"last_name"`
+	Email         string    `json:"email"`
+	LastLogin     time.Time `json:"last_login"`
+	IsActive      bool      `json:"is_active"`
+	IsAdmin       bool      `json:"is_admin"`
+	EmailVerified bool      `json:"email_verified"`
+}
+
+// NewAdminUser converts a BaseUserInformation to an AdminUser.
+func NewAdminUser(info *BaseUserInformation) *AdminUser {
+	return &AdminUser{ID: info.ID, UserName: info.UserName,
+		FirstName: info.FirstName, LastName: info.LastName, Email: info.Email,
+		LastLogin: info.LastLogin, IsActive: info.IsActive, IsAdmin: info.IsAdmin,
+		EmailVerified: info.EmailVerified}
+}
+
+// AdminSession is the representation of a session in the AdminAPI, it
+// contains the SessionID and never the key itself.
+type AdminSession struct {
+	ID         string    `json:"id"`
+	Created    time.Time `json:"created"`
+	ValidUntil time.Time `json:"valid_until"`
+}
+
+// AdminFlagRequest is the body of a request that changes the admin flag.
+type AdminFlagRequest struct {
+	IsAdmin bool `json:"is_admin"`
+}
+
+// AdminRenameRequest is the body of a request that renames a user.
+type AdminRenameRequest struct {
+	UserName string `json:"username"`
+}
+
+// AdminPasswordRequest is the body of a password reset in the AdminAPI.
+type AdminPasswordRequest struct {
+	Password string `json:"password"`
+	// RevokeSessions ends all sessions of the user.
+	RevokeSessions bool `json:"revoke_sessions"`
+}
+
+// AdminAPI is a JSON REST API to manage users and their sessions, mount it
+// with http.StripPrefix:
+//
+//	api := goauth.NewAdminAPI(users, controller, isAdmin)
+//	http.Handle("/admin/", http.StripPrefix("/admin", api))
+//
+// The routes are:
+//
+//	GET    /users                       list all users (id -> username)
+//	POST   /users                       create a user (see AuthRequest)
+//	GET    /users/{name}                get a user
+//	DELETE /users/{name}                delete a user and end its sessions
+//	POST   /users/{name}/password       set a new password (see AdminPasswordRequest)
+//	PUT    /users/{name}/admin          set the admin flag (see AdminFlagRequest)
+//	PUT    /users/{name}/name           rename a user (see AdminRenameRequest)
+//	GET    /users/{name}/sessions       list the sessions of a user
+//	DELETE /users/{name}/sessions       end all sessions of a user
+//	DELETE /users/{name}/sessions/{id}  end a single session
+//
+// Request bodies must be JSON with the content type application/json (up
+// to 64 KiB), other requests are rejected with 415.
+//
+// Sessions are expected to store the id of the user as uint64 (as
+// AuthHandlers does). Listing sessions requires a SessionHandler that
+// implements SessionLister.
+//
+// New in version v0.7
+type AdminAPI struct {
+	Users      UserHandler
+	Controller *SessionController
+
+	// Authorize is called for each request and must return true if the
+	// request is made by an administrator. If it is nil all requests are
+	// denied. NewAdminAPI uses AdminUserAuthorizer if no function is given.
+	Authorize func(r *http.Request) bool
+
+	// Notifier gets notified about password changes and revoked sessions,
+	// may be nil.
+	Notifier SecurityNotifier
+
+	// Render and RenderError write the responses, see AuthHandlers.
+	Render      func(w http.ResponseWriter, r *http.Request, status int, value interface{})
+	RenderError func(w http.ResponseWriter, r *http.Request, status int, err error)
+}
+
+// NewAdminAPI returns a new AdminAPI that renders JSON.
+// If authorize is nil AdminUserAuthorizer(users) is used.
+func NewAdminAPI(users UserHandler, controller *SessionController, authorize func(r *http.Request) bool) *AdminAPI {
+	if authorize == nil {
+		authorize = AdminUserAuthorizer(users)
+	}
+	return &AdminAPI{Users: users, Controller: controller, Authorize: authorize,
+		Render: RenderJSON, RenderError: RenderJSONError}
+}
+
+// AdminUserAuthorizer returns an authorization function for AdminAPI that
+// allows requests of users with the admin flag (BaseUserInformation.IsAdmin).
+// The user is taken from the request context, so the API must be wrapped by
+// a session middleware.
+//
+// New in version v0.7
+func AdminUserAuthorizer(users UserHandler) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		id, ok := UserIDFromContext(r.Context())
+		if !ok {
+			return false
+		}
+		isAdmin, err := IsAdminUser(users, id)
+		if err != nil {
+			if err != ErrUserNotFound {
+				log.WithError(err).Error("goauth: Can't check admin flag")
+			}
+			return false
+		}
+		return isAdmin
+	}
+}
+
+// userError renders err with a matching status code.
+func (a *AdminAPI) userError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, ErrUserNotFound):
+		a.RenderError(w, r, http.StatusNotFound, err)
+	case errors.Is(err, ErrNotSupported):
+		a.RenderError(w, r, http.StatusNotImplemented, err)
+	case errors.Is(err, ErrDuplicateUsername), errors.Is(err, ErrDuplicateEmail),
+		errors.Is(err, ErrUsernameReserved):
+		a.RenderError(w, r, http.StatusConflict, err)
+	case errors.Is(err, ErrBackendUnavailable):
+		a.RenderError(w, r, http.StatusServiceUnavailable, err)
+	default:
+		a.RenderError(w, r, http.StatusInternalServerError, err)
+	}
+}
+
+func (a *AdminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if a.Authorize == nil || !a.Authorize(r) {
+		a.RenderError(w, r, http.StatusForbidden, errors.New("Admin permission required."))
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if parts[0] != "users" {
+		a.RenderError(w, r, http.StatusNotFound, errors.New("Not found."))
+		return
+	}
+	route := ""
+	switch {
+	case len(parts) == 1:
+		route = "users"
+	case len(parts) == 2:
+		route = "user"
+	case len(parts) == 3 && parts[2] == "password":
+		route = "password"
+	case len(parts) == 3 && parts[2] == "admin":
+		route = "admin"
+	case len(parts) == 3 && parts[2] == "name":
+		route = "name"
+	case len(parts) == 3 && parts[2] == "sessions":
+		route = "sessions"
+	case len(parts) == 4 && parts[2] == "sessions":
+		route = "session"
+	}
+	switch route + " " + r.Method {
+	case "users GET":
+		a.listUsers(w, r)
+	case "users POST":
+		a.createUser(w, r)
+	case "user GET":
+		a.getUser(w, r, parts[1])
+	case "user DELETE":
+		a.deleteUser(w, r, parts[1])
+	case "password POST":
+		a.setPassword(w, r, parts[1])
+	case "admin PUT":
+		a.setAdmin(w, r, parts[1])
+	case "name PUT":
+		a.renameUser(w, r, parts[1])
+	case "sessions GET":
+		a.listSessions(w, r, parts[1])
+	case "sessions DELETE":
+		a.revokeSessions(w, r, parts[1], "")
+	case "session DELETE":
+		a.revokeSessions(w, r, parts[1], parts[3])
+	default:
+		if route == "" {
+			a.RenderError(w, r, http.StatusNotFound, errors.New("Not found."))
+		} else {
+			a.RenderError(w, r, http.StatusMethodNotAllowed, errors.New("Method not allowed."))
+		}
+	}
+}
+
+// decode decodes the JSON body of the request into v. The body must have
+// the content type application/json: A cross-site form can't send it
+// without a CORS preflight, so the session cookie of an administrator
+// can't be abused. If the body can't be decoded an error is rendered and
+// false is returned.
+func (a *AdminAPI) decode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		a.RenderError(w, r, http.StatusUnsupportedMediaType, errors.New("Content-Type must be application/json."))
+		return false
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBody)).Decode(v); err != nil {
+		a.RenderError(w, r, http.StatusBadRequest, err)
+		return false
+	}
+	return true
+}
+
+func (a *AdminAPI) listUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := a.Users.ListUsers()
+	if err != nil {
+		a.userError(w, r, err)
+		return
+	}
+	a.Render(w, r, http.StatusOK, users)
+}
+
+func (a *AdminAPI) createUser(w http.ResponseWriter, r *http.Request) {
+	var req AuthRequest
+	if !a.decode(w, r, &req) {
+		return
+	}
+	if req.UserName == "" || req.Password == "" {
+		a.RenderError(w, r, http.StatusBadRequest, errors.New("Username and password are required."))
+		return
+	}
+	if _, err := a.Users.GetUserID(req.UserName); err == nil {
+		a.RenderError(w, r, http.StatusConflict, ErrDuplicateUsername)
+		return
+	} else if err != ErrUserNotFound {
+		a.userError(w, r, err)
+		return
+	}
+	if _, err := a.Users.Insert(req.UserName, req.FirstName, req.LastName, req.Email, []byte(req.Password)); err != nil {
+		a.userError(w, r, err)
+		return
+	}
+	info, err := a.Users.GetUserBaseInfo(req.UserName)
+	if err != nil {
+		a.userError(w, r, err)
+		return
+	}
+	a.Render(w, r, http.StatusCreated, NewAdminUser(info))
+}
+
+func (a *AdminAPI) getUser(w http.ResponseWriter, r *http.Request, userName string) {
+	info, err := a.Users.GetUserBaseInfo(userName)
+	if err != nil {
+		a.userError(w, r, err)
+		return
+	}
+	a.Render(w, r, http.StatusOK, NewAdminUser(info))
+}
+
+func (a *AdminAPI) deleteUser(w http.ResponseWriter, r *http.Request, userName string) {
+	id, err := a.Users.GetUserID(userName)
+	if err != nil {
+		a.userError(w, r, err)
+		return
+	}
+	if _, err := a.Controller.DeleteEntriesForUser(id); err != nil {
+		a.userError(w, r, err)
+		return
+	}
+	if err := a.Users.DeleteUser(userName); err != nil {
+		a.userError(w, r, err)
+		return
+	}
+	a.Render(w, r, http.StatusOK, &AuthResponse{Status: "ok", UserID: id, UserName: userName})
+}
+
+func (a *AdminAPI) setPassword(w http.ResponseWriter, r *http.Request, userName string) {
+	var req AdminPasswordRequest
+	if !a.decode(w, r, &req) {
+		return
+	}
+	if req.Password == "" {
+		a.RenderError(w, r, http.StatusBadRequest, errors.New("Password is required."))
+		return
+	}
+	id, err := a.Users.GetUserID(userName)
+	if err != nil {
+		a.userError(w, r, err)
+		return
+	}
+	if err := a.Users.UpdatePassword(userName, []byte(req.Password)); err != nil {
+		a.userError(w, r, err)
+		return
+	}
+	if a.Notifier != nil {
+		event := NewSecurityEvent(EventPasswordChanged, id, userName)
+		event.IP = ClientIP(r)
+		a.Notifier.Notify(event)
+	}
+	var num int64
+	if req.RevokeSessions {
+		if num, err = a.Controller.RevokeEntriesForUser(id, ReasonPasswordChanged); err != nil {
+			a.userError(w, r, err)
+			return
+		}
+	}
+	a.Render(w, r, http.StatusOK, &AuthResponse{Status: "ok", UserID: id,
+		UserName: userName, Deleted: num})
+}
+
+func (a *AdminAPI) setAdmin(w http.ResponseWriter, r *http.Request, userName string) {
+	flags, ok := a.Users.(AdminFlagHandler)
+	if !ok {
+		a.userError(w, r, ErrNotSupported)
+		return
+	}
+	var req AdminFlagRequest
+	if !a.decode(w, r, &req) {
+		return
+	}
+	id, err := a.Users.GetUserID(userName)
+	if err != nil {
+		a.userError(w, r, err)
+		return
+	}
+	// don't let administrators lock themselves out
+	if self, ok := UserIDFromContext(r.Context()); ok && self == id && !req.IsAdmin {
+		a.RenderError(w, r, http.StatusConflict, errors.New("Can't remove the admin flag of yourself."))
+		return
+	}
+	if err := flags.SetAdmin(userName, req.IsAdmin); err != nil {
+		a.userError(w, r, err)
+		return
+	}
+	a.Render(w, r, http.StatusOK, &AuthResponse{Status: "ok", UserID: id, UserName: userName})
+}
+
+func (a *AdminAPI) renameUser(w http.ResponseWriter, r *http.Request, userName string) {
+	renamer, ok := a.Users.(UserRenamer)
+	if !ok {
+		a.userError(w, r, ErrNotSupported)
+		return
+	}
+	var req AdminRenameRequest
+	if !a.decode(w, r, &req) {
+		return
+	}
+	if req.UserName == "" {
+		a.RenderError(w, r, http.StatusBadRequest, errors.New("Username is required."))
+		return
+	}
+	id, err := a.Users.GetUserID(userName)
+	if err != nil {
+		a.userError(w, r, err)
+		return
+	}
+	if err := renamer.RenameUser(userName, req.UserName); err != nil {
+		a.userError(w, r, err)
+		return
+	}
+	a.Render(w, r, http.StatusOK, &AuthResponse{Status: "ok", UserID: id, UserName: req.UserName})
+}
+
+func (a *AdminAPI) listSessions(w http.ResponseWriter, r *http.Request, userName string) {
+	id, err := a.Users.GetUserID(userName)
+	if err != nil {
+		a.userError(w, r, err)
+		return
+	}
+	sessions, err := a.Controller.ListSessions(id)
+	if err != nil {
+		a.userError(w, r, err)
+		return
+	}
+	res := make([]*AdminSession, 0, len(sessions))
+	for key, data := range sessions {
+		res = append(res, &AdminSession{ID: SessionID(key),
+			Created: data.CreationTime, ValidUntil: data.ValidUntil})
+	}
+	a.Render(w, r, http.StatusOK, res)
+}
+
+// revokeSessions ends the session with the given id or all sessions if
+// sessionID is "".
+func (a *AdminAPI) revokeSessions(w http.ResponseWriter, r *http.Request, userName, sessionID string) {
+	id, err := a.Users.GetUserID(userName)
+	if err != nil {
+		a.userError(w, r, err)
+		return
+	}
+	if sessionID == "" {
+		num, err := a.Controller.RevokeEntriesForUser(id, ReasonAdminRevoked)
+		if err != nil {
+			a.userError(w, r, err)
+			return
+		}
+		a.notifyRevoked(r, id, userName, map[string]string{"sessions": strconv.FormatInt(num, 10)})
+		a.Render(w, r, http.StatusOK, &AuthResponse{Status: "ok", UserID: id,
+			UserName: userName, Deleted: num})
+		return
+	}
+	sessions, err := a.Controller.ListSessions(id)
+	if err != nil {
+		a.userError(w, r, err)
+		return
+	}
+	for key := range sessions {
+		if SessionID(key) == sessionID {
+			if err := a.Controller.RevokeKey(key, ReasonAdminRevoked); err != nil {
+				a.userError(w, r, err)
+				return
+			}
+			a.notifyRevoked(r, id, userName, map[string]string{"session_id": sessionID})
+			a.Render(w, r, http.StatusOK, &AuthResponse{Status: "ok", UserID: id,
+				UserName: userName, Deleted: 1})
+			return
+		}
+	}
+	a.RenderError(w, r, http.StatusNotFound, errors.New("Session not found."))
+}
+
+// notifyRevoked sends an EventSessionRevoked event to the Notifier.
+func (a *AdminAPI) notifyRevoked(r *http.Request, id uint64, userName string, data map[string]string) {
+	if a.Notifier == nil {
+		return
+	}
+	event := NewSecurityEvent(EventSessionRevoked, id, userName)
+	event.IP = ClientIP(r)
+	event.Data = data
+	a.Notifier.Notify(event)
+}
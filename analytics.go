@@ -0,0 +1,415 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	log "github.com/sirupsen/logrus"
+)
+
+// SessionAnalytics is implemented by SessionHandlers that can report usage
+// statistics, for example for a dashboard with the number of daily active
+// users.
+// InMemoryHandler and SQLSessionHandler compute exact values,
+// RedisSessionHandler approximations (if AnalyticsPrefix is set).
+//
+// New in version v0.7
+type SessionAnalytics interface {
+	// ActiveUsers returns the number of distinct users with a valid session.
+	ActiveUsers() (int64, error)
+
+	// SessionsCreated returns the number of sessions created in [from, to).
+	SessionsCreated(from, to time.Time) (int64, error)
+}
+
+// SessionsCreatedPerInterval returns the number of sessions created in each
+// interval (for example time.Hour or 24*time.Hour) between from and to.
+//
+// New in version v0.7
+func SessionsCreatedPerInterval(analytics SessionAnalytics, from, to time.Time, interval time.Duration) ([]int64, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("goauth: Invalid interval %v", interval)
+	}
+	res := make([]int64, 0)
+	for start := from; start.Before(to); start = start.Add(interval) {
+		end := start.Add(interval)
+		if end.After(to) {
+			end = to
+		}
+		num, err := analytics.SessionsCreated(start, end)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, num)
+	}
+	return res, nil
+}
+
+// LoginStatsHandler stores the number of successful and failed logins per
+// hour. Use RecordLoginEvents to fill it from an EventBus.
+//
+// New in version v0.7
+type LoginStatsHandler interface {
+	// Init initializes the storage.
+	Init() error
+
+	// RecordLogin counts a login at the given time.
+	RecordLogin(t time.Time, success bool) error
+
+	// LoginCounts returns the number of successful and failed logins in
+	// [from, to), the range is extended to full hours.
+	LoginCounts(from, to time.Time) (succeeded, failed int64, err error)
+
+	// DeleteLoginStats removes the statistics of hours before the given
+	// time and returns the number of removed entries.
+	DeleteLoginStats(before time.Time) (int64, error)
+}
+
+// LoginFailureRate returns the fraction of failed logins in [from, to), it
+// returns 0 if there were no logins.
+//
+// New in version v0.7
+func LoginFailureRate(stats LoginStatsHandler, from, to time.Time) (float64, error) {
+	succeeded, failed, err := stats.LoginCounts(from, to)
+	if err != nil {
+		return 0, err
+	}
+	if succeeded+failed == 0 {
+		return 0, nil
+	}
+	return float64(failed) / float64(succeeded+failed), nil
+}
+
+// RecordLoginEvents returns an EventHandler that records EventLoginSucceeded
+// and EventLoginFailed events in stats. The events are recorded in a new
+// goroutine, errors are logged.
+//
+// Usage:
+//
+//	bus.Subscribe(goauth.RecordLoginEvents(stats), goauth.EventLoginSucceeded, goauth.EventLoginFailed)
+//
+// New in version v0.7
+func RecordLoginEvents(stats LoginStatsHandler) EventHandler {
+	return func(event *SecurityEvent) {
+		var success bool
+		switch event.Type {
+		case EventLoginSucceeded:
+			success = true
+		case EventLoginFailed:
+			success = false
+		default:
+			return
+		}
+		t := event.Time
+		go func() {
+			if err := stats.RecordLogin(t, success); err != nil {
+				log.WithError(err).Error("goauth: Can't record login statistics")
+			}
+		}()
+	}
+}
+
+type loginCounts struct {
+	succeeded, failed int64
+}
+
+// InMemoryLoginStatsHandler is a LoginStatsHandler that keeps the
+// statistics in memory.
+//
+// New in version v0.7
+type InMemoryLoginStatsHandler struct {
+	mutex sync.RWMutex
+	hours map[time.Time]*loginCounts
+}
+
+// NewInMemoryLoginStatsHandler returns a new InMemoryLoginStatsHandler.
+func NewInMemoryLoginStatsHandler() *InMemoryLoginStatsHandler {
+	return &InMemoryLoginStatsHandler{hours: make(map[time.Time]*loginCounts)}
+}
+
+func (h *InMemoryLoginStatsHandler) Init() error {
+	return nil
+}
+
+func (h *InMemoryLoginStatsHandler) RecordLogin(t time.Time, success bool) error {
+	hour := t.UTC().Truncate(time.Hour)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	counts, has := h.hours[hour]
+	if !has {
+		counts = &loginCounts{}
+		h.hours[hour] = counts
+	}
+	if success {
+		counts.succeeded++
+	} else {
+		counts.failed++
+	}
+	return nil
+}
+
+func (h *InMemoryLoginStatsHandler) LoginCounts(from, to time.Time) (int64, int64, error) {
+	from = from.UTC().Truncate(time.Hour)
+	var succeeded, failed int64
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	for hour, counts := range h.hours {
+		if !hour.Before(from) && hour.Before(to) {
+			succeeded += counts.succeeded
+			failed += counts.failed
+		}
+	}
+	return succeeded, failed, nil
+}
+
+func (h *InMemoryLoginStatsHandler) DeleteLoginStats(before time.Time) (int64, error) {
+	var num int64
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for hour := range h.hours {
+		if hour.Before(before) {
+			delete(h.hours, hour)
+			num++
+		}
+	}
+	return num, nil
+}
+
+// SQLLoginStatsQueries stores the queries for SQLLoginStatsHandler.
+//
+// New in version v0.7
+type SQLLoginStatsQueries struct {
+	// RecordQuery inserts or increments the counters, the arguments are
+	// the hour, the number of successful and the number of failed logins.
+	InitQuery, RecordQuery, CountQuery, DeleteQuery string
+}
+
+// MySQLLoginStatsQueries provides queries to use with MySQL.
+func MySQLLoginStatsQueries() *SQLLoginStatsQueries {
+	initQ := `
+	CREATE TABLE IF NOT EXISTS login_stats (
+		hour DATETIME NOT NULL,
+		succeeded BIGINT UNSIGNED NOT NULL,
+		failed BIGINT UNSIGNED NOT NULL,
+		PRIMARY KEY(hour)
+	);
+	`
+	return &SQLLoginStatsQueries{InitQuery: initQ,
+		RecordQuery: "INSERT INTO login_stats (hour, succeeded, failed) VALUES(?, ?, ?) " +
+			"ON DUPLICATE KEY UPDATE succeeded = succeeded + VALUES(succeeded), failed = failed + VALUES(failed)",
+		CountQuery:  "SELECT COALESCE(SUM(succeeded), 0), COALESCE(SUM(failed), 0) FROM login_stats WHERE hour >= ? AND hour < ?",
+		DeleteQuery: "DELETE FROM login_stats WHERE hour < ?"}
+}
+
+// PostgresLoginStatsQueries provides queries to use with postgres.
+func PostgresLoginStatsQueries() *SQLLoginStatsQueries {
+	initQ := `
+	CREATE TABLE IF NOT EXISTS login_stats (
+		hour timestamp PRIMARY KEY,
+		succeeded bigint NOT NULL,
+		failed bigint NOT NULL
+	);
+	`
+	return &SQLLoginStatsQueries{InitQuery: initQ,
+		RecordQuery: "INSERT INTO login_stats (hour, succeeded, failed) VALUES($1, $2, $3) " +
+			"ON CONFLICT (hour) DO UPDATE SET succeeded = login_stats.succeeded + EXCLUDED.succeeded, failed = login_stats.failed + EXCLUDED.failed",
+		CountQuery:  "SELECT COALESCE(SUM(succeeded), 0), COALESCE(SUM(failed), 0) FROM login_stats WHERE hour >= $1 AND hour < $2",
+		DeleteQuery: "DELETE FROM login_stats WHERE hour < $1"}
+}
+
+// SQLite3LoginStatsQueries provides queries to use with sqlite3 (version
+// 3.24 or newer is required).
+func SQLite3LoginStatsQueries() *SQLLoginStatsQueries {
+	res := MySQLLoginStatsQueries()
+	res.RecordQuery = "INSERT INTO login_stats (hour, succeeded, failed) VALUES(?, ?, ?) " +
+		"ON CONFLICT (hour) DO UPDATE SET succeeded = succeeded + excluded.succeeded, failed = failed + excluded.failed"
+	return res
+}
+
+// SQLLoginStatsHandler implements LoginStatsHandler with a summary table
+// that has one row per hour.
+//
+// New in version v0.7
+type SQLLoginStatsHandler struct {
+	*SQLLoginStatsQueries
+
+	// DB is the database to execute the queries on.
+	DB *sql.DB
+
+	blockDB bool
+	mutex   sync.RWMutex
+}
+
+// NewSQLLoginStatsHandler returns a new SQLLoginStatsHandler, blockDB has
+// the same meaning as in NewSQLUserHandler.
+func NewSQLLoginStatsHandler(queries *SQLLoginStatsQueries, db *sql.DB, blockDB bool) *SQLLoginStatsHandler {
+	return &SQLLoginStatsHandler{SQLLoginStatsQueries: queries, DB: db, blockDB: blockDB}
+}
+
+// NewMySQLLoginStatsHandler returns a new SQLLoginStatsHandler that uses
+// MySQL.
+func NewMySQLLoginStatsHandler(db *sql.DB) *SQLLoginStatsHandler {
+	return NewSQLLoginStatsHandler(MySQLLoginStatsQueries(), db, false)
+}
+
+// NewPostgresLoginStatsHandler returns a new SQLLoginStatsHandler that uses
+// postgres.
+func NewPostgresLoginStatsHandler(db *sql.DB) *SQLLoginStatsHandler {
+	return NewSQLLoginStatsHandler(PostgresLoginStatsQueries(), db, false)
+}
+
+// NewSQLite3LoginStatsHandler returns a new SQLLoginStatsHandler that uses
+// sqlite3.
+func NewSQLite3LoginStatsHandler(db *sql.DB) *SQLLoginStatsHandler {
+	return NewSQLLoginStatsHandler(SQLite3LoginStatsQueries(), db, true)
+}
+
+func (handler *SQLLoginStatsHandler) Init() error {
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	_, err := handler.DB.Exec(handler.InitQuery)
+	return err
+}
+
+func (handler *SQLLoginStatsHandler) RecordLogin(t time.Time, success bool) error {
+	var succeeded, failed int64
+	if success {
+		succeeded = 1
+	} else {
+		failed = 1
+	}
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	_, err := handler.DB.Exec(handler.RecordQuery, t.UTC().Truncate(time.Hour), succeeded, failed)
+	return wrapBackendError("sql", "RecordLogin", err)
+}
+
+func (handler *SQLLoginStatsHandler) LoginCounts(from, to time.Time) (int64, int64, error) {
+	if handler.blockDB {
+		handler.mutex.RLock()
+		defer handler.mutex.RUnlock()
+	}
+	var succeeded, failed int64
+	err := handler.DB.QueryRow(handler.CountQuery, from.UTC().Truncate(time.Hour), to.UTC()).Scan(&succeeded, &failed)
+	if err != nil {
+		return 0, 0, wrapBackendError("sql", "LoginCounts", err)
+	}
+	return succeeded, failed, nil
+}
+
+func (handler *SQLLoginStatsHandler) DeleteLoginStats(before time.Time) (int64, error) {
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	res, err := handler.DB.Exec(handler.DeleteQuery, before.UTC())
+	if err != nil {
+		return -1, wrapBackendError("sql", "DeleteLoginStats", err)
+	}
+	num, err := res.RowsAffected()
+	if err != nil {
+		return -1, nil
+	}
+	return num, nil
+}
+
+// RedisLoginStatsHandler implements LoginStatsHandler with one counter per
+// hour and result, the counters expire after Retention so
+// DeleteLoginStats does nothing.
+//
+// New in version v0.7
+type RedisLoginStatsHandler struct {
+	Client *redis.Client
+
+	// Prefix is the prefix of all keys, defaults to "stats:logins:".
+	Prefix string
+
+	// Retention is the time after which the counters expire, defaults to 30
+	// days.
+	Retention time.Duration
+}
+
+// NewRedisLoginStatsHandler returns a new RedisLoginStatsHandler.
+func NewRedisLoginStatsHandler(client *redis.Client) *RedisLoginStatsHandler {
+	return &RedisLoginStatsHandler{Client: client, Prefix: "stats:logins:",
+		Retention: 30 * 24 * time.Hour}
+}
+
+func (h *RedisLoginStatsHandler) Init() error {
+	return nil
+}
+
+func (h *RedisLoginStatsHandler) key(hour time.Time, success bool) string {
+	if success {
+		return h.Prefix + "ok:" + hour.Format(redisHourFormat)
+	}
+	return h.Prefix + "failed:" + hour.Format(redisHourFormat)
+}
+
+func (h *RedisLoginStatsHandler) RecordLogin(t time.Time, success bool) error {
+	key := h.key(t.UTC(), success)
+	pipe := h.Client.Pipeline()
+	pipe.Incr(key)
+	pipe.Expire(key, h.Retention)
+	_, err := pipe.Exec()
+	return wrapBackendError("redis", "RecordLogin", err)
+}
+
+func (h *RedisLoginStatsHandler) LoginCounts(from, to time.Time) (int64, int64, error) {
+	keys := make([]string, 0)
+	for hour := from.UTC().Truncate(time.Hour); hour.Before(to); hour = hour.Add(time.Hour) {
+		keys = append(keys, h.key(hour, true), h.key(hour, false))
+	}
+	if len(keys) == 0 {
+		return 0, 0, nil
+	}
+	values, err := h.Client.MGet(keys...).Result()
+	if err != nil {
+		return 0, 0, wrapBackendError("redis", "LoginCounts", err)
+	}
+	var counts [2]int64
+	for i, val := range values {
+		if str, ok := val.(string); ok {
+			num, err := strconv.ParseInt(str, 10, 64)
+			if err != nil {
+				return 0, 0, err
+			}
+			counts[i%2] += num
+		}
+	}
+	return counts[0], counts[1], nil
+}
+
+func (h *RedisLoginStatsHandler) DeleteLoginStats(before time.Time) (int64, error) {
+	return 0, nil
+}
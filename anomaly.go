@@ -0,0 +1,452 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"database/sql"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	log "github.com/sirupsen/logrus"
+)
+
+// FailedLoginCounter keeps rolling counters of failed logins, globally and
+// per username. The counters are stored in buckets of one minute.
+// Use LoginAnomalyMonitor to raise alarms, for example on credential
+// stuffing spikes.
+//
+// New in version v0.7
+type FailedLoginCounter interface {
+	// Init initializes the storage.
+	Init() error
+
+	// RecordFailure counts a failed login for the username and the global
+	// counter.
+	RecordFailure(userName string, t time.Time) error
+
+	// FailedLogins returns the number of failed logins for the username
+	// within the window (rounded to full minutes) before now. If userName
+	// is "" the global number is returned.
+	FailedLogins(userName string, window time.Duration) (int64, error)
+
+	// DeleteFailedLogins removes the counters before the given time and
+	// returns the number of removed entries.
+	DeleteFailedLogins(before time.Time) (int64, error)
+}
+
+// failedLoginMinutes returns the start times of the buckets in the window
+// before now.
+func failedLoginMinutes(window time.Duration) []time.Time {
+	now := CurrentTime().Truncate(time.Minute)
+	res := make([]time.Time, 0)
+	for minute := now.Add(-window); !minute.After(now); minute = minute.Add(time.Minute) {
+		res = append(res, minute.Truncate(time.Minute))
+	}
+	return res
+}
+
+type failedLoginBucket struct {
+	userName string
+	minute   time.Time
+}
+
+// InMemoryFailedLoginCounter is a FailedLoginCounter that keeps the
+// counters in memory.
+//
+// New in version v0.7
+type InMemoryFailedLoginCounter struct {
+	mutex   sync.RWMutex
+	buckets map[failedLoginBucket]int64
+}
+
+// NewInMemoryFailedLoginCounter returns a new InMemoryFailedLoginCounter.
+func NewInMemoryFailedLoginCounter() *InMemoryFailedLoginCounter {
+	return &InMemoryFailedLoginCounter{buckets: make(map[failedLoginBucket]int64)}
+}
+
+func (c *InMemoryFailedLoginCounter) Init() error {
+	return nil
+}
+
+func (c *InMemoryFailedLoginCounter) RecordFailure(userName string, t time.Time) error {
+	minute := t.UTC().Truncate(time.Minute)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.buckets[failedLoginBucket{minute: minute}]++
+	if userName != "" {
+		c.buckets[failedLoginBucket{userName: userName, minute: minute}]++
+	}
+	return nil
+}
+
+func (c *InMemoryFailedLoginCounter) FailedLogins(userName string, window time.Duration) (int64, error) {
+	var res int64
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	for _, minute := range failedLoginMinutes(window) {
+		res += c.buckets[failedLoginBucket{userName: userName, minute: minute}]
+	}
+	return res, nil
+}
+
+func (c *InMemoryFailedLoginCounter) DeleteFailedLogins(before time.Time) (int64, error) {
+	var num int64
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for bucket := range c.buckets {
+		if bucket.minute.Before(before) {
+			delete(c.buckets, bucket)
+			num++
+		}
+	}
+	return num, nil
+}
+
+// SQLFailedLoginQueries stores the queries for SQLFailedLoginCounter.
+// The global counter is stored with the username "".
+//
+// New in version v0.7
+type SQLFailedLoginQueries struct {
+	// RecordQuery inserts or increments a counter, the arguments are the
+	// username and the minute.
+	// CountQuery sums the counters of a username since a given minute.
+	InitQuery, RecordQuery, CountQuery, DeleteQuery string
+}
+
+// MySQLFailedLoginQueries provides queries to use with MySQL.
+func MySQLFailedLoginQueries() *SQLFailedLoginQueries {
+	initQ := `
+	CREATE TABLE IF NOT EXISTS failed_logins (
+		username VARCHAR(150) NOT NULL,
+		minute DATETIME NOT NULL,
+		failures BIGINT UNSIGNED NOT NULL,
+		PRIMARY KEY(username, minute)
+	);
+	`
+	return &SQLFailedLoginQueries{InitQuery: initQ,
+		RecordQuery: "INSERT INTO failed_logins (username, minute, failures) VALUES(?, ?, 1) " +
+			"ON DUPLICATE KEY UPDATE failures = failures + 1",
+		CountQuery:  "SELECT COALESCE(SUM(failures), 0) FROM failed_logins WHERE username = ? AND minute >= ?",
+		DeleteQuery: "DELETE FROM failed_logins WHERE minute < ?"}
+}
+
+// PostgresFailedLoginQueries provides queries to use with postgres.
+func PostgresFailedLoginQueries() *SQLFailedLoginQueries {
+	initQ := `
+	CREATE TABLE IF NOT EXISTS failed_logins (
+		username varchar(150) NOT NULL,
+		minute timestamp NOT NULL,
+		failures bigint NOT NULL,
+		PRIMARY KEY(username, minute)
+	);
+	`
+	return &SQLFailedLoginQueries{InitQuery: initQ,
+		RecordQuery: "INSERT INTO failed_logins (username, minute, failures) VALUES($1, $2, 1) " +
+			"ON CONFLICT (username, minute) DO UPDATE SET failures = failed_logins.failures + 1",
+		CountQuery:  "SELECT COALESCE(SUM(failures), 0) FROM failed_logins WHERE username = $1 AND minute >= $2",
+		DeleteQuery: "DELETE FROM failed_logins WHERE minute < $1"}
+}
+
+// SQLite3FailedLoginQueries provides queries to use with sqlite3 (version
+// 3.24 or newer is required).
+func SQLite3FailedLoginQueries() *SQLFailedLoginQueries {
+	res := MySQLFailedLoginQueries()
+	res.RecordQuery = "INSERT INTO failed_logins (username, minute, failures) VALUES(?, ?, 1) " +
+		"ON CONFLICT (username, minute) DO UPDATE SET failures = failures + 1"
+	return res
+}
+
+// SQLFailedLoginCounter implements FailedLoginCounter with a summary table
+// that has one row per username and minute. Use DeleteFailedLogins (for
+// example in a Janitor) to remove old rows.
+//
+// New in version v0.7
+type SQLFailedLoginCounter struct {
+	*SQLFailedLoginQueries
+
+	// DB is the database to execute the queries on.
+	DB *sql.DB
+
+	blockDB bool
+	mutex   sync.RWMutex
+}
+
+// NewSQLFailedLoginCounter returns a new SQLFailedLoginCounter, blockDB has
+// the same meaning as in NewSQLUserHandler.
+func NewSQLFailedLoginCounter(queries *SQLFailedLoginQueries, db *sql.DB, blockDB bool) *SQLFailedLoginCounter {
+	return &SQLFailedLoginCounter{SQLFailedLoginQueries: queries, DB: db, blockDB: blockDB}
+}
+
+// NewMySQLFailedLoginCounter returns a new SQLFailedLoginCounter that uses
+// MySQL.
+func NewMySQLFailedLoginCounter(db *sql.DB) *SQLFailedLoginCounter {
+	return NewSQLFailedLoginCounter(MySQLFailedLoginQueries(), db, false)
+}
+
+// NewPostgresFailedLoginCounter returns a new SQLFailedLoginCounter that
+// uses postgres.
+func NewPostgresFailedLoginCounter(db *sql.DB) *SQLFailedLoginCounter {
+	return NewSQLFailedLoginCounter(PostgresFailedLoginQueries(), db, false)
+}
+
+// NewSQLite3FailedLoginCounter returns a new SQLFailedLoginCounter that uses
+// sqlite3.
+func NewSQLite3FailedLoginCounter(db *sql.DB) *SQLFailedLoginCounter {
+	return NewSQLFailedLoginCounter(SQLite3FailedLoginQueries(), db, true)
+}
+
+func (c *SQLFailedLoginCounter) Init() error {
+	if c.blockDB {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+	}
+	_, err := c.DB.Exec(c.InitQuery)
+	return err
+}
+
+func (c *SQLFailedLoginCounter) RecordFailure(userName string, t time.Time) error {
+	minute := t.UTC().Truncate(time.Minute)
+	if c.blockDB {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+	}
+	if _, err := c.DB.Exec(c.RecordQuery, "", minute); err != nil {
+		return wrapBackendError("sql", "RecordFailure", err)
+	}
+	if userName != "" {
+		if _, err := c.DB.Exec(c.RecordQuery, userName, minute); err != nil {
+			return wrapBackendError("sql", "RecordFailure", err)
+		}
+	}
+	return nil
+}
+
+func (c *SQLFailedLoginCounter) FailedLogins(userName string, window time.Duration) (int64, error) {
+	since := failedLoginMinutes(window)[0]
+	if c.blockDB {
+		c.mutex.RLock()
+		defer c.mutex.RUnlock()
+	}
+	var res int64
+	if err := c.DB.QueryRow(c.CountQuery, userName, since).Scan(&res); err != nil {
+		return 0, wrapBackendError("sql", "FailedLogins", err)
+	}
+	return res, nil
+}
+
+func (c *SQLFailedLoginCounter) DeleteFailedLogins(before time.Time) (int64, error) {
+	if c.blockDB {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+	}
+	res, err := c.DB.Exec(c.DeleteQuery, before.UTC())
+	if err != nil {
+		return -1, wrapBackendError("sql", "DeleteFailedLogins", err)
+	}
+	num, err := res.RowsAffected()
+	if err != nil {
+		return -1, nil
+	}
+	return num, nil
+}
+
+// RedisFailedLoginCounter implements FailedLoginCounter with one counter
+// (INCR) per minute that expires after MaxWindow, so DeleteFailedLogins
+// does nothing.
+//
+// New in version v0.7
+type RedisFailedLoginCounter struct {
+	Client *redis.Client
+
+	// Prefix is the prefix of all keys, defaults to "failedlogins:".
+	Prefix string
+
+	// MaxWindow is the largest window that can be queried, defaults to one
+	// day.
+	MaxWindow time.Duration
+}
+
+// NewRedisFailedLoginCounter returns a new RedisFailedLoginCounter.
+func NewRedisFailedLoginCounter(client *redis.Client) *RedisFailedLoginCounter {
+	return &RedisFailedLoginCounter{Client: client, Prefix: "failedlogins:",
+		MaxWindow: 24 * time.Hour}
+}
+
+func (c *RedisFailedLoginCounter) Init() error {
+	return nil
+}
+
+func (c *RedisFailedLoginCounter) key(userName string, minute time.Time) string {
+	return c.Prefix + userName + ":" + minute.Format("2006-01-02T15:04")
+}
+
+func (c *RedisFailedLoginCounter) RecordFailure(userName string, t time.Time) error {
+	minute := t.UTC().Truncate(time.Minute)
+	// keep the bucket a minute longer than required, it's not complete when
+	// it's created
+	expiration := c.MaxWindow + time.Minute
+	names := []string{""}
+	if userName != "" {
+		names = append(names, userName)
+	}
+	pipe := c.Client.Pipeline()
+	for _, name := range names {
+		key := c.key(name, minute)
+		pipe.Incr(key)
+		pipe.Expire(key, expiration)
+	}
+	_, err := pipe.Exec()
+	return wrapBackendError("redis", "RecordFailure", err)
+}
+
+func (c *RedisFailedLoginCounter) FailedLogins(userName string, window time.Duration) (int64, error) {
+	minutes := failedLoginMinutes(window)
+	keys := make([]string, len(minutes))
+	for i, minute := range minutes {
+		keys[i] = c.key(userName, minute)
+	}
+	values, err := c.Client.MGet(keys...).Result()
+	if err != nil {
+		return 0, wrapBackendError("redis", "FailedLogins", err)
+	}
+	var res int64
+	for _, val := range values {
+		if str, ok := val.(string); ok {
+			num, err := strconv.ParseInt(str, 10, 64)
+			if err != nil {
+				return 0, err
+			}
+			res += num
+		}
+	}
+	return res, nil
+}
+
+func (c *RedisFailedLoginCounter) DeleteFailedLogins(before time.Time) (int64, error) {
+	return 0, nil
+}
+
+// LoginAnomalyMonitor records failed logins in a FailedLoginCounter and
+// sends an EventLoginAnomaly event to the Notifier if the number of
+// failures within Window exceeds GlobalThreshold (for all users) or
+// UserThreshold (for a single username). After an alarm the same scope
+// (global or the username) is not reported again for Window.
+// The event contains the fields "scope" ("global" or "user"), "failures"
+// and "window" in Data.
+//
+// Usage:
+//
+//	monitor := goauth.NewLoginAnomalyMonitor(counter, 15*time.Minute, 1000, 20)
+//	monitor.Notifier = webhooks
+//	bus.Subscribe(monitor.Handle, goauth.EventLoginFailed)
+//
+// New in version v0.7
+type LoginAnomalyMonitor struct {
+	Counter FailedLoginCounter
+	Window  time.Duration
+
+	// GlobalThreshold and UserThreshold are the number of failures that
+	// trigger an alarm, 0 disables the check.
+	GlobalThreshold, UserThreshold int64
+
+	// Notifier gets the EventLoginAnomaly events, may be nil.
+	Notifier SecurityNotifier
+
+	mutex  sync.Mutex
+	alarms map[string]time.Time
+}
+
+// NewLoginAnomalyMonitor returns a new LoginAnomalyMonitor.
+func NewLoginAnomalyMonitor(counter FailedLoginCounter, window time.Duration, globalThreshold, userThreshold int64) *LoginAnomalyMonitor {
+	return &LoginAnomalyMonitor{Counter: counter, Window: window,
+		GlobalThreshold: globalThreshold, UserThreshold: userThreshold,
+		alarms: make(map[string]time.Time)}
+}
+
+// Handle is an EventHandler for EventLoginFailed events, the failure is
+// recorded in a new goroutine.
+func (m *LoginAnomalyMonitor) Handle(event *SecurityEvent) {
+	if event.Type != EventLoginFailed {
+		return
+	}
+	go func() {
+		if err := m.RecordFailure(event.UserName, event.Time); err != nil {
+			log.WithError(err).Error("goauth: Can't record failed login")
+		}
+	}()
+}
+
+// RecordFailure records a failed login and checks the thresholds.
+func (m *LoginAnomalyMonitor) RecordFailure(userName string, t time.Time) error {
+	if err := m.Counter.RecordFailure(userName, t); err != nil {
+		return err
+	}
+	if m.GlobalThreshold > 0 {
+		if err := m.check("", m.GlobalThreshold); err != nil {
+			return err
+		}
+	}
+	if m.UserThreshold > 0 && userName != "" {
+		if err := m.check(userName, m.UserThreshold); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// check sends an alarm if the failures of the username (or all users if it
+// is "") reached the threshold.
+func (m *LoginAnomalyMonitor) check(userName string, threshold int64) error {
+	num, err := m.Counter.FailedLogins(userName, m.Window)
+	if err != nil || num < threshold {
+		return err
+	}
+	now := CurrentTime()
+	m.mutex.Lock()
+	if last, has := m.alarms[userName]; has && now.Sub(last) < m.Window {
+		m.mutex.Unlock()
+		return nil
+	}
+	m.alarms[userName] = now
+	// remove old alarms so the map doesn't grow forever
+	for name, last := range m.alarms {
+		if now.Sub(last) >= m.Window {
+			delete(m.alarms, name)
+		}
+	}
+	m.mutex.Unlock()
+	scope := "user"
+	if userName == "" {
+		scope = "global"
+	}
+	log.WithField("scope", scope).WithField("username", userName).WithField("failures", num).Warn("goauth: Login anomaly detected")
+	if m.Notifier != nil {
+		event := NewSecurityEvent(EventLoginAnomaly, NoUserID, userName)
+		event.Data = map[string]string{"scope": scope,
+			"failures": strconv.FormatInt(num, 10), "window": m.Window.String()}
+		m.Notifier.Notify(event)
+	}
+	return nil
+}
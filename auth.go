@@ -24,15 +24,23 @@ package goauth
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 
 	log "github.com/sirupsen/logrus"
 
 	"net/http"
 	"time"
 
-	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
 )
 
@@ -46,6 +54,52 @@ import (
 // "Basic" types such as int, string, ... work fine.
 type UserKeyType interface{}
 
+// UserKeyToID converts a user key to a user id as used by the UserHandler.
+// Database drivers return different types for integer columns (for example
+// int64 instead of uint64), this function accepts all integer types and
+// strings containing a number.
+//
+// New in version v0.7
+func UserKeyToID(user UserKeyType) (uint64, error) {
+	switch v := user.(type) {
+	case uint64:
+		return v, nil
+	case int64:
+		if v >= 0 {
+			return uint64(v), nil
+		}
+	case int:
+		if v >= 0 {
+			return uint64(v), nil
+		}
+	case uint:
+		return uint64(v), nil
+	case uint32:
+		return uint64(v), nil
+	case int32:
+		if v >= 0 {
+			return uint64(v), nil
+		}
+	case []byte:
+		return strconv.ParseUint(string(v), 10, 64)
+	case string:
+		return strconv.ParseUint(v, 10, 64)
+	}
+	return NoUserID, fmt.Errorf("Can't convert user key %v to a user id", user)
+}
+
+// sameUser reports whether the keys belong to the same user. Keys of
+// different types (for example int64 from a database driver and uint64) are
+// compared by their id, see UserKeyToID.
+func sameUser(a, b UserKeyType) bool {
+	idA, errA := UserKeyToID(a)
+	idB, errB := UserKeyToID(b)
+	if errA == nil && errB == nil {
+		return idA == idB
+	}
+	return reflect.DeepEqual(a, b)
+}
+
 // ErrKeyNotFound is the error that is returned whenever you try to lookup
 // the information stored for a certain key but that key does not exist.
 var ErrKeyNotFound = errors.New("No entry for key was found")
@@ -72,13 +126,33 @@ const (
 // or directly use these constraints directly in your database queries.
 type SessionKeyData struct {
 	// User is the user connected with a key.
-	User UserKeyType
+	User UserKeyType `json:"user"`
 
 	// CreationTime is the time the key was created.
-	CreationTime time.Time
+	CreationTime time.Time `json:"created"`
 
 	// ValidUntil is the time until the key is considered valid.
-	ValidUntil time.Time
+	ValidUntil time.Time `json:"valid_until"`
+
+	// Guest is true for guest sessions (User is GuestUserID), it's not
+	// stored but set by SessionController. See AddGuestKey.
+	//
+	// New in version v0.7
+	Guest bool `json:"guest,omitempty"`
+
+	// Scoped is true if the session is restricted to Scopes, both are not
+	// stored but set by SessionController from its Payload. See
+	// AddScopedKey.
+	//
+	// New in version v0.7
+	Scoped bool     `json:"-"`
+	Scopes []string `json:"-"`
+
+	// Device is the device of the session, it's only set by the methods that
+	// read it from the SessionPayloadHandler (see ListSessionsWithDevices).
+	//
+	// New in version v0.7
+	Device *SessionDevice `json:"device,omitempty"`
 }
 
 // NewSessionKeyData creates a new SessionKeyData instance with the given
@@ -91,16 +165,23 @@ func NewSessionKeyData(user UserKeyType, creationTime, validUntil time.Time) *Se
 
 // CurrentTime returns the current type. For consistent behaviour you should
 // always use this method to get the current time.
-// It returns time.Now().UTC()
+// It returns the time of the clock set with SetClock in UTC, by default
+// time.Now().UTC().
 func CurrentTime() time.Time {
-	return time.Now().UTC()
+	return globalClock.Load().(clockHolder).clock.Now().UTC()
 }
 
 // CurrentTimeKeyData creates a new SessionKeyData object with the current time.
 // It should be use by all handlers s.t. the behaviour is consistent.
 // it creates the time object in UTC.
 func CurrentTimeKeyData(user UserKeyType, validDuration time.Duration) *SessionKeyData {
-	now := CurrentTime()
+	return clockKeyData(nil, user, validDuration)
+}
+
+// clockKeyData is like CurrentTimeKeyData but uses the time of clock, see
+// clockNow.
+func clockKeyData(clock Clock, user UserKeyType, validDuration time.Duration) *SessionKeyData {
+	now := clockNow(clock)
 	validUntil := now.Add(validDuration)
 	return NewSessionKeyData(user, now, validUntil)
 }
@@ -130,17 +211,56 @@ func KeyValid(now, validUntil time.Time) bool {
 // and n = 96 for keys of length 128.
 // Use n = -1 to use the default value which is 48, so a random string of
 // length 64.
+//
+// Since v0.7 the random bytes are read into pooled buffers for n up to
+// maxPooledRandomBytes (96), so the only allocation is the returned string.
 func GenRandomBase64(n int) (string, error) {
 	if n <= 0 {
 		n = DefaultRandomByteLength
 	}
-	b := securecookie.GenerateRandomKey(n)
-	if b == nil {
-		return "", errors.New("Can't generate random bytes, probably an error with your random generator, do not continue!")
+	if n > maxPooledRandomBytes {
+		b := make([]byte, n)
+		if _, err := io.ReadFull(rand.Reader, b); err != nil {
+			return "", errRandom
+		}
+		return base64.URLEncoding.EncodeToString(b), nil
 	}
-	return base64.URLEncoding.EncodeToString(b), nil
+	buf := randomBufferPool.Get().(*randomBuffer)
+	raw := buf.raw[:n]
+	enc := buf.enc[:base64.URLEncoding.EncodedLen(n)]
+	defer func() {
+		// don't leave key material in the pool
+		for i := range raw {
+			raw[i] = 0
+		}
+		for i := range enc {
+			enc[i] = 0
+		}
+		randomBufferPool.Put(buf)
+	}()
+	if _, err := io.ReadFull(rand.Reader, raw); err != nil {
+		return "", errRandom
+	}
+	base64.URLEncoding.Encode(enc, raw)
+	return string(enc), nil
 }
 
+// maxPooledRandomBytes is the maximal number of random bytes
+// GenRandomBase64 generates with pooled buffers.
+const maxPooledRandomBytes = 96
+
+// randomBuffer holds the random bytes and their encoding for GenRandomBase64.
+type randomBuffer struct {
+	raw [maxPooledRandomBytes]byte
+	enc [(maxPooledRandomBytes + 2) / 3 * 4]byte
+}
+
+var randomBufferPool = sync.Pool{New: func() interface{} {
+	return new(randomBuffer)
+}}
+
+var errRandom = errors.New("Can't generate random bytes, probably an error with your random generator, do not continue!")
+
 // SessionHandler is the interface to store and retrieve session keys and
 // the associated SessionKeyData objects.
 type SessionHandler interface {
@@ -179,6 +299,30 @@ type SessionHandler interface {
 	DeleteKey(key string) error
 }
 
+// SessionLister is implemented by SessionHandlers that can list all sessions
+// of a user, for example to show the user where they're logged in or to
+// revoke single sessions.
+// InMemoryHandler, SQLSessionHandler and RedisSessionHandler implement this
+// interface.
+//
+// New in version v0.7
+type SessionLister interface {
+	// ListSessionsForUser returns all valid sessions of the user as a map
+	// session key -> data.
+	ListSessionsForUser(user UserKeyType) (map[string]*SessionKeyData, error)
+}
+
+// SessionID returns a public identifier for a session key. The session key
+// is a secret (everyone who knows it is logged in as the user), so never
+// show it to anyone. Use the id instead, for example in a list of active
+// sessions.
+//
+// New in version v0.7
+func SessionID(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:16])
+}
+
 // SessionController uses a SessionHandler to query the storage and add
 // additional functionality. It is used as the main anchorpoint for user
 // authentication.
@@ -190,8 +334,100 @@ type SessionController struct {
 	SessionHandler
 	NumBytes    int
 	SessionName string
+
+	// Metrics is informed about failed session validations, may be nil.
+	// Use InstrumentedSessionHandler to measure the backend.
+	//
+	// New in version v0.7
+	Metrics Metrics
+
+	// OperationTimeout is the default timeout for each operation of the
+	// SessionHandler, set it with SetOperationTimeout.
+	//
+	// New in version v0.7
+	OperationTimeout time.Duration
+
+	// Clock is used to check if sessions are expired, nil (the default)
+	// means CurrentTime. Note that the SessionHandler has its own clock.
+	//
+	// New in version v0.7
+	Clock Clock
+
+	// Tombstones stores a tombstone for each session deleted by RevokeKey or
+	// RevokeEntriesForUser, GetData then returns a *SessionRevokedError
+	// instead of ErrKeyNotFound. nil (the default) disables tombstones.
+	//
+	// New in version v0.7
+	Tombstones TombstoneStore
+
+	// TombstoneTTL is the time a tombstone is kept, defaults to
+	// DefaultTombstoneTTL.
+	//
+	// New in version v0.7
+	TombstoneTTL time.Duration
+
+	// TokenHeader is the name of a header that contains the session key, for
+	// API clients that don't handle cookies (see ValidateToken).
+	// ValidateSession only uses the session cookie, but the SessionMiddleware,
+	// EndSession and AuthHandlers use a key in this header instead of the
+	// cookie if the request has one.
+	// "" (the default) disables the header, DefaultTokenHeader is a good
+	// choice.
+	//
+	// New in version v0.7
+	TokenHeader string
+
+	// LogoutNotifier is notified about sessions revoked by RevokeKey,
+	// RevokeEntriesForUser and RevokeOtherSessions so that other
+	// applications can terminate their sessions too (back channel logout).
+	// nil (the default) disables the notifications.
+	//
+	// New in version v0.7
+	LogoutNotifier LogoutNotifier
+
+	// Audience is the name of this application for sessions shared with
+	// other applications (see SSOCookieOptions). If set, only sessions that
+	// contain Audience in their audiences are accepted (from the cookie,
+	// TokenHeader and bearer tokens), otherwise ErrWrongAudience is
+	// returned.
+	//
+	// New in version v0.7
+	Audience string
+
+	// Audiences are stored with each key created by AddKey, for example
+	// all applications a central login issues sessions for.
+	// nil (the default) means only Audience.
+	//
+	// New in version v0.7
+	Audiences []string
+
+	// Payload stores the audiences of the sessions, it is required if
+	// Audience or Audiences are set (see AudiencesPayloadName).
+	//
+	// New in version v0.7
+	Payload SessionPayloadHandler
+
+	// Signer signs the session keys sent to clients, so forged or garbled
+	// keys are rejected before the backend is queried. See ClientKey.
+	// nil (the default) sends the plain keys.
+	//
+	// New in version v0.7
+	Signer *SessionKeySigner
 }
 
+// DefaultTokenHeader is the usual value of SessionController.TokenHeader.
+//
+// New in version v0.7
+const DefaultTokenHeader = "X-Session-Token"
+
+// TokenExpiresHeader is the response header that contains the time (in
+// http.TimeFormat) a session key sent in SessionController.TokenHeader
+// expires, see SetTokenExpiry. It's the equivalent to the MaxAge of a
+// session cookie.
+//
+// New in version v0.7
+const TokenExpiresHeader = "X-Session-Expires"
+
 // NewSessionController creates a new session controller given a SessionHandler,
 // the size of the random byte slice
 // If you use another key length or session name set the values after calling
@@ -202,6 +438,22 @@ func NewSessionController(h SessionHandler) *SessionController {
 		SessionName: "user-auth"}
 }
 
+// ListSessions returns all valid sessions of the user if the SessionHandler
+// implements SessionLister, otherwise it returns ErrNotSupported.
+// The guest sessions are not listed, the result for a guest user is empty.
+//
+// New in version v0.7
+func (c *SessionController) ListSessions(user UserKeyType) (map[string]*SessionKeyData, error) {
+	if IsGuestUser(user) {
+		return make(map[string]*SessionKeyData), nil
+	}
+	lister, ok := c.SessionHandler.(SessionLister)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return lister.ListSessionsForUser(user)
+}
+
 // AddKey adds a new entry to the storage.
 // This function returns either nil, "" and some error if something went wrong
 // or the SessionKeyData instance, the key that was used to identify this
@@ -215,6 +467,9 @@ func (c *SessionController) AddKey(user UserKeyType, validDuration time.Duration
 	if insertErr != nil {
 		return nil, "", insertErr
 	}
+	if err := c.setAudiences(key, data.ValidUntil); err != nil {
+		return nil, "", err
+	}
 	// everything ok
 	return data, key, nil
 }
@@ -266,7 +521,7 @@ func (c SessionController) GetKey(session *sessions.Session) (string, error) {
 	if !ok {
 		return "", errors.New("Internal lookup error. \"key\" is present in the session but not of type string.")
 	}
-	return key, nil
+	return c.ParseClientKey(key)
 }
 
 // ValidateSession validates the key that is stored in the session.
@@ -299,6 +554,9 @@ func (c SessionController) GetKey(session *sessions.Session) (string, error) {
 // or the session of the user simply expired and was therefore deleted from
 // storage (4) err == InvalidKeyErr the key was still found in the database
 // but is not valid any more, so probably the user hast to login again.
+// (5) err == ErrGuestSession the key belongs to a guest session, use
+// ValidateGuestSession to accept guest sessions. (6) err == ErrScopedSession
+// the key is restricted to scopes, see SessionMiddleware.RequireScope.
 //
 // This method will automatically update the session.MaxAge to the time
 // the key is still considered valid. If the key is invalid it will set the
@@ -308,7 +566,19 @@ func (c SessionController) GetKey(session *sessions.Session) (string, error) {
 //
 // See examples for how to use this method.
 func (c *SessionController) ValidateSession(r *http.Request, store sessions.Store) (*SessionKeyData, *sessions.Session, error) {
-	now := CurrentTime()
+	info, session, err := c.validateSession(r, store)
+	if err != nil && c.Metrics != nil {
+		c.Metrics.ValidationFailed(validationFailureReason(err))
+	}
+	if err != nil {
+		// the data of guest sessions is only returned by ValidateGuestSession
+		return nil, session, err
+	}
+	return info, session, nil
+}
+
+func (c *SessionController) validateSession(r *http.Request, store sessions.Store) (*SessionKeyData, *sessions.Session, error) {
+	now := clockNow(c.Clock)
 	// first get the session
 	session, err := c.GetSession(r, store)
 	if err != nil {
@@ -317,31 +587,130 @@ func (c *SessionController) ValidateSession(r *http.Request, store sessions.Stor
 
 	// check for the key value stored in session
 	key, keyErr := c.GetKey(session)
+	if keyErr == ErrInvalidKeySignature {
+		session.Options.MaxAge = -1
+	}
 	if keyErr != nil {
 		return nil, session, keyErr
 	}
 
+	info, err := c.validateKey(r, key, now)
+	if err == ErrInvalidKey {
+		session.Options.MaxAge = -1
+	}
+	if info == nil {
+		return nil, session, err
+	}
+
+	// update the max age of the session to the time that is still left
+	durationLeft := info.ValidUntil.Sub(now)
+	session.Options.MaxAge = int(durationLeft / time.Second)
+	return info, session, err
+}
+
+// validateKey looks up the key and checks that it's still valid, it's used
+// for keys from the session cookie and from TokenHeader. For guest sessions
+// the data and ErrGuestSession are returned, the exported methods drop the
+// data (except ValidateGuestSession). The same applies to sessions
+// restricted to scopes and ErrScopedSession.
+func (c *SessionController) validateKey(r *http.Request, key string, now time.Time) (*SessionKeyData, error) {
 	// try to get the information out of the underlying storage
-	info, err := c.GetData(key)
+	// (restricted to the tenant of the request, if any)
+	tenant, _ := TenantFromContext(r.Context())
+	info, err := c.lookupKey(tenant, key)
 	if err != nil {
-		return nil, session, err
+		return nil, err
 	}
 
 	// now info is not allowed to be nil
-	// so we validate the entry and update the max age of the session, update to
-	// the time that is still left
-
 	if KeyInvalid(now, info.ValidUntil) {
-		session.Options.MaxAge = -1
-		return nil, session, ErrInvalidKey
+		return nil, ErrInvalidKey
 	}
 
-	durationLeft := info.ValidUntil.Sub(now)
-	session.Options.MaxAge = int(durationLeft / time.Second)
+	// the key may be shared with other applications, so a cookie with a
+	// wrong audience is not removed
+	if err := c.checkAudience(key); err != nil {
+		return nil, err
+	}
 
-	// everything is fine, so now return everything: the user should be considered
-	// as logged in
-	return info, session, nil
+	// guest sessions are valid but not logged in, see ValidateGuestSession
+	if info.Guest {
+		return info, ErrGuestSession
+	}
+
+	// scoped sessions are only accepted by the routes that opt in
+	if err := c.loadScopes(key, info); err != nil {
+		return nil, err
+	}
+	if info.Scoped {
+		return info, ErrScopedSession
+	}
+
+	// everything is fine: the user should be considered as logged in
+	return info, nil
+}
+
+// SessionToken returns the session key from TokenHeader or "" if
+// TokenHeader is not set or the request doesn't have the header.
+// If Signer is set the key is still signed, see ParseClientKey.
+//
+// New in version v0.7
+func (c *SessionController) SessionToken(r *http.Request) string {
+	if c.TokenHeader == "" {
+		return ""
+	}
+	return strings.TrimSpace(r.Header.Get(c.TokenHeader))
+}
+
+// ValidateToken is like ValidateSession but validates the session key sent
+// in TokenHeader, so API clients don't have to handle cookies. The errors
+// are the same as those of ValidateSession: ErrNotAuthSession if there is
+// no key in the header, ErrKeyNotFound (or a *SessionRevokedError) and
+// ErrInvalidKey for unknown and expired keys, ErrGuestSession for guest
+// sessions and ErrScopedSession for scoped sessions. It returns the key as
+// well.
+//
+// There is no cookie that expires, use SetTokenExpiry to tell the client
+// how long the key is valid.
+//
+// New in version v0.7
+func (c *SessionController) ValidateToken(r *http.Request) (*SessionKeyData, string, error) {
+	return c.validateToken(r, false)
+}
+
+// validateToken implements ValidateToken, if allowScoped is true sessions
+// restricted to scopes are accepted as well.
+func (c *SessionController) validateToken(r *http.Request, allowScoped bool) (*SessionKeyData, string, error) {
+	value := c.SessionToken(r)
+	if value == "" {
+		return nil, "", ErrNotAuthSession
+	}
+	key, err := c.ParseClientKey(value)
+	if err != nil {
+		if c.Metrics != nil {
+			c.Metrics.ValidationFailed(validationFailureReason(err))
+		}
+		return nil, "", err
+	}
+	info, err := c.validateKey(r, key, clockNow(c.Clock))
+	if err == ErrScopedSession && allowScoped {
+		err = nil
+	}
+	if err != nil {
+		if c.Metrics != nil {
+			c.Metrics.ValidationFailed(validationFailureReason(err))
+		}
+		return nil, key, err
+	}
+	return info, key, nil
+}
+
+// SetTokenExpiry sets the TokenExpiresHeader to the expiry time of the
+// session.
+//
+// New in version v0.7
+func SetTokenExpiry(w http.ResponseWriter, data *SessionKeyData) {
+	w.Header().Set(TokenExpiresHeader, data.ValidUntil.UTC().Format(http.TimeFormat))
 }
 
 // CreateAuthSession will create a new session and add it to the underlying
@@ -362,11 +731,12 @@ func (c *SessionController) CreateAuthSession(r *http.Request, store sessions.St
 	if err != nil {
 		return nil, "", nil, err
 	}
-	data, key, err := c.AddKey(user, validDuration)
+	tenant, _ := TenantFromContext(r.Context())
+	data, key, err := c.AddKeyForTenant(tenant, user, validDuration)
 	if err != nil {
 		return nil, "", session, err
 	}
-	session.Values[SessionKey] = key
+	session.Values[SessionKey] = c.ClientKey(key)
 	session.Options.MaxAge = int(validDuration / time.Second)
 	// everything ok
 	return data, key, session, nil
@@ -380,7 +750,21 @@ func (c *SessionController) CreateAuthSession(r *http.Request, store sessions.St
 // something really went wrong.
 //
 // The session.MaxAge will be set to -1.
+// The key is revoked with ReasonLogout, see RevokeKey.
+//
+// Since v0.7 a key in TokenHeader is revoked instead of the key in the
+// session.
 func (c *SessionController) EndSession(r *http.Request, store sessions.Store) error {
+	if value := c.SessionToken(r); value != "" {
+		key, err := c.ParseClientKey(value)
+		if err == ErrInvalidKeySignature {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return c.RevokeKey(key, ReasonLogout)
+	}
 	session, err := store.Get(r, c.SessionName)
 	if err != nil {
 		return err
@@ -399,7 +783,14 @@ func (c *SessionController) EndSession(r *http.Request, store sessions.Store) er
 	}
 	// set the session age to -1
 	session.Options.MaxAge = -1
-	return c.DeleteKey(key)
+	key, err = c.ParseClientKey(key)
+	if err == ErrInvalidKeySignature {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return c.RevokeKey(key, ReasonLogout)
 }
 
 // DeleteEntriesDaemon starts a goroutine that runs forever and deletes invalid
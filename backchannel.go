@@ -0,0 +1,269 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/go-redis/redis"
+	log "github.com/sirupsen/logrus"
+)
+
+// LogoutEvent is sent to other applications when sessions are revoked (back
+// channel logout), so they can clear local caches and terminate sessions
+// derived from the revoked ones.
+//
+// If SessionID is set a single session was revoked, SessionID is the public
+// id of the session key (see SessionID). If SessionID is empty all sessions
+// of the user were revoked. UserID is 0 if the user is unknown or can't be
+// converted with UserKeyToID.
+//
+// New in version v0.7
+type LogoutEvent struct {
+	SessionID string           `json:"session_id,omitempty"`
+	UserID    uint64           `json:"user_id"`
+	Reason    RevocationReason `json:"reason"`
+	Time      time.Time        `json:"time"`
+}
+
+// LogoutNotifier gets notified when sessions are revoked.
+// NotifyLogout must not block.
+//
+// New in version v0.7
+type LogoutNotifier interface {
+	NotifyLogout(event *LogoutEvent)
+}
+
+// MultiLogoutNotifier passes each event to all its notifiers.
+//
+// New in version v0.7
+type MultiLogoutNotifier []LogoutNotifier
+
+func (m MultiLogoutNotifier) NotifyLogout(event *LogoutEvent) {
+	for _, notifier := range m {
+		notifier.NotifyLogout(event)
+	}
+}
+
+// notifyLogout passes an event to LogoutNotifier (if set).
+func (c *SessionController) notifyLogout(sessionID string, user UserKeyType, reason RevocationReason) {
+	if c.LogoutNotifier == nil {
+		return
+	}
+	event := &LogoutEvent{SessionID: sessionID, Reason: reason, Time: CurrentTime()}
+	if user != nil {
+		if id, err := UserKeyToID(user); err == nil {
+			event.UserID = id
+		}
+	}
+	c.LogoutNotifier.NotifyLogout(event)
+}
+
+// LogoutCallbacks posts LogoutEvents as JSON to the back channel logout URLs
+// of other applications.
+// Each endpoint is a WebhookDispatcher, so requests are signed and retried
+// the same way as webhooks, receivers can use LogoutCallbackHandler.
+//
+// Call Start before using NotifyLogout, Send can be used without it.
+//
+// New in version v0.7
+type LogoutCallbacks struct {
+	Endpoints []*WebhookDispatcher
+
+	queue chan *LogoutEvent
+}
+
+// NewLogoutCallbacks returns LogoutCallbacks posting to all urls, all
+// requests are signed with secret.
+//
+// New in version v0.7
+func NewLogoutCallbacks(secret string, urls ...string) *LogoutCallbacks {
+	res := &LogoutCallbacks{Endpoints: make([]*WebhookDispatcher, len(urls))}
+	for i, url := range urls {
+		res.Endpoints[i] = NewWebhookDispatcher(url, secret)
+	}
+	return res
+}
+
+// Send posts the event to all endpoints, it blocks until the event is
+// delivered everywhere, the retries are exhausted or ctx is done.
+// A failed endpoint doesn't stop the delivery to the other endpoints, the
+// first error is returned.
+func (l *LogoutCallbacks) Send(ctx context.Context, event *LogoutEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	var res error
+	for _, endpoint := range l.Endpoints {
+		if err := endpoint.deliver(ctx, body); err != nil {
+			log.WithError(err).WithField("url", endpoint.URL).Error("goauth: Can't deliver logout callback")
+			if res == nil {
+				res = err
+			}
+		}
+	}
+	return res
+}
+
+// Start starts a goroutine that sends the events passed to NotifyLogout
+// until ctx is done. queueSize is the number of events that can wait for
+// delivery.
+func (l *LogoutCallbacks) Start(ctx context.Context, queueSize int) {
+	l.queue = make(chan *LogoutEvent, queueSize)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event := <-l.queue:
+				l.Send(ctx, event)
+			}
+		}
+	}()
+}
+
+// NotifyLogout queues the event for delivery, if the queue is full the event
+// is dropped (and logged).
+func (l *LogoutCallbacks) NotifyLogout(event *LogoutEvent) {
+	select {
+	case l.queue <- event:
+	default:
+		log.WithField("session", event.SessionID).Warn("goauth: Logout callback queue full, dropping event")
+	}
+}
+
+// LogoutCallbackHandler returns a handler for the receiving side of
+// LogoutCallbacks: it verifies the signature of the request (see
+// VerifyWebhookSignature) and passes the event to handle.
+// Requests older than maxAge are rejected.
+//
+// New in version v0.7
+func LogoutCallbackHandler(secret string, maxAge time.Duration, handle func(event *LogoutEvent)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<16))
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		if !VerifyWebhookSignature(secret, r.Header.Get("X-Goauth-Timestamp"),
+			r.Header.Get("X-Goauth-Signature"), body, maxAge) {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		var event LogoutEvent
+		if err := json.Unmarshal(body, &event); err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		handle(&event)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// RedisLogoutPublisher publishes LogoutEvents as JSON to a redis pub/sub
+// channel, receivers can use SubscribeLogouts.
+// Note that redis pub/sub doesn't store messages: applications that aren't
+// subscribed when the event is published never receive it.
+//
+// New in version v0.7
+type RedisLogoutPublisher struct {
+	// Client is the client to connect to redis.
+	Client *redis.Client
+
+	// Channel is the name of the channel, defaults to
+	// DefaultLogoutChannel.
+	Channel string
+}
+
+// DefaultLogoutChannel is the default redis channel for LogoutEvents.
+//
+// New in version v0.7
+const DefaultLogoutChannel = "goauth:logout"
+
+// NewRedisLogoutPublisher returns a new RedisLogoutPublisher.
+//
+// New in version v0.7
+func NewRedisLogoutPublisher(client *redis.Client) *RedisLogoutPublisher {
+	return &RedisLogoutPublisher{Client: client, Channel: DefaultLogoutChannel}
+}
+
+// Publish publishes the event.
+func (p *RedisLogoutPublisher) Publish(event *LogoutEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	err = p.Client.Publish(p.Channel, string(payload)).Err()
+	return wrapBackendError("redis", "Publish", err)
+}
+
+// NotifyLogout publishes the event in a new goroutine, errors are logged.
+func (p *RedisLogoutPublisher) NotifyLogout(event *LogoutEvent) {
+	go func() {
+		if err := p.Publish(event); err != nil {
+			log.WithError(err).WithField("session", event.SessionID).Error("goauth: Can't publish logout event")
+		}
+	}()
+}
+
+// SubscribeLogouts subscribes to the redis channel and passes each
+// LogoutEvent to handle until ctx is done. It blocks, so usually it's
+// called in a new goroutine. Messages that can't be decoded are logged and
+// skipped.
+//
+// New in version v0.7
+func SubscribeLogouts(ctx context.Context, client *redis.Client, channel string, handle func(event *LogoutEvent)) error {
+	pubsub := client.Subscribe(channel)
+	defer pubsub.Close()
+	// wait until the subscription is confirmed
+	if _, err := pubsub.Receive(); err != nil {
+		return wrapBackendError("redis", "Subscribe", err)
+	}
+	messages := pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case msg, ok := <-messages:
+			if !ok {
+				return nil
+			}
+			var event LogoutEvent
+			if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+				log.WithError(err).Warn("goauth: Can't decode logout event")
+				continue
+			}
+			handle(&event)
+		}
+	}
+}
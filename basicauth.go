@@ -0,0 +1,256 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	log "github.com/sirupsen/logrus"
+)
+
+type basicAuthCacheEntry struct {
+	mac        []byte
+	userID     uint64
+	validUntil time.Time
+}
+
+// BasicAuthMiddleware protects handlers with HTTP basic authentication,
+// the credentials are checked with UserHandler.Validate. This is useful to
+// quickly protect internal tools.
+//
+// Password hashes are expensive by design, so successful logins are cached
+// in memory for CacheDuration: the cache stores a keyed HMAC of the
+// password, never the password itself. A changed password is noticed after
+// CacheDuration at the latest, use ClearCache if you need it immediately.
+//
+// The user id is stored in the request context as with the
+// SessionMiddleware, so UserIDFromContext works.
+// Always use basic auth over https only!
+//
+// Set LoginService to limit the number of attempts and Policy to deny
+// logins, for example with BusinessHoursPolicy. Inactive users are always
+// denied if Users implements ActiveFlagHandler. The middleware responds
+// with 429 Too Many Requests if the rate limit is exceeded, 403 Forbidden
+// for banned IP addresses, denied logins and inactive users and 503 Service
+// Unavailable if the password can't be verified now (ErrVerificationBusy).
+//
+// New in version v0.7
+type BasicAuthMiddleware struct {
+	Users UserHandler
+
+	// Realm is the realm sent in the WWW-Authenticate header, defaults to
+	// "Restricted".
+	Realm string
+
+	// CacheDuration is the duration a successful validation is cached,
+	// defaults to 5 minutes. Set to 0 to disable the cache.
+	CacheDuration time.Duration
+
+	// LoginService is used to validate the credentials if it is not nil,
+	// so the attempts are rate limited and the IPFilter is consulted. This
+	// happens for every request, also if the validation is cached: Choose
+	// an IPLimiter that allows the request rate of your clients.
+	LoginService *LoginService
+
+	// Policy is evaluated for each request with valid credentials (also
+	// if the validation is cached), may be nil. LoginStepUp is handled as
+	// LoginDeny, basic auth has no additional steps.
+	Policy LoginPolicy
+
+	initOnce sync.Once
+	cacheKey []byte
+	cache    map[string]basicAuthCacheEntry
+	mutex    sync.Mutex
+}
+
+// NewBasicAuthMiddleware returns a new BasicAuthMiddleware.
+func NewBasicAuthMiddleware(users UserHandler, realm string) *BasicAuthMiddleware {
+	if realm == "" {
+		realm = "Restricted"
+	}
+	return &BasicAuthMiddleware{Users: users, Realm: realm,
+		CacheDuration: 5 * time.Minute}
+}
+
+// init creates the cache, so a BasicAuthMiddleware can be created without
+// NewBasicAuthMiddleware.
+func (m *BasicAuthMiddleware) init() {
+	m.initOnce.Do(func() {
+		m.cacheKey = securecookie.GenerateRandomKey(32)
+		m.mutex.Lock()
+		if m.cache == nil {
+			m.cache = make(map[string]basicAuthCacheEntry)
+		}
+		m.mutex.Unlock()
+	})
+}
+
+func (m *BasicAuthMiddleware) mac(userName, password string) []byte {
+	h := hmac.New(sha256.New, m.cacheKey)
+	h.Write([]byte(userName))
+	h.Write([]byte{0})
+	h.Write([]byte(password))
+	return h.Sum(nil)
+}
+
+// ClearCache removes all cached validations.
+func (m *BasicAuthMiddleware) ClearCache() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.cache = make(map[string]basicAuthCacheEntry)
+}
+
+// Validate checks the credentials, it returns the user id or NoUserID if
+// the credentials are wrong. ip is the address of the client for the
+// LoginService, it may be "" if unknown.
+// The IP filter and the rate limits of the LoginService are checked for
+// cached validations as well, the cache only saves the password hashing.
+func (m *BasicAuthMiddleware) Validate(userName, password, ip string) (uint64, error) {
+	m.init()
+	now := CurrentTime()
+	userKey := loginUserKey("", userName)
+	if m.LoginService != nil {
+		if err := m.LoginService.check(userKey, ip); err != nil {
+			return NoUserID, err
+		}
+	}
+	var mac []byte
+	if m.CacheDuration > 0 {
+		mac = m.mac(userName, password)
+		m.mutex.Lock()
+		entry, has := m.cache[userName]
+		m.mutex.Unlock()
+		if has && KeyValid(now, entry.validUntil) && hmac.Equal(entry.mac, mac) {
+			if m.LoginService != nil {
+				if err := m.LoginService.resetUser(userKey); err != nil {
+					return NoUserID, err
+				}
+			}
+			return entry.userID, nil
+		}
+	}
+	var id uint64
+	var err error
+	if m.LoginService != nil {
+		id, err = m.LoginService.validateChecked("", userKey, userName, []byte(password), ip)
+	} else {
+		id, err = m.Users.Validate(userName, []byte(password))
+	}
+	if err == ErrUserNotFound || err == ErrRegistrationPending {
+		return NoUserID, nil
+	}
+	if err != nil || id == NoUserID {
+		return NoUserID, err
+	}
+	if m.CacheDuration > 0 {
+		m.mutex.Lock()
+		// remove expired entries so the cache doesn't grow forever
+		for name, entry := range m.cache {
+			if KeyInvalid(now, entry.validUntil) {
+				delete(m.cache, name)
+			}
+		}
+		m.cache[userName] = basicAuthCacheEntry{mac: mac, userID: id,
+			validUntil: now.Add(m.CacheDuration)}
+		m.mutex.Unlock()
+	}
+	return id, nil
+}
+
+// evaluatePolicy returns ErrLoginDenied if Policy doesn't allow the login
+// and ErrUserInactive if the user is not active (see ActiveFlagHandler).
+func (m *BasicAuthMiddleware) evaluatePolicy(r *http.Request, userName string) error {
+	activeFlag := hasActiveFlag(m.Users)
+	if m.Policy == nil && !activeFlag {
+		return nil
+	}
+	attempt, err := NewLoginAttempt(r, m.Users, userName)
+	if err == ErrUserNotFound {
+		// deleted while the validation was cached
+		return ErrLoginDenied
+	}
+	if err != nil {
+		return err
+	}
+	if activeFlag && !attempt.User.IsActive {
+		return ErrUserInactive
+	}
+	if m.Policy == nil {
+		return nil
+	}
+	decision, err := m.Policy.Evaluate(attempt)
+	if err != nil {
+		return err
+	}
+	if decision != LoginAllow {
+		return ErrLoginDenied
+	}
+	return nil
+}
+
+// Middleware returns a handler that calls next only if the request has
+// valid basic auth credentials.
+func (m *BasicAuthMiddleware) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userName, password, ok := r.BasicAuth()
+		if ok {
+			id, err := m.Validate(userName, password, ClientIP(r))
+			if err == nil && id != NoUserID {
+				err = m.evaluatePolicy(r, userName)
+			}
+			if rateErr, isRate := err.(*RateLimitError); isRate {
+				SetRetryAfter(w, rateErr.RetryAfter)
+				http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+				return
+			}
+			switch err {
+			case nil:
+			case ErrIPBanned, ErrLoginDenied, ErrUserInactive:
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			case ErrVerificationBusy:
+				SetRetryAfter(w, time.Second)
+				http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+				return
+			default:
+				log.WithError(err).Error("goauth: Can't validate basic auth credentials")
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			if id != NoUserID {
+				now := CurrentTime()
+				data := &SessionKeyData{User: id, CreationTime: now, ValidUntil: now}
+				next.ServeHTTP(w, r.WithContext(NewSessionContext(r.Context(), "", data)))
+				return
+			}
+		}
+		w.Header().Set("WWW-Authenticate", "Basic realm="+strconv.Quote(m.Realm)+`, charset="UTF-8"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	})
+}
@@ -0,0 +1,228 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TokenVerifier verifies a bearer token and returns the identity it
+// belongs to. It must return ErrKeyNotFound or ErrInvalidKey if the token is
+// unknown or expired, other errors are treated as internal errors.
+//
+// goauth ships SessionTokenVerifier for session keys (which includes the
+// access tokens of OAuthServer), for JWTs or API keys implement this
+// interface and combine the verifiers with ChainTokenVerifier.
+//
+// New in version v0.7
+type TokenVerifier interface {
+	VerifyToken(token string) (*SessionKeyData, error)
+}
+
+// TokenVerifierFunc is a function that implements TokenVerifier.
+type TokenVerifierFunc func(token string) (*SessionKeyData, error)
+
+// VerifyToken calls f(token).
+func (f TokenVerifierFunc) VerifyToken(token string) (*SessionKeyData, error) {
+	return f(token)
+}
+
+// SessionTokenVerifier accepts session keys of a SessionController as
+// bearer tokens.
+type SessionTokenVerifier struct {
+	Controller *SessionController
+}
+
+// VerifyToken looks up the token with Controller.GetData, signed tokens
+// (see SessionController.Signer) are verified first.
+func (v SessionTokenVerifier) VerifyToken(token string) (*SessionKeyData, error) {
+	return v.verify(token, false)
+}
+
+// verify implements VerifyToken, if allowScoped is true sessions restricted
+// to scopes are accepted as well.
+func (v SessionTokenVerifier) verify(token string, allowScoped bool) (*SessionKeyData, error) {
+	key, err := v.Controller.ParseClientKey(token)
+	if err != nil {
+		return nil, err
+	}
+	data, err := v.Controller.GetData(key)
+	if err != nil {
+		return nil, err
+	}
+	if KeyInvalid(clockNow(v.Controller.Clock), data.ValidUntil) {
+		return nil, ErrInvalidKey
+	}
+	if err := v.Controller.checkAudience(key); err != nil {
+		return nil, err
+	}
+	if err := v.Controller.loadScopes(key, data); err != nil {
+		return nil, err
+	}
+	if data.Scoped && !allowScoped {
+		return nil, ErrScopedSession
+	}
+	return data, nil
+}
+
+// verifyToken verifies the token with verifier, if allowScoped is true
+// sessions restricted to scopes are accepted by the verifiers of this
+// package as well. Other verifiers must reject them in VerifyToken.
+func verifyToken(verifier TokenVerifier, token string, allowScoped bool) (*SessionKeyData, error) {
+	switch v := verifier.(type) {
+	case SessionTokenVerifier:
+		return v.verify(token, allowScoped)
+	case *DelegationTokens:
+		return v.verify(token, allowScoped)
+	case ChainTokenVerifier:
+		return v.verify(token, allowScoped)
+	default:
+		return verifier.VerifyToken(token)
+	}
+}
+
+// plainToken returns the plain session key of a verified token if verifier
+// is a SessionTokenVerifier (see SessionController.Signer) and the token
+// otherwise.
+func plainToken(verifier TokenVerifier, token string) string {
+	if v, ok := verifier.(SessionTokenVerifier); ok {
+		token, _ = v.Controller.ParseClientKey(token)
+	}
+	return token
+}
+
+// ChainTokenVerifier tries all verifiers in order and returns the result of
+// the first one that accepts the token. If no verifier accepts the token it
+// returns ErrKeyNotFound, internal errors are returned immediately.
+type ChainTokenVerifier []TokenVerifier
+
+// VerifyToken tries all verifiers in the chain.
+func (chain ChainTokenVerifier) VerifyToken(token string) (*SessionKeyData, error) {
+	return chain.verify(token, false)
+}
+
+// verify implements VerifyToken, see verifyToken.
+func (chain ChainTokenVerifier) verify(token string, allowScoped bool) (*SessionKeyData, error) {
+	for _, v := range chain {
+		data, err := verifyToken(v, token, allowScoped)
+		if err == nil {
+			return data, nil
+		}
+		if !isAuthError(err) {
+			return nil, err
+		}
+	}
+	return nil, ErrKeyNotFound
+}
+
+// BearerMiddleware authenticates requests with an
+// "Authorization: Bearer <token>" header, for SPAs, mobile apps and other
+// API clients that don't use cookies.
+// The identity is stored in the request context just like the
+// SessionMiddleware does, so UserFromContext etc. work the same way for
+// both; SessionKeyFromContext returns the token.
+//
+// If you want to accept both cookies and bearer tokens use the
+// SessionMiddleware and set its Tokens field.
+//
+// New in version v0.7
+type BearerMiddleware struct {
+	Verifier TokenVerifier
+
+	// Unauthorized is called by RequireBearer if there is no valid token,
+	// defaults to a 401 response with a WWW-Authenticate header.
+	Unauthorized http.HandlerFunc
+}
+
+// NewBearerMiddleware returns a new BearerMiddleware.
+func NewBearerMiddleware(verifier TokenVerifier) *BearerMiddleware {
+	return &BearerMiddleware{Verifier: verifier}
+}
+
+// Authenticate verifies the bearer token of the request. It returns
+// ErrNotAuthSession if the request has no bearer token. Tokens restricted
+// to scopes are rejected with ErrScopedSession, see RequireScope.
+func (m *BearerMiddleware) Authenticate(r *http.Request) (string, *SessionKeyData, error) {
+	return m.authenticate(r, false)
+}
+
+// authenticate implements Authenticate, if allowScoped is true tokens
+// restricted to scopes are accepted as well.
+func (m *BearerMiddleware) authenticate(r *http.Request, allowScoped bool) (string, *SessionKeyData, error) {
+	token := bearerToken(r)
+	if token == "" {
+		return "", nil, ErrNotAuthSession
+	}
+	data, err := verifyToken(m.Verifier, token, allowScoped)
+	if err != nil {
+		return "", nil, err
+	}
+	return plainToken(m.Verifier, token), data, nil
+}
+
+// RequireBearer returns a handler that calls next only if the request has a
+// valid bearer token.
+func (m *BearerMiddleware) RequireBearer(next http.Handler) http.Handler {
+	return m.require(false, next)
+}
+
+// require implements RequireBearer and RequireScope.
+func (m *BearerMiddleware) require(allowScoped bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, data, err := m.authenticate(r, allowScoped)
+		if err != nil {
+			if !isAuthError(err) {
+				log.WithError(err).Error("goauth: Can't verify bearer token")
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			if m.Unauthorized != nil {
+				m.Unauthorized(w, r)
+			} else if err == ErrNotAuthSession {
+				writeBearerError(w, "")
+			} else {
+				writeBearerError(w, "invalid_token")
+			}
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(NewSessionContext(r.Context(), token, data)))
+	})
+}
+
+// OptionalBearer returns a handler that always calls next, the identity is
+// only stored in the context if the request has a valid bearer token.
+func (m *BearerMiddleware) OptionalBearer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, data, err := m.Authenticate(r)
+		if err != nil {
+			if !isAuthError(err) {
+				log.WithError(err).Warn("goauth: Can't verify bearer token")
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(NewSessionContext(r.Context(), token, data)))
+	})
+}
@@ -0,0 +1,436 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is the original error (see BackendError.Err) returned by
+// CircuitBreaker if the circuit is open, the Kind of the error is
+// ErrBackendUnavailable.
+var ErrCircuitOpen = errors.New("The circuit breaker is open.")
+
+// CircuitState is the state of a CircuitBreaker.
+//
+// New in version v0.7
+type CircuitState int
+
+const (
+	// CircuitClosed means that calls are executed.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen means that calls fail fast.
+	CircuitOpen
+	// CircuitHalfOpen means that a single trial call is executed, the
+	// circuit is closed again if it succeeds.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// IsBackendFailure reports whether err means that the backend failed (it's
+// unavailable or timed out), errors like ErrUserNotFound are results and not
+// failures. It's the default of CircuitBreaker.IsFailure.
+//
+// New in version v0.7
+func IsBackendFailure(err error) bool {
+	return err != nil && (errors.Is(err, ErrBackendUnavailable) || isUnavailableError(err))
+}
+
+// CircuitBreaker opens after FailureThreshold consecutive backend failures,
+// while it's open calls fail fast with ErrBackendUnavailable instead of
+// hammering a down database. After OpenDuration a single trial call is
+// executed, if it succeeds the circuit is closed again.
+//
+// Use it with CircuitBreakerSessionHandler and CircuitBreakerUserHandler.
+//
+// New in version v0.7
+type CircuitBreaker struct {
+	// FailureThreshold is the number of consecutive failures that open the
+	// circuit, defaults to 5.
+	FailureThreshold int
+
+	// OpenDuration is the time the circuit stays open, defaults to 30
+	// seconds.
+	OpenDuration time.Duration
+
+	// IsFailure decides which errors are failures, defaults to
+	// IsBackendFailure.
+	IsFailure func(err error) bool
+
+	mutex    sync.Mutex
+	state    CircuitState
+	failures int
+	openedAt time.Time
+}
+
+// NewCircuitBreaker returns a new closed CircuitBreaker.
+func NewCircuitBreaker(failureThreshold int, openDuration time.Duration) *CircuitBreaker {
+	if failureThreshold <= 0 {
+		failureThreshold = 5
+	}
+	if openDuration <= 0 {
+		openDuration = 30 * time.Second
+	}
+	return &CircuitBreaker{FailureThreshold: failureThreshold,
+		OpenDuration: openDuration, IsFailure: IsBackendFailure}
+}
+
+// State returns the current state.
+func (b *CircuitBreaker) State() CircuitState {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.state == CircuitOpen && time.Since(b.openedAt) >= b.OpenDuration {
+		return CircuitHalfOpen
+	}
+	return b.state
+}
+
+// Allow reports whether a call may be executed, if it returns true the
+// result must be passed to Record.
+func (b *CircuitBreaker) Allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	switch b.state {
+	case CircuitOpen:
+		if time.Since(b.openedAt) < b.OpenDuration {
+			return false
+		}
+		// let a single call through
+		b.state = CircuitHalfOpen
+		return true
+	case CircuitHalfOpen:
+		// the trial call is still running
+		return false
+	default:
+		return true
+	}
+}
+
+func (b *CircuitBreaker) failure(err error) bool {
+	if b.IsFailure == nil {
+		return IsBackendFailure(err)
+	}
+	return b.IsFailure(err)
+}
+
+// Record records the result of a call.
+func (b *CircuitBreaker) Record(err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if !b.failure(err) {
+		b.state = CircuitClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == CircuitHalfOpen || b.failures >= b.FailureThreshold {
+		b.state = CircuitOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// Do executes f if the circuit allows it and records the result, otherwise
+// it returns ErrCircuitOpen wrapped in a *BackendError.
+func (b *CircuitBreaker) Do(op string, f func() error) error {
+	if !b.Allow() {
+		return &BackendError{Backend: "breaker", Op: op, Kind: ErrBackendUnavailable, Err: ErrCircuitOpen}
+	}
+	err := f()
+	b.Record(err)
+	return err
+}
+
+// call is Do with a fallback that is called (if not nil) if the circuit is
+// open or f failed.
+func (b *CircuitBreaker) call(op string, f, fallback func() error) error {
+	err := b.Do(op, f)
+	if fallback != nil && b.failure(err) {
+		return fallback()
+	}
+	return err
+}
+
+// CircuitBreakerSessionHandler wraps a SessionHandler with a
+// CircuitBreaker. If Fallback is not nil it's used while the circuit is
+// open or if a call failed, for example an InMemoryHandler that keeps users
+// logged in during a short outage (sessions created in the fallback are not
+// known to the primary handler).
+// It implements SessionLister, TenantSessionHandler and HealthChecker if the
+// wrapped handler does, otherwise these methods return ErrNotSupported.
+// The health check is not guarded by the breaker.
+//
+// New in version v0.7
+type CircuitBreakerSessionHandler struct {
+	SessionHandler
+	Breaker  *CircuitBreaker
+	Fallback SessionHandler
+}
+
+// NewCircuitBreakerSessionHandler returns a new
+// CircuitBreakerSessionHandler, fallback may be nil.
+func NewCircuitBreakerSessionHandler(h SessionHandler, breaker *CircuitBreaker, fallback SessionHandler) *CircuitBreakerSessionHandler {
+	return &CircuitBreakerSessionHandler{SessionHandler: h, Breaker: breaker, Fallback: fallback}
+}
+
+func (h *CircuitBreakerSessionHandler) GetData(key string) (res *SessionKeyData, err error) {
+	var fallback func() error
+	if h.Fallback != nil {
+		fallback = func() (err error) {
+			res, err = h.Fallback.GetData(key)
+			return
+		}
+	}
+	err = h.Breaker.call("GetData", func() (err error) {
+		res, err = h.SessionHandler.GetData(key)
+		return
+	}, fallback)
+	return
+}
+
+func (h *CircuitBreakerSessionHandler) CreateEntry(user UserKeyType, key string, validDuration time.Duration) (res *SessionKeyData, err error) {
+	var fallback func() error
+	if h.Fallback != nil {
+		fallback = func() (err error) {
+			res, err = h.Fallback.CreateEntry(user, key, validDuration)
+			return
+		}
+	}
+	err = h.Breaker.call("CreateEntry", func() (err error) {
+		res, err = h.SessionHandler.CreateEntry(user, key, validDuration)
+		return
+	}, fallback)
+	return
+}
+
+func (h *CircuitBreakerSessionHandler) DeleteEntriesForUser(user UserKeyType) (num int64, err error) {
+	err = h.Breaker.Do("DeleteEntriesForUser", func() (err error) {
+		num, err = h.SessionHandler.DeleteEntriesForUser(user)
+		return
+	})
+	if h.Fallback != nil {
+		// the user may have sessions in both handlers
+		fallbackNum, fallbackErr := h.Fallback.DeleteEntriesForUser(user)
+		num += fallbackNum
+		if err == nil {
+			err = fallbackErr
+		}
+	}
+	return
+}
+
+func (h *CircuitBreakerSessionHandler) DeleteInvalidKeys() (num int64, err error) {
+	err = h.Breaker.Do("DeleteInvalidKeys", func() (err error) {
+		num, err = h.SessionHandler.DeleteInvalidKeys()
+		return
+	})
+	return
+}
+
+func (h *CircuitBreakerSessionHandler) DeleteKey(key string) error {
+	err := h.Breaker.Do("DeleteKey", func() error {
+		return h.SessionHandler.DeleteKey(key)
+	})
+	if h.Fallback != nil {
+		if fallbackErr := h.Fallback.DeleteKey(key); err == nil {
+			err = fallbackErr
+		}
+	}
+	return err
+}
+
+// ListSessionsForUser calls the wrapped handler, see SessionLister.
+func (h *CircuitBreakerSessionHandler) ListSessionsForUser(user UserKeyType) (res map[string]*SessionKeyData, err error) {
+	lister, ok := h.SessionHandler.(SessionLister)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	err = h.Breaker.Do("ListSessionsForUser", func() (err error) {
+		res, err = lister.ListSessionsForUser(user)
+		return
+	})
+	return
+}
+
+// CreateEntryForTenant calls the wrapped handler, see TenantSessionHandler.
+func (h *CircuitBreakerSessionHandler) CreateEntryForTenant(tenant string, user UserKeyType, key string, validDuration time.Duration) (res *SessionKeyData, err error) {
+	tenantHandler, ok := h.SessionHandler.(TenantSessionHandler)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	err = h.Breaker.Do("CreateEntry", func() (err error) {
+		res, err = tenantHandler.CreateEntryForTenant(tenant, user, key, validDuration)
+		return
+	})
+	return
+}
+
+// GetDataForTenant calls the wrapped handler, see TenantSessionHandler.
+func (h *CircuitBreakerSessionHandler) GetDataForTenant(tenant, key string) (res *SessionKeyData, err error) {
+	tenantHandler, ok := h.SessionHandler.(TenantSessionHandler)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	err = h.Breaker.Do("GetData", func() (err error) {
+		res, err = tenantHandler.GetDataForTenant(tenant, key)
+		return
+	})
+	return
+}
+
+// Healthy calls the wrapped handler if it implements HealthChecker.
+func (h *CircuitBreakerSessionHandler) Healthy(ctx context.Context) error {
+	if checker, ok := h.SessionHandler.(HealthChecker); ok {
+		return checker.Healthy(ctx)
+	}
+	return nil
+}
+
+// CircuitBreakerUserHandler wraps a UserHandler with a CircuitBreaker. If
+// Fallback is not nil it's used for reads (Validate, ListUsers,
+// GetUserName, GetUserID and GetUserBaseInfo) while the circuit is open or
+// if a call failed, for example a read replica. Writes are never sent to the
+// fallback.
+// Like InstrumentedUserHandler it only implements UserHandler and
+// HealthChecker.
+//
+// New in version v0.7
+type CircuitBreakerUserHandler struct {
+	Users    UserHandler
+	Breaker  *CircuitBreaker
+	Fallback UserHandler
+}
+
+// NewCircuitBreakerUserHandler returns a new CircuitBreakerUserHandler,
+// fallback may be nil.
+func NewCircuitBreakerUserHandler(users UserHandler, breaker *CircuitBreaker, fallback UserHandler) *CircuitBreakerUserHandler {
+	return &CircuitBreakerUserHandler{Users: users, Breaker: breaker, Fallback: fallback}
+}
+
+// Unwrap returns the wrapped UserHandler.
+func (h *CircuitBreakerUserHandler) Unwrap() UserHandler {
+	return h.Users
+}
+
+// read executes f with the primary handler and falls back to the fallback
+// handler.
+func (h *CircuitBreakerUserHandler) read(op string, f func(users UserHandler) error) error {
+	var fallback func() error
+	if h.Fallback != nil {
+		fallback = func() error {
+			return f(h.Fallback)
+		}
+	}
+	return h.Breaker.call(op, func() error {
+		return f(h.Users)
+	}, fallback)
+}
+
+func (h *CircuitBreakerUserHandler) Init() error {
+	return h.Breaker.Do("Init", h.Users.Init)
+}
+
+func (h *CircuitBreakerUserHandler) Insert(userName, firstName, lastName, email string, plainPW []byte) (id uint64, err error) {
+	id = NoUserID
+	err = h.Breaker.Do("Insert", func() (err error) {
+		id, err = h.Users.Insert(userName, firstName, lastName, email, plainPW)
+		return
+	})
+	return
+}
+
+func (h *CircuitBreakerUserHandler) Validate(userName string, cleartextPwCheck []byte) (id uint64, err error) {
+	id = NoUserID
+	err = h.read("Validate", func(users UserHandler) (err error) {
+		id, err = users.Validate(userName, cleartextPwCheck)
+		return
+	})
+	return
+}
+
+func (h *CircuitBreakerUserHandler) UpdatePassword(userName string, plainPW []byte) error {
+	return h.Breaker.Do("UpdatePassword", func() error {
+		return h.Users.UpdatePassword(userName, plainPW)
+	})
+}
+
+func (h *CircuitBreakerUserHandler) ListUsers() (res map[uint64]string, err error) {
+	err = h.read("ListUsers", func(users UserHandler) (err error) {
+		res, err = users.ListUsers()
+		return
+	})
+	return
+}
+
+func (h *CircuitBreakerUserHandler) GetUserName(id uint64) (res string, err error) {
+	err = h.read("GetUserName", func(users UserHandler) (err error) {
+		res, err = users.GetUserName(id)
+		return
+	})
+	return
+}
+
+func (h *CircuitBreakerUserHandler) GetUserID(userName string) (res uint64, err error) {
+	res = NoUserID
+	err = h.read("GetUserID", func(users UserHandler) (err error) {
+		res, err = users.GetUserID(userName)
+		return
+	})
+	return
+}
+
+func (h *CircuitBreakerUserHandler) DeleteUser(userName string) error {
+	return h.Breaker.Do("DeleteUser", func() error {
+		return h.Users.DeleteUser(userName)
+	})
+}
+
+func (h *CircuitBreakerUserHandler) GetUserBaseInfo(userName string) (res *BaseUserInformation, err error) {
+	err = h.read("GetUserBaseInfo", func(users UserHandler) (err error) {
+		res, err = users.GetUserBaseInfo(userName)
+		return
+	})
+	return
+}
+
+// Healthy calls the wrapped handler if it implements HealthChecker.
+func (h *CircuitBreakerUserHandler) Healthy(ctx context.Context) error {
+	if checker, ok := h.Users.(HealthChecker); ok {
+		return checker.Healthy(ctx)
+	}
+	return nil
+}
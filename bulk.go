@@ -0,0 +1,195 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package goauth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// BulkSessionDeleter is implemented by SessionHandlers that can delete many
+// sessions at once, for example when off-boarding a team or after a
+// credential leak. SQLSessionHandler (with a SQLSessionBulkTemplate),
+// RedisSessionHandler and InMemoryHandler implement this interface.
+//
+// New in version v0.7
+type BulkSessionDeleter interface {
+	// DeleteKeys removes all keys and returns the number of removed keys.
+	// Like DeleteKey it doesn't return an error for keys that don't exist.
+	DeleteKeys(keys []string) (int64, error)
+
+	// DeleteEntriesForUsers removes all keys of the users and returns the
+	// number of removed keys.
+	DeleteEntriesForUsers(users []UserKeyType) (int64, error)
+}
+
+// DeleteKeys removes all keys. If the SessionHandler doesn't implement
+// BulkSessionDeleter DeleteKey is called for each key, the number of keys
+// is returned then (even if some of them didn't exist).
+//
+// New in version v0.7
+func (c *SessionController) DeleteKeys(keys []string) (int64, error) {
+	if bulk, ok := c.SessionHandler.(BulkSessionDeleter); ok {
+		if num, err := bulk.DeleteKeys(keys); err != ErrNotSupported {
+			return num, err
+		}
+	}
+	var removed int64
+	for _, key := range keys {
+		if err := c.SessionHandler.DeleteKey(key); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// DeleteEntriesForUsers removes all keys of the users. If the
+// SessionHandler doesn't implement BulkSessionDeleter DeleteEntriesForUser is
+// called for each user. Guest users are ignored, see DeleteEntriesForUser.
+//
+// New in version v0.7
+func (c *SessionController) DeleteEntriesForUsers(users []UserKeyType) (int64, error) {
+	users = withoutGuests(users)
+	if bulk, ok := c.SessionHandler.(BulkSessionDeleter); ok {
+		if num, err := bulk.DeleteEntriesForUsers(users); err != ErrNotSupported {
+			return num, err
+		}
+	}
+	var removed int64
+	for _, user := range users {
+		num, err := c.SessionHandler.DeleteEntriesForUser(user)
+		if err != nil {
+			return removed, err
+		}
+		removed += num
+	}
+	return removed, nil
+}
+
+// MultiSessionGetter is implemented by SessionHandlers that can look up many
+// keys at once, for example for gateways that validate many tokens per
+// request. SQLSessionHandler (with a SQLSessionBulkTemplate),
+// RedisSessionHandler and InMemoryHandler implement this interface.
+//
+// New in version v0.7
+type MultiSessionGetter interface {
+	// GetDataMulti returns the data for all keys, keys that don't exist are
+	// not contained in the result. The result contains invalid (expired)
+	// sessions as well, like GetData.
+	GetDataMulti(keys []string) (map[string]*SessionKeyData, error)
+}
+
+// GetDataMulti returns the data for all keys, see MultiSessionGetter. If the
+// SessionHandler doesn't implement MultiSessionGetter GetData is called for
+// each key.
+//
+// New in version v0.7
+func (c *SessionController) GetDataMulti(keys []string) (map[string]*SessionKeyData, error) {
+	if multi, ok := c.SessionHandler.(MultiSessionGetter); ok {
+		if res, err := multi.GetDataMulti(keys); err != ErrNotSupported {
+			return res, err
+		}
+	}
+	res := make(map[string]*SessionKeyData, len(keys))
+	for _, key := range keys {
+		data, err := c.SessionHandler.GetData(key)
+		switch {
+		case err == nil:
+			res[key] = data
+		case err != ErrKeyNotFound:
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// ValidateKeys returns the data of all keys that are valid, invalid keys,
+// guest sessions and keys that don't exist are not contained in the result.
+//
+// New in version v0.7
+func (c *SessionController) ValidateKeys(keys []string) (map[string]*SessionKeyData, error) {
+	res, err := c.GetDataMulti(keys)
+	if err != nil {
+		return nil, err
+	}
+	now := clockNow(c.Clock)
+	for key, data := range res {
+		if !KeyValid(now, data.ValidUntil) || IsGuestUser(data.User) {
+			delete(res, key)
+		}
+	}
+	return res, nil
+}
+
+// validatedKey is the JSON representation of a valid key in
+// ValidateKeysHandler.
+type validatedKey struct {
+	User       UserKeyType `json:"user"`
+	Created    time.Time   `json:"created"`
+	ValidUntil time.Time   `json:"valid_until"`
+}
+
+// ValidateKeysHandler returns a handler that validates many session keys at
+// once, for example for gateways. It expects a POST request with the JSON
+// body {"keys": [...]} and responds with
+// {"sessions": {"<key>": {"user": ..., "created": ..., "valid_until": ...}}}
+// for all valid keys. maxKeys limits the number of keys in one request
+// (400 if exceeded), use <= 0 for the default of 1000.
+//
+// This handler is meant for internal services, don't expose it publicly.
+//
+// New in version v0.7
+func ValidateKeysHandler(c *SessionController, maxKeys int) http.HandlerFunc {
+	if maxKeys <= 0 {
+		maxKeys = 1000
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requirePost(w, r, RenderJSONError) {
+			return
+		}
+		var req struct {
+			Keys []string `json:"keys"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			RenderJSONError(w, r, http.StatusBadRequest, errors.New("Invalid request body."))
+			return
+		}
+		if len(req.Keys) > maxKeys {
+			RenderJSONError(w, r, http.StatusBadRequest, fmt.Errorf("At most %d keys are allowed.", maxKeys))
+			return
+		}
+		valid, err := c.ValidateKeys(req.Keys)
+		if err != nil {
+			RenderJSONError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		sessions := make(map[string]validatedKey, len(valid))
+		for key, data := range valid {
+			sessions[key] = validatedKey{User: data.User, Created: data.CreationTime, ValidUntil: data.ValidUntil}
+		}
+		RenderJSON(w, r, http.StatusOK, map[string]interface{}{"sessions": sessions})
+	}
+}
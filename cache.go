@@ -0,0 +1,385 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package goauth
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// lruCache is a least recently used cache with a TTL for each entry.
+// It is safe for concurrent use.
+//
+// Each invalidation increments a generation counter, addIfGeneration only
+// adds values that were loaded before no invalidation took place. This way
+// a value that was loaded while it got invalidated is not cached.
+type lruCache struct {
+	mutex      sync.Mutex
+	size       int
+	ttl        time.Duration
+	list       *list.List
+	items      map[string]*list.Element
+	generation uint64
+}
+
+type lruEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+func newLRUCache(size int, ttl time.Duration) *lruCache {
+	return &lruCache{size: size, ttl: ttl, list: list.New(),
+		items: make(map[string]*list.Element)}
+}
+
+// get returns the value for key and the current generation.
+func (c *lruCache) get(key string) (interface{}, uint64, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	elem, has := c.items[key]
+	if !has {
+		return nil, c.generation, false
+	}
+	entry := elem.Value.(*lruEntry)
+	if time.Now().After(entry.expires) {
+		c.removeElement(elem)
+		return nil, c.generation, false
+	}
+	c.list.MoveToFront(elem)
+	return entry.value, c.generation, true
+}
+
+// addIfGeneration adds the value if the generation is still generation.
+func (c *lruCache) addIfGeneration(key string, value interface{}, generation uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if generation != c.generation || c.size <= 0 {
+		return
+	}
+	expires := time.Now().Add(c.ttl)
+	if elem, has := c.items[key]; has {
+		entry := elem.Value.(*lruEntry)
+		entry.value, entry.expires = value, expires
+		c.list.MoveToFront(elem)
+		return
+	}
+	c.items[key] = c.list.PushFront(&lruEntry{key: key, value: value, expires: expires})
+	for c.list.Len() > c.size {
+		c.removeElement(c.list.Back())
+	}
+}
+
+func (c *lruCache) removeElement(elem *list.Element) {
+	c.list.Remove(elem)
+	delete(c.items, elem.Value.(*lruEntry).key)
+}
+
+// remove removes the key from the cache.
+func (c *lruCache) remove(key string) {
+	c.removeIf(func(k string, value interface{}) bool {
+		return k == key
+	})
+}
+
+// removeIf removes all entries for which f returns true.
+func (c *lruCache) removeIf(f func(key string, value interface{}) bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.generation++
+	for elem := c.list.Front(); elem != nil; {
+		next := elem.Next()
+		entry := elem.Value.(*lruEntry)
+		if f(entry.key, entry.value) {
+			c.removeElement(elem)
+		}
+		elem = next
+	}
+}
+
+// purge removes all entries.
+func (c *lruCache) purge() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.generation++
+	c.list.Init()
+	c.items = make(map[string]*list.Element)
+}
+
+// flightGroup deduplicates concurrent calls for the same key: while a call is
+// in flight all other calls wait for its result.
+type flightGroup struct {
+	mutex sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	wg    sync.WaitGroup
+	value interface{}
+	err   error
+}
+
+func (g *flightGroup) do(key string, f func() (interface{}, error)) (interface{}, error) {
+	g.mutex.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	if call, has := g.calls[key]; has {
+		g.mutex.Unlock()
+		call.wg.Wait()
+		return call.value, call.err
+	}
+	call := new(flightCall)
+	call.wg.Add(1)
+	g.calls[key] = call
+	g.mutex.Unlock()
+
+	call.value, call.err = f()
+	call.wg.Done()
+
+	g.mutex.Lock()
+	delete(g.calls, key)
+	g.mutex.Unlock()
+	return call.value, call.err
+}
+
+// CachedSessionHandler is a read-through cache for GetData of another
+// SessionHandler: Results are kept in an in-process LRU cache for a certain
+// time (TTL), concurrent lookups for the same key are sent to the wrapped
+// handler only once. Errors (for example ErrKeyNotFound) are not cached.
+//
+// DeleteKey and DeleteEntriesForUser remove the affected entries from the
+// cache. Note that the cache is local to the process: If you run several
+// instances of your app a session that is deleted by another instance is
+// considered valid until the TTL expires, so keep the TTL short.
+// Like InstrumentedSessionHandler it forwards SessionLister,
+// TenantSessionHandler and HealthChecker, sessions for tenants are not
+// cached.
+//
+// New in version v0.7
+type CachedSessionHandler struct {
+	SessionHandler
+	cache  *lruCache
+	flight flightGroup
+}
+
+// NewCachedSessionHandler returns a new CachedSessionHandler that caches at
+// most size sessions for ttl.
+//
+// New in version v0.7
+func NewCachedSessionHandler(h SessionHandler, size int, ttl time.Duration) *CachedSessionHandler {
+	return &CachedSessionHandler{SessionHandler: h, cache: newLRUCache(size, ttl)}
+}
+
+func (h *CachedSessionHandler) GetData(key string) (*SessionKeyData, error) {
+	if value, _, has := h.cache.get(key); has {
+		data := *value.(*SessionKeyData)
+		return &data, nil
+	}
+	value, err := h.flight.do(key, func() (interface{}, error) {
+		_, generation, _ := h.cache.get(key)
+		data, err := h.SessionHandler.GetData(key)
+		if err != nil {
+			return nil, err
+		}
+		h.cache.addIfGeneration(key, data, generation)
+		return data, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	data := *value.(*SessionKeyData)
+	return &data, nil
+}
+
+func (h *CachedSessionHandler) DeleteEntriesForUser(user UserKeyType) (int64, error) {
+	num, err := h.SessionHandler.DeleteEntriesForUser(user)
+	h.cache.removeIf(func(key string, value interface{}) bool {
+		return sameUser(value.(*SessionKeyData).User, user)
+	})
+	return num, err
+}
+
+func (h *CachedSessionHandler) DeleteInvalidKeys() (int64, error) {
+	num, err := h.SessionHandler.DeleteInvalidKeys()
+	now := CurrentTime()
+	h.cache.removeIf(func(key string, value interface{}) bool {
+		return !KeyValid(now, value.(*SessionKeyData).ValidUntil)
+	})
+	return num, err
+}
+
+func (h *CachedSessionHandler) DeleteKey(key string) error {
+	err := h.SessionHandler.DeleteKey(key)
+	h.cache.remove(key)
+	return err
+}
+
+// Invalidate removes the key from the cache, for example if the session was
+// changed by another program.
+func (h *CachedSessionHandler) Invalidate(key string) {
+	h.cache.remove(key)
+}
+
+// Purge removes all entries from the cache.
+func (h *CachedSessionHandler) Purge() {
+	h.cache.purge()
+}
+
+// ListSessionsForUser calls the wrapped handler, see SessionLister.
+func (h *CachedSessionHandler) ListSessionsForUser(user UserKeyType) (map[string]*SessionKeyData, error) {
+	lister, ok := h.SessionHandler.(SessionLister)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return lister.ListSessionsForUser(user)
+}
+
+// CreateEntryForTenant calls the wrapped handler, see TenantSessionHandler.
+func (h *CachedSessionHandler) CreateEntryForTenant(tenant string, user UserKeyType, key string, validDuration time.Duration) (*SessionKeyData, error) {
+	tenantHandler, ok := h.SessionHandler.(TenantSessionHandler)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return tenantHandler.CreateEntryForTenant(tenant, user, key, validDuration)
+}
+
+// GetDataForTenant calls the wrapped handler, see TenantSessionHandler.
+func (h *CachedSessionHandler) GetDataForTenant(tenant, key string) (*SessionKeyData, error) {
+	tenantHandler, ok := h.SessionHandler.(TenantSessionHandler)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return tenantHandler.GetDataForTenant(tenant, key)
+}
+
+// Healthy calls the wrapped handler if it implements HealthChecker.
+func (h *CachedSessionHandler) Healthy(ctx context.Context) error {
+	if checker, ok := h.SessionHandler.(HealthChecker); ok {
+		return checker.Healthy(ctx)
+	}
+	return nil
+}
+
+// CachedUserHandler is a read-through cache for GetUserBaseInfo of another
+// UserHandler, see CachedSessionHandler for details about the cache.
+// UpdatePassword and DeleteUser remove the user from the cache, if you change
+// the user in another way (for example with UserAdmin) call Invalidate.
+// Like InstrumentedUserHandler it only implements UserHandler and
+// HealthChecker.
+//
+// New in version v0.7
+type CachedUserHandler struct {
+	Users  UserHandler
+	cache  *lruCache
+	flight flightGroup
+}
+
+// NewCachedUserHandler returns a new CachedUserHandler that caches at most
+// size users for ttl.
+//
+// New in version v0.7
+func NewCachedUserHandler(users UserHandler, size int, ttl time.Duration) *CachedUserHandler {
+	return &CachedUserHandler{Users: users, cache: newLRUCache(size, ttl)}
+}
+
+// Unwrap returns the wrapped UserHandler.
+func (h *CachedUserHandler) Unwrap() UserHandler {
+	return h.Users
+}
+
+func (h *CachedUserHandler) Init() error {
+	return h.Users.Init()
+}
+
+func (h *CachedUserHandler) Insert(userName, firstName, lastName, email string, plainPW []byte) (uint64, error) {
+	return h.Users.Insert(userName, firstName, lastName, email, plainPW)
+}
+
+func (h *CachedUserHandler) Validate(userName string, cleartextPwCheck []byte) (uint64, error) {
+	return h.Users.Validate(userName, cleartextPwCheck)
+}
+
+func (h *CachedUserHandler) UpdatePassword(userName string, plainPW []byte) error {
+	err := h.Users.UpdatePassword(userName, plainPW)
+	h.cache.remove(userName)
+	return err
+}
+
+func (h *CachedUserHandler) ListUsers() (map[uint64]string, error) {
+	return h.Users.ListUsers()
+}
+
+func (h *CachedUserHandler) GetUserName(id uint64) (string, error) {
+	return h.Users.GetUserName(id)
+}
+
+func (h *CachedUserHandler) GetUserID(userName string) (uint64, error) {
+	return h.Users.GetUserID(userName)
+}
+
+func (h *CachedUserHandler) DeleteUser(userName string) error {
+	err := h.Users.DeleteUser(userName)
+	h.cache.remove(userName)
+	return err
+}
+
+func (h *CachedUserHandler) GetUserBaseInfo(userName string) (*BaseUserInformation, error) {
+	if value, _, has := h.cache.get(userName); has {
+		info := *value.(*BaseUserInformation)
+		return &info, nil
+	}
+	value, err := h.flight.do(userName, func() (interface{}, error) {
+		_, generation, _ := h.cache.get(userName)
+		info, err := h.Users.GetUserBaseInfo(userName)
+		if err != nil {
+			return nil, err
+		}
+		h.cache.addIfGeneration(userName, info, generation)
+		return info, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	info := *value.(*BaseUserInformation)
+	return &info, nil
+}
+
+// Invalidate removes the user from the cache.
+func (h *CachedUserHandler) Invalidate(userName string) {
+	h.cache.remove(userName)
+}
+
+// Purge removes all entries from the cache.
+func (h *CachedUserHandler) Purge() {
+	h.cache.purge()
+}
+
+// Healthy calls the wrapped handler if it implements HealthChecker.
+func (h *CachedUserHandler) Healthy(ctx context.Context) error {
+	if checker, ok := h.Users.(HealthChecker); ok {
+		return checker.Healthy(ctx)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"testing"
+	"time"
+)
+
+// userSessionHandler is a SessionHandler that returns the user with the
+// type a database driver uses (int64) and records the deletions.
+type userSessionHandler struct {
+	*InMemoryHandler
+	deleted []UserKeyType
+}
+
+func (h *userSessionHandler) DeleteEntriesForUser(user UserKeyType) (int64, error) {
+	h.deleted = append(h.deleted, user)
+	return 1, nil
+}
+
+func TestCachedSessionHandlerDeleteEntriesForUser(t *testing.T) {
+	backend := &userSessionHandler{InMemoryHandler: NewInMemoryHandler()}
+	if _, err := backend.CreateEntry(int64(42), "key", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.CreateEntry(int64(43), "other", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	h := NewCachedSessionHandler(backend, 10, time.Hour)
+	for _, key := range []string{"key", "other"} {
+		if _, err := h.GetData(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// RevokeEntriesForUser and the deletion hooks pass a uint64
+	if _, err := h.DeleteEntriesForUser(uint64(42)); err != nil {
+		t.Fatal(err)
+	}
+	if len(backend.deleted) != 1 {
+		t.Fatalf("Expected one call of the wrapped handler, got %d", len(backend.deleted))
+	}
+	if _, _, has := h.cache.get("key"); has {
+		t.Error("Session of the deleted user is still cached")
+	}
+	if _, _, has := h.cache.get("other"); !has {
+		t.Error("Session of another user was removed from the cache")
+	}
+}
+
+func TestSameUser(t *testing.T) {
+	tests := []struct {
+		a, b UserKeyType
+		same bool
+	}{
+		{uint64(1), int64(1), true},
+		{int64(1), "1", true},
+		{[]byte("2"), uint64(2), true},
+		{uint64(1), uint64(2), false},
+		{int64(-1), uint64(1), false},
+		{"alice", "alice", true},
+		{"alice", "bob", false},
+	}
+	for _, test := range tests {
+		if got := sameUser(test.a, test.b); got != test.same {
+			t.Errorf("sameUser(%#v, %#v) = %v, expected %v", test.a, test.b, got, test.same)
+		}
+	}
+}
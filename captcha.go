@@ -0,0 +1,192 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// ErrChallengeFailed is returned if a CAPTCHA is required but the response
+// is missing or wrong.
+var ErrChallengeFailed = errors.New("CAPTCHA verification failed.")
+
+// Challenge verifies the response of a CAPTCHA (or a similar challenge)
+// solved by the client.
+//
+// New in version v0.7
+type Challenge interface {
+	// Verify checks the response token, remoteIP may be "".
+	Verify(token, remoteIP string) (bool, error)
+}
+
+// SiteVerifyChallenge verifies tokens with a "siteverify" API, as used by
+// reCAPTCHA, hCaptcha and Cloudflare Turnstile. Use NewReCAPTCHA,
+// NewHCaptcha or NewTurnstile to create one.
+//
+// New in version v0.7
+type SiteVerifyChallenge struct {
+	VerifyURL, Secret string
+
+	// MinScore is the minimal score for reCAPTCHA v3 (between 0 and 1), 0
+	// means the score is ignored.
+	MinScore float64
+
+	Client *http.Client
+}
+
+// NewReCAPTCHA returns a Challenge for Google reCAPTCHA.
+func NewReCAPTCHA(secret string) *SiteVerifyChallenge {
+	return &SiteVerifyChallenge{VerifyURL: "https://www.google.com/recaptcha/api/siteverify",
+		Secret: secret, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// NewHCaptcha returns a Challenge for hCaptcha.
+func NewHCaptcha(secret string) *SiteVerifyChallenge {
+	return &SiteVerifyChallenge{VerifyURL: "https://api.hcaptcha.com/siteverify",
+		Secret: secret, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// NewTurnstile returns a Challenge for Cloudflare Turnstile.
+func NewTurnstile(secret string) *SiteVerifyChallenge {
+	return &SiteVerifyChallenge{VerifyURL: "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+		Secret: secret, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Verify posts the token to the siteverify API.
+func (c *SiteVerifyChallenge) Verify(token, remoteIP string) (bool, error) {
+	if token == "" {
+		return false, nil
+	}
+	form := url.Values{}
+	form.Set("secret", c.Secret)
+	form.Set("response", token)
+	if remoteIP != "" {
+		form.Set("remoteip", remoteIP)
+	}
+	resp, err := c.Client.PostForm(c.VerifyURL, form)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Success bool     `json:"success"`
+		Score   *float64 `json:"score"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, err
+	}
+	if !result.Success {
+		return false, nil
+	}
+	if c.MinScore > 0 && result.Score != nil && *result.Score < c.MinScore {
+		return false, nil
+	}
+	return true, nil
+}
+
+type challengeFailures struct {
+	count int
+	until time.Time
+}
+
+// ChallengePolicy decides when a Challenge is required. If AfterFailures is
+// 0 it is always required, otherwise it is required after AfterFailures
+// failed attempts from the same IP address within Window.
+// The failures are counted in memory.
+//
+// New in version v0.7
+type ChallengePolicy struct {
+	Challenge     Challenge
+	AfterFailures int
+	Window        time.Duration
+
+	failures map[string]challengeFailures
+	mutex    sync.Mutex
+}
+
+// NewChallengePolicy returns a new ChallengePolicy, the window defaults to
+// one hour.
+func NewChallengePolicy(challenge Challenge, afterFailures int) *ChallengePolicy {
+	return &ChallengePolicy{Challenge: challenge, AfterFailures: afterFailures,
+		Window: time.Hour, failures: make(map[string]challengeFailures)}
+}
+
+// Required returns true if a challenge is required for the IP address.
+func (p *ChallengePolicy) Required(ip string) bool {
+	if p.AfterFailures <= 0 {
+		return true
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	entry, has := p.failures[ip]
+	return has && KeyValid(CurrentTime(), entry.until) && entry.count >= p.AfterFailures
+}
+
+// Check verifies the token if a challenge is required, it returns
+// ErrChallengeFailed if the token is not valid.
+func (p *ChallengePolicy) Check(token, ip string) error {
+	if !p.Required(ip) {
+		return nil
+	}
+	ok, err := p.Challenge.Verify(token, ip)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrChallengeFailed
+	}
+	return nil
+}
+
+// RecordFailure counts a failed attempt from the IP address.
+func (p *ChallengePolicy) RecordFailure(ip string) {
+	if p.AfterFailures <= 0 {
+		return
+	}
+	now := CurrentTime()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	entry, has := p.failures[ip]
+	if !has || KeyInvalid(now, entry.until) {
+		for other, otherEntry := range p.failures {
+			if KeyInvalid(now, otherEntry.until) {
+				delete(p.failures, other)
+			}
+		}
+		entry = challengeFailures{until: now.Add(p.Window)}
+	}
+	entry.count++
+	p.failures[ip] = entry
+}
+
+// Reset removes the failures of the IP address.
+func (p *ChallengePolicy) Reset(ip string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.failures, ip)
+}
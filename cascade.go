@@ -0,0 +1,262 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// DeletionHook removes data that depends on a user (sessions, API keys,
+// refresh tokens, 2FA secrets, external identities...) before the user is
+// deleted.
+// DeleteUserData must not fail if there is no data for the user, it's called
+// again when the deletion is retried.
+//
+// New in version v0.7
+type DeletionHook interface {
+	DeleteUserData(user uint64, userName string) error
+}
+
+// DeletionHookFunc is a function that implements DeletionHook.
+//
+// New in version v0.7
+type DeletionHookFunc func(user uint64, userName string) error
+
+func (f DeletionHookFunc) DeleteUserData(user uint64, userName string) error {
+	return f(user, userName)
+}
+
+// DeletionHooks is a registry of DeletionHooks, it's safe for concurrent
+// use. The hooks run in the order they were registered.
+//
+// New in version v0.7
+type DeletionHooks struct {
+	mutex sync.RWMutex
+	names []string
+	hooks map[string]DeletionHook
+}
+
+// NewDeletionHooks returns an empty registry.
+//
+// New in version v0.7
+func NewDeletionHooks() *DeletionHooks {
+	return &DeletionHooks{hooks: make(map[string]DeletionHook)}
+}
+
+// Register adds a hook, name is used in errors. Registering a name again
+// replaces the hook (and keeps its position).
+func (d *DeletionHooks) Register(name string, hook DeletionHook) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if _, has := d.hooks[name]; !has {
+		d.names = append(d.names, name)
+	}
+	d.hooks[name] = hook
+}
+
+// Unregister removes the hook, it does nothing if there is no such hook.
+func (d *DeletionHooks) Unregister(name string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if _, has := d.hooks[name]; !has {
+		return
+	}
+	delete(d.hooks, name)
+	for i, other := range d.names {
+		if other == name {
+			d.names = append(d.names[:i], d.names[i+1:]...)
+			break
+		}
+	}
+}
+
+// Names returns the names of all hooks in the order they run.
+func (d *DeletionHooks) Names() []string {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return append([]string(nil), d.names...)
+}
+
+// Run runs all hooks for the user, it stops at the first error.
+func (d *DeletionHooks) Run(user uint64, userName string) error {
+	d.mutex.RLock()
+	names := append([]string(nil), d.names...)
+	hooks := make([]DeletionHook, len(names))
+	for i, name := range names {
+		hooks[i] = d.hooks[name]
+	}
+	d.mutex.RUnlock()
+	for i, hook := range hooks {
+		if err := hook.DeleteUserData(user, userName); err != nil {
+			return fmt.Errorf("goauth: Deletion hook %s failed: %w", names[i], err)
+		}
+	}
+	return nil
+}
+
+// SessionDeletionHook revokes all sessions of the user with
+// ReasonAccountDeleted.
+//
+// New in version v0.7
+func SessionDeletionHook(controller *SessionController) DeletionHook {
+	return DeletionHookFunc(func(user uint64, userName string) error {
+		_, err := controller.RevokeEntriesForUser(user, ReasonAccountDeleted)
+		return err
+	})
+}
+
+// IdentityDeletionHook removes all external identities linked with the user.
+//
+// New in version v0.7
+func IdentityDeletionHook(identities IdentityHandler) DeletionHook {
+	return DeletionHookFunc(func(user uint64, userName string) error {
+		linked, err := identities.ListIdentities(user)
+		if err != nil {
+			return err
+		}
+		for _, identity := range linked {
+			if err := identities.DeleteIdentity(identity.Provider, identity.Subject); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// RecoveryCodeDeletionHook removes all recovery codes of the user.
+//
+// New in version v0.7
+func RecoveryCodeDeletionHook(codes RecoveryCodeHandler) DeletionHook {
+	return DeletionHookFunc(func(user uint64, userName string) error {
+		return codes.SetRecoveryCodes(user, nil)
+	})
+}
+
+// RoleDeletionHook revokes all roles of the user.
+//
+// New in version v0.7
+func RoleDeletionHook(roles RoleHandler) DeletionHook {
+	return DeletionHookFunc(func(user uint64, userName string) error {
+		assigned, err := roles.UserRoles(user)
+		if err != nil {
+			return err
+		}
+		for _, role := range assigned {
+			if err := roles.RevokeRole(user, role); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// CascadingUserHandler runs the DeletionHooks before DeleteUser of the
+// wrapped UserHandler, so no credentials of a deleted user survive.
+// If a hook fails the user is not deleted and DeleteUser can be retried.
+// Like CachedUserHandler it only implements UserHandler and HealthChecker.
+//
+// Usage:
+//
+//	hooks := goauth.NewDeletionHooks()
+//	hooks.Register("sessions", goauth.SessionDeletionHook(controller))
+//	hooks.Register("identities", goauth.IdentityDeletionHook(identities))
+//	hooks.Register("api_keys", goauth.DeletionHookFunc(deleteAPIKeys))
+//	users = goauth.NewCascadingUserHandler(users, hooks)
+//
+// New in version v0.7
+type CascadingUserHandler struct {
+	Users UserHandler
+	Hooks *DeletionHooks
+}
+
+// NewCascadingUserHandler returns a new CascadingUserHandler.
+//
+// New in version v0.7
+func NewCascadingUserHandler(users UserHandler, hooks *DeletionHooks) *CascadingUserHandler {
+	return &CascadingUserHandler{Users: users, Hooks: hooks}
+}
+
+// Unwrap returns the wrapped UserHandler.
+func (h *CascadingUserHandler) Unwrap() UserHandler {
+	return h.Users
+}
+
+func (h *CascadingUserHandler) Init() error {
+	return h.Users.Init()
+}
+
+func (h *CascadingUserHandler) Insert(userName, firstName, lastName, email string, plainPW []byte) (uint64, error) {
+	return h.Users.Insert(userName, firstName, lastName, email, plainPW)
+}
+
+func (h *CascadingUserHandler) Validate(userName string, cleartextPwCheck []byte) (uint64, error) {
+	return h.Users.Validate(userName, cleartextPwCheck)
+}
+
+func (h *CascadingUserHandler) UpdatePassword(userName string, plainPW []byte) error {
+	return h.Users.UpdatePassword(userName, plainPW)
+}
+
+func (h *CascadingUserHandler) ListUsers() (map[uint64]string, error) {
+	return h.Users.ListUsers()
+}
+
+func (h *CascadingUserHandler) GetUserName(id uint64) (string, error) {
+	return h.Users.GetUserName(id)
+}
+
+func (h *CascadingUserHandler) GetUserID(userName string) (uint64, error) {
+	return h.Users.GetUserID(userName)
+}
+
+// DeleteUser runs the hooks and then deletes the user. Like
+// UserHandler.DeleteUser it does nothing if the user doesn't exist.
+func (h *CascadingUserHandler) DeleteUser(userName string) error {
+	id, err := h.Users.GetUserID(userName)
+	if err == ErrUserNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if h.Hooks != nil {
+		if err := h.Hooks.Run(id, userName); err != nil {
+			return err
+		}
+	}
+	return h.Users.DeleteUser(userName)
+}
+
+func (h *CascadingUserHandler) GetUserBaseInfo(userName string) (*BaseUserInformation, error) {
+	return h.Users.GetUserBaseInfo(userName)
+}
+
+// Healthy calls the wrapped handler if it implements HealthChecker.
+func (h *CascadingUserHandler) Healthy(ctx context.Context) error {
+	if checker, ok := h.Users.(HealthChecker); ok {
+		return checker.Healthy(ctx)
+	}
+	return nil
+}
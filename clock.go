@@ -0,0 +1,132 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package goauth
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Clock is the source of the current time. CurrentTime uses the clock set
+// with SetClock, the session handlers and SessionController have a Clock
+// field that overrides it. Use a ManualClock in tests to advance the time
+// deterministically and an OffsetClock to compensate a skewed clock.
+//
+// New in version v0.7
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is the default Clock, it returns time.Now().
+//
+// New in version v0.7
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+// OffsetClock adds Offset to the time of Clock (SystemClock if nil), for
+// example to use the clock of a database server that is off by a known
+// amount.
+//
+// New in version v0.7
+type OffsetClock struct {
+	Clock  Clock
+	Offset time.Duration
+}
+
+func (c OffsetClock) Now() time.Time {
+	if c.Clock == nil {
+		return time.Now().Add(c.Offset)
+	}
+	return c.Clock.Now().Add(c.Offset)
+}
+
+// ManualClock is a Clock that only changes with Set and Advance, it's safe
+// for concurrent use.
+//
+// New in version v0.7
+type ManualClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+// NewManualClock returns a new ManualClock set to now.
+//
+// New in version v0.7
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{now: now}
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+// Set sets the time of the clock.
+func (c *ManualClock) Set(now time.Time) {
+	c.mutex.Lock()
+	c.now = now
+	c.mutex.Unlock()
+}
+
+// Advance adds d to the time of the clock and returns the new time.
+func (c *ManualClock) Advance(d time.Duration) time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+	return c.now
+}
+
+// clockHolder wraps the global clock, atomic.Value requires the same
+// concrete type for all values.
+type clockHolder struct {
+	clock Clock
+}
+
+var globalClock atomic.Value
+
+func init() {
+	globalClock.Store(clockHolder{SystemClock{}})
+}
+
+// SetClock sets the clock used by CurrentTime and everything that doesn't
+// have its own Clock, nil restores SystemClock.
+//
+// New in version v0.7
+func SetClock(clock Clock) {
+	if clock == nil {
+		clock = SystemClock{}
+	}
+	globalClock.Store(clockHolder{clock})
+}
+
+// clockNow returns the time of clock in UTC, CurrentTime if clock is nil.
+func clockNow(clock Clock) time.Time {
+	if clock == nil {
+		return CurrentTime()
+	}
+	return clock.Now().UTC()
+}
@@ -0,0 +1,392 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+// Command goauthctl administrates the users and sessions of goauth.
+//
+// Usage:
+//
+//	goauthctl [-driver sqlite3|mysql|postgres|redis] [-dsn dsn] command [arguments]
+//
+// For redis the dsn is the address of the server (for example
+// localhost:6379). The commands are:
+//
+//	init-db                                 create the tables
+//	migrate                                 apply the schema migrations (SQL only)
+//	doctor                                  check the schema of the database (SQL only)
+//	sql                                     print the SQL statements of the schema (SQL only)
+//	export                                  write all users and sessions as JSON to stdout
+//	import                                  read users and sessions from export on stdin
+//	create-user [-first f] [-last l] [-email e] [-password p] name
+//	set-password [-password p] name
+//	deactivate name
+//	list-users
+//	list-sessions user-id
+//	revoke-session key
+//	purge-expired
+//
+// If -password is not given the password is read from the first line of
+// stdin.
+//
+// goauthctl doesn't check the admin flag of the users (see
+// goauth.AdminFlagHandler) like the AdminAPI does: It works directly on the
+// database, so whoever can run it with the dsn already has full access to
+// all users. Protect the credentials of the database instead.
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/FabianWe/goauth"
+	"github.com/go-redis/redis"
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// backend holds the handlers of the configured backend.
+type backend struct {
+	users     goauth.UserHandler
+	sessions  *goauth.SessionController
+	migrator  *goauth.SQLMigrator
+	inspector goauth.SchemaInspector
+	close     func() error
+}
+
+func openBackend(driver, dsn string) (*backend, error) {
+	if dsn == "" {
+		return nil, errors.New("-dsn is required")
+	}
+	if driver == "redis" {
+		client := redis.NewClient(&redis.Options{Addr: dsn})
+		return &backend{users: goauth.NewRedisUserHandler(client, nil),
+			sessions: goauth.NewSessionController(goauth.NewRedisSessionHandler(client)),
+			close:    client.Close}, nil
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	res := &backend{close: db.Close}
+	pwLength := goauth.DefaultPWHandler.PasswordHashLength()
+	switch driver {
+	case "sqlite3":
+		res.users = goauth.NewSQLite3UserHandler(db, nil)
+		res.sessions = goauth.NewSQLite3SessionController(db, "", "")
+		res.migrator = goauth.NewSQLite3Migrator(db, pwLength)
+		res.inspector = goauth.SQLite3SchemaInspector{}
+	case "mysql":
+		res.users = goauth.NewMySQLUserHandler(db, nil)
+		res.sessions = goauth.NewMySQLSessionController(db, "", "")
+		res.migrator = goauth.NewMySQLMigrator(db, pwLength)
+		res.inspector = goauth.MySQLSchemaInspector{}
+	case "postgres":
+		res.users = goauth.NewPostgresUserHandler(db, nil)
+		res.sessions = goauth.NewPostgresSessionController(db, "", "")
+		res.migrator = goauth.NewPostgresMigrator(db, pwLength)
+		res.inspector = goauth.PostgresSchemaInspector{}
+	default:
+		db.Close()
+		return nil, fmt.Errorf("unknown driver %q", driver)
+	}
+	return res, nil
+}
+
+func main() {
+	driver := flag.String("driver", "sqlite3", "the backend: sqlite3, mysql, postgres or redis")
+	dsn := flag.String("dsn", "", "data source name of the database or address of the redis server")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: goauthctl [flags] command [arguments]")
+		fmt.Fprintln(os.Stderr, "commands: init-db, migrate, doctor, sql, export, import, create-user, set-password,")
+		fmt.Fprintln(os.Stderr, "          deactivate, list-users, list-sessions, revoke-session, purge-expired")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	b, err := openBackend(*driver, *dsn)
+	if err != nil {
+		exit(err)
+	}
+	defer b.close()
+	if err := run(b, flag.Arg(0), flag.Args()[1:]); err != nil {
+		b.close()
+		exit(err)
+	}
+}
+
+func run(b *backend, command string, args []string) error {
+	switch command {
+	case "init-db":
+		if err := b.users.Init(); err != nil {
+			return err
+		}
+		return b.sessions.Init()
+	case "migrate":
+		if b.migrator == nil {
+			return goauth.ErrNotSupported
+		}
+		num, err := b.migrator.Migrate()
+		if err != nil {
+			return err
+		}
+		version, err := b.migrator.Version()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("applied %d migrations, schema version is %d\n", num, version)
+		return nil
+	case "doctor":
+		return doctor(b)
+	case "sql":
+		return writeSQL(b)
+	case "export":
+		stats, err := goauth.Export(os.Stdout, b.users, b.sessions.SessionHandler)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "exported %d users and %d sessions\n", stats.Users, stats.Sessions)
+		return nil
+	case "import":
+		stats, err := goauth.Import(os.Stdin, b.users, b.sessions.SessionHandler)
+		fmt.Fprintf(os.Stderr, "imported %d users and %d sessions\n", stats.Users, stats.Sessions)
+		return err
+	case "create-user":
+		return createUser(b, args)
+	case "set-password":
+		return setPassword(b, args)
+	case "deactivate":
+		return deactivate(b, args)
+	case "list-users":
+		return listUsers(b)
+	case "list-sessions":
+		return listSessions(b, args)
+	case "revoke-session":
+		if len(args) != 1 {
+			return errors.New("usage: revoke-session key")
+		}
+		return b.sessions.DeleteKey(args[0])
+	case "purge-expired":
+		num, err := b.sessions.DeleteInvalidKeys()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("removed %d expired sessions\n", num)
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q", command)
+	}
+}
+
+func createUser(b *backend, args []string) error {
+	flags := flag.NewFlagSet("create-user", flag.ExitOnError)
+	firstName := flags.String("first", "", "first name")
+	lastName := flags.String("last", "", "last name")
+	email := flags.String("email", "", "email address")
+	password := flags.String("password", "", "password, read from stdin if empty")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("usage: create-user [flags] name")
+	}
+	pw, err := readPassword(*password)
+	if err != nil {
+		return err
+	}
+	id, err := b.users.Insert(flags.Arg(0), *firstName, *lastName, *email, pw)
+	if err != nil {
+		return err
+	}
+	if id == goauth.NoUserID {
+		fmt.Println("user created")
+	} else {
+		fmt.Printf("user created with id %d\n", id)
+	}
+	return nil
+}
+
+func setPassword(b *backend, args []string) error {
+	flags := flag.NewFlagSet("set-password", flag.ExitOnError)
+	password := flags.String("password", "", "password, read from stdin if empty")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("usage: set-password [flags] name")
+	}
+	if _, err := b.users.GetUserID(flags.Arg(0)); err != nil {
+		return err
+	}
+	pw, err := readPassword(*password)
+	if err != nil {
+		return err
+	}
+	return b.users.UpdatePassword(flags.Arg(0), pw)
+}
+
+func deactivate(b *backend, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: deactivate name")
+	}
+	handler, ok := b.users.(goauth.ActiveFlagHandler)
+	if !ok {
+		return goauth.ErrNotSupported
+	}
+	if err := handler.SetActive(args[0], false); err != nil {
+		return err
+	}
+	// the sessions of the user are stored with the id
+	id, err := b.users.GetUserID(args[0])
+	if err != nil {
+		return err
+	}
+	num, err := b.sessions.DeleteEntriesForUser(id)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("user deactivated, removed %d sessions\n", num)
+	return nil
+}
+
+func listUsers(b *backend) error {
+	users, err := b.users.ListUsers()
+	if err != nil {
+		return err
+	}
+	ids := make([]uint64, 0, len(users))
+	for id := range users {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tUSERNAME\tACTIVE\tLAST LOGIN")
+	for _, id := range ids {
+		info, err := b.users.GetUserBaseInfo(users[id])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%d\t%s\t%t\t%s\n", id, info.UserName, info.IsActive, info.LastLogin.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+func doctor(b *backend) error {
+	users, ok := b.users.(*goauth.SQLUserHandler)
+	if !ok || b.inspector == nil {
+		return goauth.ErrNotSupported
+	}
+	problems, err := users.VerifySchema(b.inspector)
+	if err != nil {
+		return err
+	}
+	if sessions, ok := b.sessions.SessionHandler.(*goauth.SQLSessionHandler); ok {
+		sessionProblems, err := sessions.VerifySchema(b.inspector)
+		if err != nil {
+			return err
+		}
+		problems = append(problems, sessionProblems...)
+	}
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("found %d problems", len(problems))
+	}
+	fmt.Println("schema ok")
+	return nil
+}
+
+// writeSQL writes the statements of the handlers and migrations to stdout,
+// the database is not accessed.
+func writeSQL(b *backend) error {
+	users, ok := b.users.(*goauth.SQLUserHandler)
+	if !ok {
+		return goauth.ErrNotSupported
+	}
+	if err := users.WriteSQL(os.Stdout); err != nil {
+		return err
+	}
+	if sessions, ok := b.sessions.SessionHandler.(*goauth.SQLSessionHandler); ok {
+		if err := sessions.WriteSQL(os.Stdout); err != nil {
+			return err
+		}
+	}
+	return b.migrator.WriteSQL(os.Stdout, 0)
+}
+
+func listSessions(b *backend, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: list-sessions user-id")
+	}
+	id, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid user id %q", args[0])
+	}
+	sessions, err := b.sessions.ListSessions(id)
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(sessions))
+	for key := range sessions {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return sessions[keys[i]].CreationTime.Before(sessions[keys[j]].CreationTime)
+	})
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tCREATED\tVALID UNTIL")
+	for _, key := range keys {
+		data := sessions[key]
+		fmt.Fprintf(w, "%s\t%s\t%s\n", key, data.CreationTime.Format(time.RFC3339), data.ValidUntil.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+// readPassword returns password or reads the first line of stdin if it's
+// empty.
+func readPassword(password string) ([]byte, error) {
+	if password != "" {
+		return []byte(password), nil
+	}
+	fmt.Fprint(os.Stderr, "password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty password")
+	}
+	return []byte(line), nil
+}
+
+func exit(err error) {
+	fmt.Fprintln(os.Stderr, "goauthctl:", err)
+	os.Exit(1)
+}
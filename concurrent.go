@@ -0,0 +1,92 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package goauth
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// ConcurrentLoginDetector detects logins while the user has active sessions
+// on other clients, call Check after the session was created (AuthHandlers
+// does that if you set its ConcurrentLogins field).
+// Two sessions belong to different clients if their fingerprints don't
+// match with the tolerance of Fingerprints, so the fingerprints must be
+// recorded for each session (see FingerprintBinding.Bind). Sessions without
+// a fingerprint are ignored. The SessionHandler must implement
+// SessionLister.
+//
+// New in version v0.7
+type ConcurrentLoginDetector struct {
+	Controller   *SessionController
+	Fingerprints *FingerprintBinding
+
+	// Notifier gets an EventConcurrentLogin event for each login while
+	// sessions on other clients exist, may be nil. AuthMailer sends an
+	// alert for these events if ConcurrentLoginAlerts is set.
+	Notifier SecurityNotifier
+}
+
+// NewConcurrentLoginDetector returns a new ConcurrentLoginDetector.
+//
+// New in version v0.7
+func NewConcurrentLoginDetector(controller *SessionController, fingerprints *FingerprintBinding, notifier SecurityNotifier) *ConcurrentLoginDetector {
+	return &ConcurrentLoginDetector{Controller: controller, Fingerprints: fingerprints,
+		Notifier: notifier}
+}
+
+// Check returns the number of valid sessions of the user (except the new
+// session with key) that were created on another client than the request.
+// If there are such sessions an EventConcurrentLogin event is sent to the
+// Notifier.
+func (d *ConcurrentLoginDetector) Check(r *http.Request, key string, userID uint64, userName string) (int, error) {
+	sessions, err := d.Controller.ListSessions(userID)
+	if err != nil {
+		return 0, err
+	}
+	current := NewClientFingerprint(r)
+	now := CurrentTime()
+	others := 0
+	for otherKey, data := range sessions {
+		if otherKey == key || KeyInvalid(now, data.ValidUntil) {
+			continue
+		}
+		value, err := d.Fingerprints.Payload.GetPayloadValue(otherKey, FingerprintPayloadName)
+		if err == ErrPayloadValueNotFound {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if !d.Fingerprints.Matches(ParseClientFingerprint(value), current) {
+			others++
+		}
+	}
+	if others > 0 && d.Notifier != nil {
+		event := NewSecurityEvent(EventConcurrentLogin, userID, userName)
+		event.IP = current.IP
+		event.Data = map[string]string{"sessions": strconv.Itoa(others),
+			"session_id": SessionID(key), "user_agent": r.UserAgent()}
+		d.Notifier.Notify(event)
+	}
+	return others, nil
+}
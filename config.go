@@ -0,0 +1,602 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package goauth
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	scrypt "github.com/elithrar/simple-scrypt"
+	"github.com/go-redis/redis"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	toml "github.com/pelletier/go-toml/v2"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// ConfigDuration is a time.Duration that is written as a string like "24h"
+// in config files.
+//
+// New in version v0.7
+type ConfigDuration time.Duration
+
+func (d *ConfigDuration) UnmarshalText(text []byte) error {
+	res, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = ConfigDuration(res)
+	return nil
+}
+
+func (d ConfigDuration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// BackendConfig configures the storage of users and sessions.
+//
+// New in version v0.7
+type BackendConfig struct {
+	// Driver is one of sqlite3, mysql, postgres and redis. For the SQL
+	// drivers you must import the driver package in your program.
+	Driver string `yaml:"driver" toml:"driver" json:"driver"`
+
+	// DSN is the data source name of the database or the address of the
+	// redis server.
+	DSN string `yaml:"dsn" toml:"dsn" json:"dsn"`
+
+	// RedisPassword and RedisDB are only used for redis.
+	RedisPassword string `yaml:"redis_password" toml:"redis_password" json:"redis_password"`
+	RedisDB       int    `yaml:"redis_db" toml:"redis_db" json:"redis_db"`
+
+	// SessionTable and UserIDType are passed to the SQL session handler,
+	// see NewSQLSessionHandler.
+	SessionTable string `yaml:"session_table" toml:"session_table" json:"session_table"`
+	UserIDType   string `yaml:"user_id_type" toml:"user_id_type" json:"user_id_type"`
+
+	// Init calls Init on the handlers in NewFromConfig.
+	Init bool `yaml:"init" toml:"init" json:"init"`
+}
+
+// PasswordConfig configures the PasswordHandler.
+//
+// New in version v0.7
+type PasswordConfig struct {
+	// Algorithm is bcrypt (the default) or scrypt.
+	Algorithm string `yaml:"algorithm" toml:"algorithm" json:"algorithm"`
+
+	// BcryptCost is the bcrypt cost, 0 for the default.
+	BcryptCost int `yaml:"bcrypt_cost" toml:"bcrypt_cost" json:"bcrypt_cost"`
+
+	// The scrypt parameters, 0 for the defaults of scrypt.DefaultParams.
+	ScryptN       int `yaml:"scrypt_n" toml:"scrypt_n" json:"scrypt_n"`
+	ScryptR       int `yaml:"scrypt_r" toml:"scrypt_r" json:"scrypt_r"`
+	ScryptP       int `yaml:"scrypt_p" toml:"scrypt_p" json:"scrypt_p"`
+	ScryptSaltLen int `yaml:"scrypt_salt_len" toml:"scrypt_salt_len" json:"scrypt_salt_len"`
+	ScryptKeyLen  int `yaml:"scrypt_key_len" toml:"scrypt_key_len" json:"scrypt_key_len"`
+}
+
+// CookieConfig configures the gorilla cookie store.
+//
+// New in version v0.7
+type CookieConfig struct {
+	// Name is the name of the session, defaults to "user-auth".
+	Name string `yaml:"name" toml:"name" json:"name"`
+
+	// HashKey (at least 32 bytes) and BlockKey (16, 24 or 32 bytes, may be
+	// empty to disable encryption) are base64 encoded keys for the cookie
+	// store.
+	HashKey  string `yaml:"hash_key" toml:"hash_key" json:"hash_key"`
+	BlockKey string `yaml:"block_key" toml:"block_key" json:"block_key"`
+
+	// ExternalKeys means that the keys are not part of the config but are
+	// set on Stack.CookieKeys, for example by a SecretRotator.
+	// HashKey and BlockKey must be empty then.
+	ExternalKeys bool `yaml:"external_keys" toml:"external_keys" json:"external_keys"`
+
+	Path     string         `yaml:"path" toml:"path" json:"path"`
+	Domain   string         `yaml:"domain" toml:"domain" json:"domain"`
+	MaxAge   ConfigDuration `yaml:"max_age" toml:"max_age" json:"max_age"`
+	Secure   bool           `yaml:"secure" toml:"secure" json:"secure"`
+	HTTPOnly bool           `yaml:"http_only" toml:"http_only" json:"http_only"`
+
+	// SameSite is lax, strict, none or empty for the browser default.
+	SameSite string `yaml:"same_site" toml:"same_site" json:"same_site"`
+}
+
+// RateLimitConfig configures the LoginService, a limit of 0 disables the
+// limiter.
+//
+// New in version v0.7
+type RateLimitConfig struct {
+	UserLimit int            `yaml:"user_limit" toml:"user_limit" json:"user_limit"`
+	IPLimit   int            `yaml:"ip_limit" toml:"ip_limit" json:"ip_limit"`
+	Window    ConfigDuration `yaml:"window" toml:"window" json:"window"`
+}
+
+// SessionConfig configures the sessions.
+//
+// New in version v0.7
+type SessionConfig struct {
+	// Duration is the duration of new sessions, defaults to 24 hours.
+	Duration ConfigDuration `yaml:"duration" toml:"duration" json:"duration"`
+
+	// KeyBytes is the number of random bytes of a session key, defaults to
+	// DefaultRandomByteLength.
+	KeyBytes int `yaml:"key_bytes" toml:"key_bytes" json:"key_bytes"`
+
+	// Audience and Audiences set SessionController.Audience and
+	// SessionController.Audiences for sessions shared across subdomains
+	// (see cookie.domain), the audiences are stored in Stack.Payload. In
+	// the environment the audiences are separated by commas.
+	Audience  string   `yaml:"audience" toml:"audience" json:"audience"`
+	Audiences []string `yaml:"audiences" toml:"audiences" json:"audiences"`
+}
+
+// Config describes the whole authentication stack, it's used by
+// NewFromConfig. Load it with LoadConfigFile or ParseConfig and override
+// values with ApplyEnv.
+//
+// New in version v0.7
+type Config struct {
+	Backend   BackendConfig   `yaml:"backend" toml:"backend" json:"backend"`
+	Password  PasswordConfig  `yaml:"password" toml:"password" json:"password"`
+	Cookie    CookieConfig    `yaml:"cookie" toml:"cookie" json:"cookie"`
+	RateLimit RateLimitConfig `yaml:"rate_limit" toml:"rate_limit" json:"rate_limit"`
+	Session   SessionConfig   `yaml:"session" toml:"session" json:"session"`
+}
+
+// ConfigError is returned by Config.Validate, it contains a problem for
+// each bad field.
+//
+// New in version v0.7
+type ConfigError struct {
+	Problems []string
+}
+
+func (err *ConfigError) Error() string {
+	return "Invalid configuration: " + strings.Join(err.Problems, "; ")
+}
+
+// ParseConfig parses the config in the given format: yaml, toml or json.
+//
+// New in version v0.7
+func ParseConfig(data []byte, format string) (*Config, error) {
+	res := new(Config)
+	var err error
+	switch strings.ToLower(format) {
+	case "yaml", "yml":
+		err = yaml.Unmarshal(data, res)
+	case "toml":
+		err = toml.Unmarshal(data, res)
+	case "json":
+		err = json.Unmarshal(data, res)
+	default:
+		return nil, fmt.Errorf("Unknown config format %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// LoadConfigFile reads the config file, the format is given by the
+// extension (.yaml, .yml, .toml or .json).
+//
+// New in version v0.7
+func LoadConfigFile(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(data, strings.TrimPrefix(filepath.Ext(path), "."))
+}
+
+// configField is a field of Config that can be set from the environment.
+type configField struct {
+	name  string
+	value interface{}
+}
+
+func (c *Config) fields() []configField {
+	return []configField{
+		{"BACKEND_DRIVER", &c.Backend.Driver}, {"BACKEND_DSN", &c.Backend.DSN},
+		{"BACKEND_REDIS_PASSWORD", &c.Backend.RedisPassword},
+		{"BACKEND_REDIS_DB", &c.Backend.RedisDB},
+		{"BACKEND_SESSION_TABLE", &c.Backend.SessionTable},
+		{"BACKEND_USER_ID_TYPE", &c.Backend.UserIDType},
+		{"BACKEND_INIT", &c.Backend.Init},
+		{"PASSWORD_ALGORITHM", &c.Password.Algorithm},
+		{"PASSWORD_BCRYPT_COST", &c.Password.BcryptCost},
+		{"PASSWORD_SCRYPT_N", &c.Password.ScryptN}, {"PASSWORD_SCRYPT_R", &c.Password.ScryptR},
+		{"PASSWORD_SCRYPT_P", &c.Password.ScryptP},
+		{"PASSWORD_SCRYPT_SALT_LEN", &c.Password.ScryptSaltLen},
+		{"PASSWORD_SCRYPT_KEY_LEN", &c.Password.ScryptKeyLen},
+		{"COOKIE_NAME", &c.Cookie.Name}, {"COOKIE_HASH_KEY", &c.Cookie.HashKey},
+		{"COOKIE_BLOCK_KEY", &c.Cookie.BlockKey},
+		{"COOKIE_EXTERNAL_KEYS", &c.Cookie.ExternalKeys}, {"COOKIE_PATH", &c.Cookie.Path},
+		{"COOKIE_DOMAIN", &c.Cookie.Domain}, {"COOKIE_MAX_AGE", &c.Cookie.MaxAge},
+		{"COOKIE_SECURE", &c.Cookie.Secure}, {"COOKIE_HTTP_ONLY", &c.Cookie.HTTPOnly},
+		{"COOKIE_SAME_SITE", &c.Cookie.SameSite},
+		{"RATE_LIMIT_USER_LIMIT", &c.RateLimit.UserLimit},
+		{"RATE_LIMIT_IP_LIMIT", &c.RateLimit.IPLimit},
+		{"RATE_LIMIT_WINDOW", &c.RateLimit.Window},
+		{"SESSION_DURATION", &c.Session.Duration}, {"SESSION_KEY_BYTES", &c.Session.KeyBytes},
+		{"SESSION_AUDIENCE", &c.Session.Audience}, {"SESSION_AUDIENCES", &c.Session.Audiences},
+	}
+}
+
+// ApplyEnv overrides the fields with environment variables, the name of a
+// variable is the prefix followed by an underscore, the section and the
+// field in upper case, for example GOAUTH_BACKEND_DSN or
+// GOAUTH_COOKIE_HASH_KEY for prefix GOAUTH. Durations are given like "24h".
+// Returns a *ConfigError with all variables that can't be parsed.
+//
+// New in version v0.7
+func (c *Config) ApplyEnv(prefix string) error {
+	var problems []string
+	for _, field := range c.fields() {
+		name := prefix + "_" + field.name
+		value, has := os.LookupEnv(name)
+		if !has {
+			continue
+		}
+		var err error
+		switch ptr := field.value.(type) {
+		case *string:
+			*ptr = value
+		case *int:
+			*ptr, err = strconv.Atoi(value)
+		case *bool:
+			*ptr, err = strconv.ParseBool(value)
+		case *ConfigDuration:
+			err = ptr.UnmarshalText([]byte(value))
+		case *[]string:
+			*ptr = nil
+			for _, s := range strings.Split(value, ",") {
+				if s = strings.TrimSpace(s); s != "" {
+					*ptr = append(*ptr, s)
+				}
+			}
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	if len(problems) > 0 {
+		return &ConfigError{Problems: problems}
+	}
+	return nil
+}
+
+// decodeKey decodes a base64 key, it accepts standard and URL encoding.
+func decodeKey(key string) ([]byte, error) {
+	if res, err := base64.StdEncoding.DecodeString(key); err == nil {
+		return res, nil
+	}
+	return base64.URLEncoding.DecodeString(key)
+}
+
+// Validate checks all fields, it returns a *ConfigError that lists every bad
+// field or nil.
+//
+// New in version v0.7
+func (c *Config) Validate() error {
+	var problems []string
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	switch c.Backend.Driver {
+	case "sqlite3", "mysql", "postgres", "redis":
+	default:
+		add("backend.driver: unknown driver %q", c.Backend.Driver)
+	}
+	if c.Backend.DSN == "" {
+		add("backend.dsn: must not be empty")
+	}
+	if c.Backend.RedisDB < 0 {
+		add("backend.redis_db: must not be negative")
+	}
+	switch c.Password.Algorithm {
+	case "", "bcrypt":
+		if c.Password.BcryptCost != 0 && (c.Password.BcryptCost < 4 || c.Password.BcryptCost > 31) {
+			add("password.bcrypt_cost: must be between 4 and 31")
+		}
+	case "scrypt":
+		if n := c.Password.ScryptN; n < 0 || n == 1 || n&(n-1) != 0 {
+			add("password.scrypt_n: must be a power of two greater than 1")
+		}
+		if c.Password.ScryptR < 0 {
+			add("password.scrypt_r: must not be negative")
+		}
+		if c.Password.ScryptP < 0 {
+			add("password.scrypt_p: must not be negative")
+		}
+		if c.Password.ScryptSaltLen < 0 {
+			add("password.scrypt_salt_len: must not be negative")
+		}
+		if c.Password.ScryptKeyLen < 0 {
+			add("password.scrypt_key_len: must not be negative")
+		}
+	default:
+		add("password.algorithm: unknown algorithm %q", c.Password.Algorithm)
+	}
+	if c.Cookie.ExternalKeys {
+		if c.Cookie.HashKey != "" || c.Cookie.BlockKey != "" {
+			add("cookie.external_keys: hash_key and block_key must be empty")
+		}
+	} else if key, err := decodeKey(c.Cookie.HashKey); err != nil {
+		add("cookie.hash_key: not base64 encoded")
+	} else if len(key) < 32 {
+		add("cookie.hash_key: must have at least 32 bytes")
+	}
+	if c.Cookie.BlockKey != "" && !c.Cookie.ExternalKeys {
+		if key, err := decodeKey(c.Cookie.BlockKey); err != nil {
+			add("cookie.block_key: not base64 encoded")
+		} else if len(key) != 16 && len(key) != 24 && len(key) != 32 {
+			add("cookie.block_key: must have 16, 24 or 32 bytes")
+		}
+	}
+	if c.Cookie.MaxAge < 0 {
+		add("cookie.max_age: must not be negative")
+	}
+	switch strings.ToLower(c.Cookie.SameSite) {
+	case "", "lax", "strict", "none":
+		if strings.ToLower(c.Cookie.SameSite) == "none" && !c.Cookie.Secure {
+			add("cookie.same_site: none requires secure")
+		}
+	default:
+		add("cookie.same_site: must be lax, strict or none")
+	}
+	if c.RateLimit.UserLimit < 0 {
+		add("rate_limit.user_limit: must not be negative")
+	}
+	if c.RateLimit.IPLimit < 0 {
+		add("rate_limit.ip_limit: must not be negative")
+	}
+	if (c.RateLimit.UserLimit > 0 || c.RateLimit.IPLimit > 0) && c.RateLimit.Window <= 0 {
+		add("rate_limit.window: must be positive")
+	}
+	if c.Session.Duration < 0 {
+		add("session.duration: must not be negative")
+	}
+	if c.Session.KeyBytes != 0 && c.Session.KeyBytes < 16 {
+		add("session.key_bytes: must be at least 16")
+	}
+	if strings.ContainsAny(c.Session.Audience, " \t\n") {
+		add("session.audience: must not contain spaces")
+	}
+	for _, audience := range c.Session.Audiences {
+		if audience == "" || strings.ContainsAny(audience, " \t\n") {
+			add("session.audiences: must not contain empty names or spaces")
+			break
+		}
+	}
+	if len(problems) > 0 {
+		return &ConfigError{Problems: problems}
+	}
+	return nil
+}
+
+// PasswordHandler returns the configured PasswordHandler.
+//
+// New in version v0.7
+func (c *PasswordConfig) PasswordHandler() PasswordHandler {
+	if c.Algorithm != "scrypt" {
+		return NewBcryptHandler(c.BcryptCost)
+	}
+	params := scrypt.DefaultParams
+	if c.ScryptN > 0 {
+		params.N = c.ScryptN
+	}
+	if c.ScryptR > 0 {
+		params.R = c.ScryptR
+	}
+	if c.ScryptP > 0 {
+		params.P = c.ScryptP
+	}
+	if c.ScryptSaltLen > 0 {
+		params.SaltLen = c.ScryptSaltLen
+	}
+	if c.ScryptKeyLen > 0 {
+		params.DKLen = c.ScryptKeyLen
+	}
+	return NewScryptHandler(&params)
+}
+
+// Stack is the authentication stack created by NewFromConfig.
+//
+// New in version v0.7
+type Stack struct {
+	// DB is the database for the SQL drivers, Redis the client for redis.
+	DB    *sql.DB
+	Redis *redis.Client
+
+	Users    UserHandler
+	Sessions *SessionController
+	Store    *sessions.CookieStore
+	Login    *LoginService
+
+	// Payload stores the audiences of the sessions, it's only set if
+	// session.audience or session.audiences is set.
+	Payload SessionPayloadHandler
+
+	// CookieKeys is the codec of Store if cookie.external_keys is set, the
+	// keys must be set before the store is used.
+	CookieKeys *CookieKeys
+
+	Handlers *AuthHandlers
+	Accounts *AccountService
+}
+
+// Close closes the database or redis client.
+func (s *Stack) Close() error {
+	if s.DB != nil {
+		return s.DB.Close()
+	}
+	if s.Redis != nil {
+		return s.Redis.Close()
+	}
+	return nil
+}
+
+// NewFromConfig validates the config and creates all handlers: The
+// UserHandler and SessionController for the backend, the cookie store, a
+// LoginService with the rate limits (stored in redis for the redis backend
+// and in memory otherwise), AuthHandlers and an AccountService that use all of
+// them.
+// If the config is invalid a *ConfigError is returned.
+//
+// New in version v0.7
+func NewFromConfig(c *Config) (*Stack, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	res := new(Stack)
+	pwHandler := c.Password.PasswordHandler()
+	backend := c.Backend
+	if backend.Driver == "redis" {
+		res.Redis = redis.NewClient(&redis.Options{Addr: backend.DSN,
+			Password: backend.RedisPassword, DB: backend.RedisDB})
+		res.Users = NewRedisUserHandler(res.Redis, pwHandler)
+		res.Sessions = NewSessionController(NewRedisSessionHandler(res.Redis))
+	} else {
+		db, err := sql.Open(backend.Driver, backend.DSN)
+		if err != nil {
+			return nil, err
+		}
+		res.DB = db
+		switch backend.Driver {
+		case "sqlite3":
+			opts := DefaultSQLite3Options()
+			res.Users = NewSQLite3UserHandlerWithOptions(db, pwHandler, opts)
+			res.Sessions = NewSessionController(NewSQLite3SessionHandlerWithOptions(db,
+				backend.SessionTable, backend.UserIDType, opts))
+		case "mysql":
+			res.Users = NewMySQLUserHandler(db, pwHandler)
+			res.Sessions = NewMySQLSessionController(db, backend.SessionTable, backend.UserIDType)
+		case "postgres":
+			res.Users = NewPostgresUserHandler(db, pwHandler)
+			res.Sessions = NewPostgresSessionController(db, backend.SessionTable, backend.UserIDType)
+		}
+	}
+	if c.Session.KeyBytes > 0 {
+		res.Sessions.NumBytes = c.Session.KeyBytes
+	}
+	if c.Cookie.Name != "" {
+		res.Sessions.SessionName = c.Cookie.Name
+	}
+	res.Sessions.Audience = c.Session.Audience
+	res.Sessions.Audiences = c.Session.Audiences
+	if c.Session.Audience != "" || len(c.Session.Audiences) > 0 {
+		switch backend.Driver {
+		case "redis":
+			res.Payload = NewRedisPayloadHandler(res.Redis)
+		case "sqlite3":
+			res.Payload = NewSQLite3PayloadHandler(res.DB)
+		case "mysql":
+			res.Payload = NewMySQLPayloadHandler(res.DB)
+		case "postgres":
+			res.Payload = NewPostgresPayloadHandler(res.DB)
+		}
+		res.Sessions.Payload = res.Payload
+	}
+	if backend.Init {
+		if err := res.Users.Init(); err != nil {
+			res.Close()
+			return nil, err
+		}
+		if err := res.Sessions.Init(); err != nil {
+			res.Close()
+			return nil, err
+		}
+		if res.Payload != nil {
+			if err := res.Payload.Init(); err != nil {
+				res.Close()
+				return nil, err
+			}
+		}
+	}
+
+	maxAge := int(time.Duration(c.Cookie.MaxAge) / time.Second)
+	if c.Cookie.ExternalKeys {
+		res.CookieKeys = NewCookieKeys()
+		if maxAge > 0 {
+			res.CookieKeys.MaxAge = maxAge
+		}
+		res.Store = &sessions.CookieStore{Codecs: []securecookie.Codec{res.CookieKeys}}
+	} else {
+		// the keys are checked by Validate
+		hashKey, _ := decodeKey(c.Cookie.HashKey)
+		var keys [][]byte
+		if c.Cookie.BlockKey != "" {
+			blockKey, _ := decodeKey(c.Cookie.BlockKey)
+			keys = [][]byte{hashKey, blockKey}
+		} else {
+			keys = [][]byte{hashKey}
+		}
+		res.Store = sessions.NewCookieStore(keys...)
+	}
+	res.Store.Options = &sessions.Options{Path: c.Cookie.Path, Domain: c.Cookie.Domain,
+		MaxAge: maxAge, Secure: c.Cookie.Secure, HttpOnly: c.Cookie.HTTPOnly}
+	if res.Store.Options.Path == "" {
+		res.Store.Options.Path = "/"
+	}
+	switch strings.ToLower(c.Cookie.SameSite) {
+	case "lax":
+		res.Store.Options.SameSite = http.SameSiteLaxMode
+	case "strict":
+		res.Store.Options.SameSite = http.SameSiteStrictMode
+	case "none":
+		res.Store.Options.SameSite = http.SameSiteNoneMode
+	}
+
+	window := time.Duration(c.RateLimit.Window)
+	newLimiter := func(limit int) RateLimiter {
+		if limit == 0 {
+			return nil
+		}
+		if res.Redis != nil {
+			return NewRedisRateLimiter(res.Redis, limit, window)
+		}
+		return NewInMemoryRateLimiter(limit, window)
+	}
+	res.Login = NewLoginService(res.Users, newLimiter(c.RateLimit.UserLimit), newLimiter(c.RateLimit.IPLimit))
+
+	res.Handlers = NewAuthHandlers(res.Users, res.Sessions, res.Store)
+	res.Handlers.LoginService = res.Login
+	if c.Session.Duration > 0 {
+		res.Handlers.SessionDuration = time.Duration(c.Session.Duration)
+	}
+	res.Accounts = NewAccountService(res.Users, res.Sessions)
+	res.Accounts.LoginService = res.Login
+	return res, nil
+}
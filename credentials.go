@@ -0,0 +1,306 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Kinds of credentials.
+// Delegation tokens (see DelegationTokens) are stateless and can't be
+// listed or revoked, they expire after their TTL.
+const (
+	CredentialSession       = "session"
+	CredentialTrustedDevice = "trusted_device"
+	CredentialOAuthDevice   = "oauth_device"
+)
+
+// Credential is something that lets a client act as the user without
+// entering the password again.
+// ID identifies the credential within its kind but must not be the secret
+// itself, for sessions it's the SessionID of the key.
+//
+// New in version v0.7
+type Credential struct {
+	Kind        string    `json:"kind"`
+	ID          string    `json:"id"`
+	Description string    `json:"description,omitempty"`
+	Created     time.Time `json:"created"`
+	ExpiresAt   time.Time `json:"expires_at"`
+
+	// Current is true for the credential used by the request, see
+	// CredentialManager.ServeListCredentials.
+	Current bool `json:"current,omitempty"`
+}
+
+// CredentialSource lists and revokes credentials of one kind. Sessions are
+// handled by SessionCredentials, trusted devices by TrustedDeviceCredentials
+// and approved device authorizations by OAuthDeviceCredentials.
+//
+// New in version v0.7
+type CredentialSource interface {
+	// ListCredentials returns all valid credentials of the user.
+	ListCredentials(user uint64) ([]*Credential, error)
+
+	// RevokeCredentials revokes all credentials of the user and returns
+	// the number of revoked credentials.
+	RevokeCredentials(user uint64, reason RevocationReason) (int64, error)
+}
+
+// SessionCredentials is the CredentialSource for the sessions of a
+// SessionController. Listing requires a SessionHandler that implements
+// SessionLister. If Payload is set the device name of a session is its
+// description.
+//
+// New in version v0.7
+type SessionCredentials struct {
+	Controller *SessionController
+	Payload    SessionPayloadHandler
+}
+
+func (s *SessionCredentials) ListCredentials(user uint64) ([]*Credential, error) {
+	var sessions map[string]*SessionKeyData
+	var err error
+	if s.Payload != nil {
+		sessions, err = s.Controller.ListSessionsWithDevices(s.Payload, user)
+	} else {
+		sessions, err = s.Controller.ListSessions(user)
+	}
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*Credential, 0, len(sessions))
+	for key, data := range sessions {
+		credential := &Credential{Kind: CredentialSession, ID: SessionID(key),
+			Created: data.CreationTime, ExpiresAt: data.ValidUntil}
+		if data.Device != nil {
+			credential.Description = data.Device.Name
+		}
+		res = append(res, credential)
+	}
+	return res, nil
+}
+
+func (s *SessionCredentials) RevokeCredentials(user uint64, reason RevocationReason) (int64, error) {
+	return s.Controller.RevokeEntriesForUser(user, reason)
+}
+
+// TrustedDeviceCredentials is the CredentialSource for the devices a user
+// logged in from (see NewDeviceDetector), logins from these devices don't
+// trigger a new device notification. Revoking forgets the devices. It
+// requires a History that implements KnownDeviceHandler.
+//
+// New in version v0.7
+type TrustedDeviceCredentials struct {
+	History LoginHistoryHandler
+}
+
+func (s *TrustedDeviceCredentials) ListCredentials(user uint64) ([]*Credential, error) {
+	known, ok := s.History.(KnownDeviceHandler)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	devices, err := known.KnownDevices(user)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*Credential, 0, len(devices))
+	for device, first := range devices {
+		res = append(res, &Credential{Kind: CredentialTrustedDevice, ID: device,
+			Created: first})
+	}
+	return res, nil
+}
+
+func (s *TrustedDeviceCredentials) RevokeCredentials(user uint64, reason RevocationReason) (int64, error) {
+	known, ok := s.History.(KnownDeviceHandler)
+	if !ok {
+		return 0, ErrNotSupported
+	}
+	return known.ForgetDevices(user)
+}
+
+// OAuthDeviceCredentials is the CredentialSource for the device
+// authorizations a user approved that were not exchanged for an access token
+// yet (the access tokens are sessions). Revoking denies them. It requires
+// Devices that implement OAuthDeviceLister.
+//
+// New in version v0.7
+type OAuthDeviceCredentials struct {
+	Devices OAuthDeviceHandler
+}
+
+func (s *OAuthDeviceCredentials) ListCredentials(user uint64) ([]*Credential, error) {
+	lister, ok := s.Devices.(OAuthDeviceLister)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	devices, err := lister.ApprovedDevices(user)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*Credential, 0, len(devices))
+	for _, device := range devices {
+		res = append(res, &Credential{Kind: CredentialOAuthDevice, ID: device.UserCode,
+			Description: device.ClientID, ExpiresAt: device.ValidUntil})
+	}
+	return res, nil
+}
+
+func (s *OAuthDeviceCredentials) RevokeCredentials(user uint64, reason RevocationReason) (int64, error) {
+	lister, ok := s.Devices.(OAuthDeviceLister)
+	if !ok {
+		return 0, ErrNotSupported
+	}
+	return lister.DenyDevices(user)
+}
+
+// CredentialManager combines the credentials of all sources, for incident
+// response and "sign out everywhere".
+//
+// Usage:
+//
+//	credentials := goauth.NewCredentialManager(&goauth.SessionCredentials{Controller: controller},
+//		&goauth.TrustedDeviceCredentials{History: history},
+//		&goauth.OAuthDeviceCredentials{Devices: oauthServer.Devices})
+//	// requires the SessionMiddleware
+//	http.Handle("/credentials", middleware.RequireSession(http.HandlerFunc(credentials.ServeListCredentials)))
+//	http.Handle("/credentials/revoke", middleware.RequireSession(http.HandlerFunc(credentials.ServeRevokeAllCredentials)))
+//
+// New in version v0.7
+type CredentialManager struct {
+	Sources []CredentialSource
+
+	// Render and RenderError write the responses of the handlers, they
+	// default to RenderJSON and RenderJSONError.
+	Render      func(w http.ResponseWriter, r *http.Request, status int, value interface{})
+	RenderError func(w http.ResponseWriter, r *http.Request, status int, err error)
+}
+
+// NewCredentialManager returns a new CredentialManager that renders JSON.
+//
+// New in version v0.7
+func NewCredentialManager(sources ...CredentialSource) *CredentialManager {
+	return &CredentialManager{Sources: sources, Render: RenderJSON,
+		RenderError: RenderJSONError}
+}
+
+// ListCredentials returns the credentials of all sources, sorted by kind
+// and creation time. Sources that return ErrNotSupported are skipped.
+func (m *CredentialManager) ListCredentials(user uint64) ([]*Credential, error) {
+	var res []*Credential
+	for _, source := range m.Sources {
+		credentials, err := source.ListCredentials(user)
+		if err == ErrNotSupported {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, credentials...)
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		if res[i].Kind != res[j].Kind {
+			return res[i].Kind < res[j].Kind
+		}
+		return res[i].Created.Before(res[j].Created)
+	})
+	return res, nil
+}
+
+// RevokeAllCredentials revokes the credentials of all sources and returns
+// the number of revoked credentials.
+// A failing source doesn't stop the other sources from revoking their
+// credentials, the first error is returned (all are logged). Sources that
+// return ErrNotSupported are skipped.
+func (m *CredentialManager) RevokeAllCredentials(user uint64, reason RevocationReason) (int64, error) {
+	var total int64
+	var res error
+	for _, source := range m.Sources {
+		num, err := source.RevokeCredentials(user, reason)
+		if err == ErrNotSupported {
+			continue
+		}
+		if err != nil {
+			log.WithError(err).WithField("user", user).Error("goauth: Can't revoke credentials")
+			if res == nil {
+				res = err
+			}
+			continue
+		}
+		total += num
+	}
+	return total, res
+}
+
+// ServeListCredentials renders the credentials of the user of the session
+// (see SessionMiddleware). The session of the request is marked as
+// Current.
+func (m *CredentialManager) ServeListCredentials(w http.ResponseWriter, r *http.Request) {
+	id, ok := UserIDFromContext(r.Context())
+	if !ok {
+		m.RenderError(w, r, http.StatusUnauthorized, ErrInvalidCredentials)
+		return
+	}
+	credentials, err := m.ListCredentials(id)
+	if err != nil {
+		m.RenderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if key := SessionKeyFromContext(r.Context()); key != "" {
+		current := SessionID(key)
+		for _, credential := range credentials {
+			if credential.Kind == CredentialSession && credential.ID == current {
+				credential.Current = true
+			}
+		}
+	}
+	if credentials == nil {
+		credentials = []*Credential{}
+	}
+	m.Render(w, r, http.StatusOK, credentials)
+}
+
+// ServeRevokeAllCredentials revokes all credentials of the user of the
+// session (including the session itself) with ReasonLogout, the response
+// contains the number of revoked credentials.
+func (m *CredentialManager) ServeRevokeAllCredentials(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r, m.RenderError) {
+		return
+	}
+	id, ok := UserIDFromContext(r.Context())
+	if !ok {
+		m.RenderError(w, r, http.StatusUnauthorized, ErrInvalidCredentials)
+		return
+	}
+	num, err := m.RevokeAllCredentials(id, ReasonLogout)
+	if err != nil {
+		m.RenderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	m.Render(w, r, http.StatusOK, &AuthResponse{Status: "ok", UserID: id, Deleted: num})
+}
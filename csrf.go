@@ -0,0 +1,244 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"crypto/subtle"
+	"errors"
+	"html/template"
+	"net/http"
+)
+
+// ErrInvalidCSRFToken is returned by CSRFProtection.Verify if the token
+// sent with the request is missing or wrong.
+var ErrInvalidCSRFToken = errors.New("Invalid or missing CSRF token.")
+
+// CSRFMode describes how CSRFProtection stores the expected token.
+type CSRFMode int
+
+const (
+	// CSRFSynchronizerToken stores the token in the session payload, this
+	// requires a session (the SessionMiddleware must run first).
+	CSRFSynchronizerToken CSRFMode = iota
+
+	// CSRFDoubleSubmitCookie stores the token in a cookie, the request is
+	// valid if the submitted token equals the cookie value. This works
+	// without server side state and without a session, but it is weaker if
+	// an attacker can set cookies for your domain (for example from a
+	// subdomain).
+	CSRFDoubleSubmitCookie
+)
+
+// CSRFPayloadName is the name under which the token is stored in the
+// session payload.
+const CSRFPayloadName = "csrf_token"
+
+// CSRFProtection generates and verifies CSRF tokens.
+//
+// The token must be sent with each unsafe request (everything except GET,
+// HEAD, OPTIONS and TRACE), either in the header HeaderName (for AJAX
+// requests) or in the form field FieldName. Use Token or TemplateFuncs to
+// include the token in your pages.
+//
+// New in version v0.7
+type CSRFProtection struct {
+	Mode CSRFMode
+
+	// Payload stores the tokens in CSRFSynchronizerToken mode.
+	Payload SessionPayloadHandler
+
+	// CookieName is the name of the cookie in CSRFDoubleSubmitCookie mode,
+	// defaults to "csrf_token". CookiePath defaults to "/".
+	CookieName, CookiePath string
+
+	// SecureCookie sets the Secure flag of the cookie, you should set it
+	// to true if you use https.
+	SecureCookie bool
+
+	// HeaderName is the header the token is read from, defaults to
+	// "X-CSRF-Token". FieldName is the form field the token is read from,
+	// defaults to "csrf_token".
+	HeaderName, FieldName string
+
+	// Failure is called by the middleware if the verification failed,
+	// defaults to a 403 response.
+	Failure http.HandlerFunc
+}
+
+// NewCSRFProtection returns a new CSRFProtection in CSRFSynchronizerToken
+// mode.
+func NewCSRFProtection(payload SessionPayloadHandler) *CSRFProtection {
+	return &CSRFProtection{Mode: CSRFSynchronizerToken, Payload: payload,
+		CookieName: "csrf_token", CookiePath: "/", HeaderName: "X-CSRF-Token",
+		FieldName: "csrf_token"}
+}
+
+// NewDoubleSubmitCSRFProtection returns a new CSRFProtection in
+// CSRFDoubleSubmitCookie mode.
+func NewDoubleSubmitCSRFProtection() *CSRFProtection {
+	res := NewCSRFProtection(nil)
+	res.Mode = CSRFDoubleSubmitCookie
+	return res
+}
+
+// expected returns the token that is expected for the request, "" if there
+// is none yet.
+func (c *CSRFProtection) expected(r *http.Request) (string, error) {
+	if c.Mode == CSRFDoubleSubmitCookie {
+		cookie, err := r.Cookie(c.CookieName)
+		if err != nil {
+			return "", nil
+		}
+		return cookie.Value, nil
+	}
+	key := SessionKeyFromContext(r.Context())
+	if key == "" {
+		return "", ErrNotAuthSession
+	}
+	token, err := c.Payload.GetPayloadValue(key, CSRFPayloadName)
+	if err == ErrPayloadValueNotFound {
+		return "", nil
+	}
+	return token, err
+}
+
+// Token returns the CSRF token for the request, a new token is created if
+// there is none yet.
+// In CSRFSynchronizerToken mode the request must have a session in its
+// context, otherwise ErrNotAuthSession is returned. In
+// CSRFDoubleSubmitCookie mode the cookie is set on w.
+func (c *CSRFProtection) Token(w http.ResponseWriter, r *http.Request) (string, error) {
+	token, err := c.expected(r)
+	if err != nil || token != "" {
+		return token, err
+	}
+	token, err = GenRandomBase64(-1)
+	if err != nil {
+		return "", err
+	}
+	if c.Mode == CSRFDoubleSubmitCookie {
+		// the cookie must be readable by JavaScript, so no HttpOnly
+		http.SetCookie(w, &http.Cookie{Name: c.CookieName, Value: token,
+			Path: c.CookiePath, Secure: c.SecureCookie,
+			SameSite: http.SameSiteLaxMode})
+		// the next call in the same request must see the cookie
+		r.AddCookie(&http.Cookie{Name: c.CookieName, Value: token})
+		return token, nil
+	}
+	data := SessionDataFromContext(r.Context())
+	if err := c.Payload.SetPayloadValue(SessionKeyFromContext(r.Context()), CSRFPayloadName, token, data.ValidUntil); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Verify checks the token sent with the request, it returns nil if the token
+// is valid, ErrInvalidCSRFToken if it's invalid and any other error if the
+// lookup failed.
+func (c *CSRFProtection) Verify(r *http.Request) error {
+	submitted := r.Header.Get(c.HeaderName)
+	if submitted == "" {
+		submitted = r.PostFormValue(c.FieldName)
+	}
+	if submitted == "" {
+		return ErrInvalidCSRFToken
+	}
+	expected, err := c.expected(r)
+	if err != nil {
+		if err == ErrNotAuthSession {
+			return ErrInvalidCSRFToken
+		}
+		return err
+	}
+	if expected == "" || subtle.ConstantTimeCompare([]byte(expected), []byte(submitted)) != 1 {
+		return ErrInvalidCSRFToken
+	}
+	return nil
+}
+
+// isSafeMethod returns true for the methods that should not change any state.
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// Middleware returns a handler that verifies the token for all unsafe
+// requests before calling next. In CSRFSynchronizerToken mode it must be
+// wrapped by the SessionMiddleware.
+func (c *CSRFProtection) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isSafeMethod(r.Method) {
+			if err := c.Verify(r); err != nil {
+				if err != ErrInvalidCSRFToken {
+					http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+					return
+				}
+				if c.Failure != nil {
+					c.Failure(w, r)
+				} else {
+					http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+				}
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// TemplateFuncs returns the functions "csrfToken" (the token as string) and
+// "csrfField" (a hidden input field containing the token) for use in
+// html/template. The functions must be known when parsing the template and
+// they depend on the request, so add them with nil arguments before parsing
+// and again with the request before executing the template:
+//
+//	tmpl := template.Must(template.New("page").Funcs(csrf.TemplateFuncs(nil, nil)).Parse(src))
+//	...
+//	tmpl.Funcs(csrf.TemplateFuncs(w, r)).Execute(w, data)
+//
+// Note that Funcs changes the template, so clone it first if you execute it
+// concurrently.
+// The functions return an error if no token can be created.
+func (c *CSRFProtection) TemplateFuncs(w http.ResponseWriter, r *http.Request) template.FuncMap {
+	return template.FuncMap{
+		"csrfToken": func() (string, error) {
+			return c.Token(w, r)
+		},
+		"csrfField": func() (template.HTML, error) {
+			token, err := c.Token(w, r)
+			if err != nil {
+				return "", err
+			}
+			return c.field(token), nil
+		},
+	}
+}
+
+// field returns a hidden input field containing the token.
+func (c *CSRFProtection) field(token string) template.HTML {
+	return template.HTML(`<input type="hidden" name="` +
+		template.HTMLEscapeString(c.FieldName) + `" value="` +
+		template.HTMLEscapeString(token) + `">`)
+}
@@ -0,0 +1,79 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCSRFDoubleSubmitCookie(t *testing.T) {
+	csrf := NewDoubleSubmitCSRFProtection()
+	handler := csrf.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	token, err := csrf.Token(w, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie := w.Result().Cookies()[0]
+	tests := []struct {
+		name, method string
+		cookie       bool
+		header, form string
+		status       int
+	}{
+		{"safe method", http.MethodGet, false, "", "", http.StatusOK},
+		{"no token", http.MethodPost, true, "", "", http.StatusForbidden},
+		{"no cookie", http.MethodPost, false, token, "", http.StatusForbidden},
+		{"wrong token", http.MethodPost, true, token + "x", "", http.StatusForbidden},
+		{"header", http.MethodPost, true, token, "", http.StatusOK},
+		{"form", http.MethodPost, true, "", token, http.StatusOK},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, "/", strings.NewReader("csrf_token="+test.form))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if test.cookie {
+			r.AddCookie(cookie)
+		}
+		if test.header != "" {
+			r.Header.Set("X-CSRF-Token", test.header)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s: Expected status %d, got %d", test.name, test.status, w.Code)
+		}
+	}
+}
+
+func TestCSRFSynchronizerTokenWithoutSession(t *testing.T) {
+	csrf := NewCSRFProtection(NewInMemoryPayloadHandler())
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.Header.Set("X-CSRF-Token", "token")
+	if err := csrf.Verify(r); err != ErrInvalidCSRFToken {
+		t.Errorf("Expected ErrInvalidCSRFToken, got %v", err)
+	}
+}
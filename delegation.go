@@ -0,0 +1,249 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// delegationTokenPrefix is the prefix of all delegation tokens, so they can
+// be told apart from session keys quickly.
+const delegationTokenPrefix = "obo."
+
+// DelegationClaims is the content of an on-behalf-of token: the service
+// that makes the call (Service) acts on behalf of the end user (User).
+//
+// New in version v0.7
+type DelegationClaims struct {
+	// Service is the identity of the acting service.
+	Service string `json:"svc"`
+
+	// User is the id of the end user.
+	User uint64 `json:"sub"`
+
+	// Audience is the service the token is meant for, "" means any
+	// service.
+	Audience string `json:"aud,omitempty"`
+
+	// Scopes restricts what the token can be used for, empty means no
+	// restriction.
+	Scopes []string `json:"scp,omitempty"`
+
+	IssuedAt  time.Time `json:"iat"`
+	ExpiresAt time.Time `json:"exp"`
+}
+
+// HasScope reports whether the claims allow the scope, see
+// SessionHasScope.
+func (c *DelegationClaims) HasScope(scope string) bool {
+	return len(c.Scopes) == 0 || scopesAllow(c.Scopes, scope)
+}
+
+// DelegationTokens creates and verifies short-lived on-behalf-of tokens for
+// service-to-service calls. A service that handles a request of a user
+// calls Issue (or IssueForRequest) and sends the token to an internal API,
+// the internal API verifies it and can enforce user-level permissions.
+//
+// Tokens are signed with HMAC-SHA256, all services that create or verify
+// tokens share the secret. The tokens are stateless, so keep TTL short.
+//
+// New in version v0.7
+type DelegationTokens struct {
+	// Secret is the key used to sign the tokens.
+	Secret []byte
+
+	// Secrets is used instead of Secret if it's not nil: tokens are signed
+	// with the current version and all versions are accepted by Verify, so
+	// the key can be rotated with a SecretRotator.
+	Secrets *RotatingSecret
+
+	// TTL is the lifetime of new tokens, defaults to five minutes.
+	TTL time.Duration
+
+	// Audience is the audience a token must have when it's verified by
+	// VerifyToken, "" accepts all tokens.
+	Audience string
+}
+
+// NewDelegationTokens returns new DelegationTokens.
+func NewDelegationTokens(secret []byte) *DelegationTokens {
+	return &DelegationTokens{Secret: secret, TTL: 5 * time.Minute}
+}
+
+// keys returns the keys accepted by Verify, the signing key first.
+func (d *DelegationTokens) keys() [][]byte {
+	if d.Secrets != nil {
+		return d.Secrets.Versions()
+	}
+	return [][]byte{d.Secret}
+}
+
+func (d *DelegationTokens) sign(key []byte, payload string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(delegationTokenPrefix + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Issue creates a token for service acting on behalf of user.
+func (d *DelegationTokens) Issue(service string, user uint64, audience string, scopes []string) (string, error) {
+	now := CurrentTime()
+	claims := &DelegationClaims{Service: service, User: user, Audience: audience,
+		Scopes: scopes, IssuedAt: now, ExpiresAt: now.Add(d.TTL)}
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	keys := d.keys()
+	if len(keys) == 0 {
+		return "", errors.New("No key to sign delegation tokens.")
+	}
+	return delegationTokenPrefix + payload + "." + d.sign(keys[0], payload), nil
+}
+
+// IssueForRequest creates a token for service acting on behalf of the user
+// of the request (stored in the context by a session middleware).
+// Returns ErrNotAuthSession if the request has no user.
+func (d *DelegationTokens) IssueForRequest(r *http.Request, service, audience string, scopes []string) (string, error) {
+	user, ok := UserIDFromContext(r.Context())
+	if !ok {
+		return "", ErrNotAuthSession
+	}
+	return d.Issue(service, user, audience, scopes)
+}
+
+// Verify checks the token and returns its claims.
+// It returns ErrKeyNotFound if the token is not a valid delegation token
+// and ErrInvalidKey if it is expired or not meant for audience (if audience
+// is not "").
+func (d *DelegationTokens) Verify(token, audience string) (*DelegationClaims, error) {
+	if !strings.HasPrefix(token, delegationTokenPrefix) {
+		return nil, ErrKeyNotFound
+	}
+	parts := strings.Split(strings.TrimPrefix(token, delegationTokenPrefix), ".")
+	if len(parts) != 2 {
+		return nil, ErrKeyNotFound
+	}
+	valid := false
+	for _, key := range d.keys() {
+		if hmac.Equal([]byte(d.sign(key, parts[0])), []byte(parts[1])) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return nil, ErrKeyNotFound
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrKeyNotFound
+	}
+	claims := &DelegationClaims{}
+	if err := json.Unmarshal(data, claims); err != nil {
+		return nil, ErrKeyNotFound
+	}
+	if KeyInvalid(CurrentTime(), claims.ExpiresAt) {
+		return nil, ErrInvalidKey
+	}
+	if audience != "" && claims.Audience != "" && claims.Audience != audience {
+		return nil, ErrInvalidKey
+	}
+	return claims, nil
+}
+
+// VerifyToken implements TokenVerifier, the user of the token is the end
+// user. Use DelegationMiddleware if you need the identity of the acting
+// service. Tokens restricted to scopes are rejected with ErrScopedSession,
+// see BearerMiddleware.RequireScope.
+func (d *DelegationTokens) VerifyToken(token string) (*SessionKeyData, error) {
+	return d.verify(token, false)
+}
+
+// verify implements VerifyToken, if allowScoped is true tokens restricted
+// to scopes are accepted as well.
+func (d *DelegationTokens) verify(token string, allowScoped bool) (*SessionKeyData, error) {
+	claims, err := d.Verify(token, d.Audience)
+	if err != nil {
+		return nil, err
+	}
+	data := NewSessionKeyData(claims.User, claims.IssuedAt, claims.ExpiresAt)
+	if len(claims.Scopes) > 0 {
+		if !allowScoped {
+			return nil, ErrScopedSession
+		}
+		data.Scoped, data.Scopes = true, claims.Scopes
+	}
+	return data, nil
+}
+
+// NewDelegationContext returns a copy of ctx that contains the claims.
+//
+// New in version v0.7
+func NewDelegationContext(ctx context.Context, claims *DelegationClaims) context.Context {
+	return context.WithValue(ctx, delegationContextKey, claims)
+}
+
+// DelegationFromContext returns the claims stored by DelegationMiddleware,
+// nil if the request was not authenticated with a delegation token.
+//
+// New in version v0.7
+func DelegationFromContext(ctx context.Context) *DelegationClaims {
+	claims, _ := ctx.Value(delegationContextKey).(*DelegationClaims)
+	return claims
+}
+
+// DelegationMiddleware returns a handler that requires a delegation token
+// in the Authorization header. The end user is stored in the context like
+// the session middleware does (so UserIDFromContext works), the claims
+// including the acting service can be retrieved with DelegationFromContext.
+// If scope is not "" the token must allow the scope.
+//
+// New in version v0.7
+func (d *DelegationTokens) DelegationMiddleware(scope string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := bearerToken(r)
+		if token == "" {
+			writeBearerError(w, "")
+			return
+		}
+		claims, err := d.Verify(token, d.Audience)
+		if err != nil {
+			writeBearerError(w, "invalid_token")
+			return
+		}
+		if scope != "" && !claims.HasScope(scope) {
+			writeInsufficientScope(w, scope)
+			return
+		}
+		ctx := NewSessionContext(r.Context(), token, NewSessionKeyData(claims.User, claims.IssuedAt, claims.ExpiresAt))
+		next.ServeHTTP(w, r.WithContext(NewDelegationContext(ctx, claims)))
+	})
+}
@@ -0,0 +1,554 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// AccountDeletionPurpose is the purpose of the tokens that cancel an account
+// deletion in a OneTimeTokenStore.
+const AccountDeletionPurpose = "account_deletion"
+
+// ErrDeletionNotScheduled is returned if no deletion is scheduled for a
+// user.
+var ErrDeletionNotScheduled = errors.New("No account deletion scheduled.")
+
+// ScheduledDeletion is an account deletion that is executed at DeleteAt.
+//
+// New in version v0.7
+type ScheduledDeletion struct {
+	User     uint64    `json:"user_id"`
+	UserName string    `json:"username"`
+	DeleteAt time.Time `json:"delete_at"`
+}
+
+// AccountDeletionHandler stores scheduled account deletions.
+//
+// New in version v0.7
+type AccountDeletionHandler interface {
+	// Init initializes the storage, see UserHandler.
+	Init() error
+
+	// ScheduleDeletion stores the deletion, an existing deletion for the
+	// user is replaced.
+	ScheduleDeletion(deletion *ScheduledDeletion) error
+
+	// GetDeletion returns the deletion scheduled for the user or
+	// ErrDeletionNotScheduled.
+	GetDeletion(user uint64) (*ScheduledDeletion, error)
+
+	// CancelDeletion removes the deletion scheduled for the user, it returns
+	// ErrDeletionNotScheduled if there is none.
+	CancelDeletion(user uint64) error
+
+	// DueDeletions returns all deletions with DeleteAt before now.
+	DueDeletions(now time.Time) ([]*ScheduledDeletion, error)
+}
+
+// InMemoryAccountDeletionHandler is an AccountDeletionHandler that keeps
+// the deletions in memory.
+//
+// New in version v0.7
+type InMemoryAccountDeletionHandler struct {
+	mutex     sync.RWMutex
+	deletions map[uint64]*ScheduledDeletion
+}
+
+// NewInMemoryAccountDeletionHandler returns a new
+// InMemoryAccountDeletionHandler.
+func NewInMemoryAccountDeletionHandler() *InMemoryAccountDeletionHandler {
+	return &InMemoryAccountDeletionHandler{deletions: make(map[uint64]*ScheduledDeletion)}
+}
+
+func (h *InMemoryAccountDeletionHandler) Init() error {
+	return nil
+}
+
+func (h *InMemoryAccountDeletionHandler) ScheduleDeletion(deletion *ScheduledDeletion) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	copied := *deletion
+	h.deletions[deletion.User] = &copied
+	return nil
+}
+
+func (h *InMemoryAccountDeletionHandler) GetDeletion(user uint64) (*ScheduledDeletion, error) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	deletion, has := h.deletions[user]
+	if !has {
+		return nil, ErrDeletionNotScheduled
+	}
+	copied := *deletion
+	return &copied, nil
+}
+
+func (h *InMemoryAccountDeletionHandler) CancelDeletion(user uint64) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if _, has := h.deletions[user]; !has {
+		return ErrDeletionNotScheduled
+	}
+	delete(h.deletions, user)
+	return nil
+}
+
+func (h *InMemoryAccountDeletionHandler) DueDeletions(now time.Time) ([]*ScheduledDeletion, error) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	var res []*ScheduledDeletion
+	for _, deletion := range h.deletions {
+		if deletion.DeleteAt.Before(now) {
+			copied := *deletion
+			res = append(res, &copied)
+		}
+	}
+	return res, nil
+}
+
+// SQLAccountDeletionQueries stores the queries for
+// SQLAccountDeletionHandler.
+//
+// New in version v0.7
+type SQLAccountDeletionQueries struct {
+	InitQuery, ScheduleQuery, GetQuery, CancelQuery, DueQuery string
+
+	// TimeFromScanType is used to transform database time entries to
+	// gos time. See SQLSessionHandler for details.
+	TimeFromScanType func(val interface{}) (time.Time, error)
+}
+
+// MySQLAccountDeletionQueries provides queries to use with MySQL.
+func MySQLAccountDeletionQueries() *SQLAccountDeletionQueries {
+	initQ := `
+	CREATE TABLE IF NOT EXISTS account_deletions (
+		user_id BIGINT UNSIGNED NOT NULL,
+		username VARCHAR(150) NOT NULL,
+		delete_at DATETIME NOT NULL,
+		PRIMARY KEY(user_id)
+	);
+	`
+	return &SQLAccountDeletionQueries{InitQuery: initQ,
+		ScheduleQuery:    "INSERT INTO account_deletions (user_id, username, delete_at) VALUES(?, ?, ?) ON DUPLICATE KEY UPDATE username=VALUES(username), delete_at=VALUES(delete_at)",
+		GetQuery:         "SELECT user_id, username, delete_at FROM account_deletions WHERE user_id=?",
+		CancelQuery:      "DELETE FROM account_deletions WHERE user_id=?",
+		DueQuery:         "SELECT user_id, username, delete_at FROM account_deletions WHERE delete_at < ?",
+		TimeFromScanType: DefaultTimeFromScanType}
+}
+
+// PostgresAccountDeletionQueries provides queries to use with postgres.
+func PostgresAccountDeletionQueries() *SQLAccountDeletionQueries {
+	initQ := `
+	CREATE TABLE IF NOT EXISTS account_deletions (
+		user_id bigint PRIMARY KEY,
+		username varchar(150) NOT NULL,
+		delete_at timestamp NOT NULL
+	);
+	`
+	return &SQLAccountDeletionQueries{InitQuery: initQ,
+		ScheduleQuery:    "INSERT INTO account_deletions (user_id, username, delete_at) VALUES($1, $2, $3) ON CONFLICT (user_id) DO UPDATE SET username = EXCLUDED.username, delete_at = EXCLUDED.delete_at",
+		GetQuery:         "SELECT user_id, username, delete_at FROM account_deletions WHERE user_id = $1",
+		CancelQuery:      "DELETE FROM account_deletions WHERE user_id = $1",
+		DueQuery:         "SELECT user_id, username, delete_at FROM account_deletions WHERE delete_at < $1",
+		TimeFromScanType: DefaultTimeFromScanType}
+}
+
+// SQLite3AccountDeletionQueries provides queries to use with sqlite3.
+func SQLite3AccountDeletionQueries() *SQLAccountDeletionQueries {
+	res := MySQLAccountDeletionQueries()
+	res.ScheduleQuery = "INSERT OR REPLACE INTO account_deletions (user_id, username, delete_at) VALUES(?, ?, ?)"
+	return res
+}
+
+// SQLAccountDeletionHandler implements AccountDeletionHandler by executing
+// the queries defined in an instance of SQLAccountDeletionQueries.
+//
+// New in version v0.7
+type SQLAccountDeletionHandler struct {
+	*SQLAccountDeletionQueries
+
+	// DB is the database to execute the queries on.
+	DB *sql.DB
+
+	blockDB bool
+	mutex   sync.RWMutex
+}
+
+// NewSQLAccountDeletionHandler returns a new SQLAccountDeletionHandler,
+// blockDB has the same meaning as in NewSQLUserHandler.
+func NewSQLAccountDeletionHandler(queries *SQLAccountDeletionQueries, db *sql.DB, blockDB bool) *SQLAccountDeletionHandler {
+	return &SQLAccountDeletionHandler{SQLAccountDeletionQueries: queries, DB: db, blockDB: blockDB}
+}
+
+// NewMySQLAccountDeletionHandler returns a new SQLAccountDeletionHandler
+// that uses MySQL.
+func NewMySQLAccountDeletionHandler(db *sql.DB) *SQLAccountDeletionHandler {
+	return NewSQLAccountDeletionHandler(MySQLAccountDeletionQueries(), db, false)
+}
+
+// NewPostgresAccountDeletionHandler returns a new SQLAccountDeletionHandler
+// that uses postgres.
+func NewPostgresAccountDeletionHandler(db *sql.DB) *SQLAccountDeletionHandler {
+	return NewSQLAccountDeletionHandler(PostgresAccountDeletionQueries(), db, false)
+}
+
+// NewSQLite3AccountDeletionHandler returns a new SQLAccountDeletionHandler
+// that uses sqlite3.
+func NewSQLite3AccountDeletionHandler(db *sql.DB) *SQLAccountDeletionHandler {
+	return NewSQLAccountDeletionHandler(SQLite3AccountDeletionQueries(), db, true)
+}
+
+func (handler *SQLAccountDeletionHandler) Init() error {
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	_, err := handler.DB.Exec(handler.InitQuery)
+	return err
+}
+
+func (handler *SQLAccountDeletionHandler) ScheduleDeletion(deletion *ScheduledDeletion) error {
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	_, err := handler.DB.Exec(handler.ScheduleQuery, deletion.User, deletion.UserName, deletion.DeleteAt)
+	return wrapBackendError("sql", "ScheduleDeletion", err)
+}
+
+func (handler *SQLAccountDeletionHandler) scan(row rowScanner) (*ScheduledDeletion, error) {
+	res := &ScheduledDeletion{}
+	var deleteAtVal interface{}
+	if err := row.Scan(&res.User, &res.UserName, &deleteAtVal); err != nil {
+		return nil, err
+	}
+	var err error
+	if res.DeleteAt, err = handler.TimeFromScanType(deleteAtVal); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (handler *SQLAccountDeletionHandler) GetDeletion(user uint64) (*ScheduledDeletion, error) {
+	if handler.blockDB {
+		handler.mutex.RLock()
+		defer handler.mutex.RUnlock()
+	}
+	res, err := handler.scan(handler.DB.QueryRow(handler.GetQuery, user))
+	if err == sql.ErrNoRows {
+		return nil, ErrDeletionNotScheduled
+	}
+	return res, wrapBackendError("sql", "GetDeletion", err)
+}
+
+func (handler *SQLAccountDeletionHandler) CancelDeletion(user uint64) error {
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	res, err := handler.DB.Exec(handler.CancelQuery, user)
+	if err != nil {
+		return wrapBackendError("sql", "CancelDeletion", err)
+	}
+	if num, err := res.RowsAffected(); err == nil && num == 0 {
+		return ErrDeletionNotScheduled
+	}
+	return nil
+}
+
+func (handler *SQLAccountDeletionHandler) DueDeletions(now time.Time) ([]*ScheduledDeletion, error) {
+	if handler.blockDB {
+		handler.mutex.RLock()
+		defer handler.mutex.RUnlock()
+	}
+	rows, err := handler.DB.Query(handler.DueQuery, now)
+	if err != nil {
+		return nil, wrapBackendError("sql", "DueDeletions", err)
+	}
+	defer rows.Close()
+	var res []*ScheduledDeletion
+	for rows.Next() {
+		deletion, err := handler.scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, deletion)
+	}
+	return res, rows.Err()
+}
+
+// AccountDeletionManager implements self-service account deletion with a
+// grace period: RequestAccountDeletion deactivates the account, revokes all
+// sessions and schedules the deletion. Until then the user can cancel it
+// with the token passed to Deliver. DeleteDue deletes the accounts whose
+// grace period is over, add it to a Janitor.
+//
+// The users must implement ActiveFlagHandler, so deactivated users can't
+// log in (see ErrUserInactive).
+//
+// New in version v0.7
+type AccountDeletionManager struct {
+	Users      UserHandler
+	Controller *SessionController
+	Deletions  AccountDeletionHandler
+	Tokens     OneTimeTokenStore
+
+	// GracePeriod is the time until the account is deleted, defaults to 30
+	// days.
+	GracePeriod time.Duration
+
+	// Notifier is informed about scheduled and executed deletions, may be
+	// nil.
+	Notifier SecurityNotifier
+
+	// Deliver sends the cancel token to the user, may be nil.
+	Deliver func(info *BaseUserInformation, deletion *ScheduledDeletion, token string) error
+
+	// OnDelete is called before a user is deleted by DeleteDue, it should
+	// delete the data of the user in your application. If it returns an
+	// error the user is not deleted and it's tried again on the next run.
+	// May be nil.
+	OnDelete func(deletion *ScheduledDeletion) error
+
+	// Render and RenderError write the responses of the handlers, they
+	// default to RenderJSON and RenderJSONError.
+	Render      func(w http.ResponseWriter, r *http.Request, status int, value interface{})
+	RenderError func(w http.ResponseWriter, r *http.Request, status int, err error)
+}
+
+// NewAccountDeletionManager returns a new AccountDeletionManager with a
+// grace period of 30 days that renders JSON.
+func NewAccountDeletionManager(users UserHandler, controller *SessionController, deletions AccountDeletionHandler, tokens OneTimeTokenStore) *AccountDeletionManager {
+	return &AccountDeletionManager{Users: users, Controller: controller,
+		Deletions: deletions, Tokens: tokens, GracePeriod: 30 * 24 * time.Hour,
+		Render: RenderJSON, RenderError: RenderJSONError}
+}
+
+func (m *AccountDeletionManager) activeHandler() (ActiveFlagHandler, error) {
+	flags, ok := m.Users.(ActiveFlagHandler)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return flags, nil
+}
+
+// RequestAccountDeletion deactivates the account, revokes all sessions of
+// the user (with ReasonAccountDeleted) and schedules the deletion. It
+// returns the deletion and the token to cancel it (it's also passed to
+// Deliver).
+func (m *AccountDeletionManager) RequestAccountDeletion(userName string) (*ScheduledDeletion, string, error) {
+	flags, err := m.activeHandler()
+	if err != nil {
+		return nil, "", err
+	}
+	info, err := m.Users.GetUserBaseInfo(userName)
+	if err != nil {
+		return nil, "", err
+	}
+	info.UserName = userName
+	deletion := &ScheduledDeletion{User: info.ID, UserName: userName,
+		DeleteAt: CurrentTime().Add(m.GracePeriod)}
+	if err := flags.SetActive(userName, false); err != nil {
+		return nil, "", err
+	}
+	// revoked (not only deleted) so tombstones and logout notifications are
+	// created like for every other revocation
+	if _, err := m.Controller.RevokeEntriesForUser(info.ID, ReasonAccountDeleted); err != nil {
+		return nil, "", err
+	}
+	if err := m.Deletions.ScheduleDeletion(deletion); err != nil {
+		return nil, "", err
+	}
+	subject := userSubject(info.ID)
+	if _, err := m.Tokens.DeleteTokens(AccountDeletionPurpose, subject); err != nil {
+		return nil, "", err
+	}
+	token, err := IssueOneTimeToken(m.Tokens, AccountDeletionPurpose, subject, "", m.GracePeriod)
+	if err != nil {
+		return nil, "", err
+	}
+	if m.Notifier != nil {
+		m.Notifier.Notify(NewSecurityEvent(EventDeletionScheduled, info.ID, userName))
+	}
+	if m.Deliver != nil {
+		if err := m.Deliver(info, deletion, token); err != nil {
+			return deletion, token, err
+		}
+	}
+	return deletion, token, nil
+}
+
+// CancelAccountDeletion redeems the cancel token: the deletion is canceled
+// and the account is activated again. Returns ErrTokenNotFound if the token
+// is invalid and ErrDeletionNotScheduled if the account was already deleted.
+func (m *AccountDeletionManager) CancelAccountDeletion(token string) (*ScheduledDeletion, error) {
+	flags, err := m.activeHandler()
+	if err != nil {
+		return nil, err
+	}
+	entry, err := ConsumeOneTimeToken(m.Tokens, AccountDeletionPurpose, token)
+	if err != nil {
+		return nil, err
+	}
+	user, err := subjectUserID(entry.Subject)
+	if err != nil {
+		return nil, ErrTokenNotFound
+	}
+	deletion, err := m.Deletions.GetDeletion(user)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.Deletions.CancelDeletion(user); err != nil {
+		return nil, err
+	}
+	if err := flags.SetActive(deletion.UserName, true); err != nil {
+		return nil, err
+	}
+	return deletion, nil
+}
+
+// DeleteDue deletes all accounts whose grace period is over and returns the
+// number of deleted accounts. It's a JanitorTask.
+// The accounts are identified by their id: If the user was renamed since the
+// deletion was scheduled the current name is deleted (and stored in the
+// ScheduledDeletion passed to OnDelete), so a new account with the old name
+// is never deleted. Deletions of users that don't exist any more are
+// removed.
+func (m *AccountDeletionManager) DeleteDue() (int64, error) {
+	due, err := m.Deletions.DueDeletions(CurrentTime())
+	if err != nil {
+		return 0, err
+	}
+	var deleted int64
+	for _, deletion := range due {
+		userName, err := m.Users.GetUserName(deletion.User)
+		switch err {
+		case nil:
+			deletion.UserName = userName
+		case ErrUserNotFound:
+			if err := m.removeDeletion(deletion.User); err != nil {
+				return deleted, err
+			}
+			continue
+		default:
+			return deleted, err
+		}
+		if m.OnDelete != nil {
+			if err := m.OnDelete(deletion); err != nil {
+				return deleted, err
+			}
+		}
+		if err := m.Users.DeleteUser(deletion.UserName); err != nil {
+			return deleted, err
+		}
+		if err := m.removeDeletion(deletion.User); err != nil {
+			return deleted, err
+		}
+		deleted++
+		if m.Notifier != nil {
+			m.Notifier.Notify(NewSecurityEvent(EventAccountDeleted, deletion.User, deletion.UserName))
+		}
+	}
+	return deleted, nil
+}
+
+// removeDeletion removes the scheduled deletion of the user and its cancel
+// token.
+func (m *AccountDeletionManager) removeDeletion(user uint64) error {
+	if _, err := m.Tokens.DeleteTokens(AccountDeletionPurpose, userSubject(user)); err != nil {
+		return err
+	}
+	if err := m.Deletions.CancelDeletion(user); err != nil && err != ErrDeletionNotScheduled {
+		return err
+	}
+	return nil
+}
+
+// ServeRequestDeletion schedules the deletion of the account of the user of
+// the session (see SessionMiddleware). The request must contain the
+// password of the user (field "password", see AuthRequest).
+func (m *AccountDeletionManager) ServeRequestDeletion(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r, m.RenderError) {
+		return
+	}
+	id, ok := UserIDFromContext(r.Context())
+	if !ok {
+		m.RenderError(w, r, http.StatusUnauthorized, ErrInvalidCredentials)
+		return
+	}
+	req, err := ParseAuthRequest(r)
+	if err != nil {
+		m.RenderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	userName, err := m.Users.GetUserName(id)
+	if err != nil {
+		m.RenderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	validID, err := m.Users.Validate(userName, []byte(req.Password))
+	if err != nil && err != ErrUserNotFound && err != ErrRegistrationPending {
+		m.RenderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if validID != id {
+		m.RenderError(w, r, http.StatusUnauthorized, ErrInvalidCredentials)
+		return
+	}
+	deletion, _, err := m.RequestAccountDeletion(userName)
+	switch {
+	case err == ErrNotSupported:
+		m.RenderError(w, r, http.StatusNotImplemented, err)
+	case err != nil && deletion == nil:
+		m.RenderError(w, r, http.StatusInternalServerError, err)
+	default:
+		// if only the delivery failed the deletion is scheduled anyway
+		m.Render(w, r, http.StatusAccepted, deletion)
+	}
+}
+
+// ServeCancelDeletion redeems a cancel token, see
+// EmailVerifier.ServeConfirmEmail for how the token is passed.
+func (m *AccountDeletionManager) ServeCancelDeletion(w http.ResponseWriter, r *http.Request) {
+	token, ok := requestToken(w, r, m.RenderError)
+	if !ok {
+		return
+	}
+	deletion, err := m.CancelAccountDeletion(token)
+	switch {
+	case err == ErrTokenNotFound || err == ErrDeletionNotScheduled:
+		m.RenderError(w, r, http.StatusBadRequest, ErrTokenNotFound)
+	case err == ErrNotSupported:
+		m.RenderError(w, r, http.StatusNotImplemented, err)
+	case err != nil:
+		m.RenderError(w, r, http.StatusInternalServerError, err)
+	default:
+		m.Render(w, r, http.StatusOK, &AuthResponse{Status: "ok",
+			UserID: deletion.User, UserName: deletion.UserName})
+	}
+}
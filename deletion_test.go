@@ -0,0 +1,194 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"testing"
+	"time"
+)
+
+// testUserHandler is a UserHandler (and PasswordStatusHandler) that keeps
+// the users in memory.
+type testUserHandler struct {
+	users     map[string]*BaseUserInformation
+	passwords map[string]string
+	nextID    uint64
+}
+
+func newTestUserHandler() *testUserHandler {
+	return &testUserHandler{users: make(map[string]*BaseUserInformation),
+		passwords: make(map[string]string), nextID: 1}
+}
+
+func (h *testUserHandler) Init() error {
+	return nil
+}
+
+func (h *testUserHandler) Insert(userName, firstName, lastName, email string, plainPW []byte) (uint64, error) {
+	if _, has := h.users[userName]; has {
+		return NoUserID, ErrDuplicateUsername
+	}
+	id := h.nextID
+	h.nextID++
+	h.users[userName] = &BaseUserInformation{ID: id, UserName: userName,
+		FirstName: firstName, LastName: lastName, Email: email, IsActive: true}
+	if len(plainPW) > 0 {
+		h.passwords[userName] = string(plainPW)
+	}
+	return id, nil
+}
+
+func (h *testUserHandler) Validate(userName string, cleartextPwCheck []byte) (uint64, error) {
+	info, has := h.users[userName]
+	if !has {
+		return NoUserID, ErrUserNotFound
+	}
+	if pw, has := h.passwords[userName]; !has || pw != string(cleartextPwCheck) {
+		return NoUserID, nil
+	}
+	return info.ID, nil
+}
+
+func (h *testUserHandler) UpdatePassword(userName string, plainPW []byte) error {
+	if _, has := h.users[userName]; !has {
+		return ErrUserNotFound
+	}
+	h.passwords[userName] = string(plainPW)
+	return nil
+}
+
+func (h *testUserHandler) ListUsers() (map[uint64]string, error) {
+	res := make(map[uint64]string, len(h.users))
+	for userName, info := range h.users {
+		res[info.ID] = userName
+	}
+	return res, nil
+}
+
+func (h *testUserHandler) GetUserName(id uint64) (string, error) {
+	for userName, info := range h.users {
+		if info.ID == id {
+			return userName, nil
+		}
+	}
+	return "", ErrUserNotFound
+}
+
+func (h *testUserHandler) GetUserID(userName string) (uint64, error) {
+	info, has := h.users[userName]
+	if !has {
+		return NoUserID, ErrUserNotFound
+	}
+	return info.ID, nil
+}
+
+func (h *testUserHandler) DeleteUser(userName string) error {
+	delete(h.users, userName)
+	delete(h.passwords, userName)
+	return nil
+}
+
+func (h *testUserHandler) GetUserBaseInfo(userName string) (*BaseUserInformation, error) {
+	info, has := h.users[userName]
+	if !has {
+		return nil, ErrUserNotFound
+	}
+	copied := *info
+	return &copied, nil
+}
+
+func (h *testUserHandler) HasPassword(userName string) (bool, error) {
+	if _, has := h.users[userName]; !has {
+		return false, ErrUserNotFound
+	}
+	_, has := h.passwords[userName]
+	return has, nil
+}
+
+func (h *testUserHandler) ClearPassword(userName string) error {
+	delete(h.passwords, userName)
+	return nil
+}
+
+func TestDeleteDue(t *testing.T) {
+	users := newTestUserHandler()
+	alice, _ := users.Insert("alice", "", "", "", nil)
+	bob, _ := users.Insert("bob", "", "", "", nil)
+	deletions := NewInMemoryAccountDeletionHandler()
+	tokens := NewInMemoryOneTimeTokenStore()
+	manager := NewAccountDeletionManager(users, NewInMemoryController(), deletions, tokens)
+	var deleted []string
+	manager.OnDelete = func(deletion *ScheduledDeletion) error {
+		deleted = append(deleted, deletion.UserName)
+		return nil
+	}
+	past := CurrentTime().Add(-time.Minute)
+	// alice was renamed after the deletion was scheduled and another user
+	// took the old name
+	if err := users.DeleteUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	users.users["alice-new"] = &BaseUserInformation{ID: alice, UserName: "alice-new"}
+	if _, err := users.Insert("alice", "", "", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	schedule := []*ScheduledDeletion{
+		{User: alice, UserName: "alice", DeleteAt: past},
+		{User: bob, UserName: "bob", DeleteAt: CurrentTime().Add(time.Hour)},
+		{User: 42, UserName: "gone", DeleteAt: past},
+	}
+	for _, deletion := range schedule {
+		if err := deletions.ScheduleDeletion(deletion); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := IssueOneTimeToken(tokens, AccountDeletionPurpose, userSubject(deletion.User), "", time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	num, err := manager.DeleteDue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if num != 1 || len(deleted) != 1 || deleted[0] != "alice-new" {
+		t.Errorf("Expected only alice-new to be deleted, got %d deletions: %v", num, deleted)
+	}
+	for _, userName := range []string{"alice", "bob"} {
+		if _, err := users.GetUserID(userName); err != nil {
+			t.Errorf("Expected user %s to exist, got %v", userName, err)
+		}
+	}
+	if _, err := users.GetUserID("alice-new"); err != ErrUserNotFound {
+		t.Errorf("Expected alice-new to be deleted, got %v", err)
+	}
+	for _, user := range []uint64{alice, 42} {
+		if _, err := deletions.GetDeletion(user); err != ErrDeletionNotScheduled {
+			t.Errorf("Expected the deletion of user %d to be removed, got %v", user, err)
+		}
+		if num, _ := tokens.DeleteTokens(AccountDeletionPurpose, userSubject(user)); num != 0 {
+			t.Errorf("Expected the cancel token of user %d to be removed", user)
+		}
+	}
+	if _, err := deletions.GetDeletion(bob); err != nil {
+		t.Errorf("Expected the deletion of bob to be kept, got %v", err)
+	}
+}
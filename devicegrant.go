@@ -0,0 +1,529 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrDeviceCodeNotFound is returned by an OAuthDeviceHandler if there is no
+// device authorization for the given device or user code.
+//
+// New in version v0.7
+var ErrDeviceCodeNotFound = errors.New("Device code not found.")
+
+// ErrDeviceCodeDecided is returned by OAuthDeviceHandler.Decide if the user
+// already approved or denied the device authorization.
+//
+// New in version v0.7
+var ErrDeviceCodeDecided = errors.New("The device code was already approved or denied.")
+
+// DeviceCodeGrantType is the grant_type used by clients polling the token
+// endpoint in the device authorization grant.
+//
+// New in version v0.7
+const DeviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// OAuthDeviceAuthorization is a pending device authorization as defined in
+// RFC 8628.
+//
+// New in version v0.7
+type OAuthDeviceAuthorization struct {
+	ClientID, Scope string
+
+	// UserCode is the (normalized) code the user enters on the
+	// verification page.
+	UserCode string
+
+	// User is the user that approved the request, Approved and Denied are
+	// set once the user made a decision.
+	User             UserKeyType
+	Approved, Denied bool
+
+	// LastPoll is the last time the client polled the token endpoint.
+	LastPoll   time.Time
+	ValidUntil time.Time
+}
+
+// OAuthDeviceHandler stores pending device authorizations.
+//
+// New in version v0.7
+type OAuthDeviceHandler interface {
+	// StoreDevice stores a new device authorization.
+	StoreDevice(deviceCode string, data *OAuthDeviceAuthorization) error
+
+	// GetByUserCode returns the authorization with the given user code.
+	// Returns ErrDeviceCodeNotFound if there is no such authorization.
+	GetByUserCode(userCode string) (*OAuthDeviceAuthorization, error)
+
+	// Decide stores the decision of the user for the authorization with the
+	// given user code. Only pending authorizations can be decided: It
+	// returns ErrDeviceCodeNotFound if there is no such authorization or it
+	// is expired and ErrDeviceCodeDecided if the user already made a
+	// decision.
+	Decide(userCode string, user UserKeyType, approved bool) error
+
+	// Poll returns the authorization for the device code and sets
+	// LastPoll to now. The returned object contains the value of LastPoll
+	// before the update.
+	// If the user made a decision the authorization must be removed, so
+	// each device code can be exchanged only once.
+	Poll(deviceCode string, now time.Time) (*OAuthDeviceAuthorization, error)
+}
+
+// OAuthDeviceLister is implemented by OAuthDeviceHandlers that can list and
+// revoke the authorizations a user approved but the device didn't exchange
+// for an access token yet, see OAuthDeviceCredentials.
+// InMemoryOAuthDeviceHandler implements this interface.
+//
+// New in version v0.7
+type OAuthDeviceLister interface {
+	// ApprovedDevices returns the valid authorizations approved by the
+	// user.
+	ApprovedDevices(user uint64) ([]*OAuthDeviceAuthorization, error)
+
+	// DenyDevices denies all authorizations approved by the user and
+	// returns their number, the devices get an access_denied error.
+	DenyDevices(user uint64) (int64, error)
+}
+
+// InMemoryOAuthDeviceHandler is an OAuthDeviceHandler that keeps everything
+// in memory, see InMemoryOAuthCodeHandler for the limitations.
+//
+// New in version v0.7
+type InMemoryOAuthDeviceHandler struct {
+	devices map[string]*OAuthDeviceAuthorization
+	// userCodes maps user codes to device codes
+	userCodes map[string]string
+	mutex     sync.Mutex
+}
+
+// NewInMemoryOAuthDeviceHandler returns a new InMemoryOAuthDeviceHandler.
+//
+// New in version v0.7
+func NewInMemoryOAuthDeviceHandler() *InMemoryOAuthDeviceHandler {
+	return &InMemoryOAuthDeviceHandler{devices: make(map[string]*OAuthDeviceAuthorization),
+		userCodes: make(map[string]string)}
+}
+
+func (h *InMemoryOAuthDeviceHandler) StoreDevice(deviceCode string, data *OAuthDeviceAuthorization) error {
+	now := CurrentTime()
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for key, value := range h.devices {
+		if KeyInvalid(now, value.ValidUntil) {
+			delete(h.userCodes, value.UserCode)
+			delete(h.devices, key)
+		}
+	}
+	if _, has := h.userCodes[data.UserCode]; has {
+		return errors.New("User code already in use")
+	}
+	h.devices[deviceCode] = data
+	h.userCodes[data.UserCode] = deviceCode
+	return nil
+}
+
+func (h *InMemoryOAuthDeviceHandler) GetByUserCode(userCode string) (*OAuthDeviceAuthorization, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	deviceCode, has := h.userCodes[userCode]
+	if !has {
+		return nil, ErrDeviceCodeNotFound
+	}
+	data := *h.devices[deviceCode]
+	return &data, nil
+}
+
+func (h *InMemoryOAuthDeviceHandler) Decide(userCode string, user UserKeyType, approved bool) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	deviceCode, has := h.userCodes[userCode]
+	if !has {
+		return ErrDeviceCodeNotFound
+	}
+	data := h.devices[deviceCode]
+	if KeyInvalid(CurrentTime(), data.ValidUntil) {
+		return ErrDeviceCodeNotFound
+	}
+	if data.Approved || data.Denied {
+		return ErrDeviceCodeDecided
+	}
+	data.User = user
+	data.Approved = approved
+	data.Denied = !approved
+	return nil
+}
+
+func (h *InMemoryOAuthDeviceHandler) Poll(deviceCode string, now time.Time) (*OAuthDeviceAuthorization, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	data, has := h.devices[deviceCode]
+	if !has {
+		return nil, ErrDeviceCodeNotFound
+	}
+	res := *data
+	data.LastPoll = now
+	if data.Approved || data.Denied {
+		delete(h.userCodes, data.UserCode)
+		delete(h.devices, deviceCode)
+	}
+	return &res, nil
+}
+
+func (h *InMemoryOAuthDeviceHandler) ApprovedDevices(user uint64) ([]*OAuthDeviceAuthorization, error) {
+	now := CurrentTime()
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	var res []*OAuthDeviceAuthorization
+	for _, data := range h.devices {
+		if data.Approved && KeyValid(now, data.ValidUntil) && sameUser(data.User, user) {
+			dataCopy := *data
+			res = append(res, &dataCopy)
+		}
+	}
+	return res, nil
+}
+
+func (h *InMemoryOAuthDeviceHandler) DenyDevices(user uint64) (int64, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	var num int64
+	for _, data := range h.devices {
+		if data.Approved && sameUser(data.User, user) {
+			data.Approved, data.Denied = false, true
+			num++
+		}
+	}
+	return num, nil
+}
+
+// userCodeAlphabet contains no vowels (so no words can be formed) and no
+// characters that are easily confused.
+const userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+
+// genUserCode returns a new random user code of the form XXXX-XXXX.
+func genUserCode() (string, error) {
+	res := make([]byte, 0, 8)
+	buf := make([]byte, 16)
+	for len(res) < 8 {
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+		for _, c := range buf {
+			// 240 is a multiple of the alphabet size, skip larger values
+			// to avoid a bias
+			if c < 240 && len(res) < 8 {
+				res = append(res, userCodeAlphabet[int(c)%len(userCodeAlphabet)])
+			}
+		}
+	}
+	return string(res[:4]) + "-" + string(res[4:]), nil
+}
+
+// NormalizeUserCode transforms a user code as entered by the user to the
+// form XXXX-XXXX: It is converted to upper case and all characters that are
+// not in the alphabet (spaces, dashes) are removed.
+//
+// New in version v0.7
+func NormalizeUserCode(code string) string {
+	code = strings.ToUpper(code)
+	res := make([]byte, 0, 9)
+	for i := 0; i < len(code); i++ {
+		if strings.IndexByte(userCodeAlphabet, code[i]) >= 0 {
+			res = append(res, code[i])
+		}
+	}
+	if len(res) != 8 {
+		return string(res)
+	}
+	return string(res[:4]) + "-" + string(res[4:])
+}
+
+// OAuthDeviceAuthorizationResponse is the response of the device
+// authorization endpoint.
+//
+// New in version v0.7
+type OAuthDeviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete,omitempty"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int64  `json:"interval"`
+}
+
+// ServeDeviceAuthorization is the http.HandlerFunc for the device
+// authorization endpoint (for example /oauth/device). The client posts its
+// client_id (and scope) and gets a device code and a user code. The user
+// enters the user code on the page at s.VerificationURI (served by
+// ServeDeviceVerification) while the client polls the token endpoint.
+func (s *OAuthServer) ServeDeviceAuthorization(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeOAuthError(w, &OAuthError{Code: "invalid_request", Description: "POST required"})
+		return
+	}
+	client, oauthErr := s.authenticateClient(r)
+	if oauthErr != nil {
+		writeOAuthError(w, oauthErr)
+		return
+	}
+	if !client.AllowsScope(r.PostFormValue("scope")) {
+		writeOAuthError(w, &OAuthError{Code: "invalid_scope"})
+		return
+	}
+	deviceCode, err := GenRandomBase64(-1)
+	if err != nil {
+		writeOAuthError(w, &OAuthError{Code: "server_error"})
+		return
+	}
+	now := CurrentTime()
+	data := &OAuthDeviceAuthorization{ClientID: client.ID,
+		Scope: r.PostFormValue("scope"), ValidUntil: now.Add(s.DeviceCodeDuration)}
+	// user codes are short, so try again if there is a collision
+	for i := 0; i < 3; i++ {
+		data.UserCode, err = genUserCode()
+		if err != nil {
+			break
+		}
+		if err = s.Devices.StoreDevice(deviceCode, data); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		writeOAuthError(w, &OAuthError{Code: "server_error"})
+		return
+	}
+	resp := &OAuthDeviceAuthorizationResponse{DeviceCode: deviceCode,
+		UserCode: data.UserCode, VerificationURI: s.VerificationURI,
+		ExpiresIn: int64(s.DeviceCodeDuration / time.Second),
+		Interval:  int64(s.DeviceInterval / time.Second)}
+	if s.VerificationURI != "" {
+		sep := "?"
+		if strings.Contains(s.VerificationURI, "?") {
+			sep = "&"
+		}
+		resp.VerificationURIComplete = s.VerificationURI + sep + "user_code=" + data.UserCode
+	}
+	writeOAuthJSON(w, http.StatusOK, resp)
+}
+
+// OAuthDevicePageData is passed to the template of the verification page.
+//
+// New in version v0.7
+type OAuthDevicePageData struct {
+	UserCode string
+	// Client is set if UserCode is a valid code.
+	Client *OAuthClient
+	// Message is a message for the user, for example if the code is invalid
+	// or the request was approved.
+	Message string
+	// CSRFField is a hidden input field containing the CSRF token (see
+	// OAuthServer.DeviceCSRF), it must be part of the form.
+	//
+	// New in version v0.7
+	CSRFField template.HTML
+}
+
+// DefaultDeviceVerificationTemplate is a very simple verification page,
+// you probably want to use your own template with the same fields.
+// The form posts user_code, action ("approve" or "deny") and the CSRF
+// token.
+//
+// New in version v0.7
+var DefaultDeviceVerificationTemplate = template.Must(template.New("device").Parse(`<!DOCTYPE html>
+<html><head><title>Device login</title></head><body>
+{{if .Message}}<p>{{.Message}}</p>{{end}}
+<form method="post">{{.CSRFField}}
+{{if .Client}}<p>{{.Client.Name}} wants to access your account.</p>
+<input type="hidden" name="user_code" value="{{.UserCode}}">
+<button type="submit" name="action" value="approve">Approve</button>
+<button type="submit" name="action" value="deny">Deny</button>
+{{else}}<label>Code: <input type="text" name="user_code" value="{{.UserCode}}"></label>
+<button type="submit">Continue</button>{{end}}
+</form></body></html>`))
+
+// sameOrigin returns false if the Origin (or, if not set, the Referer)
+// header of the request names another host than the request. Requests
+// without both headers (from non-browser clients) are allowed.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Referer()
+	}
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// ServeDeviceVerification is the http.HandlerFunc for the verification page
+// the user visits to enter the user code. The user must be logged in,
+// otherwise s.Login is called.
+// The page is rendered with s.DeviceTemplate. Approving or denying requires
+// a valid CSRF token (see DeviceCSRF) and a request from the same origin,
+// user code lookups are limited by DeviceLimiter.
+func (s *OAuthServer) ServeDeviceVerification(w http.ResponseWriter, r *http.Request) {
+	data, session, err := s.Controller.ValidateSession(r, s.Store)
+	if err != nil || data == nil {
+		if session != nil {
+			session.Save(r, w)
+		}
+		if s.Login == nil {
+			http.Error(w, "Not logged in", http.StatusUnauthorized)
+			return
+		}
+		s.Login(w, r)
+		return
+	}
+	key, err := s.Controller.GetKey(session)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	// the CSRF token of CSRFSynchronizerToken mode is stored with the session
+	r = r.WithContext(NewSessionContext(r.Context(), key, data))
+	page := &OAuthDevicePageData{UserCode: NormalizeUserCode(r.FormValue("user_code"))}
+	if page.UserCode != "" && s.DeviceLimiter != nil {
+		allowed, retry, err := s.DeviceLimiter.Allow(fmt.Sprintf("device:%v", data.User))
+		if err != nil {
+			log.WithError(err).Error("goauth: Can't check user code rate limit")
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if !allowed {
+			SetRetryAfter(w, retry)
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+	}
+	if page.UserCode != "" {
+		device, err := s.Devices.GetByUserCode(page.UserCode)
+		switch {
+		case err == ErrDeviceCodeNotFound || (err == nil && KeyInvalid(CurrentTime(), device.ValidUntil)):
+			page.Message = "Invalid or expired code."
+		case err != nil:
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		case device.Approved || device.Denied:
+			page.Message = "This code was already used."
+		default:
+			page.Client, err = s.Clients.GetClient(device.ClientID)
+			if err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			if action := r.PostFormValue("action"); r.Method == http.MethodPost && action != "" {
+				if s.DeviceCSRF == nil {
+					log.Error("goauth: OAuthServer.DeviceCSRF is required to approve devices")
+					http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+					return
+				}
+				if !sameOrigin(r) {
+					http.Error(w, "Cross-origin request", http.StatusForbidden)
+					return
+				}
+				if err := s.DeviceCSRF.Verify(r); err != nil {
+					if err != ErrInvalidCSRFToken {
+						log.WithError(err).Error("goauth: Can't verify CSRF token")
+						http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+					} else {
+						http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+					}
+					return
+				}
+				approved := action == "approve"
+				err := s.Devices.Decide(page.UserCode, data.User, approved)
+				page.Client = nil
+				page.UserCode = ""
+				switch {
+				case err == ErrDeviceCodeNotFound:
+					page.Message = "Invalid or expired code."
+				case err == ErrDeviceCodeDecided:
+					page.Message = "This code was already used."
+				case err != nil:
+					http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+					return
+				case approved:
+					page.Message = "Device approved, you can return to your device."
+				default:
+					page.Message = "Access denied."
+				}
+			}
+		}
+	}
+	if s.DeviceCSRF != nil {
+		token, err := s.DeviceCSRF.Token(w, r)
+		if err != nil {
+			log.WithError(err).Error("goauth: Can't create CSRF token")
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		page.CSRFField = s.DeviceCSRF.field(token)
+	}
+	tmpl := s.DeviceTemplate
+	if tmpl == nil {
+		tmpl = DefaultDeviceVerificationTemplate
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	tmpl.Execute(w, page)
+}
+
+// deviceCodeGrant handles the polling of the client at the token endpoint.
+func (s *OAuthServer) deviceCodeGrant(r *http.Request, client *OAuthClient) (*OAuthTokenResponse, *OAuthError) {
+	now := CurrentTime()
+	device, err := s.Devices.Poll(r.PostFormValue("device_code"), now)
+	if err != nil {
+		if err == ErrDeviceCodeNotFound {
+			return nil, &OAuthError{Code: "invalid_grant"}
+		}
+		return nil, &OAuthError{Code: "server_error"}
+	}
+	if device.ClientID != client.ID {
+		return nil, &OAuthError{Code: "invalid_grant"}
+	}
+	if KeyInvalid(now, device.ValidUntil) {
+		return nil, &OAuthError{Code: "expired_token"}
+	}
+	switch {
+	case device.Denied:
+		return nil, &OAuthError{Code: "access_denied"}
+	case device.Approved:
+		return s.issueToken(client, device.User, device.Scope)
+	case !device.LastPoll.IsZero() && now.Sub(device.LastPoll) < s.DeviceInterval:
+		return nil, &OAuthError{Code: "slow_down"}
+	default:
+		return nil, &OAuthError{Code: "authorization_pending"}
+	}
+}
@@ -0,0 +1,394 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"database/sql"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// LoginSignal describes whether a login came from a known device and
+// network.
+//
+// New in version v0.7
+type LoginSignal struct {
+	// FirstLogin is true if there is no history for the user yet, in this
+	// case NewDevice and NewNetwork are true as well.
+	FirstLogin, NewDevice, NewNetwork bool
+
+	// Device is the device identifier (the hash of the User-Agent) and
+	// Network the network (in CIDR notation) of the login.
+	Device, Network string
+}
+
+// LoginHistoryHandler stores the devices and networks each user logged in
+// from.
+//
+// New in version v0.7
+type LoginHistoryHandler interface {
+	// Init initializes the storage, it must not fail if called several
+	// times.
+	Init() error
+
+	// RecordLogin records the device and network for the user and returns
+	// whether they were seen before.
+	RecordLogin(userID uint64, device, network string, now time.Time) (*LoginSignal, error)
+}
+
+// KnownDeviceHandler is implemented by LoginHistoryHandlers that can list
+// and forget the devices of a user, see TrustedDeviceCredentials.
+// InMemoryLoginHistory and SQLLoginHistory implement this interface.
+//
+// New in version v0.7
+type KnownDeviceHandler interface {
+	// KnownDevices maps the devices of the user to the time of the first
+	// login from the device.
+	KnownDevices(userID uint64) (map[string]time.Time, error)
+
+	// ForgetDevices removes all devices of the user, so the next login
+	// from each of them is a login from a new device. It returns the
+	// number of removed devices.
+	ForgetDevices(userID uint64) (int64, error)
+}
+
+// loginHistoryEntry maps devices and networks to the first login.
+type loginHistoryEntry struct {
+	devices, networks map[string]time.Time
+}
+
+// InMemoryLoginHistory is a LoginHistoryHandler that keeps everything in
+// memory.
+//
+// New in version v0.7
+type InMemoryLoginHistory struct {
+	users map[uint64]*loginHistoryEntry
+	mutex sync.Mutex
+}
+
+// NewInMemoryLoginHistory returns a new InMemoryLoginHistory.
+func NewInMemoryLoginHistory() *InMemoryLoginHistory {
+	return &InMemoryLoginHistory{users: make(map[uint64]*loginHistoryEntry)}
+}
+
+func (h *InMemoryLoginHistory) Init() error {
+	return nil
+}
+
+func (h *InMemoryLoginHistory) RecordLogin(userID uint64, device, network string, now time.Time) (*LoginSignal, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	res := &LoginSignal{Device: device, Network: network}
+	entry, has := h.users[userID]
+	if !has {
+		res.FirstLogin = true
+		entry = &loginHistoryEntry{devices: make(map[string]time.Time),
+			networks: make(map[string]time.Time)}
+		h.users[userID] = entry
+	}
+	if _, seen := entry.devices[device]; !seen {
+		res.NewDevice = true
+		entry.devices[device] = now
+	}
+	if _, seen := entry.networks[network]; !seen {
+		res.NewNetwork = true
+		entry.networks[network] = now
+	}
+	return res, nil
+}
+
+func (h *InMemoryLoginHistory) KnownDevices(userID uint64) (map[string]time.Time, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	res := make(map[string]time.Time)
+	if entry, has := h.users[userID]; has {
+		for device, first := range entry.devices {
+			res[device] = first
+		}
+	}
+	return res, nil
+}
+
+func (h *InMemoryLoginHistory) ForgetDevices(userID uint64) (int64, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	entry, has := h.users[userID]
+	if !has {
+		return 0, nil
+	}
+	num := int64(len(entry.devices))
+	entry.devices = make(map[string]time.Time)
+	return num, nil
+}
+
+// SQLLoginHistoryQueries stores the queries used by SQLLoginHistory, the
+// history is stored in the table login_history. kind is either "device" or
+// "network".
+// ListDevicesQuery selects value and first_seen of all devices of a user,
+// ForgetDevicesQuery deletes them (see KnownDeviceHandler).
+//
+// New in version v0.7
+type SQLLoginHistoryQueries struct {
+	InitQuery, CountQuery, ExistsQuery, InsertQuery, UpdateQuery string
+
+	ListDevicesQuery, ForgetDevicesQuery string
+
+	// TimeFromScanType is used to transform database time entries to
+	// gos time. See SQLSessionHandler for details.
+	TimeFromScanType func(val interface{}) (time.Time, error)
+}
+
+// MySQLLoginHistoryQueries provides queries to use with MySQL.
+func MySQLLoginHistoryQueries() *SQLLoginHistoryQueries {
+	initQ := `
+	CREATE TABLE IF NOT EXISTS login_history (
+		user_id BIGINT UNSIGNED NOT NULL,
+		kind VARCHAR(10) NOT NULL,
+		value VARCHAR(64) NOT NULL,
+		first_seen DATETIME NOT NULL,
+		last_seen DATETIME NOT NULL,
+		PRIMARY KEY(user_id, kind, value)
+	);
+	`
+	return &SQLLoginHistoryQueries{InitQuery: initQ,
+		CountQuery:         "SELECT COUNT(*) FROM login_history WHERE user_id=?",
+		ExistsQuery:        "SELECT COUNT(*) FROM login_history WHERE user_id=? AND kind=? AND value=?",
+		InsertQuery:        "INSERT INTO login_history (user_id, kind, value, first_seen, last_seen) VALUES(?, ?, ?, ?, ?)",
+		UpdateQuery:        "UPDATE login_history SET last_seen=? WHERE user_id=? AND kind=? AND value=?",
+		ListDevicesQuery:   "SELECT value, first_seen FROM login_history WHERE user_id=? AND kind='device'",
+		ForgetDevicesQuery: "DELETE FROM login_history WHERE user_id=? AND kind='device'",
+		TimeFromScanType:   DefaultTimeFromScanType}
+}
+
+// PostgresLoginHistoryQueries provides queries to use with postgres.
+func PostgresLoginHistoryQueries() *SQLLoginHistoryQueries {
+	initQ := `
+	CREATE TABLE IF NOT EXISTS login_history (
+		user_id bigint NOT NULL,
+		kind varchar(10) NOT NULL,
+		value varchar(64) NOT NULL,
+		first_seen timestamp NOT NULL,
+		last_seen timestamp NOT NULL,
+		PRIMARY KEY(user_id, kind, value)
+	);
+	`
+	return &SQLLoginHistoryQueries{InitQuery: initQ,
+		CountQuery:         "SELECT COUNT(*) FROM login_history WHERE user_id = $1",
+		ExistsQuery:        "SELECT COUNT(*) FROM login_history WHERE user_id = $1 AND kind = $2 AND value = $3",
+		InsertQuery:        "INSERT INTO login_history (user_id, kind, value, first_seen, last_seen) VALUES ($1, $2, $3, $4, $5)",
+		UpdateQuery:        "UPDATE login_history SET last_seen = $1 WHERE user_id = $2 AND kind = $3 AND value = $4",
+		ListDevicesQuery:   "SELECT value, first_seen FROM login_history WHERE user_id = $1 AND kind = 'device'",
+		ForgetDevicesQuery: "DELETE FROM login_history WHERE user_id = $1 AND kind = 'device'",
+		TimeFromScanType:   DefaultTimeFromScanType}
+}
+
+// SQLite3LoginHistoryQueries provides queries to use with sqlite3.
+func SQLite3LoginHistoryQueries() *SQLLoginHistoryQueries {
+	// the MySQL queries work fine
+	return MySQLLoginHistoryQueries()
+}
+
+// SQLLoginHistory implements LoginHistoryHandler by executing the queries
+// defined in an instance of SQLLoginHistoryQueries.
+//
+// New in version v0.7
+type SQLLoginHistory struct {
+	*SQLLoginHistoryQueries
+
+	// DB is the database to execute the queries on.
+	DB *sql.DB
+
+	blockDB bool
+	mutex   sync.Mutex
+}
+
+// NewSQLLoginHistory returns a new SQLLoginHistory, blockDB has the same
+// meaning as in NewSQLUserHandler.
+func NewSQLLoginHistory(queries *SQLLoginHistoryQueries, db *sql.DB, blockDB bool) *SQLLoginHistory {
+	return &SQLLoginHistory{SQLLoginHistoryQueries: queries, DB: db, blockDB: blockDB}
+}
+
+// NewMySQLLoginHistory returns a new SQLLoginHistory that uses MySQL.
+func NewMySQLLoginHistory(db *sql.DB) *SQLLoginHistory {
+	return NewSQLLoginHistory(MySQLLoginHistoryQueries(), db, false)
+}
+
+// NewPostgresLoginHistory returns a new SQLLoginHistory that uses postgres.
+func NewPostgresLoginHistory(db *sql.DB) *SQLLoginHistory {
+	return NewSQLLoginHistory(PostgresLoginHistoryQueries(), db, false)
+}
+
+// NewSQLite3LoginHistory returns a new SQLLoginHistory that uses sqlite3.
+func NewSQLite3LoginHistory(db *sql.DB) *SQLLoginHistory {
+	return NewSQLLoginHistory(SQLite3LoginHistoryQueries(), db, true)
+}
+
+func (h *SQLLoginHistory) Init() error {
+	if h.blockDB {
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+	}
+	_, err := h.DB.Exec(h.InitQuery)
+	return err
+}
+
+// record inserts or updates an entry and returns true if it's new.
+func (h *SQLLoginHistory) record(tx *sql.Tx, userID uint64, kind, value string, now time.Time) (bool, error) {
+	var count int
+	if err := tx.QueryRow(h.ExistsQuery, userID, kind, value).Scan(&count); err != nil {
+		return false, err
+	}
+	if count > 0 {
+		_, err := tx.Exec(h.UpdateQuery, now, userID, kind, value)
+		return false, err
+	}
+	_, err := tx.Exec(h.InsertQuery, userID, kind, value, now, now)
+	return true, err
+}
+
+func (h *SQLLoginHistory) RecordLogin(userID uint64, device, network string, now time.Time) (*LoginSignal, error) {
+	if h.blockDB {
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+	}
+	tx, err := h.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	res := &LoginSignal{Device: device, Network: network}
+	var count int
+	if err := tx.QueryRow(h.CountQuery, userID).Scan(&count); err != nil {
+		return nil, err
+	}
+	res.FirstLogin = count == 0
+	if res.NewDevice, err = h.record(tx, userID, "device", device, now); err != nil {
+		return nil, err
+	}
+	if res.NewNetwork, err = h.record(tx, userID, "network", network, now); err != nil {
+		return nil, err
+	}
+	return res, tx.Commit()
+}
+
+func (h *SQLLoginHistory) KnownDevices(userID uint64) (map[string]time.Time, error) {
+	if h.blockDB {
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+	}
+	rows, err := h.DB.Query(h.ListDevicesQuery, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make(map[string]time.Time)
+	for rows.Next() {
+		var device string
+		var firstVal interface{}
+		if err := rows.Scan(&device, &firstVal); err != nil {
+			return nil, err
+		}
+		first, err := h.TimeFromScanType(firstVal)
+		if err != nil {
+			return nil, err
+		}
+		res[device] = first
+	}
+	return res, rows.Err()
+}
+
+func (h *SQLLoginHistory) ForgetDevices(userID uint64) (int64, error) {
+	if h.blockDB {
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+	}
+	res, err := h.DB.Exec(h.ForgetDevicesQuery, userID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// NewDeviceDetector detects logins from new devices and networks, call Check
+// after a successful login (AuthHandlers does that if you set its Devices
+// field).
+// A device is identified by the hash of the User-Agent, a network is the
+// IPv4 /24 or IPv6 /48 network of the client.
+//
+// New in version v0.7
+type NewDeviceDetector struct {
+	History LoginHistoryHandler
+
+	// IPv4Prefix and IPv6Prefix define the networks, default to 24 and 48.
+	IPv4Prefix, IPv6Prefix int
+
+	// Notifier gets an EventNewDeviceLogin event for each login from a new
+	// device (except the first login of a user), may be nil.
+	Notifier SecurityNotifier
+}
+
+// NewNewDeviceDetector returns a new NewDeviceDetector.
+func NewNewDeviceDetector(history LoginHistoryHandler, notifier SecurityNotifier) *NewDeviceDetector {
+	return &NewDeviceDetector{History: history, IPv4Prefix: 24, IPv6Prefix: 48,
+		Notifier: notifier}
+}
+
+// network returns the network of the IP address in CIDR notation.
+func (d *NewDeviceDetector) network(ipString string) string {
+	ip := net.ParseIP(ipString)
+	if ip == nil {
+		return ipString
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		n := net.IPNet{IP: ip4.Mask(net.CIDRMask(d.IPv4Prefix, 32)), Mask: net.CIDRMask(d.IPv4Prefix, 32)}
+		return n.String()
+	}
+	n := net.IPNet{IP: ip.Mask(net.CIDRMask(d.IPv6Prefix, 128)), Mask: net.CIDRMask(d.IPv6Prefix, 128)}
+	return n.String()
+}
+
+// Check records the login and returns whether it came from a new device or
+// network.
+func (d *NewDeviceDetector) Check(r *http.Request, userID uint64, userName string) (*LoginSignal, error) {
+	fp := NewClientFingerprint(r)
+	signal, err := d.History.RecordLogin(userID, fp.UserAgentHash, d.network(fp.IP), CurrentTime())
+	if err != nil {
+		return nil, err
+	}
+	if d.Notifier != nil && !signal.FirstLogin && (signal.NewDevice || signal.NewNetwork) {
+		event := NewSecurityEvent(EventNewDeviceLogin, userID, userName)
+		event.IP = fp.IP
+		event.Data = map[string]string{"network": signal.Network,
+			"user_agent": r.UserAgent()}
+		if signal.NewDevice {
+			event.Data["new_device"] = "true"
+		}
+		if signal.NewNetwork {
+			event.Data["new_network"] = "true"
+		}
+		d.Notifier.Notify(event)
+	}
+	return signal, nil
+}
@@ -46,6 +46,13 @@
 // user information. It also provides implementations for these interface
 // for MySQL, postgres and sqlite databases.
 //
+// Upgrading from v0.6: Version v0.7 adds columns to the users table of the
+// default SQL schema (is_admin, email_verified, is_pending, display_name,
+// avatar_url, locale and timezone). Init only creates missing tables, so run
+// SQLMigrator.Migrate (see NewMySQLMigrator, NewPostgresMigrator and
+// NewSQLite3Migrator) before Init to add the columns to an existing
+// database.
+//
 // See the github page for more details: https://github.com/FabianWe/goauth
 // and the wiki for some more explanation and small examples:
 // https://github.com/FabianWe/goauth/wiki
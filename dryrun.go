@@ -0,0 +1,157 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package goauth
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// namedQuery is a query with the name of the field it's stored in.
+type namedQuery struct {
+	name, query string
+}
+
+// writeQueries writes all non-empty queries to w, each query is preceded by
+// a comment with its name and terminated by a semicolon.
+func writeQueries(w io.Writer, section string, queries []namedQuery) error {
+	if _, err := fmt.Fprintf(w, "-- %s\n\n", section); err != nil {
+		return err
+	}
+	for _, q := range queries {
+		query := strings.TrimSpace(q.query)
+		if query == "" {
+			continue
+		}
+		if !strings.HasSuffix(query, ";") {
+			query += ";"
+		}
+		if _, err := fmt.Fprintf(w, "-- %s\n%s\n\n", q.name, query); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pragmaQueries returns the pragmas as named queries.
+func pragmaQueries(pragmas []string) []namedQuery {
+	res := make([]namedQuery, len(pragmas))
+	for i, pragma := range pragmas {
+		res[i] = namedQuery{"Pragmas", "PRAGMA " + pragma}
+	}
+	return res
+}
+
+// WriteSQL writes all statements the handler executes to w without touching
+// the database: First the DDL executed by Init, then all other queries. The
+// table name, user id type and key size are already substituted, the
+// remaining placeholders are bound to the arguments of each operation.
+// The bulk queries (DeleteKeysQ etc.) contain a %s that is replaced by the
+// list of placeholders. This is useful to review the statements and apply
+// them through your own change process (and not call Init).
+//
+// New in version v0.7
+func (c *SQLSessionHandler) WriteSQL(w io.Writer) error {
+	ddl := append(pragmaQueries(c.Pragmas), namedQuery{"InitQ", c.InitQ})
+	if err := writeQueries(w, fmt.Sprintf("DDL for table %s", c.TableName), ddl); err != nil {
+		return err
+	}
+	return writeQueries(w, fmt.Sprintf("DML for table %s", c.TableName), []namedQuery{
+		{"GetQ", c.GetQ}, {"CreateQ", c.CreateQ},
+		{"DeleteForUserQ", c.DeleteForUserQ}, {"DeleteInvalidQ", c.DeleteInvalidQ},
+		{"DeleteKeyQ", c.DeleteKeyQ}, {"ListForUserQ", c.ListForUserQ},
+		{"ActiveUsersQ", c.ActiveUsersQ}, {"CreatedBetweenQ", c.CreatedBetweenQ},
+		{"GetForTenantQ", c.GetForTenantQ}, {"CreateForTenantQ", c.CreateForTenantQ},
+		{"DeleteKeysQ", c.DeleteKeysQ}, {"DeleteForUsersQ", c.DeleteForUsersQ},
+		{"GetKeysQ", c.GetKeysQ},
+	})
+}
+
+// WriteSQL writes all statements the handler executes to w without touching
+// the database: First the DDL executed by Init, then all other queries.
+// See SQLSessionHandler.WriteSQL.
+//
+// New in version v0.7
+func (handler *SQLUserHandler) WriteSQL(w io.Writer) error {
+	ddl := append(pragmaQueries(handler.Pragmas), namedQuery{"InitQuery", handler.InitQuery})
+	if err := writeQueries(w, "DDL for table users", ddl); err != nil {
+		return err
+	}
+	return writeQueries(w, "DML for table users", []namedQuery{
+		{"InsertQuery", handler.InsertQuery}, {"ValidateQuery", handler.ValidateQuery},
+		{"UpdatePasswordQuery", handler.UpdatePasswordQuery},
+		{"ListUsersQuery", handler.ListUsersQuery}, {"GetUsernameQ", handler.GetUsernameQ},
+		{"DeleteUserQ", handler.DeleteUserQ}, {"GetUserInfoQuery", handler.GetUserInfoQuery},
+		{"GetIDQuery", handler.GetIDQuery}, {"ListPIIQuery", handler.ListPIIQuery},
+		{"UpdatePIIQuery", handler.UpdatePIIQuery}, {"SetAdminQuery", handler.SetAdminQuery},
+		{"SetEmailVerifiedQuery", handler.SetEmailVerifiedQuery},
+		{"SetEmailQuery", handler.SetEmailQuery}, {"SetActiveQuery", handler.SetActiveQuery},
+		{"RenameUserQuery", handler.RenameUserQuery},
+		{"InsertPendingQuery", handler.InsertPendingQuery},
+		{"CompleteRegistrationQuery", handler.CompleteRegistrationQuery},
+		{"PendingQuery", handler.PendingQuery},
+		{"SetDisplayNameQuery", handler.SetDisplayNameQuery},
+		{"SetAvatarURLQuery", handler.SetAvatarURLQuery},
+		{"SetLocaleQuery", handler.SetLocaleQuery},
+		{"SetTimezoneQuery", handler.SetTimezoneQuery},
+		{"TenantInsertQuery", handler.TenantInsertQuery},
+		{"TenantValidateQuery", handler.TenantValidateQuery},
+		{"TenantGetIDQuery", handler.TenantGetIDQuery},
+		{"TenantGetUserInfoQuery", handler.TenantGetUserInfoQuery},
+		{"TenantPendingQuery", handler.TenantPendingQuery},
+	})
+}
+
+// WriteSQL writes the statements of all migrations with a version greater
+// than fromVersion to w without touching the database. The statements of a
+// migration are followed by InsertQ that records the migration, its
+// arguments are given in a comment. Migrations with an Applied check are
+// marked because the check can't be evaluated without the database.
+//
+// New in version v0.7
+func (m *SQLMigrator) WriteSQL(w io.Writer, fromVersion int) error {
+	if err := writeQueries(w, "DDL for table goauth_schema_migrations",
+		[]namedQuery{{"InitQ", m.InitQ}}); err != nil {
+		return err
+	}
+	for _, migration := range m.Migrations {
+		if migration.Version <= fromVersion {
+			continue
+		}
+		queries := make([]namedQuery, 0, len(migration.Statements)+1)
+		for _, stmt := range migration.Statements {
+			queries = append(queries, namedQuery{"statement", stmt})
+		}
+		queries = append(queries, namedQuery{
+			fmt.Sprintf("InsertQ with arguments (%d, %q, now)", migration.Version, migration.Description),
+			m.InsertQ})
+		section := fmt.Sprintf("migration %d: %s", migration.Version, migration.Description)
+		if migration.Applied != nil {
+			section += " (skip if already applied)"
+		}
+		if err := writeQueries(w, section, queries); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package goauth
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// PublicUserInformation is the part of BaseUserInformation that can be
+// shown to other users, it omits the email address, the last login and the
+// flags.
+//
+// New in version v0.7
+type PublicUserInformation struct {
+	ID          uint64 `json:"id"`
+	UserName    string `json:"username"`
+	FirstName   string `json:"first_name"`
+	LastName    string `json:"last_name"`
+	DisplayName string `json:"display_name,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+}
+
+// Public returns the information that can be shown to other users.
+//
+// New in version v0.7
+func (info *BaseUserInformation) Public() *PublicUserInformation {
+	return &PublicUserInformation{ID: info.ID, UserName: info.UserName,
+		FirstName: info.FirstName, LastName: info.LastName,
+		DisplayName: info.DisplayName, AvatarURL: info.AvatarURL}
+}
+
+// redactedValue replaces non-empty personal information in String.
+const redactedValue = "[redacted]"
+
+// redact returns redactedValue for non-empty values.
+func redact(value string) string {
+	if value == "" {
+		return ""
+	}
+	return redactedValue
+}
+
+// RedactEmail keeps the first character of the local part and the domain of
+// an email address, for example "j***@example.com".
+//
+// New in version v0.7
+func RedactEmail(email string) string {
+	at := strings.LastIndexByte(email, '@')
+	if at <= 0 {
+		return redact(email)
+	}
+	return email[:1] + "***" + email[at:]
+}
+
+// String returns the information with the names, the email address and the
+// avatar url redacted, so it's safe to write it to logs.
+//
+// New in version v0.7
+func (info *BaseUserInformation) String() string {
+	return fmt.Sprintf("User{ID: %d, UserName: %q, FirstName: %q, LastName: %q, Email: %q, LastLogin: %s, IsActive: %t, IsAdmin: %t, EmailVerified: %t, IsPending: %t, DisplayName: %q, AvatarURL: %q, Locale: %q, Timezone: %q}",
+		info.ID, info.UserName, redact(info.FirstName), redact(info.LastName),
+		RedactEmail(info.Email), info.LastLogin.Format(time.RFC3339), info.IsActive,
+		info.IsAdmin, info.EmailVerified, info.IsPending, redact(info.DisplayName),
+		redact(info.AvatarURL), info.Locale, info.Timezone)
+}
+
+// GoString is the same as String, so %#v is redacted too.
+//
+// New in version v0.7
+func (info *BaseUserInformation) GoString() string {
+	return info.String()
+}
+
+// SessionInfo is the representation of a session for APIs: It contains the
+// public id of the session (see SessionID) instead of the secret key.
+//
+// New in version v0.7
+type SessionInfo struct {
+	ID         string      `json:"id"`
+	User       UserKeyType `json:"user"`
+	Created    time.Time   `json:"created"`
+	ValidUntil time.Time   `json:"valid_until"`
+	// Device is only set if the session has a device, see
+	// ListSessionsWithDevices.
+	Device *SessionDevice `json:"device,omitempty"`
+}
+
+// Info returns the SessionInfo for the session with the given key.
+//
+// New in version v0.7
+func (data *SessionKeyData) Info(key string) *SessionInfo {
+	return &SessionInfo{ID: SessionID(key), User: data.User,
+		Created: data.CreationTime, ValidUntil: data.ValidUntil, Device: data.Device}
+}
+
+// String returns the user and the times of the session.
+//
+// New in version v0.7
+func (data *SessionKeyData) String() string {
+	return fmt.Sprintf("Session{User: %v, Created: %s, ValidUntil: %s}", data.User,
+		data.CreationTime.Format(time.RFC3339), data.ValidUntil.Format(time.RFC3339))
+}
@@ -0,0 +1,323 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// Purposes of the email change tokens in a OneTimeTokenStore.
+const (
+	EmailChangePurpose     = "email_change"
+	EmailChangeUndoPurpose = "email_change_undo"
+)
+
+// ErrEmailUnchanged is returned if the new email address is the current
+// address of the user.
+var ErrEmailUnchanged = errors.New("New email address is the current address.")
+
+// pendingEmailField is used as additional data when encrypting pending
+// addresses.
+const pendingEmailField = "pending_email"
+
+// EmailChangeManager changes email addresses with confirmation, so an
+// attacker with a session can't silently take over an account by changing
+// its address (and then resetting the password):
+//
+// RequestEmailChange stores the new address as pending and sends a token to
+// it, the address only changes when ConfirmEmailChange redeems that token.
+// The old address then gets a notification with an undo token,
+// UndoEmailChange restores the old address and ends all sessions of the
+// user.
+//
+// The users must implement EmailVerifiedHandler.
+//
+// New in version v0.7
+type EmailChangeManager struct {
+	Users      UserHandler
+	Controller *SessionController
+	Tokens     OneTimeTokenStore
+
+	// TTL is the time a confirmation token is valid, defaults to 24 hours.
+	TTL time.Duration
+
+	// UndoTTL is the time an undo token is valid, defaults to 7 days.
+	UndoTTL time.Duration
+
+	// Encryptor encrypts the pending and old addresses stored with the
+	// tokens, may be nil.
+	Encryptor *FieldEncryptor
+
+	// Notifier is informed about changed and restored addresses, may be
+	// nil.
+	Notifier SecurityNotifier
+
+	// DeliverConfirmation sends the confirmation token to the new address.
+	DeliverConfirmation func(info *BaseUserInformation, newEmail, token string) error
+
+	// DeliverUndo informs the old address (info.Email) about the change and
+	// sends the undo token.
+	DeliverUndo func(info *BaseUserInformation, newEmail, token string) error
+
+	// Render and RenderError write the responses of the handlers, they
+	// default to RenderJSON and RenderJSONError.
+	Render      func(w http.ResponseWriter, r *http.Request, status int, value interface{})
+	RenderError func(w http.ResponseWriter, r *http.Request, status int, err error)
+}
+
+// NewEmailChangeManager returns a new EmailChangeManager that renders JSON.
+func NewEmailChangeManager(users UserHandler, controller *SessionController, tokens OneTimeTokenStore) *EmailChangeManager {
+	return &EmailChangeManager{Users: users, Controller: controller,
+		Tokens: tokens, TTL: 24 * time.Hour, UndoTTL: 7 * 24 * time.Hour,
+		Render: RenderJSON, RenderError: RenderJSONError}
+}
+
+func (m *EmailChangeManager) emailHandler() (EmailVerifiedHandler, error) {
+	flags, ok := m.Users.(EmailVerifiedHandler)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return flags, nil
+}
+
+func (m *EmailChangeManager) issue(purpose string, id uint64, email string, ttl time.Duration) (string, error) {
+	data := email
+	if m.Encryptor != nil {
+		var err error
+		if data, err = m.Encryptor.Encrypt(pendingEmailField, email); err != nil {
+			return "", err
+		}
+	}
+	return IssueOneTimeToken(m.Tokens, purpose, userSubject(id), data, ttl)
+}
+
+// redeem consumes the token and returns the user and the stored address.
+func (m *EmailChangeManager) redeem(purpose, token string) (*BaseUserInformation, string, error) {
+	entry, err := ConsumeOneTimeToken(m.Tokens, purpose, token)
+	if err != nil {
+		return nil, "", err
+	}
+	email := entry.Data
+	if m.Encryptor != nil {
+		if email, err = m.Encryptor.Decrypt(pendingEmailField, email); err != nil {
+			return nil, "", err
+		}
+	}
+	id, err := subjectUserID(entry.Subject)
+	if err != nil {
+		return nil, "", ErrTokenNotFound
+	}
+	userName, err := m.Users.GetUserName(id)
+	if err != nil {
+		return nil, "", err
+	}
+	info, err := m.Users.GetUserBaseInfo(userName)
+	if err != nil {
+		return nil, "", err
+	}
+	info.UserName = userName
+	return info, email, nil
+}
+
+// RequestEmailChange stores newEmail as the pending address of the user and
+// passes a confirmation token to DeliverConfirmation. An older pending
+// change is discarded.
+func (m *EmailChangeManager) RequestEmailChange(userName, newEmail string) error {
+	if _, err := m.emailHandler(); err != nil {
+		return err
+	}
+	info, err := m.Users.GetUserBaseInfo(userName)
+	if err != nil {
+		return err
+	}
+	if info.Email == newEmail {
+		return ErrEmailUnchanged
+	}
+	info.UserName = userName
+	if _, err := m.Tokens.DeleteTokens(EmailChangePurpose, userSubject(info.ID)); err != nil {
+		return err
+	}
+	token, err := m.issue(EmailChangePurpose, info.ID, newEmail, m.TTL)
+	if err != nil {
+		return err
+	}
+	if m.DeliverConfirmation == nil {
+		return errors.New("No delivery function for email change tokens set.")
+	}
+	return m.DeliverConfirmation(info, newEmail, token)
+}
+
+// ConfirmEmailChange redeems the confirmation token: the pending address
+// becomes the (verified) address of the user and the old address gets an
+// undo token by DeliverUndo. It returns the user with the old address.
+// Returns ErrTokenNotFound if the token is invalid or was already used.
+func (m *EmailChangeManager) ConfirmEmailChange(token string) (*BaseUserInformation, error) {
+	flags, err := m.emailHandler()
+	if err != nil {
+		return nil, err
+	}
+	info, newEmail, err := m.redeem(EmailChangePurpose, token)
+	if err != nil {
+		return nil, err
+	}
+	// create the undo token first, the change must not happen without it
+	var undo string
+	if info.Email != "" {
+		if undo, err = m.issue(EmailChangeUndoPurpose, info.ID, info.Email, m.UndoTTL); err != nil {
+			return nil, err
+		}
+	}
+	if err := flags.SetEmail(info.UserName, newEmail, true); err != nil {
+		return nil, err
+	}
+	if m.Notifier != nil {
+		m.Notifier.Notify(NewSecurityEvent(EventEmailChanged, info.ID, info.UserName))
+	}
+	if undo != "" {
+		if m.DeliverUndo == nil {
+			return info, errors.New("No delivery function for email change undo tokens set.")
+		}
+		if err := m.DeliverUndo(info, newEmail, undo); err != nil {
+			return info, err
+		}
+	}
+	return info, nil
+}
+
+// UndoEmailChange redeems an undo token: the old address is restored,
+// pending changes are discarded and all sessions of the user are deleted.
+// It returns the user (with the address before the undo) and the number of
+// deleted sessions. The user should reset the password afterwards.
+func (m *EmailChangeManager) UndoEmailChange(token string) (*BaseUserInformation, int64, error) {
+	flags, err := m.emailHandler()
+	if err != nil {
+		return nil, -1, err
+	}
+	info, oldEmail, err := m.redeem(EmailChangeUndoPurpose, token)
+	if err != nil {
+		return nil, -1, err
+	}
+	// the undo token was delivered to the old address, so it's verified
+	if err := flags.SetEmail(info.UserName, oldEmail, true); err != nil {
+		return nil, -1, err
+	}
+	if _, err := m.Tokens.DeleteTokens(EmailChangePurpose, userSubject(info.ID)); err != nil {
+		return nil, -1, err
+	}
+	if m.Notifier != nil {
+		m.Notifier.Notify(NewSecurityEvent(EventEmailRestored, info.ID, info.UserName))
+	}
+	num, err := m.Controller.DeleteEntriesForUser(info.ID)
+	if err != nil {
+		return nil, -1, err
+	}
+	return info, num, nil
+}
+
+// ServeRequestEmailChange starts the change for the user of the session
+// (see SessionMiddleware), the new address is the field "email" of the
+// request.
+func (m *EmailChangeManager) ServeRequestEmailChange(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r, m.RenderError) {
+		return
+	}
+	id, ok := UserIDFromContext(r.Context())
+	if !ok {
+		m.RenderError(w, r, http.StatusUnauthorized, ErrInvalidCredentials)
+		return
+	}
+	req, err := ParseAuthRequest(r)
+	if err != nil {
+		m.RenderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if req.Email == "" {
+		m.RenderError(w, r, http.StatusBadRequest, errors.New("Email is required."))
+		return
+	}
+	userName, err := m.Users.GetUserName(id)
+	if err == nil {
+		err = m.RequestEmailChange(userName, req.Email)
+	}
+	switch {
+	case err == ErrEmailUnchanged:
+		m.RenderError(w, r, http.StatusBadRequest, err)
+	case err == ErrNotSupported:
+		m.RenderError(w, r, http.StatusNotImplemented, err)
+	case err != nil:
+		m.RenderError(w, r, http.StatusInternalServerError, err)
+	default:
+		m.Render(w, r, http.StatusAccepted, &AuthResponse{Status: "accepted",
+			UserID: id, UserName: userName})
+	}
+}
+
+// ServeConfirmEmailChange redeems a confirmation token, see
+// EmailVerifier.ServeConfirmEmail for how the token is passed.
+func (m *EmailChangeManager) ServeConfirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	token, ok := requestToken(w, r, m.RenderError)
+	if !ok {
+		return
+	}
+	info, err := m.ConfirmEmailChange(token)
+	if info == nil {
+		m.tokenError(w, r, err)
+		return
+	}
+	if err != nil {
+		// the address was changed, only the notification failed
+		m.RenderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	m.Render(w, r, http.StatusOK, &AuthResponse{Status: "ok", UserID: info.ID,
+		UserName: info.UserName})
+}
+
+// ServeUndoEmailChange redeems an undo token, see
+// EmailVerifier.ServeConfirmEmail for how the token is passed.
+func (m *EmailChangeManager) ServeUndoEmailChange(w http.ResponseWriter, r *http.Request) {
+	token, ok := requestToken(w, r, m.RenderError)
+	if !ok {
+		return
+	}
+	info, num, err := m.UndoEmailChange(token)
+	if err != nil {
+		m.tokenError(w, r, err)
+		return
+	}
+	m.Render(w, r, http.StatusOK, &AuthResponse{Status: "ok", UserID: info.ID,
+		UserName: info.UserName, Deleted: num})
+}
+
+func (m *EmailChangeManager) tokenError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case ErrTokenNotFound, ErrUserNotFound:
+		m.RenderError(w, r, http.StatusBadRequest, ErrTokenNotFound)
+	case ErrNotSupported:
+		m.RenderError(w, r, http.StatusNotImplemented, err)
+	default:
+		m.RenderError(w, r, http.StatusInternalServerError, err)
+	}
+}
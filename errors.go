@@ -0,0 +1,184 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+)
+
+// This file defines the errors that are shared by all backends. The
+// handlers return the sentinel errors directly (so comparing with == works)
+// or wrap errors of the underlying driver in a *BackendError, use errors.Is
+// to check for a certain kind of error and errors.As to get the driver
+// error.
+
+// ErrDuplicateUsername is returned when inserting a user with a username
+// that is already in use.
+var ErrDuplicateUsername = errors.New("The username is already in use.")
+
+// ErrDuplicateEmail is returned when inserting a user with an email address
+// that is already in use (if your scheme requires unique addresses).
+var ErrDuplicateEmail = errors.New("The email address is already in use.")
+
+// ErrDuplicateEntry is returned for other violations of unique constraints.
+var ErrDuplicateEntry = errors.New("The entry already exists.")
+
+// ErrSessionExpired is the same error as ErrInvalidKey, the session exists
+// but is not valid any more.
+var ErrSessionExpired = ErrInvalidKey
+
+// ErrBackendUnavailable is returned (wrapped in a *BackendError) if the
+// storage backend can't be reached, for example if the database connection
+// failed.
+var ErrBackendUnavailable = errors.New("The storage backend is unavailable.")
+
+// ErrNotSupported is returned by handlers that don't support an operation,
+// for example the LDAP UserHandler of the ldapauth adapter can't create users
+// in the directory.
+//
+// New in version v0.7
+var ErrNotSupported = errors.New("Operation not supported by this handler.")
+
+// BackendError wraps an error of a storage backend (a database driver, the
+// redis client, ...) with some context.
+//
+// New in version v0.7
+type BackendError struct {
+	// Backend is the name of the backend, for example "sql" or "redis".
+	Backend string
+
+	// Op is the operation that failed, for example "Insert".
+	Op string
+
+	// Kind is one of the sentinel errors of this package that describes the
+	// error (for example ErrDuplicateUsername), nil if it's not known.
+	Kind error
+
+	// Err is the original error.
+	Err error
+}
+
+func (e *BackendError) Error() string {
+	if e.Kind != nil {
+		return fmt.Sprintf("goauth(%s): %s: %v (%v)", e.Backend, e.Op, e.Kind, e.Err)
+	}
+	return fmt.Sprintf("goauth(%s): %s: %v", e.Backend, e.Op, e.Err)
+}
+
+// Unwrap returns the original error.
+func (e *BackendError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is the Kind of the error.
+func (e *BackendError) Is(target error) bool {
+	return e.Kind != nil && target == e.Kind
+}
+
+// IsDuplicateKeyError returns true if err is a violation of a unique
+// constraint reported by a database driver: MySQL error 1062, Postgres
+// SQLSTATE 23505 (lib/pq and pgx) or a sqlite3 UNIQUE / PRIMARY KEY
+// constraint error.
+// The drivers are not imported, the errors are detected by their fields and
+// messages.
+func IsDuplicateKeyError(err error) bool {
+	for ; err != nil; err = errors.Unwrap(err) {
+		v := reflect.ValueOf(err)
+		if v.Kind() == reflect.Ptr {
+			v = v.Elem()
+		}
+		if v.Kind() == reflect.Struct {
+			// github.com/go-sql-driver/mysql.MySQLError
+			if f := v.FieldByName("Number"); f.IsValid() && f.CanUint() && f.Uint() == 1062 {
+				return true
+			}
+			// github.com/lib/pq.Error and github.com/jackc/pgx PgError
+			if f := v.FieldByName("Code"); f.IsValid() && f.Kind() == reflect.String && f.String() == "23505" {
+				return true
+			}
+		}
+		msg := err.Error()
+		if strings.Contains(msg, "UNIQUE constraint failed") || strings.Contains(msg, "PRIMARY KEY constraint failed") {
+			return true
+		}
+	}
+	return false
+}
+
+// isUnavailableError returns true if err means that the backend can't be
+// reached.
+func isUnavailableError(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) ||
+		errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return strings.Contains(err.Error(), "connection refused")
+}
+
+// wrapBackendError wraps err in a *BackendError, it returns nil if err is nil
+// and err itself if it's already a *BackendError.
+func wrapBackendError(backend, op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var backendErr *BackendError
+	if errors.As(err, &backendErr) {
+		return err
+	}
+	res := &BackendError{Backend: backend, Op: op, Err: err}
+	switch {
+	case IsDuplicateKeyError(err):
+		res.Kind = ErrDuplicateEntry
+	case isUnavailableError(err):
+		res.Kind = ErrBackendUnavailable
+	}
+	return res
+}
+
+// wrapInsertUserError is wrapBackendError for inserting users: unique
+// violations are reported as ErrDuplicateEmail if the message mentions the
+// email column and as ErrDuplicateUsername otherwise.
+func wrapInsertUserError(backend string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if IsDuplicateKeyError(err) {
+		kind := ErrDuplicateUsername
+		if strings.Contains(strings.ToLower(err.Error()), "email") {
+			kind = ErrDuplicateEmail
+		}
+		return &BackendError{Backend: backend, Op: "Insert", Kind: kind, Err: err}
+	}
+	return wrapBackendError(backend, "Insert", err)
+}
@@ -0,0 +1,122 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"sync"
+)
+
+// EventHandler handles a security event, it must not block or modify the
+// event (it is shared by all subscribers).
+//
+// New in version v0.7
+type EventHandler func(event *SecurityEvent)
+
+type eventSubscription struct {
+	id      uint64
+	types   map[string]bool
+	handler EventHandler
+}
+
+// EventBus is an in-process publish / subscribe hub for security events.
+// It's a SecurityNotifier, so it can be set as the Notifier of all flows
+// (AuthHandlers, AdminAPI, PasswordResetManager...) and other subsystems
+// (audit logs, webhooks, metrics) subscribe to the events they're
+// interested in instead of hooking each flow separately.
+//
+// Usage:
+//
+//	bus := goauth.NewEventBus()
+//	authHandlers.Notifier = bus
+//	resets.Notifier = bus
+//	bus.SubscribeNotifier(webhooks)
+//	bus.Subscribe(func(event *goauth.SecurityEvent) {
+//		log.Println("failed login for", event.UserName, "from", event.IP)
+//	}, goauth.EventLoginFailed)
+//
+// New in version v0.7
+type EventBus struct {
+	mutex         sync.RWMutex
+	nextID        uint64
+	subscriptions []eventSubscription
+}
+
+// NewEventBus returns a new EventBus without subscribers.
+func NewEventBus() *EventBus {
+	return &EventBus{}
+}
+
+// Subscribe registers handler for the given event types, if no types are
+// given the handler gets all events.
+// It returns a function that removes the subscription.
+func (b *EventBus) Subscribe(handler EventHandler, types ...string) func() {
+	var typeSet map[string]bool
+	if len(types) > 0 {
+		typeSet = make(map[string]bool, len(types))
+		for _, t := range types {
+			typeSet[t] = true
+		}
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	id := b.nextID
+	b.nextID++
+	b.subscriptions = append(b.subscriptions, eventSubscription{id: id,
+		types: typeSet, handler: handler})
+	return func() {
+		b.unsubscribe(id)
+	}
+}
+
+// SubscribeNotifier is like Subscribe but passes the events to a
+// SecurityNotifier, for example a WebhookDispatcher or an AuthMailer.
+func (b *EventBus) SubscribeNotifier(notifier SecurityNotifier, types ...string) func() {
+	return b.Subscribe(notifier.Notify, types...)
+}
+
+func (b *EventBus) unsubscribe(id uint64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for i, sub := range b.subscriptions {
+		if sub.id == id {
+			b.subscriptions = append(b.subscriptions[:i], b.subscriptions[i+1:]...)
+			return
+		}
+	}
+}
+
+// Notify publishes the event to all subscribers of its type, the handlers
+// are called synchronously.
+func (b *EventBus) Notify(event *SecurityEvent) {
+	b.mutex.RLock()
+	handlers := make([]EventHandler, 0, len(b.subscriptions))
+	for _, sub := range b.subscriptions {
+		if sub.types == nil || sub.types[event.Type] {
+			handlers = append(handlers, sub.handler)
+		}
+	}
+	b.mutex.RUnlock()
+	for _, handler := range handlers {
+		handler(event)
+	}
+}
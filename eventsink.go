@@ -0,0 +1,231 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package goauth
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// EventWriter writes a batch of security events to a store for analysis, for
+// example a column store like ClickHouse, see EventSink.
+//
+// New in version v0.7
+type EventWriter interface {
+	WriteEvents(ctx context.Context, events []*SecurityEvent) error
+}
+
+// EventSink is a SecurityNotifier that collects the events and writes them
+// in batches with an EventWriter, so high-volume telemetry (every login
+// attempt) doesn't cause one write per event. A batch is written when it
+// has BatchSize events or FlushInterval has passed.
+//
+// Call Start before using Notify. Batches that can't be written are logged
+// and dropped, the sink is meant for analytics and not as the only audit
+// trail.
+//
+// Usage:
+//
+//	sink := goauth.NewEventSink(goauth.NewClickHouseEventWriter(db, "goauth_events"))
+//	sink.Start(ctx, 10000)
+//	bus.SubscribeNotifier(sink)
+//
+// New in version v0.7
+type EventSink struct {
+	Writer EventWriter
+
+	// BatchSize is the maximal number of events in a batch, defaults to
+	// 1000.
+	BatchSize int
+
+	// FlushInterval is the maximal time an event waits in a batch, defaults
+	// to five seconds.
+	FlushInterval time.Duration
+
+	// Timeout is the timeout for each call to Writer, defaults to 30
+	// seconds.
+	Timeout time.Duration
+
+	queue chan *SecurityEvent
+	done  chan struct{}
+}
+
+// NewEventSink returns a new EventSink.
+func NewEventSink(writer EventWriter) *EventSink {
+	return &EventSink{Writer: writer, BatchSize: 1000, FlushInterval: 5 * time.Second,
+		Timeout: 30 * time.Second}
+}
+
+// Start starts a goroutine that writes the events passed to Notify until ctx
+// is done, the pending events are written then. queueSize is the number of
+// events that can wait for the goroutine.
+func (s *EventSink) Start(ctx context.Context, queueSize int) {
+	s.queue = make(chan *SecurityEvent, queueSize)
+	s.done = make(chan struct{})
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(s.FlushInterval)
+		defer ticker.Stop()
+		batch := make([]*SecurityEvent, 0, s.BatchSize)
+		flush := func() {
+			if len(batch) == 0 {
+				return
+			}
+			s.write(batch)
+			batch = make([]*SecurityEvent, 0, s.BatchSize)
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				// write what's left in the queue
+				for {
+					select {
+					case event := <-s.queue:
+						batch = append(batch, event)
+						if len(batch) >= s.BatchSize {
+							flush()
+						}
+					default:
+						flush()
+						return
+					}
+				}
+			case event := <-s.queue:
+				batch = append(batch, event)
+				if len(batch) >= s.BatchSize {
+					flush()
+				}
+			case <-ticker.C:
+				flush()
+			}
+		}
+	}()
+}
+
+// Wait blocks until the goroutine started by Start has written the pending
+// events after its context was cancelled.
+func (s *EventSink) Wait() {
+	<-s.done
+}
+
+func (s *EventSink) write(batch []*SecurityEvent) {
+	ctx, cancel := operationContext(context.Background(), s.Timeout)
+	defer cancel()
+	if err := s.Writer.WriteEvents(ctx, batch); err != nil {
+		log.WithError(err).WithField("events", len(batch)).Error("goauth: Can't write security events")
+	}
+}
+
+// Notify queues the event, if the queue is full the event is dropped (and
+// logged).
+func (s *EventSink) Notify(event *SecurityEvent) {
+	select {
+	case s.queue <- event:
+	default:
+		log.WithField("event", event.Type).Warn("goauth: Event sink queue full, dropping event")
+	}
+}
+
+// SQLEventWriter is an EventWriter for databases with a database/sql driver,
+// each batch is inserted in one transaction with a prepared statement. This
+// is the batch insert of the ClickHouse driver
+// (github.com/ClickHouse/clickhouse-go/v2), see NewClickHouseEventWriter.
+//
+// New in version v0.7
+type SQLEventWriter struct {
+	DB *sql.DB
+
+	// InitQuery creates the table.
+	InitQuery string
+
+	// InsertQuery inserts a single event, the arguments are the time, type,
+	// user id, username, ip and the data encoded as JSON.
+	InsertQuery string
+
+	// one batch at a time, the driver batches the whole transaction
+	mutex sync.Mutex
+}
+
+// NewClickHouseEventWriter returns a new SQLEventWriter for ClickHouse, the
+// table is a MergeTree partitioned by month and ordered by type and time.
+// Use JSONExtractString to query the data column.
+//
+// New in version v0.7
+func NewClickHouseEventWriter(db *sql.DB, table string) *SQLEventWriter {
+	initQ := `CREATE TABLE IF NOT EXISTS %s (
+		time DateTime64(3, 'UTC'),
+		type LowCardinality(String),
+		user_id UInt64,
+		username String,
+		ip String,
+		data String
+	) ENGINE = MergeTree
+	PARTITION BY toYYYYMM(time)
+	ORDER BY (type, time)`
+	insertQ := "INSERT INTO %s (time, type, user_id, username, ip, data) VALUES (?, ?, ?, ?, ?, ?)"
+	return &SQLEventWriter{DB: db, InitQuery: fmt.Sprintf(initQ, table),
+		InsertQuery: fmt.Sprintf(insertQ, table)}
+}
+
+// Init creates the table.
+func (w *SQLEventWriter) Init() error {
+	_, err := w.DB.Exec(w.InitQuery)
+	return wrapBackendError("sql", "Init", err)
+}
+
+func (w *SQLEventWriter) WriteEvents(ctx context.Context, events []*SecurityEvent) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	tx, err := w.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapBackendError("sql", "WriteEvents", err)
+	}
+	stmt, err := tx.PrepareContext(ctx, w.InsertQuery)
+	if err != nil {
+		tx.Rollback()
+		return wrapBackendError("sql", "WriteEvents", err)
+	}
+	defer stmt.Close()
+	for _, event := range events {
+		data := "{}"
+		if len(event.Data) > 0 {
+			encoded, err := json.Marshal(event.Data)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+			data = string(encoded)
+		}
+		if _, err := stmt.ExecContext(ctx, event.Time.UTC(), event.Type, event.UserID,
+			event.UserName, event.IP, data); err != nil {
+			tx.Rollback()
+			return wrapBackendError("sql", "WriteEvents", err)
+		}
+	}
+	return wrapBackendError("sql", "WriteEvents", tx.Commit())
+}
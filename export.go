@@ -0,0 +1,331 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package goauth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// PasswordHashHandler is implemented by UserHandlers that give access to the
+// stored password hashes. It's used by Export and Import to move users
+// between backends without knowing their passwords, so the hashes must be
+// compatible with the PasswordHandler of the target.
+// SQLUserHandler and RedisUserHandler implement this interface.
+//
+// New in version v0.7
+type PasswordHashHandler interface {
+	// GetPasswordHash returns the hash of the password of the user, nil if
+	// the user has no password (see PasswordStatusHandler).
+	// Returns ErrUserNotFound if the user doesn't exist.
+	GetPasswordHash(userName string) ([]byte, error)
+
+	// InsertWithHash inserts a user with an already hashed password (nil for
+	// no password). It uses UserName, FirstName, LastName, Email, IsActive,
+	// LastLogin and IsPending of info, the id is ignored.
+	// It behaves like Insert otherwise.
+	InsertWithHash(info *BaseUserInformation, hash []byte) (uint64, error)
+}
+
+// ExportFormatVersion is the version of the format written by Export, it's
+// stored in the header record.
+//
+// New in version v0.7
+const ExportFormatVersion = 1
+
+// ExportedUser is a user in the export format.
+//
+// New in version v0.7
+type ExportedUser struct {
+	ID            uint64    `json:"id"`
+	UserName      string    `json:"username"`
+	FirstName     string    `json:"first_name"`
+	LastName      string    `json:"last_name"`
+	Email         string    `json:"email"`
+	PasswordHash  string    `json:"password_hash,omitempty"`
+	IsActive      bool      `json:"is_active"`
+	IsAdmin       bool      `json:"is_admin"`
+	EmailVerified bool      `json:"email_verified"`
+	IsPending     bool      `json:"is_pending"`
+	LastLogin     time.Time `json:"last_login"`
+	DisplayName   string    `json:"display_name,omitempty"`
+	AvatarURL     string    `json:"avatar_url,omitempty"`
+	Locale        string    `json:"locale,omitempty"`
+	Timezone      string    `json:"timezone,omitempty"`
+}
+
+// ExportedSession is a session in the export format, UserID is the id of the
+// user in the exported storage.
+//
+// New in version v0.7
+type ExportedSession struct {
+	Key        string    `json:"key"`
+	UserID     uint64    `json:"user_id"`
+	Created    time.Time `json:"created"`
+	ValidUntil time.Time `json:"valid_until"`
+}
+
+// ExportRecord is a single line of the export format (newline delimited
+// JSON). The first record has type "header" and contains Version, followed
+// by records of type "user" and then records of type "session".
+//
+// New in version v0.7
+type ExportRecord struct {
+	Type    string           `json:"type"`
+	Version int              `json:"version,omitempty"`
+	User    *ExportedUser    `json:"user,omitempty"`
+	Session *ExportedSession `json:"session,omitempty"`
+}
+
+// ExportStats is returned by Export and Import.
+//
+// New in version v0.7
+type ExportStats struct {
+	Users, Sessions int
+}
+
+// ErrInvalidExport is returned by Import if the input is not in the export
+// format.
+//
+// New in version v0.7
+var ErrInvalidExport = errors.New("Invalid export format.")
+
+// Export writes all users (including the password hashes) and the valid
+// sessions of all users as newline delimited JSON to w, see ExportRecord.
+// Users are ordered by id and sessions by user and key, so exporting the same
+// data always gives the same output.
+// users must implement PasswordHashHandler and sessions (if not nil) must
+// implement SessionLister, otherwise ErrNotSupported is returned. If sessions
+// is nil only the users are exported.
+// Note that the export contains secrets (hashes and session keys), protect
+// it accordingly.
+//
+// New in version v0.7
+func Export(w io.Writer, users UserHandler, sessions SessionHandler) (ExportStats, error) {
+	var stats ExportStats
+	hashes, ok := users.(PasswordHashHandler)
+	if !ok {
+		return stats, ErrNotSupported
+	}
+	var lister SessionLister
+	if sessions != nil {
+		if lister, ok = sessions.(SessionLister); !ok {
+			return stats, ErrNotSupported
+		}
+	}
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(ExportRecord{Type: "header", Version: ExportFormatVersion}); err != nil {
+		return stats, err
+	}
+	names, err := users.ListUsers()
+	if err != nil {
+		return stats, err
+	}
+	ids := make([]uint64, 0, len(names))
+	for id := range names {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		info, err := users.GetUserBaseInfo(names[id])
+		if err != nil {
+			return stats, err
+		}
+		hash, err := hashes.GetPasswordHash(names[id])
+		if err != nil {
+			return stats, err
+		}
+		user := &ExportedUser{ID: id, UserName: info.UserName, FirstName: info.FirstName,
+			LastName: info.LastName, Email: info.Email, PasswordHash: string(hash),
+			IsActive: info.IsActive, IsAdmin: info.IsAdmin, EmailVerified: info.EmailVerified,
+			IsPending: info.IsPending, LastLogin: info.LastLogin,
+			DisplayName: info.DisplayName, AvatarURL: info.AvatarURL,
+			Locale: info.Locale, Timezone: info.Timezone}
+		if err := enc.Encode(ExportRecord{Type: "user", User: user}); err != nil {
+			return stats, err
+		}
+		stats.Users++
+	}
+	if lister == nil {
+		return stats, nil
+	}
+	for _, id := range ids {
+		entries, err := lister.ListSessionsForUser(id)
+		if err != nil {
+			return stats, err
+		}
+		keys := make([]string, 0, len(entries))
+		for key := range entries {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			session := &ExportedSession{Key: key, UserID: id,
+				Created: entries[key].CreationTime, ValidUntil: entries[key].ValidUntil}
+			if err := enc.Encode(ExportRecord{Type: "session", Session: session}); err != nil {
+				return stats, err
+			}
+			stats.Sessions++
+		}
+	}
+	return stats, nil
+}
+
+// Import reads the output of Export from r and inserts the users and
+// sessions. Users get new ids in the target storage, the sessions are
+// assigned to the new ids. If users is nil the users are skipped and the
+// sessions keep their user ids, if sessions is nil the sessions are skipped.
+// users must implement PasswordHashHandler, the admin and email verified
+// flags are only imported if it implements AdminFlagHandler and
+// EmailVerifiedHandler.
+// Sessions are created with CreateEntry, so their creation time is the time
+// of the import, expired sessions are skipped.
+// Import stops on the first error (for example ErrDuplicateUsername), the
+// records imported so far are not removed.
+//
+// New in version v0.7
+func Import(r io.Reader, users UserHandler, sessions SessionHandler) (ExportStats, error) {
+	var stats ExportStats
+	var hashes PasswordHashHandler
+	if users != nil {
+		var ok bool
+		if hashes, ok = users.(PasswordHashHandler); !ok {
+			return stats, ErrNotSupported
+		}
+	}
+	ids := make(map[uint64]uint64)
+	dec := json.NewDecoder(r)
+	var header ExportRecord
+	if err := dec.Decode(&header); err != nil {
+		if err == io.EOF {
+			return stats, ErrInvalidExport
+		}
+		return stats, err
+	}
+	if header.Type != "header" || header.Version != ExportFormatVersion {
+		return stats, ErrInvalidExport
+	}
+	for {
+		var record ExportRecord
+		if err := dec.Decode(&record); err != nil {
+			if err == io.EOF {
+				return stats, nil
+			}
+			return stats, err
+		}
+		switch {
+		case record.Type == "user" && record.User != nil:
+			if hashes == nil {
+				continue
+			}
+			id, err := importUser(users, hashes, record.User)
+			if err != nil {
+				return stats, fmt.Errorf("Import of user %s failed: %w", record.User.UserName, err)
+			}
+			ids[record.User.ID] = id
+			stats.Users++
+		case record.Type == "session" && record.Session != nil:
+			if sessions == nil {
+				continue
+			}
+			validDuration := record.Session.ValidUntil.Sub(CurrentTime())
+			if validDuration <= 0 {
+				continue
+			}
+			userID := record.Session.UserID
+			if hashes != nil {
+				newID, has := ids[userID]
+				if !has {
+					// the user was not imported
+					continue
+				}
+				userID = newID
+			}
+			if _, err := sessions.CreateEntry(userID, record.Session.Key, validDuration); err != nil {
+				return stats, err
+			}
+			stats.Sessions++
+		default:
+			return stats, ErrInvalidExport
+		}
+	}
+}
+
+// importUser inserts the user and sets the flags, it returns the new id.
+func importUser(users UserHandler, hashes PasswordHashHandler, user *ExportedUser) (uint64, error) {
+	var hash []byte
+	if user.PasswordHash != "" {
+		hash = []byte(user.PasswordHash)
+	}
+	info := &BaseUserInformation{UserName: user.UserName, FirstName: user.FirstName,
+		LastName: user.LastName, Email: user.Email, LastLogin: user.LastLogin,
+		IsActive: user.IsActive, IsPending: user.IsPending}
+	id, err := hashes.InsertWithHash(info, hash)
+	if err != nil {
+		return NoUserID, err
+	}
+	// some databases don't return the id of the new user
+	if id == NoUserID {
+		if id, err = users.GetUserID(user.UserName); err != nil {
+			return NoUserID, err
+		}
+	}
+	if admin, ok := users.(AdminFlagHandler); ok && user.IsAdmin {
+		if err := admin.SetAdmin(user.UserName, true); err != nil {
+			return NoUserID, err
+		}
+	}
+	if verified, ok := users.(EmailVerifiedHandler); ok && user.EmailVerified {
+		if err := verified.SetEmailVerified(user.UserName, true); err != nil {
+			return NoUserID, err
+		}
+	}
+	if profile, ok := users.(ProfileHandler); ok {
+		if user.DisplayName != "" {
+			if err := profile.SetDisplayName(user.UserName, user.DisplayName); err != nil {
+				return NoUserID, err
+			}
+		}
+		if user.AvatarURL != "" {
+			if err := profile.SetAvatarURL(user.UserName, user.AvatarURL); err != nil {
+				return NoUserID, err
+			}
+		}
+	}
+	if locales, ok := users.(LocaleHandler); ok {
+		if user.Locale != "" {
+			if err := locales.SetLocale(user.UserName, user.Locale); err != nil {
+				return NoUserID, err
+			}
+		}
+		if user.Timezone != "" {
+			if err := locales.SetTimezone(user.UserName, user.Timezone); err != nil {
+				return NoUserID, err
+			}
+		}
+	}
+	return id, nil
+}
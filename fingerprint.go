@@ -0,0 +1,216 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// FingerprintPayloadName is the name under which the fingerprint is stored
+// in the session payload.
+const FingerprintPayloadName = "fingerprint"
+
+// ClientFingerprint identifies the client a session was created for: its IP
+// address and a hash of its User-Agent.
+//
+// New in version v0.7
+type ClientFingerprint struct {
+	IP            string
+	UserAgentHash string
+}
+
+// NewClientFingerprint returns the fingerprint of the client that sent the
+// request, the IP address is taken from ClientIP.
+func NewClientFingerprint(r *http.Request) *ClientFingerprint {
+	hash := sha256.Sum256([]byte(r.UserAgent()))
+	return &ClientFingerprint{IP: ClientIP(r),
+		UserAgentHash: hex.EncodeToString(hash[:8])}
+}
+
+// String encodes the fingerprint, see ParseClientFingerprint.
+func (f *ClientFingerprint) String() string {
+	return f.IP + "|" + f.UserAgentHash
+}
+
+// ParseClientFingerprint parses a fingerprint encoded with String.
+func ParseClientFingerprint(s string) *ClientFingerprint {
+	res := &ClientFingerprint{}
+	if i := strings.LastIndexByte(s, '|'); i >= 0 {
+		res.IP, res.UserAgentHash = s[:i], s[i+1:]
+	} else {
+		res.IP = s
+	}
+	return res
+}
+
+// FingerprintMode describes what happens if the fingerprint of a request
+// doesn't match the fingerprint of its session.
+type FingerprintMode int
+
+const (
+	// FingerprintFlag only flags the request, see
+	// FingerprintMismatchFromContext.
+	FingerprintFlag FingerprintMode = iota
+
+	// FingerprintReject rejects the request and ends the session.
+	FingerprintReject
+)
+
+type fingerprintContextKey struct{}
+
+// FingerprintMismatchFromContext returns true if the FingerprintBinding
+// middleware flagged the request.
+//
+// New in version v0.7
+func FingerprintMismatchFromContext(ctx context.Context) bool {
+	mismatch, _ := ctx.Value(fingerprintContextKey{}).(bool)
+	return mismatch
+}
+
+// FingerprintBinding binds sessions to the client they were created for, as
+// a mitigation against stolen session cookies. The fingerprint is recorded
+// with Bind when the session is created (AuthHandlers does that if you set
+// its Fingerprints field) and checked by Middleware for each request.
+//
+// IP addresses change (mobile networks, ...), so they're only compared up
+// to a prefix length: By default two IPv4 addresses match if they are in
+// the same /16 network and two IPv6 addresses if they are in the same /48
+// network. Set the prefix to 0 to ignore the address.
+//
+// New in version v0.7
+type FingerprintBinding struct {
+	Payload SessionPayloadHandler
+	Mode    FingerprintMode
+
+	// IPv4Prefix and IPv6Prefix are the prefix lengths compared.
+	IPv4Prefix, IPv6Prefix int
+
+	// CheckUserAgent compares the User-Agent hash, defaults to true.
+	CheckUserAgent bool
+
+	// OnMismatch is called for each mismatch (in both modes) if not nil,
+	// for example to log it or to send an event.
+	OnMismatch func(r *http.Request, key string, data *SessionKeyData, stored, current *ClientFingerprint)
+}
+
+// NewFingerprintBinding returns a new FingerprintBinding with the default
+// tolerance.
+func NewFingerprintBinding(payload SessionPayloadHandler, mode FingerprintMode) *FingerprintBinding {
+	return &FingerprintBinding{Payload: payload, Mode: mode, IPv4Prefix: 16,
+		IPv6Prefix: 48, CheckUserAgent: true}
+}
+
+// Bind stores the fingerprint of the request for the session.
+func (b *FingerprintBinding) Bind(r *http.Request, key string, data *SessionKeyData) error {
+	return b.Payload.SetPayloadValue(key, FingerprintPayloadName,
+		NewClientFingerprint(r).String(), data.ValidUntil)
+}
+
+// ipMatches compares two IP addresses up to the configured prefix.
+func (b *FingerprintBinding) ipMatches(a, c string) bool {
+	ipA, ipC := net.ParseIP(a), net.ParseIP(c)
+	if ipA == nil || ipC == nil {
+		return a == c
+	}
+	bits, prefix := 128, b.IPv6Prefix
+	if ipA.To4() != nil && ipC.To4() != nil {
+		ipA, ipC = ipA.To4(), ipC.To4()
+		bits, prefix = 32, b.IPv4Prefix
+	} else if (ipA.To4() == nil) != (ipC.To4() == nil) {
+		return prefix <= 0 && b.IPv4Prefix <= 0
+	}
+	if prefix <= 0 {
+		return true
+	}
+	mask := net.CIDRMask(prefix, bits)
+	return ipA.Mask(mask).Equal(ipC.Mask(mask))
+}
+
+// Matches compares two fingerprints with the configured tolerance.
+func (b *FingerprintBinding) Matches(stored, current *ClientFingerprint) bool {
+	if b.CheckUserAgent && stored.UserAgentHash != current.UserAgentHash {
+		return false
+	}
+	return b.ipMatches(stored.IP, current.IP)
+}
+
+// Verify compares the fingerprint of the request with the fingerprint
+// stored for the session. Sessions without a stored fingerprint always
+// match. It returns the stored and the current fingerprint as well.
+func (b *FingerprintBinding) Verify(r *http.Request, key string) (bool, *ClientFingerprint, *ClientFingerprint, error) {
+	current := NewClientFingerprint(r)
+	value, err := b.Payload.GetPayloadValue(key, FingerprintPayloadName)
+	if err == ErrPayloadValueNotFound {
+		return true, nil, current, nil
+	}
+	if err != nil {
+		return false, nil, current, err
+	}
+	stored := ParseClientFingerprint(value)
+	return b.Matches(stored, current), stored, current, nil
+}
+
+// Middleware returns a handler that verifies the fingerprint of the session
+// in the request context, so it must be wrapped by the SessionMiddleware.
+// Requests without a session are passed on.
+//
+// In FingerprintReject mode the session is deleted and a 401 response is
+// written, the SessionController is required for that.
+func (b *FingerprintBinding) Middleware(controller *SessionController, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := SessionKeyFromContext(r.Context())
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ok, stored, current, err := b.Verify(r, key)
+		if err != nil {
+			log.WithError(err).Error("goauth: Can't verify session fingerprint")
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		data := SessionDataFromContext(r.Context())
+		if b.OnMismatch != nil {
+			b.OnMismatch(r, key, data, stored, current)
+		}
+		if b.Mode == FingerprintReject {
+			if err := controller.DeleteKey(key); err != nil {
+				log.WithError(err).Error("goauth: Can't delete session with wrong fingerprint")
+			}
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), fingerprintContextKey{}, true)))
+	})
+}
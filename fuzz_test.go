@@ -0,0 +1,143 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package goauth
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The fuzz targets run their seed corpus with go test, use for example
+// go test -fuzz FuzzDefaultTimeFromScanType to fuzz.
+
+func FuzzDefaultTimeFromScanType(f *testing.F) {
+	f.Add([]byte("2018-01-02 15:04:05"))
+	f.Add([]byte("0000-00-00 00:00:00"))
+	f.Add([]byte("2018-01-02T15:04:05Z"))
+	f.Add([]byte(""))
+	f.Add([]byte("\xff\x00"))
+	f.Fuzz(func(t *testing.T, value []byte) {
+		parsed, err := DefaultTimeFromScanType(value)
+		if err != nil {
+			return
+		}
+		// a parsed value must survive a round trip
+		formatted := parsed.Format("2006-01-02 15:04:05")
+		again, err := DefaultTimeFromScanType([]byte(formatted))
+		if err != nil {
+			t.Fatalf("Can't parse formatted time %q: %v", formatted, err)
+		}
+		if !again.Equal(parsed) {
+			t.Fatalf("Round trip changed %v to %v", parsed, again)
+		}
+	})
+}
+
+func FuzzRedisParseEntry(f *testing.F) {
+	now := time.Date(2018, 1, 2, 15, 4, 5, 0, time.UTC).Format(RedisDateFormat)
+	f.Add("42", now, now)
+	f.Add("", "", "")
+	f.Add("-1", now, "not a date")
+	f.Add("18446744073709551616", now, now)
+	handler := NewRedisSessionHandler(nil)
+	f.Fuzz(func(t *testing.T, user, created, validUntil string) {
+		data, err := handler.parseEntry([]interface{}{user, created, validUntil})
+		if err != nil {
+			if data != nil {
+				t.Fatalf("Got data %v together with error %v", data, err)
+			}
+			return
+		}
+		if _, ok := data.User.(uint64); !ok {
+			t.Fatalf("User %v is not a uint64", data.User)
+		}
+	})
+}
+
+func FuzzRedisParseUser(f *testing.F) {
+	now := time.Date(2018, 1, 2, 15, 4, 5, 0, time.UTC).Format(RedisDateFormat)
+	f.Add("1", "first", "last", "mail@example.com", "1", now, "0", "true", "", "Name", "https://example.com/a.png", "de-AT", "Europe/Vienna")
+	f.Add("", "", "", "", "", "", "", "", "", "", "", "", "")
+	f.Add("x", "first", "last", "mail", "maybe", "yesterday", "2", "t", "F", "\x00", ":", "_", "Local")
+	f.Fuzz(func(t *testing.T, id, firstName, lastName, email, active, lastLogin, admin, verified, pending, displayName, avatarURL, locale, timezone string) {
+		entry := []interface{}{id, firstName, lastName, email, active, lastLogin, admin, verified, pending, displayName, avatarURL, locale, timezone}
+		info, err := parseRedisUser("user", entry)
+		if err != nil {
+			return
+		}
+		if info.UserName != "user" || info.FirstName != firstName || info.Email != email || info.DisplayName != displayName {
+			t.Fatalf("Wrong user information %v", info)
+		}
+		// missing optional fields must not be an error
+		for i := 6; i < len(entry); i++ {
+			entry[i] = nil
+		}
+		if _, err := parseRedisUser("user", entry); err != nil {
+			t.Fatalf("Missing optional fields gave error %v", err)
+		}
+	})
+}
+
+func FuzzBearerToken(f *testing.F) {
+	f.Add("Bearer abc")
+	f.Add("bearer   abc  ")
+	f.Add("Bearer ")
+	f.Add("Basic dXNlcjpwdw==")
+	f.Add("Bearer\x00\xff")
+	f.Fuzz(func(t *testing.T, header string) {
+		r := &http.Request{Header: http.Header{"Authorization": []string{header}}}
+		token := bearerToken(r)
+		if token == "" {
+			return
+		}
+		if token != strings.TrimSpace(token) {
+			t.Fatalf("Token %q is not trimmed", token)
+		}
+		if !strings.Contains(header, token) {
+			t.Fatalf("Token %q is not part of the header %q", token, header)
+		}
+	})
+}
+
+func FuzzFieldEncryptorDecrypt(f *testing.F) {
+	encryptor := NewFieldEncryptor(NewStaticKeyProvider(1, make([]byte, 32)))
+	valid, err := encryptor.Encrypt("email", "mail@example.com")
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(valid)
+	f.Add(encryptedFieldPrefix)
+	f.Add(encryptedFieldPrefix + "1:")
+	f.Add(encryptedFieldPrefix + "4294967296:AAAA")
+	f.Add("plain value")
+	f.Fuzz(func(t *testing.T, value string) {
+		plain, err := encryptor.Decrypt("email", value)
+		if err != nil {
+			return
+		}
+		if !IsEncrypted(value) && plain != value {
+			t.Fatalf("Plaintext %q was changed to %q", value, plain)
+		}
+	})
+}
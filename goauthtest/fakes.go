@@ -0,0 +1,341 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+// Package goauthtest provides fakes and mocks of the goauth interfaces for
+// tests of applications that use goauth, so these tests need neither a
+// database nor slow password hashing.
+//
+// The fakes are working in-memory implementations: FakePasswordHandler
+// hashes instantly (and insecurely) and FakeUserHandler stores users in a
+// map. For sessions use goauth.NewInMemoryHandler:
+//
+//	users := goauthtest.NewFakeUserHandler()
+//	controller := goauth.NewInMemoryController()
+//	handlers := goauth.NewAuthHandlers(users, controller, store)
+//
+// The mocks (MockSessionHandler and MockUserHandler) call a function field
+// for each method and record the calls, use them to inject errors or to
+// check that a method was called.
+//
+// New in version v0.7
+package goauthtest
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"sync"
+
+	"github.com/FabianWe/goauth"
+)
+
+// fakeHashPrefix is the prefix of hashes generated by FakePasswordHandler.
+const fakeHashPrefix = "fake$"
+
+// FakePasswordHandler is a goauth.PasswordHandler that hashes with a single
+// SHA-256, so it's fast but insecure. Never use it outside of tests.
+type FakePasswordHandler struct{}
+
+func (FakePasswordHandler) GenerateHash(password []byte) ([]byte, error) {
+	hash := sha256.Sum256(password)
+	return []byte(fakeHashPrefix + hex.EncodeToString(hash[:])), nil
+}
+
+func (h FakePasswordHandler) CheckPassword(hashedPW, password []byte) (bool, error) {
+	expected, _ := h.GenerateHash(password)
+	return subtle.ConstantTimeCompare(hashedPW, expected) == 1, nil
+}
+
+func (FakePasswordHandler) PasswordHashLength() int {
+	return len(fakeHashPrefix) + hex.EncodedLen(sha256.Size)
+}
+
+// fakeUser is a user stored in FakeUserHandler.
+type fakeUser struct {
+	info goauth.BaseUserInformation
+	hash []byte
+}
+
+// FakeUserHandler is an in-memory goauth.UserHandler. Besides UserHandler it
+// implements AdminFlagHandler, ActiveFlagHandler, EmailVerifiedHandler,
+// UserRenamer, PendingUserHandler, PasswordStatusHandler, ProfileHandler,
+// LocaleHandler and PasswordHashHandler.
+//
+// The ids start with 1, PwHandler is used to hash the passwords and defaults
+// to FakePasswordHandler.
+type FakeUserHandler struct {
+	PwHandler goauth.PasswordHandler
+
+	mutex  sync.RWMutex
+	users  map[string]*fakeUser
+	names  map[uint64]string
+	nextID uint64
+}
+
+// NewFakeUserHandler returns a new FakeUserHandler without users.
+func NewFakeUserHandler() *FakeUserHandler {
+	return &FakeUserHandler{PwHandler: FakePasswordHandler{},
+		users: make(map[string]*fakeUser), names: make(map[uint64]string), nextID: 1}
+}
+
+func (h *FakeUserHandler) Init() error {
+	return nil
+}
+
+func (h *FakeUserHandler) Insert(userName, firstName, lastName, email string, plainPW []byte) (uint64, error) {
+	return h.insert(userName, firstName, lastName, email, plainPW, false)
+}
+
+func (h *FakeUserHandler) InsertPending(userName, email string, plainPW []byte) (uint64, error) {
+	return h.insert(userName, "", "", email, plainPW, true)
+}
+
+func (h *FakeUserHandler) insert(userName, firstName, lastName, email string, plainPW []byte, pending bool) (uint64, error) {
+	hash, err := h.PwHandler.GenerateHash(plainPW)
+	if err != nil {
+		return goauth.NoUserID, err
+	}
+	info := &goauth.BaseUserInformation{UserName: userName, FirstName: firstName,
+		LastName: lastName, Email: email, IsActive: true, IsPending: pending,
+		LastLogin: goauth.CurrentTime()}
+	return h.InsertWithHash(info, hash)
+}
+
+func (h *FakeUserHandler) InsertWithHash(info *goauth.BaseUserInformation, hash []byte) (uint64, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if _, has := h.users[info.UserName]; has {
+		return goauth.NoUserID, goauth.ErrDuplicateUsername
+	}
+	user := &fakeUser{info: *info, hash: hash}
+	user.info.ID = h.nextID
+	user.info.IsAdmin, user.info.EmailVerified = false, false
+	user.info.DisplayName, user.info.AvatarURL = "", ""
+	user.info.Locale, user.info.Timezone = "", ""
+	h.nextID++
+	h.users[info.UserName] = user
+	h.names[user.info.ID] = info.UserName
+	return user.info.ID, nil
+}
+
+func (h *FakeUserHandler) Validate(userName string, cleartextPwCheck []byte) (uint64, error) {
+	h.mutex.RLock()
+	user, has := h.users[userName]
+	var hash []byte
+	var info goauth.BaseUserInformation
+	if has {
+		hash, info = user.hash, user.info
+	}
+	h.mutex.RUnlock()
+	if !has {
+		return goauth.NoUserID, goauth.ErrUserNotFound
+	}
+	if len(hash) == 0 {
+		return goauth.NoUserID, nil
+	}
+	ok, err := h.PwHandler.CheckPassword(hash, cleartextPwCheck)
+	if err != nil || !ok {
+		return goauth.NoUserID, err
+	}
+	if info.IsPending {
+		return info.ID, goauth.ErrRegistrationPending
+	}
+	return info.ID, nil
+}
+
+// update calls f with the user, it returns ErrUserNotFound if the user
+// doesn't exist.
+func (h *FakeUserHandler) update(userName string, f func(user *fakeUser)) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	user, has := h.users[userName]
+	if !has {
+		return goauth.ErrUserNotFound
+	}
+	f(user)
+	return nil
+}
+
+func (h *FakeUserHandler) UpdatePassword(userName string, plainPW []byte) error {
+	hash, err := h.PwHandler.GenerateHash(plainPW)
+	if err != nil {
+		return err
+	}
+	return h.update(userName, func(user *fakeUser) { user.hash = hash })
+}
+
+func (h *FakeUserHandler) ListUsers() (map[uint64]string, error) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	res := make(map[uint64]string, len(h.names))
+	for id, name := range h.names {
+		res[id] = name
+	}
+	return res, nil
+}
+
+func (h *FakeUserHandler) GetUserName(id uint64) (string, error) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	name, has := h.names[id]
+	if !has {
+		return "", goauth.ErrUserNotFound
+	}
+	return name, nil
+}
+
+func (h *FakeUserHandler) GetUserID(userName string) (uint64, error) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	user, has := h.users[userName]
+	if !has {
+		return goauth.NoUserID, goauth.ErrUserNotFound
+	}
+	return user.info.ID, nil
+}
+
+func (h *FakeUserHandler) DeleteUser(userName string) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if user, has := h.users[userName]; has {
+		delete(h.names, user.info.ID)
+		delete(h.users, userName)
+	}
+	return nil
+}
+
+func (h *FakeUserHandler) GetUserBaseInfo(userName string) (*goauth.BaseUserInformation, error) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	user, has := h.users[userName]
+	if !has {
+		return nil, goauth.ErrUserNotFound
+	}
+	info := user.info
+	return &info, nil
+}
+
+func (h *FakeUserHandler) SetAdmin(userName string, admin bool) error {
+	return h.update(userName, func(user *fakeUser) { user.info.IsAdmin = admin })
+}
+
+func (h *FakeUserHandler) SetActive(userName string, active bool) error {
+	return h.update(userName, func(user *fakeUser) { user.info.IsActive = active })
+}
+
+func (h *FakeUserHandler) SetEmailVerified(userName string, verified bool) error {
+	return h.update(userName, func(user *fakeUser) { user.info.EmailVerified = verified })
+}
+
+func (h *FakeUserHandler) SetEmail(userName, email string, verified bool) error {
+	return h.update(userName, func(user *fakeUser) {
+		user.info.Email, user.info.EmailVerified = email, verified
+	})
+}
+
+func (h *FakeUserHandler) SetDisplayName(userName, displayName string) error {
+	if err := goauth.CheckDisplayName(displayName); err != nil {
+		return err
+	}
+	return h.update(userName, func(user *fakeUser) { user.info.DisplayName = displayName })
+}
+
+func (h *FakeUserHandler) SetAvatarURL(userName, avatarURL string) error {
+	if err := goauth.CheckAvatarURL(avatarURL); err != nil {
+		return err
+	}
+	return h.update(userName, func(user *fakeUser) { user.info.AvatarURL = avatarURL })
+}
+
+func (h *FakeUserHandler) SetLocale(userName, locale string) error {
+	locale, err := goauth.NormalizeLocale(locale)
+	if err != nil {
+		return err
+	}
+	return h.update(userName, func(user *fakeUser) { user.info.Locale = locale })
+}
+
+func (h *FakeUserHandler) SetTimezone(userName, timezone string) error {
+	if err := goauth.CheckTimezone(timezone); err != nil {
+		return err
+	}
+	return h.update(userName, func(user *fakeUser) { user.info.Timezone = timezone })
+}
+
+func (h *FakeUserHandler) CompleteRegistration(userName, firstName, lastName string) error {
+	return h.update(userName, func(user *fakeUser) {
+		user.info.FirstName, user.info.LastName = firstName, lastName
+		user.info.IsPending = false
+	})
+}
+
+func (h *FakeUserHandler) RenameUser(oldName, newName string) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	user, has := h.users[oldName]
+	if !has {
+		return goauth.ErrUserNotFound
+	}
+	if _, has := h.users[newName]; has {
+		return goauth.ErrDuplicateUsername
+	}
+	delete(h.users, oldName)
+	user.info.UserName = newName
+	h.users[newName] = user
+	h.names[user.info.ID] = newName
+	return nil
+}
+
+func (h *FakeUserHandler) HasPassword(userName string) (bool, error) {
+	hash, err := h.GetPasswordHash(userName)
+	return len(hash) > 0, err
+}
+
+func (h *FakeUserHandler) ClearPassword(userName string) error {
+	return h.update(userName, func(user *fakeUser) { user.hash = nil })
+}
+
+func (h *FakeUserHandler) GetPasswordHash(userName string) ([]byte, error) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	user, has := h.users[userName]
+	if !has {
+		return nil, goauth.ErrUserNotFound
+	}
+	if len(user.hash) == 0 {
+		return nil, nil
+	}
+	return append([]byte(nil), user.hash...), nil
+}
+
+var (
+	_ goauth.PasswordHandler       = FakePasswordHandler{}
+	_ goauth.UserHandler           = (*FakeUserHandler)(nil)
+	_ goauth.AdminFlagHandler      = (*FakeUserHandler)(nil)
+	_ goauth.ActiveFlagHandler     = (*FakeUserHandler)(nil)
+	_ goauth.EmailVerifiedHandler  = (*FakeUserHandler)(nil)
+	_ goauth.UserRenamer           = (*FakeUserHandler)(nil)
+	_ goauth.PendingUserHandler    = (*FakeUserHandler)(nil)
+	_ goauth.PasswordStatusHandler = (*FakeUserHandler)(nil)
+	_ goauth.ProfileHandler        = (*FakeUserHandler)(nil)
+	_ goauth.LocaleHandler         = (*FakeUserHandler)(nil)
+	_ goauth.PasswordHashHandler   = (*FakeUserHandler)(nil)
+)
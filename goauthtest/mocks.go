@@ -0,0 +1,231 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package goauthtest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/FabianWe/goauth"
+)
+
+// MockCall is a call of a method of a mock.
+type MockCall struct {
+	Method string
+	Args   []interface{}
+}
+
+// calls records the calls of a mock.
+type calls struct {
+	mutex sync.Mutex
+	calls []MockCall
+}
+
+func (c *calls) record(method string, args ...interface{}) {
+	c.mutex.Lock()
+	c.calls = append(c.calls, MockCall{Method: method, Args: args})
+	c.mutex.Unlock()
+}
+
+// Calls returns all recorded calls in order.
+func (c *calls) Calls() []MockCall {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]MockCall(nil), c.calls...)
+}
+
+// CallCount returns the number of calls of the method.
+func (c *calls) CallCount(method string) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	res := 0
+	for _, call := range c.calls {
+		if call.Method == method {
+			res++
+		}
+	}
+	return res
+}
+
+// Reset removes all recorded calls.
+func (c *calls) Reset() {
+	c.mutex.Lock()
+	c.calls = nil
+	c.mutex.Unlock()
+}
+
+// MockSessionHandler is a goauth.SessionHandler that calls the function
+// field of each method and records the call. If a function is nil the
+// method returns zero values, GetData returns goauth.ErrKeyNotFound.
+type MockSessionHandler struct {
+	calls
+
+	InitFunc                 func() error
+	GetDataFunc              func(key string) (*goauth.SessionKeyData, error)
+	CreateEntryFunc          func(user goauth.UserKeyType, key string, validDuration time.Duration) (*goauth.SessionKeyData, error)
+	DeleteEntriesForUserFunc func(user goauth.UserKeyType) (int64, error)
+	DeleteInvalidKeysFunc    func() (int64, error)
+	DeleteKeyFunc            func(key string) error
+}
+
+func (m *MockSessionHandler) Init() error {
+	m.record("Init")
+	if m.InitFunc == nil {
+		return nil
+	}
+	return m.InitFunc()
+}
+
+func (m *MockSessionHandler) GetData(key string) (*goauth.SessionKeyData, error) {
+	m.record("GetData", key)
+	if m.GetDataFunc == nil {
+		return nil, goauth.ErrKeyNotFound
+	}
+	return m.GetDataFunc(key)
+}
+
+func (m *MockSessionHandler) CreateEntry(user goauth.UserKeyType, key string, validDuration time.Duration) (*goauth.SessionKeyData, error) {
+	m.record("CreateEntry", user, key, validDuration)
+	if m.CreateEntryFunc == nil {
+		return goauth.CurrentTimeKeyData(user, validDuration), nil
+	}
+	return m.CreateEntryFunc(user, key, validDuration)
+}
+
+func (m *MockSessionHandler) DeleteEntriesForUser(user goauth.UserKeyType) (int64, error) {
+	m.record("DeleteEntriesForUser", user)
+	if m.DeleteEntriesForUserFunc == nil {
+		return 0, nil
+	}
+	return m.DeleteEntriesForUserFunc(user)
+}
+
+func (m *MockSessionHandler) DeleteInvalidKeys() (int64, error) {
+	m.record("DeleteInvalidKeys")
+	if m.DeleteInvalidKeysFunc == nil {
+		return 0, nil
+	}
+	return m.DeleteInvalidKeysFunc()
+}
+
+func (m *MockSessionHandler) DeleteKey(key string) error {
+	m.record("DeleteKey", key)
+	if m.DeleteKeyFunc == nil {
+		return nil
+	}
+	return m.DeleteKeyFunc(key)
+}
+
+// MockUserHandler is a goauth.UserHandler that calls the function field of
+// each method and records the call. If a function is nil the method returns
+// zero values, the lookups return goauth.ErrUserNotFound and Validate
+// returns goauth.NoUserID.
+type MockUserHandler struct {
+	calls
+
+	InitFunc            func() error
+	InsertFunc          func(userName, firstName, lastName, email string, plainPW []byte) (uint64, error)
+	ValidateFunc        func(userName string, cleartextPwCheck []byte) (uint64, error)
+	UpdatePasswordFunc  func(userName string, plainPW []byte) error
+	ListUsersFunc       func() (map[uint64]string, error)
+	GetUserNameFunc     func(id uint64) (string, error)
+	GetUserIDFunc       func(userName string) (uint64, error)
+	DeleteUserFunc      func(userName string) error
+	GetUserBaseInfoFunc func(userName string) (*goauth.BaseUserInformation, error)
+}
+
+func (m *MockUserHandler) Init() error {
+	m.record("Init")
+	if m.InitFunc == nil {
+		return nil
+	}
+	return m.InitFunc()
+}
+
+func (m *MockUserHandler) Insert(userName, firstName, lastName, email string, plainPW []byte) (uint64, error) {
+	m.record("Insert", userName, firstName, lastName, email, plainPW)
+	if m.InsertFunc == nil {
+		return goauth.NoUserID, nil
+	}
+	return m.InsertFunc(userName, firstName, lastName, email, plainPW)
+}
+
+func (m *MockUserHandler) Validate(userName string, cleartextPwCheck []byte) (uint64, error) {
+	m.record("Validate", userName, cleartextPwCheck)
+	if m.ValidateFunc == nil {
+		return goauth.NoUserID, nil
+	}
+	return m.ValidateFunc(userName, cleartextPwCheck)
+}
+
+func (m *MockUserHandler) UpdatePassword(userName string, plainPW []byte) error {
+	m.record("UpdatePassword", userName, plainPW)
+	if m.UpdatePasswordFunc == nil {
+		return nil
+	}
+	return m.UpdatePasswordFunc(userName, plainPW)
+}
+
+func (m *MockUserHandler) ListUsers() (map[uint64]string, error) {
+	m.record("ListUsers")
+	if m.ListUsersFunc == nil {
+		return make(map[uint64]string), nil
+	}
+	return m.ListUsersFunc()
+}
+
+func (m *MockUserHandler) GetUserName(id uint64) (string, error) {
+	m.record("GetUserName", id)
+	if m.GetUserNameFunc == nil {
+		return "", goauth.ErrUserNotFound
+	}
+	return m.GetUserNameFunc(id)
+}
+
+func (m *MockUserHandler) GetUserID(userName string) (uint64, error) {
+	m.record("GetUserID", userName)
+	if m.GetUserIDFunc == nil {
+		return goauth.NoUserID, goauth.ErrUserNotFound
+	}
+	return m.GetUserIDFunc(userName)
+}
+
+func (m *MockUserHandler) DeleteUser(userName string) error {
+	m.record("DeleteUser", userName)
+	if m.DeleteUserFunc == nil {
+		return nil
+	}
+	return m.DeleteUserFunc(userName)
+}
+
+func (m *MockUserHandler) GetUserBaseInfo(userName string) (*goauth.BaseUserInformation, error) {
+	m.record("GetUserBaseInfo", userName)
+	if m.GetUserBaseInfoFunc == nil {
+		return nil, goauth.ErrUserNotFound
+	}
+	return m.GetUserBaseInfoFunc(userName)
+}
+
+var (
+	_ goauth.SessionHandler = (*MockSessionHandler)(nil)
+	_ goauth.UserHandler    = (*MockUserHandler)(nil)
+)
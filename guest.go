@@ -0,0 +1,228 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package goauth
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// GuestUserID is the user of guest sessions, for example to keep a shopping
+// cart (in the SessionPayloadHandler) before the visitor logs in. The ids of
+// the UserHandlers start at 1, so 0 is never a real user.
+//
+// New in version v0.7
+const GuestUserID uint64 = 0
+
+// ErrGuestSession is returned by SessionController.GetData and
+// ValidateSession if the key belongs to a guest session, the data is only
+// returned by ValidateGuestSession. Guest sessions are not logged in, so all
+// middlewares reject them.
+//
+// New in version v0.7
+var ErrGuestSession = errors.New("The session is a guest session.")
+
+// ErrNotGuestSession is returned by UpgradeSession if the session already
+// belongs to a user.
+//
+// New in version v0.7
+var ErrNotGuestSession = errors.New("The session is not a guest session.")
+
+// IsGuestUser returns true if user is nil or GuestUserID (as any integer
+// type or string).
+//
+// New in version v0.7
+func IsGuestUser(user UserKeyType) bool {
+	if user == nil {
+		return true
+	}
+	id, err := UserKeyToID(user)
+	return err == nil && id == GuestUserID
+}
+
+// withoutGuests returns the users that are not guests.
+func withoutGuests(users []UserKeyType) []UserKeyType {
+	res := make([]UserKeyType, 0, len(users))
+	for _, user := range users {
+		if !IsGuestUser(user) {
+			res = append(res, user)
+		}
+	}
+	return res
+}
+
+// CreateEntry creates the entry with the SessionHandler, a nil user creates
+// a guest session (with user GuestUserID).
+//
+// New in version v0.7
+func (c *SessionController) CreateEntry(user UserKeyType, key string, validDuration time.Duration) (*SessionKeyData, error) {
+	if user == nil {
+		user = GuestUserID
+	}
+	data, err := c.SessionHandler.CreateEntry(user, key, validDuration)
+	if err != nil {
+		return nil, err
+	}
+	data.Guest = IsGuestUser(data.User)
+	return data, nil
+}
+
+// GetData returns the data of the key from the SessionHandler. For guest
+// sessions it returns nil and ErrGuestSession, so code that only checks the
+// returned data never accepts a guest as logged in user. Use
+// ValidateGuestSession to get the data of guest sessions.
+// If the key doesn't exist but a tombstone was recorded for it (see
+// Tombstones) it returns a *SessionRevokedError.
+//
+// New in version v0.7
+func (c *SessionController) GetData(key string) (*SessionKeyData, error) {
+	return c.GetDataForTenant("", key)
+}
+
+// DeleteEntriesForUser removes all keys of the user. It does nothing for
+// guest users: All guest sessions share GuestUserID, so deleting them would
+// end the guest sessions of all visitors. Guest sessions expire and are
+// removed by DeleteInvalidKeys.
+//
+// New in version v0.7
+func (c *SessionController) DeleteEntriesForUser(user UserKeyType) (int64, error) {
+	if IsGuestUser(user) {
+		return 0, nil
+	}
+	return c.SessionHandler.DeleteEntriesForUser(user)
+}
+
+// AddGuestKey is like AddKey but creates a guest session.
+//
+// New in version v0.7
+func (c *SessionController) AddGuestKey(validDuration time.Duration) (*SessionKeyData, string, error) {
+	return c.AddKey(GuestUserID, validDuration)
+}
+
+// CreateGuestSession is like CreateAuthSession but creates a guest session.
+//
+// New in version v0.7
+func (c *SessionController) CreateGuestSession(r *http.Request, store sessions.Store, validDuration time.Duration) (*SessionKeyData, string, *sessions.Session, error) {
+	data, key, session, err := c.CreateAuthSession(r, store, GuestUserID, validDuration)
+	if data != nil {
+		data.Guest = true
+	}
+	return data, key, session, err
+}
+
+// ValidateGuestSession is like ValidateSession but accepts guest sessions
+// as well, check SessionKeyData.Guest to tell them apart.
+//
+// New in version v0.7
+func (c *SessionController) ValidateGuestSession(r *http.Request, store sessions.Store) (*SessionKeyData, *sessions.Session, error) {
+	info, session, err := c.validateSession(r, store)
+	if err == ErrGuestSession {
+		return info, session, nil
+	}
+	if err != nil && c.Metrics != nil {
+		c.Metrics.ValidationFailed(validationFailureReason(err))
+	}
+	return info, session, err
+}
+
+// UpgradeSession attaches the user to the guest session with the given key,
+// for example after the visitor logged in. The guest key is replaced by a
+// new key for the user (keeping the key would allow session fixation: who
+// knows the guest key would be logged in as the user). The payload of the
+// guest session (for example the shopping cart) is copied to the new key if
+// payload is not nil, the new values are valid as long as the new key.
+// The guest key and its payload are deleted.
+//
+// It returns ErrKeyNotFound or ErrInvalidKey if the guest session doesn't
+// exist or is expired and ErrNotGuestSession if it belongs to a user.
+//
+// New in version v0.7
+func (c *SessionController) UpgradeSession(payload SessionPayloadHandler, key string, user UserKeyType, validDuration time.Duration) (*SessionKeyData, string, error) {
+	if IsGuestUser(user) {
+		return nil, "", ErrGuestSession
+	}
+	data, err := c.SessionHandler.GetData(key)
+	if err != nil {
+		return nil, "", err
+	}
+	if KeyInvalid(clockNow(c.Clock), data.ValidUntil) {
+		return nil, "", ErrInvalidKey
+	}
+	if !IsGuestUser(data.User) {
+		return nil, "", ErrNotGuestSession
+	}
+	newData, newKey, err := c.AddKey(user, validDuration)
+	if err != nil {
+		return nil, "", err
+	}
+	if payload != nil {
+		values, err := payload.GetPayload(key)
+		if err != nil {
+			return nil, "", err
+		}
+		for name, value := range values {
+			if err := payload.SetPayloadValue(newKey, name, value, newData.ValidUntil); err != nil {
+				return nil, "", err
+			}
+		}
+		if err := payload.DeletePayload(key); err != nil {
+			return nil, "", err
+		}
+	}
+	if err := c.DeleteKey(key); err != nil {
+		return nil, "", err
+	}
+	return newData, newKey, nil
+}
+
+// UpgradeAuthSession is like CreateAuthSession but upgrades the guest
+// session of the request with UpgradeSession. If the request has no valid
+// guest session a new session is created for the user.
+//
+// Like CreateAuthSession it doesn't call session.Save.
+//
+// New in version v0.7
+func (c *SessionController) UpgradeAuthSession(r *http.Request, store sessions.Store, payload SessionPayloadHandler,
+	user UserKeyType, validDuration time.Duration) (*SessionKeyData, string, *sessions.Session, error) {
+	session, err := c.GetSession(r, store)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	key, err := c.GetKey(session)
+	if err != nil {
+		return c.CreateAuthSession(r, store, user, validDuration)
+	}
+	data, newKey, err := c.UpgradeSession(payload, key, user, validDuration)
+	switch {
+	case err == nil:
+	case isKeyNotFound(err), err == ErrInvalidKey, err == ErrNotGuestSession:
+		return c.CreateAuthSession(r, store, user, validDuration)
+	default:
+		return nil, "", session, err
+	}
+	session.Values[SessionKey] = c.ClientKey(newKey)
+	session.Options.MaxAge = int(validDuration / time.Second)
+	return data, newKey, session, nil
+}
@@ -0,0 +1,671 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/sessions"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrInvalidCredentials is returned by the login handler if the username or
+// the password is wrong.
+var ErrInvalidCredentials = errors.New("Invalid username or password.")
+
+// AuthRequest is the request accepted by the handlers of AuthHandlers.
+// It is either sent as JSON object or as form post with the same field names.
+type AuthRequest struct {
+	UserName  string `json:"username"`
+	Password  string `json:"password"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Email     string `json:"email"`
+	// Captcha is the response of a CAPTCHA, see ChallengePolicy.
+	Captcha string `json:"captcha"`
+	// Token is the invite token, see InviteManager.ServeAcceptInvite.
+	Token string `json:"token"`
+	// DeviceName and DeviceType name the device of the new session, see
+	// AuthHandlers.SessionDevices.
+	DeviceName string `json:"device_name"`
+	DeviceType string `json:"device_type"`
+	// NewPassword is the new password, see
+	// AccountService.ServeChangePassword.
+	NewPassword string `json:"new_password"`
+}
+
+// AuthResponse is the value passed to the renderer on success.
+type AuthResponse struct {
+	Status     string     `json:"status"`
+	UserID     uint64     `json:"user_id,omitempty"`
+	UserName   string     `json:"username,omitempty"`
+	ValidUntil *time.Time `json:"valid_until,omitempty"`
+	// Deleted is the number of sessions ended by logout_all.
+	Deleted int64 `json:"deleted,omitempty"`
+	// NewDevice and NewNetwork are set by login if a NewDeviceDetector
+	// is used.
+	NewDevice  bool `json:"new_device,omitempty"`
+	NewNetwork bool `json:"new_network,omitempty"`
+	// Pending is set by login if the user has to complete the
+	// registration, see AuthHandlers.AllowPending.
+	Pending bool `json:"pending,omitempty"`
+	// ConcurrentSessions is the number of sessions of the user on other
+	// clients, see AuthHandlers.ConcurrentLogins.
+	ConcurrentSessions int `json:"concurrent_sessions,omitempty"`
+	// Token is the session key, it's set by login if
+	// AuthHandlers.ReturnToken is true.
+	Token string `json:"token,omitempty"`
+}
+
+// maxRequestBody is the maximal size of a JSON request body.
+const maxRequestBody = 1 << 16
+
+// ParseAuthRequest parses the request body, either JSON (if the content type
+// is application/json) or a form.
+// Since v0.7 JSON bodies are limited to 64 KiB (forms are limited by
+// net/http to 10 MB).
+func ParseAuthRequest(r *http.Request) (*AuthRequest, error) {
+	res := &AuthRequest{}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		if err := json.NewDecoder(http.MaxBytesReader(nil, r.Body, maxRequestBody)).Decode(res); err != nil {
+			return nil, err
+		}
+		return res, nil
+	}
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+	res.UserName = r.PostFormValue("username")
+	res.Password = r.PostFormValue("password")
+	res.FirstName = r.PostFormValue("first_name")
+	res.LastName = r.PostFormValue("last_name")
+	res.Email = r.PostFormValue("email")
+	res.Token = r.PostFormValue("token")
+	res.DeviceName = r.PostFormValue("device_name")
+	res.DeviceType = r.PostFormValue("device_type")
+	res.NewPassword = r.PostFormValue("new_password")
+	// the widgets of the providers use different field names
+	for _, field := range []string{"captcha", "g-recaptcha-response", "h-captcha-response", "cf-turnstile-response"} {
+		if res.Captcha = r.PostFormValue(field); res.Captcha != "" {
+			break
+		}
+	}
+	return res, nil
+}
+
+// RenderJSON writes value as JSON with the given status code.
+// It's the default renderer of AuthHandlers.
+func RenderJSON(w http.ResponseWriter, r *http.Request, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+// RenderJSONError writes {"error": err.Error()} with the given status code.
+// For internal errors (status 500) the error is logged and only a generic
+// message is written.
+// It's the default error renderer of AuthHandlers.
+func RenderJSONError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	msg := err.Error()
+	if status == http.StatusInternalServerError {
+		log.WithError(err).Error("goauth: Internal error in auth handler")
+		msg = http.StatusText(status)
+	}
+	RenderJSON(w, r, status, map[string]string{"error": msg})
+}
+
+// AuthHandlers provides http.HandlerFuncs for login, logout, logout of all
+// sessions and registration. They connect a UserHandler and a
+// SessionController, the session stores the id of the user as uint64.
+//
+// The request body is parsed with ParseAuthRequest, so JSON and forms work.
+// The responses are written by Render and RenderError, they default to JSON
+// but you can for example set them to functions that redirect for
+// classic form-based apps.
+//
+// Usage:
+//
+//	h := goauth.NewAuthHandlers(users, controller, store)
+//	http.HandleFunc("/login", h.Login)
+//	http.HandleFunc("/logout", h.Logout)
+//	http.HandleFunc("/logout_all", h.LogoutAll)
+//	http.HandleFunc("/register", h.Register)
+//
+// For progressive profiling use RegisterPending instead of Register and
+// CompleteRegistration with AllowPending set, the UserHandler must implement
+// PendingUserHandler.
+//
+// New in version v0.7
+type AuthHandlers struct {
+	Users      UserHandler
+	Controller *SessionController
+	Store      sessions.Store
+
+	// SessionDuration is the duration of a new session, defaults to 24
+	// hours.
+	SessionDuration time.Duration
+
+	// LoginService is used to validate the credentials if it is not nil, so login
+	// attempts are rate limited. Requests above the limit get a 429 response
+	// with a Retry-After header.
+	LoginService *LoginService
+
+	// Fingerprints binds new sessions to the client, may be nil.
+	Fingerprints *FingerprintBinding
+
+	// ConcurrentLogins detects logins while the user is logged in on other
+	// clients, the result is part of the response. May be nil, it requires
+	// Fingerprints.
+	//
+	// New in version v0.7
+	ConcurrentLogins *ConcurrentLoginDetector
+
+	// Devices detects logins from new devices, the result is part of the
+	// response. May be nil.
+	Devices *NewDeviceDetector
+
+	// LoginChallenge and RegisterChallenge require a CAPTCHA for login and
+	// registration, may be nil.
+	LoginChallenge, RegisterChallenge *ChallengePolicy
+
+	// Policy is evaluated after the credentials were verified and before
+	// the session is created, may be nil.
+	// If the policy denies the login the response is 403 with
+	// ErrLoginDenied.
+	Policy LoginPolicy
+
+	// StepUp is called if Policy requires an additional authentication
+	// step instead of creating a session, it should start the step (for
+	// example redirect to a second factor page). If it is nil the response
+	// is 401 with ErrStepUpRequired.
+	StepUp func(w http.ResponseWriter, r *http.Request, attempt *LoginAttempt)
+
+	// UnverifiedScopes restricts the sessions of users whose email address
+	// is not verified to the given scopes (see AddScopedKey), Controller.Payload
+	// must be set to store them. If it is nil sessions are not restricted.
+	// Restricted sessions can only access the routes protected by
+	// SessionMiddleware.RequireScope.
+	// The restriction isn't lifted on verification, the user has to log in
+	// again.
+	UnverifiedScopes []string
+	Payload          SessionPayloadHandler
+
+	// SessionDevices stores the device of each new session in Payload, see
+	// SessionDeviceFromRequest. The client can name the device with the
+	// fields device_name and device_type of the login request.
+	//
+	// New in version v0.7
+	SessionDevices bool
+
+	// ReturnToken makes Login return the session key in the field token of
+	// the response, for API clients that send it in Controller.TokenHeader
+	// instead of using the cookie.
+	//
+	// New in version v0.7
+	ReturnToken bool
+
+	// AllowPending allows users that haven't completed the registration
+	// to log in, see PendingUserHandler. The response has Pending set so
+	// the UI can resume the onboarding. If it is false the response is 403
+	// with ErrRegistrationPending.
+	AllowPending bool
+
+	// Metrics is informed about the result of each login, may be nil.
+	Metrics Metrics
+
+	// Notifier gets EventLoginSucceeded, EventLoginFailed (for invalid
+	// credentials) and EventSessionRevoked (for logout_all) events, may be
+	// nil. Use an EventBus to inform several subscribers.
+	Notifier SecurityNotifier
+
+	// Render writes the response on success, value is an *AuthResponse.
+	Render func(w http.ResponseWriter, r *http.Request, status int, value interface{})
+
+	// RenderError writes the response for an error.
+	RenderError func(w http.ResponseWriter, r *http.Request, status int, err error)
+}
+
+// NewAuthHandlers returns new AuthHandlers that render JSON.
+func NewAuthHandlers(users UserHandler, controller *SessionController, store sessions.Store) *AuthHandlers {
+	return &AuthHandlers{Users: users, Controller: controller, Store: store,
+		SessionDuration: 24 * time.Hour, Render: RenderJSON,
+		RenderError: RenderJSONError}
+}
+
+func requirePost(w http.ResponseWriter, r *http.Request, renderError func(w http.ResponseWriter, r *http.Request, status int, err error)) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		renderError(w, r, http.StatusMethodNotAllowed, errors.New("POST required"))
+		return false
+	}
+	return true
+}
+
+// checkChallenge checks the CAPTCHA if the policy requires it, it returns
+// false if it failed (and wrote a response).
+func (h *AuthHandlers) checkChallenge(w http.ResponseWriter, r *http.Request, policy *ChallengePolicy, token, ip string) bool {
+	if policy == nil {
+		return true
+	}
+	err := policy.Check(token, ip)
+	switch {
+	case err == nil:
+		return true
+	case err == ErrChallengeFailed:
+		h.RenderError(w, r, http.StatusForbidden, err)
+	default:
+		h.RenderError(w, r, http.StatusInternalServerError, err)
+	}
+	return false
+}
+
+// Login validates the username and password and creates a new session.
+func (h *AuthHandlers) Login(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r, h.RenderError) {
+		return
+	}
+	req, err := ParseAuthRequest(r)
+	if err != nil {
+		h.RenderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	ip := ClientIP(r)
+	if !h.checkChallenge(w, r, h.LoginChallenge, req.Captcha, ip) {
+		return
+	}
+	result := LoginResultError
+	if h.Metrics != nil {
+		defer func() { h.Metrics.LoginAttempt(result) }()
+	}
+	var id uint64
+	tenant, _ := TenantFromContext(r.Context())
+	if h.LoginService != nil {
+		id, err = h.LoginService.ValidateForTenant(tenant, req.UserName, []byte(req.Password), ip)
+		if rateErr, ok := err.(*RateLimitError); ok {
+			result = LoginResultRateLimited
+			SetRetryAfter(w, rateErr.RetryAfter)
+			h.RenderError(w, r, http.StatusTooManyRequests, rateErr)
+			return
+		}
+		if err == ErrIPBanned {
+			result = LoginResultBanned
+			h.RenderError(w, r, http.StatusForbidden, err)
+			return
+		}
+	} else {
+		id, err = ValidateForTenant(h.Users, tenant, req.UserName, []byte(req.Password))
+	}
+	pending := err == ErrRegistrationPending
+	if pending {
+		if !h.AllowPending {
+			result = LoginResultPending
+			h.RenderError(w, r, http.StatusForbidden, err)
+			return
+		}
+		err = nil
+	}
+	if err == ErrVerificationBusy {
+		result = LoginResultBusy
+		SetRetryAfter(w, time.Second)
+		h.RenderError(w, r, http.StatusServiceUnavailable, err)
+		return
+	}
+	if err == ErrUserInactive {
+		result = LoginResultDenied
+		h.RenderError(w, r, http.StatusForbidden, err)
+		return
+	}
+	if err != nil && err != ErrUserNotFound {
+		h.RenderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if err == ErrUserNotFound || id == NoUserID {
+		result = LoginResultInvalid
+		h.notify(r, EventLoginFailed, NoUserID, req.UserName, nil)
+		if h.LoginChallenge != nil {
+			h.LoginChallenge.RecordFailure(ip)
+		}
+		h.RenderError(w, r, http.StatusUnauthorized, ErrInvalidCredentials)
+		return
+	}
+	if h.LoginChallenge != nil {
+		h.LoginChallenge.Reset(ip)
+	}
+	var attempt *LoginAttempt
+	activeFlag := hasActiveFlag(h.Users)
+	if h.Policy != nil || h.UnverifiedScopes != nil || activeFlag {
+		if attempt, err = NewLoginAttempt(r, h.Users, req.UserName); err != nil {
+			h.RenderError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	if activeFlag && !attempt.User.IsActive {
+		result = LoginResultDenied
+		h.RenderError(w, r, http.StatusForbidden, ErrUserInactive)
+		return
+	}
+	if h.Policy != nil {
+		decision, err := h.Policy.Evaluate(attempt)
+		if err != nil {
+			h.RenderError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		switch decision {
+		case LoginDeny:
+			result = LoginResultDenied
+			h.RenderError(w, r, http.StatusForbidden, ErrLoginDenied)
+			return
+		case LoginStepUp:
+			result = LoginResultStepUp
+			if h.StepUp != nil {
+				h.StepUp(w, r, attempt)
+			} else {
+				h.RenderError(w, r, http.StatusUnauthorized, ErrStepUpRequired)
+			}
+			return
+		}
+	}
+	var signal *LoginSignal
+	if h.Devices != nil {
+		if signal, err = h.Devices.Check(r, id, req.UserName); err != nil {
+			h.RenderError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	data, key, session, err := h.Controller.CreateAuthSession(r, h.Store, id, h.SessionDuration)
+	if err != nil {
+		h.RenderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if h.UnverifiedScopes != nil && !attempt.User.EmailVerified {
+		if err := h.Controller.setScopes(key, data.ValidUntil, h.UnverifiedScopes); err != nil {
+			if delErr := h.Controller.DeleteKey(key); delErr != nil {
+				log.WithError(delErr).Error("goauth: Can't delete key after failing to store its scopes")
+			}
+			h.RenderError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	if h.SessionDevices {
+		if err := SetSessionDevice(h.Payload, key, data.ValidUntil, SessionDeviceFromRequest(r, req)); err != nil {
+			if delErr := h.Controller.DeleteKey(key); delErr != nil {
+				log.WithError(delErr).Error("goauth: Can't delete key after failing to store its device")
+			}
+			status := http.StatusInternalServerError
+			if err == ErrInvalidDeviceName {
+				status = http.StatusBadRequest
+			}
+			h.RenderError(w, r, status, err)
+			return
+		}
+	}
+	if h.Fingerprints != nil {
+		if err := h.Fingerprints.Bind(r, key, data); err != nil {
+			if delErr := h.Controller.DeleteKey(key); delErr != nil {
+				log.WithError(delErr).Error("goauth: Can't delete key after failing to bind its fingerprint")
+			}
+			h.RenderError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	concurrent := 0
+	if h.ConcurrentLogins != nil {
+		// the session exists already, so don't fail the login
+		if concurrent, err = h.ConcurrentLogins.Check(r, key, id, req.UserName); err != nil {
+			log.WithError(err).Error("goauth: Can't check for concurrent sessions")
+		}
+	}
+	if err := session.Save(r, w); err != nil {
+		if delErr := h.Controller.DeleteKey(key); delErr != nil {
+			log.WithError(delErr).Error("goauth: Can't delete key after failing to save the session")
+		}
+		h.RenderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	resp := &AuthResponse{Status: "ok", UserID: id, UserName: req.UserName,
+		ValidUntil: &data.ValidUntil, Pending: pending, ConcurrentSessions: concurrent}
+	if signal != nil {
+		resp.NewDevice, resp.NewNetwork = signal.NewDevice, signal.NewNetwork
+	}
+	if h.ReturnToken {
+		resp.Token = h.Controller.ClientKey(key)
+		SetTokenExpiry(w, data)
+	}
+	result = LoginResultSuccess
+	h.notify(r, EventLoginSucceeded, id, req.UserName, nil)
+	h.Render(w, r, http.StatusOK, resp)
+}
+
+// notify sends an event to the Notifier if it is not nil.
+func (h *AuthHandlers) notify(r *http.Request, eventType string, id uint64, userName string, data map[string]string) {
+	if h.Notifier == nil {
+		return
+	}
+	event := NewSecurityEvent(eventType, id, userName)
+	event.IP = ClientIP(r)
+	event.Data = data
+	h.Notifier.Notify(event)
+}
+
+// Logout ends the current session.
+func (h *AuthHandlers) Logout(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r, h.RenderError) {
+		return
+	}
+	if err := h.Controller.EndSession(r, h.Store); err != nil {
+		h.RenderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	// the session is cached for the request, so this is the session
+	// EndSession changed
+	session, err := h.Controller.GetSession(r, h.Store)
+	if err == nil {
+		session.Options.MaxAge = -1
+		session.Save(r, w)
+	}
+	h.Render(w, r, http.StatusOK, &AuthResponse{Status: "ok"})
+}
+
+// LogoutAll ends all sessions of the current user (on all devices).
+func (h *AuthHandlers) LogoutAll(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r, h.RenderError) {
+		return
+	}
+	var data *SessionKeyData
+	var session *sessions.Session
+	var err error
+	if h.Controller.SessionToken(r) != "" {
+		data, _, err = h.Controller.ValidateToken(r)
+	} else {
+		data, session, err = h.Controller.ValidateSession(r, h.Store)
+	}
+	if err != nil {
+		if isAuthError(err) {
+			h.RenderError(w, r, http.StatusUnauthorized, err)
+		} else {
+			h.RenderError(w, r, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	num, err := h.Controller.RevokeEntriesForUser(data.User, ReasonLogout)
+	if err != nil {
+		h.RenderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if id, err := UserKeyToID(data.User); err == nil {
+		h.notify(r, EventSessionRevoked, id, "",
+			map[string]string{"sessions": strconv.FormatInt(num, 10)})
+	}
+	if session != nil {
+		session.Options.MaxAge = -1
+		session.Save(r, w)
+	}
+	h.Render(w, r, http.StatusOK, &AuthResponse{Status: "ok", Deleted: num})
+}
+
+// Register creates a new user, it doesn't log the user in.
+func (h *AuthHandlers) Register(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r, h.RenderError) {
+		return
+	}
+	req, err := ParseAuthRequest(r)
+	if err != nil {
+		h.RenderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if !h.checkChallenge(w, r, h.RegisterChallenge, req.Captcha, ClientIP(r)) {
+		return
+	}
+	if req.UserName == "" || req.Password == "" {
+		h.RenderError(w, r, http.StatusBadRequest, errors.New("Username and password are required."))
+		return
+	}
+	_, err = h.Users.GetUserID(req.UserName)
+	switch {
+	case err == nil:
+		h.RenderError(w, r, http.StatusConflict, ErrDuplicateUsername)
+		return
+	case err != ErrUserNotFound:
+		h.RenderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	id, err := h.Users.Insert(req.UserName, req.FirstName, req.LastName, req.Email, []byte(req.Password))
+	h.inserted(w, r, req.UserName, id, err)
+}
+
+// RegisterPending creates a new user with only username, email and password,
+// the user must complete the registration with CompleteRegistration. The
+// username is required: The email is not verified yet, so it's not used as
+// the username (that would let anyone claim the address of somebody else as
+// a username). It doesn't log the user in.
+// The UserHandler must implement PendingUserHandler, otherwise the response
+// is 501.
+//
+// New in version v0.7
+func (h *AuthHandlers) RegisterPending(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r, h.RenderError) {
+		return
+	}
+	pendingUsers, ok := h.Users.(PendingUserHandler)
+	if !ok {
+		h.RenderError(w, r, http.StatusNotImplemented, ErrNotSupported)
+		return
+	}
+	req, err := ParseAuthRequest(r)
+	if err != nil {
+		h.RenderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if !h.checkChallenge(w, r, h.RegisterChallenge, req.Captcha, ClientIP(r)) {
+		return
+	}
+	if req.UserName == "" || req.Email == "" || req.Password == "" {
+		h.RenderError(w, r, http.StatusBadRequest, errors.New("Username, email and password are required."))
+		return
+	}
+	_, err = h.Users.GetUserID(req.UserName)
+	switch {
+	case err == nil:
+		h.RenderError(w, r, http.StatusConflict, ErrDuplicateUsername)
+		return
+	case err != ErrUserNotFound:
+		h.RenderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	id, err := pendingUsers.InsertPending(req.UserName, req.Email, []byte(req.Password))
+	h.inserted(w, r, req.UserName, id, err)
+}
+
+// inserted writes the response of the registration handlers given the
+// result of the insert.
+func (h *AuthHandlers) inserted(w http.ResponseWriter, r *http.Request, userName string, id uint64, err error) {
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrDuplicateUsername):
+			h.RenderError(w, r, http.StatusConflict, ErrDuplicateUsername)
+		case errors.Is(err, ErrDuplicateEmail):
+			h.RenderError(w, r, http.StatusConflict, ErrDuplicateEmail)
+		case err == ErrUsernameReserved:
+			h.RenderError(w, r, http.StatusConflict, err)
+		default:
+			h.RenderError(w, r, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	if id == NoUserID {
+		if id, err = h.Users.GetUserID(userName); err != nil {
+			h.RenderError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	h.Render(w, r, http.StatusCreated, &AuthResponse{Status: "ok", UserID: id,
+		UserName: userName})
+}
+
+// CompleteRegistration sets first_name and last_name of the user of the
+// session (see SessionMiddleware) and completes the registration, see PendingUserHandler.
+// The UserHandler must implement PendingUserHandler, otherwise the response
+// is 501.
+//
+// New in version v0.7
+func (h *AuthHandlers) CompleteRegistration(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r, h.RenderError) {
+		return
+	}
+	pendingUsers, ok := h.Users.(PendingUserHandler)
+	if !ok {
+		h.RenderError(w, r, http.StatusNotImplemented, ErrNotSupported)
+		return
+	}
+	id, ok := UserIDFromContext(r.Context())
+	if !ok {
+		h.RenderError(w, r, http.StatusUnauthorized, ErrInvalidCredentials)
+		return
+	}
+	req, err := ParseAuthRequest(r)
+	if err != nil {
+		h.RenderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if req.FirstName == "" || req.LastName == "" {
+		h.RenderError(w, r, http.StatusBadRequest, errors.New("First and last name are required."))
+		return
+	}
+	userName, err := h.Users.GetUserName(id)
+	if err != nil {
+		h.RenderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if err := pendingUsers.CompleteRegistration(userName, req.FirstName, req.LastName); err != nil {
+		h.RenderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	h.Render(w, r, http.StatusOK, &AuthResponse{Status: "ok", UserID: id,
+		UserName: userName})
+}
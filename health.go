@@ -0,0 +1,157 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// HealthChecker is implemented by handlers that can check the connection to
+// their backend, for example with a PING or a lightweight query.
+// SQLSessionHandler, SQLUserHandler, RedisSessionHandler, RedisUserHandler
+// and SessionController implement this interface.
+//
+// New in version v0.7
+type HealthChecker interface {
+	// Healthy returns nil if the backend is reachable.
+	Healthy(ctx context.Context) error
+}
+
+// HealthCheckFunc is a function that implements HealthChecker.
+//
+// New in version v0.7
+type HealthCheckFunc func(ctx context.Context) error
+
+// Healthy calls f.
+func (f HealthCheckFunc) Healthy(ctx context.Context) error {
+	return f(ctx)
+}
+
+// HealthError is returned by CheckHealth, it maps the names of the failed
+// checks to their errors.
+//
+// New in version v0.7
+type HealthError map[string]error
+
+func (e HealthError) Error() string {
+	names := e.Failed()
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = fmt.Sprintf("%s: %v", name, e[name])
+	}
+	return "goauth: Health checks failed: " + strings.Join(parts, "; ")
+}
+
+// Failed returns the sorted names of the failed checks.
+func (e HealthError) Failed() []string {
+	res := make([]string, 0, len(e))
+	for name := range e {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// CheckHealth runs all checks concurrently and returns a HealthError if one
+// of them failed.
+//
+// New in version v0.7
+func CheckHealth(ctx context.Context, checks map[string]HealthChecker) error {
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	failed := make(HealthError)
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check HealthChecker) {
+			defer wg.Done()
+			if err := check.Healthy(ctx); err != nil {
+				mutex.Lock()
+				failed[name] = err
+				mutex.Unlock()
+			}
+		}(name, check)
+	}
+	wg.Wait()
+	if len(failed) > 0 {
+		return failed
+	}
+	return nil
+}
+
+// Healthy checks the SessionHandler if it implements HealthChecker,
+// otherwise it returns nil.
+//
+// New in version v0.7
+func (c *SessionController) Healthy(ctx context.Context) error {
+	if checker, ok := c.SessionHandler.(HealthChecker); ok {
+		return checker.Healthy(ctx)
+	}
+	return nil
+}
+
+// HealthHandler returns a handler for /healthz endpoints that runs the checks
+// with the given timeout (no timeout if it's <= 0).
+// The response is 200 and {"status": "ok"} if all checks passed and 503 and
+// {"status": "unavailable", "failed": [names]} otherwise, the errors are
+// only logged.
+//
+// Usage:
+//
+//	http.Handle("/healthz", goauth.HealthHandler(2*time.Second, map[string]goauth.HealthChecker{
+//		"sessions": controller,
+//		"users":    users,
+//	}))
+//
+// New in version v0.7
+func HealthHandler(timeout time.Duration, checks map[string]HealthChecker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		err := CheckHealth(ctx, checks)
+		if err == nil {
+			RenderJSON(w, r, http.StatusOK, map[string]string{"status": "ok"})
+			return
+		}
+		log.WithError(err).Error("goauth: Health check failed")
+		var failed []string
+		if healthErr, ok := err.(HealthError); ok {
+			failed = healthErr.Failed()
+		}
+		RenderJSON(w, r, http.StatusServiceUnavailable, map[string]interface{}{
+			"status": "unavailable",
+			"failed": failed,
+		})
+	}
+}
@@ -0,0 +1,568 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrIdentityNotFound is returned by an IdentityHandler if there is no user
+// linked to a given provider / subject pair.
+//
+// New in version v0.7
+var ErrIdentityNotFound = errors.New("No user is linked with this external identity.")
+
+// ErrIdentityAlreadyLinked is returned when trying to link an external
+// identity that is already linked with a user.
+//
+// New in version v0.7
+var ErrIdentityAlreadyLinked = errors.New("The external identity is already linked with a user.")
+
+// ErrLastCredential is returned when trying to unlink the last external
+// identity of a user that has no password, the user would not be able to
+// log in any more.
+//
+// New in version v0.7
+var ErrLastCredential = errors.New("Can't remove the last credential of a user.")
+
+// ExternalIdentity links an account at an external identity provider (such
+// as Google or GitHub) to a user of the UserHandler.
+// Provider is the name of the provider (as used in the LoginManager of the
+// oauth2auth adapter) and Subject is the unique and stable identifier of the
+// account at the provider (the "sub" claim for OpenID Connect providers).
+//
+// New in version v0.7
+type ExternalIdentity struct {
+	Provider, Subject string
+	UserID            uint64
+	Created           time.Time
+}
+
+// IdentityHandler stores the mapping provider + subject -> user id, the
+// external_identities store.
+//
+// New in version v0.7
+type IdentityHandler interface {
+	// Init initializes the storage, it must not fail if called several times.
+	Init() error
+
+	// GetUserID returns the id of the user linked with the identity at the
+	// provider.
+	// Returns NoUserID and ErrIdentityNotFound if no such link exists.
+	GetUserID(provider, subject string) (uint64, error)
+
+	// AddIdentity links the subject at the provider with the user.
+	// A provider / subject pair can only be linked with one user, an error
+	// is returned if there already is a link for the pair.
+	AddIdentity(userID uint64, provider, subject string) error
+
+	// ListIdentities returns all identities linked with the user.
+	ListIdentities(userID uint64) ([]*ExternalIdentity, error)
+
+	// DeleteIdentity removes the link for the identity at the provider.
+	// If there is no such link it does nothing.
+	DeleteIdentity(provider, subject string) error
+}
+
+// IdentityUnlinker is implemented by IdentityHandlers that can check and
+// remove an identity of a user atomically, IdentityManager.UnlinkIdentity
+// uses it so that concurrent requests can't remove all identities of a user.
+// InMemoryIdentityHandler and SQLIdentityHandler implement this interface.
+//
+// New in version v0.7
+type IdentityUnlinker interface {
+	// UnlinkIdentity removes the link for the identity at the provider.
+	// It returns ErrIdentityNotFound if the identity is not linked with
+	// the user and, if keepLast is true, ErrLastCredential if it is the
+	// last identity of the user.
+	UnlinkIdentity(userID uint64, provider, subject string, keepLast bool) error
+}
+
+// checkUnlink returns the error of IdentityUnlinker.UnlinkIdentity given the
+// identities of the user.
+func checkUnlink(identities []*ExternalIdentity, provider, subject string, keepLast bool) error {
+	found := false
+	for _, identity := range identities {
+		if identity.Provider == provider && identity.Subject == subject {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return ErrIdentityNotFound
+	}
+	if keepLast && len(identities) == 1 {
+		return ErrLastCredential
+	}
+	return nil
+}
+
+// InMemoryIdentityHandler is an IdentityHandler that keeps all links in memory.
+//
+// New in version v0.7
+type InMemoryIdentityHandler struct {
+	identities map[string]*ExternalIdentity
+	mutex      sync.RWMutex
+}
+
+// NewInMemoryIdentityHandler returns a new InMemoryIdentityHandler.
+//
+// New in version v0.7
+func NewInMemoryIdentityHandler() *InMemoryIdentityHandler {
+	return &InMemoryIdentityHandler{identities: make(map[string]*ExternalIdentity)}
+}
+
+// identityMapKey returns the key an identity is stored with in the map.
+func identityMapKey(provider, subject string) string {
+	return provider + "\x00" + subject
+}
+
+func (h *InMemoryIdentityHandler) Init() error {
+	return nil
+}
+
+func (h *InMemoryIdentityHandler) GetUserID(provider, subject string) (uint64, error) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	if identity, has := h.identities[identityMapKey(provider, subject)]; has {
+		return identity.UserID, nil
+	}
+	return NoUserID, ErrIdentityNotFound
+}
+
+func (h *InMemoryIdentityHandler) AddIdentity(userID uint64, provider, subject string) error {
+	mapKey := identityMapKey(provider, subject)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if _, has := h.identities[mapKey]; has {
+		return ErrIdentityAlreadyLinked
+	}
+	h.identities[mapKey] = &ExternalIdentity{Provider: provider, Subject: subject,
+		UserID: userID, Created: CurrentTime()}
+	return nil
+}
+
+func (h *InMemoryIdentityHandler) ListIdentities(userID uint64) ([]*ExternalIdentity, error) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	res := make([]*ExternalIdentity, 0)
+	for _, identity := range h.identities {
+		if identity.UserID == userID {
+			identityCopy := *identity
+			res = append(res, &identityCopy)
+		}
+	}
+	return res, nil
+}
+
+func (h *InMemoryIdentityHandler) DeleteIdentity(provider, subject string) error {
+	h.mutex.Lock()
+	delete(h.identities, identityMapKey(provider, subject))
+	h.mutex.Unlock()
+	return nil
+}
+
+func (h *InMemoryIdentityHandler) UnlinkIdentity(userID uint64, provider, subject string, keepLast bool) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	var identities []*ExternalIdentity
+	for _, identity := range h.identities {
+		if identity.UserID == userID {
+			identities = append(identities, identity)
+		}
+	}
+	if err := checkUnlink(identities, provider, subject, keepLast); err != nil {
+		return err
+	}
+	delete(h.identities, identityMapKey(provider, subject))
+	return nil
+}
+
+// SQLIdentityQueries stores the queries used by SQLIdentityHandler.
+// The default scheme looks as follows (in MySQL syntax):
+//
+//	  CREATE TABLE IF NOT EXISTS external_identities (
+//			provider VARCHAR(50) NOT NULL,
+//			subject VARCHAR(255) NOT NULL,
+//			user_id BIGINT UNSIGNED NOT NULL,
+//			created DATETIME NOT NULL,
+//			PRIMARY KEY(provider, subject)
+//		);
+//
+// New in version v0.7
+type SQLIdentityQueries struct {
+	// InitQuery creates the external_identities table if it doesn't exist.
+	InitQuery string
+
+	// GetUserQuery selects the user_id given provider and subject.
+	GetUserQuery string
+
+	// InsertQuery inserts a new identity, the values are passed in the order
+	// provider, subject, user_id, created.
+	InsertQuery string
+
+	// ListQuery selects provider, subject and created for all identities
+	// given the user_id.
+	ListQuery string
+
+	// DeleteQuery deletes the identity given provider and subject.
+	DeleteQuery string
+
+	// LockQuery selects provider and subject for all identities given the
+	// user_id and locks the rows until the end of the transaction (SELECT
+	// ... FOR UPDATE), it is used by UnlinkIdentity.
+	//
+	// New in version v0.7
+	LockQuery string
+
+	// TimeFromScanType is used to transform database time entries to
+	// gos time. See SQLSessionHandler for details.
+	TimeFromScanType func(val interface{}) (time.Time, error)
+}
+
+// MySQLIdentityQueries provides queries to use with MySQL.
+//
+// New in version v0.7
+func MySQLIdentityQueries() *SQLIdentityQueries {
+	initQ := `
+	CREATE TABLE IF NOT EXISTS external_identities (
+		provider VARCHAR(50) NOT NULL,
+		subject VARCHAR(255) NOT NULL,
+		user_id BIGINT UNSIGNED NOT NULL,
+		created DATETIME NOT NULL,
+		PRIMARY KEY(provider, subject)
+	);
+	`
+	return &SQLIdentityQueries{InitQuery: initQ,
+		GetUserQuery:     "SELECT user_id FROM external_identities WHERE provider=? AND subject=?",
+		InsertQuery:      "INSERT INTO external_identities (provider, subject, user_id, created) VALUES(?, ?, ?, ?)",
+		ListQuery:        "SELECT provider, subject, created FROM external_identities WHERE user_id=?",
+		DeleteQuery:      "DELETE FROM external_identities WHERE provider=? AND subject=?",
+		LockQuery:        "SELECT provider, subject FROM external_identities WHERE user_id=? FOR UPDATE",
+		TimeFromScanType: DefaultTimeFromScanType}
+}
+
+// PostgresIdentityQueries provides queries to use with postgres.
+//
+// New in version v0.7
+func PostgresIdentityQueries() *SQLIdentityQueries {
+	initQ := `
+	CREATE TABLE IF NOT EXISTS external_identities (
+		provider varchar(50) NOT NULL,
+		subject varchar(255) NOT NULL,
+		user_id bigint NOT NULL,
+		created timestamp NOT NULL,
+		PRIMARY KEY(provider, subject)
+	);
+	`
+	return &SQLIdentityQueries{InitQuery: initQ,
+		GetUserQuery:     "SELECT user_id FROM external_identities WHERE provider = $1 AND subject = $2",
+		InsertQuery:      "INSERT INTO external_identities (provider, subject, user_id, created) VALUES ($1, $2, $3, $4)",
+		ListQuery:        "SELECT provider, subject, created FROM external_identities WHERE user_id = $1",
+		DeleteQuery:      "DELETE FROM external_identities WHERE provider = $1 AND subject = $2",
+		LockQuery:        "SELECT provider, subject FROM external_identities WHERE user_id = $1 FOR UPDATE",
+		TimeFromScanType: DefaultTimeFromScanType}
+}
+
+// SQLite3IdentityQueries provides queries to use with sqlite3.
+//
+// New in version v0.7
+func SQLite3IdentityQueries() *SQLIdentityQueries {
+	// the MySQL queries work fine, except that sqlite has no row locks (the
+	// handler locks the whole database instead)
+	res := MySQLIdentityQueries()
+	res.LockQuery = "SELECT provider, subject FROM external_identities WHERE user_id=?"
+	return res
+}
+
+// SQLIdentityHandler implements IdentityHandler by executing the queries
+// defined in an instance of SQLIdentityQueries.
+//
+// New in version v0.7
+type SQLIdentityHandler struct {
+	*SQLIdentityQueries
+
+	// DB is the database to execute the queries on.
+	DB *sql.DB
+
+	blockDB bool
+	mutex   sync.RWMutex
+}
+
+// NewSQLIdentityHandler returns a new SQLIdentityHandler, blockDB has the
+// same meaning as in NewSQLUserHandler.
+//
+// New in version v0.7
+func NewSQLIdentityHandler(queries *SQLIdentityQueries, db *sql.DB, blockDB bool) *SQLIdentityHandler {
+	return &SQLIdentityHandler{SQLIdentityQueries: queries, DB: db, blockDB: blockDB}
+}
+
+// NewMySQLIdentityHandler returns a new SQLIdentityHandler that uses MySQL.
+//
+// New in version v0.7
+func NewMySQLIdentityHandler(db *sql.DB) *SQLIdentityHandler {
+	return NewSQLIdentityHandler(MySQLIdentityQueries(), db, false)
+}
+
+// NewPostgresIdentityHandler returns a new SQLIdentityHandler that uses
+// postgres.
+//
+// New in version v0.7
+func NewPostgresIdentityHandler(db *sql.DB) *SQLIdentityHandler {
+	return NewSQLIdentityHandler(PostgresIdentityQueries(), db, false)
+}
+
+// NewSQLite3IdentityHandler returns a new SQLIdentityHandler that uses
+// sqlite3.
+//
+// New in version v0.7
+func NewSQLite3IdentityHandler(db *sql.DB) *SQLIdentityHandler {
+	return NewSQLIdentityHandler(SQLite3IdentityQueries(), db, true)
+}
+
+func (handler *SQLIdentityHandler) Init() error {
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	_, err := handler.DB.Exec(handler.InitQuery)
+	return err
+}
+
+func (handler *SQLIdentityHandler) GetUserID(provider, subject string) (uint64, error) {
+	if handler.blockDB {
+		handler.mutex.RLock()
+		defer handler.mutex.RUnlock()
+	}
+	row := handler.DB.QueryRow(handler.GetUserQuery, provider, subject)
+	var id uint64
+	if err := row.Scan(&id); err != nil {
+		if err == sql.ErrNoRows {
+			return NoUserID, ErrIdentityNotFound
+		}
+		return NoUserID, err
+	}
+	return id, nil
+}
+
+func (handler *SQLIdentityHandler) AddIdentity(userID uint64, provider, subject string) error {
+	now := CurrentTime()
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	_, err := handler.DB.Exec(handler.InsertQuery, provider, subject, userID, now)
+	if IsDuplicateKeyError(err) {
+		// linked concurrently, LinkIdentity only checks before inserting
+		return ErrIdentityAlreadyLinked
+	}
+	return err
+}
+
+func (handler *SQLIdentityHandler) ListIdentities(userID uint64) ([]*ExternalIdentity, error) {
+	if handler.blockDB {
+		handler.mutex.RLock()
+		defer handler.mutex.RUnlock()
+	}
+	rows, err := handler.DB.Query(handler.ListQuery, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make([]*ExternalIdentity, 0)
+	for rows.Next() {
+		var provider, subject string
+		var createdVal interface{}
+		if scanErr := rows.Scan(&provider, &subject, &createdVal); scanErr != nil {
+			return nil, scanErr
+		}
+		created, timeErr := handler.TimeFromScanType(createdVal)
+		if timeErr != nil {
+			return nil, timeErr
+		}
+		res = append(res, &ExternalIdentity{Provider: provider, Subject: subject,
+			UserID: userID, Created: created})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (handler *SQLIdentityHandler) DeleteIdentity(provider, subject string) error {
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	_, err := handler.DB.Exec(handler.DeleteQuery, provider, subject)
+	return err
+}
+
+// UnlinkIdentity checks and deletes the identity in a transaction, the
+// identities of the user are locked with LockQuery.
+func (handler *SQLIdentityHandler) UnlinkIdentity(userID uint64, provider, subject string, keepLast bool) error {
+	if handler.LockQuery == "" {
+		return ErrNotSupported
+	}
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	tx, err := handler.DB.Begin()
+	if err != nil {
+		return err
+	}
+	rows, err := tx.Query(handler.LockQuery, userID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	var identities []*ExternalIdentity
+	for rows.Next() {
+		identity := &ExternalIdentity{UserID: userID}
+		if err := rows.Scan(&identity.Provider, &identity.Subject); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return err
+		}
+		identities = append(identities, identity)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := checkUnlink(identities, provider, subject, keepLast); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(handler.DeleteQuery, provider, subject); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// IdentityManager is used to link and unlink external identities with
+// existing users, for example to allow a user that logs in with a password
+// to log in with their Google account as well.
+//
+// To link an account start a login with the oauth2auth LoginManager while the
+// user is logged in. The callback then returns ErrIdentityNotLinked with
+// the ExternalUserInfo, call LinkIdentity with the id of the logged in user
+// and the provider and subject from the ExternalUserInfo.
+//
+// New in version v0.7
+type IdentityManager struct {
+	// Identities stores the links.
+	Identities IdentityHandler
+
+	// Users is used to check that users exist and if they have a password.
+	Users UserHandler
+
+	// mutex serializes UnlinkIdentity if Identities doesn't implement
+	// IdentityUnlinker.
+	mutex sync.Mutex
+}
+
+// NewIdentityManager returns a new IdentityManager.
+//
+// New in version v0.7
+func NewIdentityManager(identities IdentityHandler, users UserHandler) *IdentityManager {
+	return &IdentityManager{Identities: identities, Users: users}
+}
+
+// LinkIdentity links the identity at the provider with the user.
+// Returns ErrUserNotFound if the user doesn't exist and
+// ErrIdentityAlreadyLinked if the identity is already linked with a user
+// (with this user or any other).
+func (m *IdentityManager) LinkIdentity(userID uint64, provider, subject string) error {
+	if _, err := m.Users.GetUserName(userID); err != nil {
+		return err
+	}
+	_, err := m.Identities.GetUserID(provider, subject)
+	switch err {
+	case nil:
+		return ErrIdentityAlreadyLinked
+	case ErrIdentityNotFound:
+		return m.Identities.AddIdentity(userID, provider, subject)
+	default:
+		return err
+	}
+}
+
+// UnlinkIdentity removes the link between the identity at the provider and
+// the user.
+// Returns ErrIdentityNotFound if the identity is not linked with this user.
+// If this is the last identity of the user and the user has no password
+// ErrLastCredential is returned and the identity is not removed. If Users
+// doesn't implement PasswordStatusHandler the user is assumed to have no
+// password.
+// The check and the removal are atomic if Identities implements
+// IdentityUnlinker, otherwise they're only synchronized within this
+// IdentityManager.
+func (m *IdentityManager) UnlinkIdentity(userID uint64, provider, subject string) error {
+	hasPassword, err := m.userHasPassword(userID)
+	if err != nil {
+		return err
+	}
+	if unlinker, ok := m.Identities.(IdentityUnlinker); ok {
+		err := unlinker.UnlinkIdentity(userID, provider, subject, !hasPassword)
+		if err != ErrNotSupported {
+			return err
+		}
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	identities, err := m.Identities.ListIdentities(userID)
+	if err != nil {
+		return err
+	}
+	if err := checkUnlink(identities, provider, subject, !hasPassword); err != nil {
+		return err
+	}
+	return m.Identities.DeleteIdentity(provider, subject)
+}
+
+// ListIdentities returns all identities linked with the user.
+func (m *IdentityManager) ListIdentities(userID uint64) ([]*ExternalIdentity, error) {
+	return m.Identities.ListIdentities(userID)
+}
+
+// userHasPassword checks if the user has a password. If Users doesn't
+// implement PasswordStatusHandler the password is assumed to be absent, so
+// the last identity of a user is never removed.
+func (m *IdentityManager) userHasPassword(userID uint64) (bool, error) {
+	statusHandler, ok := m.Users.(PasswordStatusHandler)
+	if !ok {
+		return false, nil
+	}
+	userName, err := m.Users.GetUserName(userID)
+	if err != nil {
+		return false, err
+	}
+	return statusHandler.HasPassword(userName)
+}
@@ -0,0 +1,89 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import "testing"
+
+// listOnlyIdentityHandler hides IdentityUnlinker, so IdentityManager falls
+// back to ListIdentities and DeleteIdentity.
+type listOnlyIdentityHandler struct {
+	IdentityHandler
+}
+
+// plainUserHandler hides PasswordStatusHandler.
+type plainUserHandler struct {
+	UserHandler
+}
+
+func TestUnlinkLastCredential(t *testing.T) {
+	users := newTestUserHandler()
+	oauthOnly, _ := users.Insert("oauth-only", "", "", "", nil)
+	withPassword, _ := users.Insert("with-password", "", "", "", []byte("secret"))
+	handlers := map[string]IdentityHandler{
+		"unlinker":  NewInMemoryIdentityHandler(),
+		"list only": listOnlyIdentityHandler{NewInMemoryIdentityHandler()},
+	}
+	for name, identities := range handlers {
+		manager := NewIdentityManager(identities, users)
+		links := []struct {
+			user              uint64
+			provider, subject string
+		}{
+			{oauthOnly, "google", "a"},
+			{oauthOnly, "github", "b"},
+			{withPassword, "google", "c"},
+		}
+		for _, link := range links {
+			if err := manager.LinkIdentity(link.user, link.provider, link.subject); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+		}
+		tests := []struct {
+			user              uint64
+			provider, subject string
+			err               error
+		}{
+			{oauthOnly, "google", "c", ErrIdentityNotFound},
+			{oauthOnly, "github", "b", nil},
+			{oauthOnly, "google", "a", ErrLastCredential},
+			{withPassword, "google", "c", nil},
+		}
+		for _, test := range tests {
+			if err := manager.UnlinkIdentity(test.user, test.provider, test.subject); err != test.err {
+				t.Errorf("%s: Unlink %s/%s of user %d: Expected %v, got %v", name, test.provider, test.subject, test.user, test.err, err)
+			}
+		}
+		if user, err := identities.GetUserID("google", "a"); err != nil || user != oauthOnly {
+			t.Errorf("%s: Expected the last identity to be kept, got %d and %v", name, user, err)
+		}
+		// without PasswordStatusHandler users are assumed to have no
+		// password
+		manager.Users = plainUserHandler{users}
+		if err := manager.LinkIdentity(withPassword, "google", "c"); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := manager.UnlinkIdentity(withPassword, "google", "c"); err != ErrLastCredential {
+			t.Errorf("%s: Expected ErrLastCredential without PasswordStatusHandler, got %v", name, err)
+		}
+	}
+}
@@ -32,12 +32,21 @@ import (
 // map.
 // This map will be lost after you stop your application.
 type InMemoryHandler struct {
-	keys  map[string]*SessionKeyData
-	mutex sync.RWMutex
+	keys map[string]*SessionKeyData
+	// tenants maps keys to their tenant, keys of the default tenant are
+	// not stored
+	tenants map[string]string
+	mutex   sync.RWMutex
+
+	// Clock is used for the creation and expiry times, nil (the default)
+	// means CurrentTime.
+	//
+	// New in version v0.7
+	Clock Clock
 }
 
 func NewInMemoryHandler() *InMemoryHandler {
-	return &InMemoryHandler{keys: make(map[string]*SessionKeyData)}
+	return &InMemoryHandler{keys: make(map[string]*SessionKeyData), tenants: make(map[string]string)}
 }
 
 func NewInMemoryController() *SessionController {
@@ -49,8 +58,18 @@ func (h *InMemoryHandler) Init() error {
 }
 
 func (h *InMemoryHandler) GetData(key string) (*SessionKeyData, error) {
+	return h.GetDataForTenant("", key)
+}
+
+// GetDataForTenant implements TenantSessionHandler.
+//
+// New in version v0.7
+func (h *InMemoryHandler) GetDataForTenant(tenant, key string) (*SessionKeyData, error) {
 	h.mutex.RLock()
 	value, ok := h.keys[key]
+	if ok && h.tenants[key] != tenant {
+		ok = false
+	}
 	h.mutex.RUnlock()
 	if ok {
 		return value, nil
@@ -60,13 +79,23 @@ func (h *InMemoryHandler) GetData(key string) (*SessionKeyData, error) {
 }
 
 func (h *InMemoryHandler) CreateEntry(user UserKeyType, key string, validDuration time.Duration) (*SessionKeyData, error) {
+	return h.CreateEntryForTenant("", user, key, validDuration)
+}
+
+// CreateEntryForTenant implements TenantSessionHandler.
+//
+// New in version v0.7
+func (h *InMemoryHandler) CreateEntryForTenant(tenant string, user UserKeyType, key string, validDuration time.Duration) (*SessionKeyData, error) {
 	h.mutex.Lock()
 	if _, hasEntry := h.keys[key]; hasEntry {
 		h.mutex.Unlock()
 		return nil, errors.New("Key already exists")
 	}
-	data := CurrentTimeKeyData(user, validDuration)
+	data := clockKeyData(h.Clock, user, validDuration)
 	h.keys[key] = data
+	if tenant != "" {
+		h.tenants[key] = tenant
+	}
 	h.mutex.Unlock()
 	return data, nil
 }
@@ -78,6 +107,60 @@ func (h *InMemoryHandler) DeleteEntriesForUser(user UserKeyType) (int64, error)
 		if value.User == user {
 			// delete entry
 			delete(h.keys, key)
+			delete(h.tenants, key)
+			removed++
+		}
+	}
+	h.mutex.Unlock()
+	return removed, nil
+}
+
+// GetDataMulti implements MultiSessionGetter.
+//
+// New in version v0.7
+func (h *InMemoryHandler) GetDataMulti(keys []string) (map[string]*SessionKeyData, error) {
+	res := make(map[string]*SessionKeyData, len(keys))
+	h.mutex.RLock()
+	for _, key := range keys {
+		if value, ok := h.keys[key]; ok && h.tenants[key] == "" {
+			res[key] = value
+		}
+	}
+	h.mutex.RUnlock()
+	return res, nil
+}
+
+// DeleteKeys implements BulkSessionDeleter.
+//
+// New in version v0.7
+func (h *InMemoryHandler) DeleteKeys(keys []string) (int64, error) {
+	var removed int64 = 0
+	h.mutex.Lock()
+	for _, key := range keys {
+		if _, has := h.keys[key]; has {
+			delete(h.keys, key)
+			delete(h.tenants, key)
+			removed++
+		}
+	}
+	h.mutex.Unlock()
+	return removed, nil
+}
+
+// DeleteEntriesForUsers implements BulkSessionDeleter.
+//
+// New in version v0.7
+func (h *InMemoryHandler) DeleteEntriesForUsers(users []UserKeyType) (int64, error) {
+	userSet := make(map[UserKeyType]struct{}, len(users))
+	for _, user := range users {
+		userSet[user] = struct{}{}
+	}
+	var removed int64 = 0
+	h.mutex.Lock()
+	for key, value := range h.keys {
+		if _, has := userSet[value.User]; has {
+			delete(h.keys, key)
+			delete(h.tenants, key)
 			removed++
 		}
 	}
@@ -87,11 +170,12 @@ func (h *InMemoryHandler) DeleteEntriesForUser(user UserKeyType) (int64, error)
 
 func (h *InMemoryHandler) DeleteInvalidKeys() (int64, error) {
 	var removed int64 = 0
-	now := CurrentTime()
+	now := clockNow(h.Clock)
 	h.mutex.Lock()
 	for key, value := range h.keys {
 		if KeyInvalid(now, value.ValidUntil) {
 			delete(h.keys, key)
+			delete(h.tenants, key)
 			removed++
 		}
 	}
@@ -102,6 +186,53 @@ func (h *InMemoryHandler) DeleteInvalidKeys() (int64, error) {
 func (h *InMemoryHandler) DeleteKey(key string) error {
 	h.mutex.Lock()
 	delete(h.keys, key)
+	delete(h.tenants, key)
 	h.mutex.Unlock()
 	return nil
 }
+
+func (h *InMemoryHandler) ListSessionsForUser(user UserKeyType) (map[string]*SessionKeyData, error) {
+	now := clockNow(h.Clock)
+	res := make(map[string]*SessionKeyData)
+	h.mutex.RLock()
+	for key, value := range h.keys {
+		if value.User == user && KeyValid(now, value.ValidUntil) {
+			res[key] = value
+		}
+	}
+	h.mutex.RUnlock()
+	return res, nil
+}
+
+// ActiveUsers returns the number of distinct users with a valid session, see
+// SessionAnalytics.
+//
+// New in version v0.7
+func (h *InMemoryHandler) ActiveUsers() (int64, error) {
+	now := clockNow(h.Clock)
+	users := make(map[UserKeyType]struct{})
+	h.mutex.RLock()
+	for _, value := range h.keys {
+		if KeyValid(now, value.ValidUntil) {
+			users[value.User] = struct{}{}
+		}
+	}
+	h.mutex.RUnlock()
+	return int64(len(users)), nil
+}
+
+// SessionsCreated returns the number of sessions created in [from, to), see
+// SessionAnalytics. Sessions removed by DeleteInvalidKeys are not counted.
+//
+// New in version v0.7
+func (h *InMemoryHandler) SessionsCreated(from, to time.Time) (int64, error) {
+	var res int64
+	h.mutex.RLock()
+	for _, value := range h.keys {
+		if !value.CreationTime.Before(from) && value.CreationTime.Before(to) {
+			res++
+		}
+	}
+	h.mutex.RUnlock()
+	return res, nil
+}
@@ -0,0 +1,703 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrInviteNotFound is returned if an invite doesn't exist, was already
+// accepted, revoked or is expired.
+var ErrInviteNotFound = errors.New("Invite not found or expired.")
+
+// Invite is an invitation to create an account. The invite token itself is
+// never stored, ID is the hash of the token.
+//
+// New in version v0.7
+type Invite struct {
+	ID        string `json:"id"`
+	Email     string `json:"email"`
+	InvitedBy uint64 `json:"invited_by"`
+
+	// Role is assigned to the new user if it is not empty.
+	Role string `json:"role,omitempty"`
+
+	// The new user becomes a member of Org (if it's not 0) with OrgRole.
+	Org     uint64  `json:"org,omitempty"`
+	OrgRole OrgRole `json:"org_role,omitempty"`
+
+	Created    time.Time `json:"created"`
+	ValidUntil time.Time `json:"valid_until"`
+}
+
+// InviteHandler stores invites.
+//
+// New in version v0.7
+type InviteHandler interface {
+	// Init initializes the storage, see UserHandler.
+	Init() error
+
+	// CreateInvite stores a new invite.
+	CreateInvite(invite *Invite) error
+
+	// GetInvite returns the invite or ErrInviteNotFound.
+	GetInvite(id string) (*Invite, error)
+
+	// DeleteInvite deletes the invite, it returns ErrInviteNotFound if the
+	// invite doesn't exist. Only one of concurrent calls may succeed.
+	DeleteInvite(id string) error
+
+	// ListInvites returns all invites created by invitedBy, ordered by
+	// creation time. If invitedBy is NoUserID all invites are returned.
+	// Expired invites may be included.
+	ListInvites(invitedBy uint64) ([]*Invite, error)
+
+	// DeleteExpiredInvites deletes all expired invites.
+	DeleteExpiredInvites() (int64, error)
+}
+
+// InMemoryInviteHandler is an InviteHandler that keeps the invites in
+// memory.
+//
+// New in version v0.7
+type InMemoryInviteHandler struct {
+	mutex   sync.RWMutex
+	invites map[string]*Invite
+}
+
+// NewInMemoryInviteHandler returns a new InMemoryInviteHandler.
+func NewInMemoryInviteHandler() *InMemoryInviteHandler {
+	return &InMemoryInviteHandler{invites: make(map[string]*Invite)}
+}
+
+func (h *InMemoryInviteHandler) Init() error {
+	return nil
+}
+
+func (h *InMemoryInviteHandler) CreateInvite(invite *Invite) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	copied := *invite
+	h.invites[invite.ID] = &copied
+	return nil
+}
+
+func (h *InMemoryInviteHandler) GetInvite(id string) (*Invite, error) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	invite, has := h.invites[id]
+	if !has {
+		return nil, ErrInviteNotFound
+	}
+	copied := *invite
+	return &copied, nil
+}
+
+func (h *InMemoryInviteHandler) DeleteInvite(id string) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if _, has := h.invites[id]; !has {
+		return ErrInviteNotFound
+	}
+	delete(h.invites, id)
+	return nil
+}
+
+func (h *InMemoryInviteHandler) ListInvites(invitedBy uint64) ([]*Invite, error) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	res := make([]*Invite, 0)
+	for _, invite := range h.invites {
+		if invitedBy == NoUserID || invite.InvitedBy == invitedBy {
+			copied := *invite
+			res = append(res, &copied)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Created.Before(res[j].Created) })
+	return res, nil
+}
+
+func (h *InMemoryInviteHandler) DeleteExpiredInvites() (int64, error) {
+	now := CurrentTime()
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	var removed int64
+	for id, invite := range h.invites {
+		if KeyInvalid(now, invite.ValidUntil) {
+			delete(h.invites, id)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// SQLInviteQueries stores the queries for SQLInviteHandler.
+//
+// New in version v0.7
+type SQLInviteQueries struct {
+	InitQuery, CreateQuery, GetQuery, DeleteQuery, ListQuery, ListAllQuery,
+	DeleteExpiredQuery string
+
+	// TimeFromScanType is used to transform database time entries to
+	// gos time. See SQLSessionHandler for details.
+	TimeFromScanType func(val interface{}) (time.Time, error)
+}
+
+// MySQLInviteQueries provides queries to use with MySQL.
+func MySQLInviteQueries() *SQLInviteQueries {
+	initQ := `
+	CREATE TABLE IF NOT EXISTS invites (
+		id CHAR(64) NOT NULL,
+		email VARCHAR(150) NOT NULL,
+		invited_by BIGINT UNSIGNED NOT NULL,
+		role VARCHAR(150) NOT NULL,
+		org_id BIGINT UNSIGNED NOT NULL,
+		org_role INT NOT NULL,
+		created DATETIME NOT NULL,
+		valid_until DATETIME NOT NULL,
+		PRIMARY KEY(id)
+	);
+	`
+	const columns = "id, email, invited_by, role, org_id, org_role, created, valid_until"
+	return &SQLInviteQueries{InitQuery: initQ,
+		CreateQuery:        "INSERT INTO invites (" + columns + ") VALUES(?, ?, ?, ?, ?, ?, ?, ?)",
+		GetQuery:           "SELECT " + columns + " FROM invites WHERE id=?",
+		DeleteQuery:        "DELETE FROM invites WHERE id=?",
+		ListQuery:          "SELECT " + columns + " FROM invites WHERE invited_by=? ORDER BY created",
+		ListAllQuery:       "SELECT " + columns + " FROM invites ORDER BY created",
+		DeleteExpiredQuery: "DELETE FROM invites WHERE valid_until < ?",
+		TimeFromScanType:   DefaultTimeFromScanType}
+}
+
+// PostgresInviteQueries provides queries to use with postgres.
+func PostgresInviteQueries() *SQLInviteQueries {
+	initQ := `
+	CREATE TABLE IF NOT EXISTS invites (
+		id char(64) PRIMARY KEY,
+		email varchar(150) NOT NULL,
+		invited_by bigint NOT NULL,
+		role varchar(150) NOT NULL,
+		org_id bigint NOT NULL,
+		org_role integer NOT NULL,
+		created timestamp NOT NULL,
+		valid_until timestamp NOT NULL
+	);
+	`
+	const columns = "id, email, invited_by, role, org_id, org_role, created, valid_until"
+	return &SQLInviteQueries{InitQuery: initQ,
+		CreateQuery:        "INSERT INTO invites (" + columns + ") VALUES($1, $2, $3, $4, $5, $6, $7, $8)",
+		GetQuery:           "SELECT " + columns + " FROM invites WHERE id = $1",
+		DeleteQuery:        "DELETE FROM invites WHERE id = $1",
+		ListQuery:          "SELECT " + columns + " FROM invites WHERE invited_by = $1 ORDER BY created",
+		ListAllQuery:       "SELECT " + columns + " FROM invites ORDER BY created",
+		DeleteExpiredQuery: "DELETE FROM invites WHERE valid_until < $1",
+		TimeFromScanType:   DefaultTimeFromScanType}
+}
+
+// SQLite3InviteQueries provides queries to use with sqlite3.
+func SQLite3InviteQueries() *SQLInviteQueries {
+	return MySQLInviteQueries()
+}
+
+// SQLInviteHandler implements InviteHandler by executing the queries
+// defined in an instance of SQLInviteQueries.
+//
+// New in version v0.7
+type SQLInviteHandler struct {
+	*SQLInviteQueries
+
+	// DB is the database to execute the queries on.
+	DB *sql.DB
+
+	blockDB bool
+	mutex   sync.RWMutex
+}
+
+// NewSQLInviteHandler returns a new SQLInviteHandler, blockDB has the same
+// meaning as in NewSQLUserHandler.
+func NewSQLInviteHandler(queries *SQLInviteQueries, db *sql.DB, blockDB bool) *SQLInviteHandler {
+	return &SQLInviteHandler{SQLInviteQueries: queries, DB: db, blockDB: blockDB}
+}
+
+// NewMySQLInviteHandler returns a new SQLInviteHandler that uses MySQL.
+func NewMySQLInviteHandler(db *sql.DB) *SQLInviteHandler {
+	return NewSQLInviteHandler(MySQLInviteQueries(), db, false)
+}
+
+// NewPostgresInviteHandler returns a new SQLInviteHandler that uses
+// postgres.
+func NewPostgresInviteHandler(db *sql.DB) *SQLInviteHandler {
+	return NewSQLInviteHandler(PostgresInviteQueries(), db, false)
+}
+
+// NewSQLite3InviteHandler returns a new SQLInviteHandler that uses sqlite3.
+func NewSQLite3InviteHandler(db *sql.DB) *SQLInviteHandler {
+	return NewSQLInviteHandler(SQLite3InviteQueries(), db, true)
+}
+
+func (handler *SQLInviteHandler) Init() error {
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	_, err := handler.DB.Exec(handler.InitQuery)
+	return err
+}
+
+func (handler *SQLInviteHandler) CreateInvite(invite *Invite) error {
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	_, err := handler.DB.Exec(handler.CreateQuery, invite.ID, invite.Email,
+		invite.InvitedBy, invite.Role, invite.Org, int(invite.OrgRole),
+		invite.Created, invite.ValidUntil)
+	return wrapBackendError("sql", "CreateInvite", err)
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func (handler *SQLInviteHandler) scan(row rowScanner) (*Invite, error) {
+	res := &Invite{}
+	var orgRole int
+	var createdVal, validUntilVal interface{}
+	if err := row.Scan(&res.ID, &res.Email, &res.InvitedBy, &res.Role, &res.Org,
+		&orgRole, &createdVal, &validUntilVal); err != nil {
+		return nil, err
+	}
+	res.OrgRole = OrgRole(orgRole)
+	var err error
+	if res.Created, err = handler.TimeFromScanType(createdVal); err != nil {
+		return nil, err
+	}
+	if res.ValidUntil, err = handler.TimeFromScanType(validUntilVal); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (handler *SQLInviteHandler) GetInvite(id string) (*Invite, error) {
+	if handler.blockDB {
+		handler.mutex.RLock()
+		defer handler.mutex.RUnlock()
+	}
+	res, err := handler.scan(handler.DB.QueryRow(handler.GetQuery, id))
+	if err == sql.ErrNoRows {
+		return nil, ErrInviteNotFound
+	}
+	return res, wrapBackendError("sql", "GetInvite", err)
+}
+
+func (handler *SQLInviteHandler) DeleteInvite(id string) error {
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	res, err := handler.DB.Exec(handler.DeleteQuery, id)
+	if err != nil {
+		return wrapBackendError("sql", "DeleteInvite", err)
+	}
+	if num, err := res.RowsAffected(); err == nil && num == 0 {
+		return ErrInviteNotFound
+	}
+	return nil
+}
+
+func (handler *SQLInviteHandler) ListInvites(invitedBy uint64) ([]*Invite, error) {
+	if handler.blockDB {
+		handler.mutex.RLock()
+		defer handler.mutex.RUnlock()
+	}
+	var rows *sql.Rows
+	var err error
+	if invitedBy == NoUserID {
+		rows, err = handler.DB.Query(handler.ListAllQuery)
+	} else {
+		rows, err = handler.DB.Query(handler.ListQuery, invitedBy)
+	}
+	if err != nil {
+		return nil, wrapBackendError("sql", "ListInvites", err)
+	}
+	defer rows.Close()
+	res := make([]*Invite, 0)
+	for rows.Next() {
+		invite, err := handler.scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, invite)
+	}
+	return res, rows.Err()
+}
+
+func (handler *SQLInviteHandler) DeleteExpiredInvites() (int64, error) {
+	now := CurrentTime()
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	res, err := handler.DB.Exec(handler.DeleteExpiredQuery, now)
+	if err != nil {
+		return -1, wrapBackendError("sql", "DeleteExpiredInvites", err)
+	}
+	num, err := res.RowsAffected()
+	if err != nil {
+		return -1, nil
+	}
+	return num, nil
+}
+
+// InviteManager implements invitations: an existing user creates an invite
+// for an email address, the token is delivered to the address and
+// AcceptInvite creates the account.
+//
+// Invites can pre-assign a role (Roles must be set) and the membership in an
+// organization (Orgs must be set). In the HTTP handlers only admins (see
+// IsAdminUser) may pre-assign roles and only admins of an organization may
+// invite to it.
+//
+// New in version v0.7
+type InviteManager struct {
+	Users   UserHandler
+	Invites InviteHandler
+
+	// Roles and Orgs are used for pre-assigned roles and organizations,
+	// may be nil.
+	Roles RoleHandler
+	Orgs  OrgHandler
+
+	// TTL is the time an invite is valid, defaults to 7 days.
+	TTL time.Duration
+
+	// Deliver sends the token to invite.Email, for example
+	// AuthMailer.SendInvite.
+	Deliver func(invite *Invite, token string) error
+
+	// Render and RenderError write the responses of the handlers, they
+	// default to RenderJSON and RenderJSONError.
+	Render      func(w http.ResponseWriter, r *http.Request, status int, value interface{})
+	RenderError func(w http.ResponseWriter, r *http.Request, status int, err error)
+}
+
+// NewInviteManager returns a new InviteManager that renders JSON.
+func NewInviteManager(users UserHandler, invites InviteHandler) *InviteManager {
+	return &InviteManager{Users: users, Invites: invites, TTL: 7 * 24 * time.Hour,
+		Render: RenderJSON, RenderError: RenderJSONError}
+}
+
+// CreateInvite stores the invite and passes the token to Deliver.
+// Email and InvitedBy must be set, ID, Created and ValidUntil are set by
+// this method. The token is returned as well.
+func (m *InviteManager) CreateInvite(invite *Invite) (string, error) {
+	if invite.Email == "" {
+		return "", errors.New("Invite without email address.")
+	}
+	if invite.Role != "" && m.Roles == nil {
+		return "", ErrNotSupported
+	}
+	if invite.Org != 0 {
+		if m.Orgs == nil {
+			return "", ErrNotSupported
+		}
+		if _, err := m.Orgs.GetOrg(invite.Org); err != nil {
+			return "", err
+		}
+		if invite.OrgRole == 0 {
+			invite.OrgRole = OrgMember
+		}
+	}
+	token, err := GenRandomBase64(32)
+	if err != nil {
+		return "", err
+	}
+	invite.ID = HashToken(token)
+	invite.Created = CurrentTime()
+	invite.ValidUntil = invite.Created.Add(m.TTL)
+	if err := m.Invites.CreateInvite(invite); err != nil {
+		return "", err
+	}
+	if m.Deliver != nil {
+		if err := m.Deliver(invite, token); err != nil {
+			return token, err
+		}
+	}
+	return token, nil
+}
+
+// ListInvites returns the outstanding (not expired) invites created by
+// invitedBy, or all outstanding invites if invitedBy is NoUserID.
+func (m *InviteManager) ListInvites(invitedBy uint64) ([]*Invite, error) {
+	invites, err := m.Invites.ListInvites(invitedBy)
+	if err != nil {
+		return nil, err
+	}
+	now := CurrentTime()
+	res := make([]*Invite, 0, len(invites))
+	for _, invite := range invites {
+		if !KeyInvalid(now, invite.ValidUntil) {
+			res = append(res, invite)
+		}
+	}
+	return res, nil
+}
+
+// RevokeInvite deletes the invite with the given id.
+func (m *InviteManager) RevokeInvite(id string) error {
+	return m.Invites.DeleteInvite(id)
+}
+
+// VerifyInvite returns the invite for the token without accepting it.
+// Returns ErrInviteNotFound if the token is invalid.
+func (m *InviteManager) VerifyInvite(token string) (*Invite, error) {
+	invite, err := m.Invites.GetInvite(HashToken(token))
+	if err != nil {
+		return nil, err
+	}
+	if KeyInvalid(CurrentTime(), invite.ValidUntil) {
+		return nil, ErrInviteNotFound
+	}
+	return invite, nil
+}
+
+// AcceptInvite creates the account for the invite and consumes the token.
+// The email address of the new user is the address of the invite, it's
+// marked as verified if the users implement EmailVerifiedHandler.
+// The pre-assigned role and organization are applied.
+// It returns the id of the new user.
+func (m *InviteManager) AcceptInvite(token, userName, firstName, lastName string, plainPW []byte) (uint64, error) {
+	invite, err := m.VerifyInvite(token)
+	if err != nil {
+		return NoUserID, err
+	}
+	id, err := m.Users.Insert(userName, firstName, lastName, invite.Email, plainPW)
+	if err != nil {
+		return NoUserID, err
+	}
+	if id == NoUserID {
+		if id, err = m.Users.GetUserID(userName); err != nil {
+			return NoUserID, err
+		}
+	}
+	if err := m.Invites.DeleteInvite(invite.ID); err != nil {
+		// the invite was accepted concurrently, don't keep the second account
+		if delErr := m.Users.DeleteUser(userName); delErr != nil {
+			return NoUserID, delErr
+		}
+		return NoUserID, err
+	}
+	if flags, ok := m.Users.(EmailVerifiedHandler); ok {
+		if err := flags.SetEmailVerified(userName, true); err != nil {
+			return id, err
+		}
+	}
+	if invite.Role != "" && m.Roles != nil {
+		if err := m.Roles.AssignRole(id, invite.Role); err != nil {
+			return id, err
+		}
+	}
+	if invite.Org != 0 && m.Orgs != nil {
+		if err := m.Orgs.SetMember(invite.Org, id, invite.OrgRole); err != nil {
+			return id, err
+		}
+	}
+	return id, nil
+}
+
+// InviteRequest is the request accepted by ServeCreateInvite.
+type InviteRequest struct {
+	Email   string  `json:"email"`
+	Role    string  `json:"role"`
+	Org     uint64  `json:"org"`
+	OrgRole OrgRole `json:"org_role"`
+}
+
+// ServeCreateInvite creates an invite by the user of the session (see
+// SessionMiddleware), the request is a JSON encoded InviteRequest.
+func (m *InviteManager) ServeCreateInvite(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r, m.RenderError) {
+		return
+	}
+	user, ok := UserIDFromContext(r.Context())
+	if !ok {
+		m.RenderError(w, r, http.StatusUnauthorized, ErrInvalidCredentials)
+		return
+	}
+	var req InviteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		m.RenderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if req.Email == "" {
+		m.RenderError(w, r, http.StatusBadRequest, errors.New("Email is required."))
+		return
+	}
+	if req.Role != "" {
+		isAdmin, err := IsAdminUser(m.Users, user)
+		if err != nil {
+			m.RenderError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		if !isAdmin {
+			m.RenderError(w, r, http.StatusForbidden, errors.New("Only admins can pre-assign roles."))
+			return
+		}
+	}
+	if req.Org != 0 && m.Orgs != nil {
+		// only owners can invite owners
+		required := OrgAdmin
+		if req.OrgRole == OrgOwner {
+			required = OrgOwner
+		}
+		allowed, err := HasOrgRole(m.Orgs, req.Org, user, required)
+		if err != nil {
+			m.RenderError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		if !allowed {
+			m.RenderError(w, r, http.StatusForbidden, ErrNotMember)
+			return
+		}
+	}
+	invite := &Invite{Email: req.Email, InvitedBy: user, Role: req.Role,
+		Org: req.Org, OrgRole: req.OrgRole}
+	if _, err := m.CreateInvite(invite); err != nil {
+		switch err {
+		case ErrNotSupported:
+			m.RenderError(w, r, http.StatusNotImplemented, err)
+		case ErrOrgNotFound:
+			m.RenderError(w, r, http.StatusNotFound, err)
+		default:
+			m.RenderError(w, r, http.StatusInternalServerError, err)
+		}
+		return
+	}
+	m.Render(w, r, http.StatusCreated, invite)
+}
+
+// requestUser returns the user of the request and whether it's an admin,
+// it returns false if there is no user (and wrote a response).
+func (m *InviteManager) requestUser(w http.ResponseWriter, r *http.Request) (uint64, bool, bool) {
+	user, ok := UserIDFromContext(r.Context())
+	if !ok {
+		m.RenderError(w, r, http.StatusUnauthorized, ErrInvalidCredentials)
+		return NoUserID, false, false
+	}
+	isAdmin, err := IsAdminUser(m.Users, user)
+	if err != nil {
+		m.RenderError(w, r, http.StatusInternalServerError, err)
+		return NoUserID, false, false
+	}
+	return user, isAdmin, true
+}
+
+// ServeListInvites lists the outstanding invites of the user of the
+// session, admins get all invites.
+func (m *InviteManager) ServeListInvites(w http.ResponseWriter, r *http.Request) {
+	user, isAdmin, ok := m.requestUser(w, r)
+	if !ok {
+		return
+	}
+	if isAdmin {
+		user = NoUserID
+	}
+	invites, err := m.ListInvites(user)
+	if err != nil {
+		m.RenderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	m.Render(w, r, http.StatusOK, invites)
+}
+
+// ServeRevokeInvite revokes the invite with the id given as query parameter
+// "id". Users can only revoke their own invites, admins all invites.
+func (m *InviteManager) ServeRevokeInvite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "POST, DELETE")
+		m.RenderError(w, r, http.StatusMethodNotAllowed, errors.New("POST or DELETE required"))
+		return
+	}
+	user, isAdmin, ok := m.requestUser(w, r)
+	if !ok {
+		return
+	}
+	id := r.URL.Query().Get("id")
+	invite, err := m.Invites.GetInvite(id)
+	if err == nil && !isAdmin && invite.InvitedBy != user {
+		err = ErrInviteNotFound
+	}
+	if err == nil {
+		err = m.RevokeInvite(id)
+	}
+	switch {
+	case err == ErrInviteNotFound:
+		m.RenderError(w, r, http.StatusNotFound, err)
+	case err != nil:
+		m.RenderError(w, r, http.StatusInternalServerError, err)
+	default:
+		m.Render(w, r, http.StatusOK, &AuthResponse{Status: "ok"})
+	}
+}
+
+// ServeAcceptInvite creates the account, the request is an AuthRequest with
+// the invite token (the email is ignored). The token can also be passed as
+// query parameter "token".
+func (m *InviteManager) ServeAcceptInvite(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r, m.RenderError) {
+		return
+	}
+	req, err := ParseAuthRequest(r)
+	if err != nil {
+		m.RenderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	token := req.Token
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	if token == "" || req.UserName == "" || req.Password == "" {
+		m.RenderError(w, r, http.StatusBadRequest, errors.New("Token, username and password are required."))
+		return
+	}
+	id, err := m.AcceptInvite(token, req.UserName, req.FirstName, req.LastName, []byte(req.Password))
+	switch {
+	case err == ErrInviteNotFound:
+		m.RenderError(w, r, http.StatusBadRequest, err)
+	case errors.Is(err, ErrDuplicateUsername):
+		m.RenderError(w, r, http.StatusConflict, ErrDuplicateUsername)
+	case err == ErrUsernameReserved:
+		m.RenderError(w, r, http.StatusConflict, err)
+	case err != nil:
+		m.RenderError(w, r, http.StatusInternalServerError, err)
+	default:
+		m.Render(w, r, http.StatusCreated, &AuthResponse{Status: "ok", UserID: id,
+			UserName: req.UserName})
+	}
+}
@@ -0,0 +1,306 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrIPBanned is returned if a request comes from an IP address on the deny
+// list of an IPFilter.
+var ErrIPBanned = errors.New("Requests from this IP address are not allowed.")
+
+// IPBanStore stores temporary bans of IP addresses.
+//
+// New in version v0.7
+type IPBanStore interface {
+	// Ban bans the IP address until the given time.
+	Ban(ip string, until time.Time) error
+
+	// BannedUntil returns the end of the ban of the IP address, the zero
+	// time if it is not banned.
+	BannedUntil(ip string) (time.Time, error)
+
+	// Unban removes the ban of the IP address.
+	Unban(ip string) error
+}
+
+// InMemoryIPBanStore is an IPBanStore that keeps the bans in memory.
+//
+// New in version v0.7
+type InMemoryIPBanStore struct {
+	bans  map[string]time.Time
+	mutex sync.RWMutex
+}
+
+// NewInMemoryIPBanStore returns a new InMemoryIPBanStore.
+func NewInMemoryIPBanStore() *InMemoryIPBanStore {
+	return &InMemoryIPBanStore{bans: make(map[string]time.Time)}
+}
+
+func (s *InMemoryIPBanStore) Ban(ip string, until time.Time) error {
+	now := CurrentTime()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for other, otherUntil := range s.bans {
+		if KeyInvalid(now, otherUntil) {
+			delete(s.bans, other)
+		}
+	}
+	s.bans[ip] = until
+	return nil
+}
+
+func (s *InMemoryIPBanStore) BannedUntil(ip string) (time.Time, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	until, has := s.bans[ip]
+	if !has || KeyInvalid(CurrentTime(), until) {
+		return time.Time{}, nil
+	}
+	return until, nil
+}
+
+func (s *InMemoryIPBanStore) Unban(ip string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.bans, ip)
+	return nil
+}
+
+// RedisIPBanStore is an IPBanStore using redis, bans are stored as
+// "ipban:<ip>" and expire automatically.
+//
+// New in version v0.7
+type RedisIPBanStore struct {
+	// Client is the client to connect to redis.
+	Client *redis.Client
+
+	// Prefix defaults to "ipban:".
+	Prefix string
+}
+
+// NewRedisIPBanStore returns a new RedisIPBanStore.
+func NewRedisIPBanStore(client *redis.Client) *RedisIPBanStore {
+	return &RedisIPBanStore{Client: client, Prefix: "ipban:"}
+}
+
+func (s *RedisIPBanStore) Ban(ip string, until time.Time) error {
+	key := s.Prefix + ip
+	if err := s.Client.Set(key, until.Format(RedisDateFormat), 0).Err(); err != nil {
+		return err
+	}
+	return s.Client.ExpireAt(key, until).Err()
+}
+
+func (s *RedisIPBanStore) BannedUntil(ip string) (time.Time, error) {
+	val, err := s.Client.Get(s.Prefix + ip).Result()
+	if err == redis.Nil {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	until, err := time.Parse(RedisDateFormat, val)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if KeyInvalid(CurrentTime(), until) {
+		return time.Time{}, nil
+	}
+	return until, nil
+}
+
+func (s *RedisIPBanStore) Unban(ip string) error {
+	return s.Client.Del(s.Prefix + ip).Err()
+}
+
+// ParseCIDR parses an IP network in CIDR notation, a single IP address is
+// accepted as well (as /32 or /128 network).
+func ParseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, errors.New("Invalid IP address: " + s)
+		}
+		bits := 128
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(s)
+	return ipNet, err
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// IPFilter blocks IP addresses before they reach the (expensive) password
+// check, to blunt credential stuffing attacks.
+//
+// Addresses on the allow list are never blocked, addresses on the deny list
+// are always blocked. Other addresses are banned for BanDuration if they
+// exceed the failure limit of Failures (use a RedisRateLimiter to share the
+// counters between several instances).
+//
+// Use Middleware to protect your login handlers or set the IPFilter of a
+// LoginService.
+//
+// New in version v0.7
+type IPFilter struct {
+	AllowList, DenyList []*net.IPNet
+
+	// Bans stores the temporary bans.
+	Bans IPBanStore
+
+	// Failures counts failed logins per IP address, if it is nil addresses
+	// are never banned automatically.
+	Failures RateLimiter
+
+	// BanDuration is the duration of an automatic ban, defaults to one
+	// hour.
+	BanDuration time.Duration
+
+	mutex sync.RWMutex
+}
+
+// NewIPFilter returns a new IPFilter.
+func NewIPFilter(bans IPBanStore, failures RateLimiter) *IPFilter {
+	return &IPFilter{Bans: bans, Failures: failures, BanDuration: time.Hour}
+}
+
+// Allow adds a network (in CIDR notation or a single IP) to the allow list.
+func (f *IPFilter) Allow(cidr string) error {
+	n, err := ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.AllowList = append(f.AllowList, n)
+	return nil
+}
+
+// Deny adds a network (in CIDR notation or a single IP) to the deny list.
+func (f *IPFilter) Deny(cidr string) error {
+	n, err := ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.DenyList = append(f.DenyList, n)
+	return nil
+}
+
+// allowListed returns true if the address is on the allow list, ip may be
+// nil.
+func (f *IPFilter) allowListed(ip net.IP) bool {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return ip != nil && containsIP(f.AllowList, ip)
+}
+
+// Check returns nil if requests from the IP address are allowed,
+// ErrIPBanned if it is on the deny list and a *RateLimitError if it is
+// temporarily banned.
+func (f *IPFilter) Check(ipString string) error {
+	ip := net.ParseIP(ipString)
+	if f.allowListed(ip) {
+		return nil
+	}
+	f.mutex.RLock()
+	denied := ip != nil && containsIP(f.DenyList, ip)
+	f.mutex.RUnlock()
+	if denied {
+		return ErrIPBanned
+	}
+	if f.Bans == nil {
+		return nil
+	}
+	until, err := f.Bans.BannedUntil(ipString)
+	if err != nil {
+		return err
+	}
+	if !until.IsZero() {
+		return &RateLimitError{RetryAfter: until.Sub(CurrentTime())}
+	}
+	return nil
+}
+
+// RecordFailure records a failed login from the IP address and bans it if
+// it exceeded the limit.
+func (f *IPFilter) RecordFailure(ipString string) error {
+	if f.Failures == nil || f.Bans == nil || f.allowListed(net.ParseIP(ipString)) {
+		return nil
+	}
+	allowed, _, err := f.Failures.Allow("ipfail:" + ipString)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		log.WithField("ip", ipString).Warn("goauth: Banning IP address after too many failed logins")
+		if err := f.Bans.Ban(ipString, CurrentTime().Add(f.BanDuration)); err != nil {
+			return err
+		}
+		return f.Failures.Reset("ipfail:" + ipString)
+	}
+	return nil
+}
+
+// Middleware returns a handler that rejects requests from blocked addresses
+// (the address is taken from ClientIP) with 403 or 429.
+func (f *IPFilter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch err := f.Check(ClientIP(r)).(type) {
+		case nil:
+			next.ServeHTTP(w, r)
+		case *RateLimitError:
+			SetRetryAfter(w, err.RetryAfter)
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		default:
+			if err == ErrIPBanned {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			} else {
+				log.WithError(err).Error("goauth: Can't check IP address")
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+		}
+	})
+}
@@ -0,0 +1,121 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// JanitorTask is a cleanup task, it returns the number of removed entries.
+//
+// New in version v0.7
+type JanitorTask func() (int64, error)
+
+type namedJanitorTask struct {
+	name string
+	task JanitorTask
+}
+
+// Janitor periodically runs cleanup tasks, for example deleting expired
+// sessions and tokens or executing scheduled account deletions.
+//
+// Usage:
+//
+//	j := goauth.NewJanitor(time.Hour)
+//	j.Add("sessions", controller.DeleteInvalidKeys)
+//	j.Add("tokens", tokens.DeleteExpiredTokens)
+//	j.Add("account deletions", deletions.DeleteDue)
+//	j.Start(ctx)
+//
+// New in version v0.7
+type Janitor struct {
+	// Interval is the time between two runs.
+	Interval time.Duration
+
+	// Metrics is informed about each run of a task, may be nil.
+	Metrics Metrics
+
+	mutex sync.Mutex
+	tasks []namedJanitorTask
+}
+
+// NewJanitor returns a new Janitor without tasks.
+func NewJanitor(interval time.Duration) *Janitor {
+	return &Janitor{Interval: interval}
+}
+
+// Add adds a task, the name is used for logging.
+func (j *Janitor) Add(name string, task JanitorTask) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.tasks = append(j.tasks, namedJanitorTask{name: name, task: task})
+}
+
+// RunOnce runs all tasks once, errors are logged and don't stop the other
+// tasks. It returns the first error.
+func (j *Janitor) RunOnce() error {
+	j.mutex.Lock()
+	tasks := make([]namedJanitorTask, len(j.tasks))
+	copy(tasks, j.tasks)
+	j.mutex.Unlock()
+	var res error
+	for _, task := range tasks {
+		num, err := task.task()
+		if j.Metrics != nil {
+			j.Metrics.JanitorRun(task.name, num, err)
+		}
+		if err != nil {
+			log.WithError(err).WithField("task", task.name).Error("goauth: Janitor task failed")
+			if res == nil {
+				res = err
+			}
+			continue
+		}
+		if num > 0 {
+			log.WithField("task", task.name).WithField("removed", num).Debug("goauth: Janitor task finished")
+		}
+	}
+	return res
+}
+
+// Start starts a goroutine that runs the tasks immediately and then every
+// Interval until the context is done.
+func (j *Janitor) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(j.Interval)
+		defer ticker.Stop()
+		j.RunOnce()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				j.RunOnce()
+			}
+		}
+	}()
+}
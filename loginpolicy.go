@@ -0,0 +1,164 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// ErrLoginDenied is returned if a LoginPolicy denies a login.
+var ErrLoginDenied = errors.New("Login denied by policy.")
+
+// ErrStepUpRequired is returned if a LoginPolicy requires an additional
+// authentication step.
+var ErrStepUpRequired = errors.New("Additional authentication required.")
+
+// LoginDecision is the result of a LoginPolicy.
+//
+// New in version v0.7
+type LoginDecision int
+
+const (
+	// LoginAllow allows the login.
+	LoginAllow LoginDecision = iota
+	// LoginStepUp requires an additional authentication step (for example
+	// a second factor) before the session is created.
+	LoginStepUp
+	// LoginDeny denies the login.
+	LoginDeny
+)
+
+// LoginAttempt contains the information a LoginPolicy can use: the user
+// (after the credentials were verified), the client IP, the time and the
+// tenant of the request.
+//
+// New in version v0.7
+type LoginAttempt struct {
+	User    *BaseUserInformation
+	IP      string
+	Time    time.Time
+	Tenant  string
+	Request *http.Request
+}
+
+// NewLoginAttempt returns the LoginAttempt for a request, the user info is
+// looked up with GetUserBaseInfo (for the tenant of the request, if any).
+//
+// New in version v0.7
+func NewLoginAttempt(r *http.Request, users UserHandler, userName string) (*LoginAttempt, error) {
+	tenant, _ := TenantFromContext(r.Context())
+	var info *BaseUserInformation
+	var err error
+	if tenantUsers, ok := users.(TenantUserHandler); ok && tenant != "" {
+		info, err = tenantUsers.GetUserBaseInfoForTenant(tenant, userName)
+	} else {
+		info, err = users.GetUserBaseInfo(userName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	info.UserName = userName
+	return &LoginAttempt{User: info, IP: ClientIP(r), Time: CurrentTime(),
+		Tenant: tenant, Request: r}, nil
+}
+
+// LoginPolicy decides if a user with valid credentials may log in.
+// It is evaluated after the credentials were verified but before the
+// session is created, so it can implement rules like "contractors can't log
+// in outside business hours".
+//
+// New in version v0.7
+type LoginPolicy interface {
+	Evaluate(attempt *LoginAttempt) (LoginDecision, error)
+}
+
+// LoginPolicyFunc is a function that implements LoginPolicy.
+//
+// New in version v0.7
+type LoginPolicyFunc func(attempt *LoginAttempt) (LoginDecision, error)
+
+func (f LoginPolicyFunc) Evaluate(attempt *LoginAttempt) (LoginDecision, error) {
+	return f(attempt)
+}
+
+// LoginPolicies combines several policies: the strictest decision wins
+// (LoginDeny over LoginStepUp over LoginAllow).
+//
+// New in version v0.7
+type LoginPolicies []LoginPolicy
+
+func (policies LoginPolicies) Evaluate(attempt *LoginAttempt) (LoginDecision, error) {
+	res := LoginAllow
+	for _, policy := range policies {
+		decision, err := policy.Evaluate(attempt)
+		if err != nil {
+			return LoginDeny, err
+		}
+		if decision > res {
+			res = decision
+		}
+		if res == LoginDeny {
+			break
+		}
+	}
+	return res, nil
+}
+
+// BusinessHoursPolicy returns a policy that returns the decision outside for
+// logins outside of the business hours and LoginAllow otherwise. The business
+// hours are from start to end (hours of the day in loc, end exclusive) on
+// the given weekdays.
+// If applies is not nil the policy only applies to attempts for which
+// applies returns true (for example only for contractors), all other
+// attempts are allowed.
+//
+// New in version v0.7
+func BusinessHoursPolicy(loc *time.Location, start, end int, weekdays []time.Weekday, outside LoginDecision, applies func(attempt *LoginAttempt) bool) LoginPolicy {
+	days := make(map[time.Weekday]bool, len(weekdays))
+	for _, day := range weekdays {
+		days[day] = true
+	}
+	return LoginPolicyFunc(func(attempt *LoginAttempt) (LoginDecision, error) {
+		if applies != nil && !applies(attempt) {
+			return LoginAllow, nil
+		}
+		t := attempt.Time.In(loc)
+		if days[t.Weekday()] && t.Hour() >= start && t.Hour() < end {
+			return LoginAllow, nil
+		}
+		return outside, nil
+	})
+}
+
+// InactiveUserPolicy is a policy that denies the login of users that are
+// not active (BaseUserInformation.IsActive).
+//
+// New in version v0.7
+var InactiveUserPolicy LoginPolicy = LoginPolicyFunc(func(attempt *LoginAttempt) (LoginDecision, error) {
+	if !attempt.User.IsActive {
+		return LoginDeny, nil
+	}
+	return LoginAllow, nil
+})
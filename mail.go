@@ -0,0 +1,419 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"mime"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrTemplateNotFound is returned if a mail template is not registered.
+var ErrTemplateNotFound = errors.New("Mail template not found.")
+
+// MailMessage is an email, HTML is optional.
+//
+// New in version v0.7
+type MailMessage struct {
+	From, Subject, Text, HTML string
+	To                        []string
+}
+
+// Mailer sends emails.
+//
+// New in version v0.7
+type Mailer interface {
+	Send(msg *MailMessage) error
+}
+
+// MailerFunc is a function that implements Mailer.
+//
+// New in version v0.7
+type MailerFunc func(msg *MailMessage) error
+
+func (f MailerFunc) Send(msg *MailMessage) error {
+	return f(msg)
+}
+
+// SMTPMailer is a Mailer that sends emails with net/smtp, so STARTTLS is
+// used if the server supports it.
+//
+// New in version v0.7
+type SMTPMailer struct {
+	// Addr is the address of the server, for example "smtp.example.com:587".
+	Addr string
+
+	// Auth is the authentication, for example smtp.PlainAuth. May be nil.
+	Auth smtp.Auth
+
+	// From is used if the message has no sender.
+	From string
+}
+
+// NewSMTPMailer returns a new SMTPMailer that uses PLAIN authentication if
+// user is not empty.
+func NewSMTPMailer(addr, user, password, from string) *SMTPMailer {
+	var auth smtp.Auth
+	if user != "" {
+		host := addr
+		if i := strings.LastIndex(addr, ":"); i >= 0 {
+			host = addr[:i]
+		}
+		auth = smtp.PlainAuth("", user, password, host)
+	}
+	return &SMTPMailer{Addr: addr, Auth: auth, From: from}
+}
+
+// Send sends the message, it's a multipart/alternative message if it has a
+// HTML part.
+func (m *SMTPMailer) Send(msg *MailMessage) error {
+	from := msg.From
+	if from == "" {
+		from = m.From
+	}
+	if len(msg.To) == 0 {
+		return errors.New("Mail without recipients.")
+	}
+	for _, addr := range append([]string{from}, msg.To...) {
+		if strings.ContainsAny(addr, "\r\n") {
+			return errors.New("Invalid mail address.")
+		}
+	}
+	body, err := FormatMailMessage(from, msg)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(m.Addr, m.Auth, from, msg.To, body)
+}
+
+// FormatMailMessage returns the message in the internet message format,
+// from is the sender.
+//
+// New in version v0.7
+func FormatMailMessage(from string, msg *MailMessage) ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(msg.To, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", CurrentTime().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	if msg.HTML == "" {
+		buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+		buf.WriteString(msg.Text)
+		return buf.Bytes(), nil
+	}
+	rnd := make([]byte, 12)
+	if _, err := rand.Read(rnd); err != nil {
+		return nil, err
+	}
+	boundary := "goauth-" + hex.EncodeToString(rnd)
+	fmt.Fprintf(&buf, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", boundary)
+	fmt.Fprintf(&buf, "--%s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n", boundary, msg.Text)
+	fmt.Fprintf(&buf, "--%s\r\nContent-Type: text/html; charset=utf-8\r\n\r\n%s\r\n", boundary, msg.HTML)
+	fmt.Fprintf(&buf, "--%s--\r\n", boundary)
+	return buf.Bytes(), nil
+}
+
+// Names of the templates used by AuthMailer.
+const (
+	MailVerification  = "verification"
+	MailPasswordReset = "password_reset"
+	MailInvite        = "invite"
+	MailNewLogin      = "new_login"
+	// MailConcurrentLogin is sent for EventConcurrentLogin events, see
+	// AuthMailer.ConcurrentLoginAlerts.
+	MailConcurrentLogin = "concurrent_login"
+)
+
+// MailData is passed to the mail templates, not all fields are set for all
+// templates: Invite is only set for invites, Event only for new-login and
+// concurrent-login alerts.
+//
+// New in version v0.7
+type MailData struct {
+	AppName string
+	User    *BaseUserInformation
+	Token   string
+	// Link is the URL containing the token.
+	Link   string
+	Invite *Invite
+	Event  *SecurityEvent
+
+	// Location is the timezone of User (see BaseUserInformation.Location),
+	// time.UTC if there is no user. Use it to format times in templates:
+	// {{(.Event.Time.In .Location).Format "2006-01-02 15:04 MST"}}.
+	//
+	// New in version v0.7
+	Location *time.Location
+}
+
+type mailTemplate struct {
+	subject, text *texttemplate.Template
+	html          *htmltemplate.Template
+}
+
+// MailTemplates is a registry of mail templates. Each template consists of
+// a subject and a text body (text/template) and an optional HTML body
+// (html/template).
+//
+// New in version v0.7
+type MailTemplates struct {
+	mutex     sync.RWMutex
+	templates map[string]*mailTemplate
+}
+
+// NewMailTemplates returns an empty registry.
+func NewMailTemplates() *MailTemplates {
+	return &MailTemplates{templates: make(map[string]*mailTemplate)}
+}
+
+// DefaultMailTemplates returns a registry with simple english templates for
+// the mails sent by AuthMailer, use Register to replace them.
+func DefaultMailTemplates() *MailTemplates {
+	res := NewMailTemplates()
+	res.MustRegister(MailVerification, "Verify your email address for {{.AppName}}",
+		"Hello {{.User.UserName}},\n\nplease verify your email address by opening the following link:\n\n{{.Link}}\n", "")
+	res.MustRegister(MailPasswordReset, "Reset your password for {{.AppName}}",
+		"Hello {{.User.UserName}},\n\nsomeone requested to reset your password. If it was you open the following link:\n\n{{.Link}}\n\nOtherwise you can ignore this mail.\n", "")
+	res.MustRegister(MailInvite, "You have been invited to {{.AppName}}",
+		"Hello,\n\nyou have been invited to create an account. Open the following link to accept the invitation:\n\n{{.Link}}\n", "")
+	res.MustRegister(MailNewLogin, "New login to your {{.AppName}} account",
+		"Hello {{.User.UserName}},\n\nthere was a login to your account from a new device at {{(.Event.Time.In .Location).Format \"2006-01-02 15:04 MST\"}} (IP {{.Event.IP}}).\n\nIf this wasn't you change your password immediately.\n", "")
+	res.MustRegister(MailConcurrentLogin, "New login to your {{.AppName}} account while you're logged in elsewhere",
+		"Hello {{.User.UserName}},\n\nthere was a login to your account at {{(.Event.Time.In .Location).Format \"2006-01-02 15:04 MST\"}} (IP {{.Event.IP}}) while you're logged in on {{index .Event.Data \"sessions\"}} other device(s).\n\nIf this wasn't you log out all sessions and change your password immediately.\n", "")
+	return res
+}
+
+// Register parses and registers a template, an existing template with the
+// same name is replaced. html may be empty.
+func (t *MailTemplates) Register(name, subject, text, html string) error {
+	tmpl := &mailTemplate{}
+	var err error
+	if tmpl.subject, err = texttemplate.New(name + ".subject").Parse(subject); err != nil {
+		return err
+	}
+	if tmpl.text, err = texttemplate.New(name + ".text").Parse(text); err != nil {
+		return err
+	}
+	if html != "" {
+		if tmpl.html, err = htmltemplate.New(name + ".html").Parse(html); err != nil {
+			return err
+		}
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.templates[name] = tmpl
+	return nil
+}
+
+// MustRegister is like Register but panics if a template can't be parsed.
+func (t *MailTemplates) MustRegister(name, subject, text, html string) {
+	if err := t.Register(name, subject, text, html); err != nil {
+		panic(err)
+	}
+}
+
+// lookup returns the name of the template for the locale: name + "." +
+// locale if registered (for example "verification.de-AT"), otherwise the
+// template for the language of the locale ("verification.de") and name if
+// neither is registered.
+func (t *MailTemplates) lookup(name, locale string) string {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	for locale != "" {
+		if _, has := t.templates[name+"."+locale]; has {
+			return name + "." + locale
+		}
+		i := strings.LastIndexByte(locale, '-')
+		if i < 0 {
+			break
+		}
+		locale = locale[:i]
+	}
+	return name
+}
+
+// Render executes the template and returns the message (without sender and
+// recipients). Returns ErrTemplateNotFound if there is no such template.
+func (t *MailTemplates) Render(name string, data interface{}) (*MailMessage, error) {
+	t.mutex.RLock()
+	tmpl, has := t.templates[name]
+	t.mutex.RUnlock()
+	if !has {
+		return nil, ErrTemplateNotFound
+	}
+	var subject, text, html bytes.Buffer
+	if err := tmpl.subject.Execute(&subject, data); err != nil {
+		return nil, err
+	}
+	if err := tmpl.text.Execute(&text, data); err != nil {
+		return nil, err
+	}
+	if tmpl.html != nil {
+		if err := tmpl.html.Execute(&html, data); err != nil {
+			return nil, err
+		}
+	}
+	// newlines in the subject would allow header injection
+	return &MailMessage{Subject: strings.Join(strings.Fields(subject.String()), " "),
+		Text: text.String(), HTML: html.String()}, nil
+}
+
+// AuthMailer sends the emails of the authentication flows. Its methods can
+// be used as delivery functions of the flows and it's a SecurityNotifier
+// that sends new-login alerts:
+//
+//	mails := goauth.NewAuthMailer(goauth.NewSMTPMailer(addr, user, pw, from), users, "My App")
+//	mails.ResetURL = "https://example.com/password/reset"
+//	resets.Deliver = mails.SendPasswordReset
+//	verifier.Deliver = mails.SendVerification
+//	invites.Deliver = mails.SendInvite
+//	devices.Notifier = mails
+//
+// New in version v0.7
+type AuthMailer struct {
+	Mailer    Mailer
+	Templates *MailTemplates
+
+	// Users is used to look up the address for new-login alerts.
+	Users UserHandler
+
+	AppName string
+
+	// VerifyURL, ResetURL and InviteURL are the pages that handle the
+	// tokens, the token is added as query parameter "token" to build
+	// MailData.Link.
+	VerifyURL, ResetURL, InviteURL string
+
+	// ConcurrentLoginAlerts enables alerts for EventConcurrentLogin events,
+	// see ConcurrentLoginDetector.
+	//
+	// New in version v0.7
+	ConcurrentLoginAlerts bool
+}
+
+// NewAuthMailer returns a new AuthMailer with the default templates.
+func NewAuthMailer(mailer Mailer, users UserHandler, appName string) *AuthMailer {
+	return &AuthMailer{Mailer: mailer, Templates: DefaultMailTemplates(),
+		Users: users, AppName: appName}
+}
+
+func tokenLink(base, token string) string {
+	if base == "" {
+		return ""
+	}
+	sep := "?"
+	if strings.Contains(base, "?") {
+		sep = "&"
+	}
+	return base + sep + "token=" + url.QueryEscape(token)
+}
+
+// Send renders the template and sends the mail to the address.
+// If data.User has a locale the template registered for the locale is used,
+// for example "verification.de" for a user with locale "de-AT". This way
+// localized templates can be registered next to the default ones.
+func (m *AuthMailer) Send(name, to string, data *MailData) error {
+	if to == "" {
+		return ErrNoEmail
+	}
+	data.AppName = m.AppName
+	if data.Location == nil {
+		data.Location = time.UTC
+		if data.User != nil {
+			data.Location = data.User.Location()
+		}
+	}
+	if data.User != nil {
+		name = m.Templates.lookup(name, data.User.Locale)
+	}
+	msg, err := m.Templates.Render(name, data)
+	if err != nil {
+		return err
+	}
+	msg.To = []string{to}
+	return m.Mailer.Send(msg)
+}
+
+// SendVerification sends the email verification token, it can be used as
+// EmailVerifier.Deliver.
+func (m *AuthMailer) SendVerification(info *BaseUserInformation, token string) error {
+	return m.Send(MailVerification, info.Email, &MailData{User: info, Token: token,
+		Link: tokenLink(m.VerifyURL, token)})
+}
+
+// SendPasswordReset sends the password reset token, it can be used as
+// PasswordResetManager.Deliver.
+func (m *AuthMailer) SendPasswordReset(info *BaseUserInformation, token string) error {
+	return m.Send(MailPasswordReset, info.Email, &MailData{User: info, Token: token,
+		Link: tokenLink(m.ResetURL, token)})
+}
+
+// SendInvite sends the invite token, it can be used as
+// InviteManager.Deliver.
+func (m *AuthMailer) SendInvite(invite *Invite, token string) error {
+	return m.Send(MailInvite, invite.Email, &MailData{Invite: invite, Token: token,
+		Link: tokenLink(m.InviteURL, token)})
+}
+
+// Notify sends a new-login alert for EventNewDeviceLogin events and (if
+// ConcurrentLoginAlerts is set) for EventConcurrentLogin events, other
+// events are ignored. The mail is sent in a new goroutine, errors are
+// logged.
+func (m *AuthMailer) Notify(event *SecurityEvent) {
+	var name string
+	switch {
+	case event.Type == EventNewDeviceLogin:
+		name = MailNewLogin
+	case event.Type == EventConcurrentLogin && m.ConcurrentLoginAlerts:
+		name = MailConcurrentLogin
+	default:
+		return
+	}
+	go func() {
+		if err := m.sendNewLogin(name, event); err != nil {
+			log.WithError(err).WithField("user", event.UserName).Error("goauth: Can't send new login mail")
+		}
+	}()
+}
+
+func (m *AuthMailer) sendNewLogin(name string, event *SecurityEvent) error {
+	info, err := m.Users.GetUserBaseInfo(event.UserName)
+	if err != nil {
+		return err
+	}
+	info.UserName = event.UserName
+	return m.Send(name, info.Email, &MailData{User: info, Event: event})
+}
@@ -0,0 +1,388 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Results of a login reported to Metrics.LoginAttempt.
+//
+// New in version v0.7
+const (
+	LoginResultSuccess     = "success"
+	LoginResultInvalid     = "invalid_credentials"
+	LoginResultRateLimited = "rate_limited"
+	LoginResultBanned      = "ip_banned"
+	LoginResultDenied      = "denied"
+	LoginResultStepUp      = "step_up"
+	LoginResultPending     = "pending"
+	LoginResultBusy        = "busy"
+	LoginResultError       = "error"
+)
+
+// Metrics receives measurements from goauth so operators can alert on auth
+// anomalies (for example a spike in failed logins).
+// goauth doesn't depend on a metrics library, the package
+// github.com/FabianWe/goauth/adapters/promauth implements Metrics with
+// Prometheus collectors.
+//
+// Metrics is used by AuthHandlers (logins), SessionController (failed session
+// validations), InstrumentedSessionHandler and InstrumentedUserHandler
+// (latency of the backends) and Janitor (removed entries).
+// The methods are called concurrently and should not block.
+//
+// New in version v0.7
+type Metrics interface {
+	// LoginAttempt is called for each login with one of the LoginResult
+	// constants.
+	LoginAttempt(result string)
+
+	// ValidationFailed is called if a session can't be validated, reason is
+	// "no_session" (no auth session cookie), "not_found" (unknown key),
+	// "expired", "audience" (see SessionController.Audience),
+	// "invalid_signature" (see SessionController.Signer) or "error".
+	ValidationFailed(reason string)
+
+	// ObserveBackend is called after an operation of a session or user
+	// backend with the name of the backend (for example "sql" or "redis"), the
+	// operation (for example "GetData" or "CreateEntry") and the result.
+	ObserveBackend(backend, op string, duration time.Duration, err error)
+
+	// JanitorRun is called after a janitor task finished.
+	JanitorRun(task string, removed int64, err error)
+}
+
+// validationFailureReason returns the reason passed to
+// Metrics.ValidationFailed for an error of ValidateSession.
+func validationFailureReason(err error) string {
+	switch {
+	case err == ErrNotAuthSession:
+		return "no_session"
+	case errors.Is(err, ErrSessionRevoked):
+		return "revoked"
+	case err == ErrKeyNotFound:
+		return "not_found"
+	case err == ErrInvalidKey:
+		return "expired"
+	case err == ErrGuestSession:
+		return "guest"
+	case err == ErrWrongAudience:
+		return "audience"
+	case err == ErrInvalidKeySignature:
+		return "invalid_signature"
+	default:
+		return "error"
+	}
+}
+
+// MultiMetrics reports to all its elements.
+//
+// New in version v0.7
+type MultiMetrics []Metrics
+
+func (m MultiMetrics) LoginAttempt(result string) {
+	for _, metrics := range m {
+		metrics.LoginAttempt(result)
+	}
+}
+
+func (m MultiMetrics) ValidationFailed(reason string) {
+	for _, metrics := range m {
+		metrics.ValidationFailed(reason)
+	}
+}
+
+func (m MultiMetrics) ObserveBackend(backend, op string, duration time.Duration, err error) {
+	for _, metrics := range m {
+		metrics.ObserveBackend(backend, op, duration, err)
+	}
+}
+
+func (m MultiMetrics) JanitorRun(task string, removed int64, err error) {
+	for _, metrics := range m {
+		metrics.JanitorRun(task, removed, err)
+	}
+}
+
+// SlowOperationLogger is a Metrics that logs all backend operations that
+// take at least Threshold, for example to catch missing indexes in
+// production. The other methods of Metrics do nothing, use MultiMetrics to
+// combine it with other metrics.
+//
+// Usage:
+//
+//	slow := goauth.NewSlowOperationLogger(100 * time.Millisecond)
+//	controller := goauth.NewSessionController(goauth.NewInstrumentedSessionHandler(sessions, "sql", slow))
+//	users := goauth.NewInstrumentedUserHandler(sqlUsers, "sql", slow)
+//
+// New in version v0.7
+type SlowOperationLogger struct {
+	// Threshold is the minimal duration of an operation that is logged.
+	Threshold time.Duration
+
+	// Logger is used to log slow operations with the fields backend, op
+	// and duration, by default the standard logger of logrus.
+	Logger log.FieldLogger
+}
+
+// NewSlowOperationLogger returns a new SlowOperationLogger that logs to the
+// standard logger.
+func NewSlowOperationLogger(threshold time.Duration) *SlowOperationLogger {
+	return &SlowOperationLogger{Threshold: threshold, Logger: log.StandardLogger()}
+}
+
+func (l *SlowOperationLogger) LoginAttempt(result string) {}
+
+func (l *SlowOperationLogger) ValidationFailed(reason string) {}
+
+func (l *SlowOperationLogger) ObserveBackend(backend, op string, duration time.Duration, err error) {
+	if duration < l.Threshold {
+		return
+	}
+	l.Logger.WithFields(log.Fields{
+		"backend":  backend,
+		"op":       op,
+		"duration": duration,
+	}).Warn("goauth: Slow backend operation")
+}
+
+func (l *SlowOperationLogger) JanitorRun(task string, removed int64, err error) {}
+
+// InstrumentedSessionHandler wraps a SessionHandler and reports the latency
+// and result of all operations to Metrics.
+// It implements SessionLister and TenantSessionHandler if the wrapped
+// handler does, otherwise these methods return ErrNotSupported.
+//
+// Usage:
+//
+//	handler := goauth.NewInstrumentedSessionHandler(goauth.NewRedisSessionHandler(client), "redis", metrics)
+//	controller := goauth.NewSessionController(handler)
+//
+// New in version v0.7
+type InstrumentedSessionHandler struct {
+	SessionHandler
+	Backend string
+	Metrics Metrics
+}
+
+// NewInstrumentedSessionHandler returns a new InstrumentedSessionHandler,
+// backend is the name of the backend reported to metrics.
+func NewInstrumentedSessionHandler(h SessionHandler, backend string, metrics Metrics) *InstrumentedSessionHandler {
+	return &InstrumentedSessionHandler{SessionHandler: h, Backend: backend, Metrics: metrics}
+}
+
+func (h *InstrumentedSessionHandler) observe(op string, start time.Time, err error) {
+	// a key that doesn't exist is not a failure of the backend
+	if err == ErrKeyNotFound {
+		err = nil
+	}
+	h.Metrics.ObserveBackend(h.Backend, op, time.Since(start), err)
+}
+
+func (h *InstrumentedSessionHandler) GetData(key string) (*SessionKeyData, error) {
+	start := time.Now()
+	data, err := h.SessionHandler.GetData(key)
+	h.observe("GetData", start, err)
+	return data, err
+}
+
+func (h *InstrumentedSessionHandler) CreateEntry(user UserKeyType, key string, validDuration time.Duration) (*SessionKeyData, error) {
+	start := time.Now()
+	data, err := h.SessionHandler.CreateEntry(user, key, validDuration)
+	h.observe("CreateEntry", start, err)
+	return data, err
+}
+
+func (h *InstrumentedSessionHandler) DeleteEntriesForUser(user UserKeyType) (int64, error) {
+	start := time.Now()
+	num, err := h.SessionHandler.DeleteEntriesForUser(user)
+	h.observe("DeleteEntriesForUser", start, err)
+	return num, err
+}
+
+func (h *InstrumentedSessionHandler) DeleteInvalidKeys() (int64, error) {
+	start := time.Now()
+	num, err := h.SessionHandler.DeleteInvalidKeys()
+	h.observe("DeleteInvalidKeys", start, err)
+	return num, err
+}
+
+func (h *InstrumentedSessionHandler) DeleteKey(key string) error {
+	start := time.Now()
+	err := h.SessionHandler.DeleteKey(key)
+	h.observe("DeleteKey", start, err)
+	return err
+}
+
+// Healthy calls the wrapped handler if it implements HealthChecker.
+func (h *InstrumentedSessionHandler) Healthy(ctx context.Context) error {
+	if checker, ok := h.SessionHandler.(HealthChecker); ok {
+		return checker.Healthy(ctx)
+	}
+	return nil
+}
+
+// ListSessionsForUser calls the wrapped handler, see SessionLister.
+func (h *InstrumentedSessionHandler) ListSessionsForUser(user UserKeyType) (map[string]*SessionKeyData, error) {
+	lister, ok := h.SessionHandler.(SessionLister)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	start := time.Now()
+	res, err := lister.ListSessionsForUser(user)
+	h.observe("ListSessionsForUser", start, err)
+	return res, err
+}
+
+// CreateEntryForTenant calls the wrapped handler, see TenantSessionHandler.
+func (h *InstrumentedSessionHandler) CreateEntryForTenant(tenant string, user UserKeyType, key string, validDuration time.Duration) (*SessionKeyData, error) {
+	tenantHandler, ok := h.SessionHandler.(TenantSessionHandler)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	start := time.Now()
+	data, err := tenantHandler.CreateEntryForTenant(tenant, user, key, validDuration)
+	h.observe("CreateEntry", start, err)
+	return data, err
+}
+
+// GetDataForTenant calls the wrapped handler, see TenantSessionHandler.
+func (h *InstrumentedSessionHandler) GetDataForTenant(tenant, key string) (*SessionKeyData, error) {
+	tenantHandler, ok := h.SessionHandler.(TenantSessionHandler)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	start := time.Now()
+	data, err := tenantHandler.GetDataForTenant(tenant, key)
+	h.observe("GetData", start, err)
+	return data, err
+}
+
+// InstrumentedUserHandler wraps a UserHandler and reports the latency and
+// result of all operations to Metrics.
+// Note that it only implements UserHandler (and HealthChecker), the
+// optional interfaces of the wrapped handler (for example AdminFlagHandler)
+// are not available through the wrapper. Use the wrapper where only a
+// UserHandler is required, or call Unwrap.
+//
+// New in version v0.7
+type InstrumentedUserHandler struct {
+	Users   UserHandler
+	Backend string
+	Metrics Metrics
+}
+
+// NewInstrumentedUserHandler returns a new InstrumentedUserHandler,
+// backend is the name of the backend reported to metrics.
+func NewInstrumentedUserHandler(users UserHandler, backend string, metrics Metrics) *InstrumentedUserHandler {
+	return &InstrumentedUserHandler{Users: users, Backend: backend, Metrics: metrics}
+}
+
+// Unwrap returns the wrapped UserHandler.
+func (h *InstrumentedUserHandler) Unwrap() UserHandler {
+	return h.Users
+}
+
+func (h *InstrumentedUserHandler) observe(op string, start time.Time, err error) {
+	// these errors are results, not failures of the backend
+	if err == ErrUserNotFound || err == ErrRegistrationPending {
+		err = nil
+	}
+	h.Metrics.ObserveBackend(h.Backend, op, time.Since(start), err)
+}
+
+func (h *InstrumentedUserHandler) Init() error {
+	start := time.Now()
+	err := h.Users.Init()
+	h.observe("Init", start, err)
+	return err
+}
+
+func (h *InstrumentedUserHandler) Insert(userName, firstName, lastName, email string, plainPW []byte) (uint64, error) {
+	start := time.Now()
+	id, err := h.Users.Insert(userName, firstName, lastName, email, plainPW)
+	h.observe("Insert", start, err)
+	return id, err
+}
+
+func (h *InstrumentedUserHandler) Validate(userName string, cleartextPwCheck []byte) (uint64, error) {
+	start := time.Now()
+	id, err := h.Users.Validate(userName, cleartextPwCheck)
+	h.observe("Validate", start, err)
+	return id, err
+}
+
+func (h *InstrumentedUserHandler) UpdatePassword(userName string, plainPW []byte) error {
+	start := time.Now()
+	err := h.Users.UpdatePassword(userName, plainPW)
+	h.observe("UpdatePassword", start, err)
+	return err
+}
+
+func (h *InstrumentedUserHandler) ListUsers() (map[uint64]string, error) {
+	start := time.Now()
+	res, err := h.Users.ListUsers()
+	h.observe("ListUsers", start, err)
+	return res, err
+}
+
+func (h *InstrumentedUserHandler) GetUserName(id uint64) (string, error) {
+	start := time.Now()
+	res, err := h.Users.GetUserName(id)
+	h.observe("GetUserName", start, err)
+	return res, err
+}
+
+func (h *InstrumentedUserHandler) GetUserID(userName string) (uint64, error) {
+	start := time.Now()
+	res, err := h.Users.GetUserID(userName)
+	h.observe("GetUserID", start, err)
+	return res, err
+}
+
+func (h *InstrumentedUserHandler) DeleteUser(userName string) error {
+	start := time.Now()
+	err := h.Users.DeleteUser(userName)
+	h.observe("DeleteUser", start, err)
+	return err
+}
+
+func (h *InstrumentedUserHandler) GetUserBaseInfo(userName string) (*BaseUserInformation, error) {
+	start := time.Now()
+	res, err := h.Users.GetUserBaseInfo(userName)
+	h.observe("GetUserBaseInfo", start, err)
+	return res, err
+}
+
+// Healthy calls the wrapped handler if it implements HealthChecker.
+func (h *InstrumentedUserHandler) Healthy(ctx context.Context) error {
+	if checker, ok := h.Users.(HealthChecker); ok {
+		return checker.Healthy(ctx)
+	}
+	return nil
+}
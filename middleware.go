@@ -0,0 +1,241 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gorilla/sessions"
+	log "github.com/sirupsen/logrus"
+)
+
+// contextKey is the type of the keys used to store values in a request
+// context, it is not exported to avoid collisions with other packages.
+type contextKey int
+
+const (
+	sessionDataContextKey contextKey = iota
+	sessionKeyContextKey
+	tenantContextKey
+	delegationContextKey
+)
+
+// NewSessionContext returns a copy of ctx that contains the session key and
+// the data stored for it. You usually don't need this, the SessionMiddleware
+// does this for you.
+//
+// New in version v0.7
+func NewSessionContext(ctx context.Context, key string, data *SessionKeyData) context.Context {
+	ctx = context.WithValue(ctx, sessionKeyContextKey, key)
+	return context.WithValue(ctx, sessionDataContextKey, data)
+}
+
+// SessionDataFromContext returns the session data stored in the context by
+// the SessionMiddleware, nil if there is no (valid) session.
+//
+// New in version v0.7
+func SessionDataFromContext(ctx context.Context) *SessionKeyData {
+	data, _ := ctx.Value(sessionDataContextKey).(*SessionKeyData)
+	return data
+}
+
+// SessionKeyFromContext returns the session key stored in the context by
+// the SessionMiddleware, "" if there is no (valid) session.
+//
+// New in version v0.7
+func SessionKeyFromContext(ctx context.Context) string {
+	key, _ := ctx.Value(sessionKeyContextKey).(string)
+	return key
+}
+
+// UserFromContext returns the user of the session stored in the context and
+// true, or nil and false if there is no (valid) session.
+//
+// New in version v0.7
+func UserFromContext(ctx context.Context) (UserKeyType, bool) {
+	data := SessionDataFromContext(ctx)
+	if data == nil {
+		return nil, false
+	}
+	return data.User, true
+}
+
+// UserIDFromContext is like UserFromContext but converts the user to an id
+// with UserKeyToID. It returns NoUserID and false if there is no session or
+// the user can't be converted.
+//
+// New in version v0.7
+func UserIDFromContext(ctx context.Context) (uint64, bool) {
+	user, ok := UserFromContext(ctx)
+	if !ok {
+		return NoUserID, false
+	}
+	id, err := UserKeyToID(user)
+	if err != nil {
+		return NoUserID, false
+	}
+	return id, true
+}
+
+// SessionMiddleware is a net/http middleware that validates the session of
+// a request and stores the session data in the request context, so your
+// handlers can simply use UserFromContext etc.
+//
+// The session key is taken from an "Authorization: Bearer <key>" header if
+// present (for API clients, for example access tokens issued by OAuthServer,
+// see Tokens), then from the header Controller.TokenHeader (if set) and
+// otherwise from the session cookie (the gorilla session managed by
+// Controller).
+//
+// New in version v0.7
+type SessionMiddleware struct {
+	Controller *SessionController
+	Store      sessions.Store
+
+	// Tokens verifies bearer tokens, if it is nil they are looked up as
+	// session keys of Controller.
+	Tokens TokenVerifier
+
+	// Unauthorized is called by RequireSession if there is no valid session.
+	// Defaults to a plain 401 response, you may want to redirect to your
+	// login page instead.
+	Unauthorized http.HandlerFunc
+}
+
+// NewSessionMiddleware returns a new SessionMiddleware.
+//
+// New in version v0.7
+func NewSessionMiddleware(controller *SessionController, store sessions.Store) *SessionMiddleware {
+	return &SessionMiddleware{Controller: controller, Store: store}
+}
+
+// isAuthError returns true if err means that the request simply doesn't
+// have a valid session (and not that something went wrong).
+func isAuthError(err error) bool {
+	return isKeyNotFound(err) || err == ErrInvalidKey || err == ErrNotAuthSession ||
+		err == ErrGuestSession || err == ErrInvalidKeySignature || err == ErrWrongAudience ||
+		err == ErrScopedSession
+}
+
+// Authenticate validates the session of the request. It returns the key and
+// the session data if the session is valid. If there is no valid session it
+// returns "", nil and an error (ErrNotAuthSession, ErrKeyNotFound,
+// ErrInvalidKey or any other error if the lookup failed). Sessions
+// restricted to scopes are rejected with ErrScopedSession, see RequireScope.
+//
+// Cookie sessions with an invalid key are deleted by saving the session
+// with MaxAge -1 (w may be nil to avoid that). For keys from
+// Controller.TokenHeader the TokenExpiresHeader is set on w instead.
+func (m *SessionMiddleware) Authenticate(w http.ResponseWriter, r *http.Request) (string, *SessionKeyData, error) {
+	return m.authenticate(w, r, false)
+}
+
+// authenticate implements Authenticate, if allowScoped is true sessions
+// restricted to scopes are accepted as well.
+func (m *SessionMiddleware) authenticate(w http.ResponseWriter, r *http.Request, allowScoped bool) (string, *SessionKeyData, error) {
+	if token := bearerToken(r); token != "" {
+		var verifier TokenVerifier = m.Tokens
+		if verifier == nil {
+			verifier = SessionTokenVerifier{Controller: m.Controller}
+		}
+		data, err := verifyToken(verifier, token, allowScoped)
+		if err != nil {
+			return "", nil, err
+		}
+		return plainToken(verifier, token), data, nil
+	}
+	if m.Controller.SessionToken(r) != "" {
+		data, key, err := m.Controller.validateToken(r, allowScoped)
+		if err != nil {
+			return "", nil, err
+		}
+		if w != nil {
+			SetTokenExpiry(w, data)
+		}
+		return key, data, nil
+	}
+	var data *SessionKeyData
+	var session *sessions.Session
+	var err error
+	if allowScoped {
+		data, session, err = m.Controller.validateScopedSession(r, m.Store)
+	} else {
+		data, session, err = m.Controller.ValidateSession(r, m.Store)
+	}
+	if err != nil {
+		if err == ErrInvalidKey && w != nil && session != nil {
+			session.Save(r, w)
+		}
+		return "", nil, err
+	}
+	key, err := m.Controller.GetKey(session)
+	if err != nil {
+		return "", nil, err
+	}
+	return key, data, nil
+}
+
+// RequireSession returns a handler that calls next only if the request has
+// a valid session, otherwise m.Unauthorized is called.
+func (m *SessionMiddleware) RequireSession(next http.Handler) http.Handler {
+	return m.require(false, next)
+}
+
+// require implements RequireSession and RequireScope.
+func (m *SessionMiddleware) require(allowScoped bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, data, err := m.authenticate(w, r, allowScoped)
+		if err != nil {
+			if !isAuthError(err) {
+				log.WithError(err).Error("goauth: Can't validate session")
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			if m.Unauthorized != nil {
+				m.Unauthorized(w, r)
+			} else {
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			}
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(NewSessionContext(r.Context(), key, data)))
+	})
+}
+
+// OptionalSession returns a handler that always calls next. If the request
+// has a valid session the session data is stored in the context, otherwise
+// the request is passed on unchanged.
+func (m *SessionMiddleware) OptionalSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, data, err := m.Authenticate(w, r)
+		if err != nil {
+			if !isAuthError(err) {
+				log.WithError(err).Warn("goauth: Can't validate session")
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(NewSessionContext(r.Context(), key, data)))
+	})
+}
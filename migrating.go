@@ -0,0 +1,279 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package goauth
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MigratingSessionHandler moves sessions from one SessionHandler to another
+// without downtime, for example from sqlite to redis.
+//
+// New sessions are written to both handlers (dual-write), so you can switch
+// back to Old at any time. GetData reads from New first and falls back to
+// Old, sessions found in Old are copied to New. Deletions are executed on
+// both handlers.
+//
+// Once no sessions are read from Old anymore (see MigrationReport) or all
+// sessions in Old have expired, all sessions are in New and you can replace
+// the MigratingSessionHandler with New. Backfill copies the sessions of
+// users immediately.
+//
+// Copied sessions are created with CreateEntry, so their creation time is
+// the time of the copy. Errors when writing to Old are logged and ignored,
+// New is authoritative.
+//
+// New in version v0.7
+type MigratingSessionHandler struct {
+	Old, New SessionHandler
+
+	newReads, oldReads, misses, copied, oldWriteErrors int64
+
+	mutex        sync.Mutex
+	lastFallback time.Time
+	started      time.Time
+}
+
+// NewMigratingSessionHandler returns a new MigratingSessionHandler.
+//
+// New in version v0.7
+func NewMigratingSessionHandler(oldHandler, newHandler SessionHandler) *MigratingSessionHandler {
+	return &MigratingSessionHandler{Old: oldHandler, New: newHandler, started: CurrentTime()}
+}
+
+// MigrationReport describes the progress of a MigratingSessionHandler.
+//
+// New in version v0.7
+type MigrationReport struct {
+	// NewReads is the number of sessions read from New.
+	NewReads int64
+
+	// OldReads is the number of sessions that were not found in New but in
+	// Old.
+	OldReads int64
+
+	// Misses is the number of keys that were found in neither handler.
+	Misses int64
+
+	// Copied is the number of sessions copied from Old to New (by GetData or
+	// Backfill).
+	Copied int64
+
+	// OldWriteErrors is the number of writes to Old that failed.
+	OldWriteErrors int64
+
+	// Started is the time the handler was created, LastFallback the last
+	// time a session was read from Old (zero if it never happened).
+	Started, LastFallback time.Time
+}
+
+// Complete reports whether no session was read from Old for the given
+// duration, set it to the maximal lifetime of a session to be sure that all
+// sessions in Old are copied or expired.
+func (r MigrationReport) Complete(quiet time.Duration) bool {
+	last := r.LastFallback
+	if last.IsZero() {
+		last = r.Started
+	}
+	return CurrentTime().Sub(last) >= quiet
+}
+
+// Report returns the progress of the migration.
+func (h *MigratingSessionHandler) Report() MigrationReport {
+	h.mutex.Lock()
+	lastFallback, started := h.lastFallback, h.started
+	h.mutex.Unlock()
+	return MigrationReport{NewReads: atomic.LoadInt64(&h.newReads),
+		OldReads: atomic.LoadInt64(&h.oldReads), Misses: atomic.LoadInt64(&h.misses),
+		Copied: atomic.LoadInt64(&h.copied), OldWriteErrors: atomic.LoadInt64(&h.oldWriteErrors),
+		Started: started, LastFallback: lastFallback}
+}
+
+// oldWriteFailed logs the error if it's not nil.
+func (h *MigratingSessionHandler) oldWriteFailed(err error) {
+	if err != nil {
+		atomic.AddInt64(&h.oldWriteErrors, 1)
+		log.WithError(err).Warn("goauth: Can't write to old session handler")
+	}
+}
+
+func (h *MigratingSessionHandler) Init() error {
+	if err := h.Old.Init(); err != nil {
+		return err
+	}
+	return h.New.Init()
+}
+
+func (h *MigratingSessionHandler) GetData(key string) (*SessionKeyData, error) {
+	data, err := h.New.GetData(key)
+	if err == nil {
+		atomic.AddInt64(&h.newReads, 1)
+		return data, nil
+	}
+	if err != ErrKeyNotFound {
+		return data, err
+	}
+	data, err = h.Old.GetData(key)
+	if err != nil {
+		if err == ErrKeyNotFound {
+			atomic.AddInt64(&h.misses, 1)
+		}
+		return data, err
+	}
+	atomic.AddInt64(&h.oldReads, 1)
+	h.mutex.Lock()
+	h.lastFallback = CurrentTime()
+	h.mutex.Unlock()
+	h.copy(key, data)
+	return data, nil
+}
+
+// copy creates the session in New if it's still valid.
+func (h *MigratingSessionHandler) copy(key string, data *SessionKeyData) bool {
+	validDuration := data.ValidUntil.Sub(CurrentTime())
+	if validDuration <= 0 {
+		return false
+	}
+	if _, err := h.New.CreateEntry(data.User, key, validDuration); err != nil {
+		log.WithError(err).Error("goauth: Can't copy session to new session handler")
+		return false
+	}
+	atomic.AddInt64(&h.copied, 1)
+	return true
+}
+
+func (h *MigratingSessionHandler) CreateEntry(user UserKeyType, key string, validDuration time.Duration) (*SessionKeyData, error) {
+	data, err := h.New.CreateEntry(user, key, validDuration)
+	if err != nil {
+		return data, err
+	}
+	_, oldErr := h.Old.CreateEntry(user, key, validDuration)
+	h.oldWriteFailed(oldErr)
+	return data, nil
+}
+
+// DeleteEntriesForUser deletes the sessions in both handlers, it returns the
+// larger of both numbers because most sessions are stored in both.
+func (h *MigratingSessionHandler) DeleteEntriesForUser(user UserKeyType) (int64, error) {
+	num, err := h.New.DeleteEntriesForUser(user)
+	if err != nil {
+		return num, err
+	}
+	// the sessions must be deleted in Old too, otherwise they would be
+	// copied again by GetData
+	oldNum, err := h.Old.DeleteEntriesForUser(user)
+	if oldNum > num {
+		num = oldNum
+	}
+	return num, err
+}
+
+// DeleteInvalidKeys deletes the invalid keys in both handlers, it returns the
+// larger of both numbers because most sessions are stored in both.
+func (h *MigratingSessionHandler) DeleteInvalidKeys() (int64, error) {
+	num, err := h.New.DeleteInvalidKeys()
+	if err != nil {
+		return num, err
+	}
+	oldNum, err := h.Old.DeleteInvalidKeys()
+	if oldNum > num {
+		num = oldNum
+	}
+	return num, err
+}
+
+func (h *MigratingSessionHandler) DeleteKey(key string) error {
+	if err := h.New.DeleteKey(key); err != nil {
+		return err
+	}
+	return h.Old.DeleteKey(key)
+}
+
+// ListSessionsForUser returns the sessions of the user in both handlers, see
+// SessionLister. Both handlers must implement SessionLister, otherwise
+// ErrNotSupported is returned.
+func (h *MigratingSessionHandler) ListSessionsForUser(user UserKeyType) (map[string]*SessionKeyData, error) {
+	newLister, newOk := h.New.(SessionLister)
+	oldLister, oldOk := h.Old.(SessionLister)
+	if !newOk || !oldOk {
+		return nil, ErrNotSupported
+	}
+	res, err := oldLister.ListSessionsForUser(user)
+	if err != nil {
+		return nil, err
+	}
+	newSessions, err := newLister.ListSessionsForUser(user)
+	if err != nil {
+		return nil, err
+	}
+	for key, data := range newSessions {
+		res[key] = data
+	}
+	return res, nil
+}
+
+// Backfill copies the valid sessions of the users from Old to New (sessions
+// that are already in New are skipped), it returns the number of copied
+// sessions. Use it to complete the migration without waiting for users to
+// send requests, for example with the ids from UserHandler.ListUsers.
+// Old must implement SessionLister, otherwise ErrNotSupported is returned.
+func (h *MigratingSessionHandler) Backfill(users []UserKeyType) (int, error) {
+	oldLister, ok := h.Old.(SessionLister)
+	if !ok {
+		return 0, ErrNotSupported
+	}
+	res := 0
+	for _, user := range users {
+		sessions, err := oldLister.ListSessionsForUser(user)
+		if err != nil {
+			return res, err
+		}
+		for key, data := range sessions {
+			if _, err := h.New.GetData(key); err == nil {
+				continue
+			} else if err != ErrKeyNotFound {
+				return res, err
+			}
+			if h.copy(key, data) {
+				res++
+			}
+		}
+	}
+	return res, nil
+}
+
+// Healthy checks both handlers, see HealthChecker.
+func (h *MigratingSessionHandler) Healthy(ctx context.Context) error {
+	for _, handler := range []SessionHandler{h.New, h.Old} {
+		if checker, ok := handler.(HealthChecker); ok {
+			if err := checker.Healthy(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
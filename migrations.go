@@ -0,0 +1,378 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package goauth
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Migration is a versioned change of the database schema, see SQLMigrator.
+//
+// New in version v0.7
+type Migration struct {
+	// Version is the version of the schema after the migration, versions
+	// start with 1.
+	Version int
+
+	// Description describes the change.
+	Description string
+
+	// Statements are executed in one transaction. Note that MySQL commits
+	// statements that change the schema (like ALTER TABLE) implicitly.
+	Statements []string
+
+	// Applied is optional and checks if the change already exists, for
+	// example because the tables were created by Init of a newer version.
+	// The migration is only recorded then.
+	Applied func(db *sql.DB) (bool, error)
+}
+
+// SQLMigrator applies migrations in the order of their versions and records
+// them in the table goauth_schema_migrations. This way upgrading the package
+// doesn't require manual ALTER TABLEs: Call Migrate each time your program
+// starts instead of (or before) Init of SQLUserHandler and
+// SQLSessionHandler.
+//
+// The migrations of NewMySQLMigrator, NewPostgresMigrator and
+// NewSQLite3Migrator manage the tables users and user_sessions of the
+// default schema. NewMySQLTenantMigrator etc. migrate them to the tenant
+// schema (see MySQLTenantUserQueries and MySQLTenantSessionTemplate)
+// instead. The tables of the other handlers (for example invites) didn't
+// change since they were introduced, their Init still creates them.
+//
+// New in version v0.7
+type SQLMigrator struct {
+	DB         *sql.DB
+	Migrations []Migration
+
+	// InitQ creates the migrations table, InsertQ records a migration
+	// (version, description and time) and VersionQ selects the current
+	// version.
+	InitQ, InsertQ, VersionQ string
+}
+
+// NewSQLMigrator returns a new SQLMigrator, the queries are set for MySQL
+// and sqlite3.
+func NewSQLMigrator(db *sql.DB, migrations []Migration) *SQLMigrator {
+	return &SQLMigrator{DB: db, Migrations: migrations,
+		InitQ: `CREATE TABLE IF NOT EXISTS goauth_schema_migrations (
+			version INT NOT NULL PRIMARY KEY,
+			description VARCHAR(255) NOT NULL,
+			applied DATETIME NOT NULL
+		);`,
+		InsertQ:  "INSERT INTO goauth_schema_migrations (version, description, applied) VALUES (?, ?, ?);",
+		VersionQ: "SELECT COALESCE(MAX(version), 0) FROM goauth_schema_migrations;",
+	}
+}
+
+// NewMySQLMigrator returns a SQLMigrator with the migrations for MySQL,
+// pwLength is the length of the password hashes (see SQLUserQueries).
+func NewMySQLMigrator(db *sql.DB, pwLength int) *SQLMigrator {
+	users := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS users (
+		id SERIAL,
+		username VARCHAR(150) NOT NULL,
+		first_name VARCHAR(30) NOT NULL,
+		last_name VARCHAR(30) NOT NULL,
+		email VARCHAR(254),
+		password CHAR(%d),
+		is_active BOOL,
+		last_login DATETIME,
+		PRIMARY KEY(id),
+		UNIQUE(username)
+	);`, pwLength)
+	sessions := fmt.Sprintf(MySQLSessionTemplate{}.InitQ(), "user_sessions", "BIGINT UNSIGNED NOT NULL", DefaultKeyLength)
+	return NewSQLMigrator(db, defaultMigrations(users, sessions, "BOOL", mySQLCatalog))
+}
+
+// NewMySQLTenantMigrator is like NewMySQLMigrator but migrates the tables
+// to the tenant schema.
+//
+// New in version v0.7
+func NewMySQLTenantMigrator(db *sql.DB, pwLength int) *SQLMigrator {
+	res := NewMySQLMigrator(db, pwLength)
+	res.Migrations = append(res.Migrations, tenantMigrations(mySQLCatalog,
+		"ALTER TABLE users DROP INDEX username, ADD UNIQUE (tenant_id, username);")...)
+	return res
+}
+
+// NewSQLite3Migrator returns a SQLMigrator with the migrations for sqlite3,
+// pwLength is the length of the password hashes (see SQLUserQueries).
+func NewSQLite3Migrator(db *sql.DB, pwLength int) *SQLMigrator {
+	users := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS users (
+		id INTEGER PRIMARY KEY,
+		username VARCHAR(150) NOT NULL,
+		first_name VARCHAR(30) NOT NULL,
+		last_name VARCHAR(30) NOT NULL,
+		email VARCHAR(254),
+		password CHAR(%d),
+		is_active BOOL,
+		last_login DATETIME,
+		UNIQUE(username)
+	);`, pwLength)
+	sessions := fmt.Sprintf(NewSQLite3SessionTemplate().InitQ(), "user_sessions", "BIGINT UNSIGNED NOT NULL", DefaultKeyLength)
+	return NewSQLMigrator(db, defaultMigrations(users, sessions, "BOOL", sqlite3Catalog))
+}
+
+// NewSQLite3TenantMigrator is like NewSQLite3Migrator but migrates the
+// tables to the tenant schema. sqlite can't drop the unique constraint on
+// username, so the users table is copied to a new table.
+//
+// New in version v0.7
+func NewSQLite3TenantMigrator(db *sql.DB, pwLength int) *SQLMigrator {
+	res := NewSQLite3Migrator(db, pwLength)
+	columns := "id, tenant_id, username, first_name, last_name, email, password, is_active, last_login, " +
+		"is_admin, email_verified, is_pending, display_name, avatar_url, locale, timezone"
+	users := strings.Replace(SQLite3TenantUserQueries(pwLength).InitQuery,
+		"IF NOT EXISTS users (", "users_new (", 1)
+	res.Migrations = append(res.Migrations, tenantMigrations(sqlite3Catalog,
+		users,
+		fmt.Sprintf("INSERT INTO users_new (%s) SELECT %s FROM users;", columns, columns),
+		"DROP TABLE users;",
+		"ALTER TABLE users_new RENAME TO users;")...)
+	return res
+}
+
+// NewPostgresMigrator returns a SQLMigrator with the migrations for
+// postgres, pwLength is the length of the password hashes (see
+// SQLUserQueries).
+func NewPostgresMigrator(db *sql.DB, pwLength int) *SQLMigrator {
+	users := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS users (
+		id bigserial,
+		username varchar(150) NOT NULL,
+		first_name varchar(30) NOT NULL,
+		last_name varchar(30) NOT NULL,
+		email varchar(254),
+		password char(%d),
+		is_active bool NOT NULL,
+		last_login timestamp NOT NULL,
+		unique (username)
+	);`, pwLength)
+	sessions := fmt.Sprintf(PostgresSessionTemplate{}.InitQ(), "user_sessions", "BIGINT NOT NULL", DefaultKeyLength)
+	res := NewSQLMigrator(db, defaultMigrations(users, sessions, "bool", postgresCatalog))
+	res.InitQ = `CREATE TABLE IF NOT EXISTS goauth_schema_migrations (
+		version int NOT NULL PRIMARY KEY,
+		description varchar(255) NOT NULL,
+		applied timestamp NOT NULL
+	);`
+	res.InsertQ = "INSERT INTO goauth_schema_migrations (version, description, applied) VALUES ($1, $2, $3);"
+	return res
+}
+
+// NewPostgresTenantMigrator is like NewPostgresMigrator but migrates the
+// tables to the tenant schema.
+//
+// New in version v0.7
+func NewPostgresTenantMigrator(db *sql.DB, pwLength int) *SQLMigrator {
+	res := NewPostgresMigrator(db, pwLength)
+	res.Migrations = append(res.Migrations, tenantMigrations(postgresCatalog,
+		"ALTER TABLE users DROP CONSTRAINT users_username_key;",
+		"ALTER TABLE users ADD UNIQUE (tenant_id, username);")...)
+	return res
+}
+
+// schemaCatalog contains the queries to inspect the schema of a database,
+// they're used by the Applied checks of the migrations.
+type schemaCatalog struct {
+	// column selects the number of columns given the table and the column
+	// name.
+	column string
+
+	// tenantUnique selects the number of unique indexes of the users table
+	// that contain the column tenant_id.
+	tenantUnique string
+}
+
+var mySQLCatalog = schemaCatalog{
+	column: "SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = ? AND column_name = ?",
+	tenantUnique: `SELECT COUNT(*) FROM information_schema.statistics
+		WHERE table_schema = DATABASE() AND table_name = 'users' AND column_name = 'tenant_id' AND non_unique = 0`,
+}
+
+var postgresCatalog = schemaCatalog{
+	column: "SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1 AND column_name = $2",
+	tenantUnique: `SELECT COUNT(*) FROM pg_index i JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey)
+		WHERE i.indrelid = 'users'::regclass AND i.indisunique AND a.attname = 'tenant_id'`,
+}
+
+var sqlite3Catalog = schemaCatalog{
+	column: "SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?",
+	tenantUnique: `SELECT COUNT(*) FROM pragma_index_list('users') AS l JOIN pragma_index_info(l.name) AS i
+		WHERE l."unique" = 1 AND i.name = 'tenant_id'`,
+}
+
+// columnApplied returns an Applied check that tests if the column exists.
+func (c schemaCatalog) columnApplied(table, column string) func(db *sql.DB) (bool, error) {
+	return func(db *sql.DB) (bool, error) {
+		var num int
+		if err := db.QueryRow(c.column, table, column).Scan(&num); err != nil {
+			return false, wrapBackendError("sql", "Migrate", err)
+		}
+		return num > 0, nil
+	}
+}
+
+// tenantUniqueApplied is the Applied check for the unique constraint on
+// tenant_id and username.
+func (c schemaCatalog) tenantUniqueApplied(db *sql.DB) (bool, error) {
+	var num int
+	if err := db.QueryRow(c.tenantUnique).Scan(&num); err != nil {
+		return false, wrapBackendError("sql", "Migrate", err)
+	}
+	return num > 0, nil
+}
+
+// tenantMigrations returns the migrations from the default schema to the
+// tenant schema, unique are the statements that replace the unique
+// constraint on username by one on tenant_id and username.
+func tenantMigrations(catalog schemaCatalog, unique ...string) []Migration {
+	addTenant := func(table string) string {
+		return fmt.Sprintf("ALTER TABLE %s ADD COLUMN tenant_id VARCHAR(100) NOT NULL DEFAULT '';", table)
+	}
+	return []Migration{
+		{Version: 9, Description: "add users.tenant_id",
+			Statements: []string{addTenant("users")},
+			Applied:    catalog.columnApplied("users", "tenant_id")},
+		{Version: 10, Description: "make usernames unique per tenant",
+			Statements: unique, Applied: catalog.tenantUniqueApplied},
+		{Version: 11, Description: "add user_sessions.tenant_id",
+			Statements: []string{addTenant("user_sessions")},
+			Applied:    catalog.columnApplied("user_sessions", "tenant_id")},
+	}
+}
+
+// defaultMigrations returns the migrations of the default schema, users and
+// sessions create the tables as of version v0.6.
+func defaultMigrations(users, sessions, boolType string, catalog schemaCatalog) []Migration {
+	addColumn := func(version int, column string) Migration {
+		return Migration{Version: version,
+			Description: fmt.Sprintf("add users.%s", column),
+			Statements: []string{fmt.Sprintf("ALTER TABLE users ADD COLUMN %s %s NOT NULL DEFAULT FALSE;",
+				column, boolType)},
+			Applied: catalog.columnApplied("users", column)}
+	}
+	addNullColumn := func(version int, column, columnType string) Migration {
+		return Migration{Version: version,
+			Description: fmt.Sprintf("add users.%s", column),
+			Statements:  []string{fmt.Sprintf("ALTER TABLE users ADD COLUMN %s %s;", column, columnType)},
+			Applied:     catalog.columnApplied("users", column)}
+	}
+	return []Migration{
+		{Version: 1, Description: "create users and user_sessions", Statements: []string{users, sessions}},
+		addColumn(2, "is_admin"),
+		addColumn(3, "email_verified"),
+		addColumn(4, "is_pending"),
+		addNullColumn(5, "display_name", "VARCHAR(150)"),
+		addNullColumn(6, "avatar_url", "VARCHAR(2048)"),
+		addNullColumn(7, "locale", "VARCHAR(35)"),
+		addNullColumn(8, "timezone", "VARCHAR(64)"),
+	}
+}
+
+// Init creates the migrations table.
+func (m *SQLMigrator) Init() error {
+	_, err := m.DB.Exec(m.InitQ)
+	return wrapBackendError("sql", "Init", err)
+}
+
+// Version returns the current version of the schema, 0 if no migration was
+// applied.
+func (m *SQLMigrator) Version() (int, error) {
+	var version int
+	if err := m.DB.QueryRow(m.VersionQ).Scan(&version); err != nil {
+		return 0, wrapBackendError("sql", "Version", err)
+	}
+	return version, nil
+}
+
+// Pending returns the migrations that were not applied yet, ordered by
+// version.
+func (m *SQLMigrator) Pending() ([]Migration, error) {
+	version, err := m.Version()
+	if err != nil {
+		return nil, err
+	}
+	var res []Migration
+	for _, migration := range m.Migrations {
+		if migration.Version > version {
+			res = append(res, migration)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Version < res[j].Version
+	})
+	return res, nil
+}
+
+// Migrate creates the migrations table and applies all pending migrations,
+// it returns the number of applied migrations.
+func (m *SQLMigrator) Migrate() (int, error) {
+	if err := m.Init(); err != nil {
+		return 0, err
+	}
+	pending, err := m.Pending()
+	if err != nil {
+		return 0, err
+	}
+	for i, migration := range pending {
+		if err := m.apply(migration); err != nil {
+			return i, fmt.Errorf("Migration %d (%s) failed: %w", migration.Version, migration.Description, err)
+		}
+	}
+	return len(pending), nil
+}
+
+func (m *SQLMigrator) apply(migration Migration) error {
+	skip := false
+	if migration.Applied != nil {
+		var err error
+		if skip, err = migration.Applied(m.DB); err != nil {
+			return err
+		}
+	}
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return wrapBackendError("sql", "Migrate", err)
+	}
+	if !skip {
+		for _, stmt := range migration.Statements {
+			if _, err := tx.Exec(stmt); err != nil {
+				tx.Rollback()
+				return wrapBackendError("sql", "Migrate", err)
+			}
+		}
+	}
+	if _, err := tx.Exec(m.InsertQ, migration.Version, migration.Description, CurrentTime()); err != nil {
+		tx.Rollback()
+		return wrapBackendError("sql", "Migrate", err)
+	}
+	if skip {
+		log.WithField("version", migration.Version).Info("goauth: Migration already applied, recorded it")
+	} else {
+		log.WithField("version", migration.Version).Info("goauth: Applied migration")
+	}
+	return wrapBackendError("sql", "Migrate", tx.Commit())
+}
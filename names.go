@@ -0,0 +1,356 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrUsernameReserved is returned by Insert and RenameUser if the username
+// is reserved, see UsernamePolicy.
+var ErrUsernameReserved = errors.New("Username is reserved.")
+
+// DefaultReservedNames are names that usually shouldn't be usernames, either
+// because users could impersonate the staff or because they collide with
+// routes of the application (for example /login if user profiles are
+// served under /<username>).
+var DefaultReservedNames = []string{
+	"admin", "administrator", "root", "superuser", "system", "support", "help",
+	"security", "staff", "moderator", "postmaster", "webmaster", "hostmaster",
+	"abuse", "noreply", "no-reply", "info", "api", "www", "login", "logout",
+	"register", "signup", "signin", "auth", "oauth", "account", "settings",
+	"password", "reset", "verify", "invite", "static", "assets",
+}
+
+// UsernameReservationHandler stores usernames that are held for some time,
+// for example after the account was deleted or renamed, so nobody else can
+// take the name and impersonate the previous owner.
+//
+// New in version v0.7
+type UsernameReservationHandler interface {
+	// Init initializes the storage, see UserHandler.
+	Init() error
+
+	// ReserveUsername reserves the name until the given time, an existing
+	// reservation is replaced.
+	ReserveUsername(userName string, until time.Time) error
+
+	// ReservedUntil returns the end of the reservation of the name, the
+	// zero time if it isn't reserved.
+	ReservedUntil(userName string) (time.Time, error)
+
+	// ReleaseUsername removes the reservation of the name.
+	ReleaseUsername(userName string) error
+
+	// DeleteExpiredReservations deletes all expired reservations.
+	DeleteExpiredReservations() (int64, error)
+}
+
+// UsernamePolicy decides which usernames can be used: names in Reserved are
+// never allowed and names that are held in Reservations are not allowed
+// until the reservation ends. Names are compared case insensitive.
+//
+// Set it as Names of SQLUserHandler or RedisUserHandler to enforce it in
+// Insert and RenameUser, the handlers hold the names of deleted and renamed
+// users for HoldDuration.
+//
+// New in version v0.7
+type UsernamePolicy struct {
+	// Reservations stores the held names, may be nil.
+	Reservations UsernameReservationHandler
+
+	// HoldDuration is the time names of deleted or renamed users are held,
+	// defaults to 90 days. If it's 0 names are not held.
+	HoldDuration time.Duration
+
+	mutex    sync.RWMutex
+	reserved map[string]struct{}
+}
+
+// NewUsernamePolicy returns a new policy with the given reserved names
+// (for example DefaultReservedNames), reservations may be nil.
+func NewUsernamePolicy(reserved []string, reservations UsernameReservationHandler) *UsernamePolicy {
+	res := &UsernamePolicy{Reservations: reservations, HoldDuration: 90 * 24 * time.Hour,
+		reserved: make(map[string]struct{}, len(reserved))}
+	res.Reserve(reserved...)
+	return res
+}
+
+// Reserve adds names to the reserved names.
+func (p *UsernamePolicy) Reserve(names ...string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.reserved == nil {
+		p.reserved = make(map[string]struct{}, len(names))
+	}
+	for _, name := range names {
+		p.reserved[strings.ToLower(name)] = struct{}{}
+	}
+}
+
+// IsReserved reports whether the name is in the reserved names.
+func (p *UsernamePolicy) IsReserved(userName string) bool {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	_, has := p.reserved[strings.ToLower(userName)]
+	return has
+}
+
+// Check returns ErrUsernameReserved if the name is reserved or held.
+// If p is nil all names are allowed.
+func (p *UsernamePolicy) Check(userName string) error {
+	if p == nil {
+		return nil
+	}
+	if p.IsReserved(userName) {
+		return ErrUsernameReserved
+	}
+	if p.Reservations == nil {
+		return nil
+	}
+	until, err := p.Reservations.ReservedUntil(strings.ToLower(userName))
+	if err != nil {
+		return err
+	}
+	if !until.IsZero() && !KeyInvalid(CurrentTime(), until) {
+		return ErrUsernameReserved
+	}
+	return nil
+}
+
+// Hold reserves the name of a deleted or renamed user for HoldDuration.
+// If p is nil or there are no Reservations nothing happens.
+func (p *UsernamePolicy) Hold(userName string) error {
+	if p == nil || p.Reservations == nil || p.HoldDuration <= 0 {
+		return nil
+	}
+	return p.Reservations.ReserveUsername(strings.ToLower(userName), CurrentTime().Add(p.HoldDuration))
+}
+
+// InMemoryUsernameReservationHandler is a UsernameReservationHandler that
+// keeps the reservations in memory.
+//
+// New in version v0.7
+type InMemoryUsernameReservationHandler struct {
+	mutex        sync.RWMutex
+	reservations map[string]time.Time
+}
+
+// NewInMemoryUsernameReservationHandler returns a new
+// InMemoryUsernameReservationHandler.
+func NewInMemoryUsernameReservationHandler() *InMemoryUsernameReservationHandler {
+	return &InMemoryUsernameReservationHandler{reservations: make(map[string]time.Time)}
+}
+
+func (h *InMemoryUsernameReservationHandler) Init() error {
+	return nil
+}
+
+func (h *InMemoryUsernameReservationHandler) ReserveUsername(userName string, until time.Time) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.reservations[userName] = until
+	return nil
+}
+
+func (h *InMemoryUsernameReservationHandler) ReservedUntil(userName string) (time.Time, error) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return h.reservations[userName], nil
+}
+
+func (h *InMemoryUsernameReservationHandler) ReleaseUsername(userName string) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	delete(h.reservations, userName)
+	return nil
+}
+
+func (h *InMemoryUsernameReservationHandler) DeleteExpiredReservations() (int64, error) {
+	now := CurrentTime()
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	var removed int64
+	for name, until := range h.reservations {
+		if KeyInvalid(now, until) {
+			delete(h.reservations, name)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// SQLUsernameReservationQueries stores the queries for
+// SQLUsernameReservationHandler.
+//
+// New in version v0.7
+type SQLUsernameReservationQueries struct {
+	InitQuery, ReserveQuery, GetQuery, ReleaseQuery, DeleteExpiredQuery string
+
+	// TimeFromScanType is used to transform database time entries to
+	// gos time. See SQLSessionHandler for details.
+	TimeFromScanType func(val interface{}) (time.Time, error)
+}
+
+// MySQLUsernameReservationQueries provides queries to use with MySQL.
+func MySQLUsernameReservationQueries() *SQLUsernameReservationQueries {
+	initQ := `
+	CREATE TABLE IF NOT EXISTS username_reservations (
+		username VARCHAR(150) NOT NULL,
+		reserved_until DATETIME NOT NULL,
+		PRIMARY KEY(username)
+	);
+	`
+	return &SQLUsernameReservationQueries{InitQuery: initQ,
+		ReserveQuery:       "INSERT INTO username_reservations (username, reserved_until) VALUES(?, ?) ON DUPLICATE KEY UPDATE reserved_until=VALUES(reserved_until)",
+		GetQuery:           "SELECT reserved_until FROM username_reservations WHERE username=?",
+		ReleaseQuery:       "DELETE FROM username_reservations WHERE username=?",
+		DeleteExpiredQuery: "DELETE FROM username_reservations WHERE reserved_until < ?",
+		TimeFromScanType:   DefaultTimeFromScanType}
+}
+
+// PostgresUsernameReservationQueries provides queries to use with postgres.
+func PostgresUsernameReservationQueries() *SQLUsernameReservationQueries {
+	initQ := `
+	CREATE TABLE IF NOT EXISTS username_reservations (
+		username varchar(150) PRIMARY KEY,
+		reserved_until timestamp NOT NULL
+	);
+	`
+	return &SQLUsernameReservationQueries{InitQuery: initQ,
+		ReserveQuery:       "INSERT INTO username_reservations (username, reserved_until) VALUES($1, $2) ON CONFLICT (username) DO UPDATE SET reserved_until = EXCLUDED.reserved_until",
+		GetQuery:           "SELECT reserved_until FROM username_reservations WHERE username = $1",
+		ReleaseQuery:       "DELETE FROM username_reservations WHERE username = $1",
+		DeleteExpiredQuery: "DELETE FROM username_reservations WHERE reserved_until < $1",
+		TimeFromScanType:   DefaultTimeFromScanType}
+}
+
+// SQLite3UsernameReservationQueries provides queries to use with sqlite3.
+func SQLite3UsernameReservationQueries() *SQLUsernameReservationQueries {
+	res := MySQLUsernameReservationQueries()
+	res.ReserveQuery = "INSERT OR REPLACE INTO username_reservations (username, reserved_until) VALUES(?, ?)"
+	return res
+}
+
+// SQLUsernameReservationHandler implements UsernameReservationHandler by
+// executing the queries defined in an instance of
+// SQLUsernameReservationQueries.
+//
+// New in version v0.7
+type SQLUsernameReservationHandler struct {
+	*SQLUsernameReservationQueries
+
+	// DB is the database to execute the queries on.
+	DB *sql.DB
+
+	blockDB bool
+	mutex   sync.RWMutex
+}
+
+// NewSQLUsernameReservationHandler returns a new
+// SQLUsernameReservationHandler, blockDB has the same meaning as in
+// NewSQLUserHandler.
+func NewSQLUsernameReservationHandler(queries *SQLUsernameReservationQueries, db *sql.DB, blockDB bool) *SQLUsernameReservationHandler {
+	return &SQLUsernameReservationHandler{SQLUsernameReservationQueries: queries, DB: db, blockDB: blockDB}
+}
+
+// NewMySQLUsernameReservationHandler returns a new
+// SQLUsernameReservationHandler that uses MySQL.
+func NewMySQLUsernameReservationHandler(db *sql.DB) *SQLUsernameReservationHandler {
+	return NewSQLUsernameReservationHandler(MySQLUsernameReservationQueries(), db, false)
+}
+
+// NewPostgresUsernameReservationHandler returns a new
+// SQLUsernameReservationHandler that uses postgres.
+func NewPostgresUsernameReservationHandler(db *sql.DB) *SQLUsernameReservationHandler {
+	return NewSQLUsernameReservationHandler(PostgresUsernameReservationQueries(), db, false)
+}
+
+// NewSQLite3UsernameReservationHandler returns a new
+// SQLUsernameReservationHandler that uses sqlite3.
+func NewSQLite3UsernameReservationHandler(db *sql.DB) *SQLUsernameReservationHandler {
+	return NewSQLUsernameReservationHandler(SQLite3UsernameReservationQueries(), db, true)
+}
+
+func (handler *SQLUsernameReservationHandler) Init() error {
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	_, err := handler.DB.Exec(handler.InitQuery)
+	return err
+}
+
+func (handler *SQLUsernameReservationHandler) ReserveUsername(userName string, until time.Time) error {
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	_, err := handler.DB.Exec(handler.ReserveQuery, userName, until)
+	return wrapBackendError("sql", "ReserveUsername", err)
+}
+
+func (handler *SQLUsernameReservationHandler) ReservedUntil(userName string) (time.Time, error) {
+	if handler.blockDB {
+		handler.mutex.RLock()
+		defer handler.mutex.RUnlock()
+	}
+	var untilVal interface{}
+	if err := handler.DB.QueryRow(handler.GetQuery, userName).Scan(&untilVal); err != nil {
+		if err == sql.ErrNoRows {
+			return time.Time{}, nil
+		}
+		return time.Time{}, wrapBackendError("sql", "ReservedUntil", err)
+	}
+	return handler.TimeFromScanType(untilVal)
+}
+
+func (handler *SQLUsernameReservationHandler) ReleaseUsername(userName string) error {
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	_, err := handler.DB.Exec(handler.ReleaseQuery, userName)
+	return wrapBackendError("sql", "ReleaseUsername", err)
+}
+
+func (handler *SQLUsernameReservationHandler) DeleteExpiredReservations() (int64, error) {
+	now := CurrentTime()
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	res, err := handler.DB.Exec(handler.DeleteExpiredQuery, now)
+	if err != nil {
+		return -1, wrapBackendError("sql", "DeleteExpiredReservations", err)
+	}
+	num, err := res.RowsAffected()
+	if err != nil {
+		return -1, nil
+	}
+	return num, nil
+}
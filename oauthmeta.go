@@ -0,0 +1,225 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// OAuthServerMetadata is the authorization server metadata (RFC 8414)
+// served at /.well-known/oauth-authorization-server.
+//
+// New in version v0.7
+type OAuthServerMetadata struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserInfoEndpoint                  string   `json:"userinfo_endpoint"`
+	DeviceAuthorizationEndpoint       string   `json:"device_authorization_endpoint,omitempty"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+}
+
+// OAuthUserInfo is the information about the user returned by the userinfo
+// endpoint, the field names are those of the OpenID Connect claims. The
+// profile fields require the scope "profile", Email requires "email".
+//
+// New in version v0.7
+type OAuthUserInfo struct {
+	Subject           string `json:"sub"`
+	PreferredUsername string `json:"preferred_username,omitempty"`
+	Name              string `json:"name,omitempty"`
+	GivenName         string `json:"given_name,omitempty"`
+	FamilyName        string `json:"family_name,omitempty"`
+	Email             string `json:"email,omitempty"`
+}
+
+// OAuthDiscovery serves the authorization server metadata (RFC 8414) and a
+// userinfo endpoint for an OAuthServer.
+//
+// This is not OpenID Connect: goauth doesn't issue ID tokens and has no
+// keys to publish, so there's no /.well-known/openid-configuration and no
+// scope "openid". Clients get the information about the user from the
+// userinfo endpoint, restricted to the scopes "profile" and "email" of the
+// access token.
+//
+// New in version v0.7
+type OAuthDiscovery struct {
+	// Server is the authorization server, its access tokens are accepted
+	// by the userinfo endpoint.
+	Server *OAuthServer
+
+	// Users is used to get the information about users.
+	Users UserHandler
+
+	// Issuer is the issuer identifier, the base URL of your server, for
+	// example "https://auth.example.com" (without a trailing slash).
+	Issuer string
+
+	// AuthorizationPath, TokenPath and UserInfoPath are the paths (relative
+	// to the issuer) the endpoints are mounted at.
+	// Default to "/oauth/authorize", "/oauth/token" and "/userinfo".
+	AuthorizationPath, TokenPath, UserInfoPath string
+
+	// DeviceAuthorizationPath is the path of the device authorization
+	// endpoint, if it is empty the device grant is not advertised.
+	DeviceAuthorizationPath string
+}
+
+// NewOAuthDiscovery returns a new OAuthDiscovery with the default paths.
+//
+// New in version v0.7
+func NewOAuthDiscovery(server *OAuthServer, users UserHandler, issuer string) *OAuthDiscovery {
+	return &OAuthDiscovery{Server: server, Users: users,
+		Issuer:            strings.TrimSuffix(issuer, "/"),
+		AuthorizationPath: "/oauth/authorize", TokenPath: "/oauth/token",
+		UserInfoPath: "/userinfo"}
+}
+
+// Metadata returns the authorization server metadata.
+func (p *OAuthDiscovery) Metadata() *OAuthServerMetadata {
+	doc := &OAuthServerMetadata{Issuer: p.Issuer,
+		AuthorizationEndpoint:             p.Issuer + p.AuthorizationPath,
+		TokenEndpoint:                     p.Issuer + p.TokenPath,
+		UserInfoEndpoint:                  p.Issuer + p.UserInfoPath,
+		ResponseTypesSupported:            []string{"code"},
+		ScopesSupported:                   []string{"profile", "email"},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		GrantTypesSupported:               []string{"authorization_code"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+	}
+	if p.Server.AllowPlainPKCE {
+		doc.CodeChallengeMethodsSupported = append(doc.CodeChallengeMethodsSupported, "plain")
+	}
+	if p.DeviceAuthorizationPath != "" {
+		doc.DeviceAuthorizationEndpoint = p.Issuer + p.DeviceAuthorizationPath
+		doc.GrantTypesSupported = append(doc.GrantTypesSupported, DeviceCodeGrantType)
+	}
+	return doc
+}
+
+// ServeMetadata is the http.HandlerFunc for
+// /.well-known/oauth-authorization-server.
+func (p *OAuthDiscovery) ServeMetadata(w http.ResponseWriter, r *http.Request) {
+	writeOAuthJSON(w, http.StatusOK, p.Metadata())
+}
+
+// bearerToken returns the token from an "Authorization: Bearer <token>"
+// header or "" if there is none.
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return ""
+}
+
+// writeBearerError writes a 401 response with the WWW-Authenticate header
+// as defined in RFC 6750.
+func writeBearerError(w http.ResponseWriter, code string) {
+	value := "Bearer"
+	if code != "" {
+		value += ` error="` + code + `"`
+	}
+	w.Header().Set("WWW-Authenticate", value)
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
+
+// UserInfo returns the information about the user with the given id.
+func (p *OAuthDiscovery) UserInfo(id uint64) (*OAuthUserInfo, error) {
+	userName, err := p.Users.GetUserName(id)
+	if err != nil {
+		return nil, err
+	}
+	info, err := p.Users.GetUserBaseInfo(userName)
+	if err != nil {
+		return nil, err
+	}
+	name := strings.TrimSpace(info.FirstName + " " + info.LastName)
+	return &OAuthUserInfo{Subject: strconv.FormatUint(id, 10),
+		PreferredUsername: userName, Name: name, GivenName: info.FirstName,
+		FamilyName: info.LastName, Email: info.Email}, nil
+}
+
+// filterClaims removes the fields that the scopes of the access token don't
+// allow.
+func filterClaims(info *OAuthUserInfo, data *SessionKeyData) {
+	if data.Scoped && !scopesAllow(data.Scopes, "profile") {
+		info.PreferredUsername, info.Name, info.GivenName, info.FamilyName = "", "", "", ""
+	}
+	if data.Scoped && !scopesAllow(data.Scopes, "email") {
+		info.Email = ""
+	}
+}
+
+// ServeUserInfo is the http.HandlerFunc for the userinfo endpoint, it
+// requires an access token issued by the server in the Authorization header.
+// Only the fields allowed by the scopes of the token are returned, see
+// OAuthUserInfo.
+func (p *OAuthDiscovery) ServeUserInfo(w http.ResponseWriter, r *http.Request) {
+	token := bearerToken(r)
+	if token == "" {
+		writeBearerError(w, "")
+		return
+	}
+	if p.Server.Controller.Payload == nil {
+		log.Error("goauth: Controller.Payload is required for the userinfo endpoint")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	// the access tokens are signed if the controller has a Signer
+	verifier := SessionTokenVerifier{Controller: p.Server.Controller}
+	data, err := verifier.verify(token, true)
+	if err != nil {
+		if !isAuthError(err) {
+			log.WithError(err).Error("goauth: Can't validate access token")
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		writeBearerError(w, "invalid_token")
+		return
+	}
+	id, err := UserKeyToID(data.User)
+	if err != nil {
+		writeBearerError(w, "invalid_token")
+		return
+	}
+	info, err := p.UserInfo(id)
+	if err != nil {
+		if err == ErrUserNotFound {
+			writeBearerError(w, "invalid_token")
+			return
+		}
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	filterClaims(info, data)
+	writeOAuthJSON(w, http.StatusOK, info)
+}
@@ -0,0 +1,903 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/sessions"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrClientNotFound is returned by an OAuthClientHandler if there is no
+// client with the given id.
+//
+// New in version v0.7
+var ErrClientNotFound = errors.New("OAuth client not found.")
+
+// ErrCodeNotFound is returned by an OAuthCodeHandler if the code doesn't
+// exist (or was already used).
+//
+// New in version v0.7
+var ErrCodeNotFound = errors.New("Authorization code not found.")
+
+// OAuthClient is an application that is registered with the OAuthServer.
+// Confidential clients authenticate with their secret at the token endpoint,
+// public clients (single page or native apps that can't keep a secret)
+// don't have a secret and must use PKCE.
+//
+// New in version v0.7
+type OAuthClient struct {
+	ID, Name string
+
+	// SecretHash is the hex encoded SHA-256 hash of the secret, empty for
+	// public clients.
+	SecretHash string
+
+	// RedirectURIs are the allowed redirect URIs, the redirect_uri in the
+	// request must match one of them exactly.
+	RedirectURIs []string
+
+	// Scopes are the scopes the client may request, they can use the same
+	// wildcards as permissions (see MatchPermission). A client without
+	// scopes only gets tokens with an empty set of scopes.
+	//
+	// New in version v0.7
+	Scopes []string
+
+	Public  bool
+	Created time.Time
+}
+
+// hashOAuthSecret returns the hex encoded SHA-256 hash of a secret.
+// Secrets are long random strings, so there is no need for a slow password
+// hash here.
+func hashOAuthSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
+
+// CheckSecret checks if secret is the secret of the client.
+func (c *OAuthClient) CheckSecret(secret string) bool {
+	if c.Public || c.SecretHash == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashOAuthSecret(secret)), []byte(c.SecretHash)) == 1
+}
+
+// HasRedirectURI checks if uri is one of the registered redirect URIs.
+func (c *OAuthClient) HasRedirectURI(uri string) bool {
+	for _, registered := range c.RedirectURIs {
+		if registered == uri {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsScope checks if the client may request all scopes of the space
+// separated list, see Scopes.
+//
+// New in version v0.7
+func (c *OAuthClient) AllowsScope(scope string) bool {
+	for _, requested := range ParseScopes(scope) {
+		allowed := false
+		for _, granted := range c.Scopes {
+			if MatchPermission(granted, requested) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
+
+// OAuthClientHandler stores the registered clients.
+//
+// New in version v0.7
+type OAuthClientHandler interface {
+	// Init initializes the storage, it must not fail if called several times.
+	Init() error
+
+	// GetClient returns the client with the id or ErrClientNotFound.
+	GetClient(id string) (*OAuthClient, error)
+
+	// InsertClient stores a new client.
+	InsertClient(client *OAuthClient) error
+
+	// DeleteClient removes the client, it does nothing if it doesn't exist.
+	DeleteClient(id string) error
+}
+
+// InMemoryOAuthClientHandler is an OAuthClientHandler that keeps all clients
+// in memory.
+//
+// New in version v0.7
+type InMemoryOAuthClientHandler struct {
+	clients map[string]*OAuthClient
+	mutex   sync.RWMutex
+}
+
+// NewInMemoryOAuthClientHandler returns a new InMemoryOAuthClientHandler.
+//
+// New in version v0.7
+func NewInMemoryOAuthClientHandler() *InMemoryOAuthClientHandler {
+	return &InMemoryOAuthClientHandler{clients: make(map[string]*OAuthClient)}
+}
+
+func (h *InMemoryOAuthClientHandler) Init() error {
+	return nil
+}
+
+func (h *InMemoryOAuthClientHandler) GetClient(id string) (*OAuthClient, error) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	client, has := h.clients[id]
+	if !has {
+		return nil, ErrClientNotFound
+	}
+	return client, nil
+}
+
+func (h *InMemoryOAuthClientHandler) InsertClient(client *OAuthClient) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if _, has := h.clients[client.ID]; has {
+		return errors.New("Client already exists")
+	}
+	h.clients[client.ID] = client
+	return nil
+}
+
+func (h *InMemoryOAuthClientHandler) DeleteClient(id string) error {
+	h.mutex.Lock()
+	delete(h.clients, id)
+	h.mutex.Unlock()
+	return nil
+}
+
+// SQLOAuthClientQueries stores the queries used by SQLOAuthClientHandler.
+// Redirect URIs are stored in one column, separated by newlines, scopes
+// are separated by spaces.
+//
+// New in version v0.7
+type SQLOAuthClientQueries struct {
+	// InitQuery creates the oauth_clients table.
+	InitQuery string
+
+	// GetQuery selects name, secret_hash, redirect_uris, scopes, public and
+	// created given the id.
+	GetQuery string
+
+	// InsertQuery inserts a client, the values are passed in the order id,
+	// name, secret_hash, redirect_uris, scopes, public, created.
+	InsertQuery string
+
+	// DeleteQuery deletes a client given the id.
+	DeleteQuery string
+
+	// TimeFromScanType is used to transform database time entries to
+	// gos time. See SQLSessionHandler for details.
+	TimeFromScanType func(val interface{}) (time.Time, error)
+}
+
+// MySQLOAuthClientQueries provides queries to use with MySQL.
+//
+// New in version v0.7
+func MySQLOAuthClientQueries() *SQLOAuthClientQueries {
+	initQ := `
+	CREATE TABLE IF NOT EXISTS oauth_clients (
+		id VARCHAR(64) NOT NULL,
+		name VARCHAR(150) NOT NULL,
+		secret_hash CHAR(64),
+		redirect_uris TEXT NOT NULL,
+		scopes TEXT NOT NULL,
+		public BOOL NOT NULL,
+		created DATETIME NOT NULL,
+		PRIMARY KEY(id)
+	);
+	`
+	return &SQLOAuthClientQueries{InitQuery: initQ,
+		GetQuery:         "SELECT name, secret_hash, redirect_uris, scopes, public, created FROM oauth_clients WHERE id=?",
+		InsertQuery:      "INSERT INTO oauth_clients (id, name, secret_hash, redirect_uris, scopes, public, created) VALUES(?, ?, ?, ?, ?, ?, ?)",
+		DeleteQuery:      "DELETE FROM oauth_clients WHERE id=?",
+		TimeFromScanType: DefaultTimeFromScanType}
+}
+
+// PostgresOAuthClientQueries provides queries to use with postgres.
+//
+// New in version v0.7
+func PostgresOAuthClientQueries() *SQLOAuthClientQueries {
+	initQ := `
+	CREATE TABLE IF NOT EXISTS oauth_clients (
+		id varchar(64) NOT NULL,
+		name varchar(150) NOT NULL,
+		secret_hash char(64),
+		redirect_uris text NOT NULL,
+		scopes text NOT NULL,
+		public bool NOT NULL,
+		created timestamp NOT NULL,
+		PRIMARY KEY(id)
+	);
+	`
+	return &SQLOAuthClientQueries{InitQuery: initQ,
+		GetQuery:         "SELECT name, secret_hash, redirect_uris, scopes, public, created FROM oauth_clients WHERE id = $1",
+		InsertQuery:      "INSERT INTO oauth_clients (id, name, secret_hash, redirect_uris, scopes, public, created) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+		DeleteQuery:      "DELETE FROM oauth_clients WHERE id = $1",
+		TimeFromScanType: DefaultTimeFromScanType}
+}
+
+// SQLite3OAuthClientQueries provides queries to use with sqlite3.
+//
+// New in version v0.7
+func SQLite3OAuthClientQueries() *SQLOAuthClientQueries {
+	return MySQLOAuthClientQueries()
+}
+
+// SQLOAuthClientHandler implements OAuthClientHandler with the queries
+// defined in an instance of SQLOAuthClientQueries.
+//
+// New in version v0.7
+type SQLOAuthClientHandler struct {
+	*SQLOAuthClientQueries
+
+	// DB is the database to execute the queries on.
+	DB *sql.DB
+
+	blockDB bool
+	mutex   sync.RWMutex
+}
+
+// NewSQLOAuthClientHandler returns a new SQLOAuthClientHandler, blockDB has
+// the same meaning as in NewSQLUserHandler.
+//
+// New in version v0.7
+func NewSQLOAuthClientHandler(queries *SQLOAuthClientQueries, db *sql.DB, blockDB bool) *SQLOAuthClientHandler {
+	return &SQLOAuthClientHandler{SQLOAuthClientQueries: queries, DB: db, blockDB: blockDB}
+}
+
+// NewMySQLOAuthClientHandler returns a new SQLOAuthClientHandler that uses
+// MySQL.
+//
+// New in version v0.7
+func NewMySQLOAuthClientHandler(db *sql.DB) *SQLOAuthClientHandler {
+	return NewSQLOAuthClientHandler(MySQLOAuthClientQueries(), db, false)
+}
+
+// NewPostgresOAuthClientHandler returns a new SQLOAuthClientHandler that uses
+// postgres.
+//
+// New in version v0.7
+func NewPostgresOAuthClientHandler(db *sql.DB) *SQLOAuthClientHandler {
+	return NewSQLOAuthClientHandler(PostgresOAuthClientQueries(), db, false)
+}
+
+// NewSQLite3OAuthClientHandler returns a new SQLOAuthClientHandler that uses
+// sqlite3.
+//
+// New in version v0.7
+func NewSQLite3OAuthClientHandler(db *sql.DB) *SQLOAuthClientHandler {
+	return NewSQLOAuthClientHandler(SQLite3OAuthClientQueries(), db, true)
+}
+
+func (handler *SQLOAuthClientHandler) Init() error {
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	_, err := handler.DB.Exec(handler.InitQuery)
+	return err
+}
+
+func (handler *SQLOAuthClientHandler) GetClient(id string) (*OAuthClient, error) {
+	if handler.blockDB {
+		handler.mutex.RLock()
+		defer handler.mutex.RUnlock()
+	}
+	row := handler.DB.QueryRow(handler.GetQuery, id)
+	var name, redirectURIs, scopes string
+	var secretHash sql.NullString
+	var public bool
+	var createdVal interface{}
+	if err := row.Scan(&name, &secretHash, &redirectURIs, &scopes, &public, &createdVal); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrClientNotFound
+		}
+		return nil, err
+	}
+	created, err := handler.TimeFromScanType(createdVal)
+	if err != nil {
+		return nil, err
+	}
+	return &OAuthClient{ID: id, Name: name, SecretHash: secretHash.String,
+		RedirectURIs: strings.Split(redirectURIs, "\n"), Scopes: ParseScopes(scopes),
+		Public: public, Created: created}, nil
+}
+
+func (handler *SQLOAuthClientHandler) InsertClient(client *OAuthClient) error {
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	secretHash := sql.NullString{String: client.SecretHash, Valid: client.SecretHash != ""}
+	_, err := handler.DB.Exec(handler.InsertQuery, client.ID, client.Name, secretHash,
+		strings.Join(client.RedirectURIs, "\n"), FormatScopes(client.Scopes), client.Public, client.Created)
+	return err
+}
+
+func (handler *SQLOAuthClientHandler) DeleteClient(id string) error {
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	_, err := handler.DB.Exec(handler.DeleteQuery, id)
+	return err
+}
+
+// OAuthCode is an authorization code issued by the authorization endpoint.
+//
+// New in version v0.7
+type OAuthCode struct {
+	ClientID, RedirectURI, Scope string
+
+	// CodeChallenge and CodeChallengeMethod are the PKCE parameters, empty
+	// if the client didn't use PKCE.
+	CodeChallenge, CodeChallengeMethod string
+
+	// ExplicitRedirectURI is true if the authorization request contained
+	// the redirect_uri, the token request must then contain the same value
+	// (RFC 6749 section 4.1.3).
+	ExplicitRedirectURI bool
+
+	User       UserKeyType
+	ValidUntil time.Time
+}
+
+// OAuthCodeHandler stores authorization codes until they're redeemed.
+//
+// New in version v0.7
+type OAuthCodeHandler interface {
+	// StoreCode stores the code.
+	StoreCode(code string, data *OAuthCode) error
+
+	// ConsumeCode returns the data for the code and removes it, so a code
+	// can only be used once. Returns ErrCodeNotFound if the code doesn't
+	// exist.
+	ConsumeCode(code string) (*OAuthCode, error)
+}
+
+// InMemoryOAuthCodeHandler is an OAuthCodeHandler that keeps all codes in
+// memory. This only works if you run a single instance of your application,
+// otherwise you have to implement OAuthCodeHandler with some shared storage.
+//
+// New in version v0.7
+type InMemoryOAuthCodeHandler struct {
+	codes map[string]*OAuthCode
+	mutex sync.Mutex
+}
+
+// NewInMemoryOAuthCodeHandler returns a new InMemoryOAuthCodeHandler.
+//
+// New in version v0.7
+func NewInMemoryOAuthCodeHandler() *InMemoryOAuthCodeHandler {
+	return &InMemoryOAuthCodeHandler{codes: make(map[string]*OAuthCode)}
+}
+
+func (h *InMemoryOAuthCodeHandler) StoreCode(code string, data *OAuthCode) error {
+	now := CurrentTime()
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	// codes are short lived, so we remove the expired ones here
+	for key, value := range h.codes {
+		if KeyInvalid(now, value.ValidUntil) {
+			delete(h.codes, key)
+		}
+	}
+	h.codes[code] = data
+	return nil
+}
+
+func (h *InMemoryOAuthCodeHandler) ConsumeCode(code string) (*OAuthCode, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	data, has := h.codes[code]
+	if !has {
+		return nil, ErrCodeNotFound
+	}
+	delete(h.codes, code)
+	return data, nil
+}
+
+// OAuthAuthorizeRequest is a validated request to the authorization endpoint.
+//
+// New in version v0.7
+type OAuthAuthorizeRequest struct {
+	Client                             *OAuthClient
+	RedirectURI, Scope, State          string
+	CodeChallenge, CodeChallengeMethod string
+
+	// ExplicitRedirectURI is false if the request didn't contain the
+	// redirect_uri and the only registered URI of the client is used.
+	ExplicitRedirectURI bool
+}
+
+// OAuthConsentFunc is called by the authorization endpoint once the user is
+// logged in. It should return true if the user agreed that the client gets
+// access.
+// If it returns false it must have written a response, usually a page that
+// asks the user for consent and submits the form to the authorization
+// endpoint again (then the function should return true).
+//
+// New in version v0.7
+type OAuthConsentFunc func(w http.ResponseWriter, r *http.Request, req *OAuthAuthorizeRequest, user UserKeyType) bool
+
+// OAuthServer is a minimal OAuth2 authorization server, so goauth can be the
+// identity provider for your other (internal) applications.
+//
+// It supports the authorization code grant with PKCE (RFC 7636) and the
+// device authorization grant (RFC 8628).
+// Users log in with the normal goauth sessions (Controller and Store), the
+// access tokens are session keys created by Controller that are restricted
+// to the granted scopes (see AddScopedKey), Controller.Payload is required
+// to store them. Access tokens are rejected by RequireSession and the other
+// session checks, handlers that clients may access must be protected with
+// SessionMiddleware.RequireScope or BearerMiddleware.RequireScope.
+//
+// Mount ServeAuthorize at your authorization endpoint (for example
+// /oauth/authorize) and ServeToken at your token endpoint (/oauth/token).
+//
+// New in version v0.7
+type OAuthServer struct {
+	// Clients stores the registered clients.
+	Clients OAuthClientHandler
+
+	// Codes stores the issued authorization codes.
+	Codes OAuthCodeHandler
+
+	// Controller is used to validate the session of the user and to create
+	// access tokens.
+	Controller *SessionController
+
+	// Store is the store of the gorilla sessions.
+	Store sessions.Store
+
+	// Login is called by the authorization endpoint if the user is not
+	// logged in. It should redirect the user to your login page which
+	// redirects back to the authorization request after the login.
+	Login http.HandlerFunc
+
+	// Consent asks for the consent of the user. If it is nil every client
+	// gets access without asking the user, that is fine if you only use
+	// it for your own applications.
+	Consent OAuthConsentFunc
+
+	// CodeDuration is the duration an authorization code is valid,
+	// defaults to 10 minutes.
+	// TokenDuration is the duration an access token is valid, defaults to
+	// 1 hour.
+	CodeDuration, TokenDuration time.Duration
+
+	// Devices stores the pending device authorizations.
+	Devices OAuthDeviceHandler
+
+	// VerificationURI is the absolute URL of the page served by
+	// ServeDeviceVerification, it is shown to the user by the device.
+	VerificationURI string
+
+	// DeviceTemplate renders the verification page, if it is nil
+	// DefaultDeviceVerificationTemplate is used.
+	DeviceTemplate *template.Template
+
+	// DeviceCodeDuration is the duration a device code is valid, defaults
+	// to 10 minutes.
+	// DeviceInterval is the minimal duration between two polls of a client,
+	// defaults to 5 seconds.
+	DeviceCodeDuration, DeviceInterval time.Duration
+
+	// DeviceCSRF protects the approve and deny form of the verification
+	// page, it is required to make a decision. Defaults to a
+	// CSRFProtection in CSRFDoubleSubmitCookie mode.
+	//
+	// New in version v0.7
+	DeviceCSRF *CSRFProtection
+
+	// DeviceLimiter limits the user code lookups per user on the
+	// verification page, so user codes can't be guessed (RFC 8628 section
+	// 5.1). Defaults to 10 lookups per minute, nil disables the limit.
+	//
+	// New in version v0.7
+	DeviceLimiter RateLimiter
+
+	// Users is used to deny access tokens for inactive users if it
+	// implements ActiveFlagHandler (see ErrUserInactive), may be nil.
+	//
+	// New in version v0.7
+	Users UserHandler
+
+	// AllowPlainPKCE accepts the PKCE method "plain" (which is also the
+	// default if the client doesn't send a code_challenge_method). By
+	// default only "S256" is accepted: With plain the challenge is the
+	// verifier, so it doesn't protect a code whose authorization request
+	// was observed.
+	//
+	// New in version v0.7
+	AllowPlainPKCE bool
+}
+
+// NewOAuthServer returns a new OAuthServer that keeps authorization codes
+// and device authorizations in memory. The controller needs a Payload
+// handler to issue access tokens.
+//
+// New in version v0.7
+func NewOAuthServer(clients OAuthClientHandler, controller *SessionController, store sessions.Store, login http.HandlerFunc) *OAuthServer {
+	return &OAuthServer{Clients: clients, Codes: NewInMemoryOAuthCodeHandler(),
+		Controller: controller, Store: store, Login: login,
+		CodeDuration: 10 * time.Minute, TokenDuration: time.Hour,
+		Devices:            NewInMemoryOAuthDeviceHandler(),
+		DeviceCodeDuration: 10 * time.Minute, DeviceInterval: 5 * time.Second,
+		DeviceCSRF:    NewDoubleSubmitCSRFProtection(),
+		DeviceLimiter: NewInMemoryRateLimiter(10, time.Minute)}
+}
+
+// RegisterClient registers a new client and returns it together with the
+// secret (empty for public clients). The secret is only stored hashed, so
+// this is the only time you can get it. scopes are the scopes the client may
+// request.
+func (s *OAuthServer) RegisterClient(name string, redirectURIs []string, public bool, scopes ...string) (*OAuthClient, string, error) {
+	if len(redirectURIs) == 0 {
+		return nil, "", errors.New("A client needs at least one redirect URI")
+	}
+	id, err := GenRandomBase64(24)
+	if err != nil {
+		return nil, "", err
+	}
+	client := &OAuthClient{ID: id, Name: name, RedirectURIs: redirectURIs,
+		Scopes: scopes, Public: public, Created: CurrentTime()}
+	secret := ""
+	if !public {
+		secret, err = GenRandomBase64(-1)
+		if err != nil {
+			return nil, "", err
+		}
+		client.SecretHash = hashOAuthSecret(secret)
+	}
+	if err := s.Clients.InsertClient(client); err != nil {
+		return nil, "", err
+	}
+	return client, secret, nil
+}
+
+// OAuthError is an error as defined in RFC 6749, it is returned as JSON by
+// the token endpoint.
+//
+// New in version v0.7
+type OAuthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e *OAuthError) Error() string {
+	if e.Description == "" {
+		return e.Code
+	}
+	return e.Code + ": " + e.Description
+}
+
+// writeOAuthJSON writes value as JSON with the given status code and the
+// headers required by RFC 6749.
+func writeOAuthJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+// writeOAuthError writes err as JSON, for the invalid_client error the
+// status code is 401, for server_error 500 and otherwise 400.
+func writeOAuthError(w http.ResponseWriter, err *OAuthError) {
+	status := http.StatusBadRequest
+	switch err.Code {
+	case "invalid_client":
+		status = http.StatusUnauthorized
+	case "server_error":
+		status = http.StatusInternalServerError
+	}
+	writeOAuthJSON(w, status, err)
+}
+
+// ParseAuthorizeRequest parses and validates a request to the authorization
+// endpoint.
+// Errors concerning the client or the redirect URI are returned as error,
+// they must not be reported back by a redirect. Other errors are returned
+// as *OAuthError and can be reported to the client with RedirectError.
+func (s *OAuthServer) ParseAuthorizeRequest(r *http.Request) (*OAuthAuthorizeRequest, error) {
+	client, err := s.Clients.GetClient(r.FormValue("client_id"))
+	if err != nil {
+		return nil, err
+	}
+	redirectURI := r.FormValue("redirect_uri")
+	if redirectURI == "" && len(client.RedirectURIs) == 1 {
+		redirectURI = client.RedirectURIs[0]
+	}
+	if !client.HasRedirectURI(redirectURI) {
+		return nil, errors.New("Invalid redirect_uri")
+	}
+	req := &OAuthAuthorizeRequest{Client: client, RedirectURI: redirectURI,
+		Scope: r.FormValue("scope"), State: r.FormValue("state"),
+		CodeChallenge:       r.FormValue("code_challenge"),
+		CodeChallengeMethod: r.FormValue("code_challenge_method"),
+		ExplicitRedirectURI: r.FormValue("redirect_uri") != ""}
+	if r.FormValue("response_type") != "code" {
+		return req, &OAuthError{Code: "unsupported_response_type"}
+	}
+	if !client.AllowsScope(req.Scope) {
+		return req, &OAuthError{Code: "invalid_scope"}
+	}
+	if req.CodeChallenge == "" {
+		if client.Public {
+			return req, &OAuthError{Code: "invalid_request", Description: "PKCE is required for public clients"}
+		}
+	} else {
+		if req.CodeChallengeMethod == "" {
+			req.CodeChallengeMethod = "plain"
+		}
+		if req.CodeChallengeMethod != "S256" && (req.CodeChallengeMethod != "plain" || !s.AllowPlainPKCE) {
+			return req, &OAuthError{Code: "invalid_request", Description: "Unsupported code_challenge_method"}
+		}
+	}
+	return req, nil
+}
+
+// redirectAuthorize redirects to the redirect URI of the request with the
+// given parameters (and the state).
+func redirectAuthorize(w http.ResponseWriter, r *http.Request, req *OAuthAuthorizeRequest, params url.Values) {
+	if req.State != "" {
+		params.Set("state", req.State)
+	}
+	target := req.RedirectURI
+	if strings.Contains(target, "?") {
+		target += "&" + params.Encode()
+	} else {
+		target += "?" + params.Encode()
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// RedirectError reports err back to the client by redirecting to the
+// redirect URI of the request.
+//
+// New in version v0.7
+func RedirectError(w http.ResponseWriter, r *http.Request, req *OAuthAuthorizeRequest, err *OAuthError) {
+	params := url.Values{}
+	params.Set("error", err.Code)
+	if err.Description != "" {
+		params.Set("error_description", err.Description)
+	}
+	redirectAuthorize(w, r, req, params)
+}
+
+// ServeAuthorize is the http.HandlerFunc for the authorization endpoint.
+func (s *OAuthServer) ServeAuthorize(w http.ResponseWriter, r *http.Request) {
+	req, err := s.ParseAuthorizeRequest(r)
+	if err != nil {
+		if oauthErr, ok := err.(*OAuthError); ok {
+			RedirectError(w, r, req, oauthErr)
+		} else {
+			http.Error(w, "Invalid client or redirect_uri", http.StatusBadRequest)
+		}
+		return
+	}
+	data, session, err := s.Controller.ValidateSession(r, s.Store)
+	if err != nil || data == nil {
+		if session != nil {
+			session.Save(r, w)
+		}
+		if s.Login == nil {
+			http.Error(w, "Not logged in", http.StatusUnauthorized)
+			return
+		}
+		s.Login(w, r)
+		return
+	}
+	if s.Consent != nil && !s.Consent(w, r, req, data.User) {
+		return
+	}
+	code, err := GenRandomBase64(-1)
+	if err != nil {
+		RedirectError(w, r, req, &OAuthError{Code: "server_error"})
+		return
+	}
+	codeData := &OAuthCode{ClientID: req.Client.ID, RedirectURI: req.RedirectURI,
+		Scope: req.Scope, CodeChallenge: req.CodeChallenge,
+		CodeChallengeMethod: req.CodeChallengeMethod,
+		ExplicitRedirectURI: req.ExplicitRedirectURI, User: data.User,
+		ValidUntil: CurrentTime().Add(s.CodeDuration)}
+	if err := s.Codes.StoreCode(code, codeData); err != nil {
+		RedirectError(w, r, req, &OAuthError{Code: "server_error"})
+		return
+	}
+	params := url.Values{}
+	params.Set("code", code)
+	redirectAuthorize(w, r, req, params)
+}
+
+// authenticateClient returns the client that authenticated with the request,
+// either with HTTP basic auth or with client_id and client_secret in the
+// form. Public clients only send their id.
+func (s *OAuthServer) authenticateClient(r *http.Request) (*OAuthClient, *OAuthError) {
+	clientID, secret, hasBasic := r.BasicAuth()
+	if !hasBasic {
+		clientID = r.PostFormValue("client_id")
+		secret = r.PostFormValue("client_secret")
+	}
+	client, err := s.Clients.GetClient(clientID)
+	if err != nil {
+		if err == ErrClientNotFound {
+			return nil, &OAuthError{Code: "invalid_client"}
+		}
+		return nil, &OAuthError{Code: "server_error"}
+	}
+	if !client.Public && !client.CheckSecret(secret) {
+		return nil, &OAuthError{Code: "invalid_client"}
+	}
+	return client, nil
+}
+
+// verifyPKCE checks the code_verifier against the challenge of the code.
+func verifyPKCE(code *OAuthCode, verifier string) bool {
+	if code.CodeChallenge == "" {
+		return verifier == ""
+	}
+	if verifier == "" {
+		return false
+	}
+	expected := verifier
+	if code.CodeChallengeMethod == "S256" {
+		hash := sha256.Sum256([]byte(verifier))
+		expected = base64.RawURLEncoding.EncodeToString(hash[:])
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(code.CodeChallenge)) == 1
+}
+
+// OAuthTokenResponse is the successful response of the token endpoint.
+//
+// New in version v0.7
+type OAuthTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+	Scope       string `json:"scope,omitempty"`
+}
+
+// ServeToken is the http.HandlerFunc for the token endpoint.
+func (s *OAuthServer) ServeToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeOAuthError(w, &OAuthError{Code: "invalid_request", Description: "POST required"})
+		return
+	}
+	client, oauthErr := s.authenticateClient(r)
+	if oauthErr != nil {
+		writeOAuthError(w, oauthErr)
+		return
+	}
+	var resp *OAuthTokenResponse
+	switch r.PostFormValue("grant_type") {
+	case "authorization_code":
+		resp, oauthErr = s.authorizationCodeGrant(r, client)
+	case DeviceCodeGrantType:
+		resp, oauthErr = s.deviceCodeGrant(r, client)
+	default:
+		oauthErr = &OAuthError{Code: "unsupported_grant_type"}
+	}
+	if oauthErr != nil {
+		writeOAuthError(w, oauthErr)
+		return
+	}
+	writeOAuthJSON(w, http.StatusOK, resp)
+}
+
+// authorizationCodeGrant redeems an authorization code.
+func (s *OAuthServer) authorizationCodeGrant(r *http.Request, client *OAuthClient) (*OAuthTokenResponse, *OAuthError) {
+	code, err := s.Codes.ConsumeCode(r.PostFormValue("code"))
+	if err != nil {
+		if err == ErrCodeNotFound {
+			return nil, &OAuthError{Code: "invalid_grant"}
+		}
+		return nil, &OAuthError{Code: "server_error"}
+	}
+	if KeyInvalid(CurrentTime(), code.ValidUntil) || code.ClientID != client.ID {
+		return nil, &OAuthError{Code: "invalid_grant"}
+	}
+	redirectURI := r.PostFormValue("redirect_uri")
+	if (code.ExplicitRedirectURI || redirectURI != "") && redirectURI != code.RedirectURI {
+		return nil, &OAuthError{Code: "invalid_grant", Description: "redirect_uri mismatch"}
+	}
+	if !verifyPKCE(code, r.PostFormValue("code_verifier")) {
+		return nil, &OAuthError{Code: "invalid_grant", Description: "Invalid code_verifier"}
+	}
+	return s.issueToken(client, code.User, code.Scope)
+}
+
+// checkActive returns ErrUserInactive if Users has an active flag and the
+// user is not active.
+func (s *OAuthServer) checkActive(user UserKeyType) error {
+	if s.Users == nil || !hasActiveFlag(s.Users) {
+		return nil
+	}
+	id, err := UserKeyToID(user)
+	if err != nil {
+		return err
+	}
+	userName, err := s.Users.GetUserName(id)
+	if err != nil {
+		return err
+	}
+	return CheckActive(s.Users, userName)
+}
+
+// issueToken creates a new access token for the user that is restricted to
+// the scope.
+func (s *OAuthServer) issueToken(client *OAuthClient, user UserKeyType, scope string) (*OAuthTokenResponse, *OAuthError) {
+	// the scopes of the client may have changed since the code was issued
+	if !client.AllowsScope(scope) {
+		return nil, &OAuthError{Code: "invalid_scope"}
+	}
+	// access tokens are always restricted to the granted scopes (an empty
+	// set if the client didn't request a scope), so a token of a client is
+	// never a full session of the user
+	if s.Controller.Payload == nil {
+		log.Error("goauth: Controller.Payload is required to issue access tokens")
+		return nil, &OAuthError{Code: "server_error"}
+	}
+	// the user may have been deactivated since the grant was issued
+	if err := s.checkActive(user); err != nil {
+		if err == ErrUserInactive || err == ErrUserNotFound {
+			return nil, &OAuthError{Code: "invalid_grant"}
+		}
+		log.WithError(err).Error("goauth: Can't check if the user is active")
+		return nil, &OAuthError{Code: "server_error"}
+	}
+	_, token, err := s.Controller.AddScopedKey(user, s.TokenDuration, ParseScopes(scope))
+	if err != nil {
+		log.WithError(err).Error("goauth: Can't create access token")
+		return nil, &OAuthError{Code: "server_error"}
+	}
+	return &OAuthTokenResponse{AccessToken: s.Controller.ClientKey(token), TokenType: "Bearer",
+		ExpiresIn: int64(s.TokenDuration / time.Second), Scope: scope}, nil
+}
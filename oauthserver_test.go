@@ -0,0 +1,163 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// testOAuthServer returns a server with a public client and the session
+// cookies of user 1.
+func testOAuthServer(t *testing.T) (*OAuthServer, *OAuthClient, []*http.Cookie) {
+	controller := NewInMemoryController()
+	controller.Payload = NewInMemoryPayloadHandler()
+	store := sessions.NewCookieStore([]byte("secret"))
+	server := NewOAuthServer(NewInMemoryOAuthClientHandler(), controller, store, nil)
+	client, _, err := server.RegisterClient("app", []string{"https://app.example.com/cb"}, true, "read")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	_, _, session, err := controller.CreateAuthSession(r, store, uint64(1), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	if err := session.Save(r, w); err != nil {
+		t.Fatal(err)
+	}
+	return server, client, w.Result().Cookies()
+}
+
+// authorize sends an authorization request and returns the redirect
+// location.
+func authorize(t *testing.T, server *OAuthServer, cookies []*http.Cookie, params url.Values) *url.URL {
+	r := httptest.NewRequest(http.MethodGet, "/authorize?"+params.Encode(), nil)
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	server.ServeAuthorize(w, r)
+	if w.Code != http.StatusFound {
+		t.Fatalf("Expected a redirect from the authorization endpoint, got status %d", w.Code)
+	}
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return location
+}
+
+func exchangeCode(server *OAuthServer, params url.Values) *httptest.ResponseRecorder {
+	params.Set("grant_type", "authorization_code")
+	r := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(params.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	server.ServeToken(w, r)
+	return w
+}
+
+func TestOAuthCodeExchange(t *testing.T) {
+	server, client, cookies := testOAuthServer(t)
+	verifier := "a-verifier-that-is-long-enough-for-pkce-0123456789"
+	hash := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(hash[:])
+	redirectURI := client.RedirectURIs[0]
+	tests := []struct {
+		name             string
+		explicitRedirect bool
+		verifier         string
+		redirectURI      string
+		status           int
+	}{
+		{"valid", true, verifier, redirectURI, http.StatusOK},
+		{"implicit redirect_uri", false, verifier, "", http.StatusOK},
+		{"wrong verifier", true, "wrong", redirectURI, http.StatusBadRequest},
+		{"missing verifier", true, "", redirectURI, http.StatusBadRequest},
+		{"missing redirect_uri", true, verifier, "", http.StatusBadRequest},
+		{"other redirect_uri", false, verifier, "https://evil.example.com/cb", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		params := url.Values{"response_type": {"code"}, "client_id": {client.ID},
+			"scope": {"read"}, "code_challenge": {challenge},
+			"code_challenge_method": {"S256"}}
+		if test.explicitRedirect {
+			params.Set("redirect_uri", redirectURI)
+		}
+		code := authorize(t, server, cookies, params).Query().Get("code")
+		if code == "" {
+			t.Fatalf("%s: No code in redirect", test.name)
+		}
+		tokenParams := url.Values{"client_id": {client.ID}, "code": {code}}
+		if test.verifier != "" {
+			tokenParams.Set("code_verifier", test.verifier)
+		}
+		if test.redirectURI != "" {
+			tokenParams.Set("redirect_uri", test.redirectURI)
+		}
+		if w := exchangeCode(server, tokenParams); w.Code != test.status {
+			t.Errorf("%s: Expected status %d, got %d: %s", test.name, test.status, w.Code, w.Body.String())
+		}
+		// a code can only be redeemed once
+		if w := exchangeCode(server, tokenParams); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: Expected status %d for a used code, got %d", test.name, http.StatusBadRequest, w.Code)
+		}
+	}
+}
+
+func TestOAuthPlainPKCE(t *testing.T) {
+	server, client, cookies := testOAuthServer(t)
+	for _, method := range []string{"plain", ""} {
+		params := url.Values{"response_type": {"code"}, "client_id": {client.ID},
+			"scope": {"read"}, "code_challenge": {"challenge"}}
+		if method != "" {
+			params.Set("code_challenge_method", method)
+		}
+		location := authorize(t, server, cookies, params)
+		if err := location.Query().Get("error"); err != "invalid_request" {
+			t.Errorf("Method %q: Expected error invalid_request, got %q", method, err)
+		}
+	}
+	// public clients must use PKCE
+	params := url.Values{"response_type": {"code"}, "client_id": {client.ID}, "scope": {"read"}}
+	if err := authorize(t, server, cookies, params).Query().Get("error"); err != "invalid_request" {
+		t.Errorf("Without PKCE: Expected error invalid_request, got %q", err)
+	}
+	server.AllowPlainPKCE = true
+	params = url.Values{"response_type": {"code"}, "client_id": {client.ID},
+		"scope": {"read"}, "code_challenge": {"challenge"}}
+	code := authorize(t, server, cookies, params).Query().Get("code")
+	tokenParams := url.Values{"client_id": {client.ID}, "code": {code}, "code_verifier": {"challenge"}}
+	if w := exchangeCode(server, tokenParams); w.Code != http.StatusOK {
+		t.Errorf("With AllowPlainPKCE: Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,695 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package goauth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrKVNotFound is returned by KVTxn.Get if the key doesn't exist.
+//
+// New in version v0.7
+var ErrKVNotFound = errors.New("No value found for the key.")
+
+// KVPair is a key and its value.
+//
+// New in version v0.7
+type KVPair struct {
+	Key, Value []byte
+}
+
+// KVTxn is a transaction on an OrderedKV.
+//
+// New in version v0.7
+type KVTxn interface {
+	// Get returns the value of the key or ErrKVNotFound.
+	Get(key []byte) ([]byte, error)
+
+	// Set sets the value of the key, the value must not be empty (TiKV
+	// doesn't support empty values).
+	Set(key, value []byte) error
+
+	// Delete deletes the key, it does nothing if the key doesn't exist.
+	Delete(key []byte) error
+
+	// Scan returns the pairs with start <= key < end ordered by key, at
+	// most limit pairs if limit > 0. Use KVPrefixEnd to scan all keys with
+	// a prefix.
+	Scan(start, end []byte, limit int) ([]KVPair, error)
+}
+
+// OrderedKV is a transactional key-value store with ordered keys, for
+// example TiKV or FoundationDB. KVSessionHandler and KVUserHandler store
+// sessions and users in an OrderedKV, so each such store only has to
+// implement this small interface. InMemoryOrderedKV is an implementation for
+// tests, adapters/tikvauth implements it with TiKV.
+//
+// New in version v0.7
+type OrderedKV interface {
+	// Update runs fn in a transaction and commits it if fn returns nil.
+	// Implementations may retry on conflicts, so fn can be called several
+	// times and must not have other side effects.
+	// An error returned by fn must be returned unchanged.
+	Update(fn func(txn KVTxn) error) error
+
+	// View runs fn in a read-only transaction, an error returned by fn must
+	// be returned unchanged.
+	View(fn func(txn KVTxn) error) error
+}
+
+// KVPrefixEnd returns the smallest key that is greater than all keys with
+// the prefix, nil if there is no such key.
+//
+// New in version v0.7
+func KVPrefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// scanPrefix returns all pairs with the prefix.
+func scanPrefix(txn KVTxn, prefix string) ([]KVPair, error) {
+	return txn.Scan([]byte(prefix), KVPrefixEnd([]byte(prefix)), 0)
+}
+
+// InMemoryOrderedKV is an OrderedKV that keeps everything in memory,
+// transactions are serialized.
+//
+// New in version v0.7
+type InMemoryOrderedKV struct {
+	data  map[string][]byte
+	mutex sync.RWMutex
+}
+
+// NewInMemoryOrderedKV returns a new InMemoryOrderedKV.
+//
+// New in version v0.7
+func NewInMemoryOrderedKV() *InMemoryOrderedKV {
+	return &InMemoryOrderedKV{data: make(map[string][]byte)}
+}
+
+func (kv *InMemoryOrderedKV) Update(fn func(txn KVTxn) error) error {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	txn := &inMemoryKVTxn{data: kv.data, writes: make(map[string][]byte)}
+	if err := fn(txn); err != nil {
+		return err
+	}
+	for key, value := range txn.writes {
+		if value == nil {
+			delete(kv.data, key)
+		} else {
+			kv.data[key] = value
+		}
+	}
+	return nil
+}
+
+func (kv *InMemoryOrderedKV) View(fn func(txn KVTxn) error) error {
+	kv.mutex.RLock()
+	defer kv.mutex.RUnlock()
+	return fn(&inMemoryKVTxn{data: kv.data})
+}
+
+// inMemoryKVTxn reads from data and buffers the writes, a nil value in
+// writes is a deleted key. writes is nil in read-only transactions.
+type inMemoryKVTxn struct {
+	data, writes map[string][]byte
+}
+
+var errKVReadOnly = errors.New("Write in a read-only transaction.")
+
+func (txn *inMemoryKVTxn) Get(key []byte) ([]byte, error) {
+	value, has := txn.writes[string(key)]
+	if !has {
+		value, has = txn.data[string(key)]
+	}
+	if !has || value == nil {
+		return nil, ErrKVNotFound
+	}
+	return append([]byte(nil), value...), nil
+}
+
+func (txn *inMemoryKVTxn) Set(key, value []byte) error {
+	if txn.writes == nil {
+		return errKVReadOnly
+	}
+	txn.writes[string(key)] = append([]byte{}, value...)
+	return nil
+}
+
+func (txn *inMemoryKVTxn) Delete(key []byte) error {
+	if txn.writes == nil {
+		return errKVReadOnly
+	}
+	txn.writes[string(key)] = nil
+	return nil
+}
+
+func (txn *inMemoryKVTxn) Scan(start, end []byte, limit int) ([]KVPair, error) {
+	inRange := func(key string) bool {
+		return key >= string(start) && (end == nil || key < string(end))
+	}
+	keys := make([]string, 0)
+	for key := range txn.data {
+		if _, written := txn.writes[key]; !written && inRange(key) {
+			keys = append(keys, key)
+		}
+	}
+	for key, value := range txn.writes {
+		if value != nil && inRange(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+	res := make([]KVPair, len(keys))
+	for i, key := range keys {
+		value, _ := txn.Get([]byte(key))
+		res[i] = KVPair{Key: []byte(key), Value: value}
+	}
+	return res, nil
+}
+
+// KVSessionHandler is a SessionHandler that stores the sessions in an
+// OrderedKV. A session is stored under "<Prefix>key/<key>", the keys of a
+// user under "<Prefix>user/<user>/<key>".
+//
+// New in version v0.7
+type KVSessionHandler struct {
+	KV OrderedKV
+
+	// Prefix is the prefix of all keys, defaults to "goauth/sessions/".
+	Prefix string
+
+	// ConvertUser is the function used to transform the string representation
+	// of the user identification back to its original type.
+	// The default assumes uint64.
+	ConvertUser func(val string) (interface{}, error)
+
+	// BatchSize is the number of sessions DeleteInvalidKeys checks in one
+	// transaction, defaults to 1000.
+	BatchSize int
+}
+
+// NewKVSessionHandler returns a new KVSessionHandler.
+//
+// New in version v0.7
+func NewKVSessionHandler(kv OrderedKV) *KVSessionHandler {
+	convert := func(val string) (interface{}, error) {
+		res, err := strconv.ParseUint(val, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		return res, nil
+	}
+	return &KVSessionHandler{KV: kv, Prefix: "goauth/sessions/", ConvertUser: convert,
+		BatchSize: 1000}
+}
+
+// kvSessionEntry is the JSON value stored for each session.
+type kvSessionEntry struct {
+	User       string    `json:"user"`
+	Created    time.Time `json:"created"`
+	ValidUntil time.Time `json:"valid_until"`
+}
+
+func (h *KVSessionHandler) sessionKey(key string) []byte {
+	return []byte(h.Prefix + "key/" + key)
+}
+
+func (h *KVSessionHandler) userPrefix(user string) string {
+	return h.Prefix + "user/" + user + "/"
+}
+
+// Init is a NOOP, there are no tables to create.
+func (h *KVSessionHandler) Init() error {
+	return nil
+}
+
+func (h *KVSessionHandler) get(txn KVTxn, key string) (*kvSessionEntry, error) {
+	value, err := txn.Get(h.sessionKey(key))
+	if err == ErrKVNotFound {
+		return nil, ErrKeyNotFound
+	}
+	if err != nil {
+		return nil, wrapBackendError("kv", "GetData", err)
+	}
+	res := &kvSessionEntry{}
+	if err := json.Unmarshal(value, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (h *KVSessionHandler) GetData(key string) (*SessionKeyData, error) {
+	var entry *kvSessionEntry
+	err := h.KV.View(func(txn KVTxn) (err error) {
+		entry, err = h.get(txn, key)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	user, err := h.ConvertUser(entry.User)
+	if err != nil {
+		return nil, err
+	}
+	return &SessionKeyData{User: user, CreationTime: entry.Created, ValidUntil: entry.ValidUntil}, nil
+}
+
+func (h *KVSessionHandler) CreateEntry(user UserKeyType, key string, validDuration time.Duration) (*SessionKeyData, error) {
+	data := CurrentTimeKeyData(user, validDuration)
+	userString := fmt.Sprintf("%v", user)
+	value, err := json.Marshal(&kvSessionEntry{User: userString, Created: data.CreationTime,
+		ValidUntil: data.ValidUntil})
+	if err != nil {
+		return nil, err
+	}
+	err = h.KV.Update(func(txn KVTxn) error {
+		if err := txn.Set(h.sessionKey(key), value); err != nil {
+			return err
+		}
+		return txn.Set([]byte(h.userPrefix(userString)+key), []byte{'1'})
+	})
+	if err != nil {
+		return nil, wrapBackendError("kv", "CreateEntry", err)
+	}
+	return data, nil
+}
+
+// deleteSession deletes the session and its index entry.
+func (h *KVSessionHandler) deleteSession(txn KVTxn, key, user string) error {
+	if err := txn.Delete(h.sessionKey(key)); err != nil {
+		return err
+	}
+	return txn.Delete([]byte(h.userPrefix(user) + key))
+}
+
+func (h *KVSessionHandler) DeleteEntriesForUser(user UserKeyType) (int64, error) {
+	userString := fmt.Sprintf("%v", user)
+	prefix := h.userPrefix(userString)
+	var removed int64
+	err := h.KV.Update(func(txn KVTxn) error {
+		removed = 0
+		pairs, err := scanPrefix(txn, prefix)
+		if err != nil {
+			return err
+		}
+		for _, pair := range pairs {
+			if err := h.deleteSession(txn, strings.TrimPrefix(string(pair.Key), prefix), userString); err != nil {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+	if err != nil {
+		return -1, wrapBackendError("kv", "DeleteEntriesForUser", err)
+	}
+	return removed, nil
+}
+
+// DeleteInvalidKeys scans all sessions in batches of BatchSize and deletes
+// the expired ones.
+func (h *KVSessionHandler) DeleteInvalidKeys() (int64, error) {
+	prefix := h.Prefix + "key/"
+	start, end := []byte(prefix), KVPrefixEnd([]byte(prefix))
+	now := CurrentTime()
+	var removed int64
+	for start != nil {
+		var batchRemoved int64
+		var next []byte
+		err := h.KV.Update(func(txn KVTxn) error {
+			batchRemoved, next = 0, nil
+			pairs, err := txn.Scan(start, end, h.BatchSize)
+			if err != nil {
+				return err
+			}
+			for _, pair := range pairs {
+				entry := &kvSessionEntry{}
+				if err := json.Unmarshal(pair.Value, entry); err != nil {
+					return err
+				}
+				if KeyInvalid(now, entry.ValidUntil) {
+					if err := h.deleteSession(txn, strings.TrimPrefix(string(pair.Key), prefix), entry.User); err != nil {
+						return err
+					}
+					batchRemoved++
+				}
+			}
+			if h.BatchSize > 0 && len(pairs) == h.BatchSize {
+				// continue after the last key of the batch
+				next = append(pairs[len(pairs)-1].Key, 0)
+			}
+			return nil
+		})
+		if err != nil {
+			return removed, wrapBackendError("kv", "DeleteInvalidKeys", err)
+		}
+		removed += batchRemoved
+		start = next
+	}
+	return removed, nil
+}
+
+func (h *KVSessionHandler) DeleteKey(key string) error {
+	err := h.KV.Update(func(txn KVTxn) error {
+		entry, err := h.get(txn, key)
+		if err == ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return h.deleteSession(txn, key, entry.User)
+	})
+	return wrapBackendError("kv", "DeleteKey", err)
+}
+
+func (h *KVSessionHandler) ListSessionsForUser(user UserKeyType) (map[string]*SessionKeyData, error) {
+	prefix := h.userPrefix(fmt.Sprintf("%v", user))
+	now := CurrentTime()
+	res := make(map[string]*SessionKeyData)
+	err := h.KV.View(func(txn KVTxn) error {
+		pairs, err := scanPrefix(txn, prefix)
+		if err != nil {
+			return err
+		}
+		for _, pair := range pairs {
+			key := strings.TrimPrefix(string(pair.Key), prefix)
+			entry, err := h.get(txn, key)
+			if err == ErrKeyNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if KeyValid(now, entry.ValidUntil) {
+				res[key] = &SessionKeyData{User: user, CreationTime: entry.Created,
+					ValidUntil: entry.ValidUntil}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, wrapBackendError("kv", "ListSessionsForUser", err)
+	}
+	return res, nil
+}
+
+// KVUserHandler is a UserHandler that stores the users in an OrderedKV.
+// A user is stored under "<Prefix>name/<username>", the username of each id
+// under "<Prefix>id/<id>" and the last assigned id under "<Prefix>next_id".
+// KVUserHandler implements AdminFlagHandler and ActiveFlagHandler as well.
+//
+// New in version v0.7
+type KVUserHandler struct {
+	KV OrderedKV
+
+	// PwHandler is used to hash and check passwords.
+	PwHandler PasswordHandler
+
+	// Prefix is the prefix of all keys, defaults to "goauth/users/".
+	Prefix string
+
+	// Names restricts the usernames of new users, see UsernamePolicy.
+	// nil means no restrictions.
+	Names *UsernamePolicy
+}
+
+// NewKVUserHandler returns a new KVUserHandler, if pwHandler is nil
+// DefaultPWHandler is used.
+//
+// New in version v0.7
+func NewKVUserHandler(kv OrderedKV, pwHandler PasswordHandler) *KVUserHandler {
+	if pwHandler == nil {
+		pwHandler = DefaultPWHandler
+	}
+	return &KVUserHandler{KV: kv, PwHandler: pwHandler, Prefix: "goauth/users/"}
+}
+
+// kvUser is the JSON value stored for each user.
+type kvUser struct {
+	BaseUserInformation
+	Password []byte `json:"password"`
+}
+
+func (h *KVUserHandler) nameKey(userName string) []byte {
+	return []byte(h.Prefix + "name/" + userName)
+}
+
+func (h *KVUserHandler) idKey(id uint64) []byte {
+	// zero padded s.t. the ids are ordered
+	return []byte(fmt.Sprintf("%sid/%020d", h.Prefix, id))
+}
+
+// Init is a NOOP, there are no tables to create.
+func (h *KVUserHandler) Init() error {
+	return nil
+}
+
+func (h *KVUserHandler) get(txn KVTxn, userName string) (*kvUser, error) {
+	value, err := txn.Get(h.nameKey(userName))
+	if err == ErrKVNotFound {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	res := &kvUser{}
+	if err := json.Unmarshal(value, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (h *KVUserHandler) put(txn KVTxn, user *kvUser) error {
+	value, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	return txn.Set(h.nameKey(user.UserName), value)
+}
+
+// update applies fn to the stored user.
+func (h *KVUserHandler) update(op, userName string, fn func(user *kvUser)) error {
+	err := h.KV.Update(func(txn KVTxn) error {
+		user, err := h.get(txn, userName)
+		if err != nil {
+			return err
+		}
+		fn(user)
+		return h.put(txn, user)
+	})
+	if err == ErrUserNotFound {
+		return err
+	}
+	return wrapBackendError("kv", op, err)
+}
+
+func (h *KVUserHandler) Insert(userName, firstName, lastName, email string, plainPW []byte) (uint64, error) {
+	if err := h.Names.Check(userName); err != nil {
+		return NoUserID, err
+	}
+	encrypted, err := h.PwHandler.GenerateHash(plainPW)
+	if err != nil {
+		return NoUserID, err
+	}
+	var id uint64
+	err = h.KV.Update(func(txn KVTxn) error {
+		if _, err := txn.Get(h.nameKey(userName)); err == nil {
+			return ErrDuplicateUsername
+		} else if err != ErrKVNotFound {
+			return err
+		}
+		id = 1
+		nextKey := []byte(h.Prefix + "next_id")
+		value, err := txn.Get(nextKey)
+		switch {
+		case err == nil:
+			last, parseErr := strconv.ParseUint(string(value), 10, 64)
+			if parseErr != nil {
+				return parseErr
+			}
+			id = last + 1
+		case err != ErrKVNotFound:
+			return err
+		}
+		if err := txn.Set(nextKey, []byte(strconv.FormatUint(id, 10))); err != nil {
+			return err
+		}
+		if err := txn.Set(h.idKey(id), []byte(userName)); err != nil {
+			return err
+		}
+		return h.put(txn, &kvUser{BaseUserInformation: BaseUserInformation{ID: id,
+			UserName: userName, FirstName: firstName, LastName: lastName, Email: email,
+			LastLogin: CurrentTime(), IsActive: true}, Password: encrypted})
+	})
+	if err == ErrDuplicateUsername {
+		return NoUserID, err
+	}
+	if err != nil {
+		return NoUserID, wrapBackendError("kv", "Insert", err)
+	}
+	return id, nil
+}
+
+func (h *KVUserHandler) Validate(userName string, cleartextPwCheck []byte) (uint64, error) {
+	var user *kvUser
+	err := h.KV.View(func(txn KVTxn) (err error) {
+		user, err = h.get(txn, userName)
+		return
+	})
+	if err == ErrUserNotFound {
+		return NoUserID, err
+	}
+	if err != nil {
+		return NoUserID, wrapBackendError("kv", "Validate", err)
+	}
+	// the password might have been cleared, the user can't log in then
+	if len(user.Password) == 0 {
+		return NoUserID, nil
+	}
+	ok, err := h.PwHandler.CheckPassword(user.Password, cleartextPwCheck)
+	if err != nil || !ok {
+		return NoUserID, err
+	}
+	if user.IsPending {
+		return user.ID, ErrRegistrationPending
+	}
+	return user.ID, nil
+}
+
+func (h *KVUserHandler) UpdatePassword(userName string, plainPW []byte) error {
+	encrypted, err := h.PwHandler.GenerateHash(plainPW)
+	if err != nil {
+		return err
+	}
+	return h.update("UpdatePassword", userName, func(user *kvUser) {
+		user.Password = encrypted
+	})
+}
+
+func (h *KVUserHandler) ListUsers() (map[uint64]string, error) {
+	prefix := h.Prefix + "id/"
+	res := make(map[uint64]string)
+	err := h.KV.View(func(txn KVTxn) error {
+		pairs, err := scanPrefix(txn, prefix)
+		if err != nil {
+			return err
+		}
+		for _, pair := range pairs {
+			id, err := strconv.ParseUint(strings.TrimPrefix(string(pair.Key), prefix), 10, 64)
+			if err != nil {
+				return err
+			}
+			res[id] = string(pair.Value)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, wrapBackendError("kv", "ListUsers", err)
+	}
+	return res, nil
+}
+
+func (h *KVUserHandler) GetUserName(id uint64) (string, error) {
+	var value []byte
+	err := h.KV.View(func(txn KVTxn) (err error) {
+		value, err = txn.Get(h.idKey(id))
+		return
+	})
+	if err == ErrKVNotFound {
+		return "", ErrUserNotFound
+	}
+	if err != nil {
+		return "", wrapBackendError("kv", "GetUserName", err)
+	}
+	return string(value), nil
+}
+
+func (h *KVUserHandler) GetUserID(userName string) (uint64, error) {
+	info, err := h.GetUserBaseInfo(userName)
+	if err != nil {
+		return NoUserID, err
+	}
+	return info.ID, nil
+}
+
+func (h *KVUserHandler) DeleteUser(userName string) error {
+	err := h.KV.Update(func(txn KVTxn) error {
+		user, err := h.get(txn, userName)
+		if err == ErrUserNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := txn.Delete(h.idKey(user.ID)); err != nil {
+			return err
+		}
+		return txn.Delete(h.nameKey(userName))
+	})
+	return wrapBackendError("kv", "DeleteUser", err)
+}
+
+func (h *KVUserHandler) GetUserBaseInfo(userName string) (*BaseUserInformation, error) {
+	var user *kvUser
+	err := h.KV.View(func(txn KVTxn) (err error) {
+		user, err = h.get(txn, userName)
+		return
+	})
+	if err == ErrUserNotFound {
+		return nil, err
+	}
+	if err != nil {
+		return nil, wrapBackendError("kv", "GetUserBaseInfo", err)
+	}
+	return &user.BaseUserInformation, nil
+}
+
+func (h *KVUserHandler) SetAdmin(userName string, admin bool) error {
+	return h.update("SetAdmin", userName, func(user *kvUser) {
+		user.IsAdmin = admin
+	})
+}
+
+func (h *KVUserHandler) SetActive(userName string, active bool) error {
+	return h.update("SetActive", userName, func(user *kvUser) {
+		user.IsActive = active
+	})
+}
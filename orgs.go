@@ -0,0 +1,578 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrOrgNotFound is returned if an organization doesn't exist.
+var ErrOrgNotFound = errors.New("Organization not found.")
+
+// ErrNotMember is returned if a user is not a member of an organization.
+var ErrNotMember = errors.New("User is not a member of the organization.")
+
+// OrgRole is the role of a user in an organization.
+// The roles are ordered: an owner is also an admin and an admin is also a
+// member.
+//
+// New in version v0.7
+type OrgRole int
+
+const (
+	OrgMember OrgRole = iota + 1
+	OrgAdmin
+	OrgOwner
+)
+
+func (role OrgRole) String() string {
+	switch role {
+	case OrgMember:
+		return "member"
+	case OrgAdmin:
+		return "admin"
+	case OrgOwner:
+		return "owner"
+	default:
+		return fmt.Sprintf("OrgRole(%d)", int(role))
+	}
+}
+
+// AtLeast reports whether role grants at least the rights of other.
+func (role OrgRole) AtLeast(other OrgRole) bool {
+	return role >= other
+}
+
+// ParseOrgRole parses the result of OrgRole.String.
+func ParseOrgRole(s string) (OrgRole, error) {
+	switch s {
+	case "member":
+		return OrgMember, nil
+	case "admin":
+		return OrgAdmin, nil
+	case "owner":
+		return OrgOwner, nil
+	default:
+		return 0, fmt.Errorf("goauth: invalid organization role %q", s)
+	}
+}
+
+// Organization is an organization (for example a customer in a B2B
+// application). Teams are organizations with a parent: Parent is the id of
+// the organization the team belongs to or 0.
+//
+// New in version v0.7
+type Organization struct {
+	ID, Parent uint64
+	Name       string
+	Created    time.Time
+}
+
+// OrgHandler manages organizations and their members.
+// Every member has exactly one OrgRole in an organization.
+//
+// New in version v0.7
+type OrgHandler interface {
+	// Init initializes the storage, see UserHandler.
+	Init() error
+
+	// CreateOrg creates a new organization and returns its id, parent is the
+	// id of the parent organization (for teams) or 0.
+	CreateOrg(name string, parent uint64) (uint64, error)
+
+	// GetOrg returns the organization or ErrOrgNotFound.
+	GetOrg(id uint64) (*Organization, error)
+
+	// DeleteOrg deletes the organization and all its memberships.
+	DeleteOrg(id uint64) error
+
+	// SetMember adds the user to the organization or changes the role of an
+	// existing member.
+	SetMember(org, user uint64, role OrgRole) error
+
+	// RemoveMember removes the user from the organization.
+	RemoveMember(org, user uint64) error
+
+	// MemberRole returns the role of the user or ErrNotMember.
+	MemberRole(org, user uint64) (OrgRole, error)
+
+	// ListUsersInOrg returns the members of the organization and their
+	// roles.
+	ListUsersInOrg(org uint64) (map[uint64]OrgRole, error)
+
+	// ListOrgsForUser returns the organizations the user is a member of and
+	// the role in each of them.
+	ListOrgsForUser(user uint64) (map[uint64]OrgRole, error)
+}
+
+// IsMember reports whether the user is a member of the organization.
+//
+// New in version v0.7
+func IsMember(orgs OrgHandler, org, user uint64) (bool, error) {
+	_, err := orgs.MemberRole(org, user)
+	switch err {
+	case nil:
+		return true, nil
+	case ErrNotMember:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// HasOrgRole reports whether the user has at least the given role in the
+// organization.
+//
+// New in version v0.7
+func HasOrgRole(orgs OrgHandler, org, user uint64, role OrgRole) (bool, error) {
+	memberRole, err := orgs.MemberRole(org, user)
+	switch err {
+	case nil:
+		return memberRole.AtLeast(role), nil
+	case ErrNotMember:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// RequireOrgRole returns a handler that calls next only if the user of the
+// request has at least the given role in the organization returned by
+// orgFromRequest (for example parsed from the URL).
+// It must be used after a middleware that stores the session in the
+// context.
+//
+// New in version v0.7
+func RequireOrgRole(orgs OrgHandler, orgFromRequest func(r *http.Request) (uint64, error), role OrgRole, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := UserIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		org, err := orgFromRequest(r)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		allowed, err := HasOrgRole(orgs, org, user, role)
+		if err != nil {
+			log.WithError(err).Error("goauth: Can't check organization membership")
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if !allowed {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// InMemoryOrgHandler is an OrgHandler that keeps everything in memory.
+//
+// New in version v0.7
+type InMemoryOrgHandler struct {
+	mutex   sync.RWMutex
+	nextID  uint64
+	orgs    map[uint64]*Organization
+	members map[uint64]map[uint64]OrgRole
+}
+
+// NewInMemoryOrgHandler returns a new InMemoryOrgHandler.
+func NewInMemoryOrgHandler() *InMemoryOrgHandler {
+	return &InMemoryOrgHandler{nextID: 1, orgs: make(map[uint64]*Organization),
+		members: make(map[uint64]map[uint64]OrgRole)}
+}
+
+func (h *InMemoryOrgHandler) Init() error {
+	return nil
+}
+
+func (h *InMemoryOrgHandler) CreateOrg(name string, parent uint64) (uint64, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if parent != 0 {
+		if _, has := h.orgs[parent]; !has {
+			return 0, ErrOrgNotFound
+		}
+	}
+	id := h.nextID
+	h.nextID++
+	h.orgs[id] = &Organization{ID: id, Parent: parent, Name: name, Created: CurrentTime()}
+	h.members[id] = make(map[uint64]OrgRole)
+	return id, nil
+}
+
+func (h *InMemoryOrgHandler) GetOrg(id uint64) (*Organization, error) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	org, has := h.orgs[id]
+	if !has {
+		return nil, ErrOrgNotFound
+	}
+	res := *org
+	return &res, nil
+}
+
+func (h *InMemoryOrgHandler) DeleteOrg(id uint64) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	delete(h.orgs, id)
+	delete(h.members, id)
+	return nil
+}
+
+func (h *InMemoryOrgHandler) SetMember(org, user uint64, role OrgRole) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	members, has := h.members[org]
+	if !has {
+		return ErrOrgNotFound
+	}
+	members[user] = role
+	return nil
+}
+
+func (h *InMemoryOrgHandler) RemoveMember(org, user uint64) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	delete(h.members[org], user)
+	return nil
+}
+
+func (h *InMemoryOrgHandler) MemberRole(org, user uint64) (OrgRole, error) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	role, has := h.members[org][user]
+	if !has {
+		return 0, ErrNotMember
+	}
+	return role, nil
+}
+
+func (h *InMemoryOrgHandler) ListUsersInOrg(org uint64) (map[uint64]OrgRole, error) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	members := h.members[org]
+	res := make(map[uint64]OrgRole, len(members))
+	for user, role := range members {
+		res[user] = role
+	}
+	return res, nil
+}
+
+func (h *InMemoryOrgHandler) ListOrgsForUser(user uint64) (map[uint64]OrgRole, error) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	res := make(map[uint64]OrgRole)
+	for org, members := range h.members {
+		if role, has := members[user]; has {
+			res[org] = role
+		}
+	}
+	return res, nil
+}
+
+// SQLOrgQueries stores the queries for SQLOrgHandler.
+// There are two tables: organizations (id, parent, name, created) and
+// org_members (org_id, user_id, role), the role is stored as the integer
+// value of the OrgRole.
+//
+// New in version v0.7
+type SQLOrgQueries struct {
+	InitOrgsQuery, InitMembersQuery, CreateQuery, GetQuery, DeleteQuery,
+	DeleteMembersQuery, SetMemberQuery, RemoveMemberQuery, MemberRoleQuery,
+	ListMembersQuery, ListOrgsQuery string
+
+	// CreateReturnsID must be true if CreateQuery returns the new id (with
+	// RETURNING in postgres), otherwise LastInsertId is used.
+	CreateReturnsID bool
+
+	// TimeFromScanType is used to transform database time entries to
+	// gos time. See SQLSessionHandler for details.
+	TimeFromScanType func(val interface{}) (time.Time, error)
+}
+
+// MySQLOrgQueries provides queries to use with MySQL.
+func MySQLOrgQueries() *SQLOrgQueries {
+	initOrgsQ := `
+	CREATE TABLE IF NOT EXISTS organizations (
+		id SERIAL,
+		parent BIGINT UNSIGNED NOT NULL,
+		name VARCHAR(150) NOT NULL,
+		created DATETIME NOT NULL,
+		PRIMARY KEY(id)
+	);
+	`
+	initMembersQ := `
+	CREATE TABLE IF NOT EXISTS org_members (
+		org_id BIGINT UNSIGNED NOT NULL,
+		user_id BIGINT UNSIGNED NOT NULL,
+		role INT NOT NULL,
+		PRIMARY KEY(org_id, user_id)
+	);
+	`
+	return &SQLOrgQueries{InitOrgsQuery: initOrgsQ, InitMembersQuery: initMembersQ,
+		CreateQuery:        "INSERT INTO organizations (parent, name, created) VALUES(?, ?, ?)",
+		GetQuery:           "SELECT parent, name, created FROM organizations WHERE id=?",
+		DeleteQuery:        "DELETE FROM organizations WHERE id=?",
+		DeleteMembersQuery: "DELETE FROM org_members WHERE org_id=?",
+		SetMemberQuery:     "INSERT INTO org_members (org_id, user_id, role) VALUES(?, ?, ?) ON DUPLICATE KEY UPDATE role=VALUES(role)",
+		RemoveMemberQuery:  "DELETE FROM org_members WHERE org_id=? AND user_id=?",
+		MemberRoleQuery:    "SELECT role FROM org_members WHERE org_id=? AND user_id=?",
+		ListMembersQuery:   "SELECT user_id, role FROM org_members WHERE org_id=?",
+		ListOrgsQuery:      "SELECT org_id, role FROM org_members WHERE user_id=?",
+		TimeFromScanType:   DefaultTimeFromScanType}
+}
+
+// PostgresOrgQueries provides queries to use with postgres.
+func PostgresOrgQueries() *SQLOrgQueries {
+	initOrgsQ := `
+	CREATE TABLE IF NOT EXISTS organizations (
+		id bigserial PRIMARY KEY,
+		parent bigint NOT NULL,
+		name varchar(150) NOT NULL,
+		created timestamp NOT NULL
+	);
+	`
+	initMembersQ := `
+	CREATE TABLE IF NOT EXISTS org_members (
+		org_id bigint NOT NULL,
+		user_id bigint NOT NULL,
+		role integer NOT NULL,
+		PRIMARY KEY(org_id, user_id)
+	);
+	`
+	return &SQLOrgQueries{InitOrgsQuery: initOrgsQ, InitMembersQuery: initMembersQ,
+		CreateQuery:        "INSERT INTO organizations (parent, name, created) VALUES ($1, $2, $3) RETURNING id",
+		GetQuery:           "SELECT parent, name, created FROM organizations WHERE id = $1",
+		DeleteQuery:        "DELETE FROM organizations WHERE id = $1",
+		DeleteMembersQuery: "DELETE FROM org_members WHERE org_id = $1",
+		SetMemberQuery:     "INSERT INTO org_members (org_id, user_id, role) VALUES ($1, $2, $3) ON CONFLICT (org_id, user_id) DO UPDATE SET role = EXCLUDED.role",
+		RemoveMemberQuery:  "DELETE FROM org_members WHERE org_id = $1 AND user_id = $2",
+		MemberRoleQuery:    "SELECT role FROM org_members WHERE org_id = $1 AND user_id = $2",
+		ListMembersQuery:   "SELECT user_id, role FROM org_members WHERE org_id = $1",
+		ListOrgsQuery:      "SELECT org_id, role FROM org_members WHERE user_id = $1",
+		CreateReturnsID:    true,
+		TimeFromScanType:   DefaultTimeFromScanType}
+}
+
+// SQLite3OrgQueries provides queries to use with sqlite3.
+func SQLite3OrgQueries() *SQLOrgQueries {
+	res := MySQLOrgQueries()
+	res.InitOrgsQuery = `
+	CREATE TABLE IF NOT EXISTS organizations (
+		id INTEGER PRIMARY KEY,
+		parent INTEGER NOT NULL,
+		name VARCHAR(150) NOT NULL,
+		created DATETIME NOT NULL
+	);
+	`
+	res.SetMemberQuery = "INSERT OR REPLACE INTO org_members (org_id, user_id, role) VALUES(?, ?, ?)"
+	return res
+}
+
+// SQLOrgHandler implements OrgHandler by executing the queries defined in
+// an instance of SQLOrgQueries.
+//
+// New in version v0.7
+type SQLOrgHandler struct {
+	*SQLOrgQueries
+
+	// DB is the database to execute the queries on.
+	DB *sql.DB
+
+	blockDB bool
+	mutex   sync.RWMutex
+}
+
+// NewSQLOrgHandler returns a new SQLOrgHandler, blockDB has the same
+// meaning as in NewSQLUserHandler.
+func NewSQLOrgHandler(queries *SQLOrgQueries, db *sql.DB, blockDB bool) *SQLOrgHandler {
+	return &SQLOrgHandler{SQLOrgQueries: queries, DB: db, blockDB: blockDB}
+}
+
+// NewMySQLOrgHandler returns a new SQLOrgHandler that uses MySQL.
+func NewMySQLOrgHandler(db *sql.DB) *SQLOrgHandler {
+	return NewSQLOrgHandler(MySQLOrgQueries(), db, false)
+}
+
+// NewPostgresOrgHandler returns a new SQLOrgHandler that uses postgres.
+func NewPostgresOrgHandler(db *sql.DB) *SQLOrgHandler {
+	return NewSQLOrgHandler(PostgresOrgQueries(), db, false)
+}
+
+// NewSQLite3OrgHandler returns a new SQLOrgHandler that uses sqlite3.
+func NewSQLite3OrgHandler(db *sql.DB) *SQLOrgHandler {
+	return NewSQLOrgHandler(SQLite3OrgQueries(), db, true)
+}
+
+func (handler *SQLOrgHandler) Init() error {
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	if _, err := handler.DB.Exec(handler.InitOrgsQuery); err != nil {
+		return err
+	}
+	_, err := handler.DB.Exec(handler.InitMembersQuery)
+	return err
+}
+
+func (handler *SQLOrgHandler) CreateOrg(name string, parent uint64) (uint64, error) {
+	if parent != 0 {
+		if _, err := handler.GetOrg(parent); err != nil {
+			return 0, err
+		}
+	}
+	now := CurrentTime()
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	if handler.CreateReturnsID {
+		var id uint64
+		if err := handler.DB.QueryRow(handler.CreateQuery, parent, name, now).Scan(&id); err != nil {
+			return 0, wrapBackendError("sql", "CreateOrg", err)
+		}
+		return id, nil
+	}
+	res, err := handler.DB.Exec(handler.CreateQuery, parent, name, now)
+	if err != nil {
+		return 0, wrapBackendError("sql", "CreateOrg", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return uint64(id), nil
+}
+
+func (handler *SQLOrgHandler) GetOrg(id uint64) (*Organization, error) {
+	if handler.blockDB {
+		handler.mutex.RLock()
+		defer handler.mutex.RUnlock()
+	}
+	res := &Organization{ID: id}
+	var createdVal interface{}
+	err := handler.DB.QueryRow(handler.GetQuery, id).Scan(&res.Parent, &res.Name, &createdVal)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrOrgNotFound
+		}
+		return nil, wrapBackendError("sql", "GetOrg", err)
+	}
+	if res.Created, err = handler.TimeFromScanType(createdVal); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (handler *SQLOrgHandler) DeleteOrg(id uint64) error {
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	if _, err := handler.DB.Exec(handler.DeleteMembersQuery, id); err != nil {
+		return wrapBackendError("sql", "DeleteOrg", err)
+	}
+	_, err := handler.DB.Exec(handler.DeleteQuery, id)
+	return wrapBackendError("sql", "DeleteOrg", err)
+}
+
+func (handler *SQLOrgHandler) SetMember(org, user uint64, role OrgRole) error {
+	if _, err := handler.GetOrg(org); err != nil {
+		return err
+	}
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	_, err := handler.DB.Exec(handler.SetMemberQuery, org, user, int(role))
+	return wrapBackendError("sql", "SetMember", err)
+}
+
+func (handler *SQLOrgHandler) RemoveMember(org, user uint64) error {
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	_, err := handler.DB.Exec(handler.RemoveMemberQuery, org, user)
+	return wrapBackendError("sql", "RemoveMember", err)
+}
+
+func (handler *SQLOrgHandler) MemberRole(org, user uint64) (OrgRole, error) {
+	if handler.blockDB {
+		handler.mutex.RLock()
+		defer handler.mutex.RUnlock()
+	}
+	var role int
+	if err := handler.DB.QueryRow(handler.MemberRoleQuery, org, user).Scan(&role); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, ErrNotMember
+		}
+		return 0, wrapBackendError("sql", "MemberRole", err)
+	}
+	return OrgRole(role), nil
+}
+
+func (handler *SQLOrgHandler) listRoles(op, query string, id uint64) (map[uint64]OrgRole, error) {
+	if handler.blockDB {
+		handler.mutex.RLock()
+		defer handler.mutex.RUnlock()
+	}
+	rows, err := handler.DB.Query(query, id)
+	if err != nil {
+		return nil, wrapBackendError("sql", op, err)
+	}
+	defer rows.Close()
+	res := make(map[uint64]OrgRole)
+	for rows.Next() {
+		var other uint64
+		var role int
+		if err := rows.Scan(&other, &role); err != nil {
+			return nil, err
+		}
+		res[other] = OrgRole(role)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (handler *SQLOrgHandler) ListUsersInOrg(org uint64) (map[uint64]OrgRole, error) {
+	return handler.listRoles("ListUsersInOrg", handler.ListMembersQuery, org)
+}
+
+func (handler *SQLOrgHandler) ListOrgsForUser(user uint64) (map[uint64]OrgRole, error) {
+	return handler.listRoles("ListOrgsForUser", handler.ListOrgsQuery, user)
+}
@@ -0,0 +1,463 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// ErrPayloadValueNotFound is returned by a SessionPayloadHandler if there is
+// no value with the given name stored for a session key.
+var ErrPayloadValueNotFound = errors.New("No payload value with this name found for the session.")
+
+// SessionPayloadHandler stores additional values for a session key on the
+// server side, for example the CSRF token of a session.
+// The SessionHandler only stores the user of a session, everything else
+// belonging to a session goes here.
+//
+// Each value gets a validUntil time, usually the ValidUntil of the session.
+// Expired values are not returned any more and get removed by
+// DeleteInvalidPayloads.
+//
+// New in version v0.7
+type SessionPayloadHandler interface {
+	// Init initializes the storage, it must not fail if called several
+	// times.
+	Init() error
+
+	// GetPayload returns all valid values stored for the session key, an
+	// empty map if there are none.
+	GetPayload(key string) (map[string]string, error)
+
+	// GetPayloadValue returns the value stored under name for the session
+	// key. Returns "" and ErrPayloadValueNotFound if there is no such value.
+	GetPayloadValue(key, name string) (string, error)
+
+	// SetPayloadValue sets the value stored under name for the session key,
+	// an existing value is replaced.
+	SetPayloadValue(key, name, value string, validUntil time.Time) error
+
+	// DeletePayloadValue removes the value stored under name for the session
+	// key, it does nothing if there is no such value.
+	DeletePayloadValue(key, name string) error
+
+	// DeletePayload removes all values stored for the session key, call it
+	// when a session ends.
+	DeletePayload(key string) error
+
+	// DeleteInvalidPayloads removes all expired values and returns the
+	// number of removed values (if supported by the storage).
+	DeleteInvalidPayloads() (int64, error)
+}
+
+type inMemoryPayloadValue struct {
+	value      string
+	validUntil time.Time
+}
+
+// InMemoryPayloadHandler is a SessionPayloadHandler that keeps all values
+// in memory, it goes well with the InMemoryHandler.
+//
+// New in version v0.7
+type InMemoryPayloadHandler struct {
+	payloads map[string]map[string]inMemoryPayloadValue
+	mutex    sync.RWMutex
+}
+
+// NewInMemoryPayloadHandler returns a new InMemoryPayloadHandler.
+func NewInMemoryPayloadHandler() *InMemoryPayloadHandler {
+	return &InMemoryPayloadHandler{payloads: make(map[string]map[string]inMemoryPayloadValue)}
+}
+
+func (h *InMemoryPayloadHandler) Init() error {
+	return nil
+}
+
+func (h *InMemoryPayloadHandler) GetPayload(key string) (map[string]string, error) {
+	now := CurrentTime()
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	res := make(map[string]string)
+	for name, value := range h.payloads[key] {
+		if KeyValid(now, value.validUntil) {
+			res[name] = value.value
+		}
+	}
+	return res, nil
+}
+
+func (h *InMemoryPayloadHandler) GetPayloadValue(key, name string) (string, error) {
+	now := CurrentTime()
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	value, has := h.payloads[key][name]
+	if !has || KeyInvalid(now, value.validUntil) {
+		return "", ErrPayloadValueNotFound
+	}
+	return value.value, nil
+}
+
+func (h *InMemoryPayloadHandler) SetPayloadValue(key, name, value string, validUntil time.Time) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	payload, has := h.payloads[key]
+	if !has {
+		payload = make(map[string]inMemoryPayloadValue)
+		h.payloads[key] = payload
+	}
+	payload[name] = inMemoryPayloadValue{value: value, validUntil: validUntil}
+	return nil
+}
+
+func (h *InMemoryPayloadHandler) DeletePayloadValue(key, name string) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if payload, has := h.payloads[key]; has {
+		delete(payload, name)
+		if len(payload) == 0 {
+			delete(h.payloads, key)
+		}
+	}
+	return nil
+}
+
+func (h *InMemoryPayloadHandler) DeletePayload(key string) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	delete(h.payloads, key)
+	return nil
+}
+
+func (h *InMemoryPayloadHandler) DeleteInvalidPayloads() (int64, error) {
+	now := CurrentTime()
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	var num int64
+	for key, payload := range h.payloads {
+		for name, value := range payload {
+			if KeyInvalid(now, value.validUntil) {
+				delete(payload, name)
+				num++
+			}
+		}
+		if len(payload) == 0 {
+			delete(h.payloads, key)
+		}
+	}
+	return num, nil
+}
+
+// SQLPayloadQueries stores the queries used by SQLPayloadHandler, the values
+// are stored in the table session_payload.
+//
+// New in version v0.7
+type SQLPayloadQueries struct {
+	InitQuery, GetQuery, GetValueQuery, SetQuery, DeleteValueQuery,
+	DeleteQuery, DeleteInvalidQuery string
+}
+
+// MySQLPayloadQueries provides queries to use with MySQL.
+func MySQLPayloadQueries() *SQLPayloadQueries {
+	initQ := `
+	CREATE TABLE IF NOT EXISTS session_payload (
+		session_key VARCHAR(255) NOT NULL,
+		name VARCHAR(100) NOT NULL,
+		value TEXT NOT NULL,
+		valid_until DATETIME NOT NULL,
+		PRIMARY KEY(session_key, name)
+	);
+	`
+	return &SQLPayloadQueries{InitQuery: initQ,
+		GetQuery:           "SELECT name, value FROM session_payload WHERE session_key=? AND valid_until >= ?",
+		GetValueQuery:      "SELECT value FROM session_payload WHERE session_key=? AND name=? AND valid_until >= ?",
+		SetQuery:           "INSERT INTO session_payload (session_key, name, value, valid_until) VALUES(?, ?, ?, ?) ON DUPLICATE KEY UPDATE value=VALUES(value), valid_until=VALUES(valid_until)",
+		DeleteValueQuery:   "DELETE FROM session_payload WHERE session_key=? AND name=?",
+		DeleteQuery:        "DELETE FROM session_payload WHERE session_key=?",
+		DeleteInvalidQuery: "DELETE FROM session_payload WHERE valid_until < ?"}
+}
+
+// PostgresPayloadQueries provides queries to use with postgres.
+func PostgresPayloadQueries() *SQLPayloadQueries {
+	initQ := `
+	CREATE TABLE IF NOT EXISTS session_payload (
+		session_key varchar(255) NOT NULL,
+		name varchar(100) NOT NULL,
+		value text NOT NULL,
+		valid_until timestamp NOT NULL,
+		PRIMARY KEY(session_key, name)
+	);
+	`
+	return &SQLPayloadQueries{InitQuery: initQ,
+		GetQuery:           "SELECT name, value FROM session_payload WHERE session_key = $1 AND valid_until >= $2",
+		GetValueQuery:      "SELECT value FROM session_payload WHERE session_key = $1 AND name = $2 AND valid_until >= $3",
+		SetQuery:           "INSERT INTO session_payload (session_key, name, value, valid_until) VALUES ($1, $2, $3, $4) ON CONFLICT (session_key, name) DO UPDATE SET value = EXCLUDED.value, valid_until = EXCLUDED.valid_until",
+		DeleteValueQuery:   "DELETE FROM session_payload WHERE session_key = $1 AND name = $2",
+		DeleteQuery:        "DELETE FROM session_payload WHERE session_key = $1",
+		DeleteInvalidQuery: "DELETE FROM session_payload WHERE valid_until < $1"}
+}
+
+// SQLite3PayloadQueries provides queries to use with sqlite3.
+func SQLite3PayloadQueries() *SQLPayloadQueries {
+	// the MySQL queries work fine, except for the upsert
+	res := MySQLPayloadQueries()
+	res.SetQuery = "INSERT OR REPLACE INTO session_payload (session_key, name, value, valid_until) VALUES(?, ?, ?, ?)"
+	return res
+}
+
+// SQLPayloadHandler implements SessionPayloadHandler by executing the
+// queries defined in an instance of SQLPayloadQueries.
+//
+// New in version v0.7
+type SQLPayloadHandler struct {
+	*SQLPayloadQueries
+
+	// DB is the database to execute the queries on.
+	DB *sql.DB
+
+	blockDB bool
+	mutex   sync.RWMutex
+}
+
+// NewSQLPayloadHandler returns a new SQLPayloadHandler, blockDB has the
+// same meaning as in NewSQLUserHandler.
+func NewSQLPayloadHandler(queries *SQLPayloadQueries, db *sql.DB, blockDB bool) *SQLPayloadHandler {
+	return &SQLPayloadHandler{SQLPayloadQueries: queries, DB: db, blockDB: blockDB}
+}
+
+// NewMySQLPayloadHandler returns a new SQLPayloadHandler that uses MySQL.
+func NewMySQLPayloadHandler(db *sql.DB) *SQLPayloadHandler {
+	return NewSQLPayloadHandler(MySQLPayloadQueries(), db, false)
+}
+
+// NewPostgresPayloadHandler returns a new SQLPayloadHandler that uses
+// postgres.
+func NewPostgresPayloadHandler(db *sql.DB) *SQLPayloadHandler {
+	return NewSQLPayloadHandler(PostgresPayloadQueries(), db, false)
+}
+
+// NewSQLite3PayloadHandler returns a new SQLPayloadHandler that uses sqlite3.
+func NewSQLite3PayloadHandler(db *sql.DB) *SQLPayloadHandler {
+	return NewSQLPayloadHandler(SQLite3PayloadQueries(), db, true)
+}
+
+func (handler *SQLPayloadHandler) Init() error {
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	_, err := handler.DB.Exec(handler.InitQuery)
+	return err
+}
+
+func (handler *SQLPayloadHandler) GetPayload(key string) (map[string]string, error) {
+	if handler.blockDB {
+		handler.mutex.RLock()
+		defer handler.mutex.RUnlock()
+	}
+	rows, err := handler.DB.Query(handler.GetQuery, key, CurrentTime())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make(map[string]string)
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, err
+		}
+		res[name] = value
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (handler *SQLPayloadHandler) GetPayloadValue(key, name string) (string, error) {
+	if handler.blockDB {
+		handler.mutex.RLock()
+		defer handler.mutex.RUnlock()
+	}
+	var value string
+	err := handler.DB.QueryRow(handler.GetValueQuery, key, name, CurrentTime()).Scan(&value)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", ErrPayloadValueNotFound
+		}
+		return "", err
+	}
+	return value, nil
+}
+
+func (handler *SQLPayloadHandler) SetPayloadValue(key, name, value string, validUntil time.Time) error {
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	_, err := handler.DB.Exec(handler.SetQuery, key, name, value, validUntil)
+	return err
+}
+
+func (handler *SQLPayloadHandler) DeletePayloadValue(key, name string) error {
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	_, err := handler.DB.Exec(handler.DeleteValueQuery, key, name)
+	return err
+}
+
+func (handler *SQLPayloadHandler) DeletePayload(key string) error {
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	_, err := handler.DB.Exec(handler.DeleteQuery, key)
+	return err
+}
+
+func (handler *SQLPayloadHandler) DeleteInvalidPayloads() (int64, error) {
+	now := CurrentTime()
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	res, err := handler.DB.Exec(handler.DeleteInvalidQuery, now)
+	if err != nil {
+		return -1, err
+	}
+	num, err := res.RowsAffected()
+	if err != nil {
+		return -1, nil
+	}
+	return num, nil
+}
+
+// RedisPayloadHandler is a SessionPayloadHandler using redis.
+// The payload of a session is stored in a hash "spayload:<key>", each value
+// is stored in the fields "v:<name>" (the value) and "t:<name>" (the
+// validUntil time). The hash expires when the last value expires, so
+// DeleteInvalidPayloads does nothing.
+//
+// New in version v0.7
+type RedisPayloadHandler struct {
+	// Client is the client to connect to redis.
+	Client *redis.Client
+
+	// PayloadPrefix is the prefix of the payload hashes, defaults to
+	// "spayload:".
+	PayloadPrefix string
+}
+
+// NewRedisPayloadHandler returns a new RedisPayloadHandler.
+func NewRedisPayloadHandler(client *redis.Client) *RedisPayloadHandler {
+	return &RedisPayloadHandler{Client: client, PayloadPrefix: "spayload:"}
+}
+
+// Init is a NOOP for redis.
+func (handler *RedisPayloadHandler) Init() error {
+	return nil
+}
+
+func (handler *RedisPayloadHandler) GetPayload(key string) (map[string]string, error) {
+	now := CurrentTime()
+	entry, err := handler.Client.HGetAll(handler.PayloadPrefix + key).Result()
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]string)
+	for field, value := range entry {
+		if len(field) < 2 || field[:2] != "v:" {
+			continue
+		}
+		name := field[2:]
+		validUntil, err := time.Parse(RedisDateFormat, entry["t:"+name])
+		if err != nil {
+			return nil, err
+		}
+		if KeyValid(now, validUntil) {
+			res[name] = value
+		}
+	}
+	return res, nil
+}
+
+func (handler *RedisPayloadHandler) GetPayloadValue(key, name string) (string, error) {
+	entry, err := handler.Client.HMGet(handler.PayloadPrefix+key, "v:"+name, "t:"+name).Result()
+	if err != nil {
+		return "", err
+	}
+	value, ok := entry[0].(string)
+	if !ok {
+		return "", ErrPayloadValueNotFound
+	}
+	s, ok := entry[1].(string)
+	if !ok {
+		return "", ErrPayloadValueNotFound
+	}
+	validUntil, err := time.Parse(RedisDateFormat, s)
+	if err != nil {
+		return "", err
+	}
+	if KeyInvalid(CurrentTime(), validUntil) {
+		return "", ErrPayloadValueNotFound
+	}
+	return value, nil
+}
+
+func (handler *RedisPayloadHandler) SetPayloadValue(key, name, value string, validUntil time.Time) error {
+	redisKey := handler.PayloadPrefix + key
+	err := handler.Client.HMSet(redisKey, map[string]interface{}{
+		"v:" + name: value,
+		"t:" + name: validUntil.Format(RedisDateFormat),
+	}).Err()
+	if err != nil {
+		return err
+	}
+	// the hash must live as long as the longest value
+	ttl, err := handler.Client.TTL(redisKey).Result()
+	if err != nil {
+		return err
+	}
+	if ttl < 0 || CurrentTime().Add(ttl).Before(validUntil) {
+		return handler.Client.ExpireAt(redisKey, validUntil).Err()
+	}
+	return nil
+}
+
+func (handler *RedisPayloadHandler) DeletePayloadValue(key, name string) error {
+	return handler.Client.HDel(handler.PayloadPrefix+key, "v:"+name, "t:"+name).Err()
+}
+
+func (handler *RedisPayloadHandler) DeletePayload(key string) error {
+	return handler.Client.Del(handler.PayloadPrefix + key).Err()
+}
+
+func (handler *RedisPayloadHandler) DeleteInvalidPayloads() (int64, error) {
+	return 0, nil
+}
@@ -0,0 +1,392 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package goauth
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"sync"
+)
+
+// ErrInvalidPhone is returned by NormalizePhone if the value is not a valid
+// international phone number.
+//
+// New in version v0.7
+var ErrInvalidPhone = errors.New("Invalid phone number, use the international format like +4915112345678.")
+
+// ErrPhoneInUse is returned by a PhoneHandler if the phone number belongs to
+// another user.
+//
+// New in version v0.7
+var ErrPhoneInUse = errors.New("The phone number is already in use.")
+
+// ErrPhoneNotFound is returned by a PhoneHandler if there is no phone number
+// for a user or no user for a phone number.
+//
+// New in version v0.7
+var ErrPhoneNotFound = errors.New("Phone number not found.")
+
+// NormalizePhone normalizes a phone number to the E.164 format: A "+"
+// followed by up to 15 digits without separators. The number must be in the
+// international format, i.e. start with "+" or "00" and the country code.
+// Spaces, dashes, dots, slashes and parentheses are removed.
+// It returns ErrInvalidPhone if the number is invalid.
+//
+// Note that this doesn't check if the country code or the number exist.
+//
+// New in version v0.7
+func NormalizePhone(phone string) (string, error) {
+	phone = strings.TrimSpace(phone)
+	switch {
+	case strings.HasPrefix(phone, "+"):
+		phone = phone[1:]
+	case strings.HasPrefix(phone, "00"):
+		phone = phone[2:]
+	default:
+		return "", ErrInvalidPhone
+	}
+	digits := make([]byte, 0, 15)
+	for i := 0; i < len(phone); i++ {
+		c := phone[i]
+		switch {
+		case c >= '0' && c <= '9':
+			digits = append(digits, c)
+		case c == ' ' || c == '-' || c == '.' || c == '/' || c == '(' || c == ')':
+		default:
+			return "", ErrInvalidPhone
+		}
+	}
+	// country codes don't start with 0, the shortest numbers have 8 digits
+	if len(digits) < 8 || len(digits) > 15 || digits[0] == '0' {
+		return "", ErrInvalidPhone
+	}
+	return "+" + string(digits), nil
+}
+
+// PhoneHandler stores the phone numbers of users, each user has at most one
+// number and a number belongs to at most one user. It's the foundation for
+// SMS one-time passwords and login by phone number.
+// All methods normalize the number with NormalizePhone and return
+// ErrInvalidPhone for invalid numbers.
+//
+// New in version v0.7
+type PhoneHandler interface {
+	// Init initializes the storage, it must not fail if called several times.
+	Init() error
+
+	// SetPhone sets the phone number of the user, an existing number is
+	// replaced. Returns ErrPhoneInUse if the number belongs to another user.
+	SetPhone(userID uint64, phone string) error
+
+	// GetPhone returns the normalized phone number of the user or
+	// ErrPhoneNotFound.
+	GetPhone(userID uint64) (string, error)
+
+	// GetUserByPhone returns the id of the user with the phone number or
+	// NoUserID and ErrPhoneNotFound.
+	GetUserByPhone(phone string) (uint64, error)
+
+	// DeletePhone removes the phone number of the user, it does nothing if
+	// the user has no number.
+	DeletePhone(userID uint64) error
+}
+
+// GetUserInfoByPhone returns the information of the user with the phone
+// number.
+//
+// New in version v0.7
+func GetUserInfoByPhone(users UserHandler, phones PhoneHandler, phone string) (*BaseUserInformation, error) {
+	id, err := phones.GetUserByPhone(phone)
+	if err != nil {
+		return nil, err
+	}
+	userName, err := users.GetUserName(id)
+	if err != nil {
+		return nil, err
+	}
+	return users.GetUserBaseInfo(userName)
+}
+
+// InMemoryPhoneHandler is a PhoneHandler that keeps all numbers in memory.
+//
+// New in version v0.7
+type InMemoryPhoneHandler struct {
+	phones map[uint64]string
+	users  map[string]uint64
+	mutex  sync.RWMutex
+}
+
+// NewInMemoryPhoneHandler returns a new InMemoryPhoneHandler.
+//
+// New in version v0.7
+func NewInMemoryPhoneHandler() *InMemoryPhoneHandler {
+	return &InMemoryPhoneHandler{phones: make(map[uint64]string), users: make(map[string]uint64)}
+}
+
+func (h *InMemoryPhoneHandler) Init() error {
+	return nil
+}
+
+func (h *InMemoryPhoneHandler) SetPhone(userID uint64, phone string) error {
+	phone, err := NormalizePhone(phone)
+	if err != nil {
+		return err
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if owner, has := h.users[phone]; has && owner != userID {
+		return ErrPhoneInUse
+	}
+	if old, has := h.phones[userID]; has {
+		delete(h.users, old)
+	}
+	h.phones[userID] = phone
+	h.users[phone] = userID
+	return nil
+}
+
+func (h *InMemoryPhoneHandler) GetPhone(userID uint64) (string, error) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	if phone, has := h.phones[userID]; has {
+		return phone, nil
+	}
+	return "", ErrPhoneNotFound
+}
+
+func (h *InMemoryPhoneHandler) GetUserByPhone(phone string) (uint64, error) {
+	phone, err := NormalizePhone(phone)
+	if err != nil {
+		return NoUserID, err
+	}
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	if id, has := h.users[phone]; has {
+		return id, nil
+	}
+	return NoUserID, ErrPhoneNotFound
+}
+
+func (h *InMemoryPhoneHandler) DeletePhone(userID uint64) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if phone, has := h.phones[userID]; has {
+		delete(h.users, phone)
+		delete(h.phones, userID)
+	}
+	return nil
+}
+
+// SQLPhoneQueries stores the queries used by SQLPhoneHandler.
+// The default scheme looks as follows (in MySQL syntax):
+//
+//	CREATE TABLE IF NOT EXISTS user_phones (
+//		user_id BIGINT UNSIGNED NOT NULL,
+//		phone VARCHAR(16) NOT NULL,
+//		PRIMARY KEY(user_id),
+//		UNIQUE(phone)
+//	);
+//
+// New in version v0.7
+type SQLPhoneQueries struct {
+	// InitQuery creates the user_phones table if it doesn't exist.
+	InitQuery string
+
+	// InsertQuery inserts user_id and phone, DeleteQuery deletes the
+	// number given the user_id.
+	InsertQuery, DeleteQuery string
+
+	// GetPhoneQuery selects the phone given the user_id, GetUserQuery
+	// selects the user_id given the phone.
+	GetPhoneQuery, GetUserQuery string
+}
+
+// MySQLPhoneQueries provides queries to use with MySQL.
+//
+// New in version v0.7
+func MySQLPhoneQueries() *SQLPhoneQueries {
+	initQ := `
+	CREATE TABLE IF NOT EXISTS user_phones (
+		user_id BIGINT UNSIGNED NOT NULL,
+		phone VARCHAR(16) NOT NULL,
+		PRIMARY KEY(user_id),
+		UNIQUE(phone)
+	);
+	`
+	return &SQLPhoneQueries{InitQuery: initQ,
+		InsertQuery:   "INSERT INTO user_phones (user_id, phone) VALUES(?, ?)",
+		DeleteQuery:   "DELETE FROM user_phones WHERE user_id=?",
+		GetPhoneQuery: "SELECT phone FROM user_phones WHERE user_id=?",
+		GetUserQuery:  "SELECT user_id FROM user_phones WHERE phone=?"}
+}
+
+// PostgresPhoneQueries provides queries to use with postgres.
+//
+// New in version v0.7
+func PostgresPhoneQueries() *SQLPhoneQueries {
+	initQ := `
+	CREATE TABLE IF NOT EXISTS user_phones (
+		user_id bigint NOT NULL,
+		phone varchar(16) NOT NULL,
+		PRIMARY KEY(user_id),
+		UNIQUE(phone)
+	);
+	`
+	return &SQLPhoneQueries{InitQuery: initQ,
+		InsertQuery:   "INSERT INTO user_phones (user_id, phone) VALUES ($1, $2)",
+		DeleteQuery:   "DELETE FROM user_phones WHERE user_id = $1",
+		GetPhoneQuery: "SELECT phone FROM user_phones WHERE user_id = $1",
+		GetUserQuery:  "SELECT user_id FROM user_phones WHERE phone = $1"}
+}
+
+// SQLite3PhoneQueries provides queries to use with sqlite3.
+//
+// New in version v0.7
+func SQLite3PhoneQueries() *SQLPhoneQueries {
+	// the MySQL queries work fine
+	return MySQLPhoneQueries()
+}
+
+// SQLPhoneHandler implements PhoneHandler by executing the queries defined
+// in an instance of SQLPhoneQueries.
+//
+// New in version v0.7
+type SQLPhoneHandler struct {
+	*SQLPhoneQueries
+
+	// DB is the database to execute the queries on.
+	DB *sql.DB
+
+	blockDB bool
+	mutex   sync.RWMutex
+}
+
+// NewSQLPhoneHandler returns a new SQLPhoneHandler, blockDB has the same
+// meaning as in NewSQLUserHandler.
+//
+// New in version v0.7
+func NewSQLPhoneHandler(queries *SQLPhoneQueries, db *sql.DB, blockDB bool) *SQLPhoneHandler {
+	return &SQLPhoneHandler{SQLPhoneQueries: queries, DB: db, blockDB: blockDB}
+}
+
+// NewMySQLPhoneHandler returns a new SQLPhoneHandler that uses MySQL.
+//
+// New in version v0.7
+func NewMySQLPhoneHandler(db *sql.DB) *SQLPhoneHandler {
+	return NewSQLPhoneHandler(MySQLPhoneQueries(), db, false)
+}
+
+// NewPostgresPhoneHandler returns a new SQLPhoneHandler that uses postgres.
+//
+// New in version v0.7
+func NewPostgresPhoneHandler(db *sql.DB) *SQLPhoneHandler {
+	return NewSQLPhoneHandler(PostgresPhoneQueries(), db, false)
+}
+
+// NewSQLite3PhoneHandler returns a new SQLPhoneHandler that uses sqlite3.
+//
+// New in version v0.7
+func NewSQLite3PhoneHandler(db *sql.DB) *SQLPhoneHandler {
+	return NewSQLPhoneHandler(SQLite3PhoneQueries(), db, true)
+}
+
+func (handler *SQLPhoneHandler) Init() error {
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	_, err := handler.DB.Exec(handler.InitQuery)
+	return err
+}
+
+// SetPhone replaces the number in a transaction, the unique constraint on
+// phone makes sure a number belongs to only one user.
+func (handler *SQLPhoneHandler) SetPhone(userID uint64, phone string) error {
+	phone, err := NormalizePhone(phone)
+	if err != nil {
+		return err
+	}
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	tx, err := handler.DB.Begin()
+	if err != nil {
+		return wrapBackendError("sql", "SetPhone", err)
+	}
+	if _, err := tx.Exec(handler.DeleteQuery, userID); err != nil {
+		tx.Rollback()
+		return wrapBackendError("sql", "SetPhone", err)
+	}
+	if _, err := tx.Exec(handler.InsertQuery, userID, phone); err != nil {
+		tx.Rollback()
+		if IsDuplicateKeyError(err) {
+			return ErrPhoneInUse
+		}
+		return wrapBackendError("sql", "SetPhone", err)
+	}
+	return wrapBackendError("sql", "SetPhone", tx.Commit())
+}
+
+func (handler *SQLPhoneHandler) GetPhone(userID uint64) (string, error) {
+	if handler.blockDB {
+		handler.mutex.RLock()
+		defer handler.mutex.RUnlock()
+	}
+	var phone string
+	if err := handler.DB.QueryRow(handler.GetPhoneQuery, userID).Scan(&phone); err != nil {
+		if err == sql.ErrNoRows {
+			return "", ErrPhoneNotFound
+		}
+		return "", wrapBackendError("sql", "GetPhone", err)
+	}
+	return phone, nil
+}
+
+func (handler *SQLPhoneHandler) GetUserByPhone(phone string) (uint64, error) {
+	phone, err := NormalizePhone(phone)
+	if err != nil {
+		return NoUserID, err
+	}
+	if handler.blockDB {
+		handler.mutex.RLock()
+		defer handler.mutex.RUnlock()
+	}
+	var id uint64
+	if err := handler.DB.QueryRow(handler.GetUserQuery, phone).Scan(&id); err != nil {
+		if err == sql.ErrNoRows {
+			return NoUserID, ErrPhoneNotFound
+		}
+		return NoUserID, wrapBackendError("sql", "GetUserByPhone", err)
+	}
+	return id, nil
+}
+
+func (handler *SQLPhoneHandler) DeletePhone(userID uint64) error {
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	_, err := handler.DB.Exec(handler.DeleteQuery, userID)
+	return wrapBackendError("sql", "DeletePhone", err)
+}
@@ -0,0 +1,483 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrUnknownKeyVersion is returned by a KeyProvider if there is no key with
+// the requested version.
+var ErrUnknownKeyVersion = errors.New("Unknown encryption key version.")
+
+// ErrInvalidCiphertext is returned if an encrypted field can't be decoded.
+var ErrInvalidCiphertext = errors.New("Invalid encrypted value.")
+
+// encryptedFieldPrefix is the prefix of all encrypted values, values without
+// this prefix are considered to be plaintext (for example entries that were
+// stored before encryption was enabled).
+const encryptedFieldPrefix = "enc:v"
+
+// KeyProvider provides the keys used to encrypt personal information.
+// Keys are versioned: new values are always encrypted with the current key,
+// the version is stored together with the ciphertext so that values
+// encrypted with an older key can still be decrypted.
+// All keys must be valid AES keys (16, 24 or 32 bytes).
+//
+// New in version v0.7
+type KeyProvider interface {
+	// CurrentKey returns the key that should be used for new values.
+	CurrentKey() (uint32, []byte, error)
+
+	// Key returns the key with the given version or ErrUnknownKeyVersion.
+	Key(version uint32) ([]byte, error)
+}
+
+// StaticKeyProvider is a KeyProvider with a fixed set of keys, for example
+// read from the environment on startup.
+//
+// New in version v0.7
+type StaticKeyProvider struct {
+	// Keys maps the version to the key.
+	Keys map[uint32][]byte
+
+	// Current is the version used for encryption.
+	Current uint32
+}
+
+// NewStaticKeyProvider returns a new StaticKeyProvider with a single key.
+// Use AddKey to add older keys.
+func NewStaticKeyProvider(version uint32, key []byte) *StaticKeyProvider {
+	return &StaticKeyProvider{Keys: map[uint32][]byte{version: key}, Current: version}
+}
+
+// AddKey adds a key with the given version.
+func (p *StaticKeyProvider) AddKey(version uint32, key []byte) {
+	p.Keys[version] = key
+}
+
+func (p *StaticKeyProvider) CurrentKey() (uint32, []byte, error) {
+	key, err := p.Key(p.Current)
+	return p.Current, key, err
+}
+
+func (p *StaticKeyProvider) Key(version uint32) ([]byte, error) {
+	if key, has := p.Keys[version]; has {
+		return key, nil
+	}
+	return nil, ErrUnknownKeyVersion
+}
+
+// VaultKeyProvider reads the keys from a HashiCorp Vault KV (version 2)
+// secret. The secret must contain one entry for each key version, the name
+// of the entry is the version and the value the base64 encoded key, for
+// example:
+//
+//	vault kv put secret/goauth/pii 1=<base64 key> 2=<base64 key>
+//
+// The key with the highest version is the current key.
+// The keys are cached for CacheDuration, key rotation works by adding a new
+// version to the secret.
+// Managed services with a compatible HTTP API (for example a KMS proxy) can
+// be used by adjusting Address and Path.
+//
+// New in version v0.7
+type VaultKeyProvider struct {
+	// Address is the address of the vault server, for example
+	// "https://vault.example.com:8200".
+	Address string
+
+	// Token is the vault token sent in the X-Vault-Token header.
+	Token string
+
+	// Path is the API path of the secret, for example
+	// "secret/data/goauth/pii".
+	Path string
+
+	// Client is the client used for requests, defaults to a client with a
+	// timeout of ten seconds.
+	Client *http.Client
+
+	// CacheDuration is the time the keys are cached, defaults to five
+	// minutes.
+	CacheDuration time.Duration
+
+	mutex     sync.Mutex
+	keys      map[uint32][]byte
+	current   uint32
+	fetchedAt time.Time
+}
+
+// NewVaultKeyProvider returns a new VaultKeyProvider.
+func NewVaultKeyProvider(address, token, path string) *VaultKeyProvider {
+	return &VaultKeyProvider{Address: strings.TrimRight(address, "/"), Token: token,
+		Path: strings.Trim(path, "/"), Client: &http.Client{Timeout: 10 * time.Second},
+		CacheDuration: 5 * time.Minute}
+}
+
+// Refresh reloads the keys from vault.
+func (p *VaultKeyProvider) Refresh() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.fetch()
+}
+
+func (p *VaultKeyProvider) fetch() error {
+	keys, current, err := readVaultVersions(p.Client, p.Address, p.Token, p.Path)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return errors.New("No encryption keys found in vault secret.")
+	}
+	p.keys, p.current, p.fetchedAt = keys, current, time.Now()
+	return nil
+}
+
+// readVaultVersions reads a KV (version 2) secret that maps versions to base64
+// encoded values, see VaultKeyProvider. It returns all values and the
+// highest version, entries that are not a version are ignored.
+func readVaultVersions(client *http.Client, address, token, path string) (map[uint32][]byte, uint32, error) {
+	req, err := http.NewRequest(http.MethodGet, address+"/v1/"+path, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, wrapBackendError("vault", "Key", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		io.Copy(io.Discard, resp.Body)
+		return nil, 0, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return nil, 0, fmt.Errorf("goauth: vault returned status %d", resp.StatusCode)
+	}
+	var secret struct {
+		Data struct {
+			Data map[string]string `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return nil, 0, err
+	}
+	values := make(map[uint32][]byte, len(secret.Data.Data))
+	var current uint32
+	for name, encoded := range secret.Data.Data {
+		version, parseErr := strconv.ParseUint(name, 10, 32)
+		if parseErr != nil {
+			continue
+		}
+		value, decodeErr := base64.StdEncoding.DecodeString(encoded)
+		if decodeErr != nil {
+			return nil, 0, fmt.Errorf("goauth: invalid key version %d in vault: %w", version, decodeErr)
+		}
+		values[uint32(version)] = value
+		if uint32(version) > current {
+			current = uint32(version)
+		}
+	}
+	return values, current, nil
+}
+
+func (p *VaultKeyProvider) load() error {
+	if p.keys != nil && time.Since(p.fetchedAt) < p.CacheDuration {
+		return nil
+	}
+	return p.fetch()
+}
+
+func (p *VaultKeyProvider) CurrentKey() (uint32, []byte, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if err := p.load(); err != nil {
+		return 0, nil, err
+	}
+	return p.current, p.keys[p.current], nil
+}
+
+func (p *VaultKeyProvider) Key(version uint32) ([]byte, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if err := p.load(); err != nil {
+		return nil, err
+	}
+	key, has := p.keys[version]
+	if !has {
+		// maybe the key was added after the last fetch
+		if err := p.fetch(); err != nil {
+			return nil, err
+		}
+		if key, has = p.keys[version]; !has {
+			return nil, ErrUnknownKeyVersion
+		}
+	}
+	return key, nil
+}
+
+// FieldEncryptor encrypts single fields (email, first and last name) of
+// users with AES-GCM.
+// Encrypted values have the form "enc:v<version>:<base64 nonce + ciphertext>",
+// the name of the field is used as additional data so that encrypted values
+// can't be swapped between fields.
+// Values without this prefix are returned unchanged by Decrypt, so
+// encryption can be enabled for an existing database, use the ReencryptPII
+// method of the user handlers to encrypt the existing entries.
+//
+// Note that encrypted values are considerably longer than the plaintext, the
+// columns of the default SQL scheme (VARCHAR(30) for the names) must be
+// enlarged, for example to VARCHAR(255) for the names and VARCHAR(512) for
+// the email.
+//
+// New in version v0.7
+type FieldEncryptor struct {
+	Keys KeyProvider
+}
+
+// NewFieldEncryptor returns a new FieldEncryptor.
+func NewFieldEncryptor(keys KeyProvider) *FieldEncryptor {
+	return &FieldEncryptor{Keys: keys}
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypt encrypts the value of the field with the current key.
+// Empty values are not encrypted.
+func (e *FieldEncryptor) Encrypt(field, value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	version, key, err := e.Keys.CurrentKey()
+	if err != nil {
+		return "", err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(value), []byte(field))
+	return fmt.Sprintf("%s%d:%s", encryptedFieldPrefix, version,
+		base64.RawURLEncoding.EncodeToString(sealed)), nil
+}
+
+// parse splits an encrypted value in the version and the sealed data.
+func (e *FieldEncryptor) parse(value string) (uint32, []byte, error) {
+	rest := strings.TrimPrefix(value, encryptedFieldPrefix)
+	sep := strings.IndexByte(rest, ':')
+	if sep < 0 {
+		return 0, nil, ErrInvalidCiphertext
+	}
+	version, err := strconv.ParseUint(rest[:sep], 10, 32)
+	if err != nil {
+		return 0, nil, ErrInvalidCiphertext
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(rest[sep+1:])
+	if err != nil {
+		return 0, nil, ErrInvalidCiphertext
+	}
+	return uint32(version), sealed, nil
+}
+
+// IsEncrypted reports whether the value was encrypted by a FieldEncryptor.
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, encryptedFieldPrefix)
+}
+
+// Decrypt decrypts a value encrypted by Encrypt, plaintext values are
+// returned unchanged.
+func (e *FieldEncryptor) Decrypt(field, value string) (string, error) {
+	if !IsEncrypted(value) {
+		return value, nil
+	}
+	version, sealed, err := e.parse(value)
+	if err != nil {
+		return "", err
+	}
+	key, err := e.Keys.Key(version)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", ErrInvalidCiphertext
+	}
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(field))
+	if err != nil {
+		return "", ErrInvalidCiphertext
+	}
+	return string(plain), nil
+}
+
+// NeedsReencryption reports whether the value is not encrypted with the
+// current key (this includes plaintext values).
+func (e *FieldEncryptor) NeedsReencryption(value string) (bool, error) {
+	if value == "" {
+		return false, nil
+	}
+	if !IsEncrypted(value) {
+		return true, nil
+	}
+	current, _, err := e.Keys.CurrentKey()
+	if err != nil {
+		return false, err
+	}
+	version, _, err := e.parse(value)
+	if err != nil {
+		return false, err
+	}
+	return version != current, nil
+}
+
+// Reencrypt decrypts the value and encrypts it with the current key, changed
+// is false if the value was already encrypted with the current key.
+func (e *FieldEncryptor) Reencrypt(field, value string) (string, bool, error) {
+	needed, err := e.NeedsReencryption(value)
+	if err != nil || !needed {
+		return value, false, err
+	}
+	plain, err := e.Decrypt(field, value)
+	if err != nil {
+		return value, false, err
+	}
+	res, err := e.Encrypt(field, plain)
+	return res, err == nil, err
+}
+
+// Names of the encrypted fields, used as additional data.
+const (
+	piiFieldFirstName = "first_name"
+	piiFieldLastName  = "last_name"
+	piiFieldEmail     = "email"
+)
+
+// encryptEmail encrypts an email address, if e is nil the value is
+// returned unchanged.
+func (e *FieldEncryptor) encryptEmail(email string) (string, error) {
+	if e == nil {
+		return email, nil
+	}
+	return e.Encrypt(piiFieldEmail, email)
+}
+
+// encryptUser encrypts the personal information of a user, if e is nil the
+// values are returned unchanged.
+func (e *FieldEncryptor) encryptUser(firstName, lastName, email string) (string, string, string, error) {
+	if e == nil {
+		return firstName, lastName, email, nil
+	}
+	var err error
+	if firstName, err = e.Encrypt(piiFieldFirstName, firstName); err != nil {
+		return "", "", "", err
+	}
+	if lastName, err = e.Encrypt(piiFieldLastName, lastName); err != nil {
+		return "", "", "", err
+	}
+	if email, err = e.Encrypt(piiFieldEmail, email); err != nil {
+		return "", "", "", err
+	}
+	return firstName, lastName, email, nil
+}
+
+// decryptUser decrypts the personal information in info, if e is nil
+// nothing happens.
+func (e *FieldEncryptor) decryptUser(info *BaseUserInformation) error {
+	if e == nil {
+		return nil
+	}
+	var err error
+	if info.FirstName, err = e.Decrypt(piiFieldFirstName, info.FirstName); err != nil {
+		return err
+	}
+	if info.LastName, err = e.Decrypt(piiFieldLastName, info.LastName); err != nil {
+		return err
+	}
+	info.Email, err = e.Decrypt(piiFieldEmail, info.Email)
+	return err
+}
+
+// reencryptUser re-encrypts the personal information of a user, changed is
+// true if at least one value was re-encrypted.
+func (e *FieldEncryptor) reencryptUser(firstName, lastName, email string) (string, string, string, bool, error) {
+	var c1, c2, c3 bool
+	var err error
+	if firstName, c1, err = e.Reencrypt(piiFieldFirstName, firstName); err != nil {
+		return "", "", "", false, err
+	}
+	if lastName, c2, err = e.Reencrypt(piiFieldLastName, lastName); err != nil {
+		return "", "", "", false, err
+	}
+	if email, c3, err = e.Reencrypt(piiFieldEmail, email); err != nil {
+		return "", "", "", false, err
+	}
+	return firstName, lastName, email, c1 || c2 || c3, nil
+}
+
+// PIIReencrypter is implemented by user handlers that support field
+// encryption. ReencryptPII encrypts all plaintext values and values
+// encrypted with an old key with the current key and returns the number of
+// updated users. Run it after enabling encryption or rotating the key.
+// SQLUserHandler and RedisUserHandler implement this interface.
+//
+// New in version v0.7
+type PIIReencrypter interface {
+	ReencryptPII() (int, error)
+}
+
+// ReencryptUsers runs ReencryptPII if the handler implements PIIReencrypter
+// and returns ErrNotSupported otherwise.
+//
+// New in version v0.7
+func ReencryptUsers(users UserHandler) (int, error) {
+	if r, ok := users.(PIIReencrypter); ok {
+		return r.ReencryptPII()
+	}
+	return 0, ErrNotSupported
+}
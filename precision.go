@@ -0,0 +1,141 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package goauth
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The default schemas store times with a precision of seconds, this is not
+// enough for short-lived tokens or to order events that happen within the
+// same second. The precise variants in this file store microseconds in
+// MySQL and nanoseconds in redis.
+// Postgres (TIMESTAMP) and sqlite3 (the driver stores a string with
+// nanoseconds) are already precise.
+
+// preciseMySQLDateFormat is the format of DATETIME(6) values.
+const preciseMySQLDateFormat = "2006-01-02 15:04:05.999999"
+
+// redisDateFormat returns format or RedisDateFormat if format is empty.
+func redisDateFormat(format string) string {
+	if format == "" {
+		return RedisDateFormat
+	}
+	return format
+}
+
+// parseRedisTime parses a time stored in RedisDateFormat (with optional
+// fractional seconds) or time.RFC3339Nano.
+func parseRedisTime(s string) (time.Time, error) {
+	res, err := time.Parse(RedisDateFormat, s)
+	if err == nil {
+		return res, nil
+	}
+	if res, rfcErr := time.Parse(time.RFC3339Nano, s); rfcErr == nil {
+		return res, nil
+	}
+	return time.Time{}, err
+}
+
+// PreciseTimeFromScanType is a TimeFromScanType that keeps fractional
+// seconds. Besides time.Time it accepts []byte and string values in the
+// format "2006-01-02 15:04:05.999999" (fractional seconds are optional) and
+// time.RFC3339Nano.
+//
+// New in version v0.7
+func PreciseTimeFromScanType(val interface{}) (time.Time, error) {
+	var s string
+	switch v := val.(type) {
+	case time.Time:
+		return v, nil
+	case []byte:
+		s = string(v)
+	case string:
+		s = v
+	default:
+		return time.Time{}, fmt.Errorf("Invalid date type %T in database", val)
+	}
+	if res, err := time.Parse(preciseMySQLDateFormat, s); err == nil {
+		return res, nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+// MySQLPreciseSessionTemplate is a MySQLSessionTemplate that stores the
+// times as DATETIME(6), i.e. with microseconds.
+// Use MySQLPreciseTimesMigration to change an existing table.
+//
+// New in version v0.7
+type MySQLPreciseSessionTemplate struct {
+	MySQLSessionTemplate
+}
+
+// NewMySQLPreciseSessionHandler returns a new SQLSessionHandler that uses
+// MySQLPreciseSessionTemplate.
+//
+// New in version v0.7
+func NewMySQLPreciseSessionHandler(db *sql.DB, tableName, userIDType string) *SQLSessionHandler {
+	return NewSQLSessionHandler(db, MySQLPreciseSessionTemplate{}, tableName, userIDType, false)
+}
+
+func (t MySQLPreciseSessionTemplate) InitQ() string {
+	return `CREATE TABLE IF NOT EXISTS %s (
+		user_id %s,
+		session_key CHAR(%d) NOT NULL,
+		created DATETIME(6) NOT NULL,
+		valid_until DATETIME(6) NOT NULL,
+		PRIMARY KEY (session_key)
+	);`
+}
+
+func (t MySQLPreciseSessionTemplate) TimeFromScanType(val interface{}) (time.Time, error) {
+	return PreciseTimeFromScanType(val)
+}
+
+// MySQLPreciseUserQueries returns MySQLUserQueries that store last_login as
+// DATETIME(6).
+//
+// New in version v0.7
+func MySQLPreciseUserQueries(pwLength int) *SQLUserQueries {
+	res := MySQLUserQueries(pwLength)
+	res.InitQuery = strings.Replace(res.InitQuery, "last_login DATETIME,", "last_login DATETIME(6),", 1)
+	res.TimeFromScanType = PreciseTimeFromScanType
+	return res
+}
+
+// MySQLPreciseTimesMigration returns a migration that changes the time
+// columns of the users table and the session table to DATETIME(6).
+//
+// New in version v0.7
+func MySQLPreciseTimesMigration(version int, sessionTable string) Migration {
+	if sessionTable == "" {
+		sessionTable = "user_sessions"
+	}
+	return Migration{Version: version, Description: "store times with microseconds",
+		Statements: []string{
+			"ALTER TABLE users MODIFY last_login DATETIME(6);",
+			fmt.Sprintf("ALTER TABLE %s MODIFY created DATETIME(6) NOT NULL, MODIFY valid_until DATETIME(6) NOT NULL;", sessionTable),
+		}}
+}
@@ -0,0 +1,506 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package goauth
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/go-redis/redis"
+)
+
+// ErrPreferenceNotFound is returned by a PreferenceHandler if the user has no
+// preference with the given name.
+//
+// New in version v0.7
+var ErrPreferenceNotFound = errors.New("No preference with this name found for the user.")
+
+// ErrInvalidPreferenceName is returned by a PreferenceHandler if the name of
+// a preference is empty or longer than MaxPreferenceNameLength.
+//
+// New in version v0.7
+var ErrInvalidPreferenceName = errors.New("Invalid preference name.")
+
+// MaxPreferenceNameLength is the maximal length of the name of a preference.
+//
+// New in version v0.7
+const MaxPreferenceNameLength = 100
+
+// CheckPreferenceName returns ErrInvalidPreferenceName if the name can't be
+// used for a preference.
+//
+// New in version v0.7
+func CheckPreferenceName(name string) error {
+	if name == "" || len(name) > MaxPreferenceNameLength {
+		return ErrInvalidPreferenceName
+	}
+	return nil
+}
+
+// PreferenceHandler stores simple per-user settings as string values, for
+// example the theme or whether the user wants to receive newsletters.
+// Use the typed accessors like PreferenceBool and SetPreferenceJSON for other
+// types.
+//
+// New in version v0.7
+type PreferenceHandler interface {
+	// Init initializes the storage, it must not fail if called several
+	// times.
+	Init() error
+
+	// GetPreference returns the value stored under name for the user.
+	// Returns "" and ErrPreferenceNotFound if there is no such value.
+	GetPreference(userID uint64, name string) (string, error)
+
+	// GetPreferences returns all values of the user, an empty map if there
+	// are none.
+	GetPreferences(userID uint64) (map[string]string, error)
+
+	// SetPreference sets the value stored under name for the user, an
+	// existing value is replaced.
+	SetPreference(userID uint64, name, value string) error
+
+	// DeletePreference removes the value stored under name for the user, it
+	// does nothing if there is no such value.
+	DeletePreference(userID uint64, name string) error
+
+	// DeletePreferences removes all values of the user, call it when a user
+	// gets deleted.
+	DeletePreferences(userID uint64) error
+}
+
+// PreferenceString returns the value stored under name for the user or def
+// if there is no such value.
+//
+// New in version v0.7
+func PreferenceString(h PreferenceHandler, userID uint64, name, def string) (string, error) {
+	value, err := h.GetPreference(userID, name)
+	if err == ErrPreferenceNotFound {
+		return def, nil
+	}
+	return value, err
+}
+
+// PreferenceBool returns the value stored under name for the user parsed as
+// bool or def if there is no such value.
+//
+// New in version v0.7
+func PreferenceBool(h PreferenceHandler, userID uint64, name string, def bool) (bool, error) {
+	value, err := h.GetPreference(userID, name)
+	if err == ErrPreferenceNotFound {
+		return def, nil
+	}
+	if err != nil {
+		return def, err
+	}
+	res, err := strconv.ParseBool(value)
+	if err != nil {
+		return def, fmt.Errorf("Preference %s is not a bool: %w", name, err)
+	}
+	return res, nil
+}
+
+// SetPreferenceBool stores a bool value under name for the user.
+//
+// New in version v0.7
+func SetPreferenceBool(h PreferenceHandler, userID uint64, name string, value bool) error {
+	return h.SetPreference(userID, name, strconv.FormatBool(value))
+}
+
+// PreferenceInt returns the value stored under name for the user parsed as
+// int64 or def if there is no such value.
+//
+// New in version v0.7
+func PreferenceInt(h PreferenceHandler, userID uint64, name string, def int64) (int64, error) {
+	value, err := h.GetPreference(userID, name)
+	if err == ErrPreferenceNotFound {
+		return def, nil
+	}
+	if err != nil {
+		return def, err
+	}
+	res, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return def, fmt.Errorf("Preference %s is not an int: %w", name, err)
+	}
+	return res, nil
+}
+
+// SetPreferenceInt stores an int64 value under name for the user.
+//
+// New in version v0.7
+func SetPreferenceInt(h PreferenceHandler, userID uint64, name string, value int64) error {
+	return h.SetPreference(userID, name, strconv.FormatInt(value, 10))
+}
+
+// PreferenceJSON decodes the value stored under name for the user into v.
+// It returns false (and leaves v unchanged) if there is no such value.
+//
+// New in version v0.7
+func PreferenceJSON(h PreferenceHandler, userID uint64, name string, v interface{}) (bool, error) {
+	value, err := h.GetPreference(userID, name)
+	if err == ErrPreferenceNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal([]byte(value), v); err != nil {
+		return false, fmt.Errorf("Preference %s is not valid JSON: %w", name, err)
+	}
+	return true, nil
+}
+
+// SetPreferenceJSON stores v encoded as JSON under name for the user.
+//
+// New in version v0.7
+func SetPreferenceJSON(h PreferenceHandler, userID uint64, name string, v interface{}) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return h.SetPreference(userID, name, string(value))
+}
+
+// InMemoryPreferenceHandler is a PreferenceHandler that keeps all values in
+// memory.
+//
+// New in version v0.7
+type InMemoryPreferenceHandler struct {
+	preferences map[uint64]map[string]string
+	mutex       sync.RWMutex
+}
+
+// NewInMemoryPreferenceHandler returns a new InMemoryPreferenceHandler.
+//
+// New in version v0.7
+func NewInMemoryPreferenceHandler() *InMemoryPreferenceHandler {
+	return &InMemoryPreferenceHandler{preferences: make(map[uint64]map[string]string)}
+}
+
+func (h *InMemoryPreferenceHandler) Init() error {
+	return nil
+}
+
+func (h *InMemoryPreferenceHandler) GetPreference(userID uint64, name string) (string, error) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	value, has := h.preferences[userID][name]
+	if !has {
+		return "", ErrPreferenceNotFound
+	}
+	return value, nil
+}
+
+func (h *InMemoryPreferenceHandler) GetPreferences(userID uint64) (map[string]string, error) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	res := make(map[string]string, len(h.preferences[userID]))
+	for name, value := range h.preferences[userID] {
+		res[name] = value
+	}
+	return res, nil
+}
+
+func (h *InMemoryPreferenceHandler) SetPreference(userID uint64, name, value string) error {
+	if err := CheckPreferenceName(name); err != nil {
+		return err
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	preferences, has := h.preferences[userID]
+	if !has {
+		preferences = make(map[string]string)
+		h.preferences[userID] = preferences
+	}
+	preferences[name] = value
+	return nil
+}
+
+func (h *InMemoryPreferenceHandler) DeletePreference(userID uint64, name string) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if preferences, has := h.preferences[userID]; has {
+		delete(preferences, name)
+		if len(preferences) == 0 {
+			delete(h.preferences, userID)
+		}
+	}
+	return nil
+}
+
+func (h *InMemoryPreferenceHandler) DeletePreferences(userID uint64) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	delete(h.preferences, userID)
+	return nil
+}
+
+// SQLPreferenceQueries stores the queries used by SQLPreferenceHandler, the
+// values are stored in the table user_preferences.
+//
+// New in version v0.7
+type SQLPreferenceQueries struct {
+	InitQuery, GetQuery, GetAllQuery, SetQuery, DeleteQuery,
+	DeleteAllQuery string
+}
+
+// MySQLPreferenceQueries provides queries to use with MySQL.
+//
+// New in version v0.7
+func MySQLPreferenceQueries() *SQLPreferenceQueries {
+	initQ := `
+	CREATE TABLE IF NOT EXISTS user_preferences (
+		user_id BIGINT UNSIGNED NOT NULL,
+		name VARCHAR(100) NOT NULL,
+		value TEXT NOT NULL,
+		PRIMARY KEY(user_id, name)
+	);
+	`
+	return &SQLPreferenceQueries{InitQuery: initQ,
+		GetQuery:       "SELECT value FROM user_preferences WHERE user_id=? AND name=?",
+		GetAllQuery:    "SELECT name, value FROM user_preferences WHERE user_id=?",
+		SetQuery:       "INSERT INTO user_preferences (user_id, name, value) VALUES(?, ?, ?) ON DUPLICATE KEY UPDATE value=VALUES(value)",
+		DeleteQuery:    "DELETE FROM user_preferences WHERE user_id=? AND name=?",
+		DeleteAllQuery: "DELETE FROM user_preferences WHERE user_id=?"}
+}
+
+// PostgresPreferenceQueries provides queries to use with postgres.
+//
+// New in version v0.7
+func PostgresPreferenceQueries() *SQLPreferenceQueries {
+	initQ := `
+	CREATE TABLE IF NOT EXISTS user_preferences (
+		user_id bigint NOT NULL,
+		name varchar(100) NOT NULL,
+		value text NOT NULL,
+		PRIMARY KEY(user_id, name)
+	);
+	`
+	return &SQLPreferenceQueries{InitQuery: initQ,
+		GetQuery:       "SELECT value FROM user_preferences WHERE user_id = $1 AND name = $2",
+		GetAllQuery:    "SELECT name, value FROM user_preferences WHERE user_id = $1",
+		SetQuery:       "INSERT INTO user_preferences (user_id, name, value) VALUES ($1, $2, $3) ON CONFLICT (user_id, name) DO UPDATE SET value = EXCLUDED.value",
+		DeleteQuery:    "DELETE FROM user_preferences WHERE user_id = $1 AND name = $2",
+		DeleteAllQuery: "DELETE FROM user_preferences WHERE user_id = $1"}
+}
+
+// SQLite3PreferenceQueries provides queries to use with sqlite3.
+//
+// New in version v0.7
+func SQLite3PreferenceQueries() *SQLPreferenceQueries {
+	// the MySQL queries work fine, except for the upsert
+	res := MySQLPreferenceQueries()
+	res.SetQuery = "INSERT OR REPLACE INTO user_preferences (user_id, name, value) VALUES(?, ?, ?)"
+	return res
+}
+
+// SQLPreferenceHandler implements PreferenceHandler by executing the queries
+// defined in an instance of SQLPreferenceQueries.
+//
+// New in version v0.7
+type SQLPreferenceHandler struct {
+	*SQLPreferenceQueries
+
+	// DB is the database to execute the queries on.
+	DB *sql.DB
+
+	blockDB bool
+	mutex   sync.RWMutex
+}
+
+// NewSQLPreferenceHandler returns a new SQLPreferenceHandler, blockDB has
+// the same meaning as in NewSQLUserHandler.
+//
+// New in version v0.7
+func NewSQLPreferenceHandler(queries *SQLPreferenceQueries, db *sql.DB, blockDB bool) *SQLPreferenceHandler {
+	return &SQLPreferenceHandler{SQLPreferenceQueries: queries, DB: db, blockDB: blockDB}
+}
+
+// NewMySQLPreferenceHandler returns a new SQLPreferenceHandler that uses
+// MySQL.
+//
+// New in version v0.7
+func NewMySQLPreferenceHandler(db *sql.DB) *SQLPreferenceHandler {
+	return NewSQLPreferenceHandler(MySQLPreferenceQueries(), db, false)
+}
+
+// NewPostgresPreferenceHandler returns a new SQLPreferenceHandler that uses
+// postgres.
+//
+// New in version v0.7
+func NewPostgresPreferenceHandler(db *sql.DB) *SQLPreferenceHandler {
+	return NewSQLPreferenceHandler(PostgresPreferenceQueries(), db, false)
+}
+
+// NewSQLite3PreferenceHandler returns a new SQLPreferenceHandler that uses
+// sqlite3.
+//
+// New in version v0.7
+func NewSQLite3PreferenceHandler(db *sql.DB) *SQLPreferenceHandler {
+	return NewSQLPreferenceHandler(SQLite3PreferenceQueries(), db, true)
+}
+
+func (handler *SQLPreferenceHandler) Init() error {
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	_, err := handler.DB.Exec(handler.InitQuery)
+	return err
+}
+
+func (handler *SQLPreferenceHandler) GetPreference(userID uint64, name string) (string, error) {
+	if handler.blockDB {
+		handler.mutex.RLock()
+		defer handler.mutex.RUnlock()
+	}
+	var value string
+	if err := handler.DB.QueryRow(handler.GetQuery, userID, name).Scan(&value); err != nil {
+		if err == sql.ErrNoRows {
+			return "", ErrPreferenceNotFound
+		}
+		return "", wrapBackendError("sql", "GetPreference", err)
+	}
+	return value, nil
+}
+
+func (handler *SQLPreferenceHandler) GetPreferences(userID uint64) (map[string]string, error) {
+	if handler.blockDB {
+		handler.mutex.RLock()
+		defer handler.mutex.RUnlock()
+	}
+	rows, err := handler.DB.Query(handler.GetAllQuery, userID)
+	if err != nil {
+		return nil, wrapBackendError("sql", "GetPreferences", err)
+	}
+	defer rows.Close()
+	res := make(map[string]string)
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, wrapBackendError("sql", "GetPreferences", err)
+		}
+		res[name] = value
+	}
+	if err := rows.Err(); err != nil {
+		return nil, wrapBackendError("sql", "GetPreferences", err)
+	}
+	return res, nil
+}
+
+func (handler *SQLPreferenceHandler) SetPreference(userID uint64, name, value string) error {
+	if err := CheckPreferenceName(name); err != nil {
+		return err
+	}
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	_, err := handler.DB.Exec(handler.SetQuery, userID, name, value)
+	return wrapBackendError("sql", "SetPreference", err)
+}
+
+func (handler *SQLPreferenceHandler) DeletePreference(userID uint64, name string) error {
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	_, err := handler.DB.Exec(handler.DeleteQuery, userID, name)
+	return wrapBackendError("sql", "DeletePreference", err)
+}
+
+func (handler *SQLPreferenceHandler) DeletePreferences(userID uint64) error {
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	_, err := handler.DB.Exec(handler.DeleteAllQuery, userID)
+	return wrapBackendError("sql", "DeletePreferences", err)
+}
+
+// RedisPreferenceHandler is a PreferenceHandler using redis.
+// The preferences of a user are stored in a hash "uprefs:<user id>".
+//
+// New in version v0.7
+type RedisPreferenceHandler struct {
+	// Client is the client to connect to redis.
+	Client *redis.Client
+
+	// PreferencePrefix is the prefix of the preference hashes, defaults to
+	// "uprefs:".
+	PreferencePrefix string
+}
+
+// NewRedisPreferenceHandler returns a new RedisPreferenceHandler.
+//
+// New in version v0.7
+func NewRedisPreferenceHandler(client *redis.Client) *RedisPreferenceHandler {
+	return &RedisPreferenceHandler{Client: client, PreferencePrefix: "uprefs:"}
+}
+
+// Init is a NOOP for redis.
+func (handler *RedisPreferenceHandler) Init() error {
+	return nil
+}
+
+func (handler *RedisPreferenceHandler) key(userID uint64) string {
+	return fmt.Sprintf("%s%d", handler.PreferencePrefix, userID)
+}
+
+func (handler *RedisPreferenceHandler) GetPreference(userID uint64, name string) (string, error) {
+	value, err := handler.Client.HGet(handler.key(userID), name).Result()
+	if err == redis.Nil {
+		return "", ErrPreferenceNotFound
+	}
+	if err != nil {
+		return "", wrapBackendError("redis", "GetPreference", err)
+	}
+	return value, nil
+}
+
+func (handler *RedisPreferenceHandler) GetPreferences(userID uint64) (map[string]string, error) {
+	res, err := handler.Client.HGetAll(handler.key(userID)).Result()
+	if err != nil {
+		return nil, wrapBackendError("redis", "GetPreferences", err)
+	}
+	return res, nil
+}
+
+func (handler *RedisPreferenceHandler) SetPreference(userID uint64, name, value string) error {
+	if err := CheckPreferenceName(name); err != nil {
+		return err
+	}
+	return wrapBackendError("redis", "SetPreference", handler.Client.HSet(handler.key(userID), name, value).Err())
+}
+
+func (handler *RedisPreferenceHandler) DeletePreference(userID uint64, name string) error {
+	return wrapBackendError("redis", "DeletePreference", handler.Client.HDel(handler.key(userID), name).Err())
+}
+
+func (handler *RedisPreferenceHandler) DeletePreferences(userID uint64) error {
+	return wrapBackendError("redis", "DeletePreferences", handler.Client.Del(handler.key(userID)).Err())
+}
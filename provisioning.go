@@ -0,0 +1,187 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"errors"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrIdentityNotLinked is returned on a callback if the login at the provider
+// was successful but the external identity is not linked with any user.
+//
+// New in version v0.7
+var ErrIdentityNotLinked = errors.New("The external identity is not linked with a user.")
+
+// ExternalUserInfo contains the information about a user as returned by an
+// external identity provider.
+// Subject is the unique identifier at the provider and always set, all other
+// fields are filled if the provider reports them.
+// Claims contains all claims (or the user info JSON object for plain OAuth2
+// providers) as returned by the provider.
+//
+// New in version v0.7
+type ExternalUserInfo struct {
+	Provider, Subject                          string
+	UserName, Name, FirstName, LastName, Email string
+	EmailVerified                              bool
+	Claims                                     map[string]interface{}
+}
+
+// ClaimMapper maps the information about a user at an external identity
+// provider to the information used to create a new user.
+// Only UserName, FirstName, LastName and Email of the result are used.
+//
+// New in version v0.7
+type ClaimMapper func(info *ExternalUserInfo) (*BaseUserInformation, error)
+
+// DefaultClaimMapper is the default ClaimMapper.
+// It uses the username reported by the provider, if there is none the email
+// address and if there is no email address either "<provider>_<subject>".
+// If the provider doesn't report first and last name the full name is split
+// at the first space.
+//
+// New in version v0.7
+func DefaultClaimMapper(info *ExternalUserInfo) (*BaseUserInformation, error) {
+	userName := info.UserName
+	if userName == "" {
+		userName = info.Email
+	}
+	if userName == "" {
+		userName = info.Provider + "_" + info.Subject
+	}
+	firstName, lastName := info.FirstName, info.LastName
+	if firstName == "" && lastName == "" && info.Name != "" {
+		parts := strings.SplitN(info.Name, " ", 2)
+		firstName = parts[0]
+		if len(parts) > 1 {
+			lastName = parts[1]
+		}
+	}
+	return &BaseUserInformation{UserName: userName, FirstName: firstName,
+		LastName: lastName, Email: info.Email}, nil
+}
+
+// UserProvisioner creates users "just in time" when a user logs in with an
+// external identity that is not linked with any user yet.
+//
+// The user is created with the information returned by MapClaims and a
+// random password. If Users implements PasswordStatusHandler the password is
+// cleared afterwards, so the user can only log in with the external identity
+// (until he sets a password).
+//
+// New in version v0.7
+type UserProvisioner struct {
+	// Users is used to create the new user.
+	Users UserHandler
+
+	// Identities is used to link the new user with the external identity.
+	Identities IdentityHandler
+
+	// MapClaims maps the external information to the user information,
+	// defaults to DefaultClaimMapper.
+	MapClaims ClaimMapper
+}
+
+// NewUserProvisioner returns a new UserProvisioner using DefaultClaimMapper.
+//
+// New in version v0.7
+func NewUserProvisioner(users UserHandler, identities IdentityHandler) *UserProvisioner {
+	return &UserProvisioner{Users: users, Identities: identities,
+		MapClaims: DefaultClaimMapper}
+}
+
+// Provision creates a new user for the external identity and links the
+// identity with the new user. It returns the id of the new user.
+// It returns ErrDuplicateUsername if the mapped username is already in use,
+// existing users are never linked automatically. If the user was created
+// but clearing the password or linking the identity fails, the user is
+// deleted again.
+func (p *UserProvisioner) Provision(info *ExternalUserInfo) (uint64, error) {
+	userInfo, err := p.MapClaims(info)
+	if err != nil {
+		return NoUserID, err
+	}
+	if userInfo.UserName == "" {
+		return NoUserID, errors.New("Claim mapper returned an empty username")
+	}
+	// don't silently take over an existing account
+	if _, err := p.Users.GetUserID(userInfo.UserName); err == nil {
+		return NoUserID, ErrDuplicateUsername
+	} else if err != ErrUserNotFound {
+		return NoUserID, err
+	}
+	password, err := GenRandomBase64(-1)
+	if err != nil {
+		return NoUserID, err
+	}
+	userID, err := p.Users.Insert(userInfo.UserName, userInfo.FirstName,
+		userInfo.LastName, userInfo.Email, []byte(password))
+	if err != nil {
+		return NoUserID, err
+	}
+	if userID == NoUserID {
+		// the database doesn't support getting the id directly
+		userID, err = p.Users.GetUserID(userInfo.UserName)
+		if err != nil {
+			return NoUserID, p.rollback(userInfo.UserName, err)
+		}
+	}
+	if statusHandler, ok := p.Users.(PasswordStatusHandler); ok {
+		if err := statusHandler.ClearPassword(userInfo.UserName); err != nil {
+			return NoUserID, p.rollback(userInfo.UserName, err)
+		}
+	}
+	if err := p.Identities.AddIdentity(userID, info.Provider, info.Subject); err != nil {
+		return NoUserID, p.rollback(userInfo.UserName, err)
+	}
+	return userID, nil
+}
+
+// rollback deletes the user created by Provision and returns err, so no
+// half provisioned user (with a random password and no identity) remains.
+func (p *UserProvisioner) rollback(userName string, err error) error {
+	if delErr := p.Users.DeleteUser(userName); delErr != nil {
+		log.WithError(delErr).WithField("user", userName).Error("goauth: Can't delete user after failing to provision it")
+	}
+	return err
+}
+
+// ResolveExternalUser returns the id of the user linked with the external
+// identity. If there is no such user and provisioner is not nil a new user is
+// created, otherwise ErrIdentityNotLinked is returned.
+// It's used by the login managers of the oauth2auth and samlauth adapters.
+//
+// New in version v0.7
+func ResolveExternalUser(identities IdentityHandler, provisioner *UserProvisioner, info *ExternalUserInfo) (uint64, error) {
+	userID, err := identities.GetUserID(info.Provider, info.Subject)
+	if err == ErrIdentityNotFound {
+		if provisioner == nil {
+			return NoUserID, ErrIdentityNotLinked
+		}
+		return provisioner.Provision(info)
+	}
+	return userID, err
+}
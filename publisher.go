@@ -0,0 +1,172 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package goauth
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SecurityEventSchema and SecurityEventSchemaVersion identify the format of
+// the JSON messages written by EventPublisher, see EventEnvelope. The
+// version is incremented on incompatible changes, new fields are added
+// without a new version.
+const (
+	SecurityEventSchema        = "goauth.security_event"
+	SecurityEventSchemaVersion = 1
+)
+
+// EventEnvelope is the JSON message published for each security event.
+// Consumers should check Schema and Version before decoding Event.
+//
+// New in version v0.7
+type EventEnvelope struct {
+	Schema  string         `json:"schema"`
+	Version int            `json:"version"`
+	ID      string         `json:"id"`
+	Event   *SecurityEvent `json:"event"`
+}
+
+// EventMessage is a message for a MessageProducer.
+//
+// New in version v0.7
+type EventMessage struct {
+	// Topic is the topic (Kafka) or subject (NATS).
+	Topic string
+
+	// Key is the id of the user, so all events of a user end up in the same
+	// partition and stay ordered.
+	Key []byte
+
+	// ID is the unique id of the message, it can be used for
+	// deduplication.
+	ID string
+
+	// Value is the encoded EventEnvelope.
+	Value []byte
+}
+
+// MessageProducer publishes messages to a message queue. The adapters
+// kafkaauth and natsauth implement it.
+//
+// New in version v0.7
+type MessageProducer interface {
+	Publish(ctx context.Context, msg *EventMessage) error
+}
+
+// EventPublisher is a SecurityNotifier that publishes the events as
+// schema-versioned JSON (see EventEnvelope) with a MessageProducer, so other
+// services (fraud detection, notifications) can consume them
+// asynchronously.
+//
+// Call Start before using Notify, Publish can be used without it.
+//
+// Usage:
+//
+//	publisher := goauth.NewEventPublisher(kafkaauth.NewProducer(writer))
+//	publisher.Start(ctx, 1000)
+//	bus.SubscribeNotifier(publisher)
+//
+// New in version v0.7
+type EventPublisher struct {
+	Producer MessageProducer
+
+	// Topic is the topic of all events, defaults to "goauth.security_events".
+	Topic string
+
+	// TopicFor is used instead of Topic if it's not nil, for example to
+	// publish each type to its own topic.
+	TopicFor func(event *SecurityEvent) string
+
+	// Timeout is the timeout for each message, defaults to ten seconds.
+	Timeout time.Duration
+
+	queue chan *SecurityEvent
+}
+
+// NewEventPublisher returns a new EventPublisher.
+func NewEventPublisher(producer MessageProducer) *EventPublisher {
+	return &EventPublisher{Producer: producer, Topic: "goauth.security_events",
+		Timeout: 10 * time.Second}
+}
+
+// Message returns the message for the event.
+func (p *EventPublisher) Message(event *SecurityEvent) (*EventMessage, error) {
+	id, err := GenRandomBase64(16)
+	if err != nil {
+		return nil, err
+	}
+	value, err := json.Marshal(&EventEnvelope{Schema: SecurityEventSchema,
+		Version: SecurityEventSchemaVersion, ID: id, Event: event})
+	if err != nil {
+		return nil, err
+	}
+	topic := p.Topic
+	if p.TopicFor != nil {
+		topic = p.TopicFor(event)
+	}
+	return &EventMessage{Topic: topic, Key: []byte(strconv.FormatUint(event.UserID, 10)),
+		ID: id, Value: value}, nil
+}
+
+// Publish publishes the event, it blocks until the producer is done.
+func (p *EventPublisher) Publish(ctx context.Context, event *SecurityEvent) error {
+	msg, err := p.Message(event)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := operationContext(ctx, p.Timeout)
+	defer cancel()
+	return p.Producer.Publish(ctx, msg)
+}
+
+// Start starts a goroutine that publishes the events passed to Notify until
+// ctx is done. queueSize is the number of events that can wait.
+func (p *EventPublisher) Start(ctx context.Context, queueSize int) {
+	p.queue = make(chan *SecurityEvent, queueSize)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event := <-p.queue:
+				if err := p.Publish(ctx, event); err != nil {
+					log.WithError(err).WithField("event", event.Type).Error("goauth: Can't publish event")
+				}
+			}
+		}
+	}()
+}
+
+// Notify queues the event, if the queue is full the event is dropped (and
+// logged).
+func (p *EventPublisher) Notify(event *SecurityEvent) {
+	select {
+	case p.queue <- event:
+	default:
+		log.WithField("event", event.Type).Warn("goauth: Publisher queue full, dropping event")
+	}
+}
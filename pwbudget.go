@@ -0,0 +1,164 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// ErrVerificationBusy is returned by a BudgetedPasswordHandler if no
+// verification slot became free within the queue timeout. Login handlers
+// respond with 503 Service Unavailable.
+//
+// New in version v0.7
+var ErrVerificationBusy = errors.New("Too many password verifications in progress.")
+
+// VerificationBudget limits the number of concurrent password hash
+// computations, so a flood of login attempts can't use all CPUs of the
+// service. Calls that don't get a slot within QueueTimeout fail with
+// ErrVerificationBusy.
+//
+// New in version v0.7
+type VerificationBudget struct {
+	// QueueTimeout is the maximum time a call waits for a slot, 0 means
+	// calls fail immediately if all slots are in use.
+	QueueTimeout time.Duration
+
+	slots    chan struct{}
+	waiting  int64
+	rejected uint64
+}
+
+// NewVerificationBudget returns a budget that allows maxConcurrent hash
+// computations at the same time, runtime.NumCPU() is a good choice.
+//
+// New in version v0.7
+func NewVerificationBudget(maxConcurrent int, queueTimeout time.Duration) *VerificationBudget {
+	if maxConcurrent < 1 {
+		maxConcurrent = 1
+	}
+	return &VerificationBudget{QueueTimeout: queueTimeout,
+		slots: make(chan struct{}, maxConcurrent)}
+}
+
+// Acquire waits for a free slot, it returns ErrVerificationBusy if no slot
+// became free within QueueTimeout. Call Release after the computation.
+func (b *VerificationBudget) Acquire() error {
+	select {
+	case b.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	if b.QueueTimeout <= 0 {
+		atomic.AddUint64(&b.rejected, 1)
+		return ErrVerificationBusy
+	}
+	atomic.AddInt64(&b.waiting, 1)
+	defer atomic.AddInt64(&b.waiting, -1)
+	timer := time.NewTimer(b.QueueTimeout)
+	defer timer.Stop()
+	select {
+	case b.slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		atomic.AddUint64(&b.rejected, 1)
+		return ErrVerificationBusy
+	}
+}
+
+// Release frees the slot taken by Acquire.
+func (b *VerificationBudget) Release() {
+	<-b.slots
+}
+
+// VerificationBudgetStats describes the saturation of a VerificationBudget.
+//
+// New in version v0.7
+type VerificationBudgetStats struct {
+	// Capacity is the number of slots, InFlight the number of used slots.
+	Capacity, InFlight int
+	// Waiting is the number of calls waiting for a slot.
+	Waiting int64
+	// Rejected is the number of calls that didn't get a slot since the
+	// budget was created.
+	Rejected uint64
+}
+
+// Saturation returns InFlight / Capacity.
+func (s VerificationBudgetStats) Saturation() float64 {
+	if s.Capacity == 0 {
+		return 0
+	}
+	return float64(s.InFlight) / float64(s.Capacity)
+}
+
+// Stats returns the current saturation of the budget.
+func (b *VerificationBudget) Stats() VerificationBudgetStats {
+	return VerificationBudgetStats{Capacity: cap(b.slots), InFlight: len(b.slots),
+		Waiting: atomic.LoadInt64(&b.waiting), Rejected: atomic.LoadUint64(&b.rejected)}
+}
+
+// BudgetedPasswordHandler is a PasswordHandler that runs GenerateHash and
+// CheckPassword of another PasswordHandler within a VerificationBudget.
+// The budget can be shared by several handlers.
+//
+// Usage:
+//
+//	budget := goauth.NewVerificationBudget(runtime.NumCPU(), 2*time.Second)
+//	pwHandler := goauth.NewBudgetedPasswordHandler(goauth.DefaultPWHandler, budget)
+//	users := goauth.NewSQLite3UserHandler(db, pwHandler)
+//
+// New in version v0.7
+type BudgetedPasswordHandler struct {
+	Handler PasswordHandler
+	Budget  *VerificationBudget
+}
+
+// NewBudgetedPasswordHandler returns a new BudgetedPasswordHandler.
+//
+// New in version v0.7
+func NewBudgetedPasswordHandler(handler PasswordHandler, budget *VerificationBudget) *BudgetedPasswordHandler {
+	return &BudgetedPasswordHandler{Handler: handler, Budget: budget}
+}
+
+func (h *BudgetedPasswordHandler) GenerateHash(password []byte) ([]byte, error) {
+	if err := h.Budget.Acquire(); err != nil {
+		return nil, err
+	}
+	defer h.Budget.Release()
+	return h.Handler.GenerateHash(password)
+}
+
+func (h *BudgetedPasswordHandler) CheckPassword(hashedPW, password []byte) (bool, error) {
+	if err := h.Budget.Acquire(); err != nil {
+		return false, err
+	}
+	defer h.Budget.Release()
+	return h.Handler.CheckPassword(hashedPW, password)
+}
+
+func (h *BudgetedPasswordHandler) PasswordHashLength() int {
+	return h.Handler.PasswordHashLength()
+}
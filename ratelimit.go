@@ -0,0 +1,452 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// RateLimitError is returned by LoginService if too many attempts were made,
+// RetryAfter is the duration after which the next attempt is allowed.
+type RateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("Too many attempts, retry after %v.", e.RetryAfter)
+}
+
+// RateLimiter limits the number of events (for example login attempts) per
+// key in a sliding window.
+//
+// New in version v0.7
+type RateLimiter interface {
+	// Allow records an event for the key and returns true if it's allowed.
+	// If it's not allowed the event is not recorded and the returned
+	// duration is the time until the next event is allowed.
+	Allow(key string) (bool, time.Duration, error)
+
+	// Reset removes all recorded events for the key.
+	Reset(key string) error
+}
+
+// InMemoryRateLimiter is a RateLimiter that stores the events in memory,
+// so it only works for a single instance of your application.
+//
+// New in version v0.7
+type InMemoryRateLimiter struct {
+	// Limit is the number of events allowed in Window.
+	Limit  int
+	Window time.Duration
+
+	events map[string][]time.Time
+	mutex  sync.Mutex
+}
+
+// NewInMemoryRateLimiter returns a new InMemoryRateLimiter.
+func NewInMemoryRateLimiter(limit int, window time.Duration) *InMemoryRateLimiter {
+	return &InMemoryRateLimiter{Limit: limit, Window: window,
+		events: make(map[string][]time.Time)}
+}
+
+func (l *InMemoryRateLimiter) Allow(key string) (bool, time.Duration, error) {
+	now := CurrentTime()
+	start := now.Add(-l.Window)
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	// events are sorted, so remove old events from the front
+	events := l.events[key]
+	i := 0
+	for i < len(events) && !events[i].After(start) {
+		i++
+	}
+	events = events[i:]
+	if len(events) >= l.Limit {
+		l.events[key] = events
+		return false, events[0].Sub(start), nil
+	}
+	l.events[key] = append(events, now)
+	// remove keys without recent events so the map doesn't grow forever
+	if len(l.events) > 10000 {
+		for k, e := range l.events {
+			if len(e) == 0 || !e[len(e)-1].After(start) {
+				delete(l.events, k)
+			}
+		}
+	}
+	return true, 0, nil
+}
+
+func (l *InMemoryRateLimiter) Reset(key string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.events, key)
+	return nil
+}
+
+// redisSlidingWindow implements a sliding window with a sorted set, the
+// scores are the timestamps of the events in milliseconds.
+// KEYS[1]: the set, ARGV: now, window, limit, member.
+// Returns {1, 0} if allowed and {0, retry after in ms} otherwise.
+var redisSlidingWindow = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now - window)
+if redis.call("ZCARD", KEYS[1]) >= tonumber(ARGV[3]) then
+	local oldest = redis.call("ZRANGE", KEYS[1], 0, 0, "WITHSCORES")
+	return {0, tonumber(oldest[2]) + window - now}
+end
+redis.call("ZADD", KEYS[1], now, ARGV[4])
+redis.call("PEXPIRE", KEYS[1], window)
+return {1, 0}
+`)
+
+// RedisRateLimiter is a RateLimiter using redis, the events are stored in
+// sorted sets "ratelimit:<key>" and evaluated atomically by a Lua script.
+//
+// New in version v0.7
+type RedisRateLimiter struct {
+	// Client is the client to connect to redis.
+	Client *redis.Client
+
+	// Prefix defaults to "ratelimit:".
+	Prefix string
+
+	// Limit is the number of events allowed in Window.
+	Limit  int
+	Window time.Duration
+}
+
+// NewRedisRateLimiter returns a new RedisRateLimiter.
+func NewRedisRateLimiter(client *redis.Client, limit int, window time.Duration) *RedisRateLimiter {
+	return &RedisRateLimiter{Client: client, Prefix: "ratelimit:", Limit: limit,
+		Window: window}
+}
+
+func (l *RedisRateLimiter) Allow(key string) (bool, time.Duration, error) {
+	now := CurrentTime().UnixNano() / int64(time.Millisecond)
+	// the member must be unique, otherwise events in the same millisecond
+	// are counted once
+	member, err := GenRandomBase64(12)
+	if err != nil {
+		return false, 0, err
+	}
+	res, err := redisSlidingWindow.Run(l.Client, []string{l.Prefix + key},
+		now, int64(l.Window/time.Millisecond), l.Limit, member).Result()
+	if err != nil {
+		return false, 0, err
+	}
+	values, ok := res.([]interface{})
+	if !ok || len(values) != 2 {
+		return false, 0, fmt.Errorf("Unexpected result from redis: %v", res)
+	}
+	allowed, _ := values[0].(int64)
+	retry, _ := values[1].(int64)
+	return allowed == 1, time.Duration(retry) * time.Millisecond, nil
+}
+
+func (l *RedisRateLimiter) Reset(key string) error {
+	return l.Client.Del(l.Prefix + key).Err()
+}
+
+// SQLRateLimitQueries stores the queries used by SQLRateLimiter, the events
+// are stored in the table rate_limit_events.
+//
+// New in version v0.7
+type SQLRateLimitQueries struct {
+	InitQuery, DeleteOldQuery, CountQuery, InsertQuery, ResetQuery string
+	TimeFromScanType                                               func(val interface{}) (time.Time, error)
+}
+
+// MySQLRateLimitQueries provides queries to use with MySQL.
+func MySQLRateLimitQueries() *SQLRateLimitQueries {
+	initQ := `
+	CREATE TABLE IF NOT EXISTS rate_limit_events (
+		limit_key VARCHAR(255) NOT NULL,
+		created DATETIME(6) NOT NULL,
+		INDEX(limit_key, created)
+	);
+	`
+	return &SQLRateLimitQueries{InitQuery: initQ,
+		DeleteOldQuery:   "DELETE FROM rate_limit_events WHERE limit_key=? AND created <= ?",
+		CountQuery:       "SELECT COUNT(*), MIN(created) FROM rate_limit_events WHERE limit_key=?",
+		InsertQuery:      "INSERT INTO rate_limit_events (limit_key, created) VALUES(?, ?)",
+		ResetQuery:       "DELETE FROM rate_limit_events WHERE limit_key=?",
+		TimeFromScanType: DefaultTimeFromScanType}
+}
+
+// PostgresRateLimitQueries provides queries to use with postgres.
+func PostgresRateLimitQueries() *SQLRateLimitQueries {
+	initQ := `
+	CREATE TABLE IF NOT EXISTS rate_limit_events (
+		limit_key varchar(255) NOT NULL,
+		created timestamp NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS rate_limit_events_key ON rate_limit_events (limit_key, created);
+	`
+	return &SQLRateLimitQueries{InitQuery: initQ,
+		DeleteOldQuery:   "DELETE FROM rate_limit_events WHERE limit_key = $1 AND created <= $2",
+		CountQuery:       "SELECT COUNT(*), MIN(created) FROM rate_limit_events WHERE limit_key = $1",
+		InsertQuery:      "INSERT INTO rate_limit_events (limit_key, created) VALUES ($1, $2)",
+		ResetQuery:       "DELETE FROM rate_limit_events WHERE limit_key = $1",
+		TimeFromScanType: DefaultTimeFromScanType}
+}
+
+// SQLite3RateLimitQueries provides queries to use with sqlite3.
+func SQLite3RateLimitQueries() *SQLRateLimitQueries {
+	res := MySQLRateLimitQueries()
+	res.InitQuery = `
+	CREATE TABLE IF NOT EXISTS rate_limit_events (
+		limit_key VARCHAR(255) NOT NULL,
+		created DATETIME NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS rate_limit_events_key ON rate_limit_events (limit_key, created);
+	`
+	return res
+}
+
+// SQLRateLimiter is a RateLimiter that stores the events in a SQL database.
+// It's slower than RedisRateLimiter but doesn't require another service.
+//
+// New in version v0.7
+type SQLRateLimiter struct {
+	*SQLRateLimitQueries
+
+	// DB is the database to execute the queries on.
+	DB *sql.DB
+
+	// Limit is the number of events allowed in Window.
+	Limit  int
+	Window time.Duration
+
+	blockDB bool
+	mutex   sync.Mutex
+}
+
+// NewSQLRateLimiter returns a new SQLRateLimiter, blockDB has the same
+// meaning as in NewSQLUserHandler.
+func NewSQLRateLimiter(queries *SQLRateLimitQueries, db *sql.DB, blockDB bool, limit int, window time.Duration) *SQLRateLimiter {
+	return &SQLRateLimiter{SQLRateLimitQueries: queries, DB: db, blockDB: blockDB,
+		Limit: limit, Window: window}
+}
+
+// NewMySQLRateLimiter returns a new SQLRateLimiter that uses MySQL.
+func NewMySQLRateLimiter(db *sql.DB, limit int, window time.Duration) *SQLRateLimiter {
+	return NewSQLRateLimiter(MySQLRateLimitQueries(), db, false, limit, window)
+}
+
+// NewPostgresRateLimiter returns a new SQLRateLimiter that uses postgres.
+func NewPostgresRateLimiter(db *sql.DB, limit int, window time.Duration) *SQLRateLimiter {
+	return NewSQLRateLimiter(PostgresRateLimitQueries(), db, false, limit, window)
+}
+
+// NewSQLite3RateLimiter returns a new SQLRateLimiter that uses sqlite3.
+func NewSQLite3RateLimiter(db *sql.DB, limit int, window time.Duration) *SQLRateLimiter {
+	return NewSQLRateLimiter(SQLite3RateLimitQueries(), db, true, limit, window)
+}
+
+// Init creates the table.
+func (l *SQLRateLimiter) Init() error {
+	if l.blockDB {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+	}
+	_, err := l.DB.Exec(l.InitQuery)
+	return err
+}
+
+func (l *SQLRateLimiter) Allow(key string) (bool, time.Duration, error) {
+	now := CurrentTime()
+	start := now.Add(-l.Window)
+	if l.blockDB {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+	}
+	tx, err := l.DB.Begin()
+	if err != nil {
+		return false, 0, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(l.DeleteOldQuery, key, start); err != nil {
+		return false, 0, err
+	}
+	var count int
+	var oldestVal interface{}
+	if err := tx.QueryRow(l.CountQuery, key).Scan(&count, &oldestVal); err != nil {
+		return false, 0, err
+	}
+	if count >= l.Limit {
+		oldest, err := l.TimeFromScanType(oldestVal)
+		if err != nil {
+			return false, 0, err
+		}
+		return false, oldest.Sub(start), tx.Commit()
+	}
+	if _, err := tx.Exec(l.InsertQuery, key, now); err != nil {
+		return false, 0, err
+	}
+	return true, 0, tx.Commit()
+}
+
+func (l *SQLRateLimiter) Reset(key string) error {
+	if l.blockDB {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+	}
+	_, err := l.DB.Exec(l.ResetQuery, key)
+	return err
+}
+
+// ClientIP returns the IP address of the client (from r.RemoteAddr).
+// If your application runs behind a proxy you have to get the address from
+// the header set by your proxy instead.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// LoginService wraps UserHandler.Validate and limits the number of login
+// attempts per username and per IP address. A successful login resets the
+// counter of the username.
+// If the limit is exceeded Validate returns a *RateLimitError without
+// checking the password. If the IP address is on the deny list of the
+// IPFilter it returns ErrIPBanned.
+//
+// New in version v0.7
+type LoginService struct {
+	Users UserHandler
+
+	// UserLimiter limits the attempts per username, IPLimiter the attempts
+	// per IP address. Each of them can be nil.
+	UserLimiter, IPLimiter RateLimiter
+
+	// IPFilter is consulted before everything else and gets notified about
+	// failed logins, may be nil.
+	IPFilter *IPFilter
+}
+
+// NewLoginService returns a new LoginService.
+func NewLoginService(users UserHandler, userLimiter, ipLimiter RateLimiter) *LoginService {
+	return &LoginService{Users: users, UserLimiter: userLimiter, IPLimiter: ipLimiter}
+}
+
+// Validate checks the rate limits and then calls Users.Validate.
+// ip may be "" if unknown, then only the username is limited.
+func (s *LoginService) Validate(userName string, password []byte, ip string) (uint64, error) {
+	return s.ValidateForTenant("", userName, password, ip)
+}
+
+// ValidateForTenant is like Validate but validates a user of the tenant,
+// see the package function ValidateForTenant.
+//
+// New in version v0.7
+func (s *LoginService) ValidateForTenant(tenant, userName string, password []byte, ip string) (uint64, error) {
+	userKey := loginUserKey(tenant, userName)
+	if err := s.check(userKey, ip); err != nil {
+		return NoUserID, err
+	}
+	return s.validateChecked(tenant, userKey, userName, password, ip)
+}
+
+// loginUserKey returns the key of the user for the UserLimiter.
+func loginUserKey(tenant, userName string) string {
+	if tenant != "" {
+		return "user:" + tenant + "/" + userName
+	}
+	return "user:" + userName
+}
+
+// check returns an error if the IPFilter or one of the limiters doesn't
+// allow the login attempt.
+func (s *LoginService) check(userKey, ip string) error {
+	if s.IPFilter != nil && ip != "" {
+		if err := s.IPFilter.Check(ip); err != nil {
+			return err
+		}
+	}
+	if s.IPLimiter != nil && ip != "" {
+		allowed, retry, err := s.IPLimiter.Allow("ip:" + ip)
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			return &RateLimitError{RetryAfter: retry}
+		}
+	}
+	if s.UserLimiter != nil {
+		allowed, retry, err := s.UserLimiter.Allow(userKey)
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			return &RateLimitError{RetryAfter: retry}
+		}
+	}
+	return nil
+}
+
+// validateChecked validates the credentials after check allowed the
+// attempt, it records failures in the IPFilter and resets the UserLimiter
+// on success.
+func (s *LoginService) validateChecked(tenant, userKey, userName string, password []byte, ip string) (uint64, error) {
+	id, err := ValidateForTenant(s.Users, tenant, userName, password)
+	if (err == ErrUserNotFound || (err == nil && id == NoUserID)) && s.IPFilter != nil && ip != "" {
+		if filterErr := s.IPFilter.RecordFailure(ip); filterErr != nil {
+			return NoUserID, filterErr
+		}
+	}
+	if (err == nil || err == ErrRegistrationPending) && id != NoUserID {
+		if err := s.resetUser(userKey); err != nil {
+			return id, err
+		}
+	}
+	return id, err
+}
+
+// resetUser resets the UserLimiter after a successful login.
+func (s *LoginService) resetUser(userKey string) error {
+	if s.UserLimiter == nil {
+		return nil
+	}
+	return s.UserLimiter.Reset(userKey)
+}
+
+// SetRetryAfter sets the Retry-After header (in seconds, rounded up).
+func SetRetryAfter(w http.ResponseWriter, retry time.Duration) {
+	seconds := int64((retry + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+}
@@ -0,0 +1,509 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// AccountRecoveryPurpose is the purpose of account recovery tokens in a
+// OneTimeTokenStore.
+const AccountRecoveryPurpose = "account_recovery"
+
+// ErrInvalidRecoveryCode is returned if a recovery code is wrong or was
+// already used.
+var ErrInvalidRecoveryCode = errors.New("Invalid recovery code.")
+
+// RecoveryCodeHandler stores the hashes of the recovery codes of users.
+// Each code can be used only once.
+//
+// New in version v0.7
+type RecoveryCodeHandler interface {
+	// Init initializes the storage, see UserHandler.
+	Init() error
+
+	// SetRecoveryCodes replaces all codes of the user.
+	SetRecoveryCodes(user uint64, hashes []string) error
+
+	// UseRecoveryCode deletes the code and returns true if the user had the
+	// code. Only one of concurrent calls may return true.
+	UseRecoveryCode(user uint64, hash string) (bool, error)
+
+	// CountRecoveryCodes returns the number of unused codes of the user.
+	CountRecoveryCodes(user uint64) (int, error)
+}
+
+var recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// normalizeRecoveryCode removes separators and spaces so codes can be typed
+// in any format.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToUpper(code)
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, code)
+}
+
+// GenerateRecoveryCodes creates n new recovery codes for the user (replacing
+// the old ones) and returns them, they must be shown to the user once.
+// The codes look like "ABCD-EFGH-IJKL-MNOP".
+//
+// New in version v0.7
+func GenerateRecoveryCodes(codes RecoveryCodeHandler, user uint64, n int) ([]string, error) {
+	res := make([]string, n)
+	hashes := make([]string, n)
+	buf := make([]byte, 10)
+	for i := range res {
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		raw := recoveryCodeEncoding.EncodeToString(buf)
+		res[i] = raw[0:4] + "-" + raw[4:8] + "-" + raw[8:12] + "-" + raw[12:16]
+		hashes[i] = HashToken(raw)
+	}
+	if err := codes.SetRecoveryCodes(user, hashes); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// UseRecoveryCode checks the code of the user and invalidates it.
+// Returns ErrInvalidRecoveryCode if the code is wrong.
+//
+// New in version v0.7
+func UseRecoveryCode(codes RecoveryCodeHandler, user uint64, code string) error {
+	ok, err := codes.UseRecoveryCode(user, HashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInvalidRecoveryCode
+	}
+	return nil
+}
+
+// InMemoryRecoveryCodeHandler is a RecoveryCodeHandler that keeps the codes
+// in memory.
+//
+// New in version v0.7
+type InMemoryRecoveryCodeHandler struct {
+	mutex sync.Mutex
+	codes map[uint64]map[string]struct{}
+}
+
+// NewInMemoryRecoveryCodeHandler returns a new InMemoryRecoveryCodeHandler.
+func NewInMemoryRecoveryCodeHandler() *InMemoryRecoveryCodeHandler {
+	return &InMemoryRecoveryCodeHandler{codes: make(map[uint64]map[string]struct{})}
+}
+
+func (h *InMemoryRecoveryCodeHandler) Init() error {
+	return nil
+}
+
+func (h *InMemoryRecoveryCodeHandler) SetRecoveryCodes(user uint64, hashes []string) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	codes := make(map[string]struct{}, len(hashes))
+	for _, hash := range hashes {
+		codes[hash] = struct{}{}
+	}
+	h.codes[user] = codes
+	return nil
+}
+
+func (h *InMemoryRecoveryCodeHandler) UseRecoveryCode(user uint64, hash string) (bool, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if _, has := h.codes[user][hash]; !has {
+		return false, nil
+	}
+	delete(h.codes[user], hash)
+	return true, nil
+}
+
+func (h *InMemoryRecoveryCodeHandler) CountRecoveryCodes(user uint64) (int, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return len(h.codes[user]), nil
+}
+
+// SQLRecoveryCodeQueries stores the queries for SQLRecoveryCodeHandler.
+//
+// New in version v0.7
+type SQLRecoveryCodeQueries struct {
+	InitQuery, DeleteAllQuery, InsertQuery, UseQuery, CountQuery string
+}
+
+// MySQLRecoveryCodeQueries provides queries to use with MySQL.
+func MySQLRecoveryCodeQueries() *SQLRecoveryCodeQueries {
+	initQ := `
+	CREATE TABLE IF NOT EXISTS recovery_codes (
+		user_id BIGINT UNSIGNED NOT NULL,
+		code_hash CHAR(64) NOT NULL,
+		PRIMARY KEY(user_id, code_hash)
+	);
+	`
+	return &SQLRecoveryCodeQueries{InitQuery: initQ,
+		DeleteAllQuery: "DELETE FROM recovery_codes WHERE user_id=?",
+		InsertQuery:    "INSERT INTO recovery_codes (user_id, code_hash) VALUES(?, ?)",
+		UseQuery:       "DELETE FROM recovery_codes WHERE user_id=? AND code_hash=?",
+		CountQuery:     "SELECT COUNT(*) FROM recovery_codes WHERE user_id=?"}
+}
+
+// PostgresRecoveryCodeQueries provides queries to use with postgres.
+func PostgresRecoveryCodeQueries() *SQLRecoveryCodeQueries {
+	initQ := `
+	CREATE TABLE IF NOT EXISTS recovery_codes (
+		user_id bigint NOT NULL,
+		code_hash char(64) NOT NULL,
+		PRIMARY KEY(user_id, code_hash)
+	);
+	`
+	return &SQLRecoveryCodeQueries{InitQuery: initQ,
+		DeleteAllQuery: "DELETE FROM recovery_codes WHERE user_id = $1",
+		InsertQuery:    "INSERT INTO recovery_codes (user_id, code_hash) VALUES($1, $2)",
+		UseQuery:       "DELETE FROM recovery_codes WHERE user_id = $1 AND code_hash = $2",
+		CountQuery:     "SELECT COUNT(*) FROM recovery_codes WHERE user_id = $1"}
+}
+
+// SQLite3RecoveryCodeQueries provides queries to use with sqlite3.
+func SQLite3RecoveryCodeQueries() *SQLRecoveryCodeQueries {
+	return MySQLRecoveryCodeQueries()
+}
+
+// SQLRecoveryCodeHandler implements RecoveryCodeHandler by executing the
+// queries defined in an instance of SQLRecoveryCodeQueries.
+//
+// New in version v0.7
+type SQLRecoveryCodeHandler struct {
+	*SQLRecoveryCodeQueries
+
+	// DB is the database to execute the queries on.
+	DB *sql.DB
+
+	blockDB bool
+	mutex   sync.RWMutex
+}
+
+// NewSQLRecoveryCodeHandler returns a new SQLRecoveryCodeHandler, blockDB
+// has the same meaning as in NewSQLUserHandler.
+func NewSQLRecoveryCodeHandler(queries *SQLRecoveryCodeQueries, db *sql.DB, blockDB bool) *SQLRecoveryCodeHandler {
+	return &SQLRecoveryCodeHandler{SQLRecoveryCodeQueries: queries, DB: db, blockDB: blockDB}
+}
+
+// NewMySQLRecoveryCodeHandler returns a new SQLRecoveryCodeHandler that uses
+// MySQL.
+func NewMySQLRecoveryCodeHandler(db *sql.DB) *SQLRecoveryCodeHandler {
+	return NewSQLRecoveryCodeHandler(MySQLRecoveryCodeQueries(), db, false)
+}
+
+// NewPostgresRecoveryCodeHandler returns a new SQLRecoveryCodeHandler that
+// uses postgres.
+func NewPostgresRecoveryCodeHandler(db *sql.DB) *SQLRecoveryCodeHandler {
+	return NewSQLRecoveryCodeHandler(PostgresRecoveryCodeQueries(), db, false)
+}
+
+// NewSQLite3RecoveryCodeHandler returns a new SQLRecoveryCodeHandler that
+// uses sqlite3.
+func NewSQLite3RecoveryCodeHandler(db *sql.DB) *SQLRecoveryCodeHandler {
+	return NewSQLRecoveryCodeHandler(SQLite3RecoveryCodeQueries(), db, true)
+}
+
+func (handler *SQLRecoveryCodeHandler) Init() error {
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	_, err := handler.DB.Exec(handler.InitQuery)
+	return err
+}
+
+func (handler *SQLRecoveryCodeHandler) SetRecoveryCodes(user uint64, hashes []string) error {
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	tx, err := handler.DB.Begin()
+	if err != nil {
+		return wrapBackendError("sql", "SetRecoveryCodes", err)
+	}
+	if _, err := tx.Exec(handler.DeleteAllQuery, user); err != nil {
+		tx.Rollback()
+		return wrapBackendError("sql", "SetRecoveryCodes", err)
+	}
+	for _, hash := range hashes {
+		if _, err := tx.Exec(handler.InsertQuery, user, hash); err != nil {
+			tx.Rollback()
+			return wrapBackendError("sql", "SetRecoveryCodes", err)
+		}
+	}
+	return wrapBackendError("sql", "SetRecoveryCodes", tx.Commit())
+}
+
+func (handler *SQLRecoveryCodeHandler) UseRecoveryCode(user uint64, hash string) (bool, error) {
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	res, err := handler.DB.Exec(handler.UseQuery, user, hash)
+	if err != nil {
+		return false, wrapBackendError("sql", "UseRecoveryCode", err)
+	}
+	num, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return num > 0, nil
+}
+
+func (handler *SQLRecoveryCodeHandler) CountRecoveryCodes(user uint64) (int, error) {
+	if handler.blockDB {
+		handler.mutex.RLock()
+		defer handler.mutex.RUnlock()
+	}
+	var res int
+	if err := handler.DB.QueryRow(handler.CountQuery, user).Scan(&res); err != nil {
+		return 0, wrapBackendError("sql", "CountRecoveryCodes", err)
+	}
+	return res, nil
+}
+
+// AccountRecoveryManager lets users regain access to their account if they
+// lost both the password and the second factor device: StartRecovery sends
+// a token to the email address of the user, Recover requires that token and
+// one of the user's recovery codes. Alternatively an admin can recover the
+// account with AdminOverride.
+//
+// On recovery the password is set, ResetSecondFactor is called (so the user
+// can enroll a new device) and all sessions of the user are deleted.
+// Each recovery is reported to the Notifier as EventAccountRecovered, the
+// event data contains the method ("recovery_code" or "admin_override") and
+// for overrides the admin and the reason, so the notifier can write the
+// audit log.
+//
+// New in version v0.7
+type AccountRecoveryManager struct {
+	Users      UserHandler
+	Controller *SessionController
+	Tokens     OneTimeTokenStore
+	Codes      RecoveryCodeHandler
+
+	// TTL is the time a recovery token is valid, defaults to one hour.
+	TTL time.Duration
+
+	// Notifier gets the audit events, may be nil.
+	Notifier SecurityNotifier
+
+	// Deliver sends the token to the user (to info.Email).
+	Deliver func(info *BaseUserInformation, token string) error
+
+	// ResetSecondFactor removes the second factors of the user, may be nil.
+	ResetSecondFactor func(user uint64) error
+
+	// Render and RenderError write the responses of the handlers, they
+	// default to RenderJSON and RenderJSONError.
+	Render      func(w http.ResponseWriter, r *http.Request, status int, value interface{})
+	RenderError func(w http.ResponseWriter, r *http.Request, status int, err error)
+}
+
+// NewAccountRecoveryManager returns a new AccountRecoveryManager with a TTL
+// of one hour that renders JSON.
+func NewAccountRecoveryManager(users UserHandler, controller *SessionController, tokens OneTimeTokenStore, codes RecoveryCodeHandler) *AccountRecoveryManager {
+	return &AccountRecoveryManager{Users: users, Controller: controller,
+		Tokens: tokens, Codes: codes, TTL: time.Hour, Render: RenderJSON,
+		RenderError: RenderJSONError}
+}
+
+// StartRecovery creates a recovery token for the user and passes it to
+// Deliver. Older recovery tokens of the user are invalidated.
+func (m *AccountRecoveryManager) StartRecovery(userName string) error {
+	info, err := m.Users.GetUserBaseInfo(userName)
+	if err != nil {
+		return err
+	}
+	info.UserName = userName
+	subject := userSubject(info.ID)
+	if _, err := m.Tokens.DeleteTokens(AccountRecoveryPurpose, subject); err != nil {
+		return err
+	}
+	token, err := IssueOneTimeToken(m.Tokens, AccountRecoveryPurpose, subject, "", m.TTL)
+	if err != nil {
+		return err
+	}
+	if m.Deliver == nil {
+		return errors.New("No delivery function for account recovery tokens set.")
+	}
+	return m.Deliver(info, token)
+}
+
+// Recover redeems the token and the recovery code and sets the new
+// password. The token is used up even if the code is wrong, so codes can't
+// be guessed with one token. It returns the id and name of the user and the
+// number of deleted sessions.
+func (m *AccountRecoveryManager) Recover(token, code string, plainPW []byte) (uint64, string, int64, error) {
+	entry, err := ConsumeOneTimeToken(m.Tokens, AccountRecoveryPurpose, token)
+	if err != nil {
+		return NoUserID, "", -1, err
+	}
+	id, err := subjectUserID(entry.Subject)
+	if err != nil {
+		return NoUserID, "", -1, ErrTokenNotFound
+	}
+	userName, err := m.Users.GetUserName(id)
+	if err != nil {
+		return NoUserID, "", -1, err
+	}
+	if err := UseRecoveryCode(m.Codes, id, code); err != nil {
+		return id, userName, -1, err
+	}
+	num, err := m.complete(id, userName, plainPW, map[string]string{"method": "recovery_code"})
+	return id, userName, num, err
+}
+
+// AdminOverride recovers the account of the user without token and code,
+// admin is the id of the admin and reason is stored in the audit event.
+// It returns the number of deleted sessions.
+func (m *AccountRecoveryManager) AdminOverride(admin uint64, userName string, plainPW []byte, reason string) (int64, error) {
+	id, err := m.Users.GetUserID(userName)
+	if err != nil {
+		return -1, err
+	}
+	return m.complete(id, userName, plainPW, map[string]string{"method": "admin_override",
+		"admin": strconv.FormatUint(admin, 10), "reason": reason})
+}
+
+func (m *AccountRecoveryManager) complete(id uint64, userName string, plainPW []byte, data map[string]string) (int64, error) {
+	if err := m.Users.UpdatePassword(userName, plainPW); err != nil {
+		return -1, err
+	}
+	if m.ResetSecondFactor != nil {
+		if err := m.ResetSecondFactor(id); err != nil {
+			return -1, err
+		}
+	}
+	// revoke the sessions before reporting success, an attacker may still
+	// have a session
+	num, err := m.Controller.RevokeEntriesForUser(id, ReasonPasswordChanged)
+	if err != nil {
+		return -1, err
+	}
+	if _, err := m.Tokens.DeleteTokens(AccountRecoveryPurpose, userSubject(id)); err != nil {
+		return num, err
+	}
+	if m.Notifier != nil {
+		event := NewSecurityEvent(EventAccountRecovered, id, userName)
+		event.Data = data
+		m.Notifier.Notify(event)
+	}
+	return num, nil
+}
+
+// RecoveryRequest is the request accepted by ServeRecover, either as JSON or
+// as form.
+type RecoveryRequest struct {
+	Token    string `json:"token"`
+	Code     string `json:"code"`
+	Password string `json:"password"`
+}
+
+func parseRecoveryRequest(r *http.Request) (*RecoveryRequest, error) {
+	res := &RecoveryRequest{}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		if err := json.NewDecoder(r.Body).Decode(res); err != nil {
+			return nil, err
+		}
+		return res, nil
+	}
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+	res.Token = r.PostFormValue("token")
+	res.Code = r.PostFormValue("code")
+	res.Password = r.PostFormValue("password")
+	return res, nil
+}
+
+// ServeStartRecovery starts the recovery for the username in the request.
+// Like PasswordResetManager.ServeRequestReset the response is always 202
+// Accepted.
+func (m *AccountRecoveryManager) ServeStartRecovery(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r, m.RenderError) {
+		return
+	}
+	req, err := ParseAuthRequest(r)
+	if err != nil {
+		m.RenderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if req.UserName == "" {
+		m.RenderError(w, r, http.StatusBadRequest, errors.New("Username is required."))
+		return
+	}
+	if err := m.StartRecovery(req.UserName); err != nil && err != ErrUserNotFound {
+		log.WithError(err).WithField("user", req.UserName).Error("goauth: Can't start account recovery")
+	}
+	m.Render(w, r, http.StatusAccepted, &AuthResponse{Status: "accepted"})
+}
+
+// ServeRecover completes the recovery, the request contains the token, the
+// recovery code and the new password (see RecoveryRequest).
+func (m *AccountRecoveryManager) ServeRecover(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r, m.RenderError) {
+		return
+	}
+	req, err := parseRecoveryRequest(r)
+	if err != nil {
+		m.RenderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if req.Token == "" || req.Code == "" || req.Password == "" {
+		m.RenderError(w, r, http.StatusBadRequest, errors.New("Token, code and password are required."))
+		return
+	}
+	id, userName, num, err := m.Recover(req.Token, req.Code, []byte(req.Password))
+	switch {
+	case err == ErrTokenNotFound || err == ErrUserNotFound || err == ErrInvalidRecoveryCode:
+		m.RenderError(w, r, http.StatusBadRequest, err)
+	case err != nil:
+		m.RenderError(w, r, http.StatusInternalServerError, err)
+	default:
+		m.Render(w, r, http.StatusOK, &AuthResponse{Status: "ok", UserID: id,
+			UserName: userName, Deleted: num})
+	}
+}
@@ -23,6 +23,7 @@
 package goauth
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"strconv"
@@ -78,6 +79,30 @@ type RedisSessionHandler struct {
 	// of the user identification back to its original type.
 	// The default assumes uint64.
 	ConvertUser func(val string) (interface{}, error)
+
+	// AnalyticsPrefix enables the statistics of SessionAnalytics if it is
+	// not empty (for example "stats:"). CreateEntry then adds the user to a
+	// HyperLogLog per day and increments a counter per hour, both expire
+	// after AnalyticsRetention (defaults to 30 days).
+	// ActiveUsersWindow is the time range used by ActiveUsers, it's rounded
+	// to full days and defaults to one day.
+	//
+	// New in version v0.7
+	AnalyticsPrefix                       string
+	AnalyticsRetention, ActiveUsersWindow time.Duration
+
+	// Clock is used for the creation and expiry times, nil (the default)
+	// means CurrentTime.
+	//
+	// New in version v0.7
+	Clock Clock
+
+	// DateFormat is used to store times, it defaults to RedisDateFormat
+	// (seconds). Set it to time.RFC3339Nano for sub-second precision.
+	// Both formats are always accepted when reading.
+	//
+	// New in version v0.7
+	DateFormat string
 }
 
 // NewRedisSessionHandler creates a new RedisSessionHandler.
@@ -99,6 +124,32 @@ func (handler *RedisSessionHandler) Init() error {
 	return nil
 }
 
+// Ping sends a PING to redis.
+//
+// New in version v0.7
+func (handler *RedisSessionHandler) Ping() error {
+	return handler.Healthy(context.Background())
+}
+
+// Healthy sends a PING to redis, see HealthChecker.
+//
+// New in version v0.7
+func (handler *RedisSessionHandler) Healthy(ctx context.Context) error {
+	return pingRedis(ctx, handler.Client)
+}
+
+// pingRedis sends a PING with the given context.
+func pingRedis(ctx context.Context, client *redis.Client) error {
+	if err := client.WithContext(ctx).Ping().Err(); err != nil {
+		return wrapBackendError("redis", "Ping", err)
+	}
+	return nil
+}
+
+// redisPipelineSize is the maximal number of commands sent in one pipeline
+// (and the COUNT hint for SCAN) for operations on many keys.
+const redisPipelineSize = 500
+
 // delUserKeys deletes all keys given the userIdentifier, i.e. usessions:
 // If delAll is true all keys for that user get deleted, otherwise
 // only those keys that don't refer to a valid session key anymore.
@@ -109,15 +160,30 @@ func (handler *RedisSessionHandler) delUserKeys(userIdentifier string, delAll bo
 		return 0, getErr
 	} else {
 		keysForDelete := make([]string, 0)
-		for _, userKey := range allUserKeys {
-			if delAll {
-				keysForDelete = append(keysForDelete, userKey)
-			} else {
-				if exists, existsErr := handler.Client.Exists(handler.SessionPrefix + userKey).Result(); existsErr != nil {
+		if delAll {
+			for _, userKey := range allUserKeys {
+				keysForDelete = append(keysForDelete, handler.SessionPrefix+userKey)
+			}
+		} else {
+			// check the keys in pipelines
+			for start := 0; start < len(allUserKeys); start += redisPipelineSize {
+				end := start + redisPipelineSize
+				if end > len(allUserKeys) {
+					end = len(allUserKeys)
+				}
+				pipe := handler.Client.Pipeline()
+				cmds := make([]*redis.IntCmd, 0, end-start)
+				for _, userKey := range allUserKeys[start:end] {
+					cmds = append(cmds, pipe.Exists(handler.SessionPrefix+userKey))
+				}
+				if _, existsErr := pipe.Exec(); existsErr != nil {
 					log.WithError(existsErr).Warn("goauth(redis): Can't check status of key")
-				} else if exists == 0 {
-					// delete
-					keysForDelete = append(keysForDelete, handler.SessionPrefix+userKey)
+				}
+				for i, cmd := range cmds {
+					if cmd.Err() == nil && cmd.Val() == 0 {
+						// delete
+						keysForDelete = append(keysForDelete, handler.SessionPrefix+allUserKeys[start+i])
+					}
 				}
 			}
 		}
@@ -145,13 +211,13 @@ func (handler *RedisSessionHandler) delUserKeys(userIdentifier string, delAll bo
 // has multiple sessions). But this is still fine if you don't add thousands
 // of keys within seconds ;).
 func (handler *RedisSessionHandler) CreateEntry(user UserKeyType, key string, validDuration time.Duration) (*SessionKeyData, error) {
-	data := CurrentTimeKeyData(user, validDuration)
+	data := clockKeyData(handler.Clock, user, validDuration)
 	redisKey := handler.SessionPrefix + key
 	err := handler.Client.HMSet(redisKey,
 		map[string]interface{}{
 			"User":         fmt.Sprintf("%v", user),
-			"CreationTime": data.CreationTime.Format(RedisDateFormat),
-			"ValidUntil":   data.ValidUntil.Format(RedisDateFormat),
+			"CreationTime": data.CreationTime.Format(redisDateFormat(handler.DateFormat)),
+			"ValidUntil":   data.ValidUntil.Format(redisDateFormat(handler.DateFormat)),
 		}).Err()
 	if err != nil {
 		return nil, err
@@ -179,15 +245,139 @@ func (handler *RedisSessionHandler) CreateEntry(user UserKeyType, key string, va
 			log.WithError(expErr).Warn("goauth(redis): Can't set Expire for user key set")
 		}
 		handler.delUserKeys(userIdentifier, false)
+		if handler.AnalyticsPrefix != "" {
+			handler.recordSession(user, data.CreationTime)
+		}
 	}()
 	return data, nil
 }
 
+const (
+	redisDayFormat  = "2006-01-02"
+	redisHourFormat = "2006-01-02T15"
+)
+
+// recordSession updates the statistics of SessionAnalytics.
+func (handler *RedisSessionHandler) recordSession(user UserKeyType, created time.Time) {
+	retention := handler.AnalyticsRetention
+	if retention <= 0 {
+		retention = 30 * 24 * time.Hour
+	}
+	usersKey := handler.AnalyticsPrefix + "users:" + created.Format(redisDayFormat)
+	createdKey := handler.AnalyticsPrefix + "created:" + created.Format(redisHourFormat)
+	pipe := handler.Client.Pipeline()
+	pipe.PFAdd(usersKey, fmt.Sprintf("%v", user))
+	pipe.Expire(usersKey, retention)
+	pipe.Incr(createdKey)
+	pipe.Expire(createdKey, retention)
+	if _, err := pipe.Exec(); err != nil {
+		log.WithError(err).Warn("goauth(redis): Can't update session statistics")
+	}
+}
+
+// ActiveUsers returns the approximate number of distinct users that created
+// a session within ActiveUsersWindow, see SessionAnalytics. The count is
+// computed with HyperLogLogs (the standard error is 0.81%).
+// It returns ErrNotSupported if AnalyticsPrefix is empty.
+//
+// New in version v0.7
+func (handler *RedisSessionHandler) ActiveUsers() (int64, error) {
+	if handler.AnalyticsPrefix == "" {
+		return 0, ErrNotSupported
+	}
+	window := handler.ActiveUsersWindow
+	if window <= 0 {
+		window = 24 * time.Hour
+	}
+	now := clockNow(handler.Clock)
+	keys := make([]string, 0)
+	for day := now.Add(-window); !day.After(now); day = day.Add(24 * time.Hour) {
+		keys = append(keys, handler.AnalyticsPrefix+"users:"+day.Format(redisDayFormat))
+	}
+	if last := handler.AnalyticsPrefix + "users:" + now.Format(redisDayFormat); keys[len(keys)-1] != last {
+		keys = append(keys, last)
+	}
+	res, err := handler.Client.PFCount(keys...).Result()
+	if err != nil {
+		return 0, wrapBackendError("redis", "ActiveUsers", err)
+	}
+	return res, nil
+}
+
+// SessionsCreated returns the number of sessions created in [from, to), see
+// SessionAnalytics. The counters are stored per hour, so the range is
+// extended to full hours.
+// It returns ErrNotSupported if AnalyticsPrefix is empty.
+//
+// New in version v0.7
+func (handler *RedisSessionHandler) SessionsCreated(from, to time.Time) (int64, error) {
+	if handler.AnalyticsPrefix == "" {
+		return 0, ErrNotSupported
+	}
+	keys := make([]string, 0)
+	for hour := from.UTC().Truncate(time.Hour); hour.Before(to); hour = hour.Add(time.Hour) {
+		keys = append(keys, handler.AnalyticsPrefix+"created:"+hour.Format(redisHourFormat))
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	values, err := handler.Client.MGet(keys...).Result()
+	if err != nil {
+		return 0, wrapBackendError("redis", "SessionsCreated", err)
+	}
+	var res int64
+	for _, val := range values {
+		if str, ok := val.(string); ok {
+			num, err := strconv.ParseInt(str, 10, 64)
+			if err != nil {
+				return 0, err
+			}
+			res += num
+		}
+	}
+	return res, nil
+}
+
 func (handler *RedisSessionHandler) GetData(key string) (*SessionKeyData, error) {
 	entry, err := handler.Client.HMGet(handler.SessionPrefix+key, "User", "CreationTime", "ValidUntil").Result()
 	if err != nil {
-		return nil, err
+		return nil, wrapBackendError("redis", "GetData", err)
+	}
+	return handler.parseEntry(entry)
+}
+
+// GetDataMulti returns the data for all keys with one pipeline, see
+// MultiSessionGetter.
+//
+// New in version v0.7
+func (handler *RedisSessionHandler) GetDataMulti(keys []string) (map[string]*SessionKeyData, error) {
+	res := make(map[string]*SessionKeyData, len(keys))
+	if len(keys) == 0 {
+		return res, nil
+	}
+	pipe := handler.Client.Pipeline()
+	cmds := make([]*redis.SliceCmd, len(keys))
+	for i, key := range keys {
+		cmds[i] = pipe.HMGet(handler.SessionPrefix+key, "User", "CreationTime", "ValidUntil")
+	}
+	if _, err := pipe.Exec(); err != nil {
+		return nil, wrapBackendError("redis", "GetDataMulti", err)
 	}
+	for i, cmd := range cmds {
+		data, err := handler.parseEntry(cmd.Val())
+		switch {
+		case err == nil:
+			res[keys[i]] = data
+		case err != ErrKeyNotFound:
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// parseEntry parses the result of HMGET for User, CreationTime and
+// ValidUntil.
+func (handler *RedisSessionHandler) parseEntry(entry []interface{}) (*SessionKeyData, error) {
 	if entry[0] == nil {
 		return nil, ErrKeyNotFound
 	}
@@ -207,14 +397,14 @@ func (handler *RedisSessionHandler) GetData(key string) (*SessionKeyData, error)
 				}
 
 			case 1:
-				if creation, creationErr := time.Parse(RedisDateFormat, s); creationErr != nil {
+				if creation, creationErr := parseRedisTime(s); creationErr != nil {
 					return nil, creationErr
 				} else {
 					result.CreationTime = creation
 				}
 
 			case 2:
-				if valid, validErr := time.Parse(RedisDateFormat, s); validErr != nil {
+				if valid, validErr := parseRedisTime(s); validErr != nil {
 					return nil, validErr
 				} else {
 					result.ValidUntil = valid
@@ -234,10 +424,92 @@ func (handler *RedisSessionHandler) DeleteEntriesForUser(user UserKeyType) (int6
 	return handler.delUserKeys(fmt.Sprintf("%s%v", handler.UserPrefix, user), true)
 }
 
+// DeleteKeys removes all keys with one DEL command, see BulkSessionDeleter.
+//
+// New in version v0.7
+func (handler *RedisSessionHandler) DeleteKeys(keys []string) (int64, error) {
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	redisKeys := make([]string, len(keys))
+	for i, key := range keys {
+		redisKeys[i] = handler.SessionPrefix + key
+	}
+	return handler.Client.Del(redisKeys...).Result()
+}
+
+// DeleteEntriesForUsers removes all keys of the users, see
+// BulkSessionDeleter. The key sets of the users are read and deleted in
+// pipelines.
+//
+// New in version v0.7
+func (handler *RedisSessionHandler) DeleteEntriesForUsers(users []UserKeyType) (int64, error) {
+	var removed int64
+	for start := 0; start < len(users); start += redisPipelineSize {
+		end := start + redisPipelineSize
+		if end > len(users) {
+			end = len(users)
+		}
+		pipe := handler.Client.Pipeline()
+		userIdentifiers := make([]string, 0, end-start)
+		cmds := make([]*redis.StringSliceCmd, 0, end-start)
+		for _, user := range users[start:end] {
+			userIdentifier := fmt.Sprintf("%s%v", handler.UserPrefix, user)
+			userIdentifiers = append(userIdentifiers, userIdentifier)
+			cmds = append(cmds, pipe.SMembers(userIdentifier))
+		}
+		if _, err := pipe.Exec(); err != nil {
+			return removed, err
+		}
+		var sessionKeys []string
+		for _, cmd := range cmds {
+			for _, key := range cmd.Val() {
+				sessionKeys = append(sessionKeys, handler.SessionPrefix+key)
+			}
+		}
+		pipe = handler.Client.Pipeline()
+		var delSessions *redis.IntCmd
+		if len(sessionKeys) > 0 {
+			delSessions = pipe.Del(sessionKeys...)
+		}
+		pipe.Del(userIdentifiers...)
+		if _, err := pipe.Exec(); err != nil {
+			return removed, err
+		}
+		if delSessions != nil {
+			removed += delSessions.Val()
+		}
+	}
+	return removed, nil
+}
+
 func (handler *RedisSessionHandler) DeleteInvalidKeys() (int64, error) {
 	return 0, nil
 }
 
+func (handler *RedisSessionHandler) ListSessionsForUser(user UserKeyType) (map[string]*SessionKeyData, error) {
+	keys, err := handler.Client.SMembers(fmt.Sprintf("%s%v", handler.UserPrefix, user)).Result()
+	if err != nil {
+		return nil, err
+	}
+	now := clockNow(handler.Clock)
+	res := make(map[string]*SessionKeyData)
+	for _, key := range keys {
+		data, err := handler.GetData(key)
+		if err != nil {
+			if err == ErrKeyNotFound {
+				// the key expired but was not removed from the set yet
+				continue
+			}
+			return nil, err
+		}
+		if KeyValid(now, data.ValidUntil) {
+			res[key] = data
+		}
+	}
+	return res, nil
+}
+
 // Users stuff
 
 // RedisUserHandler is a UserHandler that uses redis.
@@ -256,6 +528,26 @@ type RedisUserHandler struct {
 
 	// The prefix used to store the mapping id -> user name
 	UserIDPrefix string
+
+	// Encryptor is used to encrypt the first name, last name and email
+	// of users, set to nil (the default) to store them unencrypted.
+	// See FieldEncryptor for details.
+	//
+	// New in version v0.7
+	Encryptor *FieldEncryptor
+
+	// Names is enforced in Insert and RenameUser, the names of deleted and
+	// renamed users are held. Set to nil (the default) to allow all names.
+	// See UsernamePolicy for details.
+	//
+	// New in version v0.7
+	Names *UsernamePolicy
+
+	// DateFormat is used to store the last login, see
+	// RedisSessionHandler.DateFormat.
+	//
+	// New in version v0.7
+	DateFormat string
 }
 
 // NewRedisUserHandler returns a new RedisUserHandler.
@@ -271,20 +563,65 @@ func (handler *RedisUserHandler) Init() error {
 	return nil
 }
 
+// Ping sends a PING to redis.
+//
+// New in version v0.7
+func (handler *RedisUserHandler) Ping() error {
+	return handler.Healthy(context.Background())
+}
+
+// Healthy sends a PING to redis, see HealthChecker.
+//
+// New in version v0.7
+func (handler *RedisUserHandler) Healthy(ctx context.Context) error {
+	return pingRedis(ctx, handler.Client)
+}
+
 func (handler *RedisUserHandler) Insert(userName, firstName, lastName, email string, plainPW []byte) (uint64, error) {
-	now := CurrentTime()
+	return handler.insert(userName, firstName, lastName, email, plainPW, false)
+}
+
+// InsertPending inserts a user with only username, email and password whose
+// registration is pending, see PendingUserHandler.
+//
+// New in version v0.7
+func (handler *RedisUserHandler) InsertPending(userName, email string, plainPW []byte) (uint64, error) {
+	return handler.insert(userName, "", "", email, plainPW, true)
+}
+
+func (handler *RedisUserHandler) insert(userName, firstName, lastName, email string, plainPW []byte, pending bool) (uint64, error) {
 	// encrypt password
 	encrypted, encErr := handler.PwHandler.GenerateHash(plainPW)
 	if encErr != nil {
 		return NoUserID, encErr
 	}
+	return handler.insertHash(userName, firstName, lastName, email, encrypted, true, pending, CurrentTime())
+}
+
+// InsertWithHash inserts a user with an already hashed password, see
+// PasswordHashHandler.
+//
+// New in version v0.7
+func (handler *RedisUserHandler) InsertWithHash(info *BaseUserInformation, hash []byte) (uint64, error) {
+	return handler.insertHash(info.UserName, info.FirstName, info.LastName, info.Email, hash, info.IsActive, info.IsPending, info.LastLogin)
+}
+
+// insertHash inserts the user with the hashed password.
+func (handler *RedisUserHandler) insertHash(userName, firstName, lastName, email string, encrypted []byte, active, pending bool, lastLogin time.Time) (uint64, error) {
+	firstName, lastName, email, encErr := handler.Encryptor.encryptUser(firstName, lastName, email)
+	if encErr != nil {
+		return NoUserID, encErr
+	}
+	if err := handler.Names.Check(userName); err != nil {
+		return NoUserID, err
+	}
 	userkey := fmt.Sprintf("%s%v", handler.UserPrefix, userName)
 	// check if user already exists
 	if exists, existsErr := handler.Client.Exists(userkey).Result(); existsErr != nil {
-		return NoUserID, existsErr
+		return NoUserID, wrapBackendError("redis", "Insert", existsErr)
 	} else if exists > 0 {
 		// user already exists
-		return NoUserID, errors.New("Username already in use")
+		return NoUserID, ErrDuplicateUsername
 	}
 	// get next id
 	id, idErr := handler.Client.Incr(handler.NextIDKey).Result()
@@ -300,15 +637,16 @@ func (handler *RedisUserHandler) Insert(userName, firstName, lastName, email str
 		"firstName":  firstName,
 		"lastName":   lastName,
 		"email":      email,
-		"is_active":  true,
-		"last_login": now.Format(RedisDateFormat),
+		"is_active":  active,
+		"last_login": lastLogin.Format(redisDateFormat(handler.DateFormat)),
 		"password":   string(encrypted),
+		"is_pending": pending,
 	})
 	// insert mapping id -> username
 	pipe.Set(fmt.Sprintf("%s%d", handler.UserIDPrefix, id), userName, 0)
 	_, insertErr := pipe.Exec()
 	if insertErr != nil {
-		return NoUserID, insertErr
+		return NoUserID, wrapBackendError("redis", "Insert", insertErr)
 	}
 	// success
 	return uint64(id), nil
@@ -317,7 +655,7 @@ func (handler *RedisUserHandler) Insert(userName, firstName, lastName, email str
 func (handler *RedisUserHandler) Validate(userName string, cleartextPwCheck []byte) (uint64, error) {
 	// try to get the entry
 	userkey := fmt.Sprintf("%s%v", handler.UserPrefix, userName)
-	entry, getErr := handler.Client.HMGet(userkey, "id", "password").Result()
+	entry, getErr := handler.Client.HMGet(userkey, "id", "password", "is_pending").Result()
 	if getErr != nil {
 		return NoUserID, getErr
 	}
@@ -333,6 +671,10 @@ func (handler *RedisUserHandler) Validate(userName string, cleartextPwCheck []by
 	if !pwOk {
 		return NoUserID, errors.New("Weird type in redis, should not happen")
 	}
+	// the password might have been cleared, the user can't log in then
+	if pwStr == "" {
+		return NoUserID, nil
+	}
 	test, testErr := handler.PwHandler.CheckPassword([]byte(pwStr), cleartextPwCheck)
 	if testErr != nil {
 		return NoUserID, testErr
@@ -343,6 +685,11 @@ func (handler *RedisUserHandler) Validate(userName string, cleartextPwCheck []by
 		if parseErr != nil {
 			return NoUserID, parseErr
 		}
+		if pendingStr, ok := entry[2].(string); ok {
+			if pending, _ := strconv.ParseBool(pendingStr); pending {
+				return id, ErrRegistrationPending
+			}
+		}
 		return id, nil
 	} else {
 		return NoUserID, nil
@@ -370,23 +717,75 @@ func (handler *RedisUserHandler) UpdatePassword(userName string, plainPW []byte)
 	return updateErr
 }
 
+// GetPasswordHash returns the stored hash of the password, see
+// PasswordHashHandler.
+//
+// New in version v0.7
+func (handler *RedisUserHandler) GetPasswordHash(userName string) ([]byte, error) {
+	userkey := fmt.Sprintf("%s%v", handler.UserPrefix, userName)
+	pwStr, err := handler.Client.HGet(userkey, "password").Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, ErrUserNotFound
+		}
+		return nil, wrapBackendError("redis", "GetPasswordHash", err)
+	}
+	if pwStr == "" {
+		return nil, nil
+	}
+	return []byte(pwStr), nil
+}
+
+// HasPassword reports whether the user has a non-empty password.
+func (handler *RedisUserHandler) HasPassword(userName string) (bool, error) {
+	userkey := fmt.Sprintf("%s%v", handler.UserPrefix, userName)
+	pwStr, err := handler.Client.HGet(userkey, "password").Result()
+	if err != nil {
+		if err == redis.Nil {
+			return false, ErrUserNotFound
+		}
+		return false, err
+	}
+	return pwStr != "", nil
+}
+
+// ClearPassword sets the password of the user to the empty string.
+func (handler *RedisUserHandler) ClearPassword(userName string) error {
+	userkey := fmt.Sprintf("%s%v", handler.UserPrefix, userName)
+	exists, existsErr := handler.Client.Exists(userkey).Result()
+	if existsErr != nil {
+		return existsErr
+	} else if exists == 0 {
+		return ErrUserNotFound
+	}
+	return handler.Client.HSet(userkey, "password", "").Err()
+}
+
 func (handler *RedisUserHandler) ListUsers() (map[uint64]string, error) {
 	res := make(map[uint64]string)
 
 	var cursor uint64
 	scanMatch := handler.UserPrefix + "*"
 	for {
-		keys, newCursor, scanErr := handler.Client.Scan(cursor, scanMatch, 0).Result()
+		keys, newCursor, scanErr := handler.Client.Scan(cursor, scanMatch, redisPipelineSize).Result()
 		cursor = newCursor
 		if scanErr != nil {
 			return nil, scanErr
 		}
-		// add all ids for the given key
-		for _, key := range keys {
-			entry, getErr := handler.Client.HMGet(key, "id", "username").Result()
-			if getErr != nil {
+		// get the ids and names of all keys in one pipeline
+		pipe := handler.Client.Pipeline()
+		cmds := make([]*redis.SliceCmd, len(keys))
+		for i, key := range keys {
+			cmds[i] = pipe.HMGet(key, "id", "username")
+		}
+		if len(keys) > 0 {
+			if _, getErr := pipe.Exec(); getErr != nil {
 				return nil, getErr
 			}
+		}
+		// add all ids for the given key
+		for i, key := range keys {
+			entry := cmds[i].Val()
 			if entry[0] == nil {
 				return nil, fmt.Errorf("No valid user information stored for key: %v", key)
 			}
@@ -445,16 +844,88 @@ func (handler *RedisUserHandler) DeleteUser(userName string) error {
 	pipe := handler.Client.TxPipeline()
 	pipe.Del(userkey)
 	pipe.Del(fmt.Sprintf("%s%s", handler.UserIDPrefix, idStr))
-	_, delErr := pipe.Exec()
-	return delErr
+	if _, delErr := pipe.Exec(); delErr != nil {
+		return delErr
+	}
+	return handler.Names.Hold(userName)
+}
+
+// RenameUser changes the username, see UserRenamer. The new name must be
+// allowed by Names, the old name is held.
+//
+// New in version v0.7
+func (handler *RedisUserHandler) RenameUser(oldName, newName string) error {
+	if oldName == newName {
+		return nil
+	}
+	if err := handler.Names.Check(newName); err != nil {
+		return err
+	}
+	id, err := handler.GetUserID(oldName)
+	if err != nil {
+		return err
+	}
+	oldKey := fmt.Sprintf("%s%v", handler.UserPrefix, oldName)
+	newKey := fmt.Sprintf("%s%v", handler.UserPrefix, newName)
+	// RENAMENX fails if the new name is in use
+	renamed, err := handler.Client.RenameNX(oldKey, newKey).Result()
+	if err != nil {
+		return wrapBackendError("redis", "RenameUser", err)
+	}
+	if !renamed {
+		return ErrDuplicateUsername
+	}
+	pipe := handler.Client.TxPipeline()
+	pipe.HSet(newKey, "username", newName)
+	pipe.Set(fmt.Sprintf("%s%d", handler.UserIDPrefix, id), newName, 0)
+	if _, err := pipe.Exec(); err != nil {
+		return wrapBackendError("redis", "RenameUser", err)
+	}
+	return handler.Names.Hold(oldName)
 }
 
 func (handler *RedisUserHandler) GetUserBaseInfo(userName string) (*BaseUserInformation, error) {
 	userkey := fmt.Sprintf("%s%v", handler.UserPrefix, userName)
-	entry, getErr := handler.Client.HMGet(userkey, "id", "firstName", "lastName", "email", "is_active", "last_login").Result()
+	entry, getErr := handler.Client.HMGet(userkey, "id", "firstName", "lastName", "email", "is_active", "last_login", "is_admin", "email_verified", "is_pending",
+		"display_name", "avatar_url", "locale", "timezone").Result()
 	if getErr != nil {
 		return nil, getErr
 	}
+	res, err := parseRedisUser(userName, entry)
+	if err != nil {
+		return nil, err
+	}
+	if err := handler.Encryptor.decryptUser(res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// parseRedisUser parses the result of HMGET id, firstName, lastName, email,
+// is_active, last_login, is_admin, email_verified, is_pending, display_name,
+// avatar_url, locale, timezone.
+func parseRedisUser(userName string, entry []interface{}) (*BaseUserInformation, error) {
+	if len(entry) != 13 {
+		return nil, errors.New("Weird type in redis, should not happen")
+	}
+	// is_admin, email_verified and is_pending are missing for users created
+	// before version v0.7 and for users that were never admins / never verified
+	isAdmin, emailVerified, isPending := false, false, false
+	if adminStr, ok := entry[6].(string); ok {
+		isAdmin, _ = strconv.ParseBool(adminStr)
+	}
+	if verifiedStr, ok := entry[7].(string); ok {
+		emailVerified, _ = strconv.ParseBool(verifiedStr)
+	}
+	if pendingStr, ok := entry[8].(string); ok {
+		isPending, _ = strconv.ParseBool(pendingStr)
+	}
+	// the profile fields are only set if the user has them
+	displayName, _ := entry[9].(string)
+	avatarURL, _ := entry[10].(string)
+	locale, _ := entry[11].(string)
+	timezone, _ := entry[12].(string)
+	entry = entry[:6]
 	// check that every entry is not nil and a string
 	strings := make([]string, len(entry))
 	for i, val := range entry {
@@ -476,13 +947,214 @@ func (handler *RedisUserHandler) GetUserBaseInfo(userName string) (*BaseUserInfo
 	if activeParseErr != nil {
 		return nil, activeParseErr
 	}
-	lastLogin, loginParseErr := time.Parse(RedisDateFormat, strings[5])
+	lastLogin, loginParseErr := parseRedisTime(strings[5])
 	if loginParseErr != nil {
 		return nil, loginParseErr
 	}
-	res := &BaseUserInformation{ID: id, UserName: userName, FirstName: strings[1],
-		LastName: strings[2], Email: strings[3], LastLogin: lastLogin, IsActive: isActive}
-	return res, nil
+	return &BaseUserInformation{ID: id, UserName: userName, FirstName: strings[1],
+		LastName: strings[2], Email: strings[3], LastLogin: lastLogin, IsActive: isActive,
+		IsAdmin: isAdmin, EmailVerified: emailVerified, IsPending: isPending,
+		DisplayName: displayName, AvatarURL: avatarURL, Locale: locale, Timezone: timezone}, nil
+}
+
+// ReencryptPII encrypts the personal information of all users with the
+// current key of the Encryptor, see PIIReencrypter.
+// Returns ErrNotSupported if no Encryptor is set.
+//
+// New in version v0.7
+func (handler *RedisUserHandler) ReencryptPII() (int, error) {
+	if handler.Encryptor == nil {
+		return 0, ErrNotSupported
+	}
+	users, err := handler.ListUsers()
+	if err != nil {
+		return 0, err
+	}
+	updated := 0
+	for _, userName := range users {
+		userkey := fmt.Sprintf("%s%v", handler.UserPrefix, userName)
+		entry, getErr := handler.Client.HMGet(userkey, "firstName", "lastName", "email").Result()
+		if getErr != nil {
+			return updated, wrapBackendError("redis", "ReencryptPII", getErr)
+		}
+		values := make([]string, len(entry))
+		for i, val := range entry {
+			if val == nil {
+				continue
+			}
+			asStr, strOK := val.(string)
+			if !strOK {
+				return updated, errors.New("Weird type in redis, should not happen")
+			}
+			values[i] = asStr
+		}
+		firstName, lastName, email, changed, encErr := handler.Encryptor.reencryptUser(values[0], values[1], values[2])
+		if encErr != nil {
+			return updated, fmt.Errorf("goauth: re-encrypting user %s: %w", userName, encErr)
+		}
+		if !changed {
+			continue
+		}
+		setErr := handler.Client.HMSet(userkey, map[string]interface{}{
+			"firstName": firstName,
+			"lastName":  lastName,
+			"email":     email,
+		}).Err()
+		if setErr != nil {
+			return updated, wrapBackendError("redis", "ReencryptPII", setErr)
+		}
+		updated++
+	}
+	return updated, nil
+}
+
+// SetAdmin sets the admin flag of the user, see AdminFlagHandler.
+//
+// New in version v0.7
+func (handler *RedisUserHandler) SetAdmin(userName string, admin bool) error {
+	userkey := fmt.Sprintf("%s%v", handler.UserPrefix, userName)
+	exists, err := handler.Client.Exists(userkey).Result()
+	if err != nil {
+		return err
+	}
+	if exists == 0 {
+		return ErrUserNotFound
+	}
+	return handler.Client.HSet(userkey, "is_admin", strconv.FormatBool(admin)).Err()
+}
+
+// SetEmailVerified sets the email_verified flag of the user, see
+// EmailVerifiedHandler.
+//
+// New in version v0.7
+func (handler *RedisUserHandler) SetEmailVerified(userName string, verified bool) error {
+	userkey := fmt.Sprintf("%s%v", handler.UserPrefix, userName)
+	exists, err := handler.Client.Exists(userkey).Result()
+	if err != nil {
+		return err
+	}
+	if exists == 0 {
+		return ErrUserNotFound
+	}
+	return handler.Client.HSet(userkey, "email_verified", strconv.FormatBool(verified)).Err()
+}
+
+// CompleteRegistration sets the profile of a pending user and completes the
+// registration, see PendingUserHandler.
+//
+// New in version v0.7
+func (handler *RedisUserHandler) CompleteRegistration(userName, firstName, lastName string) error {
+	firstName, lastName, _, err := handler.Encryptor.encryptUser(firstName, lastName, "")
+	if err != nil {
+		return err
+	}
+	userkey := fmt.Sprintf("%s%v", handler.UserPrefix, userName)
+	exists, err := handler.Client.Exists(userkey).Result()
+	if err != nil {
+		return err
+	}
+	if exists == 0 {
+		return ErrUserNotFound
+	}
+	return handler.Client.HMSet(userkey, map[string]interface{}{
+		"firstName":  firstName,
+		"lastName":   lastName,
+		"is_pending": false,
+	}).Err()
+}
+
+// SetActive sets the is_active flag of the user, see ActiveFlagHandler.
+//
+// New in version v0.7
+func (handler *RedisUserHandler) SetActive(userName string, active bool) error {
+	userkey := fmt.Sprintf("%s%v", handler.UserPrefix, userName)
+	exists, err := handler.Client.Exists(userkey).Result()
+	if err != nil {
+		return err
+	}
+	if exists == 0 {
+		return ErrUserNotFound
+	}
+	return handler.Client.HSet(userkey, "is_active", strconv.FormatBool(active)).Err()
+}
+
+// SetDisplayName sets the display name of the user, see ProfileHandler.
+//
+// New in version v0.7
+func (handler *RedisUserHandler) SetDisplayName(userName, displayName string) error {
+	if err := CheckDisplayName(displayName); err != nil {
+		return err
+	}
+	return handler.setProfileField(userName, "display_name", displayName)
+}
+
+// SetAvatarURL sets the avatar url of the user, see ProfileHandler.
+//
+// New in version v0.7
+func (handler *RedisUserHandler) SetAvatarURL(userName, avatarURL string) error {
+	if err := CheckAvatarURL(avatarURL); err != nil {
+		return err
+	}
+	return handler.setProfileField(userName, "avatar_url", avatarURL)
+}
+
+// SetLocale sets the locale of the user, see LocaleHandler.
+//
+// New in version v0.7
+func (handler *RedisUserHandler) SetLocale(userName, locale string) error {
+	locale, err := NormalizeLocale(locale)
+	if err != nil {
+		return err
+	}
+	return handler.setProfileField(userName, "locale", locale)
+}
+
+// SetTimezone sets the timezone of the user, see LocaleHandler.
+//
+// New in version v0.7
+func (handler *RedisUserHandler) SetTimezone(userName, timezone string) error {
+	if err := CheckTimezone(timezone); err != nil {
+		return err
+	}
+	return handler.setProfileField(userName, "timezone", timezone)
+}
+
+// setProfileField sets the field of the user hash, the empty string removes
+// the field.
+func (handler *RedisUserHandler) setProfileField(userName, field, value string) error {
+	userkey := fmt.Sprintf("%s%v", handler.UserPrefix, userName)
+	exists, err := handler.Client.Exists(userkey).Result()
+	if err != nil {
+		return err
+	}
+	if exists == 0 {
+		return ErrUserNotFound
+	}
+	if value == "" {
+		return handler.Client.HDel(userkey, field).Err()
+	}
+	return handler.Client.HSet(userkey, field, value).Err()
+}
+
+// SetEmail sets the email address of the user, see EmailVerifiedHandler.
+//
+// New in version v0.7
+func (handler *RedisUserHandler) SetEmail(userName, email string, verified bool) error {
+	userkey := fmt.Sprintf("%s%v", handler.UserPrefix, userName)
+	exists, err := handler.Client.Exists(userkey).Result()
+	if err != nil {
+		return err
+	}
+	if exists == 0 {
+		return ErrUserNotFound
+	}
+	if email, err = handler.Encryptor.encryptEmail(email); err != nil {
+		return err
+	}
+	return handler.Client.HMSet(userkey, map[string]interface{}{
+		"email":          email,
+		"email_verified": strconv.FormatBool(verified),
+	}).Err()
 }
 
 func (handler *RedisUserHandler) GetUserID(userName string) (uint64, error) {
@@ -0,0 +1,93 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package goauth
+
+import (
+	"database/sql"
+	"sync/atomic"
+	"time"
+)
+
+// ReadReplica routes the read queries of a SQL handler (GetData,
+// Validate, ListUsers etc.) to a replica of the database, all writes still go
+// to the DB of the handler. See SQLSessionHandler.Replica and
+// SQLUserHandler.Replica.
+//
+// Replicas usually lag behind the primary, so a session that was just created
+// might not be found on the replica. Set PrimaryAfterWrite to the expected
+// replication lag: For this duration after a write of the handler all reads
+// are sent to the primary. Writes are tracked by the ReadReplica, so if
+// several handlers share one instance a write of one handler affects the
+// reads of all of them.
+//
+// Prepared statements (PrepareStatements) are only prepared on the primary,
+// queries on the replica always use the query strings.
+//
+// New in version v0.7
+type ReadReplica struct {
+	// DB is the replica.
+	DB *sql.DB
+
+	// PrimaryAfterWrite is the duration after a write during which reads are
+	// sent to the primary, 0 sends all reads to the replica.
+	PrimaryAfterWrite time.Duration
+
+	// lastWrite is the time of the last write in nanoseconds since the epoch.
+	lastWrite int64
+}
+
+// NewReadReplica returns a new ReadReplica for db.
+//
+// New in version v0.7
+func NewReadReplica(db *sql.DB, primaryAfterWrite time.Duration) *ReadReplica {
+	return &ReadReplica{DB: db, PrimaryAfterWrite: primaryAfterWrite}
+}
+
+// wrote records a write, it's safe to call on nil.
+func (r *ReadReplica) wrote() {
+	if r == nil || r.PrimaryAfterWrite <= 0 {
+		return
+	}
+	atomic.StoreInt64(&r.lastWrite, time.Now().UnixNano())
+}
+
+// UsePrimary returns true if reads should be sent to the primary, that is if
+// r is nil or there was a write within PrimaryAfterWrite.
+func (r *ReadReplica) UsePrimary() bool {
+	if r == nil {
+		return true
+	}
+	if r.PrimaryAfterWrite <= 0 {
+		return false
+	}
+	last := atomic.LoadInt64(&r.lastWrite)
+	return last != 0 && time.Since(time.Unix(0, last)) < r.PrimaryAfterWrite
+}
+
+// readConn returns the connection and statement to use for a read query,
+// stmt is the prepared statement on primary (may be nil).
+func (r *ReadReplica) readConn(primary *sql.DB, stmt *sql.Stmt) (sqlConn, *sql.Stmt) {
+	if r.UsePrimary() {
+		return primary, stmt
+	}
+	return r.DB, nil
+}
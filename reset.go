@@ -0,0 +1,241 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PasswordResetPurpose is the purpose of password reset tokens in a
+// OneTimeTokenStore.
+const PasswordResetPurpose = "password_reset"
+
+// PasswordResetManager implements the "forgot password" flow:
+// CreateResetToken creates a token for a user that must be delivered to the
+// user (usually by email), ResetPassword sets a new password if the token is
+// valid. Tokens are single-use and only their hashes are stored.
+// After a reset all sessions of the user are deleted.
+//
+// Usage:
+//
+//	m := goauth.NewPasswordResetManager(users, controller, goauth.NewMySQLOneTimeTokenStore(db))
+//	m.Deliver = func(info *goauth.BaseUserInformation, token string) error {
+//		// send a link containing the token to info.Email
+//	}
+//	http.HandleFunc("/password/forgot", m.ServeRequestReset)
+//	http.HandleFunc("/password/reset", m.ServeResetPassword)
+//
+// New in version v0.7
+type PasswordResetManager struct {
+	Users      UserHandler
+	Controller *SessionController
+	Tokens     OneTimeTokenStore
+
+	// TTL is the time a token is valid, defaults to one hour.
+	TTL time.Duration
+
+	// Notifier is informed about changed passwords, may be nil.
+	Notifier SecurityNotifier
+
+	// Deliver sends the token to the user, it's called by
+	// ServeRequestReset. AuthMailer.SendPasswordReset sends it by email.
+	Deliver func(info *BaseUserInformation, token string) error
+
+	// Render and RenderError write the responses of the handlers, they
+	// default to RenderJSON and RenderJSONError.
+	Render      func(w http.ResponseWriter, r *http.Request, status int, value interface{})
+	RenderError func(w http.ResponseWriter, r *http.Request, status int, err error)
+}
+
+// NewPasswordResetManager returns a new PasswordResetManager with a TTL of
+// one hour that renders JSON.
+func NewPasswordResetManager(users UserHandler, controller *SessionController, tokens OneTimeTokenStore) *PasswordResetManager {
+	return &PasswordResetManager{Users: users, Controller: controller,
+		Tokens: tokens, TTL: time.Hour, Render: RenderJSON,
+		RenderError: RenderJSONError}
+}
+
+// CreateResetToken creates a new reset token for the user, all older reset
+// tokens of the user are invalidated.
+// Returns ErrUserNotFound if the user doesn't exist.
+func (m *PasswordResetManager) CreateResetToken(userName string) (string, error) {
+	id, err := m.Users.GetUserID(userName)
+	if err != nil {
+		return "", err
+	}
+	subject := userSubject(id)
+	if _, err := m.Tokens.DeleteTokens(PasswordResetPurpose, subject); err != nil {
+		return "", err
+	}
+	return IssueOneTimeToken(m.Tokens, PasswordResetPurpose, subject, "", m.TTL)
+}
+
+// VerifyToken checks if the token is valid without using it and returns the
+// id and name of the user. Returns ErrTokenNotFound if the token is invalid.
+func (m *PasswordResetManager) VerifyToken(token string) (uint64, string, error) {
+	entry, err := VerifyOneTimeToken(m.Tokens, PasswordResetPurpose, token)
+	if err != nil {
+		return NoUserID, "", err
+	}
+	return m.tokenUser(entry)
+}
+
+func (m *PasswordResetManager) tokenUser(entry *OneTimeToken) (uint64, string, error) {
+	id, err := subjectUserID(entry.Subject)
+	if err != nil {
+		return NoUserID, "", ErrTokenNotFound
+	}
+	userName, err := m.Users.GetUserName(id)
+	if err != nil {
+		return NoUserID, "", err
+	}
+	return id, userName, nil
+}
+
+// ResetPassword uses the token to set the new password and deletes all
+// sessions of the user. It returns the id and name of the user and the
+// number of deleted sessions.
+// Returns ErrTokenNotFound if the token is invalid or was already used.
+func (m *PasswordResetManager) ResetPassword(token string, plainPW []byte) (uint64, string, int64, error) {
+	entry, err := ConsumeOneTimeToken(m.Tokens, PasswordResetPurpose, token)
+	if err != nil {
+		return NoUserID, "", -1, err
+	}
+	id, userName, err := m.tokenUser(entry)
+	if err != nil {
+		return NoUserID, "", -1, err
+	}
+	if err := m.Users.UpdatePassword(userName, plainPW); err != nil {
+		return id, userName, -1, err
+	}
+	if m.Notifier != nil {
+		m.Notifier.Notify(NewSecurityEvent(EventPasswordChanged, id, userName))
+	}
+	num, err := m.Controller.RevokeEntriesForUser(id, ReasonPasswordChanged)
+	if err != nil {
+		return id, userName, -1, err
+	}
+	return id, userName, num, nil
+}
+
+// PasswordResetRequest is the request accepted by the handlers of
+// PasswordResetManager, either as JSON or as form.
+type PasswordResetRequest struct {
+	UserName string `json:"username"`
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+func parseTokenRequest(r *http.Request) (*PasswordResetRequest, error) {
+	res := &PasswordResetRequest{}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		if err := json.NewDecoder(r.Body).Decode(res); err != nil {
+			return nil, err
+		}
+		return res, nil
+	}
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+	res.UserName = r.PostFormValue("username")
+	res.Token = r.PostFormValue("token")
+	res.Password = r.PostFormValue("password")
+	return res, nil
+}
+
+// ServeRequestReset creates a reset token for the username in the request
+// and passes it to Deliver.
+// The response is always 202 Accepted, also if the user doesn't exist, so
+// the handler can't be used to find out which users exist. Errors are
+// logged.
+func (m *PasswordResetManager) ServeRequestReset(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r, m.RenderError) {
+		return
+	}
+	req, err := parseTokenRequest(r)
+	if err != nil {
+		m.RenderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if req.UserName == "" {
+		m.RenderError(w, r, http.StatusBadRequest, errors.New("Username is required."))
+		return
+	}
+	if err := m.requestReset(req.UserName); err != nil && err != ErrUserNotFound {
+		log.WithError(err).WithField("user", req.UserName).Error("goauth: Can't create password reset token")
+	}
+	m.Render(w, r, http.StatusAccepted, &AuthResponse{Status: "accepted"})
+}
+
+func (m *PasswordResetManager) requestReset(userName string) error {
+	info, err := m.Users.GetUserBaseInfo(userName)
+	if err != nil {
+		return err
+	}
+	if !info.IsActive {
+		return nil
+	}
+	token, err := m.CreateResetToken(userName)
+	if err != nil {
+		return err
+	}
+	if m.Deliver == nil {
+		return errors.New("No delivery function for password reset tokens set.")
+	}
+	return m.Deliver(info, token)
+}
+
+// ServeResetPassword sets the new password for the token in the request.
+// An invalid token results in 400 Bad Request.
+func (m *PasswordResetManager) ServeResetPassword(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r, m.RenderError) {
+		return
+	}
+	req, err := parseTokenRequest(r)
+	if err != nil {
+		m.RenderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if req.Token == "" || req.Password == "" {
+		m.RenderError(w, r, http.StatusBadRequest, errors.New("Token and password are required."))
+		return
+	}
+	id, userName, num, err := m.ResetPassword(req.Token, []byte(req.Password))
+	switch {
+	case err == ErrTokenNotFound || err == ErrUserNotFound:
+		m.RenderError(w, r, http.StatusBadRequest, ErrTokenNotFound)
+		return
+	case err != nil:
+		m.RenderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	m.Render(w, r, http.StatusOK, &AuthResponse{Status: "ok", UserID: id,
+		UserName: userName, Deleted: num})
+}
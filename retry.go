@@ -0,0 +1,242 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math/rand"
+	"net"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	log "github.com/sirupsen/logrus"
+)
+
+// IsTransientError reports whether err is a temporary failure that is likely
+// to succeed if the operation is retried: MySQL deadlocks and lock wait
+// timeouts (errors 1213 and 1205), postgres serialization failures and
+// deadlocks (SQLSTATE 40001 and 40P01), sqlite3 "database is locked"
+// errors, redis LOADING, BUSY, TRYAGAIN and CLUSTERDOWN errors and network
+// timeouts.
+// Like IsDuplicateKeyError the drivers are not imported.
+//
+// New in version v0.7
+func IsTransientError(err error) bool {
+	for ; err != nil; err = errors.Unwrap(err) {
+		v := reflect.ValueOf(err)
+		if v.Kind() == reflect.Ptr {
+			v = v.Elem()
+		}
+		if v.Kind() == reflect.Struct {
+			// github.com/go-sql-driver/mysql.MySQLError
+			if f := v.FieldByName("Number"); f.IsValid() && f.CanUint() && (f.Uint() == 1213 || f.Uint() == 1205) {
+				return true
+			}
+			// github.com/lib/pq.Error and github.com/jackc/pgx PgError
+			if f := v.FieldByName("Code"); f.IsValid() && f.Kind() == reflect.String && (f.String() == "40001" || f.String() == "40P01") {
+				return true
+			}
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return true
+		}
+		msg := err.Error()
+		if strings.Contains(msg, "database is locked") {
+			return true
+		}
+		for _, prefix := range []string{"LOADING ", "BUSY ", "TRYAGAIN ", "CLUSTERDOWN "} {
+			if strings.HasPrefix(msg, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RetryPolicy retries operations that failed with a transient error, the
+// delay between two attempts grows exponentially and is randomized by
+// Jitter.
+// A nil *RetryPolicy executes operations only once.
+//
+// Set it as Retry of SQLSessionHandler and SQLUserHandler, for redis use
+// EnableRedisRetries.
+//
+// New in version v0.7
+type RetryPolicy struct {
+	// MaxRetries is the number of retries after the first attempt.
+	MaxRetries int
+
+	// InitialBackoff is the delay before the first retry, it's doubled for
+	// each retry but never exceeds MaxBackoff (if MaxBackoff > 0).
+	InitialBackoff, MaxBackoff time.Duration
+
+	// Jitter randomizes the delay by up to this fraction (between 0 and 1),
+	// so clients don't retry in lockstep.
+	Jitter float64
+
+	// IsRetriable decides which errors are retried, defaults to
+	// IsTransientError.
+	IsRetriable func(err error) bool
+}
+
+// NewRetryPolicy returns a policy with the given number of retries, the
+// backoff starts with 10 milliseconds and is limited to one second, the
+// jitter is 0.2.
+func NewRetryPolicy(maxRetries int) *RetryPolicy {
+	return &RetryPolicy{MaxRetries: maxRetries, InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff: time.Second, Jitter: 0.2, IsRetriable: IsTransientError}
+}
+
+func (p *RetryPolicy) retriable(err error) bool {
+	if p.IsRetriable == nil {
+		return IsTransientError(err)
+	}
+	return p.IsRetriable(err)
+}
+
+// backoff returns the delay before the given retry (starting with 0).
+func (p *RetryPolicy) backoff(retry int) time.Duration {
+	delay := p.InitialBackoff
+	for i := 0; i < retry; i++ {
+		delay *= 2
+		if p.MaxBackoff > 0 && delay >= p.MaxBackoff {
+			delay = p.MaxBackoff
+			break
+		}
+	}
+	if p.Jitter > 0 {
+		delay += time.Duration((rand.Float64()*2 - 1) * p.Jitter * float64(delay))
+	}
+	return delay
+}
+
+// Do executes f until it succeeds, returns an error that is not retriable
+// or the retries are exhausted. It returns the last error.
+func (p *RetryPolicy) Do(f func() error) error {
+	err := f()
+	if p == nil {
+		return err
+	}
+	for retry := 0; retry < p.MaxRetries && err != nil && p.retriable(err); retry++ {
+		log.WithError(err).WithField("retry", retry+1).Debug("goauth: Retrying after transient error")
+		time.Sleep(p.backoff(retry))
+		err = f()
+	}
+	return err
+}
+
+// EnableRedisRetries wraps the commands of the client so they're retried
+// according to the policy, use it on the client of RedisSessionHandler and
+// RedisUserHandler. Pipelines are not retried.
+// Note that a command is also retried after a timeout, so commands like
+// INCR may be executed twice.
+//
+// New in version v0.7
+func EnableRedisRetries(client *redis.Client, policy *RetryPolicy) {
+	client.WrapProcess(func(old func(cmd redis.Cmder) error) func(cmd redis.Cmder) error {
+		return func(cmd redis.Cmder) error {
+			return policy.Do(func() error {
+				return old(cmd)
+			})
+		}
+	})
+}
+
+// sqlConn is implemented by *sql.DB and *sql.Tx, the retry functions accept
+// both.
+type sqlConn interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// retryRow is a row that executes the query (again) when Scan is called, so
+// the query can be retried. Each attempt runs with the timeout, see
+// OperationTimeoutHandler. If stmt is not nil it's used instead of the
+// query.
+type retryRow struct {
+	policy  *RetryPolicy
+	timeout time.Duration
+	db      sqlConn
+	stmt    *sql.Stmt
+	query   string
+	args    []interface{}
+}
+
+func (r retryRow) Scan(dest ...interface{}) error {
+	return r.policy.Do(func() error {
+		ctx, cancel := operationContext(context.Background(), r.timeout)
+		defer cancel()
+		if r.stmt != nil {
+			return r.stmt.QueryRowContext(ctx, r.args...).Scan(dest...)
+		}
+		return r.db.QueryRowContext(ctx, r.query, r.args...).Scan(dest...)
+	})
+}
+
+// retryExec executes db.Exec (or stmt.Exec if stmt is not nil) with the
+// policy, each attempt runs with the timeout.
+func retryExec(policy *RetryPolicy, timeout time.Duration, db sqlConn, stmt *sql.Stmt, query string, args ...interface{}) (sql.Result, error) {
+	var res sql.Result
+	err := policy.Do(func() (err error) {
+		ctx, cancel := operationContext(context.Background(), timeout)
+		defer cancel()
+		if stmt != nil {
+			res, err = stmt.ExecContext(ctx, args...)
+		} else {
+			res, err = db.ExecContext(ctx, query, args...)
+		}
+		return
+	})
+	return res, err
+}
+
+// retryQuery executes db.Query (or stmt.Query if stmt is not nil) with the
+// policy, only the query is retried and not errors while reading the rows.
+// The timeout includes reading the rows, the context is cancelled when the
+// rows are closed.
+func retryQuery(policy *RetryPolicy, timeout time.Duration, db sqlConn, stmt *sql.Stmt, query string, args ...interface{}) (timeoutRows, error) {
+	var res timeoutRows
+	err := policy.Do(func() error {
+		ctx, cancel := operationContext(context.Background(), timeout)
+		var rows *sql.Rows
+		var err error
+		if stmt != nil {
+			rows, err = stmt.QueryContext(ctx, args...)
+		} else {
+			rows, err = db.QueryContext(ctx, query, args...)
+		}
+		if err != nil {
+			cancel()
+			return err
+		}
+		res = timeoutRows{Rows: rows, cancel: cancel}
+		return nil
+	})
+	return res, err
+}
@@ -0,0 +1,579 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	log "github.com/sirupsen/logrus"
+)
+
+// RoleHandler stores the roles of users and the permissions granted to
+// roles.
+// Roles and permissions are simple names. Permissions are namespaced by
+// dots, for example "billing.invoices.read". A permission granted to a role
+// can be a pattern: "billing.*" grants all permissions in the namespace
+// billing and "*" grants everything, see MatchPermission.
+//
+// Use a PermissionChecker to check permissions of a user.
+//
+// New in version v0.7
+type RoleHandler interface {
+	// Init initializes the storage, see UserHandler.
+	Init() error
+
+	// AssignRole gives the user a role, assigning a role twice is not an
+	// error.
+	AssignRole(user uint64, role string) error
+
+	// RevokeRole removes a role from the user.
+	RevokeRole(user uint64, role string) error
+
+	// UserRoles returns the roles of the user.
+	UserRoles(user uint64) ([]string, error)
+
+	// GrantPermission grants a permission (pattern) to a role.
+	GrantPermission(role, permission string) error
+
+	// RevokePermission removes a permission (pattern) from a role.
+	RevokePermission(role, permission string) error
+
+	// RolePermissions returns the permissions granted to the role.
+	RolePermissions(role string) ([]string, error)
+}
+
+// MatchPermission reports whether the granted permission (pattern) matches
+// the requested permission.
+// The pattern "*" matches all permissions, a pattern ending with ".*" matches
+// all permissions in that namespace (including sub-namespaces), so
+// "billing.*" matches "billing.read" and "billing.invoices.read" but not
+// "billing" itself. All other patterns must be equal to permission.
+//
+// New in version v0.7
+func MatchPermission(pattern, permission string) bool {
+	if pattern == "*" || pattern == permission {
+		return true
+	}
+	if strings.HasSuffix(pattern, ".*") {
+		return strings.HasPrefix(permission, pattern[:len(pattern)-1])
+	}
+	return false
+}
+
+// InMemoryRoleHandler is a RoleHandler that keeps everything in memory.
+//
+// New in version v0.7
+type InMemoryRoleHandler struct {
+	mutex       sync.RWMutex
+	roles       map[uint64]map[string]struct{}
+	permissions map[string]map[string]struct{}
+}
+
+// NewInMemoryRoleHandler returns a new InMemoryRoleHandler.
+func NewInMemoryRoleHandler() *InMemoryRoleHandler {
+	return &InMemoryRoleHandler{roles: make(map[uint64]map[string]struct{}),
+		permissions: make(map[string]map[string]struct{})}
+}
+
+func (h *InMemoryRoleHandler) Init() error {
+	return nil
+}
+
+func (h *InMemoryRoleHandler) AssignRole(user uint64, role string) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.roles[user] == nil {
+		h.roles[user] = make(map[string]struct{})
+	}
+	h.roles[user][role] = struct{}{}
+	return nil
+}
+
+func (h *InMemoryRoleHandler) RevokeRole(user uint64, role string) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	delete(h.roles[user], role)
+	return nil
+}
+
+func (h *InMemoryRoleHandler) UserRoles(user uint64) ([]string, error) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return sortedKeys(h.roles[user]), nil
+}
+
+func (h *InMemoryRoleHandler) GrantPermission(role, permission string) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.permissions[role] == nil {
+		h.permissions[role] = make(map[string]struct{})
+	}
+	h.permissions[role][permission] = struct{}{}
+	return nil
+}
+
+func (h *InMemoryRoleHandler) RevokePermission(role, permission string) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	delete(h.permissions[role], permission)
+	return nil
+}
+
+func (h *InMemoryRoleHandler) RolePermissions(role string) ([]string, error) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return sortedKeys(h.permissions[role]), nil
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	res := make([]string, 0, len(m))
+	for key := range m {
+		res = append(res, key)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// SQLRoleQueries stores the queries for SQLRoleHandler.
+// There are two tables: user_roles (user_id, role) and role_permissions
+// (role, permission).
+//
+// New in version v0.7
+type SQLRoleQueries struct {
+	InitRolesQuery, InitPermissionsQuery, AssignQuery, RevokeQuery,
+	UserRolesQuery, GrantQuery, RevokePermissionQuery, RolePermissionsQuery string
+}
+
+// MySQLRoleQueries provides queries to use with MySQL.
+func MySQLRoleQueries() *SQLRoleQueries {
+	initRolesQ := `
+	CREATE TABLE IF NOT EXISTS user_roles (
+		user_id BIGINT UNSIGNED NOT NULL,
+		role VARCHAR(100) NOT NULL,
+		PRIMARY KEY(user_id, role)
+	);
+	`
+	initPermissionsQ := `
+	CREATE TABLE IF NOT EXISTS role_permissions (
+		role VARCHAR(100) NOT NULL,
+		permission VARCHAR(150) NOT NULL,
+		PRIMARY KEY(role, permission)
+	);
+	`
+	return &SQLRoleQueries{InitRolesQuery: initRolesQ, InitPermissionsQuery: initPermissionsQ,
+		AssignQuery:           "INSERT IGNORE INTO user_roles (user_id, role) VALUES(?, ?)",
+		RevokeQuery:           "DELETE FROM user_roles WHERE user_id=? AND role=?",
+		UserRolesQuery:        "SELECT role FROM user_roles WHERE user_id=? ORDER BY role",
+		GrantQuery:            "INSERT IGNORE INTO role_permissions (role, permission) VALUES(?, ?)",
+		RevokePermissionQuery: "DELETE FROM role_permissions WHERE role=? AND permission=?",
+		RolePermissionsQuery:  "SELECT permission FROM role_permissions WHERE role=? ORDER BY permission"}
+}
+
+// PostgresRoleQueries provides queries to use with postgres.
+func PostgresRoleQueries() *SQLRoleQueries {
+	initRolesQ := `
+	CREATE TABLE IF NOT EXISTS user_roles (
+		user_id bigint NOT NULL,
+		role varchar(100) NOT NULL,
+		PRIMARY KEY(user_id, role)
+	);
+	`
+	initPermissionsQ := `
+	CREATE TABLE IF NOT EXISTS role_permissions (
+		role varchar(100) NOT NULL,
+		permission varchar(150) NOT NULL,
+		PRIMARY KEY(role, permission)
+	);
+	`
+	return &SQLRoleQueries{InitRolesQuery: initRolesQ, InitPermissionsQuery: initPermissionsQ,
+		AssignQuery:           "INSERT INTO user_roles (user_id, role) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+		RevokeQuery:           "DELETE FROM user_roles WHERE user_id = $1 AND role = $2",
+		UserRolesQuery:        "SELECT role FROM user_roles WHERE user_id = $1 ORDER BY role",
+		GrantQuery:            "INSERT INTO role_permissions (role, permission) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+		RevokePermissionQuery: "DELETE FROM role_permissions WHERE role = $1 AND permission = $2",
+		RolePermissionsQuery:  "SELECT permission FROM role_permissions WHERE role = $1 ORDER BY permission"}
+}
+
+// SQLite3RoleQueries provides queries to use with sqlite3.
+func SQLite3RoleQueries() *SQLRoleQueries {
+	res := MySQLRoleQueries()
+	res.AssignQuery = "INSERT OR IGNORE INTO user_roles (user_id, role) VALUES(?, ?)"
+	res.GrantQuery = "INSERT OR IGNORE INTO role_permissions (role, permission) VALUES(?, ?)"
+	return res
+}
+
+// SQLRoleHandler implements RoleHandler by executing the queries defined in
+// an instance of SQLRoleQueries.
+//
+// New in version v0.7
+type SQLRoleHandler struct {
+	*SQLRoleQueries
+
+	// DB is the database to execute the queries on.
+	DB *sql.DB
+
+	blockDB bool
+	mutex   sync.RWMutex
+
+	// set by WithTx
+	tx *sql.Tx
+}
+
+// NewSQLRoleHandler returns a new SQLRoleHandler, blockDB has the same
+// meaning as in NewSQLUserHandler.
+func NewSQLRoleHandler(queries *SQLRoleQueries, db *sql.DB, blockDB bool) *SQLRoleHandler {
+	return &SQLRoleHandler{SQLRoleQueries: queries, DB: db, blockDB: blockDB}
+}
+
+// NewMySQLRoleHandler returns a new SQLRoleHandler that uses MySQL.
+func NewMySQLRoleHandler(db *sql.DB) *SQLRoleHandler {
+	return NewSQLRoleHandler(MySQLRoleQueries(), db, false)
+}
+
+// NewPostgresRoleHandler returns a new SQLRoleHandler that uses postgres.
+func NewPostgresRoleHandler(db *sql.DB) *SQLRoleHandler {
+	return NewSQLRoleHandler(PostgresRoleQueries(), db, false)
+}
+
+// NewSQLite3RoleHandler returns a new SQLRoleHandler that uses sqlite3.
+func NewSQLite3RoleHandler(db *sql.DB) *SQLRoleHandler {
+	return NewSQLRoleHandler(SQLite3RoleQueries(), db, true)
+}
+
+func (handler *SQLRoleHandler) Init() error {
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	if _, err := handler.DB.Exec(handler.InitRolesQuery); err != nil {
+		return err
+	}
+	_, err := handler.DB.Exec(handler.InitPermissionsQuery)
+	return err
+}
+
+// WithTx returns a handler that executes all queries in the transaction tx,
+// see SQLUserHandler.WithTx. Committing or rolling back tx is up to the
+// caller.
+//
+// New in version v0.7
+func (handler *SQLRoleHandler) WithTx(tx *sql.Tx) *SQLRoleHandler {
+	return &SQLRoleHandler{SQLRoleQueries: handler.SQLRoleQueries, DB: handler.DB, tx: tx}
+}
+
+// conn returns the transaction set by WithTx or DB.
+func (handler *SQLRoleHandler) conn() sqlConn {
+	if handler.tx != nil {
+		return handler.tx
+	}
+	return handler.DB
+}
+
+func (handler *SQLRoleHandler) exec(query string, args ...interface{}) error {
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	_, err := handler.conn().ExecContext(context.Background(), query, args...)
+	return wrapBackendError("sql", "RoleHandler", err)
+}
+
+func (handler *SQLRoleHandler) queryStrings(query string, args ...interface{}) ([]string, error) {
+	if handler.blockDB {
+		handler.mutex.RLock()
+		defer handler.mutex.RUnlock()
+	}
+	rows, err := handler.conn().QueryContext(context.Background(), query, args...)
+	if err != nil {
+		return nil, wrapBackendError("sql", "RoleHandler", err)
+	}
+	defer rows.Close()
+	res := make([]string, 0)
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		res = append(res, value)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (handler *SQLRoleHandler) AssignRole(user uint64, role string) error {
+	return handler.exec(handler.AssignQuery, user, role)
+}
+
+func (handler *SQLRoleHandler) RevokeRole(user uint64, role string) error {
+	return handler.exec(handler.RevokeQuery, user, role)
+}
+
+func (handler *SQLRoleHandler) UserRoles(user uint64) ([]string, error) {
+	return handler.queryStrings(handler.UserRolesQuery, user)
+}
+
+func (handler *SQLRoleHandler) GrantPermission(role, permission string) error {
+	return handler.exec(handler.GrantQuery, role, permission)
+}
+
+func (handler *SQLRoleHandler) RevokePermission(role, permission string) error {
+	return handler.exec(handler.RevokePermissionQuery, role, permission)
+}
+
+func (handler *SQLRoleHandler) RolePermissions(role string) ([]string, error) {
+	return handler.queryStrings(handler.RolePermissionsQuery, role)
+}
+
+// RedisRoleHandler is a RoleHandler using redis sets: the roles of a user
+// are stored in "roles:<id>" and the permissions of a role in
+// "permissions:<role>".
+//
+// New in version v0.7
+type RedisRoleHandler struct {
+	// Client is the client to connect to redis.
+	Client *redis.Client
+
+	// RolesPrefix and PermissionsPrefix are the prefixes of the sets,
+	// default to "roles:" and "permissions:".
+	RolesPrefix, PermissionsPrefix string
+}
+
+// NewRedisRoleHandler returns a new RedisRoleHandler.
+func NewRedisRoleHandler(client *redis.Client) *RedisRoleHandler {
+	return &RedisRoleHandler{Client: client, RolesPrefix: "roles:", PermissionsPrefix: "permissions:"}
+}
+
+// Init is a NOOP for redis.
+func (handler *RedisRoleHandler) Init() error {
+	return nil
+}
+
+func (handler *RedisRoleHandler) rolesKey(user uint64) string {
+	return handler.RolesPrefix + strconv.FormatUint(user, 10)
+}
+
+func (handler *RedisRoleHandler) AssignRole(user uint64, role string) error {
+	return handler.Client.SAdd(handler.rolesKey(user), role).Err()
+}
+
+func (handler *RedisRoleHandler) RevokeRole(user uint64, role string) error {
+	return handler.Client.SRem(handler.rolesKey(user), role).Err()
+}
+
+func (handler *RedisRoleHandler) UserRoles(user uint64) ([]string, error) {
+	res, err := handler.Client.SMembers(handler.rolesKey(user)).Result()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+func (handler *RedisRoleHandler) GrantPermission(role, permission string) error {
+	return handler.Client.SAdd(handler.PermissionsPrefix+role, permission).Err()
+}
+
+func (handler *RedisRoleHandler) RevokePermission(role, permission string) error {
+	return handler.Client.SRem(handler.PermissionsPrefix+role, permission).Err()
+}
+
+func (handler *RedisRoleHandler) RolePermissions(role string) ([]string, error) {
+	res, err := handler.Client.SMembers(handler.PermissionsPrefix + role).Result()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// cachedPermissions are the roles and permissions of a user stored in the
+// PermissionChecker cache.
+type cachedPermissions struct {
+	roles      map[string]struct{}
+	exact      map[string]struct{}
+	patterns   []string
+	validUntil time.Time
+}
+
+// PermissionChecker checks the permissions of users given the roles and
+// permissions stored in a RoleHandler.
+// The roles and permissions of a user are cached for CacheDuration, call
+// Invalidate / InvalidateAll after changing roles or permissions if changes
+// must take effect immediately.
+//
+// New in version v0.7
+type PermissionChecker struct {
+	// Roles is the handler the roles and permissions are read from.
+	Roles RoleHandler
+
+	// CacheDuration is the time the permissions of a user are cached,
+	// defaults to one minute. Set to 0 to disable the cache.
+	CacheDuration time.Duration
+
+	// Forbidden is called by RequirePermission and RequireRole if the
+	// permission check fails, defaults to a 403 response.
+	Forbidden http.HandlerFunc
+
+	mutex sync.RWMutex
+	cache map[uint64]*cachedPermissions
+}
+
+// NewPermissionChecker returns a new PermissionChecker.
+func NewPermissionChecker(roles RoleHandler) *PermissionChecker {
+	return &PermissionChecker{Roles: roles, CacheDuration: time.Minute,
+		cache: make(map[uint64]*cachedPermissions)}
+}
+
+// Invalidate removes the cached permissions of the user.
+func (c *PermissionChecker) Invalidate(user uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.cache, user)
+}
+
+// InvalidateAll clears the cache, for example after changing the permissions
+// of a role.
+func (c *PermissionChecker) InvalidateAll() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.cache = make(map[uint64]*cachedPermissions)
+}
+
+func (c *PermissionChecker) load(user uint64) (*cachedPermissions, error) {
+	now := CurrentTime()
+	c.mutex.RLock()
+	entry, has := c.cache[user]
+	c.mutex.RUnlock()
+	if has && KeyValid(now, entry.validUntil) {
+		return entry, nil
+	}
+	roles, err := c.Roles.UserRoles(user)
+	if err != nil {
+		return nil, err
+	}
+	entry = &cachedPermissions{roles: make(map[string]struct{}, len(roles)),
+		exact: make(map[string]struct{}), validUntil: now.Add(c.CacheDuration)}
+	for _, role := range roles {
+		entry.roles[role] = struct{}{}
+		permissions, err := c.Roles.RolePermissions(role)
+		if err != nil {
+			return nil, err
+		}
+		for _, permission := range permissions {
+			if permission == "*" || strings.HasSuffix(permission, ".*") {
+				entry.patterns = append(entry.patterns, permission)
+			} else {
+				entry.exact[permission] = struct{}{}
+			}
+		}
+	}
+	if c.CacheDuration > 0 {
+		c.mutex.Lock()
+		if c.cache == nil {
+			c.cache = make(map[uint64]*cachedPermissions)
+		}
+		c.cache[user] = entry
+		c.mutex.Unlock()
+	}
+	return entry, nil
+}
+
+// HasRole reports whether the user has the role.
+func (c *PermissionChecker) HasRole(user uint64, role string) (bool, error) {
+	entry, err := c.load(user)
+	if err != nil {
+		return false, err
+	}
+	_, has := entry.roles[role]
+	return has, nil
+}
+
+// HasPermission reports whether one of the roles of the user grants the
+// permission.
+func (c *PermissionChecker) HasPermission(user uint64, permission string) (bool, error) {
+	entry, err := c.load(user)
+	if err != nil {
+		return false, err
+	}
+	if _, has := entry.exact[permission]; has {
+		return true, nil
+	}
+	for _, pattern := range entry.patterns {
+		if MatchPermission(pattern, permission) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (c *PermissionChecker) require(check func(user uint64) (bool, error), next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := UserIDFromContext(r.Context())
+		if !ok {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		allowed, err := check(user)
+		if err != nil {
+			log.WithError(err).Error("goauth: Can't check permissions")
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if !allowed {
+			if c.Forbidden != nil {
+				c.Forbidden(w, r)
+			} else {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			}
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequirePermission returns a handler that calls next only if the user of
+// the request has the permission. It must be used after a middleware that
+// stores the session in the context (for example
+// SessionMiddleware.RequireSession).
+func (c *PermissionChecker) RequirePermission(permission string, next http.Handler) http.Handler {
+	return c.require(func(user uint64) (bool, error) {
+		return c.HasPermission(user, permission)
+	}, next)
+}
+
+// RequireRole is like RequirePermission but checks for a role.
+func (c *PermissionChecker) RequireRole(role string, next http.Handler) http.Handler {
+	return c.require(func(user uint64) (bool, error) {
+		return c.HasRole(user, role)
+	}, next)
+}
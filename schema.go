@@ -0,0 +1,349 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package goauth
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SchemaColumn describes a column of a live database table.
+//
+// New in version v0.7
+type SchemaColumn struct {
+	// Name is the name of the column.
+	Name string
+
+	// Type is the data type in lower case without the length, for example
+	// "char" or "varchar".
+	Type string
+
+	// Length is the maximal length of character types, 0 if it's unbounded
+	// or not enforced (like in sqlite).
+	Length int
+}
+
+// SchemaInspector introspects a live database, it's used by VerifySchema.
+// There are implementations for MySQL, postgres and sqlite3.
+//
+// New in version v0.7
+type SchemaInspector interface {
+	// Columns returns the columns of the table by their name, an empty map if
+	// the table doesn't exist.
+	Columns(db *sql.DB, table string) (map[string]SchemaColumn, error)
+
+	// UniqueIndexes returns the columns of all unique indexes (including the
+	// primary key) of the table.
+	UniqueIndexes(db *sql.DB, table string) ([][]string, error)
+}
+
+// SchemaProblem is a discrepancy between the live database and the schema
+// expected by a handler.
+//
+// New in version v0.7
+type SchemaProblem struct {
+	Table, Column string
+	Problem       string
+}
+
+func (p SchemaProblem) String() string {
+	if p.Column == "" {
+		return fmt.Sprintf("%s: %s", p.Table, p.Problem)
+	}
+	return fmt.Sprintf("%s.%s: %s", p.Table, p.Column, p.Problem)
+}
+
+// expectedColumn is a column that VerifySchema checks.
+type expectedColumn struct {
+	name string
+	// minLength is the minimal length for character types, 0 for no check
+	minLength int
+	// character is true if the column must be a character type
+	character bool
+}
+
+// characterTypes are the data types that can store strings.
+var characterTypes = map[string]bool{"char": true, "character": true,
+	"varchar": true, "character varying": true, "text": true, "tinytext": true,
+	"mediumtext": true, "longtext": true, "binary": true, "varbinary": true,
+	"blob": true, "bytea": true, "": true}
+
+// verifyTable compares the table with the expected columns and unique
+// indexes.
+func verifyTable(inspector SchemaInspector, db *sql.DB, table string, expected []expectedColumn, unique []string) ([]SchemaProblem, error) {
+	columns, err := inspector.Columns(db, table)
+	if err != nil {
+		return nil, wrapBackendError("sql", "VerifySchema", err)
+	}
+	if len(columns) == 0 {
+		return []SchemaProblem{{Table: table, Problem: "table doesn't exist"}}, nil
+	}
+	var res []SchemaProblem
+	for _, exp := range expected {
+		col, has := columns[exp.name]
+		if !has {
+			res = append(res, SchemaProblem{Table: table, Column: exp.name, Problem: "column is missing"})
+			continue
+		}
+		if exp.character && !characterTypes[col.Type] {
+			res = append(res, SchemaProblem{Table: table, Column: exp.name,
+				Problem: fmt.Sprintf("type %s can't store strings", col.Type)})
+		}
+		if exp.minLength > 0 && col.Length > 0 && col.Length < exp.minLength {
+			res = append(res, SchemaProblem{Table: table, Column: exp.name,
+				Problem: fmt.Sprintf("length %d is too short, values have length %d and would be truncated", col.Length, exp.minLength)})
+		}
+	}
+	if len(unique) > 0 {
+		indexes, err := inspector.UniqueIndexes(db, table)
+		if err != nil {
+			return nil, wrapBackendError("sql", "VerifySchema", err)
+		}
+		found := false
+		for _, index := range indexes {
+			if strings.Join(index, ",") == strings.Join(unique, ",") {
+				found = true
+				break
+			}
+		}
+		if !found {
+			res = append(res, SchemaProblem{Table: table, Column: strings.Join(unique, ","),
+				Problem: "unique index is missing"})
+		}
+	}
+	return res, nil
+}
+
+// VerifySchema compares the users table of the live database with the
+// default schema: It reports missing columns, the unique index on username
+// and a password column that is too short for the hashes of PwHandler (for
+// example CHAR(60) for bcrypt but a handler that creates longer hashes).
+// It returns an empty slice if no problems were found.
+//
+// New in version v0.7
+func (handler *SQLUserHandler) VerifySchema(inspector SchemaInspector) ([]SchemaProblem, error) {
+	expected := []expectedColumn{{name: "id"}, {name: "username", character: true},
+		{name: "first_name", character: true}, {name: "last_name", character: true},
+		{name: "email", character: true},
+		{name: "password", character: true, minLength: handler.PwHandler.PasswordHashLength()},
+		{name: "is_active"}, {name: "last_login"}, {name: "is_admin"},
+		{name: "email_verified"}, {name: "is_pending"},
+		{name: "display_name", character: true, minLength: MaxDisplayNameLength},
+		{name: "avatar_url", character: true, minLength: MaxAvatarURLLength},
+		{name: "locale", character: true}, {name: "timezone", character: true}}
+	unique := []string{"username"}
+	if handler.TenantInsertQuery != "" {
+		expected = append(expected, expectedColumn{name: "tenant_id", character: true})
+		unique = []string{"tenant_id", "username"}
+	}
+	return verifyTable(inspector, handler.DB, "users", expected, unique)
+}
+
+// VerifySchema compares the session table of the live database with the
+// schema of the handler: It reports missing columns, a session_key column
+// that is too short for KeySize and a missing primary key on session_key.
+// It returns an empty slice if no problems were found.
+//
+// New in version v0.7
+func (c *SQLSessionHandler) VerifySchema(inspector SchemaInspector) ([]SchemaProblem, error) {
+	expected := []expectedColumn{{name: "user_id"},
+		{name: "session_key", character: true, minLength: c.KeySize},
+		{name: "created"}, {name: "valid_until"}}
+	if c.GetForTenantQ != "" {
+		expected = append(expected, expectedColumn{name: "tenant_id", character: true})
+	}
+	return verifyTable(inspector, c.DB, c.TableName, expected, []string{"session_key"})
+}
+
+// MySQLSchemaInspector is a SchemaInspector for MySQL, it inspects the
+// current database.
+//
+// New in version v0.7
+type MySQLSchemaInspector struct{}
+
+func (MySQLSchemaInspector) Columns(db *sql.DB, table string) (map[string]SchemaColumn, error) {
+	return informationSchemaColumns(db, `SELECT column_name, data_type, character_maximum_length
+		FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = ?`, table)
+}
+
+func (MySQLSchemaInspector) UniqueIndexes(db *sql.DB, table string) ([][]string, error) {
+	return uniqueIndexes(db, `SELECT index_name, column_name FROM information_schema.statistics
+		WHERE table_schema = DATABASE() AND table_name = ? AND non_unique = 0
+		ORDER BY index_name, seq_in_index`, table)
+}
+
+// PostgresSchemaInspector is a SchemaInspector for postgres, it inspects the
+// current schema.
+//
+// New in version v0.7
+type PostgresSchemaInspector struct{}
+
+func (PostgresSchemaInspector) Columns(db *sql.DB, table string) (map[string]SchemaColumn, error) {
+	return informationSchemaColumns(db, `SELECT column_name, data_type, character_maximum_length
+		FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1`, table)
+}
+
+func (PostgresSchemaInspector) UniqueIndexes(db *sql.DB, table string) ([][]string, error) {
+	return uniqueIndexes(db, `SELECT i.relname, a.attname FROM pg_index x
+		JOIN pg_class t ON t.oid = x.indrelid
+		JOIN pg_class i ON i.oid = x.indexrelid
+		JOIN pg_attribute a ON a.attrelid = t.oid AND a.attnum = ANY(x.indkey)
+		WHERE t.relname = $1 AND x.indisunique AND t.relnamespace = current_schema()::regnamespace
+		ORDER BY i.relname, array_position(x.indkey, a.attnum)`, table)
+}
+
+// SQLite3SchemaInspector is a SchemaInspector for sqlite3. sqlite doesn't
+// enforce lengths, so the length of all columns is 0.
+//
+// New in version v0.7
+type SQLite3SchemaInspector struct{}
+
+func (SQLite3SchemaInspector) Columns(db *sql.DB, table string) (map[string]SchemaColumn, error) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s);", table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make(map[string]SchemaColumn)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, dataType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &dataType, &notNull, &defaultValue, &pk); err != nil {
+			return nil, err
+		}
+		res[name] = SchemaColumn{Name: name, Type: baseType(dataType)}
+	}
+	return res, rows.Err()
+}
+
+func (SQLite3SchemaInspector) UniqueIndexes(db *sql.DB, table string) ([][]string, error) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA index_list(%s);", table))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for rows.Next() {
+		var seq, unique, partial int
+		var name, origin string
+		if err := rows.Scan(&seq, &name, &unique, &origin, &partial); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if unique == 1 {
+			names = append(names, name)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	var res [][]string
+	for _, name := range names {
+		index, err := uniqueIndexes(db, fmt.Sprintf("SELECT '%s', name FROM pragma_index_info('%s') ORDER BY seqno", name, name))
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, index...)
+	}
+	// INTEGER PRIMARY KEY columns are not contained in index_list
+	columns, err := db.Query(fmt.Sprintf("SELECT name FROM pragma_table_info('%s') WHERE pk > 0 ORDER BY pk", table))
+	if err != nil {
+		return nil, err
+	}
+	defer columns.Close()
+	var pk []string
+	for columns.Next() {
+		var name string
+		if err := columns.Scan(&name); err != nil {
+			return nil, err
+		}
+		pk = append(pk, name)
+	}
+	if len(pk) > 0 {
+		res = append(res, pk)
+	}
+	return res, columns.Err()
+}
+
+// baseType returns the lower case type without the length, for example
+// "char" for "CHAR(60)".
+func baseType(dataType string) string {
+	dataType = strings.ToLower(strings.TrimSpace(dataType))
+	if i := strings.IndexByte(dataType, '('); i >= 0 {
+		dataType = strings.TrimSpace(dataType[:i])
+	}
+	return dataType
+}
+
+// informationSchemaColumns executes a query on information_schema.columns
+// that selects the name, type and length.
+func informationSchemaColumns(db *sql.DB, query, table string) (map[string]SchemaColumn, error) {
+	rows, err := db.Query(query, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make(map[string]SchemaColumn)
+	for rows.Next() {
+		var name, dataType string
+		var length sql.NullString
+		if err := rows.Scan(&name, &dataType, &length); err != nil {
+			return nil, err
+		}
+		col := SchemaColumn{Name: name, Type: baseType(dataType)}
+		if length.Valid {
+			// MySQL reports large values for text types, ignore them
+			if n, err := strconv.ParseInt(length.String, 10, 64); err == nil && n < 1<<24 {
+				col.Length = int(n)
+			}
+		}
+		res[name] = col
+	}
+	return res, rows.Err()
+}
+
+// uniqueIndexes executes a query that selects the index name and column name
+// ordered by index and position.
+func uniqueIndexes(db *sql.DB, query string, args ...interface{}) ([][]string, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res [][]string
+	lastIndex := ""
+	for rows.Next() {
+		var index, column string
+		if err := rows.Scan(&index, &column); err != nil {
+			return nil, err
+		}
+		if index != lastIndex || len(res) == 0 {
+			res = append(res, nil)
+			lastIndex = index
+		}
+		res[len(res)-1] = append(res[len(res)-1], column)
+	}
+	return res, rows.Err()
+}
@@ -0,0 +1,232 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+	log "github.com/sirupsen/logrus"
+)
+
+// ScopesPayloadName is the name of the payload value that stores the
+// scopes of a session.
+const ScopesPayloadName = "scopes"
+
+// ParseScopes splits a space separated list of scopes (as used by OAuth).
+//
+// New in version v0.7
+func ParseScopes(s string) []string {
+	return strings.Fields(s)
+}
+
+// FormatScopes joins the scopes to a space separated list.
+//
+// New in version v0.7
+func FormatScopes(scopes []string) string {
+	return strings.Join(scopes, " ")
+}
+
+// SetSessionScopes restricts the session with the given key to the scopes.
+// The scopes are stored in the payload and expire with the session.
+//
+// Sessions without scopes are not restricted (for example a normal browser
+// session), so a user can have a full access session and a scoped token at
+// the same time. SessionController only rejects the session (see
+// ErrScopedSession) if payload is its Payload, use AddScopedKey to create
+// scoped sessions.
+//
+// New in version v0.7
+func SetSessionScopes(payload SessionPayloadHandler, key string, validUntil time.Time, scopes []string) error {
+	return payload.SetPayloadValue(key, ScopesPayloadName, FormatScopes(scopes), validUntil)
+}
+
+// SessionScopes returns the scopes of the session, restricted is false if
+// the session has no scopes (full access).
+//
+// New in version v0.7
+func SessionScopes(payload SessionPayloadHandler, key string) (scopes []string, restricted bool, err error) {
+	value, err := payload.GetPayloadValue(key, ScopesPayloadName)
+	switch err {
+	case nil:
+		return ParseScopes(value), true, nil
+	case ErrPayloadValueNotFound:
+		return nil, false, nil
+	default:
+		return nil, false, err
+	}
+}
+
+// SessionHasScope reports whether the session is allowed to access the
+// scope: either the session is not restricted or one of its scopes matches
+// scope. Scopes can use the same wildcards as permissions, see
+// MatchPermission.
+//
+// New in version v0.7
+func SessionHasScope(payload SessionPayloadHandler, key, scope string) (bool, error) {
+	scopes, restricted, err := SessionScopes(payload, key)
+	if err != nil || !restricted {
+		return err == nil, err
+	}
+	return scopesAllow(scopes, scope), nil
+}
+
+// scopesAllow returns true if one of the granted scopes matches scope.
+func scopesAllow(granted []string, scope string) bool {
+	for _, g := range granted {
+		if MatchPermission(g, scope) {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrScopedSession is returned by SessionController.ValidateSession,
+// ValidateToken and the token verifiers if the session is restricted to
+// scopes (for example an access token issued by OAuthServer). Such a
+// session is not a full login of the user, it's only accepted by the
+// routes that opt in with SessionMiddleware.RequireScope or
+// BearerMiddleware.RequireScope.
+//
+// New in version v0.7
+var ErrScopedSession = errors.New("The session is restricted to scopes.")
+
+// errNoScopesPayload is returned if scoped sessions are created without
+// SessionController.Payload.
+var errNoScopesPayload = errors.New("goauth: SessionController.Payload is required for scoped sessions")
+
+// setScopes restricts the session with the given key to the scopes, they're
+// stored in Payload so that the controller can reject the session on routes
+// that don't accept scoped sessions.
+func (c *SessionController) setScopes(key string, validUntil time.Time, scopes []string) error {
+	if c.Payload == nil {
+		return errNoScopesPayload
+	}
+	return SetSessionScopes(c.Payload, key, validUntil, scopes)
+}
+
+// loadScopes sets data.Scoped and data.Scopes from the scopes stored in
+// Payload, without Payload there are no scoped sessions.
+func (c *SessionController) loadScopes(key string, data *SessionKeyData) error {
+	if c.Payload == nil {
+		return nil
+	}
+	scopes, restricted, err := SessionScopes(c.Payload, key)
+	if err != nil {
+		return err
+	}
+	data.Scoped, data.Scopes = restricted, scopes
+	return nil
+}
+
+// AddScopedKey is like AddKey but restricts the new key to the given
+// scopes, for example to create a narrowly scoped token for a mobile app.
+// The scopes are stored in Payload, which is required.
+//
+// The key is rejected with ErrScopedSession everywhere except on the
+// routes protected with SessionMiddleware.RequireScope or
+// BearerMiddleware.RequireScope.
+//
+// New in version v0.7
+func (c *SessionController) AddScopedKey(user UserKeyType, validDuration time.Duration, scopes []string) (*SessionKeyData, string, error) {
+	if c.Payload == nil {
+		return nil, "", errNoScopesPayload
+	}
+	data, key, err := c.AddKey(user, validDuration)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := c.setScopes(key, data.ValidUntil, scopes); err != nil {
+		// don't leave an unrestricted key behind
+		if delErr := c.DeleteKey(key); delErr != nil {
+			log.WithError(delErr).Error("goauth: Can't delete key after failing to store its scopes")
+		}
+		return nil, "", err
+	}
+	data.Scoped, data.Scopes = true, scopes
+	return data, key, nil
+}
+
+// validateScopedSession is like ValidateSession but accepts sessions
+// restricted to scopes as well.
+func (c *SessionController) validateScopedSession(r *http.Request, store sessions.Store) (*SessionKeyData, *sessions.Session, error) {
+	info, session, err := c.validateSession(r, store)
+	if err == ErrScopedSession {
+		return info, session, nil
+	}
+	if err != nil {
+		if c.Metrics != nil {
+			c.Metrics.ValidationFailed(validationFailureReason(err))
+		}
+		return nil, session, err
+	}
+	return info, session, nil
+}
+
+// checkScope returns true if the session may access the scope, otherwise
+// it writes a 403 response with an insufficient_scope error (RFC 6750).
+func checkScope(w http.ResponseWriter, data *SessionKeyData, scope string) bool {
+	if !data.Scoped || scopesAllow(data.Scopes, scope) {
+		return true
+	}
+	writeInsufficientScope(w, scope)
+	return false
+}
+
+// writeInsufficientScope writes a 403 response with the WWW-Authenticate
+// header for a missing scope.
+func writeInsufficientScope(w http.ResponseWriter, scope string) {
+	w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="`+scope+`"`)
+	http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+}
+
+// RequireScope is like RequireSession but accepts sessions restricted to
+// scopes (see AddScopedKey) if one of their scopes matches scope, otherwise
+// the response is 403. Sessions that aren't restricted are accepted as
+// well. All other middleware methods reject scoped sessions, so only the
+// routes protected by RequireScope can be accessed with an access token.
+//
+// New in version v0.7
+func (m *SessionMiddleware) RequireScope(scope string, next http.Handler) http.Handler {
+	return m.require(true, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if checkScope(w, SessionDataFromContext(r.Context()), scope) {
+			next.ServeHTTP(w, r)
+		}
+	}))
+}
+
+// RequireScope is like RequireBearer but accepts tokens restricted to
+// scopes if one of their scopes matches scope, see
+// SessionMiddleware.RequireScope.
+//
+// New in version v0.7
+func (m *BearerMiddleware) RequireScope(scope string, next http.Handler) http.Handler {
+	return m.require(true, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if checkScope(w, SessionDataFromContext(r.Context()), scope) {
+			next.ServeHTTP(w, r)
+		}
+	}))
+}
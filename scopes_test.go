@@ -0,0 +1,74 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+func TestScopedSessionRejectedByUnscopedRoutes(t *testing.T) {
+	controller := NewInMemoryController()
+	controller.Payload = NewInMemoryPayloadHandler()
+	middleware := NewSessionMiddleware(controller, sessions.NewCookieStore([]byte("secret")))
+	_, token, err := controller.AddScopedKey(uint64(1), time.Hour, []string{"read"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, full, err := controller.AddKey(uint64(1), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	routes := map[string]http.Handler{
+		"session": middleware.RequireSession(ok),
+		"read":    middleware.RequireScope("read", ok),
+		"write":   middleware.RequireScope("write", ok),
+	}
+	tests := []struct {
+		key, route string
+		status     int
+	}{
+		{token, "session", http.StatusUnauthorized},
+		{token, "read", http.StatusOK},
+		{token, "write", http.StatusForbidden},
+		{full, "session", http.StatusOK},
+		{full, "write", http.StatusOK},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Authorization", "Bearer "+test.key)
+		w := httptest.NewRecorder()
+		routes[test.route].ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("Route %s with key %s: Expected status %d, got %d", test.route, test.key, test.status, w.Code)
+		}
+	}
+	if _, err := (SessionTokenVerifier{Controller: controller}).VerifyToken(token); err != ErrScopedSession {
+		t.Errorf("Expected ErrScopedSession from VerifyToken, got %v", err)
+	}
+}
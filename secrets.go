@@ -0,0 +1,395 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package goauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrSecretNotFound is returned by a SecretProvider if the secret doesn't
+// exist.
+//
+// New in version v0.7
+var ErrSecretNotFound = errors.New("Secret not found.")
+
+// SecretProvider fetches secrets like the cookie keys or the key used to sign
+// DelegationTokens from a secret store, so they don't have to be part of the
+// config. A secret can have several versions to support rotation: the
+// current version is used to create new values (cookies, tokens) and all
+// versions are accepted when values are verified.
+//
+// Implementations are VaultSecretProvider and KMSSecretProvider, use a
+// SecretRotator to fetch the secrets at startup and on a schedule.
+//
+// New in version v0.7
+type SecretProvider interface {
+	// Secret returns all versions of the secret with the given name, the
+	// current version first. It returns ErrSecretNotFound if there is no
+	// such secret.
+	Secret(name string) ([][]byte, error)
+}
+
+// VaultSecretProvider reads secrets from a HashiCorp Vault KV (version 2)
+// engine, each secret is stored under Path/<name>. The format is the same as
+// for VaultKeyProvider: one entry for each version with the base64 encoded
+// value, the highest version is the current one. For example:
+//
+//	vault kv put secret/goauth/cookie_hash 1=<base64 key> 2=<base64 key>
+//
+// New in version v0.7
+type VaultSecretProvider struct {
+	// Address is the address of the vault server, for example
+	// "https://vault.example.com:8200".
+	Address string
+
+	// Token is the vault token sent in the X-Vault-Token header.
+	Token string
+
+	// Path is the API path of the secrets, for example
+	// "secret/data/goauth".
+	Path string
+
+	// Client is the client used for requests, defaults to a client with a
+	// timeout of ten seconds.
+	Client *http.Client
+}
+
+// NewVaultSecretProvider returns a new VaultSecretProvider.
+//
+// New in version v0.7
+func NewVaultSecretProvider(address, token, path string) *VaultSecretProvider {
+	return &VaultSecretProvider{Address: strings.TrimRight(address, "/"), Token: token,
+		Path: strings.Trim(path, "/"), Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (p *VaultSecretProvider) Secret(name string) ([][]byte, error) {
+	values, _, err := readVaultVersions(p.Client, p.Address, p.Token, p.Path+"/"+name)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, ErrSecretNotFound
+	}
+	versions := make([]uint32, 0, len(values))
+	for version := range values {
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] > versions[j] })
+	res := make([][]byte, len(versions))
+	for i, version := range versions {
+		res[i] = values[version]
+	}
+	return res, nil
+}
+
+// KMSDecrypter decrypts data with a key management service, see
+// KMSSecretProvider. The adapters awskmsauth and gcpkmsauth implement it for
+// AWS KMS and Google Cloud KMS.
+//
+// New in version v0.7
+type KMSDecrypter interface {
+	Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error)
+}
+
+// KMSSecretProvider implements SecretProvider with envelope encryption: the
+// config contains only the secrets encrypted with a KMS key, they're
+// decrypted by the KMS when they're requested. Add the ciphertexts with
+// Add, for example the output of "aws kms encrypt".
+//
+// New in version v0.7
+type KMSSecretProvider struct {
+	// KMS decrypts the secrets.
+	KMS KMSDecrypter
+
+	// Timeout is the timeout for each call to KMS, 0 means no timeout.
+	Timeout time.Duration
+
+	mutex       sync.RWMutex
+	ciphertexts map[string][][]byte
+}
+
+// NewKMSSecretProvider returns a new KMSSecretProvider without secrets.
+//
+// New in version v0.7
+func NewKMSSecretProvider(kms KMSDecrypter) *KMSSecretProvider {
+	return &KMSSecretProvider{KMS: kms, Timeout: 10 * time.Second,
+		ciphertexts: make(map[string][][]byte)}
+}
+
+// Add sets the encrypted versions of the secret, the current version first.
+func (p *KMSSecretProvider) Add(name string, ciphertexts ...[]byte) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.ciphertexts[name] = ciphertexts
+}
+
+func (p *KMSSecretProvider) Secret(name string) ([][]byte, error) {
+	p.mutex.RLock()
+	ciphertexts, has := p.ciphertexts[name]
+	p.mutex.RUnlock()
+	if !has || len(ciphertexts) == 0 {
+		return nil, ErrSecretNotFound
+	}
+	res := make([][]byte, len(ciphertexts))
+	for i, ciphertext := range ciphertexts {
+		ctx, cancel := operationContext(context.Background(), p.Timeout)
+		plain, err := p.KMS.Decrypt(ctx, ciphertext)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		res[i] = plain
+	}
+	return res, nil
+}
+
+// RotatingSecret holds the versions of a secret that can be replaced while
+// it's in use, for example by a SecretRotator:
+//
+//	secret := goauth.NewRotatingSecret()
+//	rotator.Watch("delegation", secret.Set)
+//
+// New in version v0.7
+type RotatingSecret struct {
+	mutex    sync.RWMutex
+	versions [][]byte
+}
+
+// NewRotatingSecret returns a new RotatingSecret with the given versions,
+// the current version first.
+//
+// New in version v0.7
+func NewRotatingSecret(versions ...[]byte) *RotatingSecret {
+	return &RotatingSecret{versions: versions}
+}
+
+// Set replaces the versions, the current version first. It returns an error
+// if versions is empty.
+func (s *RotatingSecret) Set(versions [][]byte) error {
+	if len(versions) == 0 {
+		return errors.New("A secret requires at least one version.")
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.versions = versions
+	return nil
+}
+
+// Current returns the current version or nil if there is none.
+func (s *RotatingSecret) Current() []byte {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if len(s.versions) == 0 {
+		return nil
+	}
+	return s.versions[0]
+}
+
+// Versions returns all versions, the current version first.
+func (s *RotatingSecret) Versions() [][]byte {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.versions
+}
+
+// CookieKeys is a securecookie.Codec with keys that can be rotated, use it
+// as the only codec of a cookie store:
+//
+//	keys := goauth.NewCookieKeys()
+//	store.Codecs = []securecookie.Codec{keys}
+//	rotator.Watch("cookie_hash", keys.SetHashKeys)
+//	rotator.Watch("cookie_block", keys.SetBlockKeys)
+//
+// Cookies are encoded with the current keys and decoded with all versions.
+// The hash key and block key of the same index form a pair, the block keys
+// are optional.
+//
+// New in version v0.7
+type CookieKeys struct {
+	// MaxAge is the max age of the cookies in seconds, see
+	// securecookie.SecureCookie.MaxAge. Set it before the keys are set.
+	MaxAge int
+
+	mutex     sync.RWMutex
+	hashKeys  [][]byte
+	blockKeys [][]byte
+	codecs    []securecookie.Codec
+}
+
+// NewCookieKeys returns new CookieKeys without keys and a MaxAge of 30 days.
+//
+// New in version v0.7
+func NewCookieKeys() *CookieKeys {
+	return &CookieKeys{MaxAge: 86400 * 30}
+}
+
+// SetHashKeys sets the hash keys (at least 32 bytes each), the current
+// version first.
+func (k *CookieKeys) SetHashKeys(keys [][]byte) error {
+	if len(keys) == 0 {
+		return errors.New("At least one cookie hash key is required.")
+	}
+	for _, key := range keys {
+		if len(key) < 32 {
+			return errors.New("Cookie hash keys must have at least 32 bytes.")
+		}
+	}
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.hashKeys = keys
+	k.build()
+	return nil
+}
+
+// SetBlockKeys sets the block keys (16, 24 or 32 bytes each), the current
+// version first.
+func (k *CookieKeys) SetBlockKeys(keys [][]byte) error {
+	for _, key := range keys {
+		if n := len(key); n != 16 && n != 24 && n != 32 {
+			return errors.New("Cookie block keys must have 16, 24 or 32 bytes.")
+		}
+	}
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.blockKeys = keys
+	k.build()
+	return nil
+}
+
+// build creates the codecs from the keys, the mutex must be held.
+func (k *CookieKeys) build() {
+	codecs := make([]securecookie.Codec, len(k.hashKeys))
+	for i, hashKey := range k.hashKeys {
+		var blockKey []byte
+		if i < len(k.blockKeys) {
+			blockKey = k.blockKeys[i]
+		}
+		codec := securecookie.New(hashKey, blockKey)
+		codec.MaxAge(k.MaxAge)
+		codecs[i] = codec
+	}
+	k.codecs = codecs
+}
+
+func (k *CookieKeys) Encode(name string, value interface{}) (string, error) {
+	k.mutex.RLock()
+	codecs := k.codecs
+	k.mutex.RUnlock()
+	return securecookie.EncodeMulti(name, value, codecs...)
+}
+
+func (k *CookieKeys) Decode(name, value string, dst interface{}) error {
+	k.mutex.RLock()
+	codecs := k.codecs
+	k.mutex.RUnlock()
+	return securecookie.DecodeMulti(name, value, dst, codecs...)
+}
+
+// secretTarget is a secret watched by a SecretRotator.
+type secretTarget struct {
+	name  string
+	apply func(versions [][]byte) error
+}
+
+// SecretRotator fetches secrets from a SecretProvider and passes them to the
+// components that use them, at startup (Refresh) and then every Interval
+// (Start), so a new version in the secret store is picked up without a
+// restart. Typical targets are CookieKeys, a RotatingSecret used by
+// DelegationTokens or any secret of the application, like a password pepper.
+//
+// New in version v0.7
+type SecretRotator struct {
+	Provider SecretProvider
+
+	// Interval is the time between two refreshes in Start.
+	Interval time.Duration
+
+	mutex   sync.Mutex
+	targets []secretTarget
+}
+
+// NewSecretRotator returns a new SecretRotator without targets.
+//
+// New in version v0.7
+func NewSecretRotator(provider SecretProvider, interval time.Duration) *SecretRotator {
+	return &SecretRotator{Provider: provider, Interval: interval}
+}
+
+// Watch adds a target: apply is called with the versions of the secret on
+// each refresh.
+func (r *SecretRotator) Watch(name string, apply func(versions [][]byte) error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.targets = append(r.targets, secretTarget{name: name, apply: apply})
+}
+
+// Refresh fetches all secrets and applies them, an error for one secret
+// doesn't stop the others. The first error is returned, call it on startup
+// to make sure all secrets are available.
+func (r *SecretRotator) Refresh() error {
+	r.mutex.Lock()
+	targets := append([]secretTarget(nil), r.targets...)
+	r.mutex.Unlock()
+	var res error
+	for _, target := range targets {
+		versions, err := r.Provider.Secret(target.name)
+		if err == nil {
+			err = target.apply(versions)
+		}
+		if err != nil {
+			err = fmt.Errorf("goauth: can't refresh secret %s: %w", target.name, err)
+			if res == nil {
+				res = err
+			}
+		}
+	}
+	return res
+}
+
+// Start calls Refresh every Interval in a new goroutine until ctx is done,
+// errors are logged and the old versions are kept.
+func (r *SecretRotator) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(r.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := r.Refresh(); err != nil {
+					log.WithError(err).Error("goauth: Can't rotate secrets")
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,258 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package goauth
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DeviceNamePayloadName and DeviceTypePayloadName are the names of the
+	// payload values that store the device of a session.
+	//
+	// New in version v0.7
+	DeviceNamePayloadName = "device_name"
+	DeviceTypePayloadName = "device_type"
+
+	// MaxDeviceNameLength is the maximal number of characters of a device
+	// name.
+	//
+	// New in version v0.7
+	MaxDeviceNameLength = 100
+)
+
+// The device types detected by SessionDeviceFromRequest, clients may send
+// other types.
+//
+// New in version v0.7
+const (
+	DeviceTypeDesktop = "desktop"
+	DeviceTypeMobile  = "mobile"
+	DeviceTypeTablet  = "tablet"
+)
+
+// ErrInvalidDeviceName is returned if a device name or type is too long or
+// contains control characters.
+//
+// New in version v0.7
+var ErrInvalidDeviceName = errors.New("Invalid device name.")
+
+// SessionDevice is the device a session was created on, for example
+// {Name: "Chrome on Windows", Type: "desktop"}. It's shown in the list of
+// the sessions of a user.
+//
+// New in version v0.7
+type SessionDevice struct {
+	Name string `json:"name"`
+	Type string `json:"type,omitempty"`
+}
+
+// checkDeviceValue returns ErrInvalidDeviceName if the value is longer than
+// MaxDeviceNameLength characters or contains control characters.
+func checkDeviceValue(value string) error {
+	if !utf8.ValidString(value) || utf8.RuneCountInString(value) > MaxDeviceNameLength {
+		return ErrInvalidDeviceName
+	}
+	if strings.IndexFunc(value, unicode.IsControl) >= 0 {
+		return ErrInvalidDeviceName
+	}
+	return nil
+}
+
+// SessionDeviceFromRequest returns the device of the request: Name and Type
+// of the AuthRequest fields device_name and device_type if sent by the
+// client (req may be nil), otherwise they're guessed from the User-Agent,
+// for example "Firefox on Linux".
+//
+// New in version v0.7
+func SessionDeviceFromRequest(r *http.Request, req *AuthRequest) *SessionDevice {
+	res := DeviceFromUserAgent(r.UserAgent())
+	if req != nil && req.DeviceName != "" {
+		res.Name = req.DeviceName
+	}
+	if req != nil && req.DeviceType != "" {
+		res.Type = req.DeviceType
+	}
+	return res
+}
+
+// DeviceFromUserAgent guesses the browser, operating system and device
+// type from a User-Agent header. The name is "<browser> on <os>" (or only
+// one of them), "Unknown device" if neither is recognized.
+//
+// New in version v0.7
+func DeviceFromUserAgent(ua string) *SessionDevice {
+	var browser, os string
+	switch {
+	case strings.Contains(ua, "Edg/"):
+		browser = "Edge"
+	case strings.Contains(ua, "OPR/"):
+		browser = "Opera"
+	case strings.Contains(ua, "Firefox/"):
+		browser = "Firefox"
+	case strings.Contains(ua, "Chrome/"), strings.Contains(ua, "CriOS/"):
+		browser = "Chrome"
+	case strings.Contains(ua, "Safari/"):
+		browser = "Safari"
+	}
+	switch {
+	case strings.Contains(ua, "Windows"):
+		os = "Windows"
+	case strings.Contains(ua, "iPhone"):
+		os = "iOS"
+	case strings.Contains(ua, "iPad"):
+		os = "iPadOS"
+	case strings.Contains(ua, "Android"):
+		os = "Android"
+	case strings.Contains(ua, "CrOS"):
+		os = "ChromeOS"
+	case strings.Contains(ua, "Mac OS X"):
+		os = "macOS"
+	case strings.Contains(ua, "Linux"):
+		os = "Linux"
+	}
+	res := &SessionDevice{}
+	switch {
+	case browser != "" && os != "":
+		res.Name = browser + " on " + os
+	case browser != "":
+		res.Name = browser
+	case os != "":
+		res.Name = os
+	default:
+		res.Name = "Unknown device"
+	}
+	switch {
+	case ua == "":
+	case os == "iPadOS", strings.Contains(ua, "Tablet"),
+		os == "Android" && !strings.Contains(ua, "Mobile"):
+		res.Type = DeviceTypeTablet
+	case os == "iOS", strings.Contains(ua, "Mobile"):
+		res.Type = DeviceTypeMobile
+	default:
+		res.Type = DeviceTypeDesktop
+	}
+	return res
+}
+
+// SetSessionDevice stores the device of the session with the given key.
+// The values are stored in the payload and expire with the session.
+// Returns ErrInvalidDeviceName if the name or the type is too long or
+// contains control characters.
+//
+// New in version v0.7
+func SetSessionDevice(payload SessionPayloadHandler, key string, validUntil time.Time, device *SessionDevice) error {
+	if err := checkDeviceValue(device.Name); err != nil {
+		return err
+	}
+	if err := checkDeviceValue(device.Type); err != nil {
+		return err
+	}
+	if err := payload.SetPayloadValue(key, DeviceNamePayloadName, device.Name, validUntil); err != nil {
+		return err
+	}
+	if device.Type == "" {
+		return payload.DeletePayloadValue(key, DeviceTypePayloadName)
+	}
+	return payload.SetPayloadValue(key, DeviceTypePayloadName, device.Type, validUntil)
+}
+
+// GetSessionDevice returns the device of the session, nil if no device was
+// stored.
+//
+// New in version v0.7
+func GetSessionDevice(payload SessionPayloadHandler, key string) (*SessionDevice, error) {
+	values, err := payload.GetPayload(key)
+	if err != nil {
+		return nil, err
+	}
+	return sessionDeviceFromPayload(values), nil
+}
+
+func sessionDeviceFromPayload(values map[string]string) *SessionDevice {
+	name, has := values[DeviceNamePayloadName]
+	if !has {
+		return nil
+	}
+	return &SessionDevice{Name: name, Type: values[DeviceTypePayloadName]}
+}
+
+// AddDeviceKey is like AddKey but stores the device of the new key, see
+// SetSessionDevice.
+//
+// New in version v0.7
+func (c *SessionController) AddDeviceKey(payload SessionPayloadHandler, user UserKeyType, validDuration time.Duration, device *SessionDevice) (*SessionKeyData, string, error) {
+	data, key, err := c.AddKey(user, validDuration)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := SetSessionDevice(payload, key, data.ValidUntil, device); err != nil {
+		if delErr := c.DeleteKey(key); delErr != nil {
+			log.WithError(delErr).Error("goauth: Can't delete key after failing to store its device")
+		}
+		return nil, "", err
+	}
+	data.Device = device
+	return data, key, nil
+}
+
+// RenameSessionDevice changes the name of the device of the session with the
+// given key, for example if the user names it "Work laptop".
+// Returns ErrKeyNotFound if the session doesn't exist.
+//
+// New in version v0.7
+func (c *SessionController) RenameSessionDevice(payload SessionPayloadHandler, key, name string) error {
+	if err := checkDeviceValue(name); err != nil {
+		return err
+	}
+	data, err := c.SessionHandler.GetData(key)
+	if err != nil {
+		return err
+	}
+	return payload.SetPayloadValue(key, DeviceNamePayloadName, name, data.ValidUntil)
+}
+
+// ListSessionsWithDevices is like ListSessions but sets the Device of each
+// session that has one.
+//
+// New in version v0.7
+func (c *SessionController) ListSessionsWithDevices(payload SessionPayloadHandler, user UserKeyType) (map[string]*SessionKeyData, error) {
+	sessions, err := c.ListSessions(user)
+	if err != nil {
+		return nil, err
+	}
+	for key, data := range sessions {
+		values, err := payload.GetPayload(key)
+		if err != nil {
+			return nil, err
+		}
+		data.Device = sessionDeviceFromPayload(values)
+	}
+	return sessions, nil
+}
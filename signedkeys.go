@@ -0,0 +1,136 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// ErrInvalidKeySignature is returned if a signed session key (see
+// SessionKeySigner) is garbled, forged or signed with a secret that is not
+// known any more. The key is rejected without a lookup in the backend.
+//
+// New in version v0.7
+var ErrInvalidKeySignature = errors.New("The signature of the session key is invalid.")
+
+const sessionKeySignaturePrefix = "goauth-session-key:"
+
+// SessionKeyID returns the id of a secret used by SessionKeySigner: the hex
+// encoded first four bytes of its SHA-256 hash. The id doesn't reveal the
+// secret but tells which version of the secret signed a key.
+//
+// New in version v0.7
+func SessionKeyID(secret []byte) string {
+	hash := sha256.Sum256(secret)
+	return hex.EncodeToString(hash[:4])
+}
+
+// SessionKeySigner signs the session keys sent to clients (see
+// SessionController.Signer). The value sent to the client is
+// "<key>.<key id>.<signature>" where the signature is the HMAC-SHA256 of
+// the key with the secret identified by the key id (see SessionKeyID).
+// The backend still stores the plain key.
+//
+// Keys are signed with the current version of Secrets and keys signed with
+// all versions are accepted, so the secret can be rotated (for example with
+// a SecretRotator) without logging out users. Removing a version invalidates
+// all keys signed with it.
+//
+// New in version v0.7
+type SessionKeySigner struct {
+	Secrets *RotatingSecret
+}
+
+// NewSessionKeySigner returns a new SessionKeySigner with the versions of
+// the secret, the current version first.
+//
+// New in version v0.7
+func NewSessionKeySigner(versions ...[]byte) *SessionKeySigner {
+	return &SessionKeySigner{Secrets: NewRotatingSecret(versions...)}
+}
+
+func (s *SessionKeySigner) mac(secret []byte, key string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(sessionKeySignaturePrefix + key))
+	return mac.Sum(nil)
+}
+
+// Sign returns the value for the client.
+func (s *SessionKeySigner) Sign(key string) string {
+	secret := s.Secrets.Current()
+	return key + "." + SessionKeyID(secret) + "." +
+		base64.RawURLEncoding.EncodeToString(s.mac(secret, key))
+}
+
+// Verify checks the value sent by a client and returns the key, it returns
+// ErrInvalidKeySignature if the value is not a correctly signed key.
+func (s *SessionKeySigner) Verify(value string) (string, error) {
+	parts := strings.Split(value, ".")
+	if len(parts) != 3 || parts[0] == "" {
+		return "", ErrInvalidKeySignature
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", ErrInvalidKeySignature
+	}
+	for _, secret := range s.Secrets.Versions() {
+		if SessionKeyID(secret) != parts[1] {
+			continue
+		}
+		if hmac.Equal(signature, s.mac(secret, parts[0])) {
+			return parts[0], nil
+		}
+	}
+	return "", ErrInvalidKeySignature
+}
+
+// ClientKey returns the value of the key that is sent to the client: the
+// signed key if Signer is set and the key itself otherwise.
+// The session cookie, tokens returned by AuthHandlers.Login and access
+// tokens of the OAuthServer are converted already, use ClientKey if you send
+// a key from AddKey to a client yourself.
+//
+// New in version v0.7
+func (c *SessionController) ClientKey(key string) string {
+	if c.Signer == nil {
+		return key
+	}
+	return c.Signer.Sign(key)
+}
+
+// ParseClientKey is the inverse of ClientKey, it returns
+// ErrInvalidKeySignature if Signer is set and the value is not correctly
+// signed.
+//
+// New in version v0.7
+func (c *SessionController) ParseClientKey(value string) (string, error) {
+	if c.Signer == nil {
+		return value, nil
+	}
+	return c.Signer.Verify(value)
+}
@@ -23,9 +23,11 @@
 package goauth
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 )
@@ -89,6 +91,72 @@ type SQLSessionTemplate interface {
 	TimeFromScanType(val interface{}) (time.Time, error)
 }
 
+// SQLSessionListTemplate is an optional extension of SQLSessionTemplate.
+// If a template implements it the SQLSessionHandler also implements
+// SessionLister.
+//
+// New in version v0.7
+type SQLSessionListTemplate interface {
+	// ListForUserQ selects the key, the time the key was created and the
+	// time until the key is valid for all valid keys of a user. The
+	// arguments are the user identification and the current time.
+	ListForUserQ() string
+}
+
+// SQLSessionAnalyticsTemplate is an optional extension of
+// SQLSessionTemplate. If a template implements it the SQLSessionHandler
+// also implements SessionAnalytics.
+//
+// New in version v0.7
+type SQLSessionAnalyticsTemplate interface {
+	// ActiveUsersQ counts the distinct users with a valid key, the argument
+	// is the current time.
+	ActiveUsersQ() string
+
+	// CreatedBetweenQ counts the keys created in a time range, the
+	// arguments are the start (inclusive) and end (exclusive) of the range.
+	CreatedBetweenQ() string
+}
+
+// SQLSessionBulkTemplate is an optional extension of SQLSessionTemplate.
+// If a template implements it the SQLSessionHandler also implements
+// BulkSessionDeleter.
+// The queries contain the table name (%s) and the list of placeholders
+// (%%s), for example "DELETE FROM %s WHERE session_key IN (%%s);".
+//
+// New in version v0.7
+type SQLSessionBulkTemplate interface {
+	// DeleteKeysQ deletes all keys in the list.
+	DeleteKeysQ() string
+
+	// DeleteForUsersQ deletes all keys of the users in the list.
+	DeleteForUsersQ() string
+
+	// GetKeysQ selects the key, user id, creation time and valid until of
+	// all keys in the list.
+	GetKeysQ() string
+
+	// Placeholder returns the placeholder of the i-th argument (starting
+	// with 1), for example "?" or "$1".
+	Placeholder(i int) string
+}
+
+// SQLSessionTenantTemplate is an optional extension of SQLSessionTemplate.
+// If a template implements it the SQLSessionHandler also implements
+// TenantSessionHandler. The session table must have a column tenant_id,
+// see MySQLTenantSessionTemplate.
+//
+// New in version v0.7
+type SQLSessionTenantTemplate interface {
+	// GetForTenantQ is like GetQ but the arguments are the tenant and the
+	// key.
+	GetForTenantQ() string
+
+	// CreateForTenantQ is like CreateQ but the tenant is passed as first
+	// argument.
+	CreateForTenantQ() string
+}
+
 // SQLSessionHandler is an implementation of SessionHandler that uses a predinfed
 // set of SQL queries. These queries are generated in NewSQLSessionHandler and stored
 // in strings here. The reason we do that is that SQLSessionTemplate uses
@@ -103,6 +171,26 @@ type SQLSessionHandler struct {
 	// The queries required by this handler.
 	InitQ, GetQ, CreateQ, DeleteForUserQ, DeleteInvalidQ, DeleteKeyQ string
 
+	// ListForUserQ is only set if the template implements
+	// SQLSessionListTemplate.
+	ListForUserQ string
+
+	// ActiveUsersQ and CreatedBetweenQ are only set if the template
+	// implements SQLSessionAnalyticsTemplate.
+	ActiveUsersQ, CreatedBetweenQ string
+
+	// GetForTenantQ and CreateForTenantQ are only set if the template
+	// implements SQLSessionTenantTemplate.
+	GetForTenantQ, CreateForTenantQ string
+
+	// DeleteKeysQ, DeleteForUsersQ and GetKeysQ are only set if the
+	// template implements SQLSessionBulkTemplate, they still contain %s for
+	// the list of placeholders.
+	DeleteKeysQ, DeleteForUsersQ, GetKeysQ string
+
+	// placeholder is SQLSessionBulkTemplate.Placeholder
+	placeholder func(i int) string
+
 	// TableName is the name of the session table, by default user_sessions.
 	TableName string
 
@@ -115,6 +203,52 @@ type SQLSessionHandler struct {
 	// TimeFromScanType: See TimeFromScanType in the documentation of SQLSessionTemplate.
 	TimeFromScanType func(val interface{}) (time.Time, error)
 
+	// Retry is used to retry queries that failed with a transient error,
+	// nil (the default) disables retries. See RetryPolicy for details.
+	//
+	// New in version v0.7
+	Retry *RetryPolicy
+
+	// Timeout is the timeout for each query, 0 (the default) means no timeout.
+	// With retries each attempt gets its own timeout.
+	// See OperationTimeoutHandler.
+	//
+	// New in version v0.7
+	Timeout time.Duration
+
+	// Pragmas are executed by Init before the table is created, see
+	// SQLite3Options.
+	//
+	// New in version v0.7
+	Pragmas []string
+
+	// PoolOptions are applied to DB in Init, may be nil.
+	//
+	// New in version v0.7
+	PoolOptions *SQLPoolOptions
+
+	// PrepareStatements prepares all queries in Init, they're used instead
+	// of the query strings then. Call Close to close the statements.
+	//
+	// New in version v0.7
+	PrepareStatements bool
+
+	// Clock is used for the creation and expiry times, nil (the default)
+	// means CurrentTime. Use an OffsetClock if the clocks of your servers
+	// differ, otherwise sessions created by one server might be considered
+	// expired by another.
+	//
+	// New in version v0.7
+	Clock Clock
+
+	// Replica routes the read queries to a replica, nil (the default) sends
+	// all queries to DB. See ReadReplica for details.
+	//
+	// New in version v0.7
+	Replica *ReadReplica
+
+	stmts stmtCache
+
 	// ForceUIDuint forces the user id to be of type uint64.
 	// This field exists because most drivers stoer big ints simply as int, which
 	// would mean we could never have more than 2^32 users. I Mean must people don't
@@ -157,6 +291,23 @@ func NewSQLSessionHandler(db *sql.DB, t SQLSessionTemplate, tableName, userIDTyp
 	h.DeleteForUserQ = fmt.Sprintf(t.DeleteForUserQ(), h.TableName)
 	h.DeleteInvalidQ = fmt.Sprintf(t.DeleteInvalidQ(), h.TableName)
 	h.DeleteKeyQ = fmt.Sprintf(t.DeleteKeyQ(), h.TableName)
+	if lt, ok := t.(SQLSessionListTemplate); ok {
+		h.ListForUserQ = fmt.Sprintf(lt.ListForUserQ(), h.TableName)
+	}
+	if at, ok := t.(SQLSessionAnalyticsTemplate); ok {
+		h.ActiveUsersQ = fmt.Sprintf(at.ActiveUsersQ(), h.TableName)
+		h.CreatedBetweenQ = fmt.Sprintf(at.CreatedBetweenQ(), h.TableName)
+	}
+	if tt, ok := t.(SQLSessionTenantTemplate); ok {
+		h.GetForTenantQ = fmt.Sprintf(tt.GetForTenantQ(), h.TableName)
+		h.CreateForTenantQ = fmt.Sprintf(tt.CreateForTenantQ(), h.TableName)
+	}
+	if bt, ok := t.(SQLSessionBulkTemplate); ok {
+		h.DeleteKeysQ = fmt.Sprintf(bt.DeleteKeysQ(), h.TableName)
+		h.DeleteForUsersQ = fmt.Sprintf(bt.DeleteForUsersQ(), h.TableName)
+		h.GetKeysQ = fmt.Sprintf(bt.GetKeysQ(), h.TableName)
+		h.placeholder = bt.Placeholder
+	}
 	return &h
 }
 
@@ -165,18 +316,89 @@ func (c *SQLSessionHandler) Init() error {
 		c.mutex.Lock()
 		defer c.mutex.Unlock()
 	}
-	_, err := c.DB.Exec(c.InitQ)
-	return err
+	if err := execPragmas(c.exec, c.Pragmas); err != nil {
+		return err
+	}
+	c.PoolOptions.Apply(c.DB)
+	if _, err := c.exec(c.InitQ); err != nil {
+		return err
+	}
+	if c.PrepareStatements {
+		return c.stmts.prepare(c.DB, c.GetQ, c.CreateQ, c.DeleteForUserQ,
+			c.DeleteInvalidQ, c.DeleteKeyQ, c.ListForUserQ, c.ActiveUsersQ,
+			c.CreatedBetweenQ, c.GetForTenantQ, c.CreateForTenantQ)
+	}
+	return nil
+}
+
+// Close closes the prepared statements, see PrepareStatements. It doesn't
+// close DB.
+//
+// New in version v0.7
+func (c *SQLSessionHandler) Close() error {
+	return c.stmts.close()
+}
+
+// Ping executes a lightweight query to check the connection to the database.
+//
+// New in version v0.7
+func (c *SQLSessionHandler) Ping() error {
+	return c.Healthy(context.Background())
+}
+
+// Healthy executes a lightweight query to check the connection to the
+// database, see HealthChecker.
+//
+// New in version v0.7
+func (c *SQLSessionHandler) Healthy(ctx context.Context) error {
+	if c.blockDB {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+	}
+	if err := pingDB(ctx, c.Timeout, c.DB); err != nil {
+		return err
+	}
+	if c.Replica != nil {
+		return pingDB(ctx, c.Timeout, c.Replica.DB)
+	}
+	return nil
+}
+
+// pingDB executes "SELECT 1" on db, the timeout is used if ctx has no
+// (earlier) deadline.
+func pingDB(ctx context.Context, timeout time.Duration, db *sql.DB) error {
+	ctx, cancel := operationContext(ctx, timeout)
+	defer cancel()
+	var one int
+	if err := db.QueryRowContext(ctx, "SELECT 1").Scan(&one); err != nil {
+		return wrapBackendError("sql", "Ping", err)
+	}
+	return nil
 }
 
 func (c *SQLSessionHandler) GetData(key string) (*SessionKeyData, error) {
+	return c.getData(c.GetQ, key)
+}
+
+// GetDataForTenant is like GetData but returns ErrKeyNotFound if the key
+// doesn't belong to the tenant, see TenantSessionHandler.
+//
+// New in version v0.7
+func (c *SQLSessionHandler) GetDataForTenant(tenant, key string) (*SessionKeyData, error) {
+	if c.GetForTenantQ == "" {
+		return nil, ErrNotSupported
+	}
+	return c.getData(c.GetForTenantQ, tenant, key)
+}
+
+func (c *SQLSessionHandler) getData(query string, args ...interface{}) (*SessionKeyData, error) {
 	if c.blockDB {
 		c.mutex.RLock()
 		defer c.mutex.RUnlock()
 	}
 	var uid, createdVal, validUntilVal interface{}
 	var err error
-	row := c.DB.QueryRow(c.GetQ, key)
+	row := c.queryRow(query, args...)
 	if c.ForceUIDuint {
 		var uidUint uint64
 		err = row.Scan(&uidUint, &createdVal, &validUntilVal)
@@ -188,7 +410,7 @@ func (c *SQLSessionHandler) GetData(key string) (*SessionKeyData, error) {
 		if err == sql.ErrNoRows {
 			return nil, ErrKeyNotFound
 		}
-		return nil, err
+		return nil, wrapBackendError("sql", "GetData", err)
 	}
 	created, err := c.TimeFromScanType(createdVal)
 	if err != nil {
@@ -208,10 +430,30 @@ func (c *SQLSessionHandler) CreateEntry(user UserKeyType, key string, validDurat
 		c.mutex.Lock()
 		defer c.mutex.Unlock()
 	}
-	data := CurrentTimeKeyData(user, validDuration)
-	_, err := c.DB.Exec(c.CreateQ, user, key, data.CreationTime, data.ValidUntil)
+	data := clockKeyData(c.Clock, user, validDuration)
+	_, err := c.exec(c.CreateQ, user, key, data.CreationTime, data.ValidUntil)
 	if err != nil {
-		return nil, err
+		return nil, wrapBackendError("sql", "CreateEntry", err)
+	}
+	return data, nil
+}
+
+// CreateEntryForTenant is like CreateEntry but stores the tenant of the
+// session, see TenantSessionHandler.
+//
+// New in version v0.7
+func (c *SQLSessionHandler) CreateEntryForTenant(tenant string, user UserKeyType, key string, validDuration time.Duration) (*SessionKeyData, error) {
+	if c.CreateForTenantQ == "" {
+		return nil, ErrNotSupported
+	}
+	if c.blockDB {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+	}
+	data := clockKeyData(c.Clock, user, validDuration)
+	_, err := c.exec(c.CreateForTenantQ, tenant, user, key, data.CreationTime, data.ValidUntil)
+	if err != nil {
+		return nil, wrapBackendError("sql", "CreateEntryForTenant", err)
 	}
 	return data, nil
 }
@@ -221,7 +463,7 @@ func (c *SQLSessionHandler) DeleteEntriesForUser(user UserKeyType) (int64, error
 		c.mutex.Lock()
 		defer c.mutex.Unlock()
 	}
-	res, err := c.DB.Exec(c.DeleteForUserQ, user)
+	res, err := c.exec(c.DeleteForUserQ, user)
 	if err != nil {
 		return -1, err
 	}
@@ -233,12 +475,12 @@ func (c *SQLSessionHandler) DeleteEntriesForUser(user UserKeyType) (int64, error
 }
 
 func (c *SQLSessionHandler) DeleteInvalidKeys() (int64, error) {
-	now := CurrentTime()
+	now := clockNow(c.Clock)
 	if c.blockDB {
 		c.mutex.Lock()
 		defer c.mutex.Unlock()
 	}
-	res, err := c.DB.Exec(c.DeleteInvalidQ, now)
+	res, err := c.exec(c.DeleteInvalidQ, now)
 	if err != nil {
 		return -1, err
 	}
@@ -254,10 +496,239 @@ func (c *SQLSessionHandler) DeleteKey(key string) error {
 		c.mutex.Lock()
 		defer c.mutex.Unlock()
 	}
-	_, err := c.DB.Exec(c.DeleteKeyQ, key)
+	_, err := c.exec(c.DeleteKeyQ, key)
 	return err
 }
 
+func (c *SQLSessionHandler) exec(query string, args ...interface{}) (sql.Result, error) {
+	res, err := retryExec(c.Retry, c.Timeout, c.DB, c.stmts.get(query), query, args...)
+	c.Replica.wrote()
+	return res, err
+}
+
+func (c *SQLSessionHandler) queryRow(query string, args ...interface{}) rowScanner {
+	db, stmt := c.Replica.readConn(c.DB, c.stmts.get(query))
+	return retryRow{policy: c.Retry, timeout: c.Timeout, db: db,
+		stmt: stmt, query: query, args: args}
+}
+
+func (c *SQLSessionHandler) query(query string, args ...interface{}) (timeoutRows, error) {
+	db, stmt := c.Replica.readConn(c.DB, c.stmts.get(query))
+	return retryQuery(c.Retry, c.Timeout, db, stmt, query, args...)
+}
+
+// OperationTimeout returns the timeout for each query, see
+// OperationTimeoutHandler.
+//
+// New in version v0.7
+func (c *SQLSessionHandler) OperationTimeout() time.Duration {
+	return c.Timeout
+}
+
+// SetOperationTimeout sets the timeout for each query, see
+// OperationTimeoutHandler.
+//
+// New in version v0.7
+func (c *SQLSessionHandler) SetOperationTimeout(timeout time.Duration) {
+	c.Timeout = timeout
+}
+
+// ListSessionsForUser returns all valid sessions of the user, it returns
+// ErrNotSupported if the template doesn't implement SQLSessionListTemplate.
+func (c *SQLSessionHandler) ListSessionsForUser(user UserKeyType) (map[string]*SessionKeyData, error) {
+	if c.ListForUserQ == "" {
+		return nil, ErrNotSupported
+	}
+	if c.blockDB {
+		c.mutex.RLock()
+		defer c.mutex.RUnlock()
+	}
+	rows, err := c.query(c.ListForUserQ, user, clockNow(c.Clock))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make(map[string]*SessionKeyData)
+	for rows.Next() {
+		var key string
+		var createdVal, validUntilVal interface{}
+		if err := rows.Scan(&key, &createdVal, &validUntilVal); err != nil {
+			return nil, err
+		}
+		created, err := c.TimeFromScanType(createdVal)
+		if err != nil {
+			return nil, err
+		}
+		validUntil, err := c.TimeFromScanType(validUntilVal)
+		if err != nil {
+			return nil, err
+		}
+		res[key] = &SessionKeyData{User: user, CreationTime: created, ValidUntil: validUntil}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// ActiveUsers returns the number of distinct users with a valid session, see
+// SessionAnalytics. It returns ErrNotSupported if the template doesn't
+// implement SQLSessionAnalyticsTemplate.
+func (c *SQLSessionHandler) ActiveUsers() (int64, error) {
+	if c.ActiveUsersQ == "" {
+		return 0, ErrNotSupported
+	}
+	return c.count("ActiveUsers", c.ActiveUsersQ, clockNow(c.Clock))
+}
+
+// SessionsCreated returns the number of sessions created in [from, to), see
+// SessionAnalytics. Sessions removed by DeleteInvalidKeys are not counted.
+// It returns ErrNotSupported if the template doesn't implement
+// SQLSessionAnalyticsTemplate.
+func (c *SQLSessionHandler) SessionsCreated(from, to time.Time) (int64, error) {
+	if c.CreatedBetweenQ == "" {
+		return 0, ErrNotSupported
+	}
+	return c.count("SessionsCreated", c.CreatedBetweenQ, from, to)
+}
+
+// DeleteKeys removes all keys, see BulkSessionDeleter. It returns
+// ErrNotSupported if the template doesn't implement SQLSessionBulkTemplate.
+//
+// New in version v0.7
+func (c *SQLSessionHandler) DeleteKeys(keys []string) (int64, error) {
+	args := make([]interface{}, len(keys))
+	for i, key := range keys {
+		args[i] = key
+	}
+	return c.deleteIn("DeleteKeys", c.DeleteKeysQ, args)
+}
+
+// DeleteEntriesForUsers removes all keys of the users, see
+// BulkSessionDeleter. It returns ErrNotSupported if the template doesn't
+// implement SQLSessionBulkTemplate.
+//
+// New in version v0.7
+func (c *SQLSessionHandler) DeleteEntriesForUsers(users []UserKeyType) (int64, error) {
+	args := make([]interface{}, len(users))
+	for i, user := range users {
+		args[i] = user
+	}
+	return c.deleteIn("DeleteEntriesForUsers", c.DeleteForUsersQ, args)
+}
+
+// GetDataMulti returns the data for all keys with one query for each 500
+// keys, see MultiSessionGetter. It returns ErrNotSupported if the
+// template doesn't implement SQLSessionBulkTemplate.
+//
+// New in version v0.7
+func (c *SQLSessionHandler) GetDataMulti(keys []string) (map[string]*SessionKeyData, error) {
+	if c.GetKeysQ == "" {
+		return nil, ErrNotSupported
+	}
+	if c.blockDB {
+		c.mutex.RLock()
+		defer c.mutex.RUnlock()
+	}
+	res := make(map[string]*SessionKeyData, len(keys))
+	for start := 0; start < len(keys); start += sqlBulkSize {
+		end := start + sqlBulkSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		placeholders := make([]string, end-start)
+		args := make([]interface{}, end-start)
+		for i := range placeholders {
+			placeholders[i] = c.placeholder(i + 1)
+			args[i] = keys[start+i]
+		}
+		if err := c.getKeys(res, fmt.Sprintf(c.GetKeysQ, strings.Join(placeholders, ", ")), args); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// getKeys executes the GetKeysQ query and adds the results to res.
+func (c *SQLSessionHandler) getKeys(res map[string]*SessionKeyData, query string, args []interface{}) error {
+	rows, err := c.query(query, args...)
+	if err != nil {
+		return wrapBackendError("sql", "GetDataMulti", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		var uid, createdVal, validUntilVal interface{}
+		if c.ForceUIDuint {
+			var uidUint uint64
+			err = rows.Scan(&key, &uidUint, &createdVal, &validUntilVal)
+			uid = uidUint
+		} else {
+			err = rows.Scan(&key, &uid, &createdVal, &validUntilVal)
+		}
+		if err != nil {
+			return wrapBackendError("sql", "GetDataMulti", err)
+		}
+		created, err := c.TimeFromScanType(createdVal)
+		if err != nil {
+			return err
+		}
+		validUntil, err := c.TimeFromScanType(validUntilVal)
+		if err != nil {
+			return err
+		}
+		res[key] = &SessionKeyData{User: uid, CreationTime: created, ValidUntil: validUntil}
+	}
+	return wrapBackendError("sql", "GetDataMulti", rows.Err())
+}
+
+// sqlBulkSize is the maximal number of arguments in the list of a bulk
+// statement, sqlite for example supports at most 999 variables.
+const sqlBulkSize = 500
+
+// deleteIn executes the query with the list of placeholders replaced, lists
+// with more than sqlBulkSize entries are split into several statements.
+func (c *SQLSessionHandler) deleteIn(op, query string, args []interface{}) (int64, error) {
+	if query == "" {
+		return -1, ErrNotSupported
+	}
+	if c.blockDB {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+	}
+	var removed int64
+	for start := 0; start < len(args); start += sqlBulkSize {
+		end := start + sqlBulkSize
+		if end > len(args) {
+			end = len(args)
+		}
+		placeholders := make([]string, end-start)
+		for i := range placeholders {
+			placeholders[i] = c.placeholder(i + 1)
+		}
+		res, err := c.exec(fmt.Sprintf(query, strings.Join(placeholders, ", ")), args[start:end]...)
+		if err != nil {
+			return removed, wrapBackendError("sql", op, err)
+		}
+		if num, err := res.RowsAffected(); err == nil {
+			removed += num
+		}
+	}
+	return removed, nil
+}
+
+func (c *SQLSessionHandler) count(op, query string, args ...interface{}) (int64, error) {
+	if c.blockDB {
+		c.mutex.RLock()
+		defer c.mutex.RUnlock()
+	}
+	var res int64
+	if err := c.queryRow(query, args...).Scan(&res); err != nil {
+		return 0, wrapBackendError("sql", op, err)
+	}
+	return res, nil
+}
+
 // MySQLSessionTemplate implements SQLSessionTemplate with MySQL queries.
 type MySQLSessionTemplate struct {
 }
@@ -309,6 +780,34 @@ func (t MySQLSessionTemplate) DeleteKeyQ() string {
 	return "DELETE FROM %s WHERE session_key = ?"
 }
 
+func (t MySQLSessionTemplate) ListForUserQ() string {
+	return "SELECT session_key, created, valid_until FROM %s WHERE user_id = ? AND valid_until >= ?;"
+}
+
+func (t MySQLSessionTemplate) ActiveUsersQ() string {
+	return "SELECT COUNT(DISTINCT user_id) FROM %s WHERE valid_until >= ?;"
+}
+
+func (t MySQLSessionTemplate) CreatedBetweenQ() string {
+	return "SELECT COUNT(*) FROM %s WHERE created >= ? AND created < ?;"
+}
+
+func (t MySQLSessionTemplate) DeleteKeysQ() string {
+	return "DELETE FROM %s WHERE session_key IN (%%s);"
+}
+
+func (t MySQLSessionTemplate) DeleteForUsersQ() string {
+	return "DELETE FROM %s WHERE user_id IN (%%s);"
+}
+
+func (t MySQLSessionTemplate) GetKeysQ() string {
+	return "SELECT session_key, user_id, created, valid_until FROM %s WHERE session_key IN (%%s);"
+}
+
+func (t MySQLSessionTemplate) Placeholder(i int) string {
+	return "?"
+}
+
 // TimeFromScanType for MySQL first checks if the value is already a time.Time
 // (the driver has an option to enable this).
 // If not it pasres the datetime in the format "2006-01-02 15:04:05".
@@ -390,6 +889,34 @@ func (t PostgresSessionTemplate) DeleteKeyQ() string {
 	return "DELETE FROM %s WHERE session_key = $1"
 }
 
+func (t PostgresSessionTemplate) ListForUserQ() string {
+	return "SELECT session_key, created, valid_until FROM %s WHERE user_id = $1 AND valid_until >= $2;"
+}
+
+func (t PostgresSessionTemplate) ActiveUsersQ() string {
+	return "SELECT COUNT(DISTINCT user_id) FROM %s WHERE valid_until >= $1;"
+}
+
+func (t PostgresSessionTemplate) CreatedBetweenQ() string {
+	return "SELECT COUNT(*) FROM %s WHERE created >= $1 AND created < $2;"
+}
+
+func (t PostgresSessionTemplate) DeleteKeysQ() string {
+	return "DELETE FROM %s WHERE session_key IN (%%s);"
+}
+
+func (t PostgresSessionTemplate) DeleteForUsersQ() string {
+	return "DELETE FROM %s WHERE user_id IN (%%s);"
+}
+
+func (t PostgresSessionTemplate) GetKeysQ() string {
+	return "SELECT session_key, user_id, created, valid_until FROM %s WHERE session_key IN (%%s);"
+}
+
+func (t PostgresSessionTemplate) Placeholder(i int) string {
+	return fmt.Sprintf("$%d", i)
+}
+
 func (t PostgresSessionTemplate) TimeFromScanType(val interface{}) (time.Time, error) {
 	return DefaultTimeFromScanType(val)
 }
@@ -435,6 +962,13 @@ func NewPostgresSessionController(db *sql.DB, tableName, userIDType string) *Ses
 // 		password CHAR(<PWLENGTH>),
 // 		is_active BOOL,
 // 		last_login DATETIME,
+// 		is_admin BOOL NOT NULL DEFAULT FALSE,
+// 		email_verified BOOL NOT NULL DEFAULT FALSE,
+// 		is_pending BOOL NOT NULL DEFAULT FALSE,
+// 		display_name VARCHAR(150),
+// 		avatar_url VARCHAR(2048),
+// 		locale VARCHAR(35),
+// 		timezone VARCHAR(64),
 // 		PRIMARY KEY(id),
 // 		UNIQUE(username)
 // 	);
@@ -502,6 +1036,81 @@ type SQLUserQueries struct {
 	// New in version v0.6
 	GetIDQuery string
 
+	// ListPIIQuery selects id, first_name, last_name and email of all users.
+	// UpdatePIIQuery sets first_name, last_name and email (in this order)
+	// given the id.
+	// They're used by SQLUserHandler.ReencryptPII.
+	//
+	// New in version v0.7
+	ListPIIQuery, UpdatePIIQuery string
+
+	// SetAdminQuery sets the is_admin flag (first argument) given the
+	// username.
+	//
+	// New in version v0.7
+	SetAdminQuery string
+
+	// SetEmailVerifiedQuery sets the email_verified flag (first argument)
+	// given the username.
+	//
+	// New in version v0.7
+	SetEmailVerifiedQuery string
+
+	// SetActiveQuery sets the is_active flag (first argument) given the
+	// username.
+	//
+	// New in version v0.7
+	SetActiveQuery string
+
+	// RenameUserQuery sets the username (first argument) given the old
+	// username.
+	//
+	// New in version v0.7
+	RenameUserQuery string
+
+	// InsertPendingQuery is like InsertQuery but creates a user with
+	// is_pending set to true, see PendingUserHandler.
+	// CompleteRegistrationQuery sets first_name, last_name and is_pending
+	// (in this order) given the username.
+	// PendingQuery selects is_pending given the username, Validate returns
+	// ErrRegistrationPending for pending users if it is not empty.
+	// Tables created before v0.7 don't have the column is_pending, so
+	// PendingQuery is empty by default (except for the tenant schema). Set it
+	// to "SELECT is_pending FROM users WHERE username=?" ($1 for postgres)
+	// after migrating the table (see SQLMigrator) to use pending users,
+	// InsertPending returns ErrNotSupported if it's empty.
+	//
+	// New in version v0.7
+	InsertPendingQuery, CompleteRegistrationQuery, PendingQuery string
+
+	// SetEmailQuery sets email and email_verified (in this order) given the
+	// username.
+	//
+	// New in version v0.7
+	SetEmailQuery string
+
+	// SetDisplayNameQuery sets display_name and SetAvatarURLQuery sets
+	// avatar_url (first argument, NULL to clear it) given the username.
+	//
+	// New in version v0.7
+	SetDisplayNameQuery, SetAvatarURLQuery string
+
+	// SetLocaleQuery sets locale and SetTimezoneQuery sets timezone (first
+	// argument, NULL to clear it) given the username.
+	//
+	// New in version v0.7
+	SetLocaleQuery, SetTimezoneQuery string
+
+	// The tenant queries are the same as InsertQuery, ValidateQuery,
+	// GetIDQuery and GetUserInfoQuery but take the tenant id as first
+	// argument. They're only set by the queries created with
+	// MySQLTenantUserQueries etc., the tenant methods of SQLUserHandler
+	// return ErrNotSupported if they're empty.
+	//
+	// New in version v0.7
+	TenantInsertQuery, TenantValidateQuery, TenantGetIDQuery,
+	TenantGetUserInfoQuery, TenantPendingQuery string
+
 	// TimeFromScanType is used to transform database time entries to
 	// gos time. See SQLSessionHandler for details.
 	// Defaults to a function that first checks if the value is already a time.Time
@@ -523,6 +1132,13 @@ func MySQLUserQueries(pwLength int) *SQLUserQueries {
 		password CHAR(%d),
 		is_active BOOL,
 		last_login DATETIME,
+		is_admin BOOL NOT NULL DEFAULT FALSE,
+		email_verified BOOL NOT NULL DEFAULT FALSE,
+		is_pending BOOL NOT NULL DEFAULT FALSE,
+		display_name VARCHAR(150),
+		avatar_url VARCHAR(2048),
+		locale VARCHAR(35),
+		timezone VARCHAR(64),
 		PRIMARY KEY(id),
 		UNIQUE(username)
 	);
@@ -537,13 +1153,35 @@ func MySQLUserQueries(pwLength int) *SQLUserQueries {
 	listUsersQ := "SELECT id, username FROM users"
 	getUsernameQ := "SELECT username FROM users WHERE id=?"
 	deleteQ := "DELETE FROM users WHERE username=?"
-	getUserInfoQ := "SELECT id, first_name, last_name, email, is_active, last_login FROM users WHERE username=?"
+	getUserInfoQ := "SELECT id, first_name, last_name, email, is_active, last_login, is_admin, email_verified, is_pending, display_name, avatar_url, locale, timezone FROM users WHERE username=?"
 	getIDQuery := "SELECT id FROM users WHERE username=?"
+	listPIIQ := "SELECT id, first_name, last_name, email FROM users"
+	updatePIIQ := "UPDATE users SET first_name=?, last_name=?, email=? WHERE id=?"
+	setAdminQ := "UPDATE users SET is_admin=? WHERE username=?"
+	setEmailVerifiedQ := "UPDATE users SET email_verified=? WHERE username=?"
+	setEmailQ := "UPDATE users SET email=?, email_verified=? WHERE username=?"
+	setActiveQ := "UPDATE users SET is_active=? WHERE username=?"
+	renameQ := "UPDATE users SET username=? WHERE username=?"
+	setDisplayNameQ := "UPDATE users SET display_name=? WHERE username=?"
+	setAvatarURLQ := "UPDATE users SET avatar_url=? WHERE username=?"
+	setLocaleQ := "UPDATE users SET locale=? WHERE username=?"
+	setTimezoneQ := "UPDATE users SET timezone=? WHERE username=?"
+	insertPendingQ := `
+	INSERT INTO users (username, first_name, last_name, email, password, is_active, last_login, is_pending)
+		VALUES(?, ?, ?, ?, ?, ?, ?, TRUE);
+	`
+	completeQ := "UPDATE users SET first_name=?, last_name=?, is_pending=? WHERE username=?"
 	return &SQLUserQueries{PwLength: pwLength, InitQuery: initQ,
 		InsertQuery: insertQ, ValidateQuery: validateQ, UpdatePasswordQuery: updateQ,
 		ListUsersQuery: listUsersQ, GetUsernameQ: getUsernameQ,
 		DeleteUserQ: deleteQ, GetUserInfoQuery: getUserInfoQ,
-		GetIDQuery: getIDQuery, TimeFromScanType: DefaultTimeFromScanType}
+		GetIDQuery: getIDQuery, ListPIIQuery: listPIIQ, UpdatePIIQuery: updatePIIQ,
+		SetAdminQuery: setAdminQ, SetEmailVerifiedQuery: setEmailVerifiedQ,
+		SetEmailQuery: setEmailQ, SetActiveQuery: setActiveQ, RenameUserQuery: renameQ,
+		SetDisplayNameQuery: setDisplayNameQ, SetAvatarURLQuery: setAvatarURLQ,
+		SetLocaleQuery: setLocaleQ, SetTimezoneQuery: setTimezoneQ,
+		InsertPendingQuery: insertPendingQ, CompleteRegistrationQuery: completeQ,
+		TimeFromScanType: DefaultTimeFromScanType}
 }
 
 // PostgresUserQueries provides queries to use with postgres.
@@ -558,6 +1196,13 @@ func PostgresUserQueries(pwLength int) *SQLUserQueries {
 		password char(%d),
 		is_active bool NOT NULL,
 		last_login timestamp NOT NULL,
+		is_admin bool NOT NULL DEFAULT FALSE,
+		email_verified bool NOT NULL DEFAULT FALSE,
+		is_pending bool NOT NULL DEFAULT FALSE,
+		display_name varchar(150),
+		avatar_url varchar(2048),
+		locale varchar(35),
+		timezone varchar(64),
 		unique (username)
 	);
 	`
@@ -571,13 +1216,35 @@ func PostgresUserQueries(pwLength int) *SQLUserQueries {
 	listUsersQ := "SELECT id, username FROM users"
 	getUsernameQ := "SELECT username FROM users WHERE id = $1"
 	deleteQ := "DELETE FROM users WHERE username = $1"
-	getUserInfoQ := "SELECT id, first_name, last_name, email, is_active, last_login FROM users WHERE username = $1"
+	getUserInfoQ := "SELECT id, first_name, last_name, email, is_active, last_login, is_admin, email_verified, is_pending, display_name, avatar_url, locale, timezone FROM users WHERE username = $1"
 	getIDQuery := "SELECT id FROM users WHERE username = $1"
+	listPIIQ := "SELECT id, first_name, last_name, email FROM users"
+	updatePIIQ := "UPDATE users SET first_name = $1, last_name = $2, email = $3 WHERE id = $4"
+	setAdminQ := "UPDATE users SET is_admin = $1 WHERE username = $2"
+	setEmailVerifiedQ := "UPDATE users SET email_verified = $1 WHERE username = $2"
+	setEmailQ := "UPDATE users SET email = $1, email_verified = $2 WHERE username = $3"
+	setActiveQ := "UPDATE users SET is_active = $1 WHERE username = $2"
+	renameQ := "UPDATE users SET username = $1 WHERE username = $2"
+	setDisplayNameQ := "UPDATE users SET display_name = $1 WHERE username = $2"
+	setAvatarURLQ := "UPDATE users SET avatar_url = $1 WHERE username = $2"
+	setLocaleQ := "UPDATE users SET locale = $1 WHERE username = $2"
+	setTimezoneQ := "UPDATE users SET timezone = $1 WHERE username = $2"
+	insertPendingQ := `
+	INSERT INTO users (username, first_name, last_name, email, password, is_active, last_login, is_pending)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, TRUE);
+	`
+	completeQ := "UPDATE users SET first_name = $1, last_name = $2, is_pending = $3 WHERE username = $4"
 	return &SQLUserQueries{PwLength: pwLength, InitQuery: initQ,
 		InsertQuery: insertQ, ValidateQuery: validateQ, UpdatePasswordQuery: updateQ,
 		ListUsersQuery: listUsersQ, GetUsernameQ: getUsernameQ,
 		DeleteUserQ: deleteQ, GetUserInfoQuery: getUserInfoQ,
-		GetIDQuery: getIDQuery, TimeFromScanType: DefaultTimeFromScanType}
+		GetIDQuery: getIDQuery, ListPIIQuery: listPIIQ, UpdatePIIQuery: updatePIIQ,
+		SetAdminQuery: setAdminQ, SetEmailVerifiedQuery: setEmailVerifiedQ,
+		SetEmailQuery: setEmailQ, SetActiveQuery: setActiveQ, RenameUserQuery: renameQ,
+		SetDisplayNameQuery: setDisplayNameQ, SetAvatarURLQuery: setAvatarURLQ,
+		SetLocaleQuery: setLocaleQ, SetTimezoneQuery: setTimezoneQ,
+		InsertPendingQuery: insertPendingQ, CompleteRegistrationQuery: completeQ,
+		TimeFromScanType: DefaultTimeFromScanType}
 }
 
 // SQLite3UserQueries provides queries to use with sqlite3.
@@ -594,6 +1261,13 @@ func SQLite3UserQueries(pwLength int) *SQLUserQueries {
 		password CHAR(%d),
 		is_active BOOL,
 		last_login DATETIME,
+		is_admin BOOL NOT NULL DEFAULT FALSE,
+		email_verified BOOL NOT NULL DEFAULT FALSE,
+		is_pending BOOL NOT NULL DEFAULT FALSE,
+		display_name VARCHAR(150),
+		avatar_url VARCHAR(2048),
+		locale VARCHAR(35),
+		timezone VARCHAR(64),
 		UNIQUE(username)
 	);
 	`
@@ -602,30 +1276,230 @@ func SQLite3UserQueries(pwLength int) *SQLUserQueries {
 	return res
 }
 
-// SQLUserHandler implements the UserHandler by executing
-// queries as defined in an instance of SQLUserQueries.
-type SQLUserHandler struct {
-	// SQLUserQueries are the queries used to access the database.
-	*SQLUserQueries
-
-	// DB is the database to execute the queries on.
-	DB *sql.DB
-
-	// PwHandler is used to encrypt / validate passwords.
-	PwHandler PasswordHandler
-
-	// required for example for sqlite
-	blockDB bool
-	mutex   sync.RWMutex
+// MySQLTenantUserQueries provides queries to use with MySQL for
+// applications with several tenants (see TenantUserHandler).
+// The users table has an additional column tenant_id and usernames must
+// only be unique per tenant. The queries without tenant (Validate etc.)
+// operate on the default tenant "".
+//
+// New in version v0.7
+func MySQLTenantUserQueries(pwLength int) *SQLUserQueries {
+	res := MySQLUserQueries(pwLength)
+	initQ := `
+	CREATE TABLE IF NOT EXISTS users (
+		id SERIAL,
+		tenant_id VARCHAR(100) NOT NULL DEFAULT '',
+		username VARCHAR(150) NOT NULL,
+		first_name VARCHAR(30) NOT NULL,
+		last_name VARCHAR(30) NOT NULL,
+		email VARCHAR(254),
+		password CHAR(%d),
+		is_active BOOL,
+		last_login DATETIME,
+		is_admin BOOL NOT NULL DEFAULT FALSE,
+		email_verified BOOL NOT NULL DEFAULT FALSE,
+		is_pending BOOL NOT NULL DEFAULT FALSE,
+		display_name VARCHAR(150),
+		avatar_url VARCHAR(2048),
+		locale VARCHAR(35),
+		timezone VARCHAR(64),
+		PRIMARY KEY(id),
+		UNIQUE(tenant_id, username)
+	);
+	`
+	res.InitQuery = fmt.Sprintf(initQ, pwLength)
+	res.ValidateQuery = "SELECT id, password FROM users WHERE tenant_id = '' AND username = ?"
+	res.UpdatePasswordQuery = "UPDATE users SET password=? WHERE tenant_id = '' AND username=?"
+	res.DeleteUserQ = "DELETE FROM users WHERE tenant_id = '' AND username=?"
+	res.GetUserInfoQuery = "SELECT id, first_name, last_name, email, is_active, last_login, is_admin, email_verified, is_pending, display_name, avatar_url, locale, timezone FROM users WHERE tenant_id = '' AND username=?"
+	res.GetIDQuery = "SELECT id FROM users WHERE tenant_id = '' AND username=?"
+	res.SetAdminQuery = "UPDATE users SET is_admin=? WHERE tenant_id = '' AND username=?"
+	res.SetEmailVerifiedQuery = "UPDATE users SET email_verified=? WHERE tenant_id = '' AND username=?"
+	res.SetEmailQuery = "UPDATE users SET email=?, email_verified=? WHERE tenant_id = '' AND username=?"
+	res.SetActiveQuery = "UPDATE users SET is_active=? WHERE tenant_id = '' AND username=?"
+	res.RenameUserQuery = "UPDATE users SET username=? WHERE tenant_id = '' AND username=?"
+	res.SetDisplayNameQuery = "UPDATE users SET display_name=? WHERE tenant_id = '' AND username=?"
+	res.SetAvatarURLQuery = "UPDATE users SET avatar_url=? WHERE tenant_id = '' AND username=?"
+	res.SetLocaleQuery = "UPDATE users SET locale=? WHERE tenant_id = '' AND username=?"
+	res.SetTimezoneQuery = "UPDATE users SET timezone=? WHERE tenant_id = '' AND username=?"
+	res.CompleteRegistrationQuery = "UPDATE users SET first_name=?, last_name=?, is_pending=? WHERE tenant_id = '' AND username=?"
+	res.PendingQuery = "SELECT is_pending FROM users WHERE tenant_id = '' AND username=?"
+	res.TenantInsertQuery = `
+	INSERT INTO users (tenant_id, username, first_name, last_name, email, password, is_active, last_login)
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?);
+	`
+	res.TenantValidateQuery = "SELECT id, password FROM users WHERE tenant_id = ? AND username = ?"
+	res.TenantPendingQuery = "SELECT is_pending FROM users WHERE tenant_id = ? AND username = ?"
+	res.TenantGetIDQuery = "SELECT id FROM users WHERE tenant_id = ? AND username = ?"
+	res.TenantGetUserInfoQuery = "SELECT id, first_name, last_name, email, is_active, last_login, is_admin, email_verified, is_pending, display_name, avatar_url, locale, timezone FROM users WHERE tenant_id = ? AND username = ?"
+	return res
 }
 
-// NewSQLUserHandler returns a new SQLUserHandler given
-// the queries and all the other information required.
-// queries are the queries used to access the database.
-//
-// db is the database to execute the queries on.
+// PostgresTenantUserQueries provides queries to use with postgres for
+// applications with several tenants, see MySQLTenantUserQueries.
 //
-// pwHandler is used to encrypt / validate passwords.
+// New in version v0.7
+func PostgresTenantUserQueries(pwLength int) *SQLUserQueries {
+	res := PostgresUserQueries(pwLength)
+	initQ := `
+	CREATE TABLE IF NOT EXISTS users (
+		id bigserial,
+		tenant_id varchar(100) NOT NULL DEFAULT '',
+		username varchar(150) NOT NULL,
+		first_name varchar(30) NOT NULL,
+		last_name varchar(30) NOT NULL,
+		email varchar(254),
+		password char(%d),
+		is_active bool NOT NULL,
+		last_login timestamp NOT NULL,
+		is_admin bool NOT NULL DEFAULT FALSE,
+		email_verified bool NOT NULL DEFAULT FALSE,
+		is_pending bool NOT NULL DEFAULT FALSE,
+		display_name varchar(150),
+		avatar_url varchar(2048),
+		locale varchar(35),
+		timezone varchar(64),
+		unique (tenant_id, username)
+	);
+	`
+	res.InitQuery = fmt.Sprintf(initQ, pwLength)
+	res.ValidateQuery = "SELECT id, password FROM users WHERE tenant_id = '' AND username = $1"
+	res.UpdatePasswordQuery = "UPDATE users SET password=$1 WHERE tenant_id = '' AND username = $2"
+	res.DeleteUserQ = "DELETE FROM users WHERE tenant_id = '' AND username = $1"
+	res.GetUserInfoQuery = "SELECT id, first_name, last_name, email, is_active, last_login, is_admin, email_verified, is_pending, display_name, avatar_url, locale, timezone FROM users WHERE tenant_id = '' AND username = $1"
+	res.GetIDQuery = "SELECT id FROM users WHERE tenant_id = '' AND username = $1"
+	res.SetAdminQuery = "UPDATE users SET is_admin = $1 WHERE tenant_id = '' AND username = $2"
+	res.SetEmailVerifiedQuery = "UPDATE users SET email_verified = $1 WHERE tenant_id = '' AND username = $2"
+	res.SetEmailQuery = "UPDATE users SET email = $1, email_verified = $2 WHERE tenant_id = '' AND username = $3"
+	res.SetActiveQuery = "UPDATE users SET is_active = $1 WHERE tenant_id = '' AND username = $2"
+	res.RenameUserQuery = "UPDATE users SET username = $1 WHERE tenant_id = '' AND username = $2"
+	res.SetDisplayNameQuery = "UPDATE users SET display_name = $1 WHERE tenant_id = '' AND username = $2"
+	res.SetAvatarURLQuery = "UPDATE users SET avatar_url = $1 WHERE tenant_id = '' AND username = $2"
+	res.SetLocaleQuery = "UPDATE users SET locale = $1 WHERE tenant_id = '' AND username = $2"
+	res.SetTimezoneQuery = "UPDATE users SET timezone = $1 WHERE tenant_id = '' AND username = $2"
+	res.CompleteRegistrationQuery = "UPDATE users SET first_name = $1, last_name = $2, is_pending = $3 WHERE tenant_id = '' AND username = $4"
+	res.PendingQuery = "SELECT is_pending FROM users WHERE tenant_id = '' AND username = $1"
+	res.TenantInsertQuery = `
+	INSERT INTO users (tenant_id, username, first_name, last_name, email, password, is_active, last_login)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8);
+	`
+	res.TenantValidateQuery = "SELECT id, password FROM users WHERE tenant_id = $1 AND username = $2"
+	res.TenantPendingQuery = "SELECT is_pending FROM users WHERE tenant_id = $1 AND username = $2"
+	res.TenantGetIDQuery = "SELECT id FROM users WHERE tenant_id = $1 AND username = $2"
+	res.TenantGetUserInfoQuery = "SELECT id, first_name, last_name, email, is_active, last_login, is_admin, email_verified, is_pending, display_name, avatar_url, locale, timezone FROM users WHERE tenant_id = $1 AND username = $2"
+	return res
+}
+
+// SQLite3TenantUserQueries provides queries to use with sqlite3 for
+// applications with several tenants, see MySQLTenantUserQueries.
+//
+// New in version v0.7
+func SQLite3TenantUserQueries(pwLength int) *SQLUserQueries {
+	res := MySQLTenantUserQueries(pwLength)
+	initQ := `
+	CREATE TABLE IF NOT EXISTS users (
+		id INTEGER PRIMARY KEY,
+		tenant_id VARCHAR(100) NOT NULL DEFAULT '',
+		username VARCHAR(150) NOT NULL,
+		first_name VARCHAR(30) NOT NULL,
+		last_name VARCHAR(30) NOT NULL,
+		email VARCHAR(254),
+		password CHAR(%d),
+		is_active BOOL,
+		last_login DATETIME,
+		is_admin BOOL NOT NULL DEFAULT FALSE,
+		email_verified BOOL NOT NULL DEFAULT FALSE,
+		is_pending BOOL NOT NULL DEFAULT FALSE,
+		display_name VARCHAR(150),
+		avatar_url VARCHAR(2048),
+		locale VARCHAR(35),
+		timezone VARCHAR(64),
+		UNIQUE(tenant_id, username)
+	);
+	`
+	res.InitQuery = fmt.Sprintf(initQ, pwLength)
+	return res
+}
+
+// SQLUserHandler implements the UserHandler by executing
+// queries as defined in an instance of SQLUserQueries.
+type SQLUserHandler struct {
+	// SQLUserQueries are the queries used to access the database.
+	*SQLUserQueries
+
+	// DB is the database to execute the queries on.
+	DB *sql.DB
+
+	// PwHandler is used to encrypt / validate passwords.
+	PwHandler PasswordHandler
+
+	// Encryptor is used to encrypt the first name, last name and email
+	// of users, set to nil (the default) to store them unencrypted.
+	// See FieldEncryptor for details.
+	//
+	// New in version v0.7
+	Encryptor *FieldEncryptor
+
+	// Names is enforced in Insert and RenameUser, the names of deleted and
+	// renamed users are held. Set to nil (the default) to allow all names.
+	// See UsernamePolicy for details.
+	//
+	// New in version v0.7
+	Names *UsernamePolicy
+
+	// Retry is used to retry queries that failed with a transient error,
+	// nil (the default) disables retries. See RetryPolicy for details.
+	//
+	// New in version v0.7
+	Retry *RetryPolicy
+
+	// Timeout is the timeout for each query, 0 (the default) means no timeout.
+	// With retries each attempt gets its own timeout.
+	// See OperationTimeoutHandler.
+	//
+	// New in version v0.7
+	Timeout time.Duration
+
+	// Pragmas are executed by Init before the table is created, see
+	// SQLite3Options.
+	//
+	// New in version v0.7
+	Pragmas []string
+
+	// PoolOptions are applied to DB in Init, may be nil.
+	//
+	// New in version v0.7
+	PoolOptions *SQLPoolOptions
+
+	// PrepareStatements prepares all queries in Init, they're used instead
+	// of the query strings then. Call Close to close the statements.
+	//
+	// New in version v0.7
+	PrepareStatements bool
+
+	// Replica routes the read queries to a replica, nil (the default) sends
+	// all queries to DB. See ReadReplica for details.
+	//
+	// New in version v0.7
+	Replica *ReadReplica
+
+	stmts stmtCache
+
+	// required for example for sqlite
+	blockDB bool
+	mutex   sync.RWMutex
+
+	// set by WithTx
+	tx *sql.Tx
+}
+
+// NewSQLUserHandler returns a new SQLUserHandler given
+// the queries and all the other information required.
+// queries are the queries used to access the database.
+//
+// db is the database to execute the queries on.
+//
+// pwHandler is used to encrypt / validate passwords.
 // Set this to nil if you want to use the default handler
 // (bcrypt with cost 13).
 //
@@ -675,30 +1549,207 @@ func NewPostgresUserHandler(db *sql.DB, pwHandler PasswordHandler) *SQLUserHandl
 		db, pwHandler, false)
 }
 
+// Ping executes a lightweight query to check the connection to the database.
+//
+// New in version v0.7
+func (handler *SQLUserHandler) Ping() error {
+	return handler.Healthy(context.Background())
+}
+
+// Healthy executes a lightweight query to check the connection to the
+// database, see HealthChecker.
+//
+// New in version v0.7
+func (handler *SQLUserHandler) Healthy(ctx context.Context) error {
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	if err := pingDB(ctx, handler.Timeout, handler.DB); err != nil {
+		return err
+	}
+	if handler.Replica != nil {
+		return pingDB(ctx, handler.Timeout, handler.Replica.DB)
+	}
+	return nil
+}
+
+// WithTx returns a handler that executes all queries in the transaction tx.
+// This way an application can for example create a user, assign roles (see
+// SQLRoleHandler.WithTx) and write its own rows atomically:
+//
+//	tx, err := db.Begin()
+//	...
+//	if _, err := users.WithTx(tx).Insert(name, first, last, email, pw); err != nil {
+//		tx.Rollback()
+//		...
+//	}
+//	...
+//	err = tx.Commit()
+//
+// The returned handler shares the queries, PwHandler, Encryptor, Names and
+// Timeout of handler. Queries are neither retried nor prepared, Replica is
+// not used and no mutex is used, the transaction holds a single connection
+// anyway.
+// Committing or rolling back tx is up to the caller, the handler must not be
+// used afterwards. Don't call Init on it.
+//
+// New in version v0.7
+func (handler *SQLUserHandler) WithTx(tx *sql.Tx) *SQLUserHandler {
+	return &SQLUserHandler{SQLUserQueries: handler.SQLUserQueries, DB: handler.DB,
+		PwHandler: handler.PwHandler, Encryptor: handler.Encryptor, Names: handler.Names,
+		Timeout: handler.Timeout, tx: tx}
+}
+
+// conn returns the transaction set by WithTx or DB.
+func (handler *SQLUserHandler) conn() sqlConn {
+	if handler.tx != nil {
+		return handler.tx
+	}
+	return handler.DB
+}
+
+// readConn returns the connection and statement for a read query, see
+// Replica.
+func (handler *SQLUserHandler) readConn(query string) (sqlConn, *sql.Stmt) {
+	if handler.tx != nil {
+		return handler.tx, nil
+	}
+	return handler.Replica.readConn(handler.DB, handler.stmts.get(query))
+}
+
+func (handler *SQLUserHandler) exec(query string, args ...interface{}) (sql.Result, error) {
+	res, err := retryExec(handler.Retry, handler.Timeout, handler.conn(), handler.stmts.get(query), query, args...)
+	handler.Replica.wrote()
+	return res, err
+}
+
+func (handler *SQLUserHandler) queryRow(query string, args ...interface{}) rowScanner {
+	db, stmt := handler.readConn(query)
+	return retryRow{policy: handler.Retry, timeout: handler.Timeout, db: db,
+		stmt: stmt, query: query, args: args}
+}
+
+func (handler *SQLUserHandler) query(query string, args ...interface{}) (timeoutRows, error) {
+	db, stmt := handler.readConn(query)
+	return retryQuery(handler.Retry, handler.Timeout, db, stmt, query, args...)
+}
+
+// OperationTimeout returns the timeout for each query, see
+// OperationTimeoutHandler.
+//
+// New in version v0.7
+func (handler *SQLUserHandler) OperationTimeout() time.Duration {
+	return handler.Timeout
+}
+
+// SetOperationTimeout sets the timeout for each query, see
+// OperationTimeoutHandler.
+//
+// New in version v0.7
+func (handler *SQLUserHandler) SetOperationTimeout(timeout time.Duration) {
+	handler.Timeout = timeout
+}
+
 func (handler *SQLUserHandler) Init() error {
 	if handler.blockDB {
 		handler.mutex.Lock()
 		defer handler.mutex.Unlock()
 	}
-	_, err := handler.DB.Exec(handler.InitQuery)
-	return err
+	if err := execPragmas(handler.exec, handler.Pragmas); err != nil {
+		return err
+	}
+	handler.PoolOptions.Apply(handler.DB)
+	if _, err := handler.exec(handler.InitQuery); err != nil {
+		return err
+	}
+	if handler.PrepareStatements {
+		return handler.stmts.prepare(handler.DB, handler.InsertQuery,
+			handler.ValidateQuery, handler.UpdatePasswordQuery,
+			handler.ListUsersQuery, handler.GetUsernameQ, handler.DeleteUserQ,
+			handler.GetUserInfoQuery, handler.GetIDQuery, handler.ListPIIQuery,
+			handler.UpdatePIIQuery, handler.SetAdminQuery,
+			handler.SetEmailVerifiedQuery, handler.SetActiveQuery,
+			handler.RenameUserQuery, handler.InsertPendingQuery,
+			handler.CompleteRegistrationQuery, handler.PendingQuery,
+			handler.SetEmailQuery, handler.SetDisplayNameQuery,
+			handler.SetAvatarURLQuery, handler.SetLocaleQuery,
+			handler.SetTimezoneQuery, handler.TenantInsertQuery,
+			handler.TenantValidateQuery, handler.TenantGetIDQuery,
+			handler.TenantGetUserInfoQuery, handler.TenantPendingQuery)
+	}
+	return nil
+}
+
+// Close closes the prepared statements, see PrepareStatements. It doesn't
+// close DB.
+//
+// New in version v0.7
+func (handler *SQLUserHandler) Close() error {
+	return handler.stmts.close()
 }
 
 func (handler *SQLUserHandler) Insert(userName, firstName, lastName, email string, plainPW []byte) (uint64, error) {
-	now := CurrentTime()
+	return handler.insert(handler.InsertQuery, nil, userName, firstName, lastName, email, plainPW)
+}
+
+// InsertForTenant inserts a user for the tenant, see TenantUserHandler.
+//
+// New in version v0.7
+func (handler *SQLUserHandler) InsertForTenant(tenant, userName, firstName, lastName, email string, plainPW []byte) (uint64, error) {
+	if handler.TenantInsertQuery == "" {
+		return NoUserID, ErrNotSupported
+	}
+	return handler.insert(handler.TenantInsertQuery, []interface{}{tenant}, userName, firstName, lastName, email, plainPW)
+}
+
+// insert executes the insert query, the values in prefix are passed to the
+// query before the user information.
+func (handler *SQLUserHandler) insert(query string, prefix []interface{}, userName, firstName, lastName, email string, plainPW []byte) (uint64, error) {
+	if err := handler.Names.Check(userName); err != nil {
+		return NoUserID, err
+	}
 	// try to encrypt the pw
 	encrypted, encErr := handler.PwHandler.GenerateHash(plainPW)
 	if encErr != nil {
 		return NoUserID, encErr
 	}
+	return handler.insertHash(query, prefix, userName, firstName, lastName, email, encrypted, true, CurrentTime())
+}
+
+// InsertWithHash inserts a user with an already hashed password, see
+// PasswordHashHandler.
+//
+// New in version v0.7
+func (handler *SQLUserHandler) InsertWithHash(info *BaseUserInformation, hash []byte) (uint64, error) {
+	if err := handler.Names.Check(info.UserName); err != nil {
+		return NoUserID, err
+	}
+	query := handler.InsertQuery
+	if info.IsPending && handler.InsertPendingQuery != "" {
+		if handler.PendingQuery == "" {
+			return NoUserID, ErrNotSupported
+		}
+		query = handler.InsertPendingQuery
+	}
+	return handler.insertHash(query, nil, info.UserName, info.FirstName, info.LastName, info.Email, hash, info.IsActive, info.LastLogin)
+}
+
+// insertHash executes the insert query with the hashed password.
+func (handler *SQLUserHandler) insertHash(query string, prefix []interface{}, userName, firstName, lastName, email string, encrypted []byte, active bool, lastLogin time.Time) (uint64, error) {
+	firstName, lastName, email, encErr := handler.Encryptor.encryptUser(firstName, lastName, email)
+	if encErr != nil {
+		return NoUserID, encErr
+	}
 
 	if handler.blockDB {
 		handler.mutex.Lock()
 		defer handler.mutex.Unlock()
 	}
-	res, err := handler.DB.Exec(handler.InsertQuery, userName, firstName, lastName, email, encrypted, true, now)
+	args := append(prefix, userName, firstName, lastName, email, encrypted, active, lastLogin)
+	res, err := handler.exec(query, args...)
 	if err != nil {
-		return NoUserID, err
+		return NoUserID, wrapInsertUserError("sql", err)
 	}
 
 	// insert worked, try to get the last insert id
@@ -716,19 +1767,40 @@ func (handler *SQLUserHandler) Insert(userName, firstName, lastName, email strin
 }
 
 func (handler *SQLUserHandler) Validate(userName string, cleartextPwCheck []byte) (uint64, error) {
+	return handler.validate(cleartextPwCheck, handler.ValidateQuery, handler.PendingQuery, userName)
+}
+
+// ValidateForTenant validates the password of a user of the tenant, see
+// TenantUserHandler.
+//
+// New in version v0.7
+func (handler *SQLUserHandler) ValidateForTenant(tenant, userName string, cleartextPwCheck []byte) (uint64, error) {
+	if handler.TenantValidateQuery == "" {
+		return NoUserID, ErrNotSupported
+	}
+	return handler.validate(cleartextPwCheck, handler.TenantValidateQuery, handler.TenantPendingQuery, tenant, userName)
+}
+
+// validate checks the password, if pendingQuery is not empty it's used to
+// check if the registration of the user is complete.
+func (handler *SQLUserHandler) validate(cleartextPwCheck []byte, query, pendingQuery string, args ...interface{}) (uint64, error) {
 	if handler.blockDB {
 		handler.mutex.RLock()
 		defer handler.mutex.RUnlock()
 	}
 	// first try to get the id and the password
-	row := handler.DB.QueryRow(handler.ValidateQuery, userName)
+	row := handler.queryRow(query, args...)
 	var userId uint64
 	var hashPw []byte
 	if err := row.Scan(&userId, &hashPw); err != nil {
 		if err == sql.ErrNoRows {
 			return NoUserID, ErrUserNotFound
 		}
-		return NoUserID, err
+		return NoUserID, wrapBackendError("sql", "Validate", err)
+	}
+	// the password might have been cleared, the user can't log in then
+	if len(hashPw) == 0 {
+		return NoUserID, nil
 	}
 	// validate the password
 	test, err := handler.PwHandler.CheckPassword(hashPw, cleartextPwCheck)
@@ -737,12 +1809,44 @@ func (handler *SQLUserHandler) Validate(userName string, cleartextPwCheck []byte
 	}
 	// no error, check if passwords did match
 	if test {
+		if pendingQuery != "" {
+			var pending sql.NullBool
+			if err := handler.queryRow(pendingQuery, args...).Scan(&pending); err != nil {
+				return NoUserID, wrapBackendError("sql", "Validate", err)
+			}
+			if pending.Valid && pending.Bool {
+				return userId, ErrRegistrationPending
+			}
+		}
 		return userId, nil
 	} else {
 		return NoUserID, nil
 	}
 }
 
+// GetPasswordHash returns the stored hash of the password, see
+// PasswordHashHandler.
+//
+// New in version v0.7
+func (handler *SQLUserHandler) GetPasswordHash(userName string) ([]byte, error) {
+	if handler.blockDB {
+		handler.mutex.RLock()
+		defer handler.mutex.RUnlock()
+	}
+	var userID uint64
+	var hash []byte
+	if err := handler.queryRow(handler.ValidateQuery, userName).Scan(&userID, &hash); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrUserNotFound
+		}
+		return nil, wrapBackendError("sql", "GetPasswordHash", err)
+	}
+	if len(hash) == 0 {
+		return nil, nil
+	}
+	return hash, nil
+}
+
 func (handler *SQLUserHandler) UpdatePassword(username string, plainPW []byte) error {
 	// try to encrypt the pw
 	encrypted, encErr := handler.PwHandler.GenerateHash(plainPW)
@@ -756,7 +1860,135 @@ func (handler *SQLUserHandler) UpdatePassword(username string, plainPW []byte) e
 	}
 
 	// now try to update the password
-	_, err := handler.DB.Exec(handler.UpdatePasswordQuery, encrypted, username)
+	_, err := handler.exec(handler.UpdatePasswordQuery, encrypted, username)
+	return wrapBackendError("sql", "UpdatePassword", err)
+}
+
+// SetAdmin sets the admin flag of the user, see AdminFlagHandler.
+//
+// New in version v0.7
+func (handler *SQLUserHandler) SetAdmin(userName string, admin bool) error {
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	_, err := handler.exec(handler.SetAdminQuery, admin, userName)
+	return wrapBackendError("sql", "SetAdmin", err)
+}
+
+// SetEmailVerified sets the email_verified flag of the user, see
+// EmailVerifiedHandler.
+//
+// New in version v0.7
+func (handler *SQLUserHandler) SetEmailVerified(userName string, verified bool) error {
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	_, err := handler.exec(handler.SetEmailVerifiedQuery, verified, userName)
+	return wrapBackendError("sql", "SetEmailVerified", err)
+}
+
+// SetEmail sets the email address of the user, see EmailVerifiedHandler.
+//
+// New in version v0.7
+func (handler *SQLUserHandler) SetEmail(userName, email string, verified bool) error {
+	email, err := handler.Encryptor.encryptEmail(email)
+	if err != nil {
+		return err
+	}
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	_, err = handler.exec(handler.SetEmailQuery, email, verified, userName)
+	return wrapBackendError("sql", "SetEmail", err)
+}
+
+// SetActive sets the is_active flag of the user, see ActiveFlagHandler.
+//
+// New in version v0.7
+func (handler *SQLUserHandler) SetActive(userName string, active bool) error {
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	_, err := handler.exec(handler.SetActiveQuery, active, userName)
+	return wrapBackendError("sql", "SetActive", err)
+}
+
+// SetDisplayName sets the display name of the user, see ProfileHandler.
+//
+// New in version v0.7
+func (handler *SQLUserHandler) SetDisplayName(userName, displayName string) error {
+	return handler.setProfileField("SetDisplayName", handler.SetDisplayNameQuery, userName, displayName, CheckDisplayName)
+}
+
+// SetAvatarURL sets the avatar url of the user, see ProfileHandler.
+//
+// New in version v0.7
+func (handler *SQLUserHandler) SetAvatarURL(userName, avatarURL string) error {
+	return handler.setProfileField("SetAvatarURL", handler.SetAvatarURLQuery, userName, avatarURL, CheckAvatarURL)
+}
+
+// SetLocale sets the locale of the user, see LocaleHandler.
+//
+// New in version v0.7
+func (handler *SQLUserHandler) SetLocale(userName, locale string) error {
+	locale, err := NormalizeLocale(locale)
+	if err != nil {
+		return err
+	}
+	return handler.setProfileField("SetLocale", handler.SetLocaleQuery, userName, locale, CheckLocale)
+}
+
+// SetTimezone sets the timezone of the user, see LocaleHandler.
+//
+// New in version v0.7
+func (handler *SQLUserHandler) SetTimezone(userName, timezone string) error {
+	return handler.setProfileField("SetTimezone", handler.SetTimezoneQuery, userName, timezone, CheckTimezone)
+}
+
+// setProfileField checks the value and stores it, the empty string is stored
+// as NULL.
+func (handler *SQLUserHandler) setProfileField(op, query, userName, value string, check func(string) error) error {
+	if err := check(value); err != nil {
+		return err
+	}
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	_, err := handler.exec(query, sql.NullString{String: value, Valid: value != ""}, userName)
+	return wrapBackendError("sql", op, err)
+}
+
+// HasPassword reports whether the user has a password, i.e. the password
+// column is neither NULL nor empty.
+func (handler *SQLUserHandler) HasPassword(userName string) (bool, error) {
+	if handler.blockDB {
+		handler.mutex.RLock()
+		defer handler.mutex.RUnlock()
+	}
+	row := handler.queryRow(handler.ValidateQuery, userName)
+	var userId uint64
+	var hashPw []byte
+	if err := row.Scan(&userId, &hashPw); err != nil {
+		if err == sql.ErrNoRows {
+			return false, ErrUserNotFound
+		}
+		return false, wrapBackendError("sql", "HasPassword", err)
+	}
+	return len(hashPw) > 0, nil
+}
+
+// ClearPassword sets the password of the user to NULL.
+func (handler *SQLUserHandler) ClearPassword(userName string) error {
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	_, err := handler.exec(handler.UpdatePasswordQuery, nil, userName)
 	return err
 }
 
@@ -767,7 +1999,7 @@ func (handler *SQLUserHandler) ListUsers() (map[uint64]string, error) {
 	}
 
 	// try to get the results
-	rows, err := handler.DB.Query(handler.ListUsersQuery)
+	rows, err := handler.query(handler.ListUsersQuery)
 	if err != nil {
 		return nil, err
 	}
@@ -794,7 +2026,7 @@ func (handler *SQLUserHandler) GetUserName(id uint64) (string, error) {
 		handler.mutex.RLock()
 		defer handler.mutex.RUnlock()
 	}
-	row := handler.DB.QueryRow(handler.GetUsernameQ, id)
+	row := handler.queryRow(handler.GetUsernameQ, id)
 	var username string
 	if err := row.Scan(&username); err != nil {
 		if err == sql.ErrNoRows {
@@ -810,44 +2042,309 @@ func (handler *SQLUserHandler) DeleteUser(username string) error {
 		handler.mutex.Lock()
 		defer handler.mutex.Unlock()
 	}
-	_, err := handler.DB.Exec(handler.DeleteUserQ, username)
-	return err
+	res, err := handler.exec(handler.DeleteUserQ, username)
+	if err != nil || handler.Names == nil {
+		return err
+	}
+	if num, err := res.RowsAffected(); err == nil && num == 0 {
+		// the user didn't exist, there is nothing to hold
+		return nil
+	}
+	return handler.Names.Hold(username)
+}
+
+// InsertPending inserts a user with only username, email and password whose
+// registration is pending, see PendingUserHandler.
+//
+// New in version v0.7
+func (handler *SQLUserHandler) InsertPending(userName, email string, plainPW []byte) (uint64, error) {
+	// without PendingQuery pending users could log in
+	if handler.PendingQuery == "" {
+		return NoUserID, ErrNotSupported
+	}
+	return handler.insert(handler.InsertPendingQuery, nil, userName, "", "", email, plainPW)
+}
+
+// CompleteRegistration sets the profile of a pending user and completes the
+// registration, see PendingUserHandler.
+//
+// New in version v0.7
+func (handler *SQLUserHandler) CompleteRegistration(userName, firstName, lastName string) error {
+	firstName, lastName, _, err := handler.Encryptor.encryptUser(firstName, lastName, "")
+	if err != nil {
+		return err
+	}
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	res, err := handler.exec(handler.CompleteRegistrationQuery, firstName, lastName, false, userName)
+	if err != nil {
+		return wrapBackendError("sql", "CompleteRegistration", err)
+	}
+	if num, err := res.RowsAffected(); err == nil && num == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// RenameUser changes the username, see UserRenamer. The new name must be
+// allowed by Names, the old name is held.
+//
+// New in version v0.7
+func (handler *SQLUserHandler) RenameUser(oldName, newName string) error {
+	if oldName == newName {
+		return nil
+	}
+	if err := handler.Names.Check(newName); err != nil {
+		return err
+	}
+	if err := handler.rename(oldName, newName); err != nil {
+		return err
+	}
+	return handler.Names.Hold(oldName)
+}
+
+func (handler *SQLUserHandler) rename(oldName, newName string) error {
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	res, err := handler.exec(handler.RenameUserQuery, newName, oldName)
+	if err != nil {
+		if IsDuplicateKeyError(err) {
+			return ErrDuplicateUsername
+		}
+		return wrapBackendError("sql", "RenameUser", err)
+	}
+	if num, err := res.RowsAffected(); err == nil && num == 0 {
+		return ErrUserNotFound
+	}
+	return nil
 }
 
 func (handler *SQLUserHandler) GetUserID(userName string) (uint64, error) {
+	return handler.getUserID(handler.GetIDQuery, userName)
+}
+
+// GetUserIDForTenant returns the id of a user of the tenant, see
+// TenantUserHandler.
+//
+// New in version v0.7
+func (handler *SQLUserHandler) GetUserIDForTenant(tenant, userName string) (uint64, error) {
+	if handler.TenantGetIDQuery == "" {
+		return NoUserID, ErrNotSupported
+	}
+	return handler.getUserID(handler.TenantGetIDQuery, tenant, userName)
+}
+
+func (handler *SQLUserHandler) getUserID(query string, args ...interface{}) (uint64, error) {
 	if handler.blockDB {
 		handler.mutex.RLock()
 		defer handler.mutex.RUnlock()
 	}
-	row := handler.DB.QueryRow(handler.GetIDQuery, userName)
+	row := handler.queryRow(query, args...)
 	var id uint64
 	if err := row.Scan(&id); err != nil {
 		if err == sql.ErrNoRows {
 			return NoUserID, ErrUserNotFound
 		}
-		return NoUserID, err
+		return NoUserID, wrapBackendError("sql", "GetUserID", err)
 	}
 	return id, nil
 }
 
-// getUserInfoQ := "SELECT id, first_name, last_name, email, is_active, last_login FROM users WHERE id=?"
+// getUserInfoQ := "SELECT id, first_name, last_name, email, is_active, last_login, is_admin, email_verified, is_pending, display_name, avatar_url, locale, timezone FROM users WHERE id=?"
 func (handler *SQLUserHandler) GetUserBaseInfo(userName string) (*BaseUserInformation, error) {
-	row := handler.DB.QueryRow(handler.GetUserInfoQuery, userName)
+	return handler.getUserBaseInfo(userName, handler.GetUserInfoQuery, userName)
+}
+
+// GetUserBaseInfoForTenant returns the information of a user of the tenant,
+// see TenantUserHandler.
+//
+// New in version v0.7
+func (handler *SQLUserHandler) GetUserBaseInfoForTenant(tenant, userName string) (*BaseUserInformation, error) {
+	if handler.TenantGetUserInfoQuery == "" {
+		return nil, ErrNotSupported
+	}
+	return handler.getUserBaseInfo(userName, handler.TenantGetUserInfoQuery, tenant, userName)
+}
+
+func (handler *SQLUserHandler) getUserBaseInfo(userName, query string, args ...interface{}) (*BaseUserInformation, error) {
+	row := handler.queryRow(query, args...)
 	var id uint64
 	var firstName, lastName, email string
 	var isActive bool
+	var isAdmin, emailVerified, isPending sql.NullBool
+	var displayName, avatarURL, locale, timezone sql.NullString
 	var lastLoginVal interface{}
-	if err := row.Scan(&id, &firstName, &lastName, &email, &isActive, &lastLoginVal); err != nil {
+	if err := row.Scan(&id, &firstName, &lastName, &email, &isActive, &lastLoginVal, &isAdmin, &emailVerified, &isPending,
+		&displayName, &avatarURL, &locale, &timezone); err != nil {
 		if err == sql.ErrNoRows {
 			return nil, ErrUserNotFound
 		}
-		return nil, err
+		return nil, wrapBackendError("sql", "GetUserBaseInfo", err)
 	}
 	lastLogin, loginParseErr := handler.TimeFromScanType(lastLoginVal)
 	if loginParseErr != nil {
 		return nil, loginParseErr
 	}
 	res := &BaseUserInformation{ID: id, UserName: userName, FirstName: firstName,
-		LastName: lastName, Email: email, LastLogin: lastLogin, IsActive: isActive}
+		LastName: lastName, Email: email, LastLogin: lastLogin, IsActive: isActive,
+		IsAdmin: isAdmin.Valid && isAdmin.Bool, EmailVerified: emailVerified.Valid && emailVerified.Bool,
+		IsPending: isPending.Valid && isPending.Bool, DisplayName: displayName.String,
+		AvatarURL: avatarURL.String, Locale: locale.String, Timezone: timezone.String}
+	if err := handler.Encryptor.decryptUser(res); err != nil {
+		return nil, err
+	}
 	return res, nil
 }
+
+// ReencryptPII encrypts the personal information of all users with the
+// current key of the Encryptor, see PIIReencrypter.
+// Returns ErrNotSupported if no Encryptor is set.
+//
+// New in version v0.7
+func (handler *SQLUserHandler) ReencryptPII() (int, error) {
+	if handler.Encryptor == nil {
+		return 0, ErrNotSupported
+	}
+	if handler.blockDB {
+		handler.mutex.Lock()
+		defer handler.mutex.Unlock()
+	}
+	type piiEntry struct {
+		id                         uint64
+		firstName, lastName, email string
+	}
+	rows, err := handler.query(handler.ListPIIQuery)
+	if err != nil {
+		return 0, wrapBackendError("sql", "ReencryptPII", err)
+	}
+	var updates []piiEntry
+	for rows.Next() {
+		var entry piiEntry
+		var email sql.NullString
+		if err := rows.Scan(&entry.id, &entry.firstName, &entry.lastName, &email); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		var changed bool
+		entry.firstName, entry.lastName, entry.email, changed, err = handler.Encryptor.reencryptUser(entry.firstName, entry.lastName, email.String)
+		if err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("goauth: re-encrypting user %d: %w", entry.id, err)
+		}
+		if changed {
+			updates = append(updates, entry)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	// update after the query has finished, sqlite doesn't like updates
+	// while a query is running
+	for i, entry := range updates {
+		if _, err := handler.exec(handler.UpdatePIIQuery, entry.firstName, entry.lastName, entry.email, entry.id); err != nil {
+			return i, wrapBackendError("sql", "ReencryptPII", err)
+		}
+	}
+	return len(updates), nil
+}
+
+// MySQLTenantSessionTemplate is a MySQLSessionTemplate with an additional
+// column tenant_id, it implements SQLSessionTenantTemplate.
+// The queries without tenant operate on the default tenant "".
+//
+// New in version v0.7
+type MySQLTenantSessionTemplate struct {
+	MySQLSessionTemplate
+}
+
+// NewMySQLTenantSessionTemplate returns a new MySQLTenantSessionTemplate.
+func NewMySQLTenantSessionTemplate() MySQLTenantSessionTemplate {
+	return MySQLTenantSessionTemplate{MySQLSessionTemplate: NewMySQLSessionTemplate()}
+}
+
+func (t MySQLTenantSessionTemplate) InitQ() string {
+	return `CREATE TABLE IF NOT EXISTS %s (
+		tenant_id VARCHAR(100) NOT NULL DEFAULT '',
+		user_id %s,
+		session_key CHAR(%d) NOT NULL,
+		created DATETIME NOT NULL,
+		valid_until DATETIME NOT NULL,
+		PRIMARY KEY (session_key)
+	);`
+}
+
+func (t MySQLTenantSessionTemplate) GetQ() string {
+	return "SELECT user_id, created, valid_until FROM %s WHERE tenant_id = '' AND session_key = ?;"
+}
+
+func (t MySQLTenantSessionTemplate) GetForTenantQ() string {
+	return "SELECT user_id, created, valid_until FROM %s WHERE tenant_id = ? AND session_key = ?;"
+}
+
+func (t MySQLTenantSessionTemplate) CreateForTenantQ() string {
+	return "INSERT INTO %s (tenant_id, user_id, session_key, created, valid_until) VALUES (?, ?, ?, ?, ?);"
+}
+
+// SQLite3TenantSessionTemplate is the sqlite3 version of
+// MySQLTenantSessionTemplate.
+//
+// New in version v0.7
+type SQLite3TenantSessionTemplate struct {
+	MySQLTenantSessionTemplate
+}
+
+// NewSQLite3TenantSessionTemplate returns a new SQLite3TenantSessionTemplate.
+func NewSQLite3TenantSessionTemplate() *SQLite3TenantSessionTemplate {
+	return &SQLite3TenantSessionTemplate{MySQLTenantSessionTemplate: NewMySQLTenantSessionTemplate()}
+}
+
+func (*SQLite3TenantSessionTemplate) InitQ() string {
+	return `CREATE TABLE IF NOT EXISTS %s (
+		tenant_id VARCHAR(100) NOT NULL DEFAULT '',
+		user_id %s,
+		session_key CHAR(%d) NOT NULL PRIMARY KEY,
+		created DATETIME NOT NULL,
+		valid_until DATETIME NOT NULL
+	);`
+}
+
+// PostgresTenantSessionTemplate is the postgres version of
+// MySQLTenantSessionTemplate.
+//
+// New in version v0.7
+type PostgresTenantSessionTemplate struct {
+	PostgresSessionTemplate
+}
+
+// NewPostgresTenantSessionTemplate returns a new PostgresTenantSessionTemplate.
+func NewPostgresTenantSessionTemplate() PostgresTenantSessionTemplate {
+	return PostgresTenantSessionTemplate{PostgresSessionTemplate: NewPostgresSessionTemplate()}
+}
+
+func (t PostgresTenantSessionTemplate) InitQ() string {
+	return `CREATE TABLE IF NOT EXISTS %s (
+		tenant_id VARCHAR(100) NOT NULL DEFAULT '',
+		user_id %s,
+		session_key CHAR(%d) NOT NULL,
+		created TIMESTAMP NOT NULL,
+		valid_until TIMESTAMP NOT NULL,
+		PRIMARY KEY (session_key)
+	);`
+}
+
+func (t PostgresTenantSessionTemplate) GetQ() string {
+	return "SELECT user_id, created, valid_until FROM %s WHERE tenant_id = '' AND session_key = $1;"
+}
+
+func (t PostgresTenantSessionTemplate) GetForTenantQ() string {
+	return "SELECT user_id, created, valid_until FROM %s WHERE tenant_id = $1 AND session_key = $2;"
+}
+
+func (t PostgresTenantSessionTemplate) CreateForTenantQ() string {
+	return "INSERT INTO %s (tenant_id, user_id, session_key, created, valid_until) VALUES ($1, $2, $3, $4, $5);"
+}
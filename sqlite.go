@@ -0,0 +1,142 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package goauth
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// SQLite3Options configures a sqlite3 database for concurrent access.
+// With journal_mode=WAL readers don't block writers (and the other way round)
+// and with a busy timeout sqlite waits for a lock instead of returning
+// "database is locked", so most applications don't need blockDB any more.
+//
+// Note that busy_timeout and foreign_keys are set per connection: Init
+// executes them on one connection of the pool only. Either limit the pool to
+// one connection (db.SetMaxOpenConns(1)) or add DSNParams to the data source
+// name when opening the database. journal_mode=WAL is stored in the database
+// file and applies to all connections.
+//
+// New in version v0.7
+type SQLite3Options struct {
+	// JournalMode is the journal mode, for example "WAL". If empty the mode is
+	// not changed.
+	JournalMode string
+
+	// BusyTimeout is the time sqlite waits for a lock, 0 means no timeout is
+	// set.
+	BusyTimeout time.Duration
+
+	// ForeignKeys enables foreign key constraints.
+	ForeignKeys bool
+
+	// BlockDB is passed to the handler constructors, see NewSQLUserHandler.
+	// It's not required with WAL and a busy timeout.
+	BlockDB bool
+}
+
+// DefaultSQLite3Options returns options with journal_mode=WAL, a busy timeout
+// of 5 seconds, foreign keys enabled and BlockDB set to false.
+//
+// New in version v0.7
+func DefaultSQLite3Options() *SQLite3Options {
+	return &SQLite3Options{JournalMode: "WAL", BusyTimeout: 5 * time.Second,
+		ForeignKeys: true}
+}
+
+// Pragmas returns the PRAGMA statements for the options.
+func (opts *SQLite3Options) Pragmas() []string {
+	var res []string
+	if opts.JournalMode != "" {
+		res = append(res, fmt.Sprintf("PRAGMA journal_mode=%s;", opts.JournalMode))
+	}
+	if opts.BusyTimeout > 0 {
+		res = append(res, fmt.Sprintf("PRAGMA busy_timeout=%d;", opts.BusyTimeout.Milliseconds()))
+	}
+	if opts.ForeignKeys {
+		res = append(res, "PRAGMA foreign_keys=ON;")
+	}
+	return res
+}
+
+// DSNParams returns the options as data source name parameters for
+// github.com/mattn/go-sqlite3, for example
+// "file:auth.db?" + opts.DSNParams().Encode().
+// This way the pragmas are set for each connection of the pool.
+func (opts *SQLite3Options) DSNParams() url.Values {
+	res := make(url.Values)
+	if opts.JournalMode != "" {
+		res.Set("_journal_mode", opts.JournalMode)
+	}
+	if opts.BusyTimeout > 0 {
+		res.Set("_busy_timeout", strconv.FormatInt(opts.BusyTimeout.Milliseconds(), 10))
+	}
+	if opts.ForeignKeys {
+		res.Set("_foreign_keys", "1")
+	}
+	return res
+}
+
+// NewSQLite3SessionHandlerWithOptions is like NewSQLite3SessionHandler but
+// sets the pragmas of opts at Init. If opts is nil DefaultSQLite3Options is
+// used.
+//
+// New in version v0.7
+func NewSQLite3SessionHandlerWithOptions(db *sql.DB, tableName, userIDType string, opts *SQLite3Options) *SQLSessionHandler {
+	if opts == nil {
+		opts = DefaultSQLite3Options()
+	}
+	res := NewSQLSessionHandler(db, NewSQLite3SessionTemplate(), tableName, userIDType, opts.BlockDB)
+	res.Pragmas = opts.Pragmas()
+	return res
+}
+
+// NewSQLite3UserHandlerWithOptions is like NewSQLite3UserHandler but sets
+// the pragmas of opts at Init. If opts is nil DefaultSQLite3Options is used.
+//
+// New in version v0.7
+func NewSQLite3UserHandlerWithOptions(db *sql.DB, pwHandler PasswordHandler, opts *SQLite3Options) *SQLUserHandler {
+	if opts == nil {
+		opts = DefaultSQLite3Options()
+	}
+	if pwHandler == nil {
+		pwHandler = DefaultPWHandler
+	}
+	res := NewSQLUserHandler(SQLite3UserQueries(pwHandler.PasswordHashLength()),
+		db, pwHandler, opts.BlockDB)
+	res.Pragmas = opts.Pragmas()
+	return res
+}
+
+// execPragmas executes the pragma statements.
+func execPragmas(exec func(query string, args ...interface{}) (sql.Result, error), pragmas []string) error {
+	for _, pragma := range pragmas {
+		if _, err := exec(pragma); err != nil {
+			return wrapBackendError("sql", "Init", err)
+		}
+	}
+	return nil
+}
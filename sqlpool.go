@@ -0,0 +1,119 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package goauth
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+)
+
+// SQLPoolOptions configures the connection pool of a sql.DB, zero values
+// leave the setting unchanged. The SQL handlers apply them in Init, see
+// SQLSessionHandler.PoolOptions and SQLUserHandler.PoolOptions.
+//
+// Note that the settings apply to the whole sql.DB, so if several handlers
+// share the database set the options on one of them only.
+//
+// New in version v0.7
+type SQLPoolOptions struct {
+	// MaxOpenConns is the maximal number of open connections.
+	MaxOpenConns int
+
+	// MaxIdleConns is the maximal number of idle connections.
+	MaxIdleConns int
+
+	// ConnMaxLifetime is the maximal time a connection is reused.
+	ConnMaxLifetime time.Duration
+
+	// ConnMaxIdleTime is the maximal time a connection is idle.
+	ConnMaxIdleTime time.Duration
+}
+
+// Apply sets the options on db.
+func (opts *SQLPoolOptions) Apply(db *sql.DB) {
+	if opts == nil {
+		return
+	}
+	if opts.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(opts.MaxOpenConns)
+	}
+	if opts.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(opts.MaxIdleConns)
+	}
+	if opts.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(opts.ConnMaxLifetime)
+	}
+	if opts.ConnMaxIdleTime > 0 {
+		db.SetConnMaxIdleTime(opts.ConnMaxIdleTime)
+	}
+}
+
+// stmtCache holds prepared statements by their query.
+type stmtCache struct {
+	mutex sync.RWMutex
+	stmts map[string]*sql.Stmt
+}
+
+// prepare prepares all (non-empty) queries that are not already prepared.
+func (c *stmtCache) prepare(db *sql.DB, queries ...string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.stmts == nil {
+		c.stmts = make(map[string]*sql.Stmt, len(queries))
+	}
+	for _, query := range queries {
+		if query == "" {
+			continue
+		}
+		if _, has := c.stmts[query]; has {
+			continue
+		}
+		stmt, err := db.Prepare(query)
+		if err != nil {
+			return wrapBackendError("sql", "Prepare", err)
+		}
+		c.stmts[query] = stmt
+	}
+	return nil
+}
+
+// get returns the statement for query or nil.
+func (c *stmtCache) get(query string) *sql.Stmt {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.stmts[query]
+}
+
+// close closes all statements.
+func (c *stmtCache) close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var res error
+	for query, stmt := range c.stmts {
+		if err := stmt.Close(); err != nil && res == nil {
+			res = err
+		}
+		delete(c.stmts, query)
+	}
+	return res
+}
@@ -0,0 +1,184 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+	log "github.com/sirupsen/logrus"
+)
+
+// AudiencesPayloadName is the name of the payload value that stores the
+// audiences of a session, see SessionController.Audiences.
+//
+// New in version v0.7
+const AudiencesPayloadName = "audiences"
+
+// ErrWrongAudience is returned by ValidateSession if the session was not
+// issued for SessionController.Audience.
+//
+// New in version v0.7
+var ErrWrongAudience = errors.New("The session was not issued for this application.")
+
+// SessionAudiences returns the audiences of the session with the given key,
+// nil if the session has no audiences.
+//
+// New in version v0.7
+func SessionAudiences(payload SessionPayloadHandler, key string) ([]string, error) {
+	value, err := payload.GetPayloadValue(key, AudiencesPayloadName)
+	switch err {
+	case nil:
+		return strings.Fields(value), nil
+	case ErrPayloadValueNotFound:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+// audiences returns the audiences for new sessions.
+func (c *SessionController) audiences() []string {
+	if len(c.Audiences) > 0 {
+		return c.Audiences
+	}
+	if c.Audience != "" {
+		return []string{c.Audience}
+	}
+	return nil
+}
+
+// errNoAudiencePayload is returned if audiences are used without
+// SessionController.Payload.
+var errNoAudiencePayload = errors.New("goauth: SessionController.Payload is required for audiences")
+
+// setAudiences stores the audiences of a new key in Payload, if the
+// audiences can't be stored the key is deleted.
+func (c *SessionController) setAudiences(key string, validUntil time.Time) error {
+	audiences := c.audiences()
+	if audiences == nil {
+		return nil
+	}
+	err := errNoAudiencePayload
+	if c.Payload != nil {
+		err = c.Payload.SetPayloadValue(key, AudiencesPayloadName, strings.Join(audiences, " "), validUntil)
+	}
+	if err != nil {
+		// don't leave a key without audiences behind
+		if delErr := c.DeleteKey(key); delErr != nil {
+			log.WithError(delErr).Error("goauth: Can't delete key after failing to store its audiences")
+		}
+	}
+	return err
+}
+
+// checkAudience returns ErrWrongAudience if Audience is set and not one of
+// the audiences of the session with the given key. Sessions created before
+// Audience was set have no audiences and are rejected as well.
+func (c *SessionController) checkAudience(key string) error {
+	if c.Audience == "" {
+		return nil
+	}
+	if c.Payload == nil {
+		return errNoAudiencePayload
+	}
+	audiences, err := SessionAudiences(c.Payload, key)
+	if err != nil {
+		return err
+	}
+	for _, audience := range audiences {
+		if audience == c.Audience {
+			return nil
+		}
+	}
+	return ErrWrongAudience
+}
+
+// SSOCookieOptions returns options for a session cookie that is shared by
+// all subdomains of domain, for example "example.com" for app.example.com
+// and admin.example.com. The cookie is secure, http only and SameSite lax
+// (so top level navigations between the applications keep the session).
+//
+// All applications that share the cookie must use the same cookie name,
+// the same keys for the cookie store and the same session backend and
+// payload storage. Set SessionController.Audience in each application to
+// restrict the applications a session is valid for.
+//
+// Usage:
+//
+//	store := sessions.NewCookieStore(hashKey, blockKey)
+//	store.Options = goauth.SSOCookieOptions("example.com", 86400)
+//
+// New in version v0.7
+func SSOCookieOptions(domain string, maxAge int) *sessions.Options {
+	return &sessions.Options{
+		Path:     "/",
+		Domain:   domain,
+		MaxAge:   maxAge,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// ParentCookieDomain returns the longest domain that all hosts are
+// subdomains of (or equal to), for example "example.com" for
+// "app.example.com" and "admin.example.com:8080". Ports are ignored.
+// An error is returned for IP addresses and if the hosts don't share a
+// domain with at least two labels.
+// Note that public suffixes (like "co.uk") are not detected, browsers
+// reject cookies for them.
+//
+// New in version v0.7
+func ParentCookieDomain(hosts ...string) (string, error) {
+	var common []string
+	for i, host := range hosts {
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.TrimSuffix(strings.ToLower(host), ".")
+		if net.ParseIP(host) != nil {
+			return "", fmt.Errorf("goauth: Can't share cookies with IP address %s", host)
+		}
+		labels := strings.Split(host, ".")
+		if i == 0 {
+			common = labels
+			continue
+		}
+		n := 0
+		for n < len(common) && n < len(labels) &&
+			common[len(common)-1-n] == labels[len(labels)-1-n] {
+			n++
+		}
+		common = common[len(common)-n:]
+	}
+	if len(common) < 2 {
+		return "", fmt.Errorf("goauth: Hosts %v don't share a domain", hosts)
+	}
+	return strings.Join(common, "."), nil
+}
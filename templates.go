@@ -0,0 +1,121 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"html/template"
+	"net/http"
+)
+
+// TemplateHelpers provides functions for html/template that read the
+// session stored in the request context by the SessionMiddleware:
+//
+//	currentUser      the *BaseUserInformation of the user, nil without session
+//	isAuthenticated  true if the request has a session of a (non guest) user
+//	hasRole          true if the user has the role (false without session)
+//	hasPermission    true if the user has the permission (false without session)
+//
+// If CSRF is set the functions of CSRFProtection.TemplateFuncs ("csrfToken"
+// and "csrfField") are included. currentUser requires Users, hasRole and
+// hasPermission require Checker.
+//
+// As with CSRFProtection.TemplateFuncs the functions must be known when
+// parsing the template, so add them with nil arguments before parsing and
+// again with the request before executing the template:
+//
+//	helpers := &goauth.TemplateHelpers{Users: users, Checker: checker, CSRF: csrf}
+//	tmpl := template.Must(template.New("page").Funcs(helpers.Funcs(nil, nil)).Parse(src))
+//	...
+//	tmpl, _ = tmpl.Clone()
+//	tmpl.Funcs(helpers.Funcs(w, r)).Execute(w, data)
+//
+// In the template:
+//
+//	{{if isAuthenticated}}Hello {{currentUser.UserName}}{{end}}
+//	{{if hasRole "admin"}}<a href="/admin">Admin</a>{{end}}
+//	<form method="post">{{csrfField}}...</form>
+//
+// New in version v0.7
+type TemplateHelpers struct {
+	Users   UserHandler
+	Checker *PermissionChecker
+	CSRF    *CSRFProtection
+}
+
+// Funcs returns the functions bound to the request. currentUser looks up the
+// user at most once per call of Funcs.
+func (h *TemplateHelpers) Funcs(w http.ResponseWriter, r *http.Request) template.FuncMap {
+	userID := func() (uint64, bool) {
+		if r == nil {
+			return NoUserID, false
+		}
+		user, ok := UserFromContext(r.Context())
+		if !ok || IsGuestUser(user) {
+			return NoUserID, false
+		}
+		id, err := UserKeyToID(user)
+		return id, err == nil
+	}
+	var current *BaseUserInformation
+	res := template.FuncMap{
+		"currentUser": func() (*BaseUserInformation, error) {
+			if current != nil {
+				return current, nil
+			}
+			id, ok := userID()
+			if !ok {
+				return nil, nil
+			}
+			userName, err := h.Users.GetUserName(id)
+			if err != nil {
+				return nil, err
+			}
+			current, err = h.Users.GetUserBaseInfo(userName)
+			return current, err
+		},
+		"isAuthenticated": func() bool {
+			_, ok := userID()
+			return ok
+		},
+		"hasRole": func(role string) (bool, error) {
+			id, ok := userID()
+			if !ok {
+				return false, nil
+			}
+			return h.Checker.HasRole(id, role)
+		},
+		"hasPermission": func(permission string) (bool, error) {
+			id, ok := userID()
+			if !ok {
+				return false, nil
+			}
+			return h.Checker.HasPermission(id, permission)
+		},
+	}
+	if h.CSRF != nil {
+		for name, f := range h.CSRF.TemplateFuncs(w, r) {
+			res[name] = f
+		}
+	}
+	return res
+}
@@ -0,0 +1,233 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// This file contains the support for applications that serve several
+// isolated customer realms (tenants) from one deployment.
+// The convention is simple: a middleware (TenantMiddleware) determines the
+// tenant of a request and stores it in the request context, the functions of
+// this package that get a request (SessionController.ValidateSession,
+// SessionController.CreateAuthSession, AuthHandlers.Login, ...) use
+// TenantFromContext and call the tenant-scoped variants of the handlers.
+// Requests without a tenant in the context use the default tenant "".
+//
+// Tenant support is optional for handlers, see TenantUserHandler and
+// TenantSessionHandler. The SQL handlers support tenants if they're created
+// with the tenant queries / templates (MySQLTenantUserQueries,
+// NewMySQLTenantSessionTemplate etc.). For redis use a different prefix for
+// each tenant.
+
+// ErrNoTenant is returned by tenant resolvers if the request has no tenant.
+var ErrNoTenant = errors.New("No tenant found for the request.")
+
+// NewTenantContext returns a copy of ctx that contains the tenant.
+//
+// New in version v0.7
+func NewTenantContext(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantContextKey, tenant)
+}
+
+// TenantFromContext returns the tenant stored in the context and true, or
+// "" and false if there is no tenant.
+//
+// New in version v0.7
+func TenantFromContext(ctx context.Context) (string, bool) {
+	tenant, ok := ctx.Value(tenantContextKey).(string)
+	return tenant, ok
+}
+
+// TenantResolver returns the tenant of a request.
+//
+// New in version v0.7
+type TenantResolver func(r *http.Request) (string, error)
+
+// TenantFromHeader returns a TenantResolver that reads the tenant from a
+// header, for example "X-Tenant-ID" set by your gateway.
+// Never use this if clients can set the header themselves!
+//
+// New in version v0.7
+func TenantFromHeader(name string) TenantResolver {
+	return func(r *http.Request) (string, error) {
+		if tenant := r.Header.Get(name); tenant != "" {
+			return tenant, nil
+		}
+		return "", ErrNoTenant
+	}
+}
+
+// TenantFromSubdomain returns a TenantResolver that uses the subdomain of
+// baseDomain as tenant, for example "acme" for "acme.example.com" if
+// baseDomain is "example.com".
+//
+// New in version v0.7
+func TenantFromSubdomain(baseDomain string) TenantResolver {
+	suffix := "." + strings.TrimPrefix(strings.ToLower(baseDomain), ".")
+	return func(r *http.Request) (string, error) {
+		host := strings.ToLower(r.Host)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if !strings.HasSuffix(host, suffix) {
+			return "", ErrNoTenant
+		}
+		tenant := strings.TrimSuffix(host, suffix)
+		if tenant == "" || strings.Contains(tenant, ".") {
+			return "", ErrNoTenant
+		}
+		return tenant, nil
+	}
+}
+
+// TenantMiddleware returns a handler that stores the tenant returned by
+// resolve in the request context and calls next. Requests without a tenant
+// are answered with 404 Not Found.
+//
+// New in version v0.7
+func TenantMiddleware(resolve TenantResolver, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant, err := resolve(r)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(NewTenantContext(r.Context(), tenant)))
+	})
+}
+
+// TenantUserHandler is implemented by UserHandlers that support several
+// tenants: usernames are unique per tenant and all lookups are restricted
+// to a tenant. The methods without tenant operate on the default tenant "".
+// User ids are still unique over all tenants.
+// The methods return ErrNotSupported if the handler was not configured for
+// tenants.
+//
+// New in version v0.7
+type TenantUserHandler interface {
+	InsertForTenant(tenant, userName, firstName, lastName, email string, plainPW []byte) (uint64, error)
+	ValidateForTenant(tenant, userName string, cleartextPwCheck []byte) (uint64, error)
+	GetUserIDForTenant(tenant, userName string) (uint64, error)
+	GetUserBaseInfoForTenant(tenant, userName string) (*BaseUserInformation, error)
+}
+
+// TenantSessionHandler is implemented by SessionHandlers that store the
+// tenant of a session. GetDataForTenant returns ErrKeyNotFound if the key
+// belongs to a different tenant, so a session of one tenant can't be used
+// for another one.
+// The methods return ErrNotSupported if the handler was not configured for
+// tenants.
+//
+// New in version v0.7
+type TenantSessionHandler interface {
+	CreateEntryForTenant(tenant string, user UserKeyType, key string, validDuration time.Duration) (*SessionKeyData, error)
+	GetDataForTenant(tenant, key string) (*SessionKeyData, error)
+}
+
+// ValidateForTenant calls users.ValidateForTenant if tenant is not "" and
+// users.Validate otherwise. Returns ErrNotSupported if a tenant is given
+// but users doesn't implement TenantUserHandler.
+//
+// New in version v0.7
+func ValidateForTenant(users UserHandler, tenant, userName string, password []byte) (uint64, error) {
+	if tenant == "" {
+		return users.Validate(userName, password)
+	}
+	tenantUsers, ok := users.(TenantUserHandler)
+	if !ok {
+		return NoUserID, ErrNotSupported
+	}
+	return tenantUsers.ValidateForTenant(tenant, userName, password)
+}
+
+// AddKeyForTenant is like AddKey but creates the key for the tenant.
+// If tenant is "" it simply calls AddKey.
+//
+// New in version v0.7
+func (c *SessionController) AddKeyForTenant(tenant string, user UserKeyType, validDuration time.Duration) (*SessionKeyData, string, error) {
+	if tenant == "" {
+		return c.AddKey(user, validDuration)
+	}
+	tenantHandler, ok := c.SessionHandler.(TenantSessionHandler)
+	if !ok {
+		return nil, "", ErrNotSupported
+	}
+	key, err := GenRandomBase64(c.NumBytes)
+	if err != nil {
+		return nil, "", err
+	}
+	data, err := tenantHandler.CreateEntryForTenant(tenant, user, key, validDuration)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := c.setAudiences(key, data.ValidUntil); err != nil {
+		return nil, "", err
+	}
+	return data, key, nil
+}
+
+// GetDataForTenant is like GetData but only returns keys of the tenant.
+// If tenant is "" it's the same as GetData.
+//
+// New in version v0.7
+func (c *SessionController) GetDataForTenant(tenant, key string) (*SessionKeyData, error) {
+	data, err := c.lookupKey(tenant, key)
+	if err != nil {
+		return nil, err
+	}
+	if IsGuestUser(data.User) {
+		return nil, ErrGuestSession
+	}
+	return data, nil
+}
+
+// lookupKey returns the data of the key (restricted to the tenant if it's
+// not ""), guest sessions are returned like all other sessions.
+func (c *SessionController) lookupKey(tenant, key string) (*SessionKeyData, error) {
+	var data *SessionKeyData
+	var err error
+	if tenant == "" {
+		data, err = c.SessionHandler.GetData(key)
+	} else {
+		tenantHandler, ok := c.SessionHandler.(TenantSessionHandler)
+		if !ok {
+			return nil, ErrNotSupported
+		}
+		data, err = tenantHandler.GetDataForTenant(tenant, key)
+	}
+	if err == ErrKeyNotFound {
+		return nil, c.revokedError(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	data.Guest = IsGuestUser(data.User)
+	return data, nil
+}
@@ -0,0 +1,80 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package goauth
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// OperationTimeoutHandler is implemented by handlers that run each backend
+// operation with a timeout. The methods of SessionHandler and UserHandler
+// don't take a context, so the handler creates a context with this timeout for
+// each query; a slow backend then returns an error (wrapping
+// context.DeadlineExceeded, reported as ErrBackendUnavailable) instead of
+// stalling the request.
+//
+// The SQL handlers implement this interface. For redis configure ReadTimeout
+// and WriteTimeout in the redis.Options of the client.
+//
+// New in version v0.7
+type OperationTimeoutHandler interface {
+	// OperationTimeout returns the timeout, 0 means no timeout.
+	OperationTimeout() time.Duration
+	// SetOperationTimeout sets the timeout, 0 disables it.
+	SetOperationTimeout(timeout time.Duration)
+}
+
+// SetOperationTimeout sets the timeout for each operation of the session
+// handler. It is used for the SessionHandler of the controller if it
+// implements OperationTimeoutHandler and doesn't have a timeout set already,
+// so set timeouts on the handler directly to override this default.
+//
+// New in version v0.7
+func (c *SessionController) SetOperationTimeout(timeout time.Duration) {
+	c.OperationTimeout = timeout
+	if h, ok := c.SessionHandler.(OperationTimeoutHandler); ok && h.OperationTimeout() == 0 {
+		h.SetOperationTimeout(timeout)
+	}
+}
+
+// operationContext returns a context with the timeout, if timeout <= 0 the
+// parent is returned.
+func operationContext(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return parent, func() {}
+	}
+	return context.WithTimeout(parent, timeout)
+}
+
+// timeoutRows are rows that cancel the context of the query on Close.
+type timeoutRows struct {
+	*sql.Rows
+	cancel context.CancelFunc
+}
+
+func (rows timeoutRows) Close() error {
+	err := rows.Rows.Close()
+	rows.cancel()
+	return err
+}
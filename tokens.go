@@ -0,0 +1,528 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// ErrTokenNotFound is returned if a one-time token doesn't exist, was
+// already used, is expired or was issued for a different purpose.
+var ErrTokenNotFound = errors.New("Token not found or expired.")
+
+// OneTimeToken is the information stored for a token that can be used only
+// once, for example for password resets or email verification.
+// The token itself is never stored, only its SHA-256 hash.
+//
+// New in version v0.7
+type OneTimeToken struct {
+	// Purpose is the flow the token was created for, for example
+	// "password_reset". A token can only be used for its purpose.
+	Purpose string
+
+	// Subject is the entity the token belongs to, usually the user id.
+	Subject string
+
+	// Data is additional data, for example a new email address.
+	Data string
+
+	ValidUntil time.Time
+}
+
+// OneTimeTokenStore stores one-time tokens by their hash.
+// Use IssueOneTimeToken, VerifyOneTimeToken and ConsumeOneTimeToken instead
+// of calling the methods directly.
+//
+// New in version v0.7
+type OneTimeTokenStore interface {
+	// Init initializes the storage, see UserHandler.
+	Init() error
+
+	// StoreToken stores a token.
+	StoreToken(hash string, token *OneTimeToken) error
+
+	// GetToken returns the token or ErrTokenNotFound.
+	GetToken(hash string) (*OneTimeToken, error)
+
+	// ConsumeToken returns the token and deletes it, it must be safe to call
+	// it concurrently: only one caller may get the token.
+	// Returns ErrTokenNotFound if the token doesn't exist.
+	ConsumeToken(hash string) (*OneTimeToken, error)
+
+	// DeleteTokens deletes all tokens with the given purpose and subject.
+	DeleteTokens(purpose, subject string) (int64, error)
+
+	// DeleteExpiredTokens deletes all expired tokens.
+	DeleteExpiredTokens() (int64, error)
+}
+
+// HashToken returns the hex encoded SHA-256 hash of a token.
+//
+// New in version v0.7
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// IssueOneTimeToken creates a new random token, stores it and returns it.
+//
+// New in version v0.7
+func IssueOneTimeToken(store OneTimeTokenStore, purpose, subject, data string, ttl time.Duration) (string, error) {
+	token, err := GenRandomBase64(32)
+	if err != nil {
+		return "", err
+	}
+	entry := &OneTimeToken{Purpose: purpose, Subject: subject, Data: data,
+		ValidUntil: CurrentTime().Add(ttl)}
+	if err := store.StoreToken(HashToken(token), entry); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func checkOneTimeToken(entry *OneTimeToken, purpose string) (*OneTimeToken, error) {
+	if entry.Purpose != purpose || KeyInvalid(CurrentTime(), entry.ValidUntil) {
+		return nil, ErrTokenNotFound
+	}
+	return entry, nil
+}
+
+// VerifyOneTimeToken returns the stored information for the token without
+// using it. Returns ErrTokenNotFound if the token is invalid.
+//
+// New in version v0.7
+func VerifyOneTimeToken(store OneTimeTokenStore, purpose, token string) (*OneTimeToken, error) {
+	entry, err := store.GetToken(HashToken(token))
+	if err != nil {
+		return nil, err
+	}
+	return checkOneTimeToken(entry, purpose)
+}
+
+// ConsumeOneTimeToken is like VerifyOneTimeToken but deletes the token, so
+// it can't be used again.
+//
+// New in version v0.7
+func ConsumeOneTimeToken(store OneTimeTokenStore, purpose, token string) (*OneTimeToken, error) {
+	entry, err := store.ConsumeToken(HashToken(token))
+	if err != nil {
+		return nil, err
+	}
+	return checkOneTimeToken(entry, purpose)
+}
+
+// InMemoryOneTimeTokenStore is a OneTimeTokenStore that keeps the tokens in
+// memory.
+//
+// New in version v0.7
+type InMemoryOneTimeTokenStore struct {
+	mutex  sync.Mutex
+	tokens map[string]*OneTimeToken
+}
+
+// NewInMemoryOneTimeTokenStore returns a new InMemoryOneTimeTokenStore.
+func NewInMemoryOneTimeTokenStore() *InMemoryOneTimeTokenStore {
+	return &InMemoryOneTimeTokenStore{tokens: make(map[string]*OneTimeToken)}
+}
+
+func (s *InMemoryOneTimeTokenStore) Init() error {
+	return nil
+}
+
+func (s *InMemoryOneTimeTokenStore) StoreToken(hash string, token *OneTimeToken) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	copied := *token
+	s.tokens[hash] = &copied
+	return nil
+}
+
+func (s *InMemoryOneTimeTokenStore) GetToken(hash string) (*OneTimeToken, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	token, has := s.tokens[hash]
+	if !has {
+		return nil, ErrTokenNotFound
+	}
+	copied := *token
+	return &copied, nil
+}
+
+func (s *InMemoryOneTimeTokenStore) ConsumeToken(hash string) (*OneTimeToken, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	token, has := s.tokens[hash]
+	if !has {
+		return nil, ErrTokenNotFound
+	}
+	delete(s.tokens, hash)
+	return token, nil
+}
+
+func (s *InMemoryOneTimeTokenStore) DeleteTokens(purpose, subject string) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var removed int64
+	for hash, token := range s.tokens {
+		if token.Purpose == purpose && token.Subject == subject {
+			delete(s.tokens, hash)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+func (s *InMemoryOneTimeTokenStore) DeleteExpiredTokens() (int64, error) {
+	now := CurrentTime()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var removed int64
+	for hash, token := range s.tokens {
+		if KeyInvalid(now, token.ValidUntil) {
+			delete(s.tokens, hash)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// SQLOneTimeTokenQueries stores the queries for SQLOneTimeTokenStore.
+// The table one_time_tokens has the columns token_hash, purpose, subject,
+// data and valid_until.
+//
+// New in version v0.7
+type SQLOneTimeTokenQueries struct {
+	InitQuery, StoreQuery, GetQuery, DeleteQuery, DeleteForSubjectQuery,
+	DeleteExpiredQuery string
+
+	// TimeFromScanType is used to transform database time entries to
+	// gos time. See SQLSessionHandler for details.
+	TimeFromScanType func(val interface{}) (time.Time, error)
+}
+
+// MySQLOneTimeTokenQueries provides queries to use with MySQL.
+func MySQLOneTimeTokenQueries() *SQLOneTimeTokenQueries {
+	initQ := `
+	CREATE TABLE IF NOT EXISTS one_time_tokens (
+		token_hash CHAR(64) NOT NULL,
+		purpose VARCHAR(50) NOT NULL,
+		subject VARCHAR(255) NOT NULL,
+		data TEXT NOT NULL,
+		valid_until DATETIME NOT NULL,
+		PRIMARY KEY(token_hash)
+	);
+	`
+	return &SQLOneTimeTokenQueries{InitQuery: initQ,
+		StoreQuery:            "INSERT INTO one_time_tokens (token_hash, purpose, subject, data, valid_until) VALUES(?, ?, ?, ?, ?)",
+		GetQuery:              "SELECT purpose, subject, data, valid_until FROM one_time_tokens WHERE token_hash=?",
+		DeleteQuery:           "DELETE FROM one_time_tokens WHERE token_hash=?",
+		DeleteForSubjectQuery: "DELETE FROM one_time_tokens WHERE purpose=? AND subject=?",
+		DeleteExpiredQuery:    "DELETE FROM one_time_tokens WHERE valid_until < ?",
+		TimeFromScanType:      DefaultTimeFromScanType}
+}
+
+// PostgresOneTimeTokenQueries provides queries to use with postgres.
+func PostgresOneTimeTokenQueries() *SQLOneTimeTokenQueries {
+	initQ := `
+	CREATE TABLE IF NOT EXISTS one_time_tokens (
+		token_hash char(64) PRIMARY KEY,
+		purpose varchar(50) NOT NULL,
+		subject varchar(255) NOT NULL,
+		data text NOT NULL,
+		valid_until timestamp NOT NULL
+	);
+	`
+	return &SQLOneTimeTokenQueries{InitQuery: initQ,
+		StoreQuery:            "INSERT INTO one_time_tokens (token_hash, purpose, subject, data, valid_until) VALUES ($1, $2, $3, $4, $5)",
+		GetQuery:              "SELECT purpose, subject, data, valid_until FROM one_time_tokens WHERE token_hash = $1",
+		DeleteQuery:           "DELETE FROM one_time_tokens WHERE token_hash = $1",
+		DeleteForSubjectQuery: "DELETE FROM one_time_tokens WHERE purpose = $1 AND subject = $2",
+		DeleteExpiredQuery:    "DELETE FROM one_time_tokens WHERE valid_until < $1",
+		TimeFromScanType:      DefaultTimeFromScanType}
+}
+
+// SQLite3OneTimeTokenQueries provides queries to use with sqlite3.
+func SQLite3OneTimeTokenQueries() *SQLOneTimeTokenQueries {
+	return MySQLOneTimeTokenQueries()
+}
+
+// SQLOneTimeTokenStore implements OneTimeTokenStore by executing the
+// queries defined in an instance of SQLOneTimeTokenQueries.
+//
+// New in version v0.7
+type SQLOneTimeTokenStore struct {
+	*SQLOneTimeTokenQueries
+
+	// DB is the database to execute the queries on.
+	DB *sql.DB
+
+	blockDB bool
+	mutex   sync.RWMutex
+}
+
+// NewSQLOneTimeTokenStore returns a new SQLOneTimeTokenStore, blockDB has
+// the same meaning as in NewSQLUserHandler.
+func NewSQLOneTimeTokenStore(queries *SQLOneTimeTokenQueries, db *sql.DB, blockDB bool) *SQLOneTimeTokenStore {
+	return &SQLOneTimeTokenStore{SQLOneTimeTokenQueries: queries, DB: db, blockDB: blockDB}
+}
+
+// NewMySQLOneTimeTokenStore returns a new SQLOneTimeTokenStore that uses
+// MySQL.
+func NewMySQLOneTimeTokenStore(db *sql.DB) *SQLOneTimeTokenStore {
+	return NewSQLOneTimeTokenStore(MySQLOneTimeTokenQueries(), db, false)
+}
+
+// NewPostgresOneTimeTokenStore returns a new SQLOneTimeTokenStore that uses
+// postgres.
+func NewPostgresOneTimeTokenStore(db *sql.DB) *SQLOneTimeTokenStore {
+	return NewSQLOneTimeTokenStore(PostgresOneTimeTokenQueries(), db, false)
+}
+
+// NewSQLite3OneTimeTokenStore returns a new SQLOneTimeTokenStore that uses
+// sqlite3.
+func NewSQLite3OneTimeTokenStore(db *sql.DB) *SQLOneTimeTokenStore {
+	return NewSQLOneTimeTokenStore(SQLite3OneTimeTokenQueries(), db, true)
+}
+
+func (s *SQLOneTimeTokenStore) Init() error {
+	if s.blockDB {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+	}
+	_, err := s.DB.Exec(s.InitQuery)
+	return err
+}
+
+func (s *SQLOneTimeTokenStore) StoreToken(hash string, token *OneTimeToken) error {
+	if s.blockDB {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+	}
+	_, err := s.DB.Exec(s.StoreQuery, hash, token.Purpose, token.Subject, token.Data, token.ValidUntil)
+	return wrapBackendError("sql", "StoreToken", err)
+}
+
+func (s *SQLOneTimeTokenStore) get(hash string) (*OneTimeToken, error) {
+	res := &OneTimeToken{}
+	var validUntilVal interface{}
+	err := s.DB.QueryRow(s.GetQuery, hash).Scan(&res.Purpose, &res.Subject, &res.Data, &validUntilVal)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrTokenNotFound
+		}
+		return nil, wrapBackendError("sql", "GetToken", err)
+	}
+	if res.ValidUntil, err = s.TimeFromScanType(validUntilVal); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (s *SQLOneTimeTokenStore) GetToken(hash string) (*OneTimeToken, error) {
+	if s.blockDB {
+		s.mutex.RLock()
+		defer s.mutex.RUnlock()
+	}
+	return s.get(hash)
+}
+
+// ConsumeToken reads the token and deletes it, only the caller whose delete
+// actually removed the row gets the token.
+func (s *SQLOneTimeTokenStore) ConsumeToken(hash string) (*OneTimeToken, error) {
+	if s.blockDB {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+	}
+	token, err := s.get(hash)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.DB.Exec(s.DeleteQuery, hash)
+	if err != nil {
+		return nil, wrapBackendError("sql", "ConsumeToken", err)
+	}
+	if num, err := res.RowsAffected(); err == nil && num == 0 {
+		// someone else was faster
+		return nil, ErrTokenNotFound
+	}
+	return token, nil
+}
+
+func (s *SQLOneTimeTokenStore) DeleteTokens(purpose, subject string) (int64, error) {
+	if s.blockDB {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+	}
+	res, err := s.DB.Exec(s.DeleteForSubjectQuery, purpose, subject)
+	if err != nil {
+		return -1, wrapBackendError("sql", "DeleteTokens", err)
+	}
+	num, err := res.RowsAffected()
+	if err != nil {
+		return -1, nil
+	}
+	return num, nil
+}
+
+func (s *SQLOneTimeTokenStore) DeleteExpiredTokens() (int64, error) {
+	now := CurrentTime()
+	if s.blockDB {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+	}
+	res, err := s.DB.Exec(s.DeleteExpiredQuery, now)
+	if err != nil {
+		return -1, wrapBackendError("sql", "DeleteExpiredTokens", err)
+	}
+	num, err := res.RowsAffected()
+	if err != nil {
+		return -1, nil
+	}
+	return num, nil
+}
+
+// RedisOneTimeTokenStore is a OneTimeTokenStore using redis.
+// Each token is stored in a hash "ott:<hash>" that expires with the token,
+// the hashes of the tokens of a subject are stored in a set
+// "ott:<purpose>:<subject>" for DeleteTokens.
+//
+// New in version v0.7
+type RedisOneTimeTokenStore struct {
+	// Client is the client to connect to redis.
+	Client *redis.Client
+
+	// Prefix is the prefix of all keys, defaults to "ott:".
+	Prefix string
+}
+
+// NewRedisOneTimeTokenStore returns a new RedisOneTimeTokenStore.
+func NewRedisOneTimeTokenStore(client *redis.Client) *RedisOneTimeTokenStore {
+	return &RedisOneTimeTokenStore{Client: client, Prefix: "ott:"}
+}
+
+// Init is a NOOP for redis.
+func (s *RedisOneTimeTokenStore) Init() error {
+	return nil
+}
+
+func (s *RedisOneTimeTokenStore) subjectKey(purpose, subject string) string {
+	return s.Prefix + purpose + ":" + subject
+}
+
+func (s *RedisOneTimeTokenStore) StoreToken(hash string, token *OneTimeToken) error {
+	key := s.Prefix + hash
+	subjectKey := s.subjectKey(token.Purpose, token.Subject)
+	pipe := s.Client.TxPipeline()
+	pipe.HMSet(key, map[string]interface{}{
+		"purpose":     token.Purpose,
+		"subject":     token.Subject,
+		"data":        token.Data,
+		"valid_until": token.ValidUntil.Format(RedisDateFormat),
+	})
+	pipe.ExpireAt(key, token.ValidUntil)
+	pipe.SAdd(subjectKey, hash)
+	pipe.ExpireAt(subjectKey, token.ValidUntil)
+	_, err := pipe.Exec()
+	return wrapBackendError("redis", "StoreToken", err)
+}
+
+func (s *RedisOneTimeTokenStore) parse(entry map[string]string) (*OneTimeToken, error) {
+	if len(entry) == 0 {
+		return nil, ErrTokenNotFound
+	}
+	validUntil, err := time.Parse(RedisDateFormat, entry["valid_until"])
+	if err != nil {
+		return nil, err
+	}
+	return &OneTimeToken{Purpose: entry["purpose"], Subject: entry["subject"],
+		Data: entry["data"], ValidUntil: validUntil}, nil
+}
+
+func (s *RedisOneTimeTokenStore) GetToken(hash string) (*OneTimeToken, error) {
+	entry, err := s.Client.HGetAll(s.Prefix + hash).Result()
+	if err != nil {
+		return nil, wrapBackendError("redis", "GetToken", err)
+	}
+	return s.parse(entry)
+}
+
+func (s *RedisOneTimeTokenStore) ConsumeToken(hash string) (*OneTimeToken, error) {
+	key := s.Prefix + hash
+	pipe := s.Client.TxPipeline()
+	get := pipe.HGetAll(key)
+	pipe.Del(key)
+	if _, err := pipe.Exec(); err != nil {
+		return nil, wrapBackendError("redis", "ConsumeToken", err)
+	}
+	token, err := s.parse(get.Val())
+	if err != nil {
+		return nil, err
+	}
+	s.Client.SRem(s.subjectKey(token.Purpose, token.Subject), hash)
+	return token, nil
+}
+
+func (s *RedisOneTimeTokenStore) DeleteTokens(purpose, subject string) (int64, error) {
+	subjectKey := s.subjectKey(purpose, subject)
+	hashes, err := s.Client.SMembers(subjectKey).Result()
+	if err != nil {
+		return -1, wrapBackendError("redis", "DeleteTokens", err)
+	}
+	keys := make([]string, 0, len(hashes)+1)
+	for _, hash := range hashes {
+		keys = append(keys, s.Prefix+hash)
+	}
+	var removed int64
+	if len(keys) > 0 {
+		if removed, err = s.Client.Del(keys...).Result(); err != nil {
+			return -1, wrapBackendError("redis", "DeleteTokens", err)
+		}
+	}
+	if err := s.Client.Del(subjectKey).Err(); err != nil {
+		return -1, wrapBackendError("redis", "DeleteTokens", err)
+	}
+	return removed, nil
+}
+
+// DeleteExpiredTokens does nothing, the tokens expire automatically.
+func (s *RedisOneTimeTokenStore) DeleteExpiredTokens() (int64, error) {
+	return 0, nil
+}
+
+// userSubject is the subject used for tokens that belong to a user.
+func userSubject(id uint64) string {
+	return strconv.FormatUint(id, 10)
+}
+
+// subjectUserID parses a subject created by userSubject.
+func subjectUserID(subject string) (uint64, error) {
+	return strconv.ParseUint(subject, 10, 64)
+}
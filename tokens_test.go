@@ -0,0 +1,65 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOneTimeTokenSingleUse(t *testing.T) {
+	store := NewInMemoryOneTimeTokenStore()
+	token, err := IssueOneTimeToken(store, "reset", "user", "data", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyOneTimeToken(store, "verify", token); err != ErrTokenNotFound {
+		t.Errorf("Expected ErrTokenNotFound for another purpose, got %v", err)
+	}
+	// verifying doesn't use the token
+	for i := 0; i < 2; i++ {
+		if _, err := VerifyOneTimeToken(store, "reset", token); err != nil {
+			t.Fatalf("Verify %d: %v", i, err)
+		}
+	}
+	entry, err := ConsumeOneTimeToken(store, "reset", token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Subject != "user" || entry.Data != "data" {
+		t.Errorf("Expected subject user and data data, got %s and %s", entry.Subject, entry.Data)
+	}
+	if _, err := ConsumeOneTimeToken(store, "reset", token); err != ErrTokenNotFound {
+		t.Errorf("Expected ErrTokenNotFound for a used token, got %v", err)
+	}
+	if _, err := VerifyOneTimeToken(store, "reset", token); err != ErrTokenNotFound {
+		t.Errorf("Expected ErrTokenNotFound from Verify for a used token, got %v", err)
+	}
+	expired, err := IssueOneTimeToken(store, "reset", "user", "", -time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ConsumeOneTimeToken(store, "reset", expired); err != ErrTokenNotFound {
+		t.Errorf("Expected ErrTokenNotFound for an expired token, got %v", err)
+	}
+}
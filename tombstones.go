@@ -0,0 +1,507 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+package goauth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	log "github.com/sirupsen/logrus"
+)
+
+// RevocationReason describes why a session was deleted.
+//
+// New in version v0.7
+type RevocationReason string
+
+const (
+	// ReasonLogout means that the user logged out.
+	ReasonLogout RevocationReason = "logout"
+	// ReasonAdminRevoked means that an administrator revoked the session.
+	ReasonAdminRevoked RevocationReason = "admin_revoked"
+	// ReasonPasswordChanged means that the session was revoked because the
+	// password of the user changed.
+	ReasonPasswordChanged RevocationReason = "password_changed"
+	// ReasonExpired means that the session expired.
+	ReasonExpired RevocationReason = "expired"
+	// ReasonAccountDeleted means that the account of the user was deleted.
+	ReasonAccountDeleted RevocationReason = "account_deleted"
+)
+
+// DefaultTombstoneTTL is the time a tombstone is kept if
+// SessionController.TombstoneTTL is not set.
+//
+// New in version v0.7
+const DefaultTombstoneTTL = 24 * time.Hour
+
+// ErrSessionRevoked is returned (wrapped in a *SessionRevokedError) by
+// SessionController.GetData if the session was revoked and a tombstone was
+// recorded for it.
+//
+// New in version v0.7
+var ErrSessionRevoked = errors.New("The session has been revoked.")
+
+// ErrTombstoneNotFound is returned by a TombstoneStore if there is no
+// tombstone for a session.
+//
+// New in version v0.7
+var ErrTombstoneNotFound = errors.New("No tombstone found for the session.")
+
+// SessionRevokedError is returned by SessionController.GetData for a session
+// that has a tombstone. errors.Is reports true for both ErrSessionRevoked and
+// ErrKeyNotFound, so code that only checks for ErrKeyNotFound with errors.Is
+// keeps working.
+//
+// New in version v0.7
+type SessionRevokedError struct {
+	Reason  RevocationReason
+	Revoked time.Time
+}
+
+func (err *SessionRevokedError) Error() string {
+	return fmt.Sprintf("The session has been revoked (%s).", err.Reason)
+}
+
+func (err *SessionRevokedError) Is(target error) bool {
+	return target == ErrSessionRevoked || target == ErrKeyNotFound
+}
+
+// RevocationReasonOf returns the reason of a *SessionRevokedError in the
+// chain of err and false if there is none.
+//
+// New in version v0.7
+func RevocationReasonOf(err error) (RevocationReason, bool) {
+	var revoked *SessionRevokedError
+	if errors.As(err, &revoked) {
+		return revoked.Reason, true
+	}
+	return "", false
+}
+
+// isKeyNotFound returns true if err is ErrKeyNotFound or a
+// *SessionRevokedError.
+func isKeyNotFound(err error) bool {
+	return errors.Is(err, ErrKeyNotFound)
+}
+
+// Tombstone is a short-lived record about a deleted session.
+//
+// New in version v0.7
+type Tombstone struct {
+	Reason     RevocationReason
+	Revoked    time.Time
+	ValidUntil time.Time
+}
+
+// TombstoneStore stores tombstones of revoked sessions. The tombstones are
+// identified by the SessionID of the key, the key itself is never stored.
+//
+// New in version v0.7
+type TombstoneStore interface {
+	// Init initializes the storage, see UserHandler.
+	Init() error
+
+	// AddTombstone stores a tombstone, an existing tombstone for the same
+	// session is replaced.
+	AddTombstone(sessionID string, tombstone *Tombstone) error
+
+	// GetTombstone returns the tombstone or ErrTombstoneNotFound. Expired
+	// tombstones are not returned.
+	GetTombstone(sessionID string) (*Tombstone, error)
+
+	// DeleteExpiredTombstones deletes all expired tombstones.
+	DeleteExpiredTombstones() (int64, error)
+}
+
+// tombstoneTTL returns TombstoneTTL or DefaultTombstoneTTL if it's not set.
+func (c *SessionController) tombstoneTTL() time.Duration {
+	if c.TombstoneTTL <= 0 {
+		return DefaultTombstoneTTL
+	}
+	return c.TombstoneTTL
+}
+
+// addTombstone records a tombstone for key if Tombstones is set.
+func (c *SessionController) addTombstone(key string, reason RevocationReason) error {
+	if c.Tombstones == nil {
+		return nil
+	}
+	now := CurrentTime()
+	return c.Tombstones.AddTombstone(SessionID(key), &Tombstone{Reason: reason,
+		Revoked: now, ValidUntil: now.Add(c.tombstoneTTL())})
+}
+
+// revokedError returns a *SessionRevokedError if there is a tombstone for
+// the key and ErrKeyNotFound otherwise.
+func (c *SessionController) revokedError(key string) error {
+	if c.Tombstones == nil {
+		return ErrKeyNotFound
+	}
+	tombstone, err := c.Tombstones.GetTombstone(SessionID(key))
+	if err != nil {
+		if err != ErrTombstoneNotFound {
+			log.WithError(err).Warn("goauth: Can't look up session tombstone.")
+		}
+		return ErrKeyNotFound
+	}
+	return &SessionRevokedError{Reason: tombstone.Reason, Revoked: tombstone.Revoked}
+}
+
+// RevokeKey deletes the key and, if Tombstones is set, records a tombstone
+// with the given reason. GetData then returns a *SessionRevokedError for
+// the key instead of ErrKeyNotFound until the tombstone expires.
+//
+// New in version v0.7
+func (c *SessionController) RevokeKey(key string, reason RevocationReason) error {
+	if err := c.addTombstone(key, reason); err != nil {
+		return err
+	}
+	var user UserKeyType
+	if c.LogoutNotifier != nil {
+		if data, err := c.GetData(key); err == nil {
+			user = data.User
+		}
+	}
+	if err := c.DeleteKey(key); err != nil {
+		return err
+	}
+	c.notifyLogout(SessionID(key), user, reason)
+	return nil
+}
+
+// RevokeEntriesForUser is like DeleteEntriesForUser but records a tombstone
+// for each session of the user. Tombstones are only recorded if Tombstones
+// is set and the SessionHandler implements SessionLister.
+//
+// New in version v0.7
+func (c *SessionController) RevokeEntriesForUser(user UserKeyType, reason RevocationReason) (int64, error) {
+	if IsGuestUser(user) {
+		return 0, nil
+	}
+	if c.Tombstones != nil {
+		sessions, err := c.ListSessions(user)
+		switch {
+		case err == ErrNotSupported:
+		case err != nil:
+			return -1, err
+		default:
+			for key := range sessions {
+				if err := c.addTombstone(key, reason); err != nil {
+					return -1, err
+				}
+			}
+		}
+	}
+	num, err := c.DeleteEntriesForUser(user)
+	if err != nil {
+		return num, err
+	}
+	c.notifyLogout("", user, reason)
+	return num, nil
+}
+
+// InMemoryTombstoneStore is a TombstoneStore that keeps all tombstones in
+// memory.
+//
+// New in version v0.7
+type InMemoryTombstoneStore struct {
+	tombstones map[string]*Tombstone
+	mutex      sync.RWMutex
+}
+
+// NewInMemoryTombstoneStore returns a new InMemoryTombstoneStore.
+//
+// New in version v0.7
+func NewInMemoryTombstoneStore() *InMemoryTombstoneStore {
+	return &InMemoryTombstoneStore{tombstones: make(map[string]*Tombstone)}
+}
+
+func (s *InMemoryTombstoneStore) Init() error {
+	return nil
+}
+
+func (s *InMemoryTombstoneStore) AddTombstone(sessionID string, tombstone *Tombstone) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	copied := *tombstone
+	s.tombstones[sessionID] = &copied
+	return nil
+}
+
+func (s *InMemoryTombstoneStore) GetTombstone(sessionID string) (*Tombstone, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	tombstone, has := s.tombstones[sessionID]
+	if !has || KeyInvalid(CurrentTime(), tombstone.ValidUntil) {
+		return nil, ErrTombstoneNotFound
+	}
+	copied := *tombstone
+	return &copied, nil
+}
+
+func (s *InMemoryTombstoneStore) DeleteExpiredTombstones() (int64, error) {
+	now := CurrentTime()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var removed int64
+	for sessionID, tombstone := range s.tombstones {
+		if KeyInvalid(now, tombstone.ValidUntil) {
+			delete(s.tombstones, sessionID)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// SQLTombstoneQueries stores the queries for SQLTombstoneStore.
+// The table session_tombstones has the columns session_id, reason, revoked
+// and valid_until.
+//
+// New in version v0.7
+type SQLTombstoneQueries struct {
+	InitQuery, AddQuery, GetQuery, DeleteExpiredQuery string
+
+	// TimeFromScanType is used to transform database time entries to
+	// gos time. See SQLSessionHandler for details.
+	TimeFromScanType func(val interface{}) (time.Time, error)
+}
+
+// MySQLTombstoneQueries provides queries to use with MySQL.
+//
+// New in version v0.7
+func MySQLTombstoneQueries() *SQLTombstoneQueries {
+	initQ := `
+	CREATE TABLE IF NOT EXISTS session_tombstones (
+		session_id CHAR(32) NOT NULL,
+		reason VARCHAR(50) NOT NULL,
+		revoked DATETIME NOT NULL,
+		valid_until DATETIME NOT NULL,
+		PRIMARY KEY(session_id)
+	);
+	`
+	return &SQLTombstoneQueries{InitQuery: initQ,
+		AddQuery:           "INSERT INTO session_tombstones (session_id, reason, revoked, valid_until) VALUES(?, ?, ?, ?) ON DUPLICATE KEY UPDATE reason=VALUES(reason), revoked=VALUES(revoked), valid_until=VALUES(valid_until)",
+		GetQuery:           "SELECT reason, revoked, valid_until FROM session_tombstones WHERE session_id=?",
+		DeleteExpiredQuery: "DELETE FROM session_tombstones WHERE valid_until < ?",
+		TimeFromScanType:   DefaultTimeFromScanType}
+}
+
+// PostgresTombstoneQueries provides queries to use with postgres.
+//
+// New in version v0.7
+func PostgresTombstoneQueries() *SQLTombstoneQueries {
+	initQ := `
+	CREATE TABLE IF NOT EXISTS session_tombstones (
+		session_id char(32) PRIMARY KEY,
+		reason varchar(50) NOT NULL,
+		revoked timestamp NOT NULL,
+		valid_until timestamp NOT NULL
+	);
+	`
+	return &SQLTombstoneQueries{InitQuery: initQ,
+		AddQuery:           "INSERT INTO session_tombstones (session_id, reason, revoked, valid_until) VALUES ($1, $2, $3, $4) ON CONFLICT (session_id) DO UPDATE SET reason = EXCLUDED.reason, revoked = EXCLUDED.revoked, valid_until = EXCLUDED.valid_until",
+		GetQuery:           "SELECT reason, revoked, valid_until FROM session_tombstones WHERE session_id = $1",
+		DeleteExpiredQuery: "DELETE FROM session_tombstones WHERE valid_until < $1",
+		TimeFromScanType:   DefaultTimeFromScanType}
+}
+
+// SQLite3TombstoneQueries provides queries to use with sqlite3.
+//
+// New in version v0.7
+func SQLite3TombstoneQueries() *SQLTombstoneQueries {
+	// the MySQL queries work fine, except for the upsert
+	res := MySQLTombstoneQueries()
+	res.AddQuery = "INSERT OR REPLACE INTO session_tombstones (session_id, reason, revoked, valid_until) VALUES(?, ?, ?, ?)"
+	return res
+}
+
+// SQLTombstoneStore implements TombstoneStore by executing the queries
+// defined in an instance of SQLTombstoneQueries.
+//
+// New in version v0.7
+type SQLTombstoneStore struct {
+	*SQLTombstoneQueries
+
+	// DB is the database to execute the queries on.
+	DB *sql.DB
+
+	blockDB bool
+	mutex   sync.RWMutex
+}
+
+// NewSQLTombstoneStore returns a new SQLTombstoneStore, blockDB has the same
+// meaning as in NewSQLUserHandler.
+//
+// New in version v0.7
+func NewSQLTombstoneStore(queries *SQLTombstoneQueries, db *sql.DB, blockDB bool) *SQLTombstoneStore {
+	return &SQLTombstoneStore{SQLTombstoneQueries: queries, DB: db, blockDB: blockDB}
+}
+
+// NewMySQLTombstoneStore returns a new SQLTombstoneStore that uses MySQL.
+//
+// New in version v0.7
+func NewMySQLTombstoneStore(db *sql.DB) *SQLTombstoneStore {
+	return NewSQLTombstoneStore(MySQLTombstoneQueries(), db, false)
+}
+
+// NewPostgresTombstoneStore returns a new SQLTombstoneStore that uses
+// postgres.
+//
+// New in version v0.7
+func NewPostgresTombstoneStore(db *sql.DB) *SQLTombstoneStore {
+	return NewSQLTombstoneStore(PostgresTombstoneQueries(), db, false)
+}
+
+// NewSQLite3TombstoneStore returns a new SQLTombstoneStore that uses
+// sqlite3.
+//
+// New in version v0.7
+func NewSQLite3TombstoneStore(db *sql.DB) *SQLTombstoneStore {
+	return NewSQLTombstoneStore(SQLite3TombstoneQueries(), db, true)
+}
+
+func (s *SQLTombstoneStore) Init() error {
+	if s.blockDB {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+	}
+	_, err := s.DB.Exec(s.InitQuery)
+	return err
+}
+
+func (s *SQLTombstoneStore) AddTombstone(sessionID string, tombstone *Tombstone) error {
+	if s.blockDB {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+	}
+	_, err := s.DB.Exec(s.AddQuery, sessionID, string(tombstone.Reason), tombstone.Revoked, tombstone.ValidUntil)
+	return wrapBackendError("sql", "AddTombstone", err)
+}
+
+func (s *SQLTombstoneStore) GetTombstone(sessionID string) (*Tombstone, error) {
+	if s.blockDB {
+		s.mutex.RLock()
+		defer s.mutex.RUnlock()
+	}
+	var reason string
+	var revokedVal, validUntilVal interface{}
+	err := s.DB.QueryRow(s.GetQuery, sessionID).Scan(&reason, &revokedVal, &validUntilVal)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrTombstoneNotFound
+		}
+		return nil, wrapBackendError("sql", "GetTombstone", err)
+	}
+	res := &Tombstone{Reason: RevocationReason(reason)}
+	if res.Revoked, err = s.TimeFromScanType(revokedVal); err != nil {
+		return nil, err
+	}
+	if res.ValidUntil, err = s.TimeFromScanType(validUntilVal); err != nil {
+		return nil, err
+	}
+	if KeyInvalid(CurrentTime(), res.ValidUntil) {
+		return nil, ErrTombstoneNotFound
+	}
+	return res, nil
+}
+
+func (s *SQLTombstoneStore) DeleteExpiredTombstones() (int64, error) {
+	now := CurrentTime()
+	if s.blockDB {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+	}
+	res, err := s.DB.Exec(s.DeleteExpiredQuery, now)
+	if err != nil {
+		return -1, wrapBackendError("sql", "DeleteExpiredTombstones", err)
+	}
+	num, err := res.RowsAffected()
+	if err != nil {
+		return -1, nil
+	}
+	return num, nil
+}
+
+// RedisTombstoneStore is a TombstoneStore using redis.
+// Each tombstone is stored in a hash "tomb:<session id>" that expires with
+// the tombstone.
+//
+// New in version v0.7
+type RedisTombstoneStore struct {
+	// Client is the client to connect to redis.
+	Client *redis.Client
+
+	// Prefix is the prefix of all keys, defaults to "tomb:".
+	Prefix string
+}
+
+// NewRedisTombstoneStore returns a new RedisTombstoneStore.
+//
+// New in version v0.7
+func NewRedisTombstoneStore(client *redis.Client) *RedisTombstoneStore {
+	return &RedisTombstoneStore{Client: client, Prefix: "tomb:"}
+}
+
+// Init is a NOOP for redis.
+func (s *RedisTombstoneStore) Init() error {
+	return nil
+}
+
+func (s *RedisTombstoneStore) AddTombstone(sessionID string, tombstone *Tombstone) error {
+	key := s.Prefix + sessionID
+	pipe := s.Client.TxPipeline()
+	pipe.HMSet(key, map[string]interface{}{
+		"reason":      string(tombstone.Reason),
+		"revoked":     tombstone.Revoked.Format(RedisDateFormat),
+		"valid_until": tombstone.ValidUntil.Format(RedisDateFormat),
+	})
+	pipe.ExpireAt(key, tombstone.ValidUntil)
+	_, err := pipe.Exec()
+	return wrapBackendError("redis", "AddTombstone", err)
+}
+
+func (s *RedisTombstoneStore) GetTombstone(sessionID string) (*Tombstone, error) {
+	entry, err := s.Client.HGetAll(s.Prefix + sessionID).Result()
+	if err != nil {
+		return nil, wrapBackendError("redis", "GetTombstone", err)
+	}
+	if len(entry) == 0 {
+		return nil, ErrTombstoneNotFound
+	}
+	res := &Tombstone{Reason: RevocationReason(entry["reason"])}
+	if res.Revoked, err = time.Parse(RedisDateFormat, entry["revoked"]); err != nil {
+		return nil, err
+	}
+	if res.ValidUntil, err = time.Parse(RedisDateFormat, entry["valid_until"]); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// DeleteExpiredTombstones does nothing, the tombstones expire automatically.
+func (s *RedisTombstoneStore) DeleteExpiredTombstones() (int64, error) {
+	return 0, nil
+}
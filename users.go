@@ -26,8 +26,12 @@ import (
 	"encoding/hex"
 	"errors"
 	"math"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	scrypt "github.com/elithrar/simple-scrypt"
 
@@ -178,15 +182,83 @@ func (handler *ScryptHandler) PasswordHashLength() int {
 // was not found.
 var ErrUserNotFound = errors.New("User not found.")
 
+// ErrRegistrationPending is returned by Validate together with the id of the
+// user if the password is correct but the user hasn't completed the
+// registration yet, see PendingUserHandler.
+//
+// New in version v0.7
+var ErrRegistrationPending = errors.New("Registration is not completed.")
+
+// ErrUserInactive is returned if the credentials of a user are correct but
+// the user is not active, see ActiveFlagHandler.
+//
+// New in version v0.7
+var ErrUserInactive = errors.New("The user is not active.")
+
 // DefaultUserInformation is used to wrap the the information for
 // a user in the default scheme.
+// Since v0.7 it has json tags, so it can be returned from APIs directly.
+// Use Public to return it to other users and note that String redacts the
+// personal information, so it's safe to log.
 //
 // New in version v0.5
 type BaseUserInformation struct {
-	ID                                   uint64
-	UserName, FirstName, LastName, Email string
-	LastLogin                            time.Time
-	IsActive                             bool
+	ID        uint64    `json:"id"`
+	UserName  string    `json:"username"`
+	FirstName string    `json:"first_name"`
+	LastName  string    `json:"last_name"`
+	Email     string    `json:"email"`
+	LastLogin time.Time `json:"last_login"`
+	IsActive  bool      `json:"is_active"`
+
+	// IsAdmin is true for administrators (superusers).
+	//
+	// New in version v0.7
+	IsAdmin bool `json:"is_admin"`
+
+	// EmailVerified is true if the user confirmed the email address, see
+	// EmailVerifier.
+	//
+	// New in version v0.7
+	EmailVerified bool `json:"email_verified"`
+
+	// IsPending is true if the user was created with only email and password
+	// and has not completed the registration yet, see PendingUserHandler.
+	//
+	// New in version v0.7
+	IsPending bool `json:"is_pending"`
+
+	// DisplayName is the name shown to other users and AvatarURL the url
+	// of the profile picture, both are empty if not set. See
+	// ProfileHandler.
+	//
+	// New in version v0.7
+	DisplayName string `json:"display_name"`
+	AvatarURL   string `json:"avatar_url"`
+
+	// Locale is the preferred locale of the user as BCP 47 language tag
+	// (for example "de-AT") and Timezone the IANA name of the timezone
+	// (for example "Europe/Vienna"), both are empty if not set. See
+	// LocaleHandler.
+	//
+	// New in version v0.7
+	Locale   string `json:"locale"`
+	Timezone string `json:"timezone"`
+}
+
+// Location returns the timezone of the user, time.UTC if the user has no
+// timezone or it can't be loaded.
+//
+// New in version v0.7
+func (info *BaseUserInformation) Location() *time.Location {
+	if info.Timezone == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(info.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
 }
 
 // UserHandler is an interface to deal with the management of
@@ -257,3 +329,316 @@ type UserHandler interface {
 	// New in version v0.5
 	GetUserBaseInfo(userName string) (*BaseUserInformation, error)
 }
+
+// AdminFlagHandler is implemented by UserHandlers that store the admin flag
+// (BaseUserInformation.IsAdmin) of users. New users are never admins.
+// SQLUserHandler and RedisUserHandler implement this interface.
+//
+// New in version v0.7
+type AdminFlagHandler interface {
+	// SetAdmin sets the admin flag of the user.
+	SetAdmin(userName string, admin bool) error
+}
+
+// UserRenamer is implemented by UserHandlers that can change the username of
+// a user, the id of the user doesn't change.
+// SQLUserHandler and RedisUserHandler implement this interface.
+//
+// New in version v0.7
+type UserRenamer interface {
+	// RenameUser changes the username, it returns ErrUserNotFound if the
+	// user doesn't exist and ErrDuplicateUsername if the new name is in
+	// use.
+	RenameUser(oldName, newName string) error
+}
+
+// ActiveFlagHandler is implemented by UserHandlers that can deactivate
+// users (BaseUserInformation.IsActive). Validate doesn't check the flag, but
+// if the UserHandler (or a handler it wraps, like the one of a
+// CachedUserHandler) implements this interface AuthHandlers.Login,
+// BasicAuthMiddleware, OAuthServer (with Users set) and the shadow handler
+// of the ldapauth UserHandler deny logins of inactive users with ErrUserInactive.
+// SQLUserHandler and RedisUserHandler implement this interface.
+//
+// New in version v0.7
+type ActiveFlagHandler interface {
+	// SetActive sets the active flag of the user.
+	SetActive(userName string, active bool) error
+}
+
+// hasActiveFlag returns true if users or a handler wrapped by it implements
+// ActiveFlagHandler.
+func hasActiveFlag(users UserHandler) bool {
+	for users != nil {
+		if _, ok := users.(ActiveFlagHandler); ok {
+			return true
+		}
+		wrapper, ok := users.(interface{ Unwrap() UserHandler })
+		if !ok {
+			return false
+		}
+		users = wrapper.Unwrap()
+	}
+	return false
+}
+
+// CheckActive returns ErrUserInactive if users (or a handler wrapped by it)
+// implements ActiveFlagHandler and the user is not active.
+//
+// New in version v0.7
+func CheckActive(users UserHandler, userName string) error {
+	if !hasActiveFlag(users) {
+		return nil
+	}
+	info, err := users.GetUserBaseInfo(userName)
+	if err != nil {
+		return err
+	}
+	if !info.IsActive {
+		return ErrUserInactive
+	}
+	return nil
+}
+
+// EmailVerifiedHandler is implemented by UserHandlers that store whether the
+// email address of a user is verified (BaseUserInformation.EmailVerified).
+// SQLUserHandler and RedisUserHandler implement this interface.
+//
+// New in version v0.7
+type EmailVerifiedHandler interface {
+	// SetEmailVerified sets the verified flag of the user.
+	SetEmailVerified(userName string, verified bool) error
+
+	// SetEmail sets the email address of the user together with the
+	// verified flag.
+	SetEmail(userName, email string, verified bool) error
+}
+
+// PendingUserHandler is implemented by UserHandlers that can create users in
+// a pending state: Only username, email and password are set and the profile
+// is completed later with CompleteRegistration. Validate returns the id of a
+// pending user together with ErrRegistrationPending (only if the password is
+// correct), so a UI can resume the onboarding.
+// SQLUserHandler and RedisUserHandler implement this interface.
+//
+// New in version v0.7
+type PendingUserHandler interface {
+	// InsertPending inserts a new pending user, it behaves like Insert.
+	InsertPending(userName, email string, plainPW []byte) (uint64, error)
+
+	// CompleteRegistration sets the profile fields of the user and marks
+	// the registration as completed.
+	// Returns ErrUserNotFound if the user doesn't exist.
+	CompleteRegistration(userName, firstName, lastName string) error
+}
+
+// ProfileHandler is implemented by UserHandlers that store the display name
+// and avatar url (BaseUserInformation.DisplayName and AvatarURL) of users.
+// The values are checked with CheckDisplayName and CheckAvatarURL, the empty
+// string removes the value.
+// SQLUserHandler and RedisUserHandler implement this interface.
+//
+// New in version v0.7
+type ProfileHandler interface {
+	// SetDisplayName sets the display name of the user.
+	SetDisplayName(userName, displayName string) error
+
+	// SetAvatarURL sets the avatar url of the user.
+	SetAvatarURL(userName, avatarURL string) error
+}
+
+// ErrInvalidDisplayName is returned by CheckDisplayName.
+//
+// New in version v0.7
+var ErrInvalidDisplayName = errors.New("Invalid display name.")
+
+// ErrInvalidAvatarURL is returned by CheckAvatarURL.
+//
+// New in version v0.7
+var ErrInvalidAvatarURL = errors.New("Invalid avatar url, must be an absolute http or https url.")
+
+const (
+	// MaxDisplayNameLength is the maximal number of characters of a display
+	// name (the length of the display_name column).
+	//
+	// New in version v0.7
+	MaxDisplayNameLength = 150
+
+	// MaxAvatarURLLength is the maximal length of an avatar url in bytes
+	// (the length of the avatar_url column).
+	//
+	// New in version v0.7
+	MaxAvatarURLLength = 2048
+)
+
+// CheckDisplayName returns ErrInvalidDisplayName if the display name is
+// longer than MaxDisplayNameLength characters, is not valid UTF-8 or
+// contains control characters. The empty string is valid.
+//
+// New in version v0.7
+func CheckDisplayName(displayName string) error {
+	if !utf8.ValidString(displayName) || utf8.RuneCountInString(displayName) > MaxDisplayNameLength {
+		return ErrInvalidDisplayName
+	}
+	for _, r := range displayName {
+		if unicode.IsControl(r) {
+			return ErrInvalidDisplayName
+		}
+	}
+	return nil
+}
+
+// CheckAvatarURL returns ErrInvalidAvatarURL if the url is not an absolute
+// http or https url or longer than MaxAvatarURLLength. Other schemes (for
+// example javascript:) are rejected because the url is usually rendered in
+// an img tag. The empty string is valid.
+//
+// New in version v0.7
+func CheckAvatarURL(avatarURL string) error {
+	if avatarURL == "" {
+		return nil
+	}
+	if len(avatarURL) > MaxAvatarURLLength {
+		return ErrInvalidAvatarURL
+	}
+	u, err := url.Parse(avatarURL)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return ErrInvalidAvatarURL
+	}
+	return nil
+}
+
+// LocaleHandler is implemented by UserHandlers that store the locale and
+// timezone (BaseUserInformation.Locale and Timezone) of users.
+// SetLocale normalizes the locale with NormalizeLocale, SetTimezone checks
+// the timezone with CheckTimezone. The empty string removes the value.
+// SQLUserHandler and RedisUserHandler implement this interface.
+//
+// New in version v0.7
+type LocaleHandler interface {
+	// SetLocale sets the locale of the user.
+	SetLocale(userName, locale string) error
+
+	// SetTimezone sets the timezone of the user.
+	SetTimezone(userName, timezone string) error
+}
+
+// ErrInvalidLocale is returned by NormalizeLocale and CheckLocale.
+//
+// New in version v0.7
+var ErrInvalidLocale = errors.New("Invalid locale, must be a language tag like en-US.")
+
+// ErrInvalidTimezone is returned by CheckTimezone.
+//
+// New in version v0.7
+var ErrInvalidTimezone = errors.New("Invalid timezone, must be an IANA timezone like Europe/Berlin.")
+
+// NormalizeLocale checks the syntax of a BCP 47 language tag and returns it
+// in the canonical case: The language in lower case, a script in title case
+// and a region in upper case (for example "zh-Hant-TW"). Underscores are
+// accepted as separator ("en_US" becomes "en-US"). The empty string is
+// returned unchanged.
+// It returns ErrInvalidLocale if the syntax is invalid, it doesn't check if
+// the language exists.
+//
+// New in version v0.7
+func NormalizeLocale(locale string) (string, error) {
+	if locale == "" {
+		return "", nil
+	}
+	if len(locale) > 35 {
+		return "", ErrInvalidLocale
+	}
+	parts := strings.Split(strings.Replace(locale, "_", "-", -1), "-")
+	for i, part := range parts {
+		if len(part) == 0 || len(part) > 8 {
+			return "", ErrInvalidLocale
+		}
+		for _, c := range part {
+			if !('a' <= c && c <= 'z') && !('A' <= c && c <= 'Z') && !('0' <= c && c <= '9') {
+				return "", ErrInvalidLocale
+			}
+		}
+		switch {
+		case i == 0:
+			// the language must be 2 to 8 letters
+			if len(part) < 2 || strings.IndexFunc(part, unicode.IsDigit) >= 0 {
+				return "", ErrInvalidLocale
+			}
+			parts[i] = strings.ToLower(part)
+		case len(part) == 4 && strings.IndexFunc(part, unicode.IsDigit) < 0:
+			parts[i] = strings.ToUpper(part[:1]) + strings.ToLower(part[1:])
+		case len(part) == 2:
+			parts[i] = strings.ToUpper(part)
+		default:
+			parts[i] = strings.ToLower(part)
+		}
+	}
+	return strings.Join(parts, "-"), nil
+}
+
+// CheckLocale returns ErrInvalidLocale if the locale is not a normalized
+// language tag, see NormalizeLocale.
+//
+// New in version v0.7
+func CheckLocale(locale string) error {
+	normalized, err := NormalizeLocale(locale)
+	if err != nil {
+		return err
+	}
+	if normalized != locale {
+		return ErrInvalidLocale
+	}
+	return nil
+}
+
+// CheckTimezone returns ErrInvalidTimezone if the timezone is not a name in
+// the IANA timezone database (time.LoadLocation). "Local" is rejected since
+// it depends on the server. The empty string is valid.
+//
+// New in version v0.7
+func CheckTimezone(timezone string) error {
+	if timezone == "" {
+		return nil
+	}
+	if timezone == "Local" || len(timezone) > 64 {
+		return ErrInvalidTimezone
+	}
+	if _, err := time.LoadLocation(timezone); err != nil {
+		return ErrInvalidTimezone
+	}
+	return nil
+}
+
+// IsAdminUser reports whether the user with the given id is an
+// administrator.
+//
+// New in version v0.7
+func IsAdminUser(users UserHandler, id uint64) (bool, error) {
+	userName, err := users.GetUserName(id)
+	if err != nil {
+		return false, err
+	}
+	info, err := users.GetUserBaseInfo(userName)
+	if err != nil {
+		return false, err
+	}
+	return info.IsAdmin, nil
+}
+
+// PasswordStatusHandler is implemented by UserHandlers that can store users
+// without a password they can log in with, for example users that only log
+// in via an external identity provider.
+// Validate must always fail (return NoUserID and no error) for such users.
+// SQLUserHandler and RedisUserHandler implement this interface.
+//
+// New in version v0.7
+type PasswordStatusHandler interface {
+	// HasPassword reports whether the user has a password.
+	// Returns ErrUserNotFound if the user doesn't exist.
+	HasPassword(userName string) (bool, error)
+
+	// ClearPassword removes the password of the user.
+	// Use UpdatePassword to set a new password.
+	ClearPassword(userName string) error
+}
@@ -0,0 +1,271 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// EmailVerificationPurpose is the purpose of email verification tokens in a
+// OneTimeTokenStore.
+const EmailVerificationPurpose = "email_verification"
+
+// ErrEmailAlreadyVerified is returned if a verification token is requested
+// for a user whose email address is already verified.
+var ErrEmailAlreadyVerified = errors.New("Email address is already verified.")
+
+// ErrNoEmail is returned if a verification token is requested for a user
+// without an email address.
+var ErrNoEmail = errors.New("User has no email address.")
+
+// EmailVerifier implements the verification of email addresses:
+// SendVerification creates a token and passes it to Deliver, ConfirmEmail
+// redeems the token and marks the address as verified.
+// The token is bound to the address it was sent to, so it becomes invalid if
+// the address changes in the meantime.
+//
+// The users must implement EmailVerifiedHandler. To block logins until the
+// address is verified use UnverifiedEmailPolicy, to restrict the sessions of
+// unverified users to some scopes set AuthHandlers.UnverifiedScopes.
+//
+// New in version v0.7
+type EmailVerifier struct {
+	Users  UserHandler
+	Tokens OneTimeTokenStore
+
+	// TTL is the time a token is valid, defaults to 24 hours.
+	TTL time.Duration
+
+	// Limiter throttles sending tokens, the key is the username.
+	// NewEmailVerifier sets it to three tokens per hour, may be nil.
+	Limiter RateLimiter
+
+	// Deliver sends the token to the user (to info.Email), for example
+	// AuthMailer.SendVerification.
+	Deliver func(info *BaseUserInformation, token string) error
+
+	// Render and RenderError write the responses of the handlers, they
+	// default to RenderJSON and RenderJSONError.
+	Render      func(w http.ResponseWriter, r *http.Request, status int, value interface{})
+	RenderError func(w http.ResponseWriter, r *http.Request, status int, err error)
+}
+
+// NewEmailVerifier returns a new EmailVerifier that renders JSON.
+func NewEmailVerifier(users UserHandler, tokens OneTimeTokenStore) *EmailVerifier {
+	return &EmailVerifier{Users: users, Tokens: tokens, TTL: 24 * time.Hour,
+		Limiter: NewInMemoryRateLimiter(3, time.Hour), Render: RenderJSON,
+		RenderError: RenderJSONError}
+}
+
+// CreateVerificationToken creates a new token for the current email address
+// of the user, older tokens of the user are invalidated.
+// It returns a *RateLimitError if too many tokens were requested,
+// ErrEmailAlreadyVerified if the address is already verified and
+// ErrUserNotFound if the user doesn't exist.
+func (v *EmailVerifier) CreateVerificationToken(userName string) (string, error) {
+	_, token, err := v.createToken(userName)
+	return token, err
+}
+
+func (v *EmailVerifier) createToken(userName string) (*BaseUserInformation, string, error) {
+	// the limit is checked first, so it doesn't tell if the user exists
+	if v.Limiter != nil {
+		allowed, retry, err := v.Limiter.Allow("verify:" + userName)
+		if err != nil {
+			return nil, "", err
+		}
+		if !allowed {
+			return nil, "", &RateLimitError{RetryAfter: retry}
+		}
+	}
+	info, err := v.Users.GetUserBaseInfo(userName)
+	if err != nil {
+		return nil, "", err
+	}
+	if info.EmailVerified {
+		return nil, "", ErrEmailAlreadyVerified
+	}
+	if info.Email == "" {
+		return nil, "", ErrNoEmail
+	}
+	subject := userSubject(info.ID)
+	if _, err := v.Tokens.DeleteTokens(EmailVerificationPurpose, subject); err != nil {
+		return nil, "", err
+	}
+	// only the hash of the address is stored with the token
+	token, err := IssueOneTimeToken(v.Tokens, EmailVerificationPurpose, subject, HashToken(info.Email), v.TTL)
+	if err != nil {
+		return nil, "", err
+	}
+	info.UserName = userName
+	return info, token, nil
+}
+
+// SendVerification creates a token (see CreateVerificationToken) and passes
+// it to Deliver.
+func (v *EmailVerifier) SendVerification(userName string) error {
+	info, token, err := v.createToken(userName)
+	if err != nil {
+		return err
+	}
+	if v.Deliver == nil {
+		return errors.New("No delivery function for email verification tokens set.")
+	}
+	return v.Deliver(info, token)
+}
+
+// ConfirmEmail redeems the token and marks the email address of the user as
+// verified. It returns the id and name of the user.
+// Returns ErrTokenNotFound if the token is invalid, was already used or the
+// address changed since the token was created.
+func (v *EmailVerifier) ConfirmEmail(token string) (uint64, string, error) {
+	flags, ok := v.Users.(EmailVerifiedHandler)
+	if !ok {
+		return NoUserID, "", ErrNotSupported
+	}
+	entry, err := ConsumeOneTimeToken(v.Tokens, EmailVerificationPurpose, token)
+	if err != nil {
+		return NoUserID, "", err
+	}
+	id, err := subjectUserID(entry.Subject)
+	if err != nil {
+		return NoUserID, "", ErrTokenNotFound
+	}
+	userName, err := v.Users.GetUserName(id)
+	if err != nil {
+		return NoUserID, "", err
+	}
+	info, err := v.Users.GetUserBaseInfo(userName)
+	if err != nil {
+		return NoUserID, "", err
+	}
+	if HashToken(info.Email) != entry.Data {
+		return NoUserID, "", ErrTokenNotFound
+	}
+	if err := flags.SetEmailVerified(userName, true); err != nil {
+		return NoUserID, "", err
+	}
+	return id, userName, nil
+}
+
+// ServeSendVerification sends a new token to the user. The username is
+// taken from the session if the request is authenticated (see
+// SessionMiddleware) and from the request body otherwise.
+// The response is 202 Accepted if the user doesn't exist or is already
+// verified, so the handler can't be used to find out which users exist.
+// If too many tokens were requested the response is 429.
+func (v *EmailVerifier) ServeSendVerification(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r, v.RenderError) {
+		return
+	}
+	var userName string
+	if id, ok := UserIDFromContext(r.Context()); ok {
+		var err error
+		if userName, err = v.Users.GetUserName(id); err != nil {
+			v.RenderError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+	} else {
+		req, err := ParseAuthRequest(r)
+		if err != nil {
+			v.RenderError(w, r, http.StatusBadRequest, err)
+			return
+		}
+		userName = req.UserName
+	}
+	if userName == "" {
+		v.RenderError(w, r, http.StatusBadRequest, errors.New("Username is required."))
+		return
+	}
+	err := v.SendVerification(userName)
+	if rateErr, ok := err.(*RateLimitError); ok {
+		SetRetryAfter(w, rateErr.RetryAfter)
+		v.RenderError(w, r, http.StatusTooManyRequests, rateErr)
+		return
+	}
+	if err != nil && err != ErrUserNotFound && err != ErrEmailAlreadyVerified {
+		log.WithError(err).WithField("user", userName).Error("goauth: Can't send email verification token")
+	}
+	v.Render(w, r, http.StatusAccepted, &AuthResponse{Status: "accepted"})
+}
+
+// ServeConfirmEmail redeems the token, it's either the query parameter
+// "token" (so it can be used in a link) or the field "token" of a POST
+// request. An invalid token results in 400 Bad Request.
+func (v *EmailVerifier) ServeConfirmEmail(w http.ResponseWriter, r *http.Request) {
+	token, ok := requestToken(w, r, v.RenderError)
+	if !ok {
+		return
+	}
+	id, userName, err := v.ConfirmEmail(token)
+	switch {
+	case err == ErrTokenNotFound || err == ErrUserNotFound:
+		v.RenderError(w, r, http.StatusBadRequest, ErrTokenNotFound)
+		return
+	case err == ErrNotSupported:
+		v.RenderError(w, r, http.StatusNotImplemented, err)
+		return
+	case err != nil:
+		v.RenderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	v.Render(w, r, http.StatusOK, &AuthResponse{Status: "ok", UserID: id,
+		UserName: userName})
+}
+
+// requestToken returns the query parameter "token" or the field "token" of
+// a POST request, it returns false if there is no token (and wrote a
+// response).
+func requestToken(w http.ResponseWriter, r *http.Request, renderError func(w http.ResponseWriter, r *http.Request, status int, err error)) (string, bool) {
+	token := r.URL.Query().Get("token")
+	if r.Method == http.MethodPost {
+		req, err := parseTokenRequest(r)
+		if err != nil {
+			renderError(w, r, http.StatusBadRequest, err)
+			return "", false
+		}
+		token = req.Token
+	}
+	if token == "" {
+		renderError(w, r, http.StatusBadRequest, errors.New("Token is required."))
+		return "", false
+	}
+	return token, true
+}
+
+// UnverifiedEmailPolicy returns a LoginPolicy that returns decision for
+// users whose email address is not verified, usually LoginDeny.
+//
+// New in version v0.7
+func UnverifiedEmailPolicy(decision LoginDecision) LoginPolicy {
+	return LoginPolicyFunc(func(attempt *LoginAttempt) (LoginDecision, error) {
+		if attempt.User.EmailVerified {
+			return LoginAllow, nil
+		}
+		return decision, nil
+	})
+}
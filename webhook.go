@@ -0,0 +1,218 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Types of security events.
+const (
+	EventNewDeviceLogin    = "login.new_device"
+	EventPasswordChanged   = "password.changed"
+	EventAccountLocked     = "account.locked"
+	EventEmailChanged      = "email.changed"
+	EventEmailRestored     = "email.restored"
+	EventDeletionScheduled = "account.deletion_scheduled"
+	EventAccountDeleted    = "account.deleted"
+	EventAccountRecovered  = "account.recovered"
+	EventLoginSucceeded    = "login.succeeded"
+	EventLoginFailed       = "login.failed"
+	EventSessionRevoked    = "session.revoked"
+	EventLoginAnomaly      = "login.anomaly"
+	EventConcurrentLogin   = "login.concurrent"
+)
+
+// SecurityEvent is a security relevant event, for example a login from a new
+// device.
+//
+// New in version v0.7
+type SecurityEvent struct {
+	Type     string            `json:"type"`
+	UserID   uint64            `json:"user_id"`
+	UserName string            `json:"username,omitempty"`
+	IP       string            `json:"ip,omitempty"`
+	Time     time.Time         `json:"time"`
+	Data     map[string]string `json:"data,omitempty"`
+}
+
+// NewSecurityEvent returns a new event with the current time.
+func NewSecurityEvent(eventType string, userID uint64, userName string) *SecurityEvent {
+	return &SecurityEvent{Type: eventType, UserID: userID, UserName: userName,
+		Time: CurrentTime()}
+}
+
+// SecurityNotifier gets notified about security events.
+// Notify must not block.
+//
+// New in version v0.7
+type SecurityNotifier interface {
+	Notify(event *SecurityEvent)
+}
+
+// WebhookDispatcher posts security events as JSON to a URL so other systems
+// can alert the user.
+//
+// Each request is signed: the header X-Goauth-Timestamp contains the unix
+// time and X-Goauth-Signature contains "sha256=" followed by the hex encoded
+// HMAC-SHA256 of "<timestamp>.<body>" with Secret as key. Receivers can use
+// VerifyWebhookSignature.
+//
+// Failed requests (network errors, 429 and 5xx responses) are retried with
+// exponential backoff.
+//
+// Call Start before using Notify, Send can be used without it.
+//
+// New in version v0.7
+type WebhookDispatcher struct {
+	URL, Secret string
+
+	Client *http.Client
+
+	// MaxRetries is the number of retries after the first attempt,
+	// defaults to 5. InitialBackoff is the delay before the first retry,
+	// it's doubled for each retry, defaults to one second.
+	MaxRetries     int
+	InitialBackoff time.Duration
+
+	queue chan *SecurityEvent
+}
+
+// NewWebhookDispatcher returns a new WebhookDispatcher.
+func NewWebhookDispatcher(url, secret string) *WebhookDispatcher {
+	return &WebhookDispatcher{URL: url, Secret: secret,
+		Client:     &http.Client{Timeout: 10 * time.Second},
+		MaxRetries: 5, InitialBackoff: time.Second}
+}
+
+// SignWebhook returns the signature for the timestamp and body.
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhookSignature checks the signature of a webhook request and that
+// the timestamp is not older than maxAge.
+func VerifyWebhookSignature(secret, timestamp, signature string, body []byte, maxAge time.Duration) bool {
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	age := CurrentTime().Sub(time.Unix(unix, 0))
+	if age > maxAge || age < -maxAge {
+		return false
+	}
+	return hmac.Equal([]byte(SignWebhook(secret, timestamp, body)), []byte(signature))
+}
+
+// post sends the body once, it returns true if the request should be
+// retried.
+func (d *WebhookDispatcher) post(body []byte) (bool, error) {
+	timestamp := strconv.FormatInt(CurrentTime().Unix(), 10)
+	req, err := http.NewRequest(http.MethodPost, d.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Goauth-Timestamp", timestamp)
+	req.Header.Set("X-Goauth-Signature", SignWebhook(d.Secret, timestamp, body))
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	err = fmt.Errorf("Webhook returned status %d", resp.StatusCode)
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500, err
+}
+
+// Send posts the event and retries on failure, it blocks until the event is
+// delivered, the retries are exhausted or ctx is done.
+func (d *WebhookDispatcher) Send(ctx context.Context, event *SecurityEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return d.deliver(ctx, body)
+}
+
+// deliver posts body and retries on failure.
+func (d *WebhookDispatcher) deliver(ctx context.Context, body []byte) error {
+	backoff := d.InitialBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := d.post(body)
+		if err == nil || !retry || attempt >= d.MaxRetries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// Start starts a goroutine that sends the events passed to Notify until ctx
+// is done. queueSize is the number of events that can wait for delivery.
+func (d *WebhookDispatcher) Start(ctx context.Context, queueSize int) {
+	d.queue = make(chan *SecurityEvent, queueSize)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event := <-d.queue:
+				if err := d.Send(ctx, event); err != nil {
+					log.WithError(err).WithField("event", event.Type).Error("goauth: Can't deliver webhook")
+				}
+			}
+		}
+	}()
+}
+
+// Notify queues the event for delivery, if the queue is full the event is
+// dropped (and logged).
+func (d *WebhookDispatcher) Notify(event *SecurityEvent) {
+	select {
+	case d.queue <- event:
+	default:
+		log.WithField("event", event.Type).Warn("goauth: Webhook queue full, dropping event")
+	}
+}
@@ -0,0 +1,327 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package goauth
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrTicketNotFound is returned by WebSocketTickets if a ticket doesn't
+// exist, was already used or expired.
+var ErrTicketNotFound = errors.New("WebSocket ticket not found.")
+
+// ErrOriginNotAllowed is returned by WebSocketAuthenticator if the Origin of
+// the upgrade request is not allowed.
+var ErrOriginNotAllowed = errors.New("Origin not allowed.")
+
+type webSocketTicket struct {
+	key        string
+	data       *SessionKeyData
+	validUntil time.Time
+}
+
+// WebSocketTickets issues short lived, single use tickets for WebSocket
+// connections. Browsers can't set headers on WebSocket requests, so instead
+// of the session key a client can fetch a ticket (with a normal
+// authenticated request) and pass it as query parameter when connecting.
+// Tickets are kept in memory.
+//
+// New in version v0.7
+type WebSocketTickets struct {
+	// Duration is the duration a ticket is valid, defaults to 30 seconds.
+	Duration time.Duration
+
+	tickets map[string]webSocketTicket
+	mutex   sync.Mutex
+}
+
+// NewWebSocketTickets returns a new WebSocketTickets.
+func NewWebSocketTickets() *WebSocketTickets {
+	return &WebSocketTickets{Duration: 30 * time.Second,
+		tickets: make(map[string]webSocketTicket)}
+}
+
+// Issue returns a new ticket for the session.
+func (t *WebSocketTickets) Issue(key string, data *SessionKeyData) (string, error) {
+	ticket, err := GenRandomBase64(-1)
+	if err != nil {
+		return "", err
+	}
+	now := CurrentTime()
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for ticket, entry := range t.tickets {
+		if KeyInvalid(now, entry.validUntil) {
+			delete(t.tickets, ticket)
+		}
+	}
+	t.tickets[ticket] = webSocketTicket{key: key, data: data,
+		validUntil: now.Add(t.Duration)}
+	return ticket, nil
+}
+
+// Redeem returns the session for the ticket and removes the ticket.
+// It returns ErrTicketNotFound if the ticket is not valid.
+func (t *WebSocketTickets) Redeem(ticket string) (string, *SessionKeyData, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	entry, has := t.tickets[ticket]
+	if !has {
+		return "", nil, ErrTicketNotFound
+	}
+	delete(t.tickets, ticket)
+	if KeyInvalid(CurrentTime(), entry.validUntil) {
+		return "", nil, ErrTicketNotFound
+	}
+	return entry.key, entry.data, nil
+}
+
+// ServeTicket is a http.HandlerFunc that issues a ticket for the session in
+// the request context and returns it as JSON {"ticket": "..."}. Wrap it
+// with SessionMiddleware.RequireSession.
+func (t *WebSocketTickets) ServeTicket(w http.ResponseWriter, r *http.Request) {
+	data := SessionDataFromContext(r.Context())
+	if data == nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	ticket, err := t.Issue(SessionKeyFromContext(r.Context()), data)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	RenderJSON(w, r, http.StatusOK, map[string]string{"ticket": ticket})
+}
+
+// WebSocketAuthenticator authenticates WebSocket upgrade requests, call
+// Authenticate before upgrading the connection (with the WebSocket library
+// of your choice).
+//
+// New in version v0.7
+type WebSocketAuthenticator struct {
+	// Sessions validates the session cookie (or bearer token).
+	Sessions *SessionMiddleware
+
+	// Tickets is used if the request contains the query parameter
+	// TicketParam (defaults to "ticket"), may be nil.
+	Tickets     *WebSocketTickets
+	TicketParam string
+
+	// AllowedOrigins are the allowed values of the Origin header (for
+	// example "https://example.com"). Browsers send cookies with WebSocket
+	// requests from every site, so if you use cookies you should always set
+	// this. If it is empty the origin must have the same host as the
+	// request.
+	AllowedOrigins []string
+}
+
+// NewWebSocketAuthenticator returns a new WebSocketAuthenticator, tickets
+// may be nil.
+func NewWebSocketAuthenticator(sessions *SessionMiddleware, tickets *WebSocketTickets) *WebSocketAuthenticator {
+	return &WebSocketAuthenticator{Sessions: sessions, Tickets: tickets,
+		TicketParam: "ticket"}
+}
+
+// CheckOrigin returns true if the Origin header of the request is allowed,
+// requests without an Origin header (from non-browser clients) are allowed.
+// It can be used as CheckOrigin function of gorilla/websocket.
+func (a *WebSocketAuthenticator) CheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if len(a.AllowedOrigins) == 0 {
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+	for _, allowed := range a.AllowedOrigins {
+		if strings.EqualFold(origin, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticate validates the upgrade request and returns the session key and
+// data. It returns ErrOriginNotAllowed if CheckOrigin fails, errors of
+// SessionMiddleware.Authenticate or ErrTicketNotFound otherwise.
+func (a *WebSocketAuthenticator) Authenticate(w http.ResponseWriter, r *http.Request) (string, *SessionKeyData, error) {
+	if !a.CheckOrigin(r) {
+		return "", nil, ErrOriginNotAllowed
+	}
+	if a.Tickets != nil {
+		if ticket := r.URL.Query().Get(a.TicketParam); ticket != "" {
+			key, data, err := a.Tickets.Redeem(ticket)
+			if err != nil {
+				return "", nil, err
+			}
+			// the session could have ended since the ticket was issued
+			if _, err := a.Sessions.Controller.GetData(key); err != nil {
+				return "", nil, err
+			}
+			return key, data, nil
+		}
+	}
+	return a.Sessions.Authenticate(w, r)
+}
+
+type webSocketSession struct {
+	user  UserKeyType
+	conns map[io.Closer]struct{}
+}
+
+// WebSocketRegistry keeps track of the open WebSocket connections of each
+// session, so they can be closed once the session ends.
+// Register each connection after the upgrade and call the returned function
+// when the connection is closed. CloseSession and CloseUser close
+// connections immediately (call them when you end sessions), Watch checks
+// regularly whether the sessions are still valid.
+//
+// New in version v0.7
+type WebSocketRegistry struct {
+	Controller *SessionController
+
+	sessions map[string]*webSocketSession
+	mutex    sync.Mutex
+}
+
+// NewWebSocketRegistry returns a new WebSocketRegistry.
+func NewWebSocketRegistry(controller *SessionController) *WebSocketRegistry {
+	return &WebSocketRegistry{Controller: controller,
+		sessions: make(map[string]*webSocketSession)}
+}
+
+// Register adds a connection of the session, the returned function removes
+// it again (without closing it).
+func (reg *WebSocketRegistry) Register(key string, data *SessionKeyData, conn io.Closer) func() {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+	session, has := reg.sessions[key]
+	if !has {
+		session = &webSocketSession{user: data.User, conns: make(map[io.Closer]struct{})}
+		reg.sessions[key] = session
+	}
+	session.conns[conn] = struct{}{}
+	return func() {
+		reg.mutex.Lock()
+		defer reg.mutex.Unlock()
+		if session, has := reg.sessions[key]; has {
+			delete(session.conns, conn)
+			if len(session.conns) == 0 {
+				delete(reg.sessions, key)
+			}
+		}
+	}
+}
+
+// closeKeys closes all connections of the given sessions and returns the
+// number of closed connections.
+func (reg *WebSocketRegistry) closeKeys(keys []string) int {
+	var conns []io.Closer
+	reg.mutex.Lock()
+	for _, key := range keys {
+		if session, has := reg.sessions[key]; has {
+			for conn := range session.conns {
+				conns = append(conns, conn)
+			}
+			delete(reg.sessions, key)
+		}
+	}
+	reg.mutex.Unlock()
+	// close without holding the lock, Close may take some time
+	for _, conn := range conns {
+		conn.Close()
+	}
+	return len(conns)
+}
+
+// CloseSession closes all connections of the session.
+func (reg *WebSocketRegistry) CloseSession(key string) int {
+	return reg.closeKeys([]string{key})
+}
+
+// CloseUser closes all connections of the user.
+func (reg *WebSocketRegistry) CloseUser(user UserKeyType) int {
+	var keys []string
+	reg.mutex.Lock()
+	for key, session := range reg.sessions {
+		if sameUser(session.user, user) {
+			keys = append(keys, key)
+		}
+	}
+	reg.mutex.Unlock()
+	return reg.closeKeys(keys)
+}
+
+// Check looks up all sessions with open connections and closes the
+// connections of sessions that are no longer valid.
+func (reg *WebSocketRegistry) Check() (int, error) {
+	reg.mutex.Lock()
+	keys := make([]string, 0, len(reg.sessions))
+	for key := range reg.sessions {
+		keys = append(keys, key)
+	}
+	reg.mutex.Unlock()
+	now := CurrentTime()
+	var invalid []string
+	for _, key := range keys {
+		data, err := reg.Controller.GetData(key)
+		switch {
+		case isKeyNotFound(err):
+			invalid = append(invalid, key)
+		case err != nil:
+			return reg.closeKeys(invalid), err
+		case KeyInvalid(now, data.ValidUntil):
+			invalid = append(invalid, key)
+		}
+	}
+	return reg.closeKeys(invalid), nil
+}
+
+// Watch starts a goroutine that calls Check every interval until ctx is
+// done.
+func (reg *WebSocketRegistry) Watch(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if _, err := reg.Check(); err != nil {
+					log.WithError(err).Error("goauth: Error checking WebSocket sessions.")
+				}
+			}
+		}
+	}()
+}